@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"context"
+	"sync"
+
+	"dnsres/dnsanalysis"
+	"dnsres/metrics"
+)
+
+// GetOrLock retrieves a value like Get. On a miss it also takes the key's
+// refresh lock and returns the func that releases it: the caller queries
+// upstream, Sets the entry and then releases. A caller that misses while
+// another holds the refresh lock waits for the release and looks again, so
+// an expired entry is re-queried once instead of by every caller that wants
+// it. If the holder releases without setting the entry, the waiters miss
+// and query for themselves, all at once, rather than one after another.
+//
+// Waiting ends early when ctx is done, returning a miss. The returned func
+// is never nil and may be called more than once.
+func (c *ShardedCache) GetOrLock(ctx context.Context, key string) (*dnsanalysis.DNSResponse, func(), bool) {
+	shard := c.getShard(key)
+	shard.rlock()
+	response, live := shard.lookup(key)
+	shard.mu.RUnlock()
+	if live {
+		c.recordHit()
+		return response, func() {}, true
+	}
+
+	shard.lock()
+	response, live = shard.lookup(key)
+	if live {
+		shard.mu.Unlock()
+		c.recordHit()
+		return response, func() {}, true
+	}
+	refreshed, waiting := shard.refreshing[key]
+	if !waiting {
+		done := make(chan struct{})
+		shard.refreshing[key] = done
+		shard.mu.Unlock()
+		c.recordMiss()
+		return nil, sync.OnceFunc(func() { shard.endRefresh(key, done) }), false
+	}
+	shard.mu.Unlock()
+
+	metrics.CacheRefreshWaits.Inc()
+	select {
+	case <-refreshed:
+	case <-ctx.Done():
+		c.recordMiss()
+		return nil, func() {}, false
+	}
+	response, live = c.Get(key)
+	return response, func() {}, live
+}
+
+// lookup returns the live entry for key. The caller holds the shard's lock.
+func (s *CacheShard) lookup(key string) (*dnsanalysis.DNSResponse, bool) {
+	entry, ok := s.entries[key]
+	if !ok || monotonicNow() >= entry.Expires {
+		return nil, false
+	}
+	return entry.Response, true
+}
+
+// endRefresh releases key's refresh lock, waking the callers waiting on it.
+func (s *CacheShard) endRefresh(key string, done chan struct{}) {
+	s.lock()
+	if s.refreshing[key] == done {
+		delete(s.refreshing, key)
+	}
+	s.mu.Unlock()
+	close(done)
+}
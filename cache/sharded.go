@@ -1,211 +1,460 @@
 package cache
 
 import (
+	"context"
+	"math/bits"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"dnsres/dnsanalysis"
 	"dnsres/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// Limits bound a cache's contents. Each limit is split evenly across shards
+// and a zero limit is not enforced.
+type Limits struct {
+	// MaxEntries caps the number of entries.
+	MaxEntries int
+	// MaxBytes caps the estimated size of the cached responses.
+	MaxBytes int64
+}
+
 // ShardedCache implements a sharded cache for DNS responses
 type ShardedCache struct {
 	shards    []*CacheShard
 	numShards int
-	maxSize   int64
+	// shardMask selects a shard from a key hash; numShards is a power of two.
+	shardMask uint64
+	limits    Limits
+	// shardLimits is limits divided across the shards, rounded up.
+	shardLimits Limits
+
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	evictions   atomic.Uint64
+	expirations atomic.Uint64
 }
 
 // CacheShard represents a single shard in the cache
 type CacheShard struct {
 	entries map[string]*CacheEntry
 	size    int64
-	mu      sync.RWMutex
+	// refreshing holds a channel per key being re-queried under
+	// GetOrLock, closed when the refresh ends.
+	refreshing map[string]chan struct{}
+	mu         sync.RWMutex
+	// contended counts lock acquisitions that found the lock held, an
+	// estimate of contention that costs nothing when there is none.
+	contended atomic.Uint64
+
+	contention   prometheus.Counter
+	entriesGauge prometheus.Gauge
+	bytesGauge   prometheus.Gauge
+}
+
+// Stats describes a cache. Counters cover the cache's lifetime.
+type Stats struct {
+	Entries     int    `json:"entries"`
+	Bytes       int64  `json:"bytes"`
+	MaxEntries  int    `json:"max_entries"`
+	MaxBytes    int64  `json:"max_bytes"`
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Evictions   uint64 `json:"evictions"`
+	Expirations uint64 `json:"expirations"`
+	// HitRatio is hits over lookups, or 0 before the first lookup.
+	HitRatio float64      `json:"hit_ratio"`
+	Shards   []ShardStats `json:"shards"`
+}
+
+// ShardStats describes one cache shard.
+type ShardStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	// Contended counts lock acquisitions that had to wait.
+	Contended uint64 `json:"contended"`
 }
 
 // CacheEntry represents a cached DNS response
 type CacheEntry struct {
 	Response *dnsanalysis.DNSResponse
-	Expires  time.Time
-	Size     int64
+	// Expires is when the entry expires on the cache's monotonic clock.
+	Expires time.Duration
+	Size    int64
+}
+
+// epoch anchors the monotonic clock that entry expiry is measured on, so
+// wall-clock steps such as NTP corrections neither expire the whole cache nor
+// keep stale entries alive.
+var epoch = time.Now()
+
+// monotonicNow returns the time elapsed since epoch. Tests replace it to
+// move the clock.
+var monotonicNow = func() time.Duration {
+	return time.Since(epoch)
 }
 
-// NewShardedCache creates a new sharded cache
+// NewShardedCache creates a sharded cache holding at most maxSize bytes of
+// estimated response size. numShards is rounded up to a power of two.
 func NewShardedCache(maxSize int64, numShards int) *ShardedCache {
+	return New(Limits{MaxBytes: maxSize}, numShards)
+}
+
+// New creates a sharded cache bounded by limits. numShards is rounded up to
+// a power of two.
+func New(limits Limits, numShards int) *ShardedCache {
 	if numShards <= 0 {
 		numShards = 16 // Default number of shards
 	}
+	numShards = 1 << bits.Len(uint(numShards-1))
 
 	cache := &ShardedCache{
 		shards:    make([]*CacheShard, numShards),
 		numShards: numShards,
-		maxSize:   maxSize,
+		shardMask: uint64(numShards - 1),
+		limits:    limits,
+		shardLimits: Limits{
+			MaxEntries: (limits.MaxEntries + numShards - 1) / numShards,
+			MaxBytes:   (limits.MaxBytes + int64(numShards) - 1) / int64(numShards),
+		},
 	}
 
 	for i := range cache.shards {
+		label := strconv.Itoa(i)
 		cache.shards[i] = &CacheShard{
-			entries: make(map[string]*CacheEntry),
+			entries:      make(map[string]*CacheEntry),
+			refreshing:   make(map[string]chan struct{}),
+			contention:   metrics.CacheLockContention.WithLabelValues(label),
+			entriesGauge: metrics.CacheShardEntries.WithLabelValues(label),
+			bytesGauge:   metrics.CacheShardBytes.WithLabelValues(label),
 		}
 	}
 
 	return cache
 }
 
-// Get retrieves a value from the cache
+// Get retrieves a value from the cache. Expiry is lazy: Get takes only the
+// shard's read lock and reports an expired entry as a miss, leaving its
+// removal to Set, eviction or Cleanup.
 func (c *ShardedCache) Get(key string) (*dnsanalysis.DNSResponse, bool) {
 	shard := c.getShard(key)
-	shard.mu.RLock()
-
-	entry, ok := shard.entries[key]
-	if !ok {
-		shard.mu.RUnlock()
-		metrics.CacheMisses.Inc()
-		return nil, false
-	}
-
-	if time.Now().After(entry.Expires) {
-		shard.mu.RUnlock()
-
-		shard.mu.Lock()
-		// Double check under write lock
-		if entry, ok := shard.entries[key]; ok && time.Now().After(entry.Expires) {
-			delete(shard.entries, key)
-			shard.size -= entry.Size
-			metrics.CacheMisses.Inc()
-		}
-		shard.mu.Unlock()
+	shard.rlock()
+	response, live := shard.lookup(key)
+	shard.mu.RUnlock()
 
+	if !live {
+		c.recordMiss()
 		return nil, false
 	}
-
-	metrics.CacheHits.Inc()
-	shard.mu.RUnlock()
-	return entry.Response, true
+	c.recordHit()
+	return response, true
 }
 
-// Set stores a value in the cache
+// Set stores a value in the cache, first evicting the entries closest to
+// expiry until it fits within the shard's limits.
 func (c *ShardedCache) Set(key string, response *dnsanalysis.DNSResponse, ttl time.Duration) {
 	shard := c.getShard(key)
-	shard.mu.Lock()
+	shard.lock()
 
 	// Calculate entry size
 	size := estimateSize(response)
 
-	// Check if we need to evict entries
-	if shard.size+size > c.maxSize/int64(c.numShards) {
-		c.evictOldest(shard)
-	}
-
-	// Create new entry
-	entry := &CacheEntry{
-		Response: response,
-		Expires:  time.Now().Add(ttl),
-		Size:     size,
-	}
+	now := monotonicNow()
+	expired := 0
 
 	// Remove old entry if exists
 	if old, ok := shard.entries[key]; ok {
-		shard.size -= old.Size
+		shard.remove(key, old)
+		if now >= old.Expires {
+			expired++
+		}
+	}
+
+	// Drop expired entries before evicting live ones.
+	if !c.fits(shard, size) {
+		expired += shard.removeExpired(now)
+	}
+	evicted := 0
+	for len(shard.entries) > 0 && !c.fits(shard, size) {
+		shard.evictOldest()
+		evicted++
 	}
 
 	// Add new entry
-	shard.entries[key] = entry
+	shard.entries[key] = &CacheEntry{
+		Response: response,
+		Expires:  now + ttl,
+		Size:     size,
+	}
 	shard.size += size
 	shard.mu.Unlock()
 
-	metrics.CacheSize.Set(float64(c.getTotalEntries()))
+	c.recordExpirations(expired)
+	c.recordEvictions(evicted)
+	c.updateGauges()
+}
+
+// fits reports whether an entry of size bytes can be added to shard without
+// exceeding the shard limits.
+func (c *ShardedCache) fits(shard *CacheShard, size int64) bool {
+	if c.shardLimits.MaxEntries > 0 && len(shard.entries)+1 > c.shardLimits.MaxEntries {
+		return false
+	}
+	if c.shardLimits.MaxBytes > 0 && shard.size+size > c.shardLimits.MaxBytes {
+		return false
+	}
+	return true
 }
 
 // Delete removes a value from the cache
 func (c *ShardedCache) Delete(key string) {
 	shard := c.getShard(key)
-	shard.mu.Lock()
+	shard.lock()
 
 	if entry, ok := shard.entries[key]; ok {
-		shard.size -= entry.Size
-		delete(shard.entries, key)
-		metrics.CacheEvictions.Inc()
+		shard.remove(key, entry)
 		shard.mu.Unlock()
-		metrics.CacheSize.Set(float64(c.getTotalEntries()))
+		c.recordEvictions(1)
+		c.updateGauges()
 		return
 	}
 	shard.mu.Unlock()
 }
 
+// Shrink evicts the entries closest to expiry until each shard keeps at most
+// keep (0 to 1) of its entries, and returns how many were evicted.
+func (c *ShardedCache) Shrink(keep float64) int {
+	evicted := 0
+	for _, shard := range c.shards {
+		shard.lock()
+		excess := len(shard.entries) - int(float64(len(shard.entries))*keep)
+		if excess > 0 {
+			keys := make([]string, 0, len(shard.entries))
+			for key := range shard.entries {
+				keys = append(keys, key)
+			}
+			sort.Slice(keys, func(i, j int) bool {
+				return shard.entries[keys[i]].Expires < shard.entries[keys[j]].Expires
+			})
+			for _, key := range keys[:excess] {
+				shard.remove(key, shard.entries[key])
+			}
+			evicted += excess
+		}
+		shard.mu.Unlock()
+	}
+	if evicted > 0 {
+		c.recordEvictions(evicted)
+		c.updateGauges()
+	}
+	return evicted
+}
+
+// Cleanup removes every expired entry and returns how many were removed.
+// Between sweeps, expired entries are only removed when their shard is full
+// or their key is set again.
+func (c *ShardedCache) Cleanup() int {
+	now := monotonicNow()
+	expired := 0
+	for _, shard := range c.shards {
+		shard.lock()
+		expired += shard.removeExpired(now)
+		shard.mu.Unlock()
+	}
+	if expired > 0 {
+		c.recordExpirations(expired)
+		c.updateGauges()
+	}
+	return expired
+}
+
+// RunCleanup calls Cleanup every interval until ctx is canceled.
+func (c *ShardedCache) RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Cleanup()
+		}
+	}
+}
+
 // Clear removes all values from the cache
 func (c *ShardedCache) Clear() {
 	for _, shard := range c.shards {
-		shard.mu.Lock()
+		shard.lock()
 		shard.entries = make(map[string]*CacheEntry)
 		shard.size = 0
 		shard.mu.Unlock()
 	}
-	metrics.CacheSize.Set(0)
+	c.updateGauges()
+}
+
+// GetStats returns cache statistics, including each shard's.
+func (c *ShardedCache) GetStats() Stats {
+	stats := Stats{
+		MaxEntries:  c.limits.MaxEntries,
+		MaxBytes:    c.limits.MaxBytes,
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Evictions:   c.evictions.Load(),
+		Expirations: c.expirations.Load(),
+		Shards:      make([]ShardStats, len(c.shards)),
+	}
+	stats.HitRatio = hitRatio(stats.Hits, stats.Misses)
+	for i, shard := range c.shards {
+		shard.mu.RLock()
+		stats.Shards[i] = ShardStats{Entries: len(shard.entries), Bytes: shard.size}
+		shard.mu.RUnlock()
+		stats.Shards[i].Contended = shard.contended.Load()
+		stats.Entries += stats.Shards[i].Entries
+		stats.Bytes += stats.Shards[i].Bytes
+	}
+	return stats
 }
 
-// GetStats returns cache statistics
-func (c *ShardedCache) GetStats() map[string]interface{} {
-	totalEntries, totalSize := c.getTotalStats()
-	return map[string]interface{}{
-		"entries":    totalEntries,
-		"size":       totalSize,
-		"hits":       float64(0), // Prometheus metrics are collected separately
-		"misses":     float64(0), // Prometheus metrics are collected separately
-		"evictions":  float64(0), // Prometheus metrics are collected separately
-		"max_size":   c.maxSize,
-		"num_shards": c.numShards,
+func hitRatio(hits, misses uint64) float64 {
+	if hits+misses == 0 {
+		return 0
 	}
+	return float64(hits) / float64(hits+misses)
+}
+
+func (c *ShardedCache) recordHit() {
+	c.hits.Add(1)
+	metrics.CacheHits.Inc()
+	c.updateHitRatio()
+}
+
+func (c *ShardedCache) recordMiss() {
+	c.misses.Add(1)
+	metrics.CacheMisses.Inc()
+	c.updateHitRatio()
 }
 
-// getTotalStats returns the total number of entries and size across all shards
-func (c *ShardedCache) getTotalStats() (int, int64) {
-	var totalEntries int
-	var totalSize int64
+func (c *ShardedCache) updateHitRatio() {
+	metrics.CacheHitRatio.Set(hitRatio(c.hits.Load(), c.misses.Load()))
+}
 
+func (c *ShardedCache) recordEvictions(n int) {
+	if n > 0 {
+		c.evictions.Add(uint64(n))
+		metrics.CacheEvictions.Add(float64(n))
+	}
+}
+
+func (c *ShardedCache) recordExpirations(n int) {
+	if n > 0 {
+		c.expirations.Add(uint64(n))
+		metrics.CacheExpirations.Add(float64(n))
+	}
+}
+
+// updateGauges publishes the entry count and size of the cache and of each
+// shard.
+func (c *ShardedCache) updateGauges() {
+	var entries int
+	var size int64
 	for _, shard := range c.shards {
 		shard.mu.RLock()
-		totalEntries += len(shard.entries)
-		totalSize += shard.size
+		shardEntries, shardSize := len(shard.entries), shard.size
 		shard.mu.RUnlock()
+		shard.entriesGauge.Set(float64(shardEntries))
+		shard.bytesGauge.Set(float64(shardSize))
+		entries += shardEntries
+		size += shardSize
 	}
+	metrics.CacheSize.Set(float64(entries))
+	metrics.CacheBytes.Set(float64(size))
+}
 
-	return totalEntries, totalSize
+// getShard returns the shard for a given key
+func (c *ShardedCache) getShard(key string) *CacheShard {
+	return c.shards[fnv1a(key)&c.shardMask]
 }
 
-// getTotalEntries returns the total number of entries across all shards
-func (c *ShardedCache) getTotalEntries() int {
-	entries, _ := c.getTotalStats()
-	return entries
+// FNV-1a parameters for 64-bit hashes.
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// fnv1a hashes key with 64-bit FNV-1a. It matches hash/fnv without its
+// allocation.
+func fnv1a(key string) uint64 {
+	hash := uint64(fnvOffset64)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= fnvPrime64
+	}
+	return hash
 }
 
-// getShard returns the shard for a given key
-func (c *ShardedCache) getShard(key string) *CacheShard {
-	hash := 0
-	for _, b := range []byte(key) {
-		hash = hash*31 + int(b)
+// lock takes the shard's write lock, counting the acquisition as contended
+// when the lock is already held.
+func (s *CacheShard) lock() {
+	if s.mu.TryLock() {
+		return
+	}
+	s.contended.Add(1)
+	s.contention.Inc()
+	s.mu.Lock()
+}
+
+// rlock takes the shard's read lock, counting the acquisition as contended
+// when a writer holds the lock.
+func (s *CacheShard) rlock() {
+	if s.mu.TryRLock() {
+		return
 	}
-	// Ensure positive hash
-	if hash < 0 {
-		hash = -hash
+	s.contended.Add(1)
+	s.contention.Inc()
+	s.mu.RLock()
+}
+
+// remove deletes key, whose entry is entry, from the shard. The caller holds
+// the shard's write lock.
+func (s *CacheShard) remove(key string, entry *CacheEntry) {
+	s.size -= entry.Size
+	delete(s.entries, key)
+}
+
+// removeExpired removes the entries that expired by now and returns how many
+// were removed. The caller holds the shard's write lock.
+func (s *CacheShard) removeExpired(now time.Duration) int {
+	removed := 0
+	for key, entry := range s.entries {
+		if now >= entry.Expires {
+			s.remove(key, entry)
+			removed++
+		}
 	}
-	return c.shards[hash%c.numShards]
+	return removed
 }
 
-// evictOldest removes the oldest entry from a shard
-func (c *ShardedCache) evictOldest(shard *CacheShard) {
+// evictOldest removes the entry closest to expiry from the shard. The caller
+// holds the shard's write lock.
+func (s *CacheShard) evictOldest() {
 	var oldestKey string
-	var oldestTime time.Time
+	var oldest *CacheEntry
 
-	for key, entry := range shard.entries {
-		if oldestKey == "" || entry.Expires.Before(oldestTime) {
+	for key, entry := range s.entries {
+		if oldest == nil || entry.Expires < oldest.Expires {
 			oldestKey = key
-			oldestTime = entry.Expires
+			oldest = entry
 		}
 	}
 
-	if oldestKey != "" {
-		shard.size -= shard.entries[oldestKey].Size
-		delete(shard.entries, oldestKey)
-		metrics.CacheEvictions.Inc()
+	if oldest != nil {
+		s.remove(oldestKey, oldest)
 	}
 }
 
@@ -1,10 +1,19 @@
 package cache
 
 import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 
 	"dnsres/dnsanalysis"
+	"dnsres/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestShardedCacheTTLExpiration(t *testing.T) {
@@ -22,6 +31,25 @@ func TestShardedCacheTTLExpiration(t *testing.T) {
 	}
 }
 
+func TestShardedCacheExpiryUsesMonotonicClock(t *testing.T) {
+	var clock time.Duration
+	monotonicNow = func() time.Duration { return clock }
+	defer func() { monotonicNow = func() time.Duration { return time.Since(epoch) } }()
+
+	cache := NewShardedCache(1024, 2)
+	cache.Set("example.com", &dnsanalysis.DNSResponse{Hostname: "example.com"}, 10*time.Second)
+
+	// Expiry follows the monotonic clock alone.
+	clock = 9 * time.Second
+	if _, ok := cache.Get("example.com"); !ok {
+		t.Fatalf("expected cache hit before expiry")
+	}
+	clock = 10 * time.Second
+	if _, ok := cache.Get("example.com"); ok {
+		t.Fatalf("expected cache miss at expiry")
+	}
+}
+
 func TestShardedCacheEviction(t *testing.T) {
 	cache := NewShardedCache(20, 1)
 
@@ -37,8 +65,7 @@ func TestShardedCacheEviction(t *testing.T) {
 	cache.Set("a.example.com", responseA, time.Minute)
 	cache.Set("b.example.com", responseB, time.Minute)
 
-	entries, _ := cache.getTotalStats()
-	if entries != 1 {
+	if entries := cache.GetStats().Entries; entries != 1 {
 		t.Fatalf("expected eviction to keep 1 entry, got %d", entries)
 	}
 }
@@ -61,17 +88,26 @@ func TestShardedCacheStats(t *testing.T) {
 	cache.Set("b.example.com", responseB, time.Minute)
 
 	stats := cache.GetStats()
-	if stats["entries"].(int) != 2 {
-		t.Fatalf("expected 2 entries, got %v", stats["entries"])
+	if stats.Entries != 2 {
+		t.Fatalf("expected 2 entries, got %v", stats.Entries)
+	}
+	if stats.Bytes <= 0 {
+		t.Fatalf("expected positive cache size, got %v", stats.Bytes)
 	}
-	if stats["size"].(int64) <= 0 {
-		t.Fatalf("expected positive cache size, got %v", stats["size"])
+	if stats.MaxBytes != 1024 {
+		t.Fatalf("expected max size 1024, got %v", stats.MaxBytes)
 	}
-	if stats["max_size"].(int64) != 1024 {
-		t.Fatalf("expected max size 1024, got %v", stats["max_size"])
+	if len(stats.Shards) != 2 {
+		t.Fatalf("expected num shards 2, got %v", len(stats.Shards))
 	}
-	if stats["num_shards"].(int) != 2 {
-		t.Fatalf("expected num shards 2, got %v", stats["num_shards"])
+	var entries int
+	var size int64
+	for _, shard := range stats.Shards {
+		entries += shard.Entries
+		size += shard.Bytes
+	}
+	if entries != stats.Entries || size != stats.Bytes {
+		t.Fatalf("shard stats %+v do not add up to %d entries, %d bytes", stats.Shards, stats.Entries, stats.Bytes)
 	}
 }
 
@@ -99,3 +135,315 @@ func TestShardedCacheEvictsOldest(t *testing.T) {
 		t.Fatalf("expected newest entry retained")
 	}
 }
+
+func TestShardedCacheShrink(t *testing.T) {
+	cache := NewShardedCache(1024, 1)
+	for i, host := range []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"} {
+		cache.Set(host, &dnsanalysis.DNSResponse{Hostname: host}, time.Duration(i+1)*time.Minute)
+	}
+
+	if evicted := cache.Shrink(0.5); evicted != 2 {
+		t.Fatalf("expected 2 entries evicted, got %d", evicted)
+	}
+	for host, want := range map[string]bool{"a.example.com": false, "b.example.com": false, "c.example.com": true, "d.example.com": true} {
+		if _, ok := cache.Get(host); ok != want {
+			t.Errorf("Get(%q) hit = %v, want %v", host, ok, want)
+		}
+	}
+}
+
+func TestCacheEntryLimit(t *testing.T) {
+	cache := New(Limits{MaxEntries: 2}, 1)
+	for i, host := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		cache.Set(host, &dnsanalysis.DNSResponse{Hostname: host}, time.Duration(i+1)*time.Minute)
+	}
+
+	stats := cache.GetStats()
+	if stats.Entries != 2 {
+		t.Fatalf("expected 2 entries, got %v", stats.Entries)
+	}
+	if stats.Evictions != 1 {
+		t.Fatalf("expected 1 eviction, got %v", stats.Evictions)
+	}
+	if _, ok := cache.Get("a.example.com"); ok {
+		t.Fatalf("expected entry closest to expiry evicted")
+	}
+
+	// Replacing an entry does not evict another.
+	cache.Set("c.example.com", &dnsanalysis.DNSResponse{Hostname: "c.example.com"}, time.Minute)
+	if _, ok := cache.Get("b.example.com"); !ok {
+		t.Fatalf("expected b.example.com retained when c.example.com is replaced")
+	}
+}
+
+func TestCacheCleanupAndStats(t *testing.T) {
+	var clock time.Duration
+	monotonicNow = func() time.Duration { return clock }
+	defer func() { monotonicNow = func() time.Duration { return time.Since(epoch) } }()
+
+	cache := New(Limits{MaxEntries: 10, MaxBytes: 1024}, 2)
+	cache.Set("short.example.com", &dnsanalysis.DNSResponse{Hostname: "short.example.com"}, time.Second)
+	cache.Set("long.example.com", &dnsanalysis.DNSResponse{Hostname: "long.example.com"}, time.Hour)
+	cache.Get("long.example.com")
+	cache.Get("missing.example.com")
+
+	clock = time.Minute
+	if removed := cache.Cleanup(); removed != 1 {
+		t.Fatalf("expected 1 expired entry removed, got %d", removed)
+	}
+	if _, ok := cache.Get("short.example.com"); ok {
+		t.Fatalf("expected expired entry removed")
+	}
+
+	stats := cache.GetStats()
+	want := Stats{
+		Entries:     1,
+		Bytes:       int64(len("long.example.com")),
+		Hits:        1,
+		Misses:      2,
+		Evictions:   0,
+		Expirations: 1,
+		MaxEntries:  10,
+		MaxBytes:    1024,
+		HitRatio:    1.0 / 3,
+		Shards:      stats.Shards,
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("GetStats() = %+v, want %+v", stats, want)
+	}
+}
+
+func TestCacheGetExpiryIsLazy(t *testing.T) {
+	var clock time.Duration
+	monotonicNow = func() time.Duration { return clock }
+	defer func() { monotonicNow = func() time.Duration { return time.Since(epoch) } }()
+
+	cache := New(Limits{MaxEntries: 2}, 1)
+	cache.Set("a.example.com", &dnsanalysis.DNSResponse{Hostname: "a.example.com"}, time.Second)
+	cache.Set("b.example.com", &dnsanalysis.DNSResponse{Hostname: "b.example.com"}, time.Second)
+	clock = time.Minute
+
+	if _, ok := cache.Get("a.example.com"); ok {
+		t.Fatalf("expected miss for expired entry")
+	}
+	if stats := cache.GetStats(); stats.Entries != 2 || stats.Expirations != 0 {
+		t.Fatalf("expected Get to leave expired entries in place, got %v", stats)
+	}
+
+	// A full shard drops expired entries rather than evicting live ones.
+	cache.Set("c.example.com", &dnsanalysis.DNSResponse{Hostname: "c.example.com"}, time.Minute)
+	stats := cache.GetStats()
+	if stats.Entries != 1 || stats.Expirations != 2 || stats.Evictions != 0 {
+		t.Fatalf("expected 2 expirations and no evictions, got %v", stats)
+	}
+}
+
+// TestCacheConcurrentExpiry exercises Get, Set and Cleanup on entries that
+// expire under load; run it with -race.
+func TestCacheConcurrentExpiry(t *testing.T) {
+	cache := New(Limits{MaxEntries: 64}, 4)
+	const workers, iterations = 8, 2000
+
+	stop := make(chan struct{})
+	var cleaner sync.WaitGroup
+	cleaner.Add(1)
+	go func() {
+		defer cleaner.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				cache.Cleanup()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range iterations {
+				host := fmt.Sprintf("host%d.example.com", (w*iterations+i)%100)
+				cache.Set(host, &dnsanalysis.DNSResponse{Hostname: host}, time.Duration(i%3)*time.Millisecond)
+				if response, ok := cache.Get(host); ok && response.Hostname != host {
+					t.Errorf("Get(%q) returned %q", host, response.Hostname)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	cleaner.Wait()
+
+	stats := cache.GetStats()
+	if got := stats.Hits + stats.Misses; got != workers*iterations {
+		t.Fatalf("expected %d lookups counted, got %d", workers*iterations, got)
+	}
+	if entries := stats.Entries; entries > 64 {
+		t.Fatalf("expected at most 64 entries, got %d", entries)
+	}
+}
+
+// expireAndRace expires key, then has workers call GetOrLock on it at once.
+// The caller that takes the refresh lock runs refresh once every other
+// worker is waiting on it. It returns how many workers got a hit.
+func expireAndRace(t *testing.T, cache *ShardedCache, key string, workers int, refresh func()) int {
+	t.Helper()
+	clock := time.Duration(0)
+	monotonicNow = func() time.Duration { return clock }
+	t.Cleanup(func() { monotonicNow = func() time.Duration { return time.Since(epoch) } })
+	cache.Set(key, &dnsanalysis.DNSResponse{Hostname: key}, time.Second)
+	clock = 2 * time.Second
+
+	waitsBefore := testutil.ToFloat64(metrics.CacheRefreshWaits)
+	var hits sync.WaitGroup
+	var mu sync.Mutex
+	hitCount := 0
+	for range workers {
+		hits.Add(1)
+		go func() {
+			defer hits.Done()
+			_, release, ok := cache.GetOrLock(context.Background(), key)
+			defer release()
+			if ok {
+				mu.Lock()
+				hitCount++
+				mu.Unlock()
+				return
+			}
+			for testutil.ToFloat64(metrics.CacheRefreshWaits)-waitsBefore < float64(workers-1) {
+				time.Sleep(time.Millisecond)
+			}
+			refresh()
+		}()
+	}
+	hits.Wait()
+	return hitCount
+}
+
+func TestGetOrLockCoalescesConcurrentExpiry(t *testing.T) {
+	cache := New(Limits{}, 4)
+	const workers = 16
+	refreshes := 0
+	hits := expireAndRace(t, cache, "example.com", workers, func() {
+		refreshes++
+		cache.Set("example.com", &dnsanalysis.DNSResponse{Hostname: "example.com"}, time.Minute)
+	})
+	if refreshes != 1 || hits != workers-1 {
+		t.Fatalf("expected 1 refresh and %d hits, got %d refreshes and %d hits", workers-1, refreshes, hits)
+	}
+}
+
+func TestGetOrLockWaitersMissWhenRefreshFails(t *testing.T) {
+	cache := New(Limits{}, 4)
+	const workers = 8
+	hits := expireAndRace(t, cache, "example.com", workers, func() {})
+	if hits != 0 {
+		t.Fatalf("expected every waiter to miss after a failed refresh, got %d hits", hits)
+	}
+
+	// A canceled waiter gives up without waiting for the refresh.
+	_, release, _ := cache.GetOrLock(context.Background(), "example.com")
+	defer release()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, ok := cache.GetOrLock(ctx, "example.com"); ok {
+		t.Fatal("expected a canceled waiter to miss")
+	}
+}
+
+func BenchmarkShardedCacheGet(b *testing.B) {
+	cache := NewShardedCache(1<<20, 16)
+	cache.Set("example.com", &dnsanalysis.DNSResponse{Hostname: "example.com"}, time.Hour)
+	b.ReportAllocs()
+	for b.Loop() {
+		cache.Get("example.com")
+	}
+}
+
+func TestFNV1aMatchesHashFNV(t *testing.T) {
+	for _, key := range []string{"", "example.com", "web01.example.com"} {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		if got, want := fnv1a(key), h.Sum64(); got != want {
+			t.Errorf("fnv1a(%q) = %x, want %x", key, got, want)
+		}
+	}
+}
+
+func TestNewShardedCacheRoundsShardsToPowerOfTwo(t *testing.T) {
+	for _, tt := range []struct{ in, want int }{{0, 16}, {1, 1}, {2, 2}, {3, 4}, {16, 16}, {17, 32}} {
+		if got := NewShardedCache(1024, tt.in).numShards; got != tt.want {
+			t.Errorf("NewShardedCache(_, %d) has %d shards, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+// legacyShard is the previous base-31 shard selection, kept to compare
+// distributions.
+func legacyShard(key string, numShards int) int {
+	hash := 0
+	for _, b := range []byte(key) {
+		hash = hash*31 + int(b)
+	}
+	if hash < 0 {
+		hash = -hash
+	}
+	return hash % numShards
+}
+
+// BenchmarkShardDistribution reports how unevenly templated hostnames, like
+// those produced by hostname expansion, spread across 16 shards: max/mean is
+// the fullest shard's load relative to an even spread (1 is ideal).
+func BenchmarkShardDistribution(b *testing.B) {
+	var hostnames []string
+	for _, zone := range []string{"example.com", "example.net", "corp.example.org"} {
+		for _, prefix := range []string{"web", "api", "db", "cache", "mail"} {
+			for i := 1; i <= 200; i++ {
+				hostnames = append(hostnames, fmt.Sprintf("%s%03d.%s", prefix, i, zone))
+			}
+		}
+	}
+	const numShards = 16
+	for _, tt := range []struct {
+		name  string
+		shard func(string) int
+	}{
+		{"fnv1a", func(key string) int { return int(fnv1a(key) & (numShards - 1)) }},
+		{"legacy31", func(key string) int { return legacyShard(key, numShards) }},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			var counts [numShards]int
+			for b.Loop() {
+				counts = [numShards]int{}
+				for _, hostname := range hostnames {
+					counts[tt.shard(hostname)]++
+				}
+			}
+			b.ReportMetric(float64(slices.Max(counts[:]))*numShards/float64(len(hostnames)), "max/mean")
+		})
+	}
+}
+
+func TestShardedCacheCountsContention(t *testing.T) {
+	cache := New(Limits{}, 1)
+	shard := cache.shards[0]
+
+	shard.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		cache.Get("a.example.com")
+		close(done)
+	}()
+	for shard.contended.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	shard.mu.Unlock()
+	<-done
+
+	if got := cache.GetStats().Shards[0].Contended; got != 1 {
+		t.Fatalf("expected 1 contended acquisition, got %d", got)
+	}
+}
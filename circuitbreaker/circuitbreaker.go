@@ -16,6 +16,29 @@ const (
 	HalfOpen
 )
 
+// String returns the state's name as reported by GetState.
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// StateChange describes a breaker moving from one state to another.
+type StateChange struct {
+	Server   string
+	From, To State
+	At       time.Time
+	// Failures is the consecutive failure count at the change, and Err the
+	// error of the last of them when it was recorded with RecordError.
+	Failures int
+	Err      error
+}
+
 // CircuitBreaker implements the circuit breaker pattern
 type CircuitBreaker struct {
 	threshold int
@@ -24,30 +47,109 @@ type CircuitBreaker struct {
 	lastError time.Time
 	mu        sync.Mutex
 	server    string // Add server field for metrics
+	// state is the state last observed; time in state is counted in the
+	// metrics up to accounted.
+	state     State
+	accounted time.Time
+	cause     error
+	onChange  func(StateChange)
+	pending   []StateChange
 }
 
 // NewCircuitBreaker creates a new circuit breaker
 func NewCircuitBreaker(threshold int, timeout time.Duration, server string) *CircuitBreaker {
+	now := time.Now()
+	for _, state := range []State{Closed, Open, HalfOpen} {
+		metrics.CircuitBreakerStateSeconds.WithLabelValues(server, state.String()).Add(0)
+	}
+	metrics.CircuitBreakerOpenings.WithLabelValues(server).Add(0)
+	metrics.CircuitBreakerLastStateChange.WithLabelValues(server).Set(float64(now.UnixNano()) / 1e9)
 	return &CircuitBreaker{
 		threshold: threshold,
 		timeout:   timeout,
 		server:    server,
+		accounted: now,
+	}
+}
+
+// current derives the state at now from the failure count.
+func (cb *CircuitBreaker) current(now time.Time) State {
+	if cb.failures < cb.threshold {
+		return Closed
+	}
+	if now.Sub(cb.lastError) < cb.timeout {
+		return Open
+	}
+	return HalfOpen
+}
+
+// update counts the time since the breaker was last observed and moves it to
+// its current state. A breaker whose timeout expired in between became
+// half-open when it expired, not now.
+func (cb *CircuitBreaker) update(now time.Time) State {
+	state := cb.current(now)
+	if cb.state == Open && state == HalfOpen {
+		cb.transition(HalfOpen, cb.lastError.Add(cb.timeout))
+	}
+	cb.transition(state, now)
+	metrics.CircuitBreakerState.WithLabelValues(cb.server).Set(float64(state))
+	return state
+}
+
+func (cb *CircuitBreaker) transition(state State, at time.Time) {
+	if at.After(cb.accounted) {
+		metrics.CircuitBreakerStateSeconds.WithLabelValues(cb.server, cb.state.String()).Add(at.Sub(cb.accounted).Seconds())
+		cb.accounted = at
+	}
+	if state == cb.state {
+		return
+	}
+	if cb.onChange != nil {
+		cb.pending = append(cb.pending, StateChange{
+			Server:   cb.server,
+			From:     cb.state,
+			To:       state,
+			At:       at,
+			Failures: cb.failures,
+			Err:      cb.cause,
+		})
+	}
+	cb.state = state
+	if state == Open {
+		metrics.CircuitBreakerOpenings.WithLabelValues(cb.server).Inc()
+	}
+	metrics.CircuitBreakerLastStateChange.WithLabelValues(cb.server).Set(float64(at.UnixNano()) / 1e9)
+}
+
+// OnStateChange registers fn to be called with every state change. A change
+// is seen when the breaker is next used, so fn runs in the goroutine using
+// it, after the breaker is unlocked.
+func (cb *CircuitBreaker) OnStateChange(fn func(StateChange)) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.onChange = fn
+}
+
+// notify delivers the pending state changes. Methods defer it before
+// locking, so it runs once the lock is released.
+func (cb *CircuitBreaker) notify() {
+	cb.mu.Lock()
+	changes, fn := cb.pending, cb.onChange
+	cb.pending = nil
+	cb.mu.Unlock()
+	for _, change := range changes {
+		fn(change)
 	}
 }
 
 // Allow checks if the circuit breaker allows the request
 func (cb *CircuitBreaker) Allow() bool {
+	defer cb.notify()
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 
-	if cb.failures >= cb.threshold {
-		if time.Since(cb.lastError) < cb.timeout {
-			metrics.CircuitBreakerState.WithLabelValues(cb.server).Set(float64(Open))
-			return false
-		}
-		metrics.CircuitBreakerState.WithLabelValues(cb.server).Set(float64(HalfOpen))
-	} else {
-		metrics.CircuitBreakerState.WithLabelValues(cb.server).Set(float64(Closed))
+	if cb.update(time.Now()) == Open {
+		return false
 	}
 
 	metrics.CircuitBreakerFailures.WithLabelValues(cb.server).Inc()
@@ -56,38 +158,41 @@ func (cb *CircuitBreaker) Allow() bool {
 
 // RecordSuccess records a successful operation
 func (cb *CircuitBreaker) RecordSuccess() {
+	defer cb.notify()
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 	cb.failures = 0
-	metrics.CircuitBreakerState.WithLabelValues(cb.server).Set(float64(Closed))
+	cb.cause = nil
+	cb.update(time.Now())
 	metrics.CircuitBreakerFailures.WithLabelValues(cb.server).Inc()
 }
 
 // RecordFailure records a failed operation
 func (cb *CircuitBreaker) RecordFailure() {
+	cb.RecordError(nil)
+}
+
+// RecordError records an operation that failed with err, which is reported
+// with the state change the failure causes.
+func (cb *CircuitBreaker) RecordError(err error) {
+	defer cb.notify()
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
+	now := time.Now()
+	cb.update(now)
 	cb.failures++
-	cb.lastError = time.Now()
+	cb.lastError = now
+	cb.cause = err
 	metrics.CircuitBreakerFailures.WithLabelValues(cb.server).Inc()
-
-	if cb.failures >= cb.threshold {
-		metrics.CircuitBreakerState.WithLabelValues(cb.server).Set(float64(Open))
-	}
+	cb.update(now)
 }
 
 // GetState returns the current state of the circuit breaker
 func (cb *CircuitBreaker) GetState() string {
+	defer cb.notify()
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
-
-	if cb.failures >= cb.threshold {
-		if time.Since(cb.lastError) < cb.timeout {
-			return "open"
-		}
-		return "half-open"
-	}
-	return "closed"
+	return cb.update(time.Now()).String()
 }
 
 // Execute runs the given function with circuit breaker protection
@@ -98,7 +203,7 @@ func (cb *CircuitBreaker) Execute(fn func() (interface{}, error)) (interface{},
 
 	result, err := fn()
 	if err != nil {
-		cb.RecordFailure()
+		cb.RecordError(err)
 		return nil, err
 	}
 
@@ -115,7 +220,10 @@ func (cb *CircuitBreaker) GetFailures() int {
 
 // Reset resets the circuit breaker to its initial state
 func (cb *CircuitBreaker) Reset() {
+	defer cb.notify()
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 	cb.failures = 0
+	cb.cause = nil
+	cb.update(time.Now())
 }
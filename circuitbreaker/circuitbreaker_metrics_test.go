@@ -42,3 +42,50 @@ func TestCircuitBreakerMetrics(t *testing.T) {
 		t.Fatalf("expected closed state metric, got %v", got)
 	}
 }
+
+func TestCircuitBreakerTimeInStateMetrics(t *testing.T) {
+	server := "time-in-state-server"
+	cb := NewCircuitBreaker(1, 20*time.Millisecond, server)
+	seconds := func(state State) float64 {
+		return testutil.ToFloat64(metrics.CircuitBreakerStateSeconds.WithLabelValues(server, state.String()))
+	}
+	openings := func() float64 {
+		return testutil.ToFloat64(metrics.CircuitBreakerOpenings.WithLabelValues(server))
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	cb.RecordFailure()
+	if got := seconds(Closed); got < 0.01 {
+		t.Fatalf("expected closed time counted before opening, got %v", got)
+	}
+	if got := openings(); got != 1 {
+		t.Fatalf("expected one open episode, got %v", got)
+	}
+	opened := testutil.ToFloat64(metrics.CircuitBreakerLastStateChange.WithLabelValues(server))
+
+	// The breaker went half-open when its timeout expired, so only the
+	// timeout counts as open even though it is observed later.
+	time.Sleep(50 * time.Millisecond)
+	if state := cb.GetState(); state != "half-open" {
+		t.Fatalf("expected half-open, got %s", state)
+	}
+	if got := seconds(Open); got < 0.02 || got > 0.03 {
+		t.Fatalf("expected open time of the 20ms timeout, got %v", got)
+	}
+	if got := seconds(HalfOpen); got < 0.02 {
+		t.Fatalf("expected half-open time counted, got %v", got)
+	}
+	changed := testutil.ToFloat64(metrics.CircuitBreakerLastStateChange.WithLabelValues(server))
+	if changed-opened < 0.019 || changed-opened > 0.021 {
+		t.Fatalf("expected state change at the timeout, %vs after opening", changed-opened)
+	}
+
+	cb.RecordFailure()
+	if got := openings(); got != 2 {
+		t.Fatalf("expected a failure while half-open to reopen, got %v openings", got)
+	}
+	cb.Reset()
+	if got := testutil.ToFloat64(metrics.CircuitBreakerState.WithLabelValues(server)); got != float64(Closed) {
+		t.Fatalf("expected closed state metric after reset, got %v", got)
+	}
+}
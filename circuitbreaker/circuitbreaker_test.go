@@ -1,6 +1,7 @@
 package circuitbreaker
 
 import (
+	"errors"
 	"testing"
 	"time"
 )
@@ -39,3 +40,39 @@ func TestCircuitBreakerStateTransitions(t *testing.T) {
 		t.Fatalf("expected state closed after success, got %s", state)
 	}
 }
+
+func TestCircuitBreakerStateChangeCallback(t *testing.T) {
+	cb := NewCircuitBreaker(2, 20*time.Millisecond, "server")
+	var changes []StateChange
+	cb.OnStateChange(func(change StateChange) {
+		// Called unlocked, so the breaker can be inspected.
+		_ = cb.GetFailures()
+		changes = append(changes, change)
+	})
+
+	cb.RecordError(errors.New("first"))
+	if len(changes) != 0 {
+		t.Fatalf("expected no change below the threshold, got %+v", changes)
+	}
+	cb.RecordError(errors.New("i/o timeout"))
+	if len(changes) != 1 {
+		t.Fatalf("expected the breaker to open, got %+v", changes)
+	}
+	opened := changes[0]
+	if opened.Server != "server" || opened.From != Closed || opened.To != Open || opened.Failures != 2 || opened.Err == nil || opened.Err.Error() != "i/o timeout" {
+		t.Fatalf("unexpected open change %+v", opened)
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	cb.Allow()
+	cb.RecordSuccess()
+	if len(changes) != 3 {
+		t.Fatalf("expected half-open and closed changes, got %+v", changes)
+	}
+	if half := changes[1]; half.From != Open || half.To != HalfOpen || !half.At.Equal(opened.At.Add(20*time.Millisecond)) {
+		t.Fatalf("expected half-open at the timeout, got %+v", half)
+	}
+	if closed := changes[2]; closed.From != HalfOpen || closed.To != Closed || closed.Err != nil {
+		t.Fatalf("unexpected close change %+v", closed)
+	}
+}
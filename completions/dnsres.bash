@@ -40,7 +40,7 @@ _dnsres_tui()
     COMPREPLY=()
     cur="${COMP_WORDS[COMP_CWORD]}"
     prev="${COMP_WORDS[COMP_CWORD-1]}"
-    opts="-config -host -help -version"
+    opts="-config -host -notify -plain -help -version"
 
     case "${prev}" in
         -config)
@@ -52,6 +52,10 @@ _dnsres_tui()
             # No automatic completion for hostname
             return 0
             ;;
+        -notify)
+            COMPREPLY=( $(compgen -W "osc9 osc777" -- "${cur}") )
+            return 0
+            ;;
         *)
             ;;
     esac
@@ -17,11 +17,15 @@ complete -c dnsres -o version -d 'Show version information'
 # dnsres-tui completions
 complete -c dnsres-tui -s c -l config -d 'Path to configuration file' -r -F
 complete -c dnsres-tui -s h -l host -d 'Hostname to resolve (overrides config)' -r
+complete -c dnsres-tui -l notify -d 'Desktop notifications via terminal escape sequences' -r -a 'osc9 osc777'
+complete -c dnsres-tui -l plain -d 'Plain-text output for screen readers and dumb terminals'
 complete -c dnsres-tui -l help -d 'Show help message'
 complete -c dnsres-tui -l version -d 'Show version information'
 
 # Short flag versions (matching Go flag package behavior)
 complete -c dnsres-tui -o config -d 'Path to configuration file' -r -F
 complete -c dnsres-tui -o host -d 'Hostname to resolve (overrides config)' -r
+complete -c dnsres-tui -o notify -d 'Desktop notifications via terminal escape sequences' -r -a 'osc9 osc777'
+complete -c dnsres-tui -o plain -d 'Plain-text output for screen readers and dumb terminals'
 complete -c dnsres-tui -o help -d 'Show help message'
 complete -c dnsres-tui -o version -d 'Show version information'
@@ -0,0 +1,324 @@
+package dnsanalysis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Finding severities.
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Names of the built-in analyzers.
+const (
+	AnalyzerConsistency = "consistency"
+	AnalyzerDNSSEC      = "dnssec"
+	AnalyzerTTLDrift    = "ttl_drift"
+	AnalyzerEmptyAnswer = "empty_answer"
+	AnalyzerReference   = "reference"
+	AnalyzerDelegation  = "delegation"
+)
+
+// ttlDriftThreshold is how far apart, in seconds, servers' TTLs for the same
+// name may be before ttl_drift reports them. Caching resolvers count TTLs
+// down independently, so small spreads are normal.
+const ttlDriftThreshold = 300
+
+// Finding is something an analyzer noticed about a response or response set.
+type Finding struct {
+	Analyzer string
+	Hostname string
+	// Server is empty for findings about the whole response set.
+	Server   string
+	Severity string
+	Message  string
+	// Detail is an optional multi-line explanation for interactive views.
+	Detail string
+}
+
+// ResponseSet holds every answer collected for one hostname in a cycle.
+// Failures maps servers that returned no usable answer to their error.
+// Reference is the server the others are compared with, if one is
+// designated.
+type ResponseSet struct {
+	Hostname  string
+	Responses []*DNSResponse
+	Failures  map[string]string
+	Reference string
+}
+
+// Analyzer inspects resolution results. AnalyzeResponse runs on each server's
+// response and AnalyzeSet on each hostname's response set; an analyzer that
+// only needs one of them returns nil from the other.
+type Analyzer interface {
+	Name() string
+	AnalyzeResponse(response *DNSResponse) []Finding
+	AnalyzeSet(set ResponseSet) []Finding
+}
+
+var (
+	analyzersMu sync.RWMutex
+	analyzers   = []Analyzer{
+		consistencyAnalyzer{},
+		dnssecAnalyzer{},
+		ttlDriftAnalyzer{},
+		emptyAnswerAnalyzer{},
+		referenceAnalyzer{},
+		delegationAnalyzer{},
+	}
+)
+
+// RegisterAnalyzer adds analyzer to the set run on every response.
+// Registering a name that already exists replaces that analyzer.
+func RegisterAnalyzer(analyzer Analyzer) {
+	analyzersMu.Lock()
+	defer analyzersMu.Unlock()
+	for i, existing := range analyzers {
+		if existing.Name() == analyzer.Name() {
+			analyzers[i] = analyzer
+			return
+		}
+	}
+	analyzers = append(analyzers, analyzer)
+}
+
+// Analyzers returns the registered analyzers in registration order, built-ins
+// first.
+func Analyzers() []Analyzer {
+	analyzersMu.RLock()
+	defer analyzersMu.RUnlock()
+	return append([]Analyzer(nil), analyzers...)
+}
+
+// LookupAnalyzer returns the registered analyzer called name.
+func LookupAnalyzer(name string) (Analyzer, bool) {
+	analyzersMu.RLock()
+	defer analyzersMu.RUnlock()
+	for _, analyzer := range analyzers {
+		if analyzer.Name() == name {
+			return analyzer, true
+		}
+	}
+	return nil, false
+}
+
+// consistencyAnalyzer reports servers whose addresses differ from the
+// majority answer.
+type consistencyAnalyzer struct{}
+
+func (consistencyAnalyzer) Name() string { return AnalyzerConsistency }
+
+func (consistencyAnalyzer) AnalyzeResponse(*DNSResponse) []Finding { return nil }
+
+func (consistencyAnalyzer) AnalyzeSet(set ResponseSet) []Finding {
+	if CompareResponses(set.Responses) {
+		return nil
+	}
+	diff := DiffResponses(set.Hostname, set.Responses, set.Failures)
+	return []Finding{{
+		Analyzer: AnalyzerConsistency,
+		Hostname: set.Hostname,
+		Severity: SeverityWarning,
+		Message:  diff.Summary(),
+		Detail:   diff.String(),
+	}}
+}
+
+// referenceAnalyzer reports each server whose addresses differ from the
+// reference server's, naming the records it is missing and the extra ones
+// it returned.
+type referenceAnalyzer struct{}
+
+func (referenceAnalyzer) Name() string { return AnalyzerReference }
+
+func (referenceAnalyzer) AnalyzeResponse(*DNSResponse) []Finding { return nil }
+
+func (referenceAnalyzer) AnalyzeSet(set ResponseSet) []Finding {
+	if set.Reference == "" {
+		return nil
+	}
+	var findings []Finding
+	for _, diff := range DiffReference(set.Reference, set.Responses, nil) {
+		if !diff.Differs() {
+			continue
+		}
+		var parts []string
+		if len(diff.Removed) > 0 {
+			parts = append(parts, "missing "+strings.Join(diff.Removed, " "))
+		}
+		if len(diff.Added) > 0 {
+			parts = append(parts, "extra "+strings.Join(diff.Added, " "))
+		}
+		message := fmt.Sprintf("%s compared to reference %s", strings.Join(parts, ", "), set.Reference)
+		findings = append(findings, Finding{
+			Analyzer: AnalyzerReference,
+			Hostname: set.Hostname,
+			Server:   diff.Server,
+			Severity: SeverityWarning,
+			Message:  message,
+			Detail:   fmt.Sprintf("%s\n  %s", message, diff.summary()),
+		})
+	}
+	return findings
+}
+
+// dnssecAnalyzer reports servers that returned unsigned answers for a name
+// other servers returned signatures for, which suggests a resolver stripping
+// RRSIGs or not validating.
+type dnssecAnalyzer struct{}
+
+func (dnssecAnalyzer) Name() string { return AnalyzerDNSSEC }
+
+func (dnssecAnalyzer) AnalyzeResponse(*DNSResponse) []Finding { return nil }
+
+func (dnssecAnalyzer) AnalyzeSet(set ResponseSet) []Finding {
+	var signed, unsigned []string
+	for _, response := range set.Responses {
+		if response.DNSSEC || (response.Response != nil && hasDNSSEC(response.Response)) {
+			signed = append(signed, response.Server)
+		} else {
+			unsigned = append(unsigned, response.Server)
+		}
+	}
+	if len(signed) == 0 || len(unsigned) == 0 {
+		return nil
+	}
+	sort.Strings(signed)
+	sort.Strings(unsigned)
+	findings := make([]Finding, 0, len(unsigned))
+	for _, server := range unsigned {
+		findings = append(findings, Finding{
+			Analyzer: AnalyzerDNSSEC,
+			Hostname: set.Hostname,
+			Server:   server,
+			Severity: SeverityWarning,
+			Message:  fmt.Sprintf("no RRSIG in answer while %s returned signatures", strings.Join(signed, ",")),
+		})
+	}
+	return findings
+}
+
+// ttlDriftAnalyzer reports names whose TTLs differ across servers by more than
+// ttlDriftThreshold, a sign that some resolvers hold a stale or different
+// copy of the zone.
+type ttlDriftAnalyzer struct{}
+
+func (ttlDriftAnalyzer) Name() string { return AnalyzerTTLDrift }
+
+func (ttlDriftAnalyzer) AnalyzeResponse(*DNSResponse) []Finding { return nil }
+
+func (ttlDriftAnalyzer) AnalyzeSet(set ResponseSet) []Finding {
+	if len(set.Responses) < 2 {
+		return nil
+	}
+	low, high := set.Responses[0], set.Responses[0]
+	for _, response := range set.Responses[1:] {
+		if response.TTL < low.TTL {
+			low = response
+		}
+		if response.TTL > high.TTL {
+			high = response
+		}
+	}
+	if high.TTL-low.TTL <= ttlDriftThreshold {
+		return nil
+	}
+	return []Finding{{
+		Analyzer: AnalyzerTTLDrift,
+		Hostname: set.Hostname,
+		Severity: SeverityInfo,
+		Message:  fmt.Sprintf("TTL spread %ds: %s ttl=%ds, %s ttl=%ds", high.TTL-low.TTL, low.Server, low.TTL, high.Server, high.TTL),
+	}}
+}
+
+// emptyAnswerAnalyzer reports successful responses that carry no addresses
+// (NODATA), which resolution otherwise counts as a success.
+type emptyAnswerAnalyzer struct{}
+
+func (emptyAnswerAnalyzer) Name() string { return AnalyzerEmptyAnswer }
+
+func (emptyAnswerAnalyzer) AnalyzeResponse(response *DNSResponse) []Finding {
+	if len(response.Addresses) > 0 || len(response.Synthesized) > 0 {
+		return nil
+	}
+	if response.Response != nil && response.Response.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	return []Finding{{
+		Analyzer: AnalyzerEmptyAnswer,
+		Hostname: response.Hostname,
+		Server:   response.Server,
+		Severity: SeverityWarning,
+		Message:  "NOERROR response with no addresses",
+	}}
+}
+
+func (emptyAnswerAnalyzer) AnalyzeSet(ResponseSet) []Finding { return nil }
+
+// delegationAnalyzer reports servers whose authority section disagrees with
+// the others': a different NS set than most servers returned, or a SOA
+// serial behind the newest seen for the same zone, which points at a stale secondary or a
+// lame delegation.
+type delegationAnalyzer struct{}
+
+func (delegationAnalyzer) Name() string { return AnalyzerDelegation }
+
+func (delegationAnalyzer) AnalyzeResponse(*DNSResponse) []Finding { return nil }
+
+func (delegationAnalyzer) AnalyzeSet(set ResponseSet) []Finding {
+	sorted := append([]*DNSResponse(nil), set.Responses...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Server < sorted[j].Server })
+
+	// The most common NS set is the baseline; ties go to the first in
+	// server order.
+	counts := make(map[string]int)
+	var baseline *DNSResponse
+	newest := make(map[string]*DNSResponse)
+	for _, response := range sorted {
+		if len(response.Nameservers) > 0 {
+			key := strings.Join(response.Nameservers, ",")
+			counts[key]++
+			if baseline == nil || counts[key] > counts[strings.Join(baseline.Nameservers, ",")] {
+				baseline = response
+			}
+		}
+		if latest := newest[response.Zone]; response.Zone != "" && (latest == nil || response.SOASerial > latest.SOASerial) {
+			newest[response.Zone] = response
+		}
+	}
+
+	var findings []Finding
+	for _, response := range sorted {
+		if baseline != nil && len(response.Nameservers) > 0 {
+			added, removed := setDifference(response.Nameservers, baseline.Nameservers)
+			if len(added) > 0 || len(removed) > 0 {
+				findings = append(findings, Finding{
+					Analyzer: AnalyzerDelegation,
+					Hostname: set.Hostname,
+					Server:   response.Server,
+					Severity: SeverityWarning,
+					Message: fmt.Sprintf("NS set [%s] differs from [%s] returned by %s",
+						strings.Join(response.Nameservers, " "), strings.Join(baseline.Nameservers, " "), baseline.Server),
+				})
+			}
+		}
+		if latest := newest[response.Zone]; latest != nil && response.SOASerial < latest.SOASerial {
+			findings = append(findings, Finding{
+				Analyzer: AnalyzerDelegation,
+				Hostname: set.Hostname,
+				Server:   response.Server,
+				Severity: SeverityWarning,
+				Message: fmt.Sprintf("SOA serial %d for %s is behind %d returned by %s",
+					response.SOASerial, response.Zone, latest.SOASerial, latest.Server),
+			})
+		}
+	}
+	return findings
+}
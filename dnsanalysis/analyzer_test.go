@@ -0,0 +1,85 @@
+package dnsanalysis
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBuiltinAnalyzers(t *testing.T) {
+	signed := new(dns.Msg)
+	rrsig, _ := dns.NewRR("example.com. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 12345 example.com. AAAA")
+	signed.Answer = append(signed.Answer, rrsig)
+
+	set := ResponseSet{
+		Hostname: "example.com",
+		Responses: []*DNSResponse{
+			{Server: "server-1", Hostname: "example.com", Addresses: []string{"10.0.0.1"}, TTL: 3600, Response: signed, Nameservers: []string{"ns1", "ns2"}},
+			{Server: "server-2", Hostname: "example.com", Addresses: []string{"10.0.0.1"}, TTL: 60, Nameservers: []string{"ns1", "ns2"}, Zone: "example.com", SOASerial: 5},
+			{Server: "server-3", Hostname: "example.com", TTL: 60, Nameservers: []string{"ns1", "ns3"}, Zone: "example.com", SOASerial: 4},
+		},
+		Reference: "server-2",
+	}
+
+	tests := []struct {
+		analyzer string
+		want     []string
+	}{
+		{analyzer: AnalyzerConsistency, want: []string{""}},
+		{analyzer: AnalyzerDNSSEC, want: []string{"server-2", "server-3"}},
+		{analyzer: AnalyzerTTLDrift, want: []string{""}},
+		{analyzer: AnalyzerEmptyAnswer, want: []string{"server-3"}},
+		{analyzer: AnalyzerReference, want: []string{"server-3"}},
+		{analyzer: AnalyzerDelegation, want: []string{"server-3", "server-3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.analyzer, func(t *testing.T) {
+			analyzer, ok := LookupAnalyzer(tt.analyzer)
+			if !ok {
+				t.Fatalf("expected built-in analyzer %s", tt.analyzer)
+			}
+			var findings []Finding
+			for _, response := range set.Responses {
+				findings = append(findings, analyzer.AnalyzeResponse(response)...)
+			}
+			findings = append(findings, analyzer.AnalyzeSet(set)...)
+
+			var servers []string
+			for _, finding := range findings {
+				if finding.Analyzer != tt.analyzer || finding.Hostname != "example.com" {
+					t.Fatalf("unexpected finding %+v", finding)
+				}
+				servers = append(servers, finding.Server)
+			}
+			if strings.Join(servers, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("expected findings for %v, got %v", tt.want, servers)
+			}
+		})
+	}
+}
+
+type stubAnalyzer struct {
+	name string
+}
+
+func (a stubAnalyzer) Name() string                           { return a.name }
+func (a stubAnalyzer) AnalyzeResponse(*DNSResponse) []Finding { return nil }
+func (a stubAnalyzer) AnalyzeSet(ResponseSet) []Finding       { return nil }
+
+func TestRegisterAnalyzer(t *testing.T) {
+	before := len(Analyzers())
+	RegisterAnalyzer(stubAnalyzer{name: "stub"})
+	RegisterAnalyzer(stubAnalyzer{name: "stub"})
+
+	all := Analyzers()
+	if len(all) != before+1 {
+		t.Fatalf("expected re-registration to replace, got %d analyzers (was %d)", len(all), before)
+	}
+	if all[0].Name() != AnalyzerConsistency || all[len(all)-1].Name() != "stub" {
+		t.Fatalf("expected built-ins first and stub last, got %s..%s", all[0].Name(), all[len(all)-1].Name())
+	}
+	if _, ok := LookupAnalyzer("missing"); ok {
+		t.Fatalf("expected unknown analyzer lookup to fail")
+	}
+}
@@ -0,0 +1,273 @@
+package dnsanalysis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ServerDiff describes how one server's answer differs from the baseline.
+type ServerDiff struct {
+	Server   string
+	Added    []string
+	Removed  []string
+	TTLDelta int64
+	// LatencyDelta is how much longer the server took than the reference;
+	// only DiffReference sets it.
+	LatencyDelta time.Duration
+	// NSAdded and NSRemoved compare the server's authority NS set with the
+	// baseline's, and SerialDelta its SOA serial, when both carry a SOA.
+	NSAdded     []string
+	NSRemoved   []string
+	SerialDelta int64
+	Error       string
+}
+
+// Differs reports whether the server's addresses differ from the baseline or
+// it failed. Differences in delegation data alone do not count.
+func (s ServerDiff) Differs() bool {
+	return len(s.Added) > 0 || len(s.Removed) > 0 || s.Error != ""
+}
+
+// ResponseDiff is a human-readable comparison of the answers returned for a
+// single hostname. The baseline is the most common address set.
+type ResponseDiff struct {
+	Hostname          string
+	BaselineServers   []string
+	BaselineAddresses []string
+	BaselineTTL       uint32
+	// BaselineNameservers and BaselineSerial are the baseline answer's
+	// authority NS set and SOA serial.
+	BaselineNameservers []string
+	BaselineSerial      uint32
+	Servers             []ServerDiff
+}
+
+// DiffResponses compares responses against the majority answer. failures maps
+// servers that returned no usable answer to their error (e.g. an rcode).
+func DiffResponses(hostname string, responses []*DNSResponse, failures map[string]string) *ResponseDiff {
+	diff := &ResponseDiff{Hostname: hostname}
+
+	sorted := append([]*DNSResponse(nil), responses...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Server < sorted[j].Server })
+
+	// Pick the most common address set as the baseline; ties go to the
+	// answer seen first in server order.
+	counts := make(map[string]int)
+	var baselineKey string
+	best := 0
+	for _, response := range sorted {
+		key := addressKey(response.Addresses)
+		counts[key]++
+		if counts[key] > best {
+			baselineKey = key
+			best = counts[key]
+		}
+	}
+
+	var baseline *DNSResponse
+	for _, response := range sorted {
+		if addressKey(response.Addresses) != baselineKey {
+			continue
+		}
+		if baseline == nil {
+			baseline = response
+			diff.BaselineAddresses = sortedCopy(response.Addresses)
+			diff.BaselineTTL = response.TTL
+			diff.BaselineNameservers = response.Nameservers
+			diff.BaselineSerial = response.SOASerial
+		}
+		diff.BaselineServers = append(diff.BaselineServers, response.Server)
+	}
+
+	for _, response := range sorted {
+		if baseline == nil || response == baseline {
+			continue
+		}
+		server := compare(response, baseline)
+		if !server.Differs() && !server.delegationDiffers() {
+			continue
+		}
+		diff.Servers = append(diff.Servers, server)
+	}
+
+	failed := make([]string, 0, len(failures))
+	for server := range failures {
+		failed = append(failed, server)
+	}
+	sort.Strings(failed)
+	for _, server := range failed {
+		diff.Servers = append(diff.Servers, ServerDiff{Server: server, Error: failures[server]})
+	}
+
+	return diff
+}
+
+// DiffReference compares every other server's answer with the reference
+// server's, in server order: Added holds the addresses the reference did not
+// return and Removed those missing compared to it. Servers in failures are
+// listed with their error. It returns nil when the reference has no answer.
+func DiffReference(reference string, responses []*DNSResponse, failures map[string]string) []ServerDiff {
+	var ref *DNSResponse
+	for _, response := range responses {
+		if response.Server == reference {
+			ref = response
+			break
+		}
+	}
+	if ref == nil {
+		return nil
+	}
+
+	sorted := append([]*DNSResponse(nil), responses...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Server < sorted[j].Server })
+	var diffs []ServerDiff
+	for _, response := range sorted {
+		if response == ref {
+			continue
+		}
+		diff := compare(response, ref)
+		diff.LatencyDelta = response.Duration - ref.Duration
+		diffs = append(diffs, diff)
+	}
+	failed := make([]string, 0, len(failures))
+	for server := range failures {
+		failed = append(failed, server)
+	}
+	sort.Strings(failed)
+	for _, server := range failed {
+		diffs = append(diffs, ServerDiff{Server: server, Error: failures[server]})
+	}
+	return diffs
+}
+
+// Consistent reports whether every server returned the baseline's
+// addresses. Servers listed only for their delegation data do not count.
+func (d *ResponseDiff) Consistent() bool {
+	for _, server := range d.Servers {
+		if server.Differs() {
+			return false
+		}
+	}
+	return true
+}
+
+// compare describes how response differs from baseline.
+func compare(response, baseline *DNSResponse) ServerDiff {
+	diff := ServerDiff{
+		Server:   response.Server,
+		TTLDelta: int64(response.TTL) - int64(baseline.TTL),
+	}
+	diff.Added, diff.Removed = setDifference(response.Addresses, baseline.Addresses)
+	diff.NSAdded, diff.NSRemoved = setDifference(response.Nameservers, baseline.Nameservers)
+	if response.Zone != "" && baseline.Zone != "" {
+		diff.SerialDelta = int64(response.SOASerial) - int64(baseline.SOASerial)
+	}
+	return diff
+}
+
+// delegationDiffers reports whether the server's NS set or SOA serial differs
+// from the baseline's.
+func (s ServerDiff) delegationDiffers() bool {
+	return len(s.NSAdded) > 0 || len(s.NSRemoved) > 0 || s.SerialDelta != 0
+}
+
+// Summary renders the diff on a single line for log files.
+func (d *ResponseDiff) Summary() string {
+	parts := []string{fmt.Sprintf("baseline %s [%s] ttl=%ds%s",
+		strings.Join(d.BaselineServers, ","), strings.Join(d.BaselineAddresses, " "), d.BaselineTTL, d.baselineDelegation())}
+	for _, server := range d.Servers {
+		parts = append(parts, server.summary())
+	}
+	return strings.Join(parts, "; ")
+}
+
+// String renders the diff as multiple lines for interactive views.
+func (d *ResponseDiff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", d.Hostname)
+	fmt.Fprintf(&b, "  baseline (%s): %s ttl=%ds%s\n",
+		strings.Join(d.BaselineServers, ", "), strings.Join(d.BaselineAddresses, " "), d.BaselineTTL, d.baselineDelegation())
+	for _, server := range d.Servers {
+		fmt.Fprintf(&b, "  %s\n", server.summary())
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// baselineDelegation renders the baseline's NS set and SOA serial, when it
+// has them, with a leading space.
+func (d *ResponseDiff) baselineDelegation() string {
+	var b strings.Builder
+	if len(d.BaselineNameservers) > 0 {
+		fmt.Fprintf(&b, " ns=[%s]", strings.Join(d.BaselineNameservers, " "))
+	}
+	if d.BaselineSerial != 0 {
+		fmt.Fprintf(&b, " serial=%d", d.BaselineSerial)
+	}
+	return b.String()
+}
+
+func (s ServerDiff) summary() string {
+	if s.Error != "" {
+		return fmt.Sprintf("%s error: %s", s.Server, s.Error)
+	}
+	parts := []string{s.Server}
+	for _, addr := range s.Added {
+		parts = append(parts, "+"+addr)
+	}
+	for _, addr := range s.Removed {
+		parts = append(parts, "-"+addr)
+	}
+	if s.TTLDelta != 0 {
+		parts = append(parts, fmt.Sprintf("ttl %+ds", s.TTLDelta))
+	}
+	for _, ns := range s.NSAdded {
+		parts = append(parts, "+ns:"+ns)
+	}
+	for _, ns := range s.NSRemoved {
+		parts = append(parts, "-ns:"+ns)
+	}
+	if s.SerialDelta != 0 {
+		parts = append(parts, fmt.Sprintf("serial %+d", s.SerialDelta))
+	}
+	if s.LatencyDelta != 0 {
+		parts = append(parts, fmt.Sprintf("latency %+dms", s.LatencyDelta.Milliseconds()))
+	}
+	return strings.Join(parts, " ")
+}
+
+func addressKey(addresses []string) string {
+	return strings.Join(sortedCopy(addresses), ",")
+}
+
+func sortedCopy(values []string) []string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// setDifference returns the values only in a and only in b.
+func setDifference(a, b []string) ([]string, []string) {
+	inA := make(map[string]struct{}, len(a))
+	for _, value := range a {
+		inA[value] = struct{}{}
+	}
+	inB := make(map[string]struct{}, len(b))
+	for _, value := range b {
+		inB[value] = struct{}{}
+	}
+
+	var onlyA, onlyB []string
+	for _, value := range sortedCopy(a) {
+		if _, ok := inB[value]; !ok {
+			onlyA = append(onlyA, value)
+		}
+	}
+	for _, value := range sortedCopy(b) {
+		if _, ok := inA[value]; !ok {
+			onlyB = append(onlyB, value)
+		}
+	}
+	return onlyA, onlyB
+}
@@ -0,0 +1,104 @@
+package dnsanalysis
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffResponses(t *testing.T) {
+	responses := []*DNSResponse{
+		{Server: "server-1", Addresses: []string{"10.0.0.1", "10.0.0.2"}, TTL: 300},
+		{Server: "server-2", Addresses: []string{"10.0.0.2", "10.0.0.1"}, TTL: 300},
+		{Server: "server-3", Addresses: []string{"10.0.0.1", "10.0.0.9"}, TTL: 60},
+	}
+	failures := map[string]string{"server-4": "NXDOMAIN"}
+
+	diff := DiffResponses("example.com", responses, failures)
+
+	if strings.Join(diff.BaselineServers, ",") != "server-1,server-2" {
+		t.Fatalf("expected majority baseline, got %v", diff.BaselineServers)
+	}
+	if len(diff.Servers) != 2 {
+		t.Fatalf("expected 2 differing servers, got %+v", diff.Servers)
+	}
+
+	divergent := diff.Servers[0]
+	if divergent.Server != "server-3" {
+		t.Fatalf("expected server-3 first, got %s", divergent.Server)
+	}
+	if len(divergent.Added) != 1 || divergent.Added[0] != "10.0.0.9" {
+		t.Fatalf("unexpected added addresses: %v", divergent.Added)
+	}
+	if len(divergent.Removed) != 1 || divergent.Removed[0] != "10.0.0.2" {
+		t.Fatalf("unexpected removed addresses: %v", divergent.Removed)
+	}
+	if divergent.TTLDelta != -240 {
+		t.Fatalf("expected TTL delta -240, got %d", divergent.TTLDelta)
+	}
+
+	summary := diff.Summary()
+	for _, want := range []string{"+10.0.0.9", "-10.0.0.2", "ttl -240s", "server-4 error: NXDOMAIN"} {
+		if !strings.Contains(summary, want) {
+			t.Fatalf("expected summary to contain %q, got %s", want, summary)
+		}
+	}
+	if strings.Contains(summary, "\n") {
+		t.Fatalf("expected single-line summary, got %q", summary)
+	}
+	if !strings.HasPrefix(diff.String(), "example.com\n") {
+		t.Fatalf("expected multi-line rendering to start with hostname, got %q", diff.String())
+	}
+}
+
+func TestDiffResponsesDelegation(t *testing.T) {
+	responses := []*DNSResponse{
+		{Server: "server-1", Nameservers: []string{"ns1.example.com", "ns2.example.com"}, Zone: "example.com", SOASerial: 7},
+		{Server: "server-2", Nameservers: []string{"ns1.example.com", "ns2.example.com"}, Zone: "example.com", SOASerial: 7},
+		{Server: "server-3", Nameservers: []string{"ns1.example.com", "ns9.example.com"}, Zone: "example.com", SOASerial: 5},
+	}
+
+	diff := DiffResponses("example.com", responses, nil)
+	if !diff.Consistent() {
+		t.Fatalf("expected matching addresses to stay consistent, got %+v", diff.Servers)
+	}
+	if len(diff.Servers) != 1 || diff.Servers[0].Server != "server-3" || diff.Servers[0].SerialDelta != -2 {
+		t.Fatalf("expected server-3 listed for its delegation, got %+v", diff.Servers)
+	}
+	summary := diff.Summary()
+	for _, want := range []string{"ns=[ns1.example.com ns2.example.com] serial=7", "+ns:ns9.example.com", "-ns:ns2.example.com", "serial -2"} {
+		if !strings.Contains(summary, want) {
+			t.Fatalf("expected summary to contain %q, got %s", want, summary)
+		}
+	}
+}
+
+func TestDiffReference(t *testing.T) {
+	responses := []*DNSResponse{
+		{Server: "server-2", Addresses: []string{"10.0.0.1"}, TTL: 300, Duration: 40 * time.Millisecond},
+		{Server: "reference", Addresses: []string{"10.0.0.1", "10.0.0.2"}, TTL: 300, Duration: 10 * time.Millisecond},
+		{Server: "server-1", Addresses: []string{"10.0.0.2", "10.0.0.1"}, TTL: 300, Duration: 5 * time.Millisecond},
+	}
+	failures := map[string]string{"server-3": "SERVFAIL"}
+
+	diffs := DiffReference("reference", responses, failures)
+	if len(diffs) != 3 {
+		t.Fatalf("expected a diff for every other server, got %+v", diffs)
+	}
+	if diffs[0].Server != "server-1" || diffs[0].Differs() || diffs[0].LatencyDelta != -5*time.Millisecond {
+		t.Fatalf("expected server-1 to agree and be 5ms faster, got %+v", diffs[0])
+	}
+	if diffs[1].Server != "server-2" || !diffs[1].Differs() || strings.Join(diffs[1].Removed, ",") != "10.0.0.2" || diffs[1].LatencyDelta != 30*time.Millisecond {
+		t.Fatalf("expected server-2 to miss 10.0.0.2 and be 30ms slower, got %+v", diffs[1])
+	}
+	if !strings.Contains(diffs[1].summary(), "latency +30ms") {
+		t.Fatalf("expected latency in summary, got %q", diffs[1].summary())
+	}
+	if diffs[2].Server != "server-3" || diffs[2].Error != "SERVFAIL" {
+		t.Fatalf("expected server-3's failure, got %+v", diffs[2])
+	}
+
+	if diffs := DiffReference("server-3", responses, failures); diffs != nil {
+		t.Fatalf("expected no diffs without a reference answer, got %+v", diffs)
+	}
+}
@@ -22,6 +22,33 @@ type DNSResponse struct {
 	EDNS        bool
 	Protocol    string
 	Duration    time.Duration
+	// Latency breakdown of Duration's query. QueueTime covers the cache,
+	// breaker, client pool and pre-query hooks before the query was sent;
+	// ConnectTime the socket, TCP or TLS setup; NetworkLatency the query
+	// round trip; ProcessingTime parsing the answer locally.
+	QueueTime      time.Duration
+	ConnectTime    time.Duration
+	NetworkLatency time.Duration
+	ProcessingTime time.Duration
+	// DNS64 marks responses containing AAAA records synthesized from A
+	// records; those addresses are kept in Synthesized, not Addresses, so
+	// they do not count against consistency.
+	DNS64       bool
+	Synthesized []string
+	// Authority and Additional are the authority and additional sections
+	// in presentation form, without the EDNS OPT record.
+	Authority  []string
+	Additional []string
+	// Zone and SOASerial come from the authority section's SOA, which
+	// negative answers carry, and NegativeTTL is how long such an answer
+	// may be cached.
+	Zone        string
+	SOASerial   uint32
+	NegativeTTL uint32
+	// Nameservers is the authority section's NS set, sorted, and Glue the
+	// additional section's addresses for them as "name address".
+	Nameservers []string
+	Glue        []string
 }
 
 // AnalyzeResponse analyzes a DNS response and updates metrics
@@ -48,6 +75,11 @@ func AnalyzeResponse(ctx context.Context, server, hostname string, response *dns
 		metrics.DNSResolutionTTL.WithLabelValues(server, hostname, recordType).Observe(float64(rr.Header().Ttl))
 	}
 
+	CaptureSections(analysis, response)
+	if len(response.Answer) == 0 {
+		analysis.TTL = analysis.NegativeTTL
+	}
+
 	// Check for DNSSEC
 	analysis.DNSSEC = hasDNSSEC(response)
 	metrics.DNSResolutionDNSSECSupport.WithLabelValues(server, hostname).Set(boolToFloat64(analysis.DNSSEC))
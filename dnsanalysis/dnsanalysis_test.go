@@ -2,6 +2,7 @@ package dnsanalysis
 
 import (
 	"context"
+	"strings"
 	"testing"
 	"time"
 
@@ -72,3 +73,99 @@ func TestCompareResponses(t *testing.T) {
 		t.Fatalf("expected responses to mismatch")
 	}
 }
+
+func TestCaptureSections(t *testing.T) {
+	negative := new(dns.Msg)
+	negative.SetQuestion(dns.Fqdn("missing.example.com"), dns.TypeA)
+	soa, _ := dns.NewRR("example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 7 7200 900 1209600 300")
+	negative.Ns = append(negative.Ns, soa)
+
+	analysis, err := AnalyzeResponse(context.Background(), "server", "missing.example.com", negative, negative.Len(), "udp", time.Millisecond)
+	if err != nil {
+		t.Fatalf("AnalyzeResponse returned error: %v", err)
+	}
+	if analysis.Zone != "example.com" || analysis.SOASerial != 7 || analysis.NegativeTTL != 300 || analysis.TTL != 300 {
+		t.Fatalf("expected SOA data and negative TTL 300, got %+v", analysis)
+	}
+	if NegativeTTL(negative) != 300 || AuthoritySummary(negative) != "soa example.com serial 7" {
+		t.Fatalf("unexpected negative TTL %d or summary %q", NegativeTTL(negative), AuthoritySummary(negative))
+	}
+
+	referral := new(dns.Msg)
+	referral.SetQuestion(dns.Fqdn("www.example.com"), dns.TypeA)
+	for _, record := range []string{
+		"example.com. 86400 IN NS ns2.example.com.",
+		"example.com. 86400 IN NS NS1.example.com.",
+	} {
+		rr, _ := dns.NewRR(record)
+		referral.Ns = append(referral.Ns, rr)
+	}
+	for _, record := range []string{
+		"ns1.example.com. 86400 IN A 192.0.2.1",
+		"ns2.example.com. 86400 IN AAAA 2001:db8::2",
+		"mail.example.com. 86400 IN A 192.0.2.25",
+	} {
+		rr, _ := dns.NewRR(record)
+		referral.Extra = append(referral.Extra, rr)
+	}
+	referral.SetEdns0(1232, false)
+
+	response := &DNSResponse{}
+	CaptureSections(response, referral)
+	if strings.Join(response.Nameservers, ",") != "ns1.example.com,ns2.example.com" {
+		t.Fatalf("unexpected nameservers %v", response.Nameservers)
+	}
+	if strings.Join(response.Glue, ",") != "ns1.example.com 192.0.2.1,ns2.example.com 2001:db8::2" {
+		t.Fatalf("unexpected glue %v", response.Glue)
+	}
+	if len(response.Authority) != 2 || len(response.Additional) != 3 {
+		t.Fatalf("expected 2 authority and 3 additional records without OPT, got %v and %v", response.Authority, response.Additional)
+	}
+	if response.Zone != "" || AuthoritySummary(referral) != "ns ns1.example.com,ns2.example.com" {
+		t.Fatalf("unexpected zone %q or summary %q", response.Zone, AuthoritySummary(referral))
+	}
+}
+
+func TestResponseResult(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn("www.example.com"), dns.TypeA)
+	msg.SetEdns0(1232, true)
+	msg.Response, msg.RecursionAvailable, msg.AuthenticatedData = true, true, true
+	for _, record := range []string{
+		"www.example.com. 300 IN CNAME web.example.com.",
+		"web.example.com. 60 IN A 192.0.2.10",
+	} {
+		rr, _ := dns.NewRR(record)
+		msg.Answer = append(msg.Answer, rr)
+	}
+
+	response, err := AnalyzeResponse(context.Background(), "server", "www.example.com", msg, msg.Len(), "udp", 12*time.Millisecond)
+	if err != nil {
+		t.Fatalf("AnalyzeResponse returned error: %v", err)
+	}
+	response.NetworkLatency = 10 * time.Millisecond
+	result := response.Result()
+	if result.Rcode != "NOERROR" || strings.Join(result.Flags, " ") != "qr rd ra ad do" || result.Validation != ValidationSecure {
+		t.Fatalf("unexpected rcode, flags or validation: %+v", result)
+	}
+	if len(result.Answer) != 2 || result.Answer[0] != (Record{Name: "www.example.com.", Type: "CNAME", Class: "IN", TTL: 300, Data: "web.example.com."}) {
+		t.Fatalf("expected typed answer records, got %+v", result.Answer)
+	}
+	if result.Additional != nil || result.Size != msg.Len() || result.Transport != "udp" || result.Timings.TotalMs != 12 || result.Timings.NetworkMs != 10 {
+		t.Fatalf("unexpected wire fields %+v", result)
+	}
+
+	rrsig, _ := dns.NewRR("web.example.com. 60 IN RRSIG A 13 3 60 20300101000000 20200101000000 12345 example.com. dGVzdA==")
+	msg.Answer = append(msg.Answer, rrsig)
+	msg.AuthenticatedData = false
+	if validation := response.Result().Validation; validation != ValidationSigned {
+		t.Fatalf("expected a signed answer without AD to be %q, got %q", ValidationSigned, validation)
+	}
+
+	// Responses without a message, such as hand-built ones, keep their
+	// addresses.
+	bare := &DNSResponse{Hostname: "www.example.com", Addresses: []string{"192.0.2.10"}, TTL: 60}
+	if result := bare.Result(); len(result.Answer) != 1 || result.Answer[0].Data != "192.0.2.10" || result.Validation != ValidationUnsigned {
+		t.Fatalf("unexpected result without a message: %+v", result)
+	}
+}
@@ -0,0 +1,172 @@
+package dnsanalysis
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Validation statuses of a Result.
+const (
+	// ValidationSecure marks an answer the server validated with DNSSEC (the
+	// AD flag is set).
+	ValidationSecure = "secure"
+	// ValidationSigned marks an answer carrying signatures the server did
+	// not vouch for.
+	ValidationSigned = "signed"
+	// ValidationUnsigned marks an answer without DNSSEC records.
+	ValidationUnsigned = "unsigned"
+)
+
+// Result is the full outcome of one query for API consumers: every record
+// in typed form and the response's wire fields. DNSResponse stays the
+// compact form the resolver caches and compares.
+type Result struct {
+	Server   string `json:"server"`
+	Hostname string `json:"hostname"`
+	Rcode    string `json:"rcode"`
+	// Flags are the set header flags as dig prints them, plus "do" when the
+	// DNSSEC OK bit is set.
+	Flags      []string `json:"flags"`
+	Answer     []Record `json:"answer"`
+	Authority  []Record `json:"authority,omitempty"`
+	Additional []Record `json:"additional,omitempty"`
+	// Size is the response's size on the wire in bytes.
+	Size      int     `json:"size"`
+	Transport string  `json:"transport"`
+	Timings   Timings `json:"timings"`
+	// Validation is ValidationSecure, ValidationSigned or
+	// ValidationUnsigned.
+	Validation string `json:"validation"`
+}
+
+// Record is one resource record. Data is the record's data in presentation
+// form, e.g. "10 mail.example.com." for an MX record.
+type Record struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+	TTL   uint32 `json:"ttl"`
+	Data  string `json:"data"`
+}
+
+// Timings are a query's latency and its phases in milliseconds; see
+// DNSResponse.
+type Timings struct {
+	TotalMs      float64 `json:"total_ms"`
+	QueueMs      float64 `json:"queue_ms"`
+	ConnectMs    float64 `json:"connect_ms"`
+	NetworkMs    float64 `json:"network_ms"`
+	ProcessingMs float64 `json:"processing_ms"`
+}
+
+// Result returns the full form of the response. Without the message, as for
+// responses built by hand, only the addresses are known and become A
+// records.
+func (r *DNSResponse) Result() *Result {
+	result := &Result{
+		Server:     r.Server,
+		Hostname:   r.Hostname,
+		Rcode:      dns.RcodeToString[dns.RcodeSuccess],
+		Flags:      []string{},
+		Answer:     []Record{},
+		Size:       r.Size,
+		Transport:  r.Protocol,
+		Validation: ValidationUnsigned,
+		Timings: Timings{
+			TotalMs:      milliseconds(r.Duration),
+			QueueMs:      milliseconds(r.QueueTime),
+			ConnectMs:    milliseconds(r.ConnectTime),
+			NetworkMs:    milliseconds(r.NetworkLatency),
+			ProcessingMs: milliseconds(r.ProcessingTime),
+		},
+	}
+	msg := r.Response
+	if msg == nil {
+		for _, address := range r.Addresses {
+			result.Answer = append(result.Answer, Record{
+				Name:  dns.Fqdn(r.Hostname),
+				Type:  dns.TypeToString[dns.TypeA],
+				Class: dns.ClassToString[dns.ClassINET],
+				TTL:   r.TTL,
+				Data:  address,
+			})
+		}
+		return result
+	}
+
+	result.Rcode = dns.RcodeToString[msg.Rcode]
+	result.Flags = Flags(msg)
+	result.Answer = append(result.Answer, records(msg.Answer)...)
+	result.Authority = records(msg.Ns)
+	result.Additional = records(msg.Extra)
+	switch {
+	case msg.AuthenticatedData:
+		result.Validation = ValidationSecure
+	case signed(msg):
+		result.Validation = ValidationSigned
+	}
+	return result
+}
+
+// records converts rrs, leaving out the EDNS OPT pseudo-record.
+func records(rrs []dns.RR) []Record {
+	var converted []Record
+	for _, rr := range rrs {
+		header := rr.Header()
+		if header.Rrtype == dns.TypeOPT {
+			continue
+		}
+		converted = append(converted, Record{
+			Name:  header.Name,
+			Type:  dns.TypeToString[header.Rrtype],
+			Class: dns.ClassToString[header.Class],
+			TTL:   header.Ttl,
+			Data:  strings.TrimPrefix(rr.String(), header.String()),
+		})
+	}
+	return converted
+}
+
+// signed reports whether any section of msg carries an RRSIG.
+func signed(msg *dns.Msg) bool {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Flags lists msg's set header flags in dig's order, plus "do" when the
+// DNSSEC OK bit is set.
+func Flags(msg *dns.Msg) []string {
+	flags := []string{}
+	for _, flag := range []struct {
+		name string
+		set  bool
+	}{
+		{"qr", msg.Response},
+		{"aa", msg.Authoritative},
+		{"tc", msg.Truncated},
+		{"rd", msg.RecursionDesired},
+		{"ra", msg.RecursionAvailable},
+		{"ad", msg.AuthenticatedData},
+		{"cd", msg.CheckingDisabled},
+	} {
+		if flag.set {
+			flags = append(flags, flag.name)
+		}
+	}
+	if opt := msg.IsEdns0(); opt != nil && opt.Do() {
+		flags = append(flags, "do")
+	}
+	return flags
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,85 @@
+package dnsanalysis
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// CaptureSections records msg's authority and additional sections on
+// response: the records themselves, the SOA negative answers carry and the
+// NS set and glue of a delegation.
+func CaptureSections(response *DNSResponse, msg *dns.Msg) {
+	for _, rr := range msg.Ns {
+		response.Authority = append(response.Authority, rr.String())
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			if response.Zone == "" {
+				response.Zone = trimDot(rr.Hdr.Name)
+				response.SOASerial = rr.Serial
+				response.NegativeTTL = min(rr.Hdr.Ttl, rr.Minttl)
+			}
+		case *dns.NS:
+			response.Nameservers = append(response.Nameservers, trimDot(rr.Ns))
+		}
+	}
+	sort.Strings(response.Nameservers)
+
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		response.Additional = append(response.Additional, rr.String())
+		name := trimDot(rr.Header().Name)
+		if !slices.Contains(response.Nameservers, name) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			response.Glue = append(response.Glue, name+" "+rr.A.String())
+		case *dns.AAAA:
+			response.Glue = append(response.Glue, name+" "+rr.AAAA.String())
+		}
+	}
+	sort.Strings(response.Glue)
+}
+
+// NegativeTTL returns how long a negative answer may be cached: the lesser
+// of the authority SOA's TTL and its minimum field, or 0 without a SOA
+// (RFC 2308).
+func NegativeTTL(msg *dns.Msg) uint32 {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+	return 0
+}
+
+// AuthoritySummary describes the authority section of a negative answer or
+// referral on one line, e.g. "soa example.com serial 2024010101" or
+// "ns a.iana-servers.net,b.iana-servers.net", or returns "" when it is
+// empty.
+func AuthoritySummary(msg *dns.Msg) string {
+	var nameservers []string
+	for _, rr := range msg.Ns {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			return fmt.Sprintf("soa %s serial %d", trimDot(rr.Hdr.Name), rr.Serial)
+		case *dns.NS:
+			nameservers = append(nameservers, trimDot(rr.Ns))
+		}
+	}
+	if len(nameservers) == 0 {
+		return ""
+	}
+	sort.Strings(nameservers)
+	return "ns " + strings.Join(nameservers, ",")
+}
+
+func trimDot(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
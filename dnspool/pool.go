@@ -1,6 +1,8 @@
 package dnspool
 
 import (
+	"errors"
+	"net"
 	"strings"
 	"sync"
 	"time"
@@ -10,20 +12,67 @@ import (
 	"github.com/miekg/dns"
 )
 
-// ClientPool manages a pool of DNS clients
+// ErrClosed is returned by Get after the pool is closed.
+var ErrClosed = errors.New("dnspool: pool is closed")
+
+// ClientPool manages a pool of DNS clients, kept separately per server
 type ClientPool struct {
-	clients map[string][]*dns.Client
-	mu      sync.Mutex
-	MaxSize int
-	Timeout time.Duration
+	clients map[string][]idleClient
+	// conns holds connected UDP sockets kept open between exchanges; see
+	// GetConn.
+	conns map[string][]idleConn
+	// serverMaxSize overrides MaxSize for individual servers.
+	serverMaxSize map[string]int
+	closed        bool
+	mu            sync.Mutex
+	MaxSize       int
+	Timeout       time.Duration
+	// IdleTimeout drops clients that sat in the pool longer than this; zero
+	// keeps them until the pool is closed.
+	IdleTimeout time.Duration
+}
+
+// idleClient is a pooled client and when it was returned.
+type idleClient struct {
+	client *dns.Client
+	since  time.Time
+}
+
+// idleConn is a pooled connected socket and when it was returned.
+type idleConn struct {
+	conn  *dns.Conn
+	since time.Time
 }
 
 // NewClientPool creates a new DNS client pool
 func NewClientPool(maxSize int, timeout time.Duration) *ClientPool {
 	return &ClientPool{
-		clients: make(map[string][]*dns.Client),
-		MaxSize: maxSize,
-		Timeout: timeout,
+		clients:       make(map[string][]idleClient),
+		conns:         make(map[string][]idleConn),
+		serverMaxSize: make(map[string]int),
+		MaxSize:       maxSize,
+		Timeout:       timeout,
+	}
+}
+
+// SetServerMaxSize sets how many idle clients are kept for server,
+// overriding MaxSize. A negative size restores MaxSize.
+func (p *ClientPool) SetServerMaxSize(server string, maxSize int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	server = poolKey(server)
+	if maxSize < 0 {
+		delete(p.serverMaxSize, server)
+		return
+	}
+	p.serverMaxSize[server] = maxSize
+	if clients := p.clients[server]; len(clients) > maxSize {
+		p.clients[server] = clients[len(clients)-maxSize:]
+	}
+	if conns := p.conns[server]; len(conns) > maxSize {
+		closeConns(conns[:len(conns)-maxSize])
+		p.conns[server] = conns[len(conns)-maxSize:]
 	}
 }
 
@@ -32,14 +81,15 @@ func (p *ClientPool) Get(server string) (*dns.Client, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	// Assume port 53 if not specified
-	if !strings.Contains(server, ":") {
-		server = server + ":53"
+	if p.closed {
+		return nil, ErrClosed
 	}
+	server = poolKey(server)
+	p.expireIdle(server, time.Now())
 
 	clients := p.clients[server]
 	if len(clients) > 0 {
-		client := clients[len(clients)-1]
+		client := clients[len(clients)-1].client
 		p.clients[server] = clients[:len(clients)-1]
 		metrics.DNSResolutionProtocol.WithLabelValues(server, "", "pooled").Inc()
 		return client, nil
@@ -52,36 +102,192 @@ func (p *ClientPool) Get(server string) (*dns.Client, error) {
 	return client, nil
 }
 
-// Put returns a client to the pool
+// Put returns a client to the pool under server. Clients returned after
+// Close are dropped.
 func (p *ClientPool) Put(server string, client *dns.Client) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	server = poolKey(server)
+	if p.closed {
+		metrics.DNSResolutionProtocol.WithLabelValues(server, "", "dropped").Inc()
+		return
+	}
+
 	// Reset client state
 	client.Timeout = p.Timeout
 
+	now := time.Now()
+	p.expireIdle(server, now)
+
 	// Add to pool if not at max size
-	if len(p.clients[server]) < p.MaxSize {
-		p.clients[server] = append(p.clients[server], client)
+	if len(p.clients[server]) < p.maxSize(server) {
+		p.clients[server] = append(p.clients[server], idleClient{client: client, since: now})
 		metrics.DNSResolutionProtocol.WithLabelValues(server, "", "returned").Inc()
 	} else {
 		metrics.DNSResolutionProtocol.WithLabelValues(server, "", "dropped").Inc()
 	}
 }
 
+// GetConn returns a connected UDP socket to server kept open by PutConn, or
+// nil when none is idle and the caller should dial one. Reusing sockets saves
+// a socket and connect per exchange at high query volumes and keeps the
+// source port, which DNS cookies and ECS-aware servers tie state to.
+func (p *ClientPool) GetConn(server string) *dns.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	server = poolKey(server)
+	p.expireIdle(server, time.Now())
+
+	conns := p.conns[server]
+	if len(conns) == 0 {
+		return nil
+	}
+	conn := conns[len(conns)-1].conn
+	p.conns[server] = conns[:len(conns)-1]
+	metrics.DNSResolutionProtocol.WithLabelValues(server, "", "socket_reused").Inc()
+	return conn
+}
+
+// PutConn keeps conn, a connected UDP socket to server, open for GetConn.
+// Sockets beyond the pool's size for server, stream connections and sockets
+// returned after Close are closed instead. Only return sockets whose last
+// exchange succeeded, so late replies to a timed-out query are not read by
+// the next one.
+func (p *ClientPool) PutConn(server string, conn *dns.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	server = poolKey(server)
+	if _, ok := conn.Conn.(net.PacketConn); !ok || p.closed {
+		conn.Close()
+		return
+	}
+
+	now := time.Now()
+	p.expireIdle(server, now)
+
+	if len(p.conns[server]) < p.maxSize(server) {
+		p.conns[server] = append(p.conns[server], idleConn{conn: conn, since: now})
+		metrics.DNSResolutionProtocol.WithLabelValues(server, "", "socket_returned").Inc()
+	} else {
+		conn.Close()
+		metrics.DNSResolutionProtocol.WithLabelValues(server, "", "socket_dropped").Inc()
+	}
+}
+
+// Close drops every pooled client and closes every pooled socket. Get fails
+// with ErrClosed afterwards.
+func (p *ClientPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.clients = make(map[string][]idleClient)
+	for _, conns := range p.conns {
+		closeConns(conns)
+	}
+	p.conns = make(map[string][]idleConn)
+	return nil
+}
+
 // GetStats returns pool statistics
 func (p *ClientPool) GetStats() map[string]interface{} {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	totalClients := 0
-	for _, clients := range p.clients {
+	servers := make(map[string]int, len(p.clients))
+	for server, clients := range p.clients {
 		totalClients += len(clients)
+		servers[server] = len(clients)
+	}
+	totalSockets := 0
+	for _, conns := range p.conns {
+		totalSockets += len(conns)
 	}
 
 	return map[string]interface{}{
 		"total_clients": totalClients,
+		"idle_sockets":  totalSockets,
+		"servers":       servers,
 		"max_size":      p.MaxSize,
 		"timeout":       p.Timeout.String(),
+		"idle_timeout":  p.IdleTimeout.String(),
+		"closed":        p.closed,
+	}
+}
+
+// maxSize returns the idle client limit for server. The caller holds p.mu.
+func (p *ClientPool) maxSize(server string) int {
+	if size, ok := p.serverMaxSize[server]; ok {
+		return size
+	}
+	return p.MaxSize
+}
+
+// expireIdle drops the clients and closes the sockets of server that have
+// been idle longer than IdleTimeout. The caller holds p.mu.
+func (p *ClientPool) expireIdle(server string, now time.Time) {
+	if p.IdleTimeout <= 0 {
+		return
+	}
+	p.expireIdleClients(server, now)
+	p.expireIdleConns(server, now)
+}
+
+// expireIdleClients drops the expired clients of server. Clients are stacked
+// in the order they were returned, so the expired ones are at the bottom.
+func (p *ClientPool) expireIdleClients(server string, now time.Time) {
+	clients := p.clients[server]
+	expired := 0
+	for expired < len(clients) && now.Sub(clients[expired].since) > p.IdleTimeout {
+		expired++
+	}
+	if expired == 0 {
+		return
+	}
+	if expired == len(clients) {
+		delete(p.clients, server)
+		return
+	}
+	p.clients[server] = append(clients[:0], clients[expired:]...)
+}
+
+// expireIdleConns closes the expired sockets of server, which are stacked
+// like clients.
+func (p *ClientPool) expireIdleConns(server string, now time.Time) {
+	conns := p.conns[server]
+	expired := 0
+	for expired < len(conns) && now.Sub(conns[expired].since) > p.IdleTimeout {
+		expired++
+	}
+	if expired == 0 {
+		return
+	}
+	closeConns(conns[:expired])
+	if expired == len(conns) {
+		delete(p.conns, server)
+		return
+	}
+	p.conns[server] = append(conns[:0], conns[expired:]...)
+}
+
+func closeConns(conns []idleConn) {
+	for _, idle := range conns {
+		idle.conn.Close()
+	}
+}
+
+// poolKey normalizes server so Get and Put agree on its key, assuming port
+// 53 if none is specified.
+func poolKey(server string) string {
+	if !strings.Contains(server, ":") {
+		return server + ":53"
 	}
+	return server
 }
@@ -1,8 +1,12 @@
 package dnspool
 
 import (
+	"errors"
+	"net"
 	"testing"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 func TestClientPoolReuse(t *testing.T) {
@@ -46,3 +50,200 @@ func TestClientPoolMaxSize(t *testing.T) {
 		t.Fatalf("expected pool size 1, got %v", stats["total_clients"])
 	}
 }
+
+func TestClientPoolPutNormalizesServer(t *testing.T) {
+	pool := NewClientPool(2, time.Second)
+
+	client, err := pool.Get("8.8.8.8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pool.Put("8.8.8.8", client)
+
+	reused, err := pool.Get("8.8.8.8:53")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reused != client {
+		t.Fatalf("expected client returned without a port to be reused")
+	}
+}
+
+func TestClientPoolServerMaxSize(t *testing.T) {
+	pool := NewClientPool(1, time.Second)
+	pool.SetServerMaxSize("1.1.1.1:53", 3)
+
+	for _, server := range []string{"8.8.8.8:53", "1.1.1.1:53"} {
+		var clients []*dns.Client
+		for range 3 {
+			client, err := pool.Get(server)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			clients = append(clients, client)
+		}
+		for _, client := range clients {
+			pool.Put(server, client)
+		}
+	}
+
+	servers := pool.GetStats()["servers"].(map[string]int)
+	if servers["8.8.8.8:53"] != 1 || servers["1.1.1.1:53"] != 3 {
+		t.Fatalf("expected 1 and 3 pooled clients, got %v", servers)
+	}
+}
+
+func TestClientPoolIdleTimeout(t *testing.T) {
+	pool := NewClientPool(2, time.Second)
+	pool.IdleTimeout = time.Millisecond
+
+	client, err := pool.Get("8.8.8.8:53")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pool.Put("8.8.8.8:53", client)
+	time.Sleep(5 * time.Millisecond)
+
+	fresh, err := pool.Get("8.8.8.8:53")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fresh == client {
+		t.Fatalf("expected idle client to expire")
+	}
+}
+
+func TestClientPoolClose(t *testing.T) {
+	pool := NewClientPool(2, time.Second)
+	client, err := pool.Get("8.8.8.8:53")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pool.Put("8.8.8.8:53", client)
+
+	if err := pool.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := pool.Get("8.8.8.8:53"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after Close, got %v", err)
+	}
+	pool.Put("8.8.8.8:53", client)
+	if stats := pool.GetStats(); stats["total_clients"].(int) != 0 {
+		t.Fatalf("expected no pooled clients after Close, got %v", stats["total_clients"])
+	}
+}
+
+// startUDPServer answers every query on a loopback UDP socket and returns
+// its address.
+func startUDPServer(tb testing.TB) string {
+	tb.Helper()
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Skipf("cannot listen on loopback: %v", err)
+	}
+	server := &dns.Server{
+		PacketConn: packetConn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			reply := new(dns.Msg)
+			reply.SetReply(req)
+			w.WriteMsg(reply)
+		}),
+	}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+	tb.Cleanup(func() { server.Shutdown() })
+	return packetConn.LocalAddr().String()
+}
+
+func TestClientPoolReusesSockets(t *testing.T) {
+	addr := startUDPServer(t)
+	pool := NewClientPool(1, time.Second)
+	client, err := pool.Get(addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if conn := pool.GetConn(addr); conn != nil {
+		t.Fatalf("expected no idle socket before any was returned")
+	}
+
+	conn, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	pool.PutConn(addr, conn)
+	reused := pool.GetConn(addr)
+	if reused != conn {
+		t.Fatalf("expected the returned socket to be reused")
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := client.ExchangeWithConn(msg, reused); err != nil {
+		t.Fatalf("exchange over reused socket failed: %v", err)
+	}
+
+	extra, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	pool.PutConn(addr, reused)
+	pool.PutConn(addr, extra)
+	if stats := pool.GetStats(); stats["idle_sockets"].(int) != 1 {
+		t.Fatalf("expected sockets beyond the pool size to be closed, got %v", stats["idle_sockets"])
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := reused.Write([]byte{0}); err == nil {
+		t.Fatalf("expected Close to close pooled sockets")
+	}
+	if conn := pool.GetConn(addr); conn != nil {
+		t.Fatalf("expected no socket after Close")
+	}
+}
+
+// BenchmarkExchangeNewSocket measures a UDP exchange that opens a socket per
+// query, as without reuse.
+func BenchmarkExchangeNewSocket(b *testing.B) {
+	addr := startUDPServer(b)
+	client := &dns.Client{Timeout: time.Second}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	b.ReportAllocs()
+	for b.Loop() {
+		conn, err := client.Dial(addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := client.ExchangeWithConn(msg, conn); err != nil {
+			b.Fatal(err)
+		}
+		conn.Close()
+	}
+}
+
+// BenchmarkExchangeReusedSocket measures the same exchange over a socket
+// kept in the pool between queries.
+func BenchmarkExchangeReusedSocket(b *testing.B) {
+	addr := startUDPServer(b)
+	pool := NewClientPool(1, time.Second)
+	defer pool.Close()
+	client := &dns.Client{Timeout: time.Second}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	b.ReportAllocs()
+	for b.Loop() {
+		conn := pool.GetConn(addr)
+		if conn == nil {
+			var err error
+			if conn, err = client.Dial(addr); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if _, _, err := client.ExchangeWithConn(msg, conn); err != nil {
+			b.Fatal(err)
+		}
+		pool.PutConn(addr, conn)
+	}
+}
@@ -1,38 +1,94 @@
 package health
 
 import (
+	"encoding/json"
 	"log"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"dnsres/instrumentation"
 	"dnsres/metrics"
 )
 
+// CheckInterval is how often every server is checked.
+const CheckInterval = 30 * time.Second
+
+// Default hysteresis: a healthy server is marked unhealthy after this many
+// consecutive failed checks, and an unhealthy one healthy again after this
+// many consecutive successes.
+const (
+	DefaultUnhealthyThreshold = 3
+	DefaultHealthyThreshold   = 2
+)
+
 // HealthStatus represents the health status of the service
 type HealthStatus struct {
 	Status    string            `json:"status"`
 	Timestamp time.Time         `json:"timestamp"`
 	Details   map[string]string `json:"details,omitempty"`
+	// Servers holds each configured server's latest check result.
+	Servers map[string]ServerHealth `json:"servers,omitempty"`
+}
+
+// ServerHealth is the latest health check result for one server.
+type ServerHealth struct {
+	Healthy bool `json:"healthy"`
+	// LastCheck is when the server was last checked; it is zero until the
+	// first check completes.
+	LastCheck time.Time `json:"last_check"`
+	// ConsecutiveFailures counts failed checks since the last success.
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// LastLatency is the duration of the last check, e.g. "1.2ms".
+	LastLatency string `json:"last_latency,omitempty"`
+	// LastError is the error of the last check, if it failed.
+	LastError string `json:"last_error,omitempty"`
+
+	successes int
+}
+
+// Checked reports whether the server has been checked at least once.
+func (s ServerHealth) Checked() bool {
+	return !s.LastCheck.IsZero()
+}
+
+// Stale reports whether the last check is more than two check intervals
+// old at now, e.g. because checks are stuck. Unchecked servers are not
+// stale.
+func (s ServerHealth) Stale(now time.Time) bool {
+	return s.Checked() && now.Sub(s.LastCheck) > 2*CheckInterval
 }
 
 // HealthChecker implements a health check endpoint
 type HealthChecker struct {
 	servers []string
-	status  map[string]bool
+	status  map[string]ServerHealth
+	issues  map[string][]string
 	mu      sync.RWMutex
 	appLog  *log.Logger
 	level   instrumentation.Level
+
+	// Consecutive results needed to change a server's state; zero uses the
+	// defaults.
+	unhealthyThreshold int
+	healthyThreshold   int
+
+	// Resolver lifecycle, reported by /startupz and /readyz.
+	configLoaded atomic.Bool
+	ready        atomic.Bool
+
+	failOnUpstreamDown atomic.Bool
 }
 
 // NewHealthChecker creates a new health checker
 func NewHealthChecker(servers []string, appLog *log.Logger, level instrumentation.Level) *HealthChecker {
 	hc := &HealthChecker{
 		servers: servers,
-		status:  make(map[string]bool),
+		status:  make(map[string]ServerHealth),
+		issues:  make(map[string][]string),
 		appLog:  appLog,
 		level:   level,
 	}
@@ -40,41 +96,170 @@ func NewHealthChecker(servers []string, appLog *log.Logger, level instrumentatio
 	return hc
 }
 
-// ServeHTTP implements the http.Handler interface
+// SetThresholds sets how many consecutive failed checks mark a server
+// unhealthy and how many consecutive successes mark it healthy again. A
+// server's first check sets its state directly. Values below 1 restore the
+// defaults.
+func (hc *HealthChecker) SetThresholds(unhealthy, healthy int) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.unhealthyThreshold = unhealthy
+	hc.healthyThreshold = healthy
+}
+
+// SetFailOnUpstreamDown makes ServeHTTP answer 503 when no server is
+// reachable. By default upstream health is reported only in the body, so a
+// liveness probe does not restart a resolver that is correctly reporting an
+// outage.
+func (hc *HealthChecker) SetFailOnUpstreamDown(fail bool) {
+	hc.failOnUpstreamDown.Store(fail)
+}
+
+// ServeHTTP implements the http.Handler interface. The body reports whether
+// any server is reachable; with ?format=json it returns a HealthStatus with
+// per-server details. The status code is 200 unless SetFailOnUpstreamDown is
+// set and no server is reachable.
 func (hc *HealthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("format") != "json" {
+		healthy := hc.healthy()
+		body := "healthy"
+		if !healthy {
+			body = "unhealthy"
+		}
+		writeProbe(w, healthy || !hc.failOnUpstreamDown.Load(), body, body)
+		return
+	}
+
+	status := hc.Status()
+	w.Header().Set("Content-Type", "application/json")
+	if status.Status == "unhealthy" && hc.failOnUpstreamDown.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("health response write failed: %v", err)
+	}
+}
+
+// healthy reports whether any server is reachable.
+func (hc *HealthChecker) healthy() bool {
 	hc.mu.RLock()
 	defer hc.mu.RUnlock()
-
-	// Check if any server is healthy
-	healthy := false
 	for _, status := range hc.status {
-		if status {
-			healthy = true
-			break
+		if status.Healthy {
+			return true
 		}
 	}
+	return false
+}
 
-	if healthy {
-		w.WriteHeader(http.StatusOK)
-		if _, err := w.Write([]byte("healthy")); err != nil {
-			log.Printf("health response write failed: %v", err)
+// Status returns the overall status and each server's reachability and
+// issues. Checked servers are reported as "ok" or "unreachable", followed by
+// any issues; the overall status is "degraded" when a server has issues.
+// Servers lists every configured server, checked or not.
+func (hc *HealthChecker) Status() HealthStatus {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	status := HealthStatus{
+		Status:    "unhealthy",
+		Timestamp: time.Now(),
+		Details:   make(map[string]string),
+		Servers:   hc.snapshotLocked(),
+	}
+	degraded := false
+	for server, result := range hc.status {
+		detail := "unreachable"
+		if result.Healthy {
+			detail = "ok"
+			status.Status = "healthy"
 		}
-	} else {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		if _, err := w.Write([]byte("unhealthy")); err != nil {
-			log.Printf("health response write failed: %v", err)
+		if issues := hc.issues[server]; len(issues) > 0 {
+			detail += ": " + strings.Join(issues, ", ")
+			degraded = true
 		}
+		status.Details[server] = detail
+	}
+	if degraded && status.Status == "healthy" {
+		status.Status = "degraded"
 	}
+	return status
 }
 
-// StatusSnapshot returns a copy of the server health map.
-func (hc *HealthChecker) StatusSnapshot() map[string]bool {
+// SetServerIssues records problems found with server by checks outside the
+// health checker, such as answer interception. An empty list clears them.
+// Issues do not change the root probe's status code.
+func (hc *HealthChecker) SetServerIssues(server string, issues []string) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if len(issues) == 0 {
+		delete(hc.issues, server)
+		return
+	}
+	hc.issues[server] = append([]string(nil), issues...)
+}
+
+// MarkConfigLoaded records that the resolver has its final startup
+// configuration, including any remote overlay.
+func (hc *HealthChecker) MarkConfigLoaded() {
+	hc.configLoaded.Store(true)
+}
+
+// MarkReady records that a resolution cycle has resolved at least one
+// hostname. Readiness is not withdrawn by later failing cycles; the root
+// health check covers ongoing server reachability.
+func (hc *HealthChecker) MarkReady() {
+	if !hc.ready.Swap(true) {
+		hc.logf(instrumentation.Low, "resolver ready after first successful cycle")
+	}
+}
+
+// StartupHandler serves the startup probe: 200 once configuration is loaded.
+func (hc *HealthChecker) StartupHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProbe(w, hc.configLoaded.Load(), "started", "starting")
+	})
+}
+
+// LivenessHandler serves the liveness probe: 200 while the process can
+// serve HTTP, whatever the state of the upstream servers.
+func (hc *HealthChecker) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProbe(w, true, "alive", "")
+	})
+}
+
+// ReadyHandler serves the readiness probe: 200 once the first successful
+// resolution cycle has completed.
+func (hc *HealthChecker) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProbe(w, hc.ready.Load(), "ready", "not ready")
+	})
+}
+
+func writeProbe(w http.ResponseWriter, ok bool, okBody, failBody string) {
+	status, body := http.StatusOK, okBody
+	if !ok {
+		status, body = http.StatusServiceUnavailable, failBody
+	}
+	w.WriteHeader(status)
+	if _, err := w.Write([]byte(body)); err != nil {
+		log.Printf("health response write failed: %v", err)
+	}
+}
+
+// StatusSnapshot returns the latest check result of every configured
+// server. Servers not yet checked have a zero LastCheck.
+func (hc *HealthChecker) StatusSnapshot() map[string]ServerHealth {
 	hc.mu.RLock()
 	defer hc.mu.RUnlock()
+	return hc.snapshotLocked()
+}
 
-	snapshot := make(map[string]bool, len(hc.status))
-	for server, status := range hc.status {
-		snapshot[server] = status
+func (hc *HealthChecker) snapshotLocked() map[string]ServerHealth {
+	snapshot := make(map[string]ServerHealth, len(hc.servers))
+	for _, server := range hc.servers {
+		server = serverAddress(server)
+		snapshot[server] = hc.status[server]
 	}
 	return snapshot
 }
@@ -82,7 +267,7 @@ func (hc *HealthChecker) StatusSnapshot() map[string]bool {
 // checkLoop periodically checks the health of DNS servers
 func (hc *HealthChecker) checkLoop() {
 	hc.checkServers() // Run initial check immediately
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(CheckInterval)
 	defer ticker.Stop()
 
 	for range ticker.C {
@@ -90,30 +275,78 @@ func (hc *HealthChecker) checkLoop() {
 	}
 }
 
-// checkServers checks the health of all DNS servers
+// checkServers checks the health of all DNS servers. Each result is recorded
+// as soon as its check completes; the lock is not held while dialing.
 func (hc *HealthChecker) checkServers() {
-	hc.mu.Lock()
-	defer hc.mu.Unlock()
-
 	for _, server := range hc.servers {
-		// Assume port 53 if not specified
-		if !strings.Contains(server, ":") {
-			server = server + ":53"
-		}
+		server = serverAddress(server)
 		start := time.Now()
 		// Simple TCP connection check
 		conn, err := net.DialTimeout("tcp", server, 5*time.Second)
-		if err != nil {
-			hc.logf(instrumentation.Medium, "health check failed server=%s err=%v", server, err)
-			hc.status[server] = false
-			metrics.DNSResolutionFailure.WithLabelValues(server, "", "health_check").Inc()
-			continue
+		latency := time.Since(start)
+		if err == nil {
+			conn.Close()
+		}
+		hc.record(server, latency, err)
+	}
+}
+
+// record stores the outcome of a check of server that just completed. A
+// server's state flips only after enough consecutive results, except on its
+// first check.
+func (hc *HealthChecker) record(server string, latency time.Duration, err error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	result := hc.status[server]
+	first := !result.Checked()
+	wasHealthy := result.Healthy
+	result.LastCheck = time.Now()
+	result.LastLatency = latency.Round(time.Microsecond).String()
+	if err != nil {
+		hc.logf(instrumentation.Medium, "health check failed server=%s err=%v", server, err)
+		result.ConsecutiveFailures++
+		result.successes = 0
+		result.LastError = err.Error()
+		if first || result.ConsecutiveFailures >= threshold(hc.unhealthyThreshold, DefaultUnhealthyThreshold) {
+			result.Healthy = false
+		}
+		metrics.DNSResolutionFailure.WithLabelValues(server, "", "health_check").Inc()
+	} else {
+		result.successes++
+		result.ConsecutiveFailures = 0
+		result.LastError = ""
+		if first || result.successes >= threshold(hc.healthyThreshold, DefaultHealthyThreshold) {
+			result.Healthy = true
 		}
-		conn.Close()
-		hc.status[server] = true
 		metrics.DNSResolutionSuccess.WithLabelValues(server, "").Inc()
-		metrics.DNSResolutionDuration.WithLabelValues(server, "").Observe(time.Since(start).Seconds())
+		metrics.DNSResolutionDuration.WithLabelValues(server, "").Observe(latency.Seconds())
+	}
+	hc.status[server] = result
+	if result.Healthy {
+		metrics.HealthStatus.WithLabelValues(server).Set(1)
+	} else {
+		metrics.HealthStatus.WithLabelValues(server).Set(0)
+	}
+
+	if !first && result.Healthy != wasHealthy {
+		hc.logf(instrumentation.Low, "health state changed server=%s healthy=%t", server, result.Healthy)
+	}
+}
+
+func threshold(configured, fallback int) int {
+	if configured < 1 {
+		return fallback
+	}
+	return configured
+}
+
+// serverAddress assumes port 53 if server does not specify one.
+func serverAddress(server string) string {
+	if !strings.Contains(server, ":") {
+		return server + ":53"
 	}
+	return server
 }
 
 func (hc *HealthChecker) logf(level instrumentation.Level, format string, args ...any) {
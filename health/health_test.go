@@ -1,6 +1,8 @@
 package health
 
 import (
+	"encoding/json"
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -28,8 +30,8 @@ func TestHealthCheckerTCPProbe(t *testing.T) {
 	hc.checkServers()
 
 	hc.mu.RLock()
-	goodStatus := hc.status[goodAddr]
-	badStatus := hc.status[badAddr]
+	goodStatus := hc.status[goodAddr].Healthy
+	badStatus := hc.status[badAddr].Healthy
 	hc.mu.RUnlock()
 
 	if !goodStatus {
@@ -69,13 +71,32 @@ func TestHealthCheckerHandler(t *testing.T) {
 		t.Fatalf("expected body healthy, got %s", string(body))
 	}
 
+	// Upstream outages are reported in the body, not the status code.
 	bad := NewHealthChecker([]string{"127.0.0.1:1"}, nil, instrumentation.None)
 	bad.checkServers()
 	badResponse := httptest.NewRecorder()
 	bad.ServeHTTP(badResponse, request)
+	if badResponse.Code != http.StatusOK || badResponse.Body.String() != "unhealthy" {
+		t.Fatalf("expected 200 unhealthy, got %d %s", badResponse.Code, badResponse.Body.String())
+	}
+
+	bad.SetFailOnUpstreamDown(true)
+	badResponse = httptest.NewRecorder()
+	bad.ServeHTTP(badResponse, request)
 	if badResponse.Code != http.StatusServiceUnavailable {
 		t.Fatalf("expected status unavailable, got %d", badResponse.Code)
 	}
+	jsonResponse := httptest.NewRecorder()
+	bad.ServeHTTP(jsonResponse, httptest.NewRequest(http.MethodGet, "/?format=json", nil))
+	if jsonResponse.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected JSON status unavailable, got %d", jsonResponse.Code)
+	}
+
+	liveResponse := httptest.NewRecorder()
+	bad.LivenessHandler().ServeHTTP(liveResponse, request)
+	if liveResponse.Code != http.StatusOK || liveResponse.Body.String() != "alive" {
+		t.Fatalf("expected liveness 200 alive, got %d %s", liveResponse.Code, liveResponse.Body.String())
+	}
 }
 
 func TestHealthCheckerLoopStarts(t *testing.T) {
@@ -114,4 +135,151 @@ func TestHealthCheckerMetrics(t *testing.T) {
 	if afterFailure <= beforeFailure {
 		t.Fatalf("expected failure metric to increment")
 	}
+	if testutil.ToFloat64(metrics.HealthStatus.WithLabelValues(goodAddr)) != 1 || testutil.ToFloat64(metrics.HealthStatus.WithLabelValues(badAddr)) != 0 {
+		t.Fatalf("expected health_status 1 for %s and 0 for %s", goodAddr, badAddr)
+	}
+}
+
+func TestHealthCheckerLifecycleProbes(t *testing.T) {
+	hc := NewHealthChecker(nil, nil, instrumentation.None)
+
+	probe := func(handler http.Handler) (int, string) {
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/", nil))
+		return response.Code, response.Body.String()
+	}
+
+	if code, body := probe(hc.StartupHandler()); code != http.StatusServiceUnavailable || body != "starting" {
+		t.Fatalf("expected startup probe 503 starting, got %d %s", code, body)
+	}
+	if code, body := probe(hc.ReadyHandler()); code != http.StatusServiceUnavailable || body != "not ready" {
+		t.Fatalf("expected readiness probe 503 not ready, got %d %s", code, body)
+	}
+
+	hc.MarkConfigLoaded()
+	if code, _ := probe(hc.StartupHandler()); code != http.StatusOK {
+		t.Fatalf("expected startup probe 200 after config load, got %d", code)
+	}
+	if code, _ := probe(hc.ReadyHandler()); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected readiness probe 503 before first cycle, got %d", code)
+	}
+
+	hc.MarkReady()
+	if code, body := probe(hc.ReadyHandler()); code != http.StatusOK || body != "ready" {
+		t.Fatalf("expected readiness probe 200 ready, got %d %s", code, body)
+	}
+}
+
+func TestHealthCheckerJSONStatus(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open listener: %v", err)
+	}
+	defer listener.Close()
+
+	addr := listener.Addr().String()
+	hc := NewHealthChecker([]string{addr}, nil, instrumentation.None)
+	hc.checkServers()
+	hc.SetServerIssues(addr, []string{"nxdomain_redirect"})
+
+	response := httptest.NewRecorder()
+	hc.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/?format=json", nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status OK for a degraded server, got %d", response.Code)
+	}
+	var status HealthStatus
+	if err := json.Unmarshal(response.Body.Bytes(), &status); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if status.Status != "degraded" || status.Details[addr] != "ok: nxdomain_redirect" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	hc.SetServerIssues(addr, nil)
+	if status := hc.Status(); status.Status != "healthy" || status.Details[addr] != "ok" {
+		t.Fatalf("expected issues cleared, got %+v", status)
+	}
+}
+
+func TestHealthCheckerSnapshot(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open listener: %v", err)
+	}
+	defer listener.Close()
+
+	goodAddr := listener.Addr().String()
+	badAddr := "127.0.0.1:1"
+	hc := &HealthChecker{servers: []string{goodAddr, badAddr}, status: make(map[string]ServerHealth)}
+
+	// Every configured server is listed before its first check.
+	snapshot := hc.StatusSnapshot()
+	if len(snapshot) != 2 || snapshot[goodAddr].Checked() || snapshot[badAddr].Checked() {
+		t.Fatalf("expected two unchecked servers, got %+v", snapshot)
+	}
+
+	hc.checkServers()
+	hc.checkServers()
+	snapshot = hc.StatusSnapshot()
+	good, bad := snapshot[goodAddr], snapshot[badAddr]
+	if !good.Healthy || !good.Checked() || good.ConsecutiveFailures != 0 || good.LastLatency == "" || good.LastError != "" {
+		t.Fatalf("unexpected healthy server result %+v", good)
+	}
+	if bad.Healthy || !bad.Checked() || bad.ConsecutiveFailures != 2 || bad.LastError == "" {
+		t.Fatalf("unexpected failing server result %+v", bad)
+	}
+
+	if good.Stale(good.LastCheck.Add(2 * CheckInterval)) {
+		t.Fatalf("expected result fresh within two check intervals")
+	}
+	if !good.Stale(good.LastCheck.Add(2*CheckInterval + time.Second)) {
+		t.Fatalf("expected result stale after two check intervals")
+	}
+	if (ServerHealth{}).Stale(time.Now()) {
+		t.Fatalf("expected unchecked server not to be stale")
+	}
+
+	if status := hc.Status(); len(status.Servers) != 2 || status.Servers[badAddr].ConsecutiveFailures != 2 {
+		t.Fatalf("expected per-server results in JSON status, got %+v", status.Servers)
+	}
+}
+
+func TestHealthCheckerHysteresis(t *testing.T) {
+	const server = "192.0.2.53:53"
+	hc := &HealthChecker{servers: []string{server}, status: make(map[string]ServerHealth)}
+	hc.SetThresholds(3, 2)
+	failure := errors.New("connection refused")
+
+	steps := []struct {
+		err  error
+		want bool
+	}{
+		{nil, true}, // the first check sets the state directly
+		{failure, true},
+		{failure, true},
+		{failure, false}, // third consecutive failure
+		{nil, false},
+		{failure, false},
+		{nil, false},
+		{nil, true}, // second consecutive success
+	}
+	for i, step := range steps {
+		hc.record(server, time.Millisecond, step.err)
+		if got := hc.StatusSnapshot()[server].Healthy; got != step.want {
+			t.Fatalf("step %d: healthy = %v, want %v", i, got, step.want)
+		}
+	}
+
+	// Thresholds below 1 restore the defaults.
+	hc.SetThresholds(0, 0)
+	for range DefaultUnhealthyThreshold - 1 {
+		hc.record(server, time.Millisecond, failure)
+	}
+	if !hc.StatusSnapshot()[server].Healthy {
+		t.Fatalf("expected server healthy before %d failures", DefaultUnhealthyThreshold)
+	}
+	hc.record(server, time.Millisecond, failure)
+	if hc.StatusSnapshot()[server].Healthy {
+		t.Fatalf("expected server unhealthy after %d failures", DefaultUnhealthyThreshold)
+	}
 }
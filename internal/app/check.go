@@ -0,0 +1,68 @@
+package app
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	"dnsres/internal/dnsres"
+)
+
+// runCheck implements `dnsres check`: it loads and validates the config, runs
+// the preflight checks and prints a pass/fail line for each, without starting
+// the daemon. It returns an error when any check fails.
+func runCheck(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	configFile := flags.String("config", "", "Path to configuration file (default: auto-detect)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	configPath, err := dnsres.ResolveConfigPath(*configFile)
+	if err != nil {
+		return fmt.Errorf("failed to resolve config path: %w", err)
+	}
+	config := dnsres.DefaultConfig()
+	source := "built-in defaults"
+	if configPath != "" {
+		source = configPath
+		if config, err = dnsres.LoadConfig(configPath); err != nil {
+			problems := configProblems(err)
+			if len(problems) == 1 {
+				fmt.Fprintf(out, "FAIL  config %s: %s\n", configPath, problems[0])
+			} else {
+				fmt.Fprintf(out, "FAIL  config %s: %d problems\n", configPath, len(problems))
+				for _, problem := range problems {
+					fmt.Fprintf(out, "        %s\n", problem)
+				}
+			}
+			return fmt.Errorf("preflight failed: config is invalid")
+		}
+	}
+	fmt.Fprintf(out, "PASS  config %s\n", source)
+	for _, warning := range config.Warnings() {
+		fmt.Fprintf(out, "WARN  config: %s\n", warning)
+	}
+
+	failed := 0
+	results := dnsres.Preflight(context.Background(), config)
+	for _, result := range results {
+		if result.Passed() {
+			fmt.Fprintf(out, "PASS  %s", result.Name)
+			if result.Detail != "" {
+				fmt.Fprintf(out, ": %s", result.Detail)
+			}
+			fmt.Fprintln(out)
+			continue
+		}
+		failed++
+		fmt.Fprintf(out, "FAIL  %s: %v\n", result.Name, result.Err)
+	}
+
+	fmt.Fprintf(out, "%d passed, %d failed\n", len(results)+1-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("preflight failed: %d of %d checks failed", failed, len(results)+1)
+	}
+	return nil
+}
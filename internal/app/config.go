@@ -0,0 +1,60 @@
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"dnsres/internal/dnsres"
+)
+
+// runConfig implements `dnsres config validate`: it loads the config and
+// lists every problem with the JSON path of its setting, without probing
+// servers or ports as `dnsres check` does. It returns an error when the
+// config is invalid.
+func runConfig(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "validate" {
+		return fmt.Errorf("usage: dnsres config validate [-config path]")
+	}
+	flags := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	configFile := flags.String("config", "", "Path to configuration file (default: auto-detect)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	configPath, err := dnsres.ResolveConfigPath(*configFile)
+	if err != nil {
+		return fmt.Errorf("failed to resolve config path: %w", err)
+	}
+	if configPath == "" {
+		return fmt.Errorf("no configuration file found")
+	}
+	config, err := dnsres.LoadConfig(configPath)
+	if err != nil {
+		problems := configProblems(err)
+		fmt.Fprintf(out, "%s is not valid:\n", configPath)
+		for _, problem := range problems {
+			fmt.Fprintf(out, "  %s\n", problem)
+		}
+		return fmt.Errorf("config has %d problem(s)", len(problems))
+	}
+	fmt.Fprintf(out, "%s is valid\n", configPath)
+	for _, warning := range config.Warnings() {
+		fmt.Fprintf(out, "  warning: %s\n", warning)
+	}
+	return nil
+}
+
+// configProblems splits a LoadConfig error into one line per problem.
+func configProblems(err error) []string {
+	var errs dnsres.ConfigErrors
+	if !errors.As(err, &errs) {
+		return []string{err.Error()}
+	}
+	problems := make([]string, len(errs))
+	for i, problem := range errs {
+		problems[i] = problem.Error()
+	}
+	return problems
+}
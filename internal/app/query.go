@@ -0,0 +1,298 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"dnsres/internal/dnsres"
+
+	"github.com/mattn/go-isatty"
+)
+
+// ANSI styles for the pretty query output.
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiDim    = "\x1b[2m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+)
+
+// queryOutput is one hostname's results as written by -json and -yaml.
+type queryOutput struct {
+	Hostname   string        `json:"hostname"`
+	Consistent bool          `json:"consistent"`
+	Baseline   []string      `json:"baseline"`
+	Results    []queryResult `json:"results"`
+}
+
+// queryResult is one server's answer. Added and Removed list the addresses
+// that differ from the baseline.
+type queryResult struct {
+	Server     string   `json:"server"`
+	Rcode      string   `json:"rcode,omitempty"`
+	Addresses  []string `json:"addresses"`
+	TTL        uint32   `json:"ttl"`
+	DurationMS float64  `json:"duration_ms"`
+	Added      []string `json:"added,omitempty"`
+	Removed    []string `json:"removed,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	duration   time.Duration
+}
+
+// runQuery implements `dnsres query`: it resolves each hostname once through
+// every configured server and prints the answers side by side, marking those
+// that differ from the majority. It returns an error when any lookup failed.
+func runQuery(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	configFile := flags.String("config", "", "Path to configuration file (default: auto-detect)")
+	servers := flags.String("servers", "", "Comma-separated DNS servers to query instead of the configured ones")
+	jsonOutput := flags.Bool("json", false, "Write results as JSON")
+	yamlOutput := flags.Bool("yaml", false, "Write results as YAML")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *jsonOutput && *yamlOutput {
+		return errors.New("-json and -yaml cannot be combined")
+	}
+
+	configPath, err := dnsres.ResolveConfigPath(*configFile)
+	if err != nil {
+		return fmt.Errorf("failed to resolve config path: %w", err)
+	}
+	config := dnsres.DefaultConfig()
+	if configPath != "" {
+		if config, err = dnsres.LoadConfig(configPath); err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+	}
+
+	hostnames := flags.Args()
+	if len(hostnames) == 0 && len(config.Hostnames) == 0 {
+		return errors.New("hostname required: dnsres query [-config file] [-servers list] [-json|-yaml] hostname...")
+	}
+	settings := map[string]any{}
+	if len(hostnames) > 0 {
+		settings["hostnames"] = hostnames
+	}
+	if *servers != "" {
+		settings["dns_servers"] = strings.Split(*servers, ",")
+	}
+	if len(settings) > 0 {
+		if config, err = dnsres.EditConfig(config, settings); err != nil {
+			return err
+		}
+	}
+
+	outputs := make([]queryOutput, 0, len(config.Hostnames))
+	failed, total := 0, 0
+	for _, hostname := range config.Hostnames {
+		results := dnsres.Lookup(context.Background(), config, hostname)
+		outputs = append(outputs, newQueryOutput(hostname, results))
+		for _, result := range results {
+			total++
+			if result.Failed() {
+				failed++
+			}
+		}
+	}
+
+	switch {
+	case *jsonOutput:
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(outputs)
+	case *yamlOutput:
+		err = writeQueryYAML(out, outputs)
+	default:
+		writeQueryPretty(out, outputs, colorEnabled(out))
+	}
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("query failed: %d of %d lookups failed", failed, total)
+	}
+	return nil
+}
+
+func newQueryOutput(hostname string, results []dnsres.LookupResult) queryOutput {
+	diff := dnsres.LookupDiff(hostname, results)
+	output := queryOutput{
+		Hostname:   hostname,
+		Consistent: true,
+		Baseline:   diff.BaselineAddresses,
+		Results:    make([]queryResult, 0, len(results)),
+	}
+	for _, result := range results {
+		entry := queryResult{
+			Server:     result.Server,
+			Rcode:      result.Rcode,
+			Addresses:  result.Addresses,
+			TTL:        result.TTL,
+			DurationMS: float64(result.Duration.Microseconds()) / 1000,
+			duration:   result.Duration,
+		}
+		if entry.Addresses == nil {
+			entry.Addresses = []string{}
+		}
+		if result.Failed() {
+			entry.Error = result.Failure()
+		}
+		for _, server := range diff.Servers {
+			if server.Server == result.Server && server.Error == "" && server.Differs() {
+				entry.Added, entry.Removed = server.Added, server.Removed
+				output.Consistent = false
+			}
+		}
+		output.Results = append(output.Results, entry)
+	}
+	return output
+}
+
+// colorEnabled reports whether pretty output to out is colorized: out must
+// be a terminal and NO_COLOR unset or empty (https://no-color.org).
+func colorEnabled(out io.Writer) bool {
+	return os.Getenv("NO_COLOR") == "" && isTerminal(out)
+}
+
+// isTerminal reports whether out is an interactive terminal.
+func isTerminal(out io.Writer) bool {
+	file, ok := out.(*os.File)
+	return ok && isatty.IsTerminal(file.Fd())
+}
+
+// writeQueryPretty writes one aligned block per hostname. Failures are red,
+// and addresses a server has beyond the baseline are green (+) and those it
+// lacks red (-).
+func writeQueryPretty(out io.Writer, outputs []queryOutput, color bool) {
+	paint := func(style, text string) string {
+		if !color || text == "" {
+			return text
+		}
+		return style + text + ansiReset
+	}
+	for i, output := range outputs {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		status := paint(ansiGreen, "consistent")
+		if !output.Consistent {
+			status = paint(ansiYellow, "inconsistent")
+		}
+		fmt.Fprintf(out, "%s  %s\n", paint(ansiBold, dnsres.DisplayHostname(output.Hostname)), status)
+
+		serverWidth, rcodeWidth, timeWidth := 0, 0, 0
+		for _, result := range output.Results {
+			serverWidth = max(serverWidth, len(result.Server))
+			rcodeWidth = max(rcodeWidth, len(queryRcode(result)))
+			timeWidth = max(timeWidth, len(queryDuration(result)))
+		}
+		for _, result := range output.Results {
+			rcode := queryRcode(result)
+			rcodeStyle := ansiGreen
+			if result.Error != "" {
+				rcodeStyle = ansiRed
+			}
+			line := fmt.Sprintf("  %-*s  %s  %s",
+				serverWidth, result.Server,
+				paint(rcodeStyle, fmt.Sprintf("%-*s", rcodeWidth, rcode)),
+				paint(ansiDim, fmt.Sprintf("%*s", timeWidth, queryDuration(result))))
+			switch {
+			case result.Rcode == "":
+				line += "  " + paint(ansiRed, result.Error)
+			case result.Error == "":
+				line += fmt.Sprintf("  ttl %-6d %s", result.TTL, queryAnswer(result, paint))
+			}
+			fmt.Fprintln(out, strings.TrimRight(line, " "))
+		}
+	}
+}
+
+// queryAnswer renders a successful answer: its addresses, or how they differ
+// from the baseline.
+func queryAnswer(result queryResult, paint func(style, text string) string) string {
+	if len(result.Added) == 0 && len(result.Removed) == 0 {
+		if len(result.Addresses) == 0 {
+			return paint(ansiDim, "(no addresses)")
+		}
+		return strings.Join(result.Addresses, " ")
+	}
+	var parts []string
+	for _, address := range result.Added {
+		parts = append(parts, paint(ansiGreen, "+"+address))
+	}
+	for _, address := range result.Removed {
+		parts = append(parts, paint(ansiRed, "-"+address))
+	}
+	return strings.Join(parts, " ")
+}
+
+func queryRcode(result queryResult) string {
+	if result.Rcode == "" {
+		return "FAILED"
+	}
+	return result.Rcode
+}
+
+func queryDuration(result queryResult) string {
+	if result.Rcode == "" {
+		return "-"
+	}
+	return result.duration.Round(time.Millisecond).String()
+}
+
+// writeQueryYAML writes outputs as a YAML sequence. Strings are written as
+// JSON strings, which YAML reads as double-quoted scalars.
+func writeQueryYAML(out io.Writer, outputs []queryOutput) error {
+	quote := func(value string) string {
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+	list := func(values []string) string {
+		quoted := make([]string, len(values))
+		for i, value := range values {
+			quoted[i] = quote(value)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	}
+
+	var b strings.Builder
+	for _, output := range outputs {
+		fmt.Fprintf(&b, "- hostname: %s\n", quote(output.Hostname))
+		fmt.Fprintf(&b, "  consistent: %t\n", output.Consistent)
+		fmt.Fprintf(&b, "  baseline: %s\n", list(output.Baseline))
+		b.WriteString("  results:\n")
+		for _, result := range output.Results {
+			fmt.Fprintf(&b, "    - server: %s\n", quote(result.Server))
+			if result.Rcode != "" {
+				fmt.Fprintf(&b, "      rcode: %s\n", quote(result.Rcode))
+			}
+			fmt.Fprintf(&b, "      addresses: %s\n", list(result.Addresses))
+			fmt.Fprintf(&b, "      ttl: %d\n", result.TTL)
+			fmt.Fprintf(&b, "      duration_ms: %g\n", result.DurationMS)
+			if len(result.Added) > 0 {
+				fmt.Fprintf(&b, "      added: %s\n", list(result.Added))
+			}
+			if len(result.Removed) > 0 {
+				fmt.Fprintf(&b, "      removed: %s\n", list(result.Removed))
+			}
+			if result.Error != "" {
+				fmt.Fprintf(&b, "      error: %s\n", quote(result.Error))
+			}
+		}
+	}
+	if len(outputs) == 0 {
+		b.WriteString("[]\n")
+	}
+	_, err := io.WriteString(out, b.String())
+	return err
+}
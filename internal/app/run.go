@@ -3,10 +3,13 @@ package app
 import (
 	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
 	"syscall"
 
@@ -14,12 +17,30 @@ import (
 )
 
 func Run() error {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			return runCheck(os.Args[2:], os.Stdout)
+		case "config":
+			return runConfig(os.Args[2:], os.Stdout)
+		case "query":
+			return runQuery(os.Args[2:], os.Stdout)
+		case "watch":
+			return runWatch(os.Args[2:], os.Stdout)
+		}
+	}
+
 	// Parse command line flags
 	configFile := flag.String("config", "", "Path to configuration file (default: auto-detect)")
 	reportMode := flag.Bool("report", false, "Generate statistics report")
+	reportBy := flag.String("by", dnsres.ReportByHour, "Group report query counts by "+strings.Join(dnsres.ReportGroupings, ", "))
 	hostname := flag.String("host", "", "Override hostname from config file")
 	flag.Parse()
 
+	if !slices.Contains(dnsres.ReportGroupings, *reportBy) {
+		return fmt.Errorf("invalid -by %q: must be one of %s", *reportBy, strings.Join(dnsres.ReportGroupings, ", "))
+	}
+
 	args := flag.Args()
 	var positionalHost string
 	if len(args) > 0 {
@@ -27,35 +48,47 @@ func Run() error {
 	}
 
 	// Resolve config path
-	configPath, wasCreated, err := dnsres.ResolveConfigPath(*configFile)
+	configPath, err := dnsres.ResolveConfigPath(*configFile)
 	if err != nil {
 		return fmt.Errorf("failed to resolve config path: %w", err)
 	}
 
 	var config *dnsres.Config
-	if configPath == "" {
-		fmt.Println("No configuration file found; using built-in defaults")
-		config = dnsres.DefaultConfig()
-	} else {
-		fmt.Printf("Loading configuration from %s\n", configPath)
-		if wasCreated {
-			fmt.Printf("Created default configuration file at %s\n", configPath)
-		}
-
+	switch {
+	case configPath != "":
 		config, err = dnsres.LoadConfig(configPath)
 		if err != nil {
 			return fmt.Errorf("failed to load config: %w", err)
 		}
-		fmt.Println("Configuration loaded")
+	case positionalHost != "" || *hostname != "":
+		fmt.Println("No configuration file found; using built-in defaults")
+		config = dnsres.DefaultConfig()
+	default:
+		config, err = dnsres.FirstRunConfig(os.Stdin, os.Stdout)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Results written to stdout keep it to themselves; status goes to stderr.
+	status := io.Writer(os.Stdout)
+	if config.ResultsFile.Path == dnsres.ResultsFileStdout {
+		status = os.Stderr
+	}
+	if configPath != "" {
+		fmt.Fprintf(status, "Configuration loaded from %s\n", configPath)
+	}
+	for _, warning := range config.Warnings() {
+		fmt.Fprintf(status, "Warning: %s\n", warning)
 	}
 
 	// Override hostname if specified
 	if positionalHost != "" {
-		config.Hostnames = []string{positionalHost}
-		fmt.Printf("Hostname set from CLI: %s\n", positionalHost)
+		config.Hostnames = []string{dnsres.NormalizeHostname(positionalHost)}
+		fmt.Fprintf(status, "Hostname set from CLI: %s\n", positionalHost)
 	} else if *hostname != "" {
-		config.Hostnames = []string{*hostname}
-		fmt.Printf("Hostname override enabled: %s\n", *hostname)
+		config.Hostnames = []string{dnsres.NormalizeHostname(*hostname)}
+		fmt.Fprintf(status, "Hostname override enabled: %s\n", *hostname)
 	}
 
 	if len(config.Hostnames) == 0 {
@@ -63,28 +96,29 @@ func Run() error {
 	}
 
 	// Create resolver
-	fmt.Println("Validating configuration")
+	fmt.Fprintln(status, "Validating configuration")
 	resolver, err := dnsres.NewDNSResolver(config)
 	if err != nil {
 		return fmt.Errorf("failed to create DNS resolver: %w", err)
 	}
-	fmt.Println("Resolver initialized")
+	resolver.SetOutputWriter(status)
+	fmt.Fprintln(status, "Resolver initialized")
 
 	// Report log directory fallback
 	if resolver.LogDirWasFallback() {
-		fmt.Printf("\nNote: Using fallback log directory at %s\n", resolver.GetLogDir())
-		fmt.Printf("(XDG state directory unavailable)\n\n")
+		fmt.Fprintf(status, "\nNote: Using fallback log directory at %s\n", resolver.GetLogDir())
+		fmt.Fprintf(status, "(XDG state directory unavailable)\n\n")
 	}
 
 	// Handle report mode
 	if *reportMode {
-		fmt.Println("Report mode enabled; generating report")
-		fmt.Println(resolver.GenerateReport())
+		fmt.Fprintln(status, "Report mode enabled; generating report")
+		fmt.Println(resolver.GenerateReportBy(*reportBy))
 		return nil
 	}
 
-	fmt.Printf("Monitoring %d hostnames across %d DNS servers every %s\n", len(config.Hostnames), len(config.DNSServers), config.QueryInterval.Duration)
-	fmt.Println("Press q then Enter to quit")
+	fmt.Fprintf(status, "Monitoring %d hostnames across %d DNS servers every %s\n", len(config.Hostnames), len(config.DNSServers), config.QueryInterval.Duration)
+	fmt.Fprintln(status, "Press q then Enter to quit")
 
 	// Setup context with cancellation
 	ctx, cancel := context.WithCancel(context.Background())
@@ -95,7 +129,7 @@ func Run() error {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		sig := <-sigChan
-		fmt.Printf("Shutdown signal received (%s)\n", sig)
+		fmt.Fprintf(status, "Shutdown signal received (%s)\n", sig)
 		cancel()
 	}()
 
@@ -104,7 +138,7 @@ func Run() error {
 		for scanner.Scan() {
 			input := strings.TrimSpace(scanner.Text())
 			if strings.EqualFold(input, "q") {
-				fmt.Println("Quit requested; shutting down")
+				fmt.Fprintln(status, "Quit requested; shutting down")
 				cancel()
 				return
 			}
@@ -113,11 +147,25 @@ func Run() error {
 
 	// Start resolution
 	if err := resolver.Start(ctx); err != nil {
+		var listenErr *dnsres.ListenError
+		if errors.As(err, &listenErr) && listenErr.AddrInUse() {
+			return fmt.Errorf("failed to start DNS resolver: %w (another process holds the port; %s)", err, listenerHint(listenErr.Listener))
+		}
 		return fmt.Errorf("failed to start DNS resolver: %w", err)
 	}
 
 	// Print log location on exit
-	fmt.Printf("\nLogs written to: %s\n", resolver.GetLogDir())
+	fmt.Fprintf(status, "\nLogs written to: %s\n", resolver.GetLogDir())
 
 	return nil
 }
+
+// listenerHint says how to move a listener whose port is taken.
+func listenerHint(listener string) string {
+	switch listener {
+	case "health", "metrics":
+		return fmt.Sprintf("change %s_port, or set it to 0 to use any free port", listener)
+	default:
+		return fmt.Sprintf("change %s.port", listener)
+	}
+}
@@ -2,11 +2,19 @@ package app
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"dnsres/internal/dnsres"
+
+	"github.com/miekg/dns"
 )
 
 // TestConfigPathResolutionMessages tests that the CLI displays appropriate
@@ -29,18 +37,17 @@ func TestConfigPathResolutionMessages(t *testing.T) {
 			t.Fatalf("failed to write test config: %v", err)
 		}
 
-		// The CLI should print: "Loading configuration from <path>"
+		// The CLI should print: "Configuration loaded from <path>"
 		// We validate this behavior exists by checking the run.go code structure
 		// Full E2E validation is in integration tests
 		t.Logf("Explicit config path: %s", configPath)
 	})
 
-	t.Run("auto-created config shows creation message", func(t *testing.T) {
-		// When config is auto-created, the CLI should print both:
-		// - "Loading configuration from <path>"
-		// - "Created default configuration file at <path>"
+	t.Run("missing config without a hostname", func(t *testing.T) {
+		// With no config file and no hostname, the CLI runs the setup wizard
+		// on a terminal and otherwise fails without writing a config.
 		// This is validated in integration tests with real process execution
-		t.Log("Auto-created config message validation is in integration tests")
+		t.Log("First-run validation is in integration tests")
 	})
 }
 
@@ -130,3 +137,212 @@ func TestStdoutCapture(t *testing.T) {
 // Note: Full CLI integration testing (with actual Run() execution) is
 // performed in internal/integration/xdg_workflow_test.go which builds
 // and executes the real binary with various environment configurations.
+
+// TestRunCheckReportsInvalidConfig verifies that `dnsres check` fails with a
+// FAIL line when the config does not validate.
+func TestRunCheckReportsInvalidConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"hostnames": ["example.com"], "dns_servers": ["192.0.2.1"]}`), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	var out bytes.Buffer
+	err := runCheck([]string{"-config", configPath}, &out)
+	if err == nil {
+		t.Fatal("expected check to fail for an invalid config")
+	}
+	if !strings.HasPrefix(out.String(), "FAIL  config "+configPath) {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+// TestRunConfigValidateListsProblems verifies that `dnsres config validate`
+// prints every problem with its JSON path.
+func TestRunConfigValidateListsProblems(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	config := `{"hostnames": ["example.com"], "dns_servers": ["192.0.2.1"], "query_timeout": "5s", "query_interval": "0s", "circuit_breaker": {"threshold": 5, "timeout": "30s"}, "cache": {"max_size": 1000, "max_bytes": -1}}`
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := runConfig([]string{"validate", "-config", configPath}, &out); err == nil {
+		t.Fatal("expected validate to fail for an invalid config")
+	}
+	want := configPath + " is not valid:\n  query_interval: must be positive\n  cache.max_bytes: must not be negative\n"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
+
+// startQueryTestServer serves an A record with addresses for every name.
+func startQueryTestServer(t *testing.T, addresses ...string) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open listener: %v", err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		for _, address := range addresses {
+			reply.Answer = append(reply.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP(address),
+			})
+		}
+		_ = w.WriteMsg(reply)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+func TestRunQuery(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Chdir(t.TempDir())
+	first := startQueryTestServer(t, "192.0.2.10")
+	second := startQueryTestServer(t, "192.0.2.10")
+	odd := startQueryTestServer(t, "192.0.2.99")
+	servers := strings.Join([]string{first, second, odd}, ",")
+
+	t.Run("json", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := runQuery([]string{"-servers", servers, "-json", "www.example.com"}, &out); err != nil {
+			t.Fatalf("runQuery returned error: %v", err)
+		}
+		var outputs []queryOutput
+		if err := json.Unmarshal(out.Bytes(), &outputs); err != nil {
+			t.Fatalf("invalid JSON output %q: %v", out.String(), err)
+		}
+		if len(outputs) != 1 || outputs[0].Consistent || len(outputs[0].Results) != 3 {
+			t.Fatalf("unexpected output %+v", outputs)
+		}
+		if got := outputs[0].Results[2]; got.Server != odd || strings.Join(got.Added, ",") != "192.0.2.99" || strings.Join(got.Removed, ",") != "192.0.2.10" {
+			t.Errorf("expected odd server diff, got %+v", got)
+		}
+	})
+
+	t.Run("yaml", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := runQuery([]string{"-servers", first, "-yaml", "www.example.com"}, &out); err != nil {
+			t.Fatalf("runQuery returned error: %v", err)
+		}
+		for _, want := range []string{`- hostname: "www.example.com"`, "  consistent: true", `      addresses: ["192.0.2.10"]`, "      ttl: 300"} {
+			if !strings.Contains(out.String(), want+"\n") {
+				t.Errorf("expected line %q in output:\n%s", want, out.String())
+			}
+		}
+	})
+
+	t.Run("pretty without a terminal", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := runQuery([]string{"-servers", servers, "www.example.com"}, &out); err != nil {
+			t.Fatalf("runQuery returned error: %v", err)
+		}
+		if strings.Contains(out.String(), "\x1b[") {
+			t.Errorf("expected no color codes, got %q", out.String())
+		}
+		if !strings.Contains(out.String(), "www.example.com  inconsistent\n") || !strings.Contains(out.String(), "+192.0.2.99 -192.0.2.10") {
+			t.Errorf("unexpected output:\n%s", out.String())
+		}
+	})
+
+	t.Run("failed lookup", func(t *testing.T) {
+		silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to open listener: %v", err)
+		}
+		defer silent.Close()
+		configPath := filepath.Join(t.TempDir(), "config.json")
+		config := `{"hostnames": ["www.example.com"], "dns_servers": ["` + first + `", "` + silent.LocalAddr().String() + `"], "query_timeout": "100ms", "query_interval": "30s", "circuit_breaker": {"threshold": 5, "timeout": "30s"}, "cache": {"max_size": 1000}}`
+		if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+			t.Fatalf("failed to write test config: %v", err)
+		}
+		var out bytes.Buffer
+		err = runQuery([]string{"-config", configPath}, &out)
+		if err == nil || !strings.Contains(err.Error(), "1 of 2 lookups failed") {
+			t.Fatalf("expected failed lookup error, got %v", err)
+		}
+		if !strings.Contains(out.String(), "FAILED") {
+			t.Errorf("expected failed server in output:\n%s", out.String())
+		}
+	})
+}
+
+func TestWriteQueryPrettyColor(t *testing.T) {
+	outputs := []queryOutput{{
+		Hostname: "www.example.com",
+		Results: []queryResult{
+			{Server: "192.0.2.1:53", Rcode: "NOERROR", Addresses: []string{"192.0.2.10"}, TTL: 300},
+			{Server: "192.0.2.2:53", Rcode: "NOERROR", Addresses: []string{"192.0.2.99"}, TTL: 60, Added: []string{"192.0.2.99"}, Removed: []string{"192.0.2.10"}},
+			{Server: "192.0.2.3:53", Error: "i/o timeout"},
+		},
+	}}
+
+	var out bytes.Buffer
+	writeQueryPretty(&out, outputs, true)
+	for _, want := range []string{ansiGreen + "+192.0.2.99" + ansiReset, ansiRed + "-192.0.2.10" + ansiReset, ansiRed + "i/o timeout" + ansiReset, ansiYellow + "inconsistent" + ansiReset} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in output %q", want, out.String())
+		}
+	}
+
+	t.Setenv("NO_COLOR", "1")
+	if colorEnabled(os.Stdout) {
+		t.Error("expected NO_COLOR to disable color")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	server := startQueryTestServer(t, "192.0.2.10")
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open listener: %v", err)
+	}
+	defer silent.Close()
+
+	config, err := dnsres.EditConfig(dnsres.DefaultConfig(), map[string]any{
+		"hostnames":     []string{"www.example.com"},
+		"dns_servers":   []string{server, silent.LocalAddr().String()},
+		"query_timeout": "20ms",
+	})
+	if err != nil {
+		t.Fatalf("EditConfig returned error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+
+	var out bytes.Buffer
+	watch(ctx, &out, config, 30*time.Millisecond, false, false)
+	output := out.String()
+	if !strings.Contains(output, "Watching www.example.com every 30ms: round 2") {
+		t.Fatalf("expected several rounds, got:\n%s", output)
+	}
+	summary := output[strings.Index(output, "Summary for www.example.com"):]
+	for _, want := range []string{server, "100.0%", silent.LocalAddr().String(), "0.0%"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("expected %q in summary:\n%s", want, summary)
+		}
+	}
+	if strings.Contains(output, "\x1b[") {
+		t.Errorf("expected no escape codes without a terminal, got %q", output)
+	}
+}
+
+func TestWatchServerCountsAnswerChanges(t *testing.T) {
+	var stats watchServer
+	for _, addresses := range [][]string{{"192.0.2.1"}, {"192.0.2.1"}, nil, {"192.0.2.2"}, {"192.0.2.1"}} {
+		result := dnsres.LookupResult{Rcode: "NOERROR", Addresses: addresses, Duration: time.Millisecond}
+		if addresses == nil {
+			result = dnsres.LookupResult{Err: context.DeadlineExceeded}
+		}
+		stats.record(result)
+	}
+	if stats.queries != 5 || stats.failures != 1 || stats.changes != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.average() != time.Millisecond {
+		t.Fatalf("expected 1ms average, got %s", stats.average())
+	}
+}
@@ -0,0 +1,263 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"dnsres/internal/dnsres"
+)
+
+// Watch mode defaults.
+const (
+	defaultWatchInterval = 2 * time.Second
+	// maxWatchTimeout caps the query timeout, which otherwise follows the
+	// interval so a silent server cannot stall a round.
+	maxWatchTimeout = 5 * time.Second
+)
+
+// watchServer accumulates one server's results over a watch.
+type watchServer struct {
+	server   string
+	queries  int
+	failures int
+	// Latency of successful lookups.
+	total, min, max time.Duration
+	// changes counts answers that differed from the server's previous one.
+	changes int
+	answer  string
+	last    dnsres.LookupResult
+}
+
+func (w *watchServer) record(result dnsres.LookupResult) {
+	w.queries++
+	w.last = result
+	if result.Failed() {
+		w.failures++
+		return
+	}
+	if w.queries-w.failures == 1 || result.Duration < w.min {
+		w.min = result.Duration
+	}
+	w.max = max(w.max, result.Duration)
+	w.total += result.Duration
+
+	answer := strings.Join(result.Addresses, " ")
+	if w.queries-w.failures > 1 && answer != w.answer {
+		w.changes++
+	}
+	w.answer = answer
+}
+
+func (w *watchServer) average() time.Duration {
+	if successes := w.queries - w.failures; successes > 0 {
+		return w.total / time.Duration(successes)
+	}
+	return 0
+}
+
+// runWatch implements `dnsres watch`: it polls one hostname through the
+// system's resolvers and public ones until interrupted, redrawing a table in
+// place, then prints a summary. No config file is read.
+func runWatch(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interval := flags.Duration("interval", defaultWatchInterval, "Time between lookups")
+	servers := flags.String("servers", "", "Comma-separated DNS servers to query instead of the system and public ones")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: dnsres watch [-interval 2s] [-servers list] hostname")
+	}
+	if *interval <= 0 {
+		return errors.New("-interval must be positive")
+	}
+
+	serverList := dnsres.SuggestedDNSServers()
+	if *servers != "" {
+		serverList = strings.Split(*servers, ",")
+	}
+	config, err := dnsres.EditConfig(dnsres.DefaultConfig(), map[string]any{
+		"hostnames":     []string{flags.Arg(0)},
+		"dns_servers":   serverList,
+		"query_timeout": min(*interval, maxWatchTimeout).String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	watch(ctx, out, config, *interval, isTerminal(out), colorEnabled(out))
+	return nil
+}
+
+// watch looks up config's first hostname through every server each interval
+// until ctx is done. When live, the table is redrawn in place; otherwise each
+// round appends a table.
+func watch(ctx context.Context, out io.Writer, config *dnsres.Config, interval time.Duration, live, color bool) {
+	hostname := config.Hostnames[0]
+	stats := make([]*watchServer, len(config.DNSServers))
+	for i, server := range config.DNSServers {
+		stats[i] = &watchServer{server: server}
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	rounds, drawn := 0, 0
+	for ctx.Err() == nil {
+		results := dnsres.Lookup(ctx, config, hostname)
+		if ctx.Err() != nil {
+			break
+		}
+		rounds++
+		for i, result := range results {
+			stats[i].record(result)
+		}
+
+		table := watchTable(dnsres.DisplayHostname(hostname), interval, rounds, stats, color)
+		switch {
+		case live && drawn > 0:
+			// Move back to the top of the previous table and overwrite it.
+			fmt.Fprintf(out, "\x1b[%dA", drawn)
+			table = strings.ReplaceAll(table, "\n", "\x1b[K\n")
+		case drawn > 0:
+			fmt.Fprintln(out)
+		}
+		fmt.Fprint(out, table)
+		drawn = strings.Count(table, "\n")
+
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+
+	fmt.Fprintln(out)
+	fmt.Fprint(out, watchSummary(dnsres.DisplayHostname(hostname), rounds, time.Since(start), stats, color))
+}
+
+// watchTable renders the current state of every server.
+func watchTable(hostname string, interval time.Duration, rounds int, stats []*watchServer, color bool) string {
+	rows := [][]tableCell{{{text: "SERVER"}, {text: "STATUS"}, {text: "LATENCY"}, {text: "OK/FAIL"}, {text: "CHANGES"}, {text: "ANSWER"}}}
+	for _, s := range stats {
+		status := tableCell{text: s.last.Rcode, style: ansiGreen}
+		latency := s.last.Duration.Round(time.Millisecond).String()
+		answer := tableCell{text: strings.Join(s.last.Addresses, " ")}
+		switch {
+		case s.last.Rcode == "":
+			status = tableCell{text: "FAILED", style: ansiRed}
+			latency = "-"
+			answer = tableCell{text: s.last.Failure(), style: ansiRed}
+		case s.last.Failed():
+			status.style = ansiRed
+		}
+		changes := tableCell{text: fmt.Sprint(s.changes)}
+		if s.changes > 0 {
+			changes.style = ansiYellow
+		}
+		rows = append(rows, []tableCell{
+			{text: s.server},
+			status,
+			{text: latency},
+			{text: fmt.Sprintf("%d/%d", s.queries-s.failures, s.failures)},
+			changes,
+			answer,
+		})
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Watching %s every %s: round %d at %s (Ctrl+C to stop)\n",
+		paintCell(tableCell{text: hostname, style: ansiBold}, color), interval, rounds, time.Now().Format("15:04:05"))
+	writeTable(&b, rows, color)
+	return b.String()
+}
+
+// watchSummary renders the per-server totals printed when a watch ends.
+func watchSummary(hostname string, rounds int, elapsed time.Duration, stats []*watchServer, color bool) string {
+	rows := [][]tableCell{{{text: "SERVER"}, {text: "QUERIES"}, {text: "FAILED"}, {text: "SUCCESS"}, {text: "MIN"}, {text: "AVG"}, {text: "MAX"}, {text: "CHANGES"}}}
+	for _, s := range stats {
+		success := tableCell{text: "-"}
+		if s.queries > 0 {
+			success.text = fmt.Sprintf("%.1f%%", 100*float64(s.queries-s.failures)/float64(s.queries))
+			switch {
+			case s.failures == 0:
+				success.style = ansiGreen
+			case s.failures == s.queries:
+				success.style = ansiRed
+			default:
+				success.style = ansiYellow
+			}
+		}
+		latency := func(d time.Duration) tableCell {
+			if s.queries == s.failures {
+				return tableCell{text: "-"}
+			}
+			return tableCell{text: d.Round(time.Millisecond).String()}
+		}
+		rows = append(rows, []tableCell{
+			{text: s.server},
+			{text: fmt.Sprint(s.queries)},
+			{text: fmt.Sprint(s.failures)},
+			success,
+			latency(s.min),
+			latency(s.average()),
+			latency(s.max),
+			{text: fmt.Sprint(s.changes)},
+		})
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Summary for %s: %d rounds in %s\n", hostname, rounds, elapsed.Round(time.Second))
+	writeTable(&b, rows, color)
+	return b.String()
+}
+
+// tableCell is a table value and the ANSI style it is painted with.
+type tableCell struct {
+	text  string
+	style string
+}
+
+func paintCell(cell tableCell, color bool) string {
+	if !color || cell.style == "" || cell.text == "" {
+		return cell.text
+	}
+	return cell.style + cell.text + ansiReset
+}
+
+// writeTable writes rows with columns padded to their widest value. Padding
+// is computed before painting, so colors do not disturb the alignment.
+func writeTable(b *strings.Builder, rows [][]tableCell, color bool) {
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], len(cell.text))
+		}
+	}
+	for _, row := range rows {
+		var line strings.Builder
+		for i, cell := range row {
+			if i > 0 {
+				line.WriteString("  ")
+			}
+			line.WriteString(paintCell(cell, color))
+			if i < len(row)-1 {
+				line.WriteString(strings.Repeat(" ", widths[i]-len(cell.text)))
+			}
+		}
+		b.WriteString(line.String())
+		b.WriteString("\n")
+	}
+}
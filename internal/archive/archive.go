@@ -0,0 +1,89 @@
+// Package archive stores files in S3, Google Cloud Storage or Azure Blob
+// Storage.
+//
+// S3 and S3-compatible stores are signed with AWS Signature Version 4. GCS
+// is reached through its S3-compatible XML API with HMAC keys. Azure uses a
+// container SAS token.
+package archive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Backends.
+const (
+	S3    = "s3"
+	GCS   = "gcs"
+	Azure = "azure"
+)
+
+// Config selects and authenticates a store.
+type Config struct {
+	Backend string
+	// Bucket is the S3 or GCS bucket, or the Azure container.
+	Bucket string
+	// Endpoint overrides the service URL, e.g. for MinIO. S3 defaults to
+	// the regional AWS endpoint, GCS to https://storage.googleapis.com and
+	// Azure to https://<account>.blob.core.windows.net.
+	Endpoint string
+	// Region is the S3 region (default us-east-1).
+	Region string
+	// AccessKeyID, SecretAccessKey and SessionToken are S3 credentials or
+	// GCS HMAC keys.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Account and SASToken authenticate Azure.
+	Account  string
+	SASToken string
+}
+
+// Object is a stored object.
+type Object struct {
+	Key          string
+	LastModified time.Time
+}
+
+// Store puts, lists and deletes objects.
+type Store interface {
+	// Put uploads size bytes from body to key.
+	Put(ctx context.Context, key string, body io.ReadSeeker, size int64, contentType string) error
+	// List returns the objects whose keys start with prefix.
+	List(ctx context.Context, prefix string) ([]Object, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// New returns the store config describes. A nil client uses
+// http.DefaultClient.
+func New(config Config, client *http.Client) (Store, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("archive bucket must be set")
+	}
+	switch config.Backend {
+	case S3, GCS:
+		return newS3Store(config, client)
+	case Azure:
+		return newAzureStore(config, client)
+	}
+	return nil, fmt.Errorf("unknown archive backend %q", config.Backend)
+}
+
+// checkResponse turns a non-2xx response into an error that includes the
+// start of the body, where the services explain what went wrong.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	// Drop the query, which holds the SAS signature for Azure.
+	u := *resp.Request.URL
+	u.RawQuery = ""
+	return fmt.Errorf("%s %s: %s: %s", resp.Request.Method, u.String(), resp.Status, body)
+}
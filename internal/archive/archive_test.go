@@ -0,0 +1,125 @@
+package archive
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSignV4(t *testing.T) {
+	// The get-vanilla case from the AWS Signature Version 4 test suite.
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signV4(req, emptyPayloadHash, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", now)
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Fatalf("Authorization =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// fakeBucket is an in-memory object store answering both S3 and Azure
+// style requests.
+type fakeBucket struct {
+	t       *testing.T
+	mu      sync.Mutex
+	objects map[string]string
+	headers http.Header
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.headers = req.Header.Clone()
+	key := strings.TrimPrefix(req.URL.Path, "/bucket/")
+	switch req.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(req.Body)
+		b.objects[key] = string(body)
+	case http.MethodDelete:
+		delete(b.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		prefix := req.URL.Query().Get("prefix")
+		if req.URL.Query().Get("comp") == "list" {
+			io.WriteString(w, "<EnumerationResults><Blobs>")
+			for key := range b.objects {
+				if strings.HasPrefix(key, prefix) {
+					io.WriteString(w, "<Blob><Name>"+key+"</Name><Properties><Last-Modified>Mon, 12 Oct 2026 10:00:00 GMT</Last-Modified></Properties></Blob>")
+				}
+			}
+			io.WriteString(w, "</Blobs><NextMarker/></EnumerationResults>")
+			return
+		}
+		io.WriteString(w, "<ListBucketResult><IsTruncated>false</IsTruncated>")
+		for key := range b.objects {
+			if strings.HasPrefix(key, prefix) {
+				io.WriteString(w, "<Contents><Key>"+key+"</Key><LastModified>2026-10-12T10:00:00.000Z</LastModified></Contents>")
+			}
+		}
+		io.WriteString(w, "</ListBucketResult>")
+	}
+}
+
+func TestStores(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		header string
+	}{
+		{"s3", Config{Backend: S3, AccessKeyID: "key", SecretAccessKey: "secret"}, "Authorization"},
+		{"gcs", Config{Backend: GCS, AccessKeyID: "key", SecretAccessKey: "secret"}, "Authorization"},
+		{"azure", Config{Backend: Azure, SASToken: "?sv=2021-08-06&sig=abc"}, "X-Ms-Blob-Type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := &fakeBucket{t: t, objects: make(map[string]string)}
+			server := httptest.NewServer(bucket)
+			defer server.Close()
+
+			tt.config.Bucket = "bucket"
+			tt.config.Endpoint = server.URL
+			store, err := New(tt.config, server.Client())
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			ctx := context.Background()
+			body := "report contents"
+			if err := store.Put(ctx, "dnsres/probe 1/report.txt", strings.NewReader(body), int64(len(body)), "text/plain"); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			if bucket.objects["dnsres/probe 1/report.txt"] != body || bucket.headers.Get(tt.header) == "" {
+				t.Fatalf("expected object stored with %s header, got %v", tt.header, bucket.objects)
+			}
+
+			objects, err := store.List(ctx, "dnsres/")
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			want := time.Date(2026, 10, 12, 10, 0, 0, 0, time.UTC)
+			if len(objects) != 1 || objects[0].Key != "dnsres/probe 1/report.txt" || !objects[0].LastModified.Equal(want) {
+				t.Fatalf("unexpected listing %+v", objects)
+			}
+
+			if err := store.Delete(ctx, objects[0].Key); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if len(bucket.objects) != 0 {
+				t.Fatalf("expected the object to be deleted, got %v", bucket.objects)
+			}
+		})
+	}
+}
+
+func TestNewValidatesCredentials(t *testing.T) {
+	if _, err := New(Config{Backend: S3, Bucket: "bucket"}, nil); err == nil {
+		t.Fatal("expected missing S3 credentials to fail")
+	}
+	if _, err := New(Config{Backend: Azure, Bucket: "bucket", SASToken: "sig=abc"}, nil); err == nil {
+		t.Fatal("expected Azure without an account or endpoint to fail")
+	}
+}
@@ -0,0 +1,146 @@
+package archive
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// azureVersion is the Blob service REST API version requests ask for.
+const azureVersion = "2021-08-06"
+
+// azureStore talks to Azure Blob Storage with a container SAS token.
+type azureStore struct {
+	client *http.Client
+	// base is the container's URL.
+	base *url.URL
+	sas  url.Values
+}
+
+func newAzureStore(config Config, client *http.Client) (*azureStore, error) {
+	if config.SASToken == "" {
+		return nil, fmt.Errorf("archive azure sas_token must be set")
+	}
+	sas, err := url.ParseQuery(strings.TrimPrefix(config.SASToken, "?"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive azure sas_token: %w", err)
+	}
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		if config.Account == "" {
+			return nil, fmt.Errorf("archive azure account or endpoint must be set")
+		}
+		endpoint = "https://" + config.Account + ".blob.core.windows.net"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid archive endpoint %q", endpoint)
+	}
+	base := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: strings.TrimSuffix(u.Path, "/") + "/" + config.Bucket}
+	return &azureStore{client: client, base: base, sas: sas}, nil
+}
+
+// url returns the container URL, or a blob's when key is set, with query
+// and the SAS token.
+func (s *azureStore) url(key string, query url.Values) string {
+	u := *s.base
+	if key != "" {
+		u.Path += "/" + key
+	}
+	values := url.Values{}
+	for name, value := range s.sas {
+		values[name] = value
+	}
+	for name, value := range query {
+		values[name] = value
+	}
+	u.RawQuery = values.Encode()
+	return u.String()
+}
+
+func (s *azureStore) Put(ctx context.Context, key string, body io.ReadSeeker, size int64, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.url(key, nil), io.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Ms-Blob-Type", "BlockBlob")
+	return s.do(req, nil)
+}
+
+// azureListResult is the List Blobs response.
+type azureListResult struct {
+	Blobs struct {
+		Blob []struct {
+			Name       string `xml:"Name"`
+			Properties struct {
+				LastModified string `xml:"Last-Modified"`
+			} `xml:"Properties"`
+		} `xml:"Blob"`
+	} `xml:"Blobs"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func (s *azureStore) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url("", query), nil)
+		if err != nil {
+			return nil, err
+		}
+		var result azureListResult
+		if err := s.do(req, &result); err != nil {
+			return nil, err
+		}
+		for _, blob := range result.Blobs.Blob {
+			modified, err := time.Parse(time.RFC1123, blob.Properties.LastModified)
+			if err != nil {
+				return nil, fmt.Errorf("blob %s: invalid Last-Modified %q", blob.Name, blob.Properties.LastModified)
+			}
+			objects = append(objects, Object{Key: blob.Name, LastModified: modified})
+		}
+		if result.NextMarker == "" {
+			return objects, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+func (s *azureStore) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.url(key, nil), nil)
+	if err != nil {
+		return err
+	}
+	return s.do(req, nil)
+}
+
+func (s *azureStore) do(req *http.Request, out any) error {
+	req.Header.Set("X-Ms-Version", azureVersion)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// Keep the SAS signature out of logs.
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = strings.SplitN(urlErr.URL, "?", 2)[0]
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	if out != nil {
+		return xml.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
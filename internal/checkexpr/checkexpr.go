@@ -0,0 +1,434 @@
+// Package checkexpr implements the small expression language used for
+// per-hostname checks in the config, for example:
+//
+//	answers.size() >= 2 && ttl > 30 && all(addr, addr.startsWith("10."))
+//
+// Values are integers, strings, booleans and lists. Supported are the
+// operators || && ! == != < <= > >= + - * / % and in, list literals and
+// indexing, the methods size, startsWith, endsWith, contains and matches, and
+// the all/exists macros, written as list.all(x, predicate) or, over the
+// answers, all(x, predicate).
+package checkexpr
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// answersVariable is the list all() and exists() range over when called
+// without a receiver.
+const answersVariable = "answers"
+
+// Program is a compiled expression.
+type Program struct {
+	source string
+	root   node
+}
+
+// Compile parses source, rejecting references to anything other than
+// variables.
+func Compile(source string, variables ...string) (*Program, error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, scope: make(map[string]int, len(variables))}
+	for _, variable := range variables {
+		p.scope[variable] = 1
+	}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf("unexpected token")
+	}
+	return &Program{source: source, root: root}, nil
+}
+
+// String returns the source the program was compiled from.
+func (p *Program) String() string {
+	return p.source
+}
+
+// Eval evaluates the program with the given variable values. Integers of any
+// width, time.Duration (as milliseconds) and []string are converted to the
+// language's own types.
+func (p *Program) Eval(variables map[string]any) (any, error) {
+	env := &scope{values: make(map[string]any, len(variables))}
+	for name, value := range variables {
+		env.values[name] = normalize(value)
+	}
+	return p.root.eval(env)
+}
+
+// EvalBool evaluates the program and requires a boolean result.
+func (p *Program) EvalBool(variables map[string]any) (bool, error) {
+	value, err := p.Eval(variables)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression returned %s, not bool", typeName(value))
+	}
+	return result, nil
+}
+
+func normalize(value any) any {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case time.Duration:
+		return v.Milliseconds()
+	case []string:
+		list := make([]any, len(v))
+		for i, s := range v {
+			list[i] = s
+		}
+		return list
+	}
+	return value
+}
+
+type scope struct {
+	values map[string]any
+	parent *scope
+}
+
+func (s *scope) lookup(name string) (any, bool) {
+	for ; s != nil; s = s.parent {
+		if value, ok := s.values[name]; ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+type node interface {
+	eval(env *scope) (any, error)
+}
+
+type literalNode struct {
+	value any
+}
+
+func (n *literalNode) eval(*scope) (any, error) {
+	return n.value, nil
+}
+
+type identNode struct {
+	name string
+}
+
+func (n *identNode) eval(env *scope) (any, error) {
+	value, ok := env.lookup(n.name)
+	if !ok {
+		return nil, fmt.Errorf("variable %q has no value", n.name)
+	}
+	return value, nil
+}
+
+type listNode struct {
+	elements []node
+}
+
+func (n *listNode) eval(env *scope) (any, error) {
+	list := make([]any, 0, len(n.elements))
+	for _, element := range n.elements {
+		value, err := element.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+	return list, nil
+}
+
+type indexNode struct {
+	list  node
+	index node
+}
+
+func (n *indexNode) eval(env *scope) (any, error) {
+	value, err := n.list.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("cannot index %s", typeName(value))
+	}
+	value, err = n.index.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	i, ok := value.(int64)
+	if !ok {
+		return nil, fmt.Errorf("list index must be int, not %s", typeName(value))
+	}
+	if i < 0 || i >= int64(len(list)) {
+		return nil, fmt.Errorf("index %d out of range for list of %d", i, len(list))
+	}
+	return list[i], nil
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n *unaryNode) eval(env *scope) (any, error) {
+	value, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case bool:
+		if n.op == "!" {
+			return !v, nil
+		}
+	case int64:
+		if n.op == "-" {
+			return -v, nil
+		}
+	}
+	return nil, fmt.Errorf("operator %s does not apply to %s", n.op, typeName(value))
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n *binaryNode) eval(env *scope) (any, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "&&" || n.op == "||" {
+		l, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("operator %s needs bool operands, not %s", n.op, typeName(left))
+		}
+		if (n.op == "&&" && !l) || (n.op == "||" && l) {
+			return l, nil
+		}
+		right, err := n.right.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("operator %s needs bool operands, not %s", n.op, typeName(right))
+		}
+		return r, nil
+	}
+
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return reflect.DeepEqual(left, right), nil
+	case "!=":
+		return !reflect.DeepEqual(left, right), nil
+	case "in":
+		list, ok := right.([]any)
+		if !ok {
+			return nil, fmt.Errorf("right side of in must be a list, not %s", typeName(right))
+		}
+		return listContains(list, left), nil
+	}
+
+	switch l := left.(type) {
+	case int64:
+		r, ok := right.(int64)
+		if !ok {
+			break
+		}
+		switch n.op {
+		case "<":
+			return l < r, nil
+		case "<=":
+			return l <= r, nil
+		case ">":
+			return l > r, nil
+		case ">=":
+			return l >= r, nil
+		case "+":
+			return l + r, nil
+		case "-":
+			return l - r, nil
+		case "*":
+			return l * r, nil
+		case "/", "%":
+			if r == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if n.op == "/" {
+				return l / r, nil
+			}
+			return l % r, nil
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			break
+		}
+		switch n.op {
+		case "<":
+			return l < r, nil
+		case "<=":
+			return l <= r, nil
+		case ">":
+			return l > r, nil
+		case ">=":
+			return l >= r, nil
+		case "+":
+			return l + r, nil
+		}
+	case []any:
+		if r, ok := right.([]any); ok && n.op == "+" {
+			return append(append([]any(nil), l...), r...), nil
+		}
+	}
+	return nil, fmt.Errorf("operator %s does not apply to %s and %s", n.op, typeName(left), typeName(right))
+}
+
+type methodNode struct {
+	receiver node
+	name     string
+	args     []node
+}
+
+func (n *methodNode) eval(env *scope) (any, error) {
+	receiver, err := n.receiver.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]any, 0, len(n.args))
+	for _, arg := range n.args {
+		value, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+	}
+
+	if n.name == "size" {
+		if len(args) != 0 {
+			return nil, fmt.Errorf("size() takes no arguments")
+		}
+		switch r := receiver.(type) {
+		case string:
+			return int64(len(r)), nil
+		case []any:
+			return int64(len(r)), nil
+		}
+		return nil, fmt.Errorf("size() does not apply to %s", typeName(receiver))
+	}
+
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s() takes one argument", n.name)
+	}
+	if list, ok := receiver.([]any); ok && n.name == "contains" {
+		return listContains(list, args[0]), nil
+	}
+	s, ok := receiver.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s() does not apply to %s", n.name, typeName(receiver))
+	}
+	arg, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s() needs a string argument, not %s", n.name, typeName(args[0]))
+	}
+	switch n.name {
+	case "startsWith":
+		return strings.HasPrefix(s, arg), nil
+	case "endsWith":
+		return strings.HasSuffix(s, arg), nil
+	case "contains":
+		return strings.Contains(s, arg), nil
+	case "matches":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+		return re.MatchString(s), nil
+	}
+	return nil, fmt.Errorf("unknown method %s()", n.name)
+}
+
+// macroNode is all(x, predicate) or exists(x, predicate) over a list.
+type macroNode struct {
+	kind      string
+	list      node
+	variable  string
+	predicate node
+}
+
+func (n *macroNode) eval(env *scope) (any, error) {
+	value, err := n.list.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s() needs a list, not %s", n.kind, typeName(value))
+	}
+	inner := &scope{values: make(map[string]any, 1), parent: env}
+	for _, element := range list {
+		inner.values[n.variable] = element
+		value, err := n.predicate.eval(inner)
+		if err != nil {
+			return nil, err
+		}
+		matched, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s() predicate returned %s, not bool", n.kind, typeName(value))
+		}
+		if n.kind == "all" && !matched {
+			return false, nil
+		}
+		if n.kind == "exists" && matched {
+			return true, nil
+		}
+	}
+	return n.kind == "all", nil
+}
+
+func listContains(list []any, value any) bool {
+	for _, element := range list {
+		if reflect.DeepEqual(element, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func typeName(value any) string {
+	switch value.(type) {
+	case int64:
+		return "int"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case []any:
+		return "list"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", value)
+}
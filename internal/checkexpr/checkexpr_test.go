@@ -0,0 +1,92 @@
+package checkexpr
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	variables := map[string]any{
+		"answers":  []string{"10.0.0.1", "10.0.0.2"},
+		"ttl":      uint32(300),
+		"hostname": "www.example.com",
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{expr: `answers.size() >= 2 && ttl > 30 && all(addr, addr.startsWith("10."))`, want: true},
+		{expr: `answers.exists(a, a == "10.0.0.9")`, want: false},
+		{expr: `"10.0.0.2" in answers`, want: true},
+		{expr: `size(answers) == 2 && answers[0].endsWith(".1")`, want: true},
+		{expr: `!(ttl < 60) || hostname.matches("^api\\.")`, want: true},
+		{expr: `ttl / 60 * 60 + 1 == 301 && ttl % 7 == 6`, want: true},
+		{expr: `hostname.contains("example") && 'www' + '.' < "x"`, want: true},
+		{expr: `answers.all(a, answers.exists(b, b != a))`, want: true},
+		{expr: `[] == [] && -ttl < 0`, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			program, err := Compile(tt.expr, "answers", "ttl", "hostname")
+			if err != nil {
+				t.Fatalf("compile failed: %v", err)
+			}
+			got, err := program.EvalBool(variables)
+			if err != nil {
+				t.Fatalf("eval failed: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr string
+	}{
+		{expr: `tll > 30`, wantErr: `unknown variable "tll"`},
+		{expr: `ttl >`, wantErr: "unexpected token"},
+		{expr: `ttl > 30)`, wantErr: "unexpected token"},
+		{expr: `"open`, wantErr: "unterminated string"},
+		{expr: `ttl # 3`, wantErr: "unexpected character"},
+		{expr: `all(1, true)`, wantErr: "needs a variable name"},
+		{expr: `answers.all(a, a) && a`, wantErr: `unknown variable "a"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := Compile(tt.expr, "answers", "ttl")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr string
+	}{
+		{expr: `ttl`, wantErr: "not bool"},
+		{expr: `ttl > "30"`, wantErr: "does not apply to int and string"},
+		{expr: `ttl / 0 == 1`, wantErr: "division by zero"},
+		{expr: `answers[5] == ""`, wantErr: "out of range"},
+		{expr: `ttl.startsWith("1")`, wantErr: "does not apply to int"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			program, err := Compile(tt.expr, "answers", "ttl")
+			if err != nil {
+				t.Fatalf("compile failed: %v", err)
+			}
+			_, err = program.EvalBool(map[string]any{"answers": []string{"10.0.0.1"}, "ttl": 60})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
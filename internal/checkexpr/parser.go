@@ -0,0 +1,256 @@
+package checkexpr
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// binaryPrecedence lists binary operators from loosest to tightest binding.
+var binaryPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	// scope counts the bindings of each visible name: declared variables
+	// once, plus one per enclosing macro that binds it.
+	scope map[string]int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOp(text string) bool {
+	t := p.peek()
+	return (t.kind == tokenOp || (t.kind == tokenIdent && text == "in")) && t.text == text
+}
+
+func (p *parser) expect(text string) error {
+	if !p.isOp(text) {
+		return p.errorf("expected %q", text)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	t := p.peek()
+	found := t.text
+	if t.kind == tokenEOF {
+		found = "end of expression"
+	}
+	return fmt.Errorf("%s at offset %d (found %s)", fmt.Sprintf(format, args...), t.pos, found)
+}
+
+func (p *parser) parseExpr() (node, error) {
+	return p.parseBinary(0)
+}
+
+func (p *parser) parseBinary(level int) (node, error) {
+	if level == len(binaryPrecedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, candidate := range binaryPrecedence[level] {
+			if p.isOp(candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isOp("!") || p.isOp("-") {
+		op := p.next().text
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.isOp("."):
+			p.next()
+			name := p.next()
+			if name.kind != tokenIdent {
+				return nil, fmt.Errorf("expected method name at offset %d", name.pos)
+			}
+			if name.text == "all" || name.text == "exists" {
+				n, err = p.parseMacro(name.text, n)
+			} else {
+				var args []node
+				args, err = p.parseArgs()
+				n = &methodNode{receiver: n, name: name.text, args: args}
+			}
+			if err != nil {
+				return nil, err
+			}
+		case p.isOp("["):
+			p.next()
+			index, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			n = &indexNode{list: n, index: index}
+		default:
+			return n, nil
+		}
+	}
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokenInt:
+		p.next()
+		value, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s at offset %d", t.text, t.pos)
+		}
+		return &literalNode{value: value}, nil
+	case t.kind == tokenString:
+		p.next()
+		return &literalNode{value: t.text}, nil
+	case t.kind == tokenIdent:
+		p.next()
+		switch t.text {
+		case "true", "false":
+			return &literalNode{value: t.text == "true"}, nil
+		case "all", "exists":
+			if p.isOp("(") {
+				// Without a receiver the macros range over the answers.
+				if p.scope[answersVariable] == 0 {
+					return nil, fmt.Errorf("%s() without a receiver needs the %s variable", t.text, answersVariable)
+				}
+				return p.parseMacro(t.text, &identNode{name: answersVariable})
+			}
+		case "size":
+			if p.isOp("(") {
+				args, err := p.parseArgs()
+				if err != nil {
+					return nil, err
+				}
+				if len(args) != 1 {
+					return nil, fmt.Errorf("size() takes one argument")
+				}
+				return &methodNode{receiver: args[0], name: "size"}, nil
+			}
+		}
+		if p.scope[t.text] == 0 {
+			return nil, fmt.Errorf("unknown variable %q at offset %d", t.text, t.pos)
+		}
+		return &identNode{name: t.text}, nil
+	case p.isOp("("):
+		p.next()
+		n, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	case p.isOp("["):
+		p.next()
+		list := &listNode{}
+		for !p.isOp("]") {
+			if len(list.elements) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			element, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			list.elements = append(list.elements, element)
+		}
+		p.next()
+		return list, nil
+	}
+	return nil, p.errorf("unexpected token")
+}
+
+func (p *parser) parseArgs() ([]node, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var args []node
+	for !p.isOp(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next()
+	return args, nil
+}
+
+// parseMacro parses the (variable, predicate) arguments of all and exists,
+// with variable bound while the predicate is parsed.
+func (p *parser) parseMacro(kind string, list node) (node, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	variable := p.next()
+	if variable.kind != tokenIdent {
+		return nil, fmt.Errorf("%s() needs a variable name at offset %d", kind, variable.pos)
+	}
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	p.scope[variable.text]++
+	predicate, err := p.parseExpr()
+	p.scope[variable.text]--
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return &macroNode{kind: kind, list: list, variable: variable.text, predicate: predicate}, nil
+}
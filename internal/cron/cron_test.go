@@ -0,0 +1,82 @@
+package cron
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// Wednesday
+	base := time.Date(2026, time.March, 11, 8, 59, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/15 9-17 * * MON-FRI", time.Date(2026, time.March, 11, 9, 0, 0, 0, time.UTC)},
+		{"*/5 * 22-23 14 3 *", time.Date(2026, time.March, 14, 22, 0, 0, 0, time.UTC)},
+		{"0 12 * * sat,sun", time.Date(2026, time.March, 14, 12, 0, 0, 0, time.UTC)},
+		{"30 8 1 * *", time.Date(2026, time.April, 1, 8, 30, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2026, time.March, 13, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, time.March, 15, 0, 0, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2026, time.March, 11, 9, 5, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, time.March, 11, 9, 0, 0, 0, time.UTC)},
+		{"@every 5s", time.Date(2026, time.March, 11, 8, 59, 35, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			schedule, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if got := schedule.Next(base); !got.Equal(tt.want) {
+				t.Fatalf("Next = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextSecondsField(t *testing.T) {
+	schedule, err := Parse("*/5 * 22-23 14 3 *")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	at := time.Date(2026, time.March, 14, 22, 0, 0, 0, time.UTC)
+	if got := schedule.Next(at); !got.Equal(at.Add(5 * time.Second)) {
+		t.Fatalf("expected firing every 5s inside the window, got %s", got)
+	}
+	end := time.Date(2026, time.March, 14, 23, 59, 55, 0, time.UTC)
+	if got := schedule.Next(end); !got.Equal(time.Date(2027, time.March, 14, 22, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected the window to close until next year, got %s", got)
+	}
+}
+
+func TestNextNeverFires(t *testing.T) {
+	schedule, err := Parse("0 0 30 2 *")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if got := schedule.Next(time.Now()); !got.IsZero() {
+		t.Fatalf("expected zero time for February 30, got %s", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"* * * *":         "5 or 6 fields",
+		"60 * * * *":      "invalid minute",
+		"* * * * funday":  "invalid day of week",
+		"* 17-9 * * *":    "invalid range",
+		"*/0 * * * *":     "invalid step",
+		"@sometimes":      "unknown descriptor",
+		"@every 100ms":    "at least 1s",
+		"@every forever":  "invalid @every",
+		"* * * 13 * * *":  "5 or 6 fields",
+		"* * * * jan-foo": "invalid day of week",
+	}
+	for expr, want := range tests {
+		if _, err := Parse(expr); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Parse(%q) error = %v, want %q", expr, err, want)
+		}
+	}
+}
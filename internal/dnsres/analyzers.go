@@ -0,0 +1,67 @@
+package dnsres
+
+import (
+	"time"
+
+	"dnsres/dnsanalysis"
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+)
+
+// runAnalyzers passes each response, then the whole set, to every enabled
+// analyzer and reports what they find.
+func (r *DNSResolver) runAnalyzers(set dnsanalysis.ResponseSet) {
+	for _, analyzer := range dnsanalysis.Analyzers() {
+		if !r.currentConfig().analyzerEnabled(analyzer.Name()) {
+			continue
+		}
+		for _, response := range set.Responses {
+			for _, finding := range analyzer.AnalyzeResponse(response) {
+				r.reportFinding(finding)
+			}
+		}
+		for _, finding := range analyzer.AnalyzeSet(set) {
+			r.reportFinding(finding)
+		}
+	}
+}
+
+// reportFinding records a finding in metrics, logs and events. Consistency
+// findings keep the inconsistent event type existing subscribers watch for.
+func (r *DNSResolver) reportFinding(finding dnsanalysis.Finding) {
+	metrics.DNSResAnalyzerFindings.WithLabelValues(finding.Analyzer, finding.Severity).Inc()
+
+	if finding.Analyzer == dnsanalysis.AnalyzerConsistency {
+		consistentValue := false
+		r.emitEvent(ResolverEvent{
+			Type:       EventInconsistent,
+			Time:       time.Now(),
+			Hostname:   finding.Hostname,
+			Consistent: &consistentValue,
+			Detail:     finding.Detail,
+		})
+		r.appLogf(instrumentation.High, "inconsistent responses hostname=%s", finding.Hostname)
+		r.errorLog.Printf("Inconsistent responses for %s: %s", finding.Hostname, finding.Message)
+		return
+	}
+
+	detail := finding.Detail
+	if detail == "" {
+		detail = finding.Message
+	}
+	r.emitEvent(ResolverEvent{
+		Type:     EventAnalyzerFinding,
+		Time:     time.Now(),
+		Hostname: finding.Hostname,
+		Server:   finding.Server,
+		Detail:   detail,
+		Severity: finding.Severity,
+		Source:   finding.Analyzer,
+	})
+	r.appLogf(instrumentation.Medium, "analyzer finding analyzer=%s severity=%s hostname=%s server=%s", finding.Analyzer, finding.Severity, finding.Hostname, finding.Server)
+	if finding.Server != "" {
+		r.errorLog.Printf("Analyzer %s (%s) flagged %s using %s: %s", finding.Analyzer, finding.Severity, finding.Hostname, finding.Server, finding.Message)
+		return
+	}
+	r.errorLog.Printf("Analyzer %s (%s) flagged %s: %s", finding.Analyzer, finding.Severity, finding.Hostname, finding.Message)
+}
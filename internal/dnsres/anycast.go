@@ -0,0 +1,212 @@
+package dnsres
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// chaosProbeNames are queried in order until one returns a TXT answer.
+var chaosProbeNames = []string{"id.server.", "hostname.bind."}
+
+// NodeInfo describes the anycast node most recently seen for a server.
+type NodeInfo struct {
+	Node     string
+	Source   string
+	Changes  int
+	LastSeen time.Time
+}
+
+// nodeTracker remembers which anycast node answered for each server. NSID and
+// CHAOS probes can name the same node differently, so each source is tracked
+// on its own and only a change within one source counts as re-routing.
+type nodeTracker struct {
+	mu    sync.Mutex
+	nodes map[nodeKey]*NodeInfo
+}
+
+type nodeKey struct {
+	server string
+	source string
+}
+
+func newNodeTracker() *nodeTracker {
+	return &nodeTracker{nodes: make(map[nodeKey]*NodeInfo)}
+}
+
+// record stores node for server as seen by source and returns the previous
+// node from that source when it changed.
+func (t *nodeTracker) record(server, node, source string, now time.Time) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := nodeKey{server: server, source: source}
+	info, ok := t.nodes[key]
+	if !ok {
+		t.nodes[key] = &NodeInfo{Node: node, Source: source, LastSeen: now}
+		return "", false
+	}
+	previous := info.Node
+	info.LastSeen = now
+	if previous == node {
+		return "", false
+	}
+	info.Node = node
+	info.Changes++
+	return previous, true
+}
+
+// snapshot returns, for each server, the node its most recent source saw and
+// the changes counted across all sources.
+func (t *nodeTracker) snapshot() map[string]NodeInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := make(map[string]NodeInfo)
+	for key, info := range t.nodes {
+		latest, ok := snapshot[key.server]
+		changes := info.Changes + latest.Changes
+		if !ok || info.LastSeen.After(latest.LastSeen) {
+			latest = *info
+		}
+		latest.Changes = changes
+		snapshot[key.server] = latest
+	}
+	return snapshot
+}
+
+// NodeSnapshot returns the anycast node last identified for each server.
+func (r *DNSResolver) NodeSnapshot() map[string]NodeInfo {
+	if r.nodes == nil {
+		return map[string]NodeInfo{}
+	}
+	return r.nodes.snapshot()
+}
+
+// requestNSID adds an empty NSID option to msg's OPT record.
+func requestNSID(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(4096, false)
+		opt = msg.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+}
+
+// responseNSID extracts the NSID returned by the server, if any.
+func responseNSID(msg *dns.Msg) string {
+	if msg == nil {
+		return ""
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, option := range opt.Option {
+		nsid, ok := option.(*dns.EDNS0_NSID)
+		if !ok || nsid.Nsid == "" {
+			continue
+		}
+		return decodeNSID(nsid.Nsid)
+	}
+	return ""
+}
+
+// decodeNSID renders the hex-encoded NSID as text when it is printable.
+func decodeNSID(value string) string {
+	raw, err := hex.DecodeString(value)
+	if err != nil {
+		return value
+	}
+	for _, c := range string(raw) {
+		if !unicode.IsPrint(c) {
+			return value
+		}
+	}
+	return string(raw)
+}
+
+// probeChaosIdentity asks server for its identity via CHAOS-class TXT queries.
+func (r *DNSResolver) probeChaosIdentity(ctx context.Context, server string) (string, error) {
+	client, err := r.getClient(server)
+	if err != nil {
+		return "", fmt.Errorf("failed to get client from pool: %w", err)
+	}
+	defer r.putClient(server, client)
+
+	var lastErr error
+	for _, name := range chaosProbeNames {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeTXT)
+		msg.Question[0].Qclass = dns.ClassCHAOS
+		msg.RecursionDesired = false
+
+		response, _, err := client.ExchangeContext(ctx, msg, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, answer := range response.Answer {
+			if txt, ok := answer.(*dns.TXT); ok && len(txt.Txt) > 0 {
+				return strings.Join(txt.Txt, " "), nil
+			}
+		}
+	}
+	if lastErr != nil {
+		return "", lastErr
+	}
+	return "", fmt.Errorf("no CHAOS identity returned")
+}
+
+// identifyNodes runs CHAOS identity probes for every server that enables them.
+func (r *DNSResolver) identifyNodes(ctx context.Context) {
+	config := r.currentConfig()
+	var wg sync.WaitGroup
+	for _, server := range config.DNSServers {
+		if !config.Settings(server).ChaosProbe {
+			continue
+		}
+		wg.Add(1)
+		go func(s string) {
+			defer wg.Done()
+			node, err := r.probeChaosIdentity(ctx, s)
+			if err != nil {
+				r.appLogf(instrumentation.Medium, "chaos identity probe failed server=%s err=%v", s, err)
+				return
+			}
+			r.recordNode(s, node, "chaos")
+		}(server)
+	}
+	wg.Wait()
+}
+
+// recordNode tracks the node identity for server and reports re-routing.
+func (r *DNSResolver) recordNode(server, node, source string) {
+	if r.nodes == nil || node == "" {
+		return
+	}
+	now := time.Now()
+	previous, changed := r.nodes.record(server, node, source, now)
+	if !changed {
+		return
+	}
+	metrics.DNSServerNodeChanges.WithLabelValues(server).Inc()
+	r.appLogf(instrumentation.Low, "anycast node change server=%s from=%s to=%s source=%s", server, previous, node, source)
+	r.emitEvent(ResolverEvent{
+		Type:         EventNodeChange,
+		Time:         now,
+		Server:       server,
+		Node:         node,
+		PreviousNode: previous,
+		Source:       source,
+	})
+}
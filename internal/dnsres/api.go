@@ -0,0 +1,161 @@
+package dnsres
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// openAPIDocument describes the endpoints apiHandler serves.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// StatsSnapshot is the JSON document served at /stats.
+type StatsSnapshot struct {
+	StartTime    time.Time               `json:"start_time"`
+	Uptime       string                  `json:"uptime"`
+	Cycles       CycleStats              `json:"cycles"`
+	Servers      map[string]ServerStats  `json:"servers"`
+	Nodes        map[string]NodeInfo     `json:"nodes,omitempty"`
+	Fingerprints map[string]Fingerprint  `json:"fingerprints,omitempty"`
+	DNS64        map[string]string       `json:"dns64,omitempty"`
+	Interception map[string]Interception `json:"interception,omitempty"`
+	MDNS         map[string]MDNSResult   `json:"mdns,omitempty"`
+	Subscribers  []SubscriberStats       `json:"event_subscribers"`
+	Cache        CacheStats              `json:"cache"`
+	Listeners    map[string]int          `json:"listeners,omitempty"`
+	Leader       *LeaderStatus           `json:"leader,omitempty"`
+	Reference    *ReferenceStats         `json:"reference,omitempty"`
+	Flapping     map[string]FlapStatus   `json:"flapping,omitempty"`
+	// LatencyAnomalies lists the servers and hostnames whose queries take
+	// a multiple of their baseline latency.
+	LatencyAnomalies []LatencyAnomaly `json:"latency_anomalies,omitempty"`
+	// Scores ranks the servers by composite health score, best first.
+	Scores []ServerScore `json:"scores,omitempty"`
+	// Randomization is the result of the startup transaction ID and
+	// source port randomization audit.
+	Randomization *RandomizationAudit `json:"randomization,omitempty"`
+}
+
+// StatsSnapshot returns a copy of the resolver statistics.
+func (r *DNSResolver) StatsSnapshot() StatsSnapshot {
+	snapshot := StatsSnapshot{
+		Servers:      make(map[string]ServerStats),
+		Nodes:        r.NodeSnapshot(),
+		Fingerprints: r.FingerprintSnapshot(),
+		DNS64:        r.DNS64Snapshot(),
+		Interception: r.InterceptionSnapshot(),
+		MDNS:         r.MDNSSnapshot(),
+		Subscribers:  r.EventSubscriberStats(),
+		Cache:        r.CacheSnapshot(),
+		Listeners:    r.ListenPorts(),
+		Leader:       r.LeaderSnapshot(),
+		Reference:    r.ReferenceSnapshot(),
+		Flapping:     r.FlapSnapshot(),
+	}
+	snapshot.LatencyAnomalies = r.LatencyAnomalySnapshot()
+	snapshot.Scores = r.ScoreSnapshot()
+	snapshot.Randomization = r.RandomizationSnapshot()
+	if r.stats != nil {
+		summary := r.RunSummary()
+		snapshot.StartTime = summary.StartTime
+		snapshot.Uptime = summary.Uptime.String()
+		snapshot.Cycles = summary.Cycles
+		snapshot.Servers = r.stats.serverSnapshot()
+	}
+	return snapshot
+}
+
+// apiHandler serves the health check at the root, the startup and readiness
+// probes, the JSON API endpoints and their OpenAPI document.
+func (r *DNSResolver) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	if r.health != nil {
+		mux.Handle("/", r.health)
+		mux.Handle("/livez", r.health.LivenessHandler())
+		mux.Handle("/readyz", r.health.ReadyHandler())
+		mux.Handle("/startupz", r.health.StartupHandler())
+	}
+	mux.HandleFunc("/stats", r.handleStats)
+	mux.HandleFunc("/events/recent", r.handleRecentEvents)
+	mux.HandleFunc("/audit", r.handleAudit)
+	mux.HandleFunc("/incidents", r.handleIncidents)
+	mux.HandleFunc("/malformed", r.handleMalformed)
+	mux.HandleFunc("/sd/hostnames", r.handleHostnameTargets)
+	mux.HandleFunc("/sd/servers", r.handleServerTargets)
+	mux.HandleFunc("/hostz/{hostname}", r.handleHostz)
+	mux.HandleFunc("/openapi.json", handleOpenAPI)
+	return mux
+}
+
+func (r *DNSResolver) handleStats(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, r.StatsSnapshot())
+}
+
+func (r *DNSResolver) handleRecentEvents(w http.ResponseWriter, req *http.Request) {
+	limit, ok := queryLimit(w, req)
+	if !ok {
+		return
+	}
+	eventType := EventType(req.URL.Query().Get("type"))
+	writeJSON(w, http.StatusOK, r.RecentEvents(limit, eventType))
+}
+
+func (r *DNSResolver) handleAudit(w http.ResponseWriter, req *http.Request) {
+	limit, ok := queryLimit(w, req)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, r.RecentAudit(limit))
+}
+
+func (r *DNSResolver) handleIncidents(w http.ResponseWriter, req *http.Request) {
+	limit, ok := queryLimit(w, req)
+	if !ok {
+		return
+	}
+	openOnly := req.URL.Query().Get("open") == "true"
+	writeJSON(w, http.StatusOK, r.Incidents(limit, openOnly))
+}
+
+func (r *DNSResolver) handleMalformed(w http.ResponseWriter, req *http.Request) {
+	limit, ok := queryLimit(w, req)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, r.MalformedSamples(limit))
+}
+
+func handleOpenAPI(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+// queryLimit parses the optional ?limit= parameter, answering 400 when it is
+// malformed.
+func queryLimit(w http.ResponseWriter, req *http.Request) (int, bool) {
+	value := req.URL.Query().Get("limit")
+	if value == "" {
+		return 0, true
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return 0, false
+	}
+	return limit, true
+}
+
+// writeJSON encodes value as the response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
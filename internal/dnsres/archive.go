@@ -0,0 +1,303 @@
+package dnsres
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/internal/archive"
+	"dnsres/internal/cron"
+	"dnsres/metrics"
+)
+
+const (
+	defaultArchivePrefix         = "dnsres"
+	defaultArchiveReportSchedule = "@daily"
+	// archiveScanInterval is how often the log directory is checked for
+	// newly rotated files.
+	archiveScanInterval = time.Minute
+	// archiveRetentionInterval is how often expired objects are deleted.
+	archiveRetentionInterval = time.Hour
+	archiveRequestTimeout    = 5 * time.Minute
+)
+
+// ArchiveConfig configures uploading rotated logs and report exports to
+// object storage. Archiving is on only when Backend is set.
+type ArchiveConfig struct {
+	// Backend is "s3", "gcs" or "azure".
+	Backend string `json:"backend"`
+	// Bucket is the S3 or GCS bucket, or the Azure container.
+	Bucket   string `json:"bucket"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Region   string `json:"region,omitempty"`
+	// AccessKeyID and SecretAccessKey are S3 credentials or GCS HMAC keys.
+	// S3 falls back to the AWS_* environment variables.
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	Account         string `json:"account,omitempty"`
+	SASToken        string `json:"sas_token,omitempty"`
+	// Objects are stored under Prefix/<host name>/.
+	Prefix string `json:"prefix"`
+	// Retention deletes this host's objects older than it; zero keeps them.
+	Retention Duration `json:"retention"`
+	// ReportSchedule is the cron expression for report exports.
+	ReportSchedule string `json:"report_schedule"`
+}
+
+func (c ArchiveConfig) prefix() string {
+	if c.Prefix == "" {
+		return defaultArchivePrefix
+	}
+	return strings.Trim(c.Prefix, "/")
+}
+
+func (c ArchiveConfig) reportSchedule() string {
+	if c.ReportSchedule == "" {
+		return defaultArchiveReportSchedule
+	}
+	return c.ReportSchedule
+}
+
+func (c ArchiveConfig) storeConfig() archive.Config {
+	config := archive.Config{
+		Backend:         c.Backend,
+		Bucket:          c.Bucket,
+		Endpoint:        c.Endpoint,
+		Region:          c.Region,
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+		Account:         c.Account,
+		SASToken:        c.SASToken,
+	}
+	if c.Backend == archive.S3 && config.AccessKeyID == "" {
+		config.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		config.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		config.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if c.Backend == archive.S3 && config.Region == "" {
+		config.Region = os.Getenv("AWS_REGION")
+	}
+	return config
+}
+
+func validateArchive(c *Config) error {
+	a := c.Archive
+	if a.Backend == "" {
+		return nil
+	}
+	var problems configProblems
+	switch a.Backend {
+	case archive.S3, archive.GCS, archive.Azure:
+	default:
+		problems.add("archive.backend", fmt.Errorf("invalid archive backend %q: must be %q, %q or %q", a.Backend, archive.S3, archive.GCS, archive.Azure))
+	}
+	problems.check(a.Bucket != "", "archive.bucket", "must be set")
+	problems.check(a.Retention.Duration >= 0, "archive.retention", "must not be negative")
+	if _, err := cron.Parse(a.reportSchedule()); err != nil {
+		problems.add("archive.report_schedule", fmt.Errorf("invalid archive report_schedule %q: %w", a.ReportSchedule, err))
+	}
+	return problems.err()
+}
+
+// archiver uploads rotated logs and reports for one host.
+type archiver struct {
+	store     archive.Store
+	keyPrefix string
+	reports   *cron.Schedule
+	retention time.Duration
+	logDir    string
+	rotation  map[string]LogRotation
+	// uploaded holds the keys of log files already in the store.
+	uploaded      map[string]bool
+	lastRetention time.Time
+}
+
+func newArchiver(config *Config, logDir string) (*archiver, error) {
+	if config.Archive.Backend == "" {
+		return nil, nil
+	}
+	store, err := archive.New(config.Archive.storeConfig(), nil)
+	if err != nil {
+		return nil, err
+	}
+	reports, err := cron.Parse(config.Archive.reportSchedule())
+	if err != nil {
+		return nil, err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("archive needs the host name: %w", err)
+	}
+	return &archiver{
+		store:     store,
+		keyPrefix: path.Join(config.Archive.prefix(), host),
+		reports:   reports,
+		retention: config.Archive.Retention.Duration,
+		logDir:    logDir,
+		rotation: map[string]LogRotation{
+			"dnsres-success.log": config.LogRotation.Success,
+			"dnsres-error.log":   config.LogRotation.Error,
+			"dnsres-app.log":     config.LogRotation.App,
+			"dnsres-slow.log":    config.SlowQueryLog.Rotation,
+		},
+		uploaded: make(map[string]bool),
+	}, nil
+}
+
+// runArchive uploads rotated logs as they appear and reports on schedule
+// until ctx is canceled.
+func (r *DNSResolver) runArchive(ctx context.Context) {
+	a := r.archive
+	// Files uploaded before a restart are already in the store.
+	listCtx, cancel := context.WithTimeout(ctx, archiveRequestTimeout)
+	objects, err := a.store.List(listCtx, a.keyPrefix+"/logs/")
+	cancel()
+	if err != nil {
+		r.errorLog.Printf("Archive listing failed: %v", err)
+	}
+	for _, object := range objects {
+		a.uploaded[object.Key] = true
+	}
+
+	ticker := time.NewTicker(archiveScanInterval)
+	defer ticker.Stop()
+	nextReport := a.reports.Next(time.Now())
+	for {
+		r.archiveLogs(ctx)
+		r.expireArchive(ctx, time.Now())
+
+		var reportDue <-chan time.Time
+		timer := time.NewTimer(time.Until(nextReport))
+		if !nextReport.IsZero() {
+			reportDue = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-ticker.C:
+		case tick := <-reportDue:
+			r.archiveReport(ctx, tick)
+			nextReport = a.reports.Next(time.Now())
+		}
+		timer.Stop()
+	}
+}
+
+// archiveLogs uploads rotated log files not yet in the store. Files that
+// fail are tried again on the next scan.
+func (r *DNSResolver) archiveLogs(ctx context.Context) {
+	a := r.archive
+	for name, rotation := range a.rotation {
+		backups, err := (&rotatingFile{path: filepath.Join(a.logDir, name)}).backups()
+		if err != nil {
+			continue
+		}
+		for _, backup := range backups {
+			// A compressed stream's plain backup is still being gzipped.
+			if rotation.Compress && !strings.HasSuffix(backup, ".gz") {
+				continue
+			}
+			key := a.keyPrefix + "/logs/" + filepath.Base(backup)
+			if a.uploaded[key] || a.expired(backup) {
+				continue
+			}
+			if err := r.archiveFile(ctx, key, backup); err != nil {
+				metrics.DNSResArchiveObjects.WithLabelValues("log", "failed").Inc()
+				r.errorLog.Printf("Archiving %s failed: %v", backup, err)
+				continue
+			}
+			a.uploaded[key] = true
+			metrics.DNSResArchiveObjects.WithLabelValues("log", "uploaded").Inc()
+			r.appLogf(instrumentation.Low, "archived log file=%s key=%s", backup, key)
+		}
+	}
+}
+
+// expired reports whether file is already past the retention, so uploading
+// it would only have it deleted again.
+func (a *archiver) expired(file string) bool {
+	if a.retention <= 0 {
+		return false
+	}
+	info, err := os.Stat(file)
+	return err == nil && time.Since(info.ModTime()) > a.retention
+}
+
+func (r *DNSResolver) archiveFile(ctx context.Context, key, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	contentType := "text/plain; charset=utf-8"
+	if strings.HasSuffix(file, ".gz") {
+		contentType = "application/gzip"
+	}
+	ctx, cancel := context.WithTimeout(ctx, archiveRequestTimeout)
+	defer cancel()
+	return r.archive.store.Put(ctx, key, f, info.Size(), contentType)
+}
+
+// archiveReport uploads the statistics report generated at tick, unless
+// another instance leads.
+func (r *DNSResolver) archiveReport(ctx context.Context, tick time.Time) {
+	if !r.leading() {
+		r.appLogf(instrumentation.Medium, "report not archived on standby")
+		return
+	}
+	report := r.GenerateReport()
+	key := r.archive.keyPrefix + "/reports/report-" + tick.Format("2006-01-02T150405") + ".txt"
+	ctx, cancel := context.WithTimeout(ctx, archiveRequestTimeout)
+	defer cancel()
+	if err := r.archive.store.Put(ctx, key, strings.NewReader(report), int64(len(report)), "text/plain; charset=utf-8"); err != nil {
+		metrics.DNSResArchiveObjects.WithLabelValues("report", "failed").Inc()
+		r.errorLog.Printf("Archiving report failed: %v", err)
+		return
+	}
+	metrics.DNSResArchiveObjects.WithLabelValues("report", "uploaded").Inc()
+	r.appLogf(instrumentation.Low, "archived report key=%s", key)
+}
+
+// expireArchive deletes this host's objects older than the retention, at
+// most once per archiveRetentionInterval.
+func (r *DNSResolver) expireArchive(ctx context.Context, now time.Time) {
+	a := r.archive
+	if a.retention <= 0 || now.Sub(a.lastRetention) < archiveRetentionInterval {
+		return
+	}
+	a.lastRetention = now
+
+	ctx, cancel := context.WithTimeout(ctx, archiveRequestTimeout)
+	defer cancel()
+	objects, err := a.store.List(ctx, a.keyPrefix+"/")
+	if err != nil {
+		r.errorLog.Printf("Archive listing failed: %v", err)
+		return
+	}
+	cutoff := now.Add(-a.retention)
+	for _, object := range objects {
+		if !object.LastModified.Before(cutoff) {
+			continue
+		}
+		if err := a.store.Delete(ctx, object.Key); err != nil {
+			r.errorLog.Printf("Deleting expired archive object %s failed: %v", object.Key, err)
+			continue
+		}
+		kind := "log"
+		if strings.Contains(object.Key, "/reports/") {
+			kind = "report"
+		}
+		metrics.DNSResArchiveObjects.WithLabelValues(kind, "expired").Inc()
+		r.appLogf(instrumentation.Medium, "archive object expired key=%s", object.Key)
+	}
+}
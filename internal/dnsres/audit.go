@@ -0,0 +1,99 @@
+package dnsres
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditRecentSize bounds the audit entries kept in memory for the API.
+const auditRecentSize = 200
+
+// AuditEntry records one runtime control action.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	Target   string    `json:"target,omitempty"`
+	OldValue string    `json:"old_value,omitempty"`
+	NewValue string    `json:"new_value,omitempty"`
+}
+
+// auditLog appends entries as JSON lines and remembers the most recent ones.
+type auditLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	recent []AuditEntry
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &auditLog{file: file}, nil
+}
+
+func (a *auditLog) record(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.recent = append(a.recent, entry)
+	if len(a.recent) > auditRecentSize {
+		a.recent = a.recent[len(a.recent)-auditRecentSize:]
+	}
+	if a.file == nil {
+		return nil
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit entry: %w", err)
+	}
+	return nil
+}
+
+func (a *auditLog) entries(limit int) []AuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entries := a.recent
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return append([]AuditEntry{}, entries...)
+}
+
+// RecordAudit appends a runtime control action to the audit log
+// (dnsres-audit.log in the log directory). Actor identifies who acted, e.g.
+// "tui" or "api 203.0.113.7".
+func (r *DNSResolver) RecordAudit(actor, action, target, oldValue, newValue string) {
+	if r.audit == nil {
+		return
+	}
+	entry := AuditEntry{
+		Time:     time.Now(),
+		Actor:    actor,
+		Action:   action,
+		Target:   target,
+		OldValue: oldValue,
+		NewValue: newValue,
+	}
+	if err := r.audit.record(entry); err != nil && r.appLog != nil {
+		r.appLog.Printf("Audit log error: %v", err)
+	}
+}
+
+// RecentAudit returns up to limit of the most recent audit entries, oldest
+// first. A limit of zero returns everything kept in memory.
+func (r *DNSResolver) RecentAudit(limit int) []AuditEntry {
+	if r.audit == nil {
+		return []AuditEntry{}
+	}
+	return r.audit.entries(limit)
+}
@@ -0,0 +1,69 @@
+package dnsres
+
+import (
+	"time"
+
+	"dnsres/internal/cron"
+	"dnsres/metrics"
+)
+
+// Scheduler tiers, the kinds of work that resolve hostnames. Each reports
+// its backlog separately, so an unsustainable interval can be told apart
+// from an overloaded schedule or burst.
+const (
+	tierInterval  = "interval"
+	tierScheduled = "scheduled"
+	tierBurst     = "burst"
+)
+
+// maxMissedFirings bounds the count of schedule firings skipped by one
+// overrun, so a schedule firing every second cannot stall the scheduler.
+const maxMissedFirings = 1000
+
+// queueWork counts n hostnames of tier waiting to be resolved.
+func queueWork(tier string, n int) {
+	metrics.DNSResSchedulerQueueDepth.WithLabelValues(tier).Add(float64(n))
+}
+
+// startWork takes a hostname of tier queued at queued off the queue as its
+// resolution starts.
+func startWork(tier string, queued time.Time) {
+	metrics.DNSResSchedulerQueueDepth.WithLabelValues(tier).Dec()
+	metrics.DNSResSchedulerWait.WithLabelValues(tier).Observe(time.Since(queued).Seconds())
+}
+
+// dropWork takes a hostname of tier off the queue without resolving it.
+// Only work dropped for a reason is counted; work abandoned at shutdown is
+// not.
+func dropWork(tier, reason string) {
+	metrics.DNSResSchedulerQueueDepth.WithLabelValues(tier).Dec()
+	if reason != "" {
+		metrics.DNSResSchedulerDropped.WithLabelValues(tier, reason).Inc()
+	}
+}
+
+// skipTicks counts n ticks of tier that were skipped because earlier work
+// was still running.
+func skipTicks(tier string, n int) {
+	if n > 0 {
+		metrics.DNSResSchedulerDropped.WithLabelValues(tier, "tick_skipped").Add(float64(n))
+	}
+}
+
+// missedTicks returns how many ticks of interval fell between last and tick.
+func missedTicks(last, tick time.Time, interval time.Duration) int {
+	if last.IsZero() || interval <= 0 {
+		return 0
+	}
+	return max(int((tick.Sub(last)+interval/2)/interval)-1, 0)
+}
+
+// missedFirings returns how many times schedule fired after tick up to now,
+// firings skipped while the run for tick was in progress.
+func missedFirings(schedule *cron.Schedule, tick, now time.Time) int {
+	missed := 0
+	for at := schedule.Next(tick); !at.IsZero() && !at.After(now) && missed < maxMissedFirings; at = schedule.Next(at) {
+		missed++
+	}
+	return missed
+}
@@ -0,0 +1,76 @@
+package dnsres
+
+import (
+	"fmt"
+	"time"
+
+	"dnsres/circuitbreaker"
+	"dnsres/instrumentation"
+)
+
+// watchBreaker reports breaker's state changes as events and log entries.
+func (r *DNSResolver) watchBreaker(breaker *circuitbreaker.CircuitBreaker) *circuitbreaker.CircuitBreaker {
+	breaker.OnStateChange(r.breakerChanged)
+	return breaker
+}
+
+// breaker returns server's circuit breaker, or nil when a reload removed the
+// server while a query to it was in flight.
+func (r *DNSResolver) breaker(server string) *circuitbreaker.CircuitBreaker {
+	r.configMu.RLock()
+	defer r.configMu.RUnlock()
+	return r.breakers[server]
+}
+
+// recordBreakerFailure counts a failure of server toward its breaker, except
+// during warm-up.
+func (r *DNSResolver) recordBreakerFailure(server string, err error) {
+	breaker := r.breaker(server)
+	if breaker == nil || r.warmingUp(time.Now()) {
+		return
+	}
+	breaker.RecordError(err)
+}
+
+func (r *DNSResolver) breakerChanged(change circuitbreaker.StateChange) {
+	var cause string
+	if change.Err != nil {
+		cause = change.Err.Error()
+	}
+	r.appLogf(instrumentation.Low, "circuit breaker state change server=%s from=%s to=%s failures=%d err=%q",
+		change.Server, change.From, change.To, change.Failures, cause)
+	if change.To == circuitbreaker.Open {
+		if r.scores != nil {
+			r.scores.recordBreakerOpen(change.Server, change.At)
+		}
+		r.errorLog.Printf("Circuit breaker for %s opened after %d consecutive failures: %s", change.Server, change.Failures, cause)
+	}
+	r.emitEvent(ResolverEvent{
+		Type:   EventBreakerChange,
+		Time:   change.At,
+		Server: change.Server,
+		Error:  cause,
+		Source: change.To.String(),
+		Detail: fmt.Sprintf("%s -> %s, %d consecutive failures", change.From, change.To, change.Failures),
+	})
+}
+
+// BreakerInfo is a server's circuit breaker state.
+type BreakerInfo struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+}
+
+// BreakerSnapshot returns the circuit breaker state of each server.
+func (r *DNSResolver) BreakerSnapshot() map[string]BreakerInfo {
+	// applyConfig replaces the map rather than changing it, so it can be
+	// read after the lock is released.
+	r.configMu.RLock()
+	breakers := r.breakers
+	r.configMu.RUnlock()
+	snapshot := make(map[string]BreakerInfo, len(breakers))
+	for server, breaker := range breakers {
+		snapshot[server] = BreakerInfo{State: breaker.GetState(), Failures: breaker.GetFailures()}
+	}
+	return snapshot
+}
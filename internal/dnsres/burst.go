@@ -0,0 +1,155 @@
+package dnsres
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+)
+
+// Burst defaults used when the burst section leaves them unset.
+const (
+	defaultBurstFactor   = 4
+	defaultBurstDuration = 5 * time.Minute
+)
+
+// burstKey marks contexts of burst queries, which skip the response cache
+// so each one reaches the server.
+type burstKey struct{}
+
+func isBurstQuery(ctx context.Context) bool {
+	return ctx.Value(burstKey{}) != nil
+}
+
+// burstState tracks when each bursting hostname returns to normal polling.
+type burstState struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func newBurstState(config *Config) *burstState {
+	if !config.Burst.Enabled {
+		return nil
+	}
+	return &burstState{until: make(map[string]time.Time)}
+}
+
+// burstFactor returns how many times more often bursting hostnames are polled.
+func (c *Config) burstFactor() int {
+	if c.Burst.Factor <= 0 {
+		return defaultBurstFactor
+	}
+	return c.Burst.Factor
+}
+
+// burstDuration returns how long a burst lasts after its last trigger.
+func (c *Config) burstDuration() time.Duration {
+	if c.Burst.Duration.Duration <= 0 {
+		return defaultBurstDuration
+	}
+	return c.Burst.Duration.Duration
+}
+
+func validateBurst(c *Config) error {
+	var problems configProblems
+	problems.check(c.Burst.Factor >= 0 && c.Burst.Factor != 1, "burst.factor", "must be at least 2")
+	problems.check(c.Burst.Duration.Duration >= 0, "burst.duration", "must not be negative")
+	return problems.err()
+}
+
+// triggerBurst starts or extends a burst for hostname. Each failure or
+// inconsistency pushes the end of the burst out by the burst duration, so a
+// burst ends that long after the hostname recovers.
+func (r *DNSResolver) triggerBurst(hostname, reason string) {
+	config := r.currentConfig()
+	if r.bursts == nil {
+		return
+	}
+	duration := config.burstDuration()
+	r.bursts.mu.Lock()
+	_, active := r.bursts.until[hostname]
+	r.bursts.until[hostname] = time.Now().Add(duration)
+	r.bursts.mu.Unlock()
+	if active {
+		return
+	}
+
+	metrics.DNSResBurstActive.WithLabelValues(r.metricHostname(hostname)).Set(1)
+	r.appLogf(instrumentation.Low, "burst start hostname=%s reason=%s factor=%d", hostname, reason, config.burstFactor())
+	r.emitEvent(ResolverEvent{
+		Type:     EventBurstStart,
+		Time:     time.Now(),
+		Hostname: hostname,
+		Duration: duration,
+		Detail:   reason,
+	})
+}
+
+// activeBursts returns the hostnames still bursting at now and ends the
+// bursts that have run their course.
+func (r *DNSResolver) activeBursts(now time.Time) []string {
+	r.bursts.mu.Lock()
+	var active, ended []string
+	for hostname, until := range r.bursts.until {
+		if now.Before(until) {
+			active = append(active, hostname)
+			continue
+		}
+		delete(r.bursts.until, hostname)
+		ended = append(ended, hostname)
+	}
+	r.bursts.mu.Unlock()
+
+	sort.Strings(active)
+	sort.Strings(ended)
+	for _, hostname := range ended {
+		metrics.DNSResBurstActive.WithLabelValues(r.metricHostname(hostname)).Set(0)
+		r.appLogf(instrumentation.Low, "burst end hostname=%s", hostname)
+		r.emitEvent(ResolverEvent{
+			Type:     EventBurstEnd,
+			Time:     now,
+			Hostname: hostname,
+		})
+	}
+	return active
+}
+
+// runBursts polls bursting hostnames every query_interval divided by the
+// burst factor until ctx is canceled.
+func (r *DNSResolver) runBursts(ctx context.Context) {
+	config := r.currentConfig()
+	interval := config.QueryInterval.Duration / time.Duration(config.burstFactor())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	burstCtx := context.WithValue(ctx, burstKey{}, true)
+	var last time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case tick := <-ticker.C:
+			hostnames := r.activeBursts(tick)
+			if len(hostnames) == 0 {
+				last = time.Time{}
+				continue
+			}
+			skipTicks(tierBurst, missedTicks(last, tick, interval))
+			last = tick
+			r.appLogf(instrumentation.Medium, "burst poll hostnames=%d", len(hostnames))
+			var wg sync.WaitGroup
+			queueWork(tierBurst, len(hostnames))
+			for _, hostname := range hostnames {
+				wg.Add(1)
+				go func(h string) {
+					defer wg.Done()
+					startWork(tierBurst, tick)
+					r.resolveHostname(burstCtx, h)
+				}(hostname)
+			}
+			wg.Wait()
+		}
+	}
+}
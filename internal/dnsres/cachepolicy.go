@@ -0,0 +1,104 @@
+package dnsres
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"dnsres/dnsanalysis"
+
+	"github.com/miekg/dns"
+)
+
+// Cache policies for cache.policies. Hostnames without a policy use
+// CachePolicyNormal.
+const (
+	// CachePolicyNormal caches successful answers for their TTL.
+	CachePolicyNormal = "normal"
+	// CachePolicyBypass never reads or writes the cache, so every query
+	// reaches its server.
+	CachePolicyBypass = "bypass"
+	// CachePolicyNegativeOnly caches only NXDOMAIN and empty answers, for
+	// their SOA negative TTL, and queries the servers while the hostname
+	// resolves.
+	CachePolicyNegativeOnly = "negative_only"
+)
+
+// cachePolicy returns the cache policy for hostname.
+func (c *Config) cachePolicy(hostname string) string {
+	if c == nil {
+		return CachePolicyNormal
+	}
+	if policy, ok := c.Cache.Policies[hostname]; ok && policy != "" {
+		return policy
+	}
+	return CachePolicyNormal
+}
+
+// validateCachePolicies checks that each policy names a known policy and a
+// monitored hostname.
+func validateCachePolicies(c *Config) error {
+	var problems configProblems
+	for _, hostname := range slices.Sorted(maps.Keys(c.Cache.Policies)) {
+		path := elementPath("cache.policies", hostname)
+		problems.check(slices.Contains(c.Hostnames, hostname), path, "is not in hostnames")
+		switch policy := c.Cache.Policies[hostname]; policy {
+		case "", CachePolicyNormal, CachePolicyBypass, CachePolicyNegativeOnly:
+		default:
+			problems.add(path, fmt.Errorf("unknown cache policy %q", policy))
+		}
+	}
+	return problems.err()
+}
+
+// cacheKey is the cache key of server's answer for hostname. Each server's
+// answer is cached apart, so one server's answer never stands in for
+// another's in the consistency check.
+func cacheKey(server, hostname string) string {
+	return server + " " + hostname
+}
+
+// cachedAnswer returns a live cached answer for hostname from any server,
+// trying primaries before fallbacks in dns_servers order.
+func (r *DNSResolver) cachedAnswer(hostname string) (*dnsanalysis.DNSResponse, bool) {
+	if r.cache == nil {
+		return nil, false
+	}
+	primaries, fallbacks := r.currentConfig().ServersByRole()
+	for _, server := range append(primaries, fallbacks...) {
+		if cached, ok := r.cache.Get(cacheKey(server, hostname)); ok {
+			return cached, true
+		}
+	}
+	return nil, false
+}
+
+// cacheNegative caches an NXDOMAIN or empty response for hostname under the
+// negative_only policy. The TTL is the SOA's negative TTL (RFC 2308),
+// subject to the configured clamps and overrides.
+func (r *DNSResolver) cacheNegative(hostname, server string, response *dns.Msg) {
+	config := r.currentConfig()
+	if config.cachePolicy(hostname) != CachePolicyNegativeOnly {
+		return
+	}
+	ttl := config.cacheTTL(hostname, dnsanalysis.NegativeTTL(response))
+	if ttl <= 0 {
+		return
+	}
+	r.cache.Set(cacheKey(server, hostname), &dnsanalysis.DNSResponse{
+		Server:   server,
+		Hostname: hostname,
+		Response: response,
+		TTL:      uint32(ttl / time.Second),
+	}, ttl)
+}
+
+// cachedRcode returns the response code of a cached response; only
+// negative_only entries carry anything but success.
+func cachedRcode(cached *dnsanalysis.DNSResponse) int {
+	if cached.Response == nil {
+		return dns.RcodeSuccess
+	}
+	return cached.Response.Rcode
+}
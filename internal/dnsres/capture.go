@@ -0,0 +1,128 @@
+package dnsres
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"dnsres/instrumentation"
+
+	"github.com/miekg/dns"
+)
+
+// maxCaptureQueries caps how many queries one capture request may arm.
+const maxCaptureQueries = 1000
+
+// captureState counts the queries still to be captured, by hostname. The
+// empty hostname captures queries for any hostname.
+type captureState struct {
+	mu        sync.Mutex
+	remaining map[string]int
+}
+
+func newCaptureState() *captureState {
+	return &captureState{remaining: make(map[string]int)}
+}
+
+// take reports whether the next query for hostname is captured, counting it
+// against the hostname's own capture before the global one.
+func (c *captureState) take(hostname string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range []string{hostname, ""} {
+		if c.remaining[key] > 0 {
+			c.remaining[key]--
+			if c.remaining[key] == 0 {
+				delete(c.remaining, key)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// captureDir returns where captured packets are written.
+func (r *DNSResolver) captureDir() string {
+	return filepath.Join(r.logDir, "captures")
+}
+
+// CaptureQueries stores the raw request and response bytes of the next count
+// queries for hostname, or for any hostname when hostname is empty, in the
+// captures directory under the log directory. A count of zero cancels the
+// capture. It returns the directory the packets are written to.
+func (r *DNSResolver) CaptureQueries(hostname string, count int) (string, error) {
+	if r.captures == nil {
+		return "", fmt.Errorf("capture is not available")
+	}
+	if count < 0 || count > maxCaptureQueries {
+		return "", fmt.Errorf("invalid capture count %d: must be between 0 and %d", count, maxCaptureQueries)
+	}
+	r.captures.mu.Lock()
+	if count == 0 {
+		delete(r.captures.remaining, hostname)
+	} else {
+		r.captures.remaining[hostname] = count
+	}
+	r.captures.mu.Unlock()
+	return r.captureDir(), nil
+}
+
+// PendingCaptures returns the queries still to be captured, by hostname. The
+// empty hostname stands for any hostname.
+func (r *DNSResolver) PendingCaptures() map[string]int {
+	pending := make(map[string]int)
+	if r.captures == nil {
+		return pending
+	}
+	r.captures.mu.Lock()
+	defer r.captures.mu.Unlock()
+	for hostname, count := range r.captures.remaining {
+		pending[hostname] = count
+	}
+	return pending
+}
+
+// writeCapture writes the query msg to server and its reply as
+// <time>-<hostname>-<server>-query.bin and -response.bin. The response is
+// the datagram as received when the query went over UDP; otherwise it is
+// response packed again, and it is absent when no reply was read.
+func (r *DNSResolver) writeCapture(hostname, server string, msg, response *dns.Msg, replies [][]byte) {
+	query, err := msg.Pack()
+	if err != nil {
+		r.appLogf(instrumentation.Medium, "query capture failed hostname=%s server=%s err=%v", hostname, server, err)
+		return
+	}
+	var reply []byte
+	for _, datagram := range replies {
+		if len(datagram) >= 2 && binary.BigEndian.Uint16(datagram) == msg.Id {
+			reply = datagram
+		}
+	}
+	if reply == nil && response != nil {
+		reply, _ = response.Pack()
+	}
+
+	dir := r.captureDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		r.appLogf(instrumentation.Medium, "query capture failed hostname=%s server=%s err=%v", hostname, server, err)
+		return
+	}
+	name := strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(
+		time.Now().UTC().Format("20060102T150405.000000000") + "-" + hostname + "-" + server)
+	base := filepath.Join(dir, name)
+	if err := os.WriteFile(base+"-query.bin", query, 0o644); err != nil {
+		r.appLogf(instrumentation.Medium, "query capture failed hostname=%s server=%s err=%v", hostname, server, err)
+		return
+	}
+	if reply != nil {
+		if err := os.WriteFile(base+"-response.bin", reply, 0o644); err != nil {
+			r.appLogf(instrumentation.Medium, "query capture failed hostname=%s server=%s err=%v", hostname, server, err)
+			return
+		}
+	}
+	r.appLogf(instrumentation.Medium, "query captured hostname=%s server=%s path=%s", hostname, server, base)
+}
@@ -0,0 +1,112 @@
+package dnsres
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"dnsres/dnsanalysis"
+	"dnsres/internal/checkexpr"
+	"dnsres/metrics"
+)
+
+// checkAnalyzer names check results in findings, events and logs.
+const checkAnalyzer = "check"
+
+// allHostnames is the checks key whose expressions apply to every hostname.
+const allHostnames = "*"
+
+// checkVariables are the names check expressions may refer to.
+var checkVariables = []string{"hostname", "server", "answers", "ttl", "duration_ms", "protocol"}
+
+// checkPrograms caches compiled check expressions by source, so reloaded
+// configs reuse programs for unchanged checks.
+type checkPrograms struct {
+	mu       sync.Mutex
+	programs map[string]*checkexpr.Program
+}
+
+func (c *checkPrograms) get(source string) (*checkexpr.Program, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if program, ok := c.programs[source]; ok {
+		return program, nil
+	}
+	program, err := checkexpr.Compile(source, checkVariables...)
+	if err != nil {
+		return nil, err
+	}
+	if c.programs == nil {
+		c.programs = make(map[string]*checkexpr.Program)
+	}
+	c.programs[source] = program
+	return program, nil
+}
+
+// validateChecks compiles every check so syntax errors and unknown variables
+// are reported when the config is loaded.
+func validateChecks(c *Config) error {
+	var problems configProblems
+	for _, hostname := range slices.Sorted(maps.Keys(c.Checks)) {
+		for i, source := range c.Checks[hostname] {
+			if _, err := checkexpr.Compile(source, checkVariables...); err != nil {
+				problems.add(elementPath(elementPath("checks", hostname), i), fmt.Errorf("invalid check %q: %w", source, err))
+			}
+		}
+	}
+	return problems.err()
+}
+
+// runChecks evaluates the checks configured for hostname, and those under
+// "*", against each server's response. A check passes when it holds for every
+// response.
+func (r *DNSResolver) runChecks(hostname string, responses []*dnsanalysis.DNSResponse) {
+	config := r.currentConfig()
+	if len(responses) == 0 {
+		return
+	}
+	sources := append(append([]string(nil), config.Checks[allHostnames]...), config.Checks[hostname]...)
+	for _, source := range sources {
+		program, err := r.checks.get(source)
+		if err != nil {
+			// Rejected by validation; only reachable for configs built in code.
+			r.reportFinding(dnsanalysis.Finding{
+				Analyzer: checkAnalyzer,
+				Hostname: hostname,
+				Severity: dnsanalysis.SeverityCritical,
+				Message:  fmt.Sprintf("check %q does not compile: %v", source, err),
+			})
+			continue
+		}
+
+		passing := true
+		for _, response := range responses {
+			ok, err := program.EvalBool(map[string]any{
+				"hostname":    hostname,
+				"server":      response.Server,
+				"answers":     response.Addresses,
+				"ttl":         response.TTL,
+				"duration_ms": response.Duration,
+				"protocol":    response.Protocol,
+			})
+			if ok {
+				continue
+			}
+			passing = false
+			finding := dnsanalysis.Finding{
+				Analyzer: checkAnalyzer,
+				Hostname: hostname,
+				Server:   response.Server,
+				Severity: dnsanalysis.SeverityWarning,
+				Message:  fmt.Sprintf("check failed: %s", source),
+			}
+			if err != nil {
+				finding.Severity = dnsanalysis.SeverityCritical
+				finding.Message = fmt.Sprintf("check %q could not be evaluated: %v", source, err)
+			}
+			r.reportFinding(finding)
+		}
+		metrics.DNSResCheckPassing.WithLabelValues(r.metricHostname(hostname), source).Set(boolToFloat64(passing))
+	}
+}
@@ -1,14 +1,19 @@
 package dnsres
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"net"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
+	"dnsres/dnsanalysis"
 	"dnsres/instrumentation"
 	"dnsres/internal/xdg"
 )
@@ -38,12 +43,19 @@ func (d *Duration) UnmarshalJSON(b []byte) error {
 	return json.Unmarshal(b, &d.Duration)
 }
 
+// MarshalJSON writes the duration in the same string form it is read from.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
 // Config represents the configuration for the DNS resolver
 type Config struct {
 	Hostnames            []string `json:"hostnames"`
 	DNSServers           []string `json:"dns_servers"`
 	QueryTimeout         Duration `json:"query_timeout"`
 	QueryInterval        Duration `json:"query_interval"`
+	CycleTimeout         Duration `json:"cycle_timeout"`
+	WarmUp               Duration `json:"warm_up"`
 	HealthPort           int      `json:"health_port"`
 	MetricsPort          int      `json:"metrics_port"`
 	LogDir               string   `json:"log_dir"`
@@ -52,9 +64,593 @@ type Config struct {
 		Threshold int      `json:"threshold"`
 		Timeout   Duration `json:"timeout"`
 	} `json:"circuit_breaker"`
+	HealthCheck struct {
+		// UnhealthyThreshold is the number of consecutive failed checks
+		// that mark a server unhealthy (default 3).
+		UnhealthyThreshold int `json:"unhealthy_threshold"`
+		// HealthyThreshold is the number of consecutive successful checks
+		// that mark an unhealthy server healthy again (default 2).
+		HealthyThreshold int `json:"healthy_threshold"`
+		// FailOnUpstreamDown makes the root health check answer 503 when
+		// no server is healthy, instead of reporting the outage only in
+		// its body.
+		FailOnUpstreamDown bool `json:"fail_on_upstream_down"`
+	} `json:"health_check"`
 	Cache struct {
+		// MaxSize is the maximum number of entries.
 		MaxSize int64 `json:"max_size"`
+		// MaxBytes caps the estimated size of the cached responses; 0
+		// means no byte limit.
+		MaxBytes int64 `json:"max_bytes"`
+		// CleanupInterval is how often expired entries are swept
+		// (default 1m).
+		CleanupInterval Duration `json:"cleanup_interval"`
+		// MinTTL and MaxTTL clamp the TTL a response is cached for; zero
+		// leaves that side unclamped.
+		MinTTL Duration `json:"min_ttl"`
+		MaxTTL Duration `json:"max_ttl"`
+		// TTLOverrides maps hostnames to the TTL their responses are
+		// cached for, ignoring the upstream TTL and the clamps.
+		TTLOverrides map[string]Duration `json:"ttl_overrides,omitempty"`
+		// Policies maps hostnames to a cache policy: normal, bypass or
+		// negative_only.
+		Policies map[string]string `json:"policies,omitempty"`
 	} `json:"cache"`
+	// ReferenceServer is the primary server, if any, every other server's
+	// answers are compared with.
+	ReferenceServer string                    `json:"reference_server,omitempty"`
+	ServerSettings  map[string]ServerSettings `json:"server_settings,omitempty"`
+	DNS64           struct {
+		Enabled bool `json:"enabled"`
+	} `json:"dns64"`
+	Events struct {
+		HistorySize int `json:"history_size"`
+	} `json:"events"`
+	Querying struct {
+		Mode    string   `json:"mode"`
+		Stagger Duration `json:"stagger"`
+		// Selection orders the servers Lookup and the forwarder try; see
+		// SelectionPolicy.
+		Selection string `json:"selection"`
+		// HedgeDelay, when positive, sends Lookup and forwarder queries to
+		// a second server too if the first has not answered within it.
+		HedgeDelay Duration `json:"hedge_delay"`
+		// ReuseSockets keeps connected UDP sockets to each server open
+		// between monitoring queries instead of opening one per query.
+		ReuseSockets bool `json:"reuse_sockets"`
+		// IDSource is where transaction IDs come from; see IDSource.
+		IDSource string `json:"id_source"`
+		// SourcePorts pins the local ports queries are sent from to a
+		// range, written "low-high", for firewalls that only pass those.
+		SourcePorts string `json:"source_ports"`
+	} `json:"querying"`
+	Analyzers struct {
+		Disabled []string `json:"disabled,omitempty"`
+	} `json:"analyzers"`
+	Checks map[string][]string `json:"checks,omitempty"`
+	// Schedules maps hostnames to cron expressions. A scheduled hostname is
+	// resolved when its schedule fires instead of every query_interval.
+	Schedules map[string]string `json:"schedules,omitempty"`
+	GeoIP     struct {
+		CountryDB string                    `json:"country_db"`
+		ASNDB     string                    `json:"asn_db"`
+		Expected  map[string]GeoExpectation `json:"expected,omitempty"`
+	} `json:"geoip"`
+	Screening struct {
+		Interval Duration          `json:"interval"`
+		Lists    []ScreeningSource `json:"lists,omitempty"`
+	} `json:"screening"`
+	MDNS struct {
+		Enabled   bool              `json:"enabled"`
+		Hostnames []string          `json:"hostnames"`
+		Timeout   Duration          `json:"timeout"`
+		Compare   map[string]string `json:"compare,omitempty"`
+	} `json:"mdns"`
+	Incidents struct {
+		// WebhookURL receives a JSON POST when an incident opens or closes.
+		WebhookURL string `json:"webhook_url,omitempty"`
+	} `json:"incidents"`
+	Email   EmailConfig   `json:"email"`
+	Publish PublishConfig `json:"publish"`
+	Kafka   KafkaConfig   `json:"kafka"`
+	Archive ArchiveConfig `json:"archive"`
+	// Reports sends the statistics report on a schedule.
+	Reports ReportsConfig `json:"reports"`
+	GRPC    GRPCConfig    `json:"grpc"`
+	Leader  LeaderConfig  `json:"leader"`
+	Memory  MemoryConfig  `json:"memory"`
+	Burst   struct {
+		Enabled  bool     `json:"enabled"`
+		Factor   int      `json:"factor"`
+		Duration Duration `json:"duration"`
+	} `json:"burst"`
+	Flapping struct {
+		// Window is how many recent answers per server are examined
+		// (default 10).
+		Window int `json:"window"`
+		// Changes is how many answer changes within the window, at least
+		// one back to an earlier answer, mark a hostname flapping
+		// (default 3).
+		Changes int `json:"changes"`
+	} `json:"flapping"`
+	Discovery struct {
+		Interval     Duration          `json:"interval"`
+		MaxHostnames int               `json:"max_hostnames"`
+		Sources      []DiscoverySource `json:"sources,omitempty"`
+	} `json:"discovery"`
+	RemoteConfig struct {
+		Backend      string   `json:"backend"`
+		Address      string   `json:"address"`
+		Key          string   `json:"key"`
+		Token        string   `json:"token,omitempty"`
+		PollInterval Duration `json:"poll_interval"`
+	} `json:"remote_config"`
+	Forwarder struct {
+		Enabled bool   `json:"enabled"`
+		Address string `json:"address"`
+		Port    int    `json:"port"`
+	} `json:"forwarder"`
+	LogRotation struct {
+		Success LogRotation `json:"success"`
+		Error   LogRotation `json:"error"`
+		App     LogRotation `json:"app"`
+	} `json:"log_rotation"`
+	ResultsFile  ResultsFileConfig  `json:"results_file"`
+	SlowQueryLog SlowQueryLogConfig `json:"slow_query_log"`
+	Sampling     SamplingConfig     `json:"sampling"`
+	// LatencyAnomaly flags queries that take far longer than usual.
+	LatencyAnomaly LatencyAnomalyConfig `json:"latency_anomaly"`
+
+	// download is set when the config was loaded from a URL.
+	download *configDownload
+	// warnings are the problems found while loading that did not stop it.
+	warnings []string
+}
+
+// LogRotation controls rotation for one log stream. The zero value never
+// rotates.
+type LogRotation struct {
+	MaxSizeMB  int      `json:"max_size_mb"`
+	MaxAge     Duration `json:"max_age"`
+	MaxBackups int      `json:"max_backups"`
+	Compress   bool     `json:"compress"`
+}
+
+func (l LogRotation) maxBytes() int64 {
+	return int64(l.MaxSizeMB) * 1024 * 1024
+}
+
+func (l LogRotation) validate(stream string) error {
+	if l.MaxSizeMB < 0 || l.MaxAge.Duration < 0 || l.MaxBackups < 0 {
+		return fmt.Errorf("invalid log rotation for %s log: values must not be negative", stream)
+	}
+	return nil
+}
+
+func validateLogRotation(c *Config) error {
+	var problems configProblems
+	problems.add("log_rotation.success", c.LogRotation.Success.validate("success"))
+	problems.add("log_rotation.error", c.LogRotation.Error.validate("error"))
+	problems.add("log_rotation.app", c.LogRotation.App.validate("app"))
+	problems.add("results_file.rotation", c.ResultsFile.Rotation.validate("results"))
+	problems.add("slow_query_log.rotation", c.SlowQueryLog.Rotation.validate("slow"))
+	return problems.err()
+}
+
+// DiscoverySource configures one discovery plugin.
+type DiscoverySource struct {
+	// Type names a registered discoverer, e.g. "crtsh" or "kubernetes".
+	Type string `json:"type"`
+	// Zone limits discovered hostnames to this domain and its subdomains.
+	// Required for crtsh; optional for kubernetes.
+	Zone string `json:"zone,omitempty"`
+	// URL overrides the source's default API endpoint.
+	URL string `json:"url,omitempty"`
+	// Kubeconfig is a JSON kubeconfig path for kubernetes; empty uses the
+	// in-cluster service account.
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// Namespace limits kubernetes discovery to one namespace; empty watches
+	// all namespaces.
+	Namespace string `json:"namespace,omitempty"`
+	// LabelSelector filters kubernetes objects, e.g. "team=edge".
+	LabelSelector string `json:"label_selector,omitempty"`
+}
+
+// GeoExpectation lists where a hostname's answers are expected to be. Empty
+// lists accept anything.
+type GeoExpectation struct {
+	// Countries are ISO 3166-1 alpha-2 codes, e.g. "US".
+	Countries []string `json:"countries,omitempty"`
+	ASNs      []uint32 `json:"asns,omitempty"`
+}
+
+// geoExpectation returns the expectation for hostname, falling back to "*".
+func (c *Config) geoExpectation(hostname string) (GeoExpectation, bool) {
+	if expected, ok := c.GeoIP.Expected[hostname]; ok {
+		return expected, true
+	}
+	expected, ok := c.GeoIP.Expected[allHostnames]
+	return expected, ok
+}
+
+// validateGeoIP requires the database each expectation depends on.
+func validateGeoIP(c *Config) error {
+	var problems configProblems
+	for _, hostname := range slices.Sorted(maps.Keys(c.GeoIP.Expected)) {
+		expected := c.GeoIP.Expected[hostname]
+		path := elementPath("geoip.expected", hostname)
+		problems.check(len(expected.Countries) == 0 || c.GeoIP.CountryDB != "", path+".countries", "needs geoip.country_db")
+		problems.check(len(expected.ASNs) == 0 || c.GeoIP.ASNDB != "", path+".asns", "needs geoip.asn_db")
+		for _, country := range expected.Countries {
+			problems.check(len(country) == 2 && strings.ToUpper(country) == country, path+".countries", fmt.Sprintf("%q must be a two-letter upper-case code", country))
+		}
+	}
+	return problems.err()
+}
+
+// ScreeningSource configures one blocklist or allowlist.
+type ScreeningSource struct {
+	// Name identifies the list in events, logs and metrics.
+	Name string `json:"name"`
+	// Kind is "block" (the default) or "allow"; allowlist entries are never
+	// reported even when a blocklist also matches.
+	Kind string `json:"kind,omitempty"`
+	// Source is a local file path or an http(s) URL.
+	Source string `json:"source"`
+}
+
+// screeningInterval returns how often screening lists are reloaded.
+func (c *Config) screeningInterval() time.Duration {
+	if c.Screening.Interval.Duration <= 0 {
+		return defaultScreeningInterval
+	}
+	return c.Screening.Interval.Duration
+}
+
+func validateScreening(c *Config) error {
+	var problems configProblems
+	problems.check(c.Screening.Interval.Duration >= 0, "screening.interval", "must not be negative")
+	names := make(map[string]bool, len(c.Screening.Lists))
+	for i, list := range c.Screening.Lists {
+		path := elementPath("screening.lists", i)
+		problems.check(list.Name != "", path+".name", "must be set")
+		problems.check(list.Source != "", path+".source", "must be set")
+		problems.check(list.Name == "" || !names[list.Name], path+".name", fmt.Sprintf("duplicate list name %q", list.Name))
+		names[list.Name] = true
+		switch list.Kind {
+		case "", ScreeningBlock, ScreeningAllow:
+		default:
+			problems.add(path+".kind", fmt.Errorf("unknown kind %q: must be %q or %q", list.Kind, ScreeningBlock, ScreeningAllow))
+		}
+	}
+	return problems.err()
+}
+
+// discoveryInterval returns how often discovery sources are refreshed.
+func (c *Config) discoveryInterval() time.Duration {
+	if c.Discovery.Interval.Duration <= 0 {
+		return defaultDiscoveryInterval
+	}
+	return c.Discovery.Interval.Duration
+}
+
+// discoveryMaxHostnames returns the cap on discovered hostnames.
+func (c *Config) discoveryMaxHostnames() int {
+	if c.Discovery.MaxHostnames <= 0 {
+		return defaultDiscoveryMaxHostnames
+	}
+	return c.Discovery.MaxHostnames
+}
+
+func validateDiscovery(c *Config) error {
+	var problems configProblems
+	problems.check(c.Discovery.Interval.Duration >= 0, "discovery.interval", "must not be negative")
+	problems.check(c.Discovery.MaxHostnames >= 0, "discovery.max_hostnames", "must not be negative")
+	for i, source := range c.Discovery.Sources {
+		_, ok := lookupDiscoverer(source.Type)
+		problems.check(ok, elementPath("discovery.sources", i)+".type", fmt.Sprintf("unknown discovery source type %q", source.Type))
+	}
+	return problems.err()
+}
+
+// remotePollInterval returns how long to wait between etcd polls and after a
+// failed remote config fetch.
+func (c *Config) remotePollInterval() time.Duration {
+	if c.RemoteConfig.PollInterval.Duration <= 0 {
+		return defaultRemotePollInterval
+	}
+	return c.RemoteConfig.PollInterval.Duration
+}
+
+func validateRemoteConfig(c *Config) error {
+	remote := c.RemoteConfig
+	if remote.Backend == "" {
+		return nil
+	}
+	var problems configProblems
+	switch remote.Backend {
+	case "consul", "etcd":
+	default:
+		problems.add("remote_config.backend", fmt.Errorf("unknown backend %q: must be \"consul\" or \"etcd\"", remote.Backend))
+	}
+	problems.check(remote.Address != "", "remote_config.address", "must be set")
+	problems.check(remote.Key != "", "remote_config.key", "must be set")
+	problems.check(remote.PollInterval.Duration >= 0, "remote_config.poll_interval", "must not be negative")
+	return problems.err()
+}
+
+// Forwarder defaults used when forwarder.address or forwarder.port is unset.
+const (
+	defaultForwarderAddress = "127.0.0.1"
+	defaultForwarderPort    = 8053
+)
+
+// forwarderAddr returns the listen address for the local DNS forwarder.
+func (c *Config) forwarderAddr() string {
+	address := c.Forwarder.Address
+	if address == "" {
+		address = defaultForwarderAddress
+	}
+	port := c.Forwarder.Port
+	if port == 0 {
+		port = defaultForwarderPort
+	}
+	return net.JoinHostPort(address, fmt.Sprint(port))
+}
+
+func validateForwarder(c *Config) error {
+	var problems configProblems
+	problems.check(c.Forwarder.Port >= 0 && c.Forwarder.Port <= 65535, "forwarder.port", "must be between 0 and 65535")
+	return problems.err()
+}
+
+// Query modes for querying.mode.
+const (
+	// QueryModeConcurrent sends a hostname's queries to all servers at once.
+	QueryModeConcurrent = "concurrent"
+	// QueryModeSequential queries servers one after another in configured
+	// order, waiting querying.stagger between them, to expose cache-warming
+	// effects between upstreams.
+	QueryModeSequential = "sequential"
+)
+
+// QueryMode returns the configured query mode, defaulting to concurrent.
+func (c *Config) QueryMode() string {
+	if c == nil || strings.TrimSpace(c.Querying.Mode) == "" {
+		return QueryModeConcurrent
+	}
+	return strings.ToLower(strings.TrimSpace(c.Querying.Mode))
+}
+
+func validateQuerying(c *Config) error {
+	var problems configProblems
+	switch c.QueryMode() {
+	case QueryModeConcurrent, QueryModeSequential:
+	default:
+		problems.add("querying.mode", fmt.Errorf("invalid query mode %q: must be %q or %q", c.Querying.Mode, QueryModeConcurrent, QueryModeSequential))
+	}
+	problems.check(c.Querying.Stagger.Duration >= 0, "querying.stagger", "must not be negative")
+	problems.add("querying.selection", validateSelection(c))
+	problems.add("querying.hedge_delay", validateHedge(c))
+	problems.add("querying.id_source", validateIDSource(c))
+	problems.add("querying.source_ports", validateSourcePorts(c))
+	return problems.err()
+}
+
+// analyzerEnabled reports whether the named analyzer should run.
+func (c *Config) analyzerEnabled(name string) bool {
+	for _, disabled := range c.Analyzers.Disabled {
+		if disabled == name {
+			return false
+		}
+	}
+	return true
+}
+
+// validateAnalyzers rejects disabling analyzers that are not registered, so a
+// typo does not silently leave one running.
+func validateAnalyzers(c *Config) error {
+	var problems configProblems
+	for i, name := range c.Analyzers.Disabled {
+		_, ok := dnsanalysis.LookupAnalyzer(name)
+		problems.check(ok, elementPath("analyzers.disabled", i), fmt.Sprintf("unknown analyzer %q", name))
+	}
+	return problems.err()
+}
+
+// defaultEventHistorySize is used when events.history_size is unset.
+const defaultEventHistorySize = 500
+
+// ServerSettings holds per-server query overrides keyed by the server
+// address in Config.ServerSettings.
+type ServerSettings struct {
+	// RecursionDesired controls the RD flag; nil keeps the default (set).
+	// Disable it for direct checks against authoritative servers.
+	RecursionDesired *bool `json:"recursion_desired,omitempty"`
+	// DelegationTrace queries the NS records of each of the name's ancestors
+	// before asking for the full name, failing early when one is missing.
+	DelegationTrace bool `json:"delegation_trace,omitempty"`
+	// NSID requests the EDNS name server identifier on every query.
+	NSID bool `json:"nsid,omitempty"`
+	// ChaosProbe queries id.server/hostname.bind (CHAOS TXT) once per cycle
+	// to identify the anycast node answering for the server.
+	ChaosProbe bool `json:"chaos_probe,omitempty"`
+	// Fingerprint probes version.bind and related names once per cycle to
+	// infer the resolver implementation and flag when it changes.
+	Fingerprint bool `json:"fingerprint,omitempty"`
+	// InterceptionProbe queries random nonexistent names and fetches
+	// well-known connectivity check URLs once per cycle to detect NXDOMAIN
+	// rewriting and captive portals.
+	InterceptionProbe bool `json:"interception_probe,omitempty"`
+	// Timeout bounds each query to this server; zero uses query_timeout.
+	Timeout Duration `json:"timeout"`
+	// PoolSize caps the idle DNS clients kept for this server; zero uses
+	// the pool default.
+	PoolSize int `json:"pool_size,omitempty"`
+	// MaxInFlight caps the queries in flight to this server at once, for
+	// servers that throttle busy clients; further queries wait for a slot.
+	// Zero leaves it unlimited.
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+	// Role is ServerRolePrimary (default) or ServerRoleFallback. Fallbacks
+	// are only queried when a primary fails or its breaker is open.
+	Role string `json:"role,omitempty"`
+}
+
+// Server roles for server_settings.role.
+const (
+	ServerRolePrimary  = "primary"
+	ServerRoleFallback = "fallback"
+)
+
+// role returns the normalized server role, defaulting to primary.
+func (s ServerSettings) role() string {
+	if strings.TrimSpace(s.Role) == "" {
+		return ServerRolePrimary
+	}
+	return strings.ToLower(strings.TrimSpace(s.Role))
+}
+
+// recursionDesired reports whether queries should set the RD flag.
+func (s ServerSettings) recursionDesired() bool {
+	if s.RecursionDesired == nil {
+		return true
+	}
+	return *s.RecursionDesired
+}
+
+// dns64Enabled reports whether AAAA answers are collected and checked for
+// DNS64 synthesis.
+func (c *Config) dns64Enabled() bool {
+	return c != nil && c.DNS64.Enabled
+}
+
+// mdnsEnabled reports whether .local names are resolved over multicast DNS.
+func (c *Config) mdnsEnabled() bool {
+	return c != nil && c.MDNS.Enabled && len(c.MDNS.Hostnames) > 0
+}
+
+// mdnsTimeout returns how long to wait for a multicast answer.
+func (c *Config) mdnsTimeout() time.Duration {
+	if c == nil || c.MDNS.Timeout.Duration <= 0 {
+		return defaultMDNSTimeout
+	}
+	return c.MDNS.Timeout.Duration
+}
+
+// validateMDNS requires .local names and compare entries that map a
+// configured .local name to a monitored unicast hostname.
+func validateMDNS(c *Config) error {
+	var problems configProblems
+	problems.check(c.MDNS.Timeout.Duration >= 0, "mdns.timeout", "must not be negative")
+	names := make(map[string]bool, len(c.MDNS.Hostnames))
+	for i, hostname := range c.MDNS.Hostnames {
+		local := strings.HasSuffix(strings.ToLower(strings.TrimSuffix(hostname, ".")), ".local")
+		problems.check(local, elementPath("mdns.hostnames", i), fmt.Sprintf("%s must end in .local", hostname))
+		names[hostname] = true
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.MDNS.Compare)) {
+		path := elementPath("mdns.compare", name)
+		problems.check(names[name], path, "is not in mdns.hostnames")
+		unicast := c.MDNS.Compare[name]
+		problems.check(slices.Contains(c.Hostnames, unicast), path, fmt.Sprintf("%s is not in hostnames", unicast))
+	}
+	return problems.err()
+}
+
+// Settings returns the per-server settings for server, or the zero value
+// when none are configured.
+func (c *Config) Settings(server string) ServerSettings {
+	if c == nil || c.ServerSettings == nil {
+		return ServerSettings{}
+	}
+	return c.ServerSettings[server]
+}
+
+// Role returns the role of server, ServerRolePrimary unless configured as a
+// fallback.
+func (c *Config) Role(server string) string {
+	return c.Settings(server).role()
+}
+
+// ServersByRole splits DNSServers into primaries and fallbacks, keeping the
+// configured order within each group.
+func (c *Config) ServersByRole() (primaries, fallbacks []string) {
+	if c == nil {
+		return nil, nil
+	}
+	for _, server := range c.DNSServers {
+		if c.Role(server) == ServerRoleFallback {
+			fallbacks = append(fallbacks, server)
+		} else {
+			primaries = append(primaries, server)
+		}
+	}
+	return primaries, fallbacks
+}
+
+// QueryTimeoutFor returns the deadline applied to each query sent to server.
+func (c *Config) QueryTimeoutFor(server string) time.Duration {
+	if timeout := c.Settings(server).Timeout.Duration; timeout > 0 {
+		return timeout
+	}
+	if c == nil {
+		return 0
+	}
+	return c.QueryTimeout.Duration
+}
+
+// defaultCacheCleanupInterval is used when cache.cleanup_interval is unset.
+const defaultCacheCleanupInterval = time.Minute
+
+// cacheCleanupInterval returns how often expired cache entries are swept.
+func (c *Config) cacheCleanupInterval() time.Duration {
+	if c.Cache.CleanupInterval.Duration <= 0 {
+		return defaultCacheCleanupInterval
+	}
+	return c.Cache.CleanupInterval.Duration
+}
+
+// cacheTTL returns how long a response for hostname carrying ttl seconds is
+// cached: the hostname's override if it has one, otherwise ttl clamped to
+// cache.min_ttl and cache.max_ttl.
+func (c *Config) cacheTTL(hostname string, ttl uint32) time.Duration {
+	d := time.Duration(ttl) * time.Second
+	if c == nil {
+		return d
+	}
+	if override, ok := c.Cache.TTLOverrides[hostname]; ok {
+		return override.Duration
+	}
+	if c.Cache.MinTTL.Duration > 0 && d < c.Cache.MinTTL.Duration {
+		d = c.Cache.MinTTL.Duration
+	}
+	if c.Cache.MaxTTL.Duration > 0 && d > c.Cache.MaxTTL.Duration {
+		d = c.Cache.MaxTTL.Duration
+	}
+	return d
+}
+
+// validateCacheTTL checks the cache TTL clamps and overrides.
+func validateCacheTTL(c *Config) error {
+	var problems configProblems
+	problems.check(c.Cache.MinTTL.Duration >= 0, "cache.min_ttl", "must not be negative")
+	problems.check(c.Cache.MaxTTL.Duration >= 0, "cache.max_ttl", "must not be negative")
+	problems.check(c.Cache.MaxTTL.Duration <= 0 || c.Cache.MinTTL.Duration <= c.Cache.MaxTTL.Duration, "cache.min_ttl", "must not exceed cache.max_ttl")
+	for _, hostname := range slices.Sorted(maps.Keys(c.Cache.TTLOverrides)) {
+		path := elementPath("cache.ttl_overrides", hostname)
+		problems.check(slices.Contains(c.Hostnames, hostname), path, "is not in hostnames")
+		problems.check(c.Cache.TTLOverrides[hostname].Duration >= 0, path, "must not be negative")
+	}
+	return problems.err()
+}
+
+// cycleTimeout returns how long a resolution cycle may run before its
+// queries are canceled; zero means the query interval.
+func (c *Config) cycleTimeout() time.Duration {
+	if c.CycleTimeout.Duration <= 0 {
+		return c.QueryInterval.Duration
+	}
+	return c.CycleTimeout.Duration
 }
 
 // DefaultConfig returns a base configuration with built-in defaults.
@@ -83,93 +679,162 @@ func DefaultConfig() *Config {
 	config.CircuitBreaker.Threshold = 5
 	config.CircuitBreaker.Timeout = Duration{Duration: 30 * time.Second}
 	config.Cache.MaxSize = 1000
+	config.Events.HistorySize = defaultEventHistorySize
 	return config
 }
 
-// Validate validates the configuration
+// Validate validates the configuration, returning every problem found as
+// ConfigErrors.
 func (c *Config) Validate() error {
-	if len(c.Hostnames) == 0 {
-		return fmt.Errorf("no hostnames specified")
-	}
-	if len(c.DNSServers) == 0 {
-		return fmt.Errorf("no DNS servers specified")
-	}
-	if c.QueryTimeout.Duration <= 0 {
-		return fmt.Errorf("invalid query timeout")
-	}
-	if c.QueryInterval.Duration <= 0 {
-		return fmt.Errorf("invalid query interval")
-	}
-	if c.CircuitBreaker.Threshold <= 0 {
-		return fmt.Errorf("invalid circuit breaker threshold")
-	}
-	if c.CircuitBreaker.Timeout.Duration <= 0 {
-		return fmt.Errorf("invalid circuit breaker timeout")
-	}
-	if c.Cache.MaxSize <= 0 {
-		return fmt.Errorf("invalid cache max size")
-	}
-	if _, err := instrumentation.ParseLevel(c.InstrumentationLevel); err != nil {
-		return fmt.Errorf("invalid instrumentation level: %w", err)
-	}
-	return nil
+	var problems configProblems
+	validateSettings(c, &problems)
+	return problems.err()
 }
 
-// LoadConfig loads the configuration from a file
+// LoadConfig loads the configuration from a file, merging in any files it
+// includes, or from an http(s) URL.
 func LoadConfig(path string) (*Config, error) {
-	file, err := os.Open(path)
+	if isConfigURL(path) {
+		return loadConfigURL(path)
+	}
+	data, err := readConfigFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open config file: %v", err)
+		return nil, err
 	}
-	defer file.Close()
+	return decodeConfig(bytes.NewReader(data))
+}
 
+// decodeConfig reads a JSON config, then normalizes and validates it.
+func decodeConfig(r io.Reader) (*Config, error) {
 	var config Config
-	if err := json.NewDecoder(file).Decode(&config); err != nil {
-		return nil, fmt.Errorf("failed to decode config file: %v", err)
-	}
-	config.InstrumentationLevel = normalizeInstrumentationLevel(config.InstrumentationLevel)
-
-	// Ensure DNS servers have ports
-	for i, server := range config.DNSServers {
-		if _, _, err := net.SplitHostPort(server); err != nil {
-			config.DNSServers[i] = net.JoinHostPort(server, "53")
+	if err := json.NewDecoder(r).Decode(&config); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			err = ConfigErrors{{Path: typeErr.Field, Message: fmt.Sprintf("must be %s, not %s", typeErr.Type, typeErr.Value)}}
 		}
+		return nil, fmt.Errorf("failed to decode config file: %w", err)
+	}
+	if err := prepareConfig(&config); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
 	}
-
 	if err := validateConfig(&config); err != nil {
-		return nil, fmt.Errorf("invalid config: %v", err)
+		return nil, fmt.Errorf("invalid config: %w", err)
 	}
 
 	return &config, nil
 }
 
-// validateConfig validates the configuration values
-func validateConfig(cfg *Config) error {
-	if len(cfg.Hostnames) == 0 {
-		return errors.New("at least one hostname must be specified")
-	}
-	if len(cfg.DNSServers) == 0 {
-		return errors.New("at least one DNS server must be specified")
-	}
-	if cfg.QueryTimeout.Duration <= 0 {
-		return errors.New("query timeout must be positive")
+// prepareConfig normalizes a decoded config: it expands hostname templates,
+// then normalizes hostnames and servers and drops duplicates.
+func prepareConfig(config *Config) error {
+	config.InstrumentationLevel = normalizeInstrumentationLevel(config.InstrumentationLevel)
+
+	// Expand hostname templates such as web{01..20}.example.com
+	var err error
+	if config.Hostnames, err = ExpandHostnames(config.Hostnames); err != nil {
+		return ConfigErrors{{Path: "hostnames", Message: err.Error()}}
 	}
-	if cfg.QueryInterval.Duration <= 0 {
-		return errors.New("query interval must be positive")
+	if config.MDNS.Hostnames, err = ExpandHostnames(config.MDNS.Hostnames); err != nil {
+		return ConfigErrors{{Path: "mdns.hostnames", Message: err.Error()}}
 	}
-	if cfg.CircuitBreaker.Threshold <= 0 {
-		return errors.New("circuit breaker threshold must be positive")
+
+	normalizeConfig(config)
+	return nil
+}
+
+// validateConfig validates a loaded config: everything Validate checks plus
+// the checks, analyzers, GeoIP, screening, schedule, burst and incident
+// settings. It returns every problem found as ConfigErrors.
+func validateConfig(cfg *Config) error {
+	var problems configProblems
+	validateSettings(cfg, &problems)
+	problems.include(validateAnalyzers(cfg))
+	problems.include(validateChecks(cfg))
+	problems.include(validateGeoIP(cfg))
+	problems.include(validateScreening(cfg))
+	problems.include(validateSchedules(cfg))
+	problems.include(validateBurst(cfg))
+	problems.include(validateIncidents(cfg))
+	return problems.err()
+}
+
+// validateSettings records the problems shared by Validate and
+// validateConfig.
+func validateSettings(c *Config, problems *configProblems) {
+	problems.check(len(c.Hostnames) > 0, "hostnames", "at least one hostname must be specified")
+	problems.check(len(c.DNSServers) > 0, "dns_servers", "at least one DNS server must be specified")
+	problems.check(c.QueryTimeout.Duration > 0, "query_timeout", "must be positive")
+	problems.check(c.QueryInterval.Duration > 0, "query_interval", "must be positive")
+	problems.check(c.HealthPort >= 0 && c.HealthPort <= 65535, "health_port", "must be between 0 and 65535")
+	problems.check(c.MetricsPort >= 0 && c.MetricsPort <= 65535, "metrics_port", "must be between 0 and 65535")
+	problems.check(c.MetricsPort == 0 || c.MetricsPort != c.HealthPort, "metrics_port", "must differ from health_port")
+	problems.check(c.CycleTimeout.Duration >= 0, "cycle_timeout", "must not be negative")
+	problems.check(c.WarmUp.Duration >= 0, "warm_up", "must not be negative")
+	problems.check(c.SlowQueryLog.Threshold.Duration >= 0, "slow_query_log.threshold", "must not be negative")
+	problems.check(c.CircuitBreaker.Threshold > 0, "circuit_breaker.threshold", "must be positive")
+	problems.check(c.CircuitBreaker.Timeout.Duration > 0, "circuit_breaker.timeout", "must be positive")
+	problems.check(c.HealthCheck.UnhealthyThreshold >= 0, "health_check.unhealthy_threshold", "must not be negative")
+	problems.check(c.HealthCheck.HealthyThreshold >= 0, "health_check.healthy_threshold", "must not be negative")
+	problems.check(c.Cache.MaxSize > 0, "cache.max_size", "must be positive")
+	problems.check(c.Cache.MaxBytes >= 0, "cache.max_bytes", "must not be negative")
+	problems.check(c.Cache.CleanupInterval.Duration >= 0, "cache.cleanup_interval", "must not be negative")
+	problems.include(validateCacheTTL(c))
+	problems.include(validateCachePolicies(c))
+	if _, err := instrumentation.ParseLevel(c.InstrumentationLevel); err != nil {
+		problems.add("instrumentation_level", err)
 	}
-	if cfg.CircuitBreaker.Timeout.Duration <= 0 {
-		return errors.New("circuit breaker timeout must be positive")
+	problems.check(c.Events.HistorySize >= 0, "events.history_size", "must not be negative")
+	problems.include(validateLogRotation(c))
+	problems.include(validateServerSettings(c))
+	if len(c.DNSServers) > 0 {
+		primaries, _ := c.ServersByRole()
+		problems.check(len(primaries) > 0, "dns_servers", "at least one DNS server must be a primary")
+		problems.check(c.ReferenceServer == "" || slices.Contains(primaries, c.ReferenceServer), "reference_server", "must be a primary server in dns_servers")
 	}
-	if cfg.Cache.MaxSize <= 0 {
-		return errors.New("cache max size must be positive")
+	problems.include(validateQuerying(c))
+	problems.include(validateEmail(c))
+	problems.include(validatePublish(c))
+	problems.include(validateKafka(c))
+	problems.include(validateArchive(c))
+	problems.include(validateReports(c))
+	problems.include(validateGRPC(c))
+	problems.include(validateLeader(c))
+	problems.include(validateMemory(c))
+	problems.include(validateSampling(c))
+	problems.include(validateForwarder(c))
+	problems.include(validateMDNS(c))
+	problems.include(validateFlapping(c))
+	problems.include(validateLatencyAnomaly(c))
+	problems.include(validateDiscovery(c))
+	problems.include(validateRemoteConfig(c))
+}
+
+// validateServerSettings rejects settings for servers that are not monitored,
+// negative per-server timeouts and pool sizes, and unknown roles.
+func validateServerSettings(cfg *Config) error {
+	var problems configProblems
+	for _, server := range slices.Sorted(maps.Keys(cfg.ServerSettings)) {
+		settings := cfg.ServerSettings[server]
+		path := elementPath("server_settings", server)
+		problems.check(slices.Contains(cfg.DNSServers, server), path, "is not in dns_servers")
+		problems.check(settings.Timeout.Duration >= 0, path+".timeout", "must not be negative")
+		problems.check(settings.PoolSize >= 0, path+".pool_size", "must not be negative")
+		problems.check(settings.MaxInFlight >= 0, path+".max_in_flight", "must not be negative")
+		switch settings.role() {
+		case ServerRolePrimary, ServerRoleFallback:
+		default:
+			problems.add(path+".role", fmt.Errorf("must be %q or %q", ServerRolePrimary, ServerRoleFallback))
+		}
 	}
-	if _, err := instrumentation.ParseLevel(cfg.InstrumentationLevel); err != nil {
-		return fmt.Errorf("invalid instrumentation level: %w", err)
+	return problems.err()
+}
+
+// ensurePort appends the default DNS port when server has none.
+func ensurePort(server string) string {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(server, "53")
 	}
-	return nil
+	return server
 }
 
 func normalizeInstrumentationLevel(value string) string {
@@ -180,27 +845,30 @@ func normalizeInstrumentationLevel(value string) string {
 }
 
 // ResolveConfigPath determines which config file to use.
-// Priority: explicit flag > ./config.json > XDG config
-// Returns: (path, wasCreated, error)
-func ResolveConfigPath(explicitPath string) (string, bool, error) {
+// Priority: explicit flag > ./config.json > XDG config. It returns an empty
+// path when no config file exists; no file is created.
+func ResolveConfigPath(explicitPath string) (string, error) {
 	// 1. Explicit path takes priority
 	if explicitPath != "" {
-		return explicitPath, false, nil
+		return explicitPath, nil
 	}
 
 	// 2. Check current directory (backward compatibility)
 	if fileExists("./config.json") {
-		return "./config.json", false, nil
+		return "./config.json", nil
 	}
 
-	// 3. Check/create XDG config file
-	xdgPath, wasCreated, err := xdg.ConfigFile()
-	if err != nil {
-		// If XDG fails, return empty (will use defaults)
-		return "", false, nil
+	// 3. Check XDG config file
+	if xdgPath, exists := xdg.ConfigFile(); exists {
+		return xdgPath, nil
 	}
+	return "", nil
+}
 
-	return xdgPath, wasCreated, nil
+// DefaultConfigPath returns where the setup wizard writes a new config file.
+func DefaultConfigPath() string {
+	path, _ := xdg.ConfigFile()
+	return path
 }
 
 // fileExists checks if a file exists and is not a directory.
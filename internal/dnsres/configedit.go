@@ -0,0 +1,147 @@
+package dnsres
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EditConfig returns a copy of config with settings applied, normalized and
+// validated like a loaded config. settings maps JSON keys to their new
+// values, with dots separating nested keys such as
+// "circuit_breaker.threshold". config itself is not modified.
+func EditConfig(config *Config, settings map[string]any) (*Config, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeConfigObject(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := setConfigValues(doc, settings); err != nil {
+		return nil, err
+	}
+	if data, err = json.Marshal(doc); err != nil {
+		return nil, err
+	}
+	edited, err := decodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	edited.download = config.download
+	return edited, nil
+}
+
+// SaveConfigSettings writes settings, keyed as for EditConfig, into the
+// config file at path and leaves its other keys as they are. The edited file
+// must load before it replaces path, so a rejected edit leaves the file
+// untouched. Files that include others are refused, since included lists
+// would be merged into the edited ones.
+func SaveConfigSettings(path string, settings map[string]any) (err error) {
+	if isConfigURL(path) {
+		return fmt.Errorf("config %s is a URL and cannot be edited", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	doc, err := decodeConfigObject(data)
+	if err != nil {
+		return fmt.Errorf("failed to decode config file %s: %v", path, err)
+	}
+	if _, ok := doc["include"]; ok {
+		return fmt.Errorf("config file %s includes other files; edit it by hand", path)
+	}
+	if err := setConfigValues(doc, settings); err != nil {
+		return err
+	}
+	data, err = json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := decodeConfig(bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), ".config-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(temp.Name())
+		}
+	}()
+	if _, err = temp.Write(append(data, '\n')); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+	if err = temp.Close(); err != nil {
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+	if err = os.Chmod(temp.Name(), info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+	if err = os.Rename(temp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+	return nil
+}
+
+// Reload queues config to replace the running config between cycles, as a
+// remote config change does; settings fixed at startup keep their values.
+// actor is recorded in the audit log. Reload blocks until the run loop
+// accepts config or ctx is done.
+func (r *DNSResolver) Reload(ctx context.Context, config *Config, actor string) error {
+	select {
+	case r.reloads <- configReload{config: config, actor: actor}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// decodeConfigObject decodes a JSON object, keeping numbers as written.
+func decodeConfigObject(data []byte) (map[string]any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc map[string]any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("config must be a JSON object")
+	}
+	return doc, nil
+}
+
+// setConfigValues sets each dotted key of settings in doc, creating the
+// objects along its path.
+func setConfigValues(doc map[string]any, settings map[string]any) error {
+	for key, value := range settings {
+		parts := strings.Split(key, ".")
+		object := doc
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := object[part].(map[string]any)
+			if !ok {
+				if object[part] != nil {
+					return fmt.Errorf("config key %s is not an object", part)
+				}
+				child = map[string]any{}
+				object[part] = child
+			}
+			object = child
+		}
+		object[parts[len(parts)-1]] = value
+	}
+	return nil
+}
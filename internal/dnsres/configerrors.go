@@ -0,0 +1,75 @@
+package dnsres
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ConfigError is one problem found in a config, at Path: the dotted JSON
+// path of the offending setting, such as "circuit_breaker.timeout".
+type ConfigError struct {
+	Path    string
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// ConfigErrors is every problem validation found in a config.
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// elementPath returns the path of the element of the list or map at path
+// with the given index or key, such as "kafka.brokers[1]".
+func elementPath(path string, key any) string {
+	return fmt.Sprintf("%s[%v]", path, key)
+}
+
+// configProblems collects ConfigErrors.
+type configProblems struct {
+	errs ConfigErrors
+}
+
+// check records message at path unless ok.
+func (p *configProblems) check(ok bool, path, message string) {
+	if !ok {
+		p.errs = append(p.errs, ConfigError{Path: path, Message: message})
+	}
+}
+
+// add records err, if any, at path.
+func (p *configProblems) add(path string, err error) {
+	if err != nil {
+		p.errs = append(p.errs, ConfigError{Path: path, Message: err.Error()})
+	}
+}
+
+// include records the problems in err, which may be ConfigErrors.
+func (p *configProblems) include(err error) {
+	var errs ConfigErrors
+	if errors.As(err, &errs) {
+		p.errs = append(p.errs, errs...)
+		return
+	}
+	p.add("", err)
+}
+
+// err returns the problems as ConfigErrors, or nil when there are none.
+func (p *configProblems) err() error {
+	if len(p.errs) == 0 {
+		return nil
+	}
+	return p.errs
+}
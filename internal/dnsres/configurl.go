@@ -0,0 +1,166 @@
+package dnsres
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dnsres/internal/xdg"
+)
+
+// configDownload records where a config loaded from a URL came from, so the
+// resolver can revalidate it.
+type configDownload struct {
+	url  string
+	etag string
+	data []byte
+	// stale is the download error when the config was read from the
+	// last-good copy instead.
+	stale error
+}
+
+func isConfigURL(path string) bool {
+	return strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://")
+}
+
+// loadConfigURL downloads the config at rawURL. A valid download is kept as
+// the last-good copy, which is used instead when the URL is unreachable.
+func loadConfigURL(rawURL string) (*Config, error) {
+	cachePath := configCachePath(rawURL)
+	var cached []byte
+	var cachedETag string
+	if cachePath != "" {
+		cached, _ = os.ReadFile(cachePath)
+		if cached != nil {
+			tag, _ := os.ReadFile(cachePath + ".etag")
+			cachedETag = string(tag)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), remoteInitialFetchTimeout)
+	defer cancel()
+	data, etag, err := downloadConfig(ctx, http.DefaultClient, rawURL, cachedETag)
+	download := &configDownload{url: rawURL, etag: etag, data: data}
+	switch {
+	case err != nil && cached == nil:
+		return nil, fmt.Errorf("failed to download config: %v", err)
+	case err != nil:
+		download.data, download.etag, download.stale = cached, cachedETag, err
+	case data == nil:
+		download.data, download.etag = cached, cachedETag
+	}
+
+	config, err := decodeConfig(bytes.NewReader(download.data))
+	if err != nil {
+		return nil, err
+	}
+	if config.RemoteConfig.Backend != "" {
+		return nil, errors.New("invalid config: remote_config cannot be used with a config URL")
+	}
+	if data != nil {
+		saveConfigCache(cachePath, data, etag)
+	}
+	config.download = download
+	return config, nil
+}
+
+// downloadConfig fetches rawURL, sending etag as If-None-Match. It returns a
+// nil body when the server answers 304 Not Modified.
+func downloadConfig(ctx context.Context, client *http.Client, rawURL, etag string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, etag, nil
+	case http.StatusOK:
+	default:
+		return nil, "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, resp.Header.Get("ETag"), nil
+}
+
+// configCachePath returns where the last-good copy of rawURL is kept, or ""
+// when there is no state directory.
+func configCachePath(rawURL string) string {
+	state := xdg.StateHome()
+	if state == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(rawURL))
+	return filepath.Join(state, "dnsres", "config-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// saveConfigCache replaces the last-good copy. Failures only cost the
+// offline fallback, so they are ignored.
+func saveConfigCache(path string, data []byte, etag string) {
+	if path == "" || os.MkdirAll(filepath.Dir(path), 0755) != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	if os.WriteFile(tmp, data, 0600) != nil || os.Rename(tmp, path) != nil {
+		os.Remove(tmp)
+		return
+	}
+	if etag == "" {
+		os.Remove(path + ".etag")
+		return
+	}
+	os.WriteFile(path+".etag", []byte(etag), 0600)
+}
+
+// urlSource revalidates a config loaded from a URL once per poll interval.
+// Unchanged documents cost a 304 Not Modified.
+type urlSource struct {
+	url       string
+	etag      string
+	last      []byte
+	cachePath string
+	client    *http.Client
+	poll      time.Duration
+}
+
+func (s *urlSource) Name() string {
+	return "url"
+}
+
+func (s *urlSource) Fetch(ctx context.Context) ([]byte, error) {
+	if !sleepContext(ctx, s.poll) {
+		return nil, ctx.Err()
+	}
+	data, etag, err := downloadConfig(ctx, s.client, s.url, s.etag)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return s.last, nil
+	}
+	s.etag, s.last = etag, data
+	if _, err := decodeConfig(bytes.NewReader(data)); err == nil {
+		saveConfigCache(s.cachePath, data, etag)
+	}
+	return data, nil
+}
@@ -0,0 +1,103 @@
+package dnsres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+)
+
+// errCycleTimeout is the cause of a cycle context canceled at its deadline,
+// which tells stragglers apart from queries canceled by shutdown.
+var errCycleTimeout = errors.New("cycle timeout")
+
+// cycleKey marks contexts of resolution cycles.
+type cycleKey struct{}
+
+// cycleDeadline collects the queries still running when a cycle's deadline
+// expired.
+type cycleDeadline struct {
+	timeout    time.Duration
+	mu         sync.Mutex
+	stragglers []string
+}
+
+// withCycleDeadline returns a context for one cycle that is canceled after
+// timeout, or only with ctx when timeout is not positive.
+func withCycleDeadline(ctx context.Context, timeout time.Duration) (context.Context, *cycleDeadline, context.CancelFunc) {
+	deadline := &cycleDeadline{timeout: timeout}
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, errCycleTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	return context.WithValue(ctx, cycleKey{}, deadline), deadline, cancel
+}
+
+// cycleTimedOut reports whether ctx was canceled by its cycle's deadline
+// rather than by shutdown.
+func cycleTimedOut(ctx context.Context) bool {
+	return ctx.Err() != nil && errors.Is(context.Cause(ctx), errCycleTimeout)
+}
+
+// recordStraggler counts a query of hostname on server that was canceled at
+// the cycle deadline as a timeout and returns the error it failed with.
+func (r *DNSResolver) recordStraggler(ctx context.Context, hostname, server string) error {
+	deadline, _ := ctx.Value(cycleKey{}).(*cycleDeadline)
+	if deadline == nil {
+		return errCycleTimeout
+	}
+	deadline.mu.Lock()
+	deadline.stragglers = append(deadline.stragglers, hostname+" via "+server)
+	deadline.mu.Unlock()
+
+	err := fmt.Errorf("query still running at the %s cycle deadline", deadline.timeout)
+	r.recordBreakerFailure(server, err)
+	metrics.DNSResolutionFailure.WithLabelValues(server, r.metricHostname(hostname), "cycle_timeout").Inc()
+	r.emitEvent(ResolverEvent{
+		Type:     EventResolveFailure,
+		Time:     time.Now(),
+		Hostname: hostname,
+		Server:   server,
+		Duration: deadline.timeout,
+		Error:    err.Error(),
+		Source:   "cycle_timeout",
+	})
+	return err
+}
+
+// reportCycleTimeout surfaces a cycle that hit its deadline: the queries it
+// canceled and the hostnames it never got to. A cycle whose queries all
+// finished in time is not reported.
+func (r *DNSResolver) reportCycleTimeout(deadline *cycleDeadline, unqueried int) {
+	deadline.mu.Lock()
+	stragglers := append([]string(nil), deadline.stragglers...)
+	deadline.mu.Unlock()
+	if len(stragglers) == 0 && unqueried == 0 {
+		return
+	}
+
+	detail := fmt.Sprintf("%d queries canceled", len(stragglers))
+	if len(stragglers) > 0 {
+		detail += " (" + strings.Join(stragglers, ", ") + ")"
+	}
+	if unqueried > 0 {
+		detail += fmt.Sprintf("; %d hostnames not queried", unqueried)
+	}
+	metrics.DNSResCycleTimeouts.Inc()
+	r.errorLog.Printf("Resolution cycle timed out after %s: %s", deadline.timeout, detail)
+	r.appLogf(instrumentation.Low, "resolution cycle timeout timeout=%s canceled=%d unqueried=%d", deadline.timeout, len(stragglers), unqueried)
+	r.outputf("Resolution cycle timed out after %s: %s\n", deadline.timeout, detail)
+	r.emitEvent(ResolverEvent{
+		Type:     EventCycleTimeout,
+		Time:     time.Now(),
+		Duration: deadline.timeout,
+		Detail:   detail,
+	})
+}
@@ -0,0 +1,58 @@
+package dnsres
+
+import (
+	"context"
+	"fmt"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// ancestorNames returns the ancestors of hostname from the top-level label
+// down, excluding hostname itself (e.g. "com.", "example.com." for
+// "www.example.com").
+func ancestorNames(hostname string) []string {
+	fqdn := dns.Fqdn(hostname)
+	offsets := dns.Split(fqdn)
+	names := make([]string, 0, len(offsets))
+	for i := len(offsets) - 1; i > 0; i-- {
+		names = append(names, fqdn[offsets[i]:])
+	}
+	return names
+}
+
+// traceDelegation queries server for the NS records of each of hostname's
+// ancestors, checking that the delegation chain down to it exists. An
+// NXDOMAIN on any ancestor ends the walk early since the full name cannot
+// exist below it.
+//
+// This is not QNAME minimization: the full name still goes to the same
+// server afterwards, and a recursive server resolves it upstream however it
+// is configured to.
+func (r *DNSResolver) traceDelegation(ctx context.Context, client dnsClient, server, hostname string, recursionDesired bool) error {
+	for _, name := range ancestorNames(hostname) {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeNS)
+		msg.RecursionDesired = recursionDesired
+
+		response, _, err := client.ExchangeContext(ctx, msg, server)
+		if err != nil {
+			return fmt.Errorf("delegation query for %s failed: %w", name, err)
+		}
+		r.appLogf(
+			instrumentation.High,
+			"delegation trace step hostname=%s server=%s name=%s rcode=%s",
+			hostname,
+			server,
+			name,
+			dns.RcodeToString[response.Rcode],
+		)
+		if response.Rcode == dns.RcodeNameError {
+			metrics.DNSResolutionNXDOMAIN.WithLabelValues(server, r.metricHostname(hostname)).Inc()
+			return fmt.Errorf("delegation query for %s returned NXDOMAIN", name)
+		}
+	}
+	return nil
+}
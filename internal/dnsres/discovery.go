@@ -0,0 +1,322 @@
+package dnsres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+)
+
+// Discovery defaults used when the discovery section leaves them unset.
+const (
+	defaultDiscoveryInterval     = time.Hour
+	defaultDiscoveryMaxHostnames = 500
+	discoveryRequestTimeout      = 30 * time.Second
+)
+
+// defaultCRTShURL is the crt.sh certificate transparency search endpoint.
+const defaultCRTShURL = "https://crt.sh/"
+
+// Discoverer finds hostnames to monitor from an external source such as a
+// certificate transparency log or a passive DNS database.
+type Discoverer interface {
+	// Name identifies the source in logs and metrics.
+	Name() string
+	// Discover returns the hostnames currently known to the source.
+	Discover(ctx context.Context) ([]string, error)
+}
+
+// LabelingDiscoverer is implemented by sources that attach metadata labels to
+// the hostnames returned by their most recent Discover call.
+type LabelingDiscoverer interface {
+	Discoverer
+	Labels() map[string]map[string]string
+}
+
+// DiscovererFactory builds a Discoverer from its configuration.
+type DiscovererFactory func(DiscoverySource) (Discoverer, error)
+
+var (
+	discoverersMu sync.RWMutex
+	discoverers   = map[string]DiscovererFactory{
+		"crtsh":      newCRTShDiscoverer,
+		"kubernetes": newKubernetesDiscoverer,
+	}
+)
+
+// RegisterDiscoverer makes a discovery plugin available as a
+// discovery.sources type. Registering an existing type replaces it.
+func RegisterDiscoverer(sourceType string, factory DiscovererFactory) {
+	discoverersMu.Lock()
+	defer discoverersMu.Unlock()
+	discoverers[sourceType] = factory
+}
+
+func lookupDiscoverer(sourceType string) (DiscovererFactory, bool) {
+	discoverersMu.RLock()
+	defer discoverersMu.RUnlock()
+	factory, ok := discoverers[sourceType]
+	return factory, ok
+}
+
+// discoveryState holds the configured discoverers and the hostnames they most
+// recently returned.
+type discoveryState struct {
+	discoverers []Discoverer
+
+	mu        sync.RWMutex
+	bySource  map[string][]string
+	hostnames []string
+	labels    map[string]map[string]string
+}
+
+// newDiscoveryState builds the discoverers configured in config, or returns
+// nil when discovery is not configured.
+func newDiscoveryState(config *Config) (*discoveryState, error) {
+	if len(config.Discovery.Sources) == 0 {
+		return nil, nil
+	}
+	state := &discoveryState{bySource: make(map[string][]string)}
+	for _, source := range config.Discovery.Sources {
+		factory, ok := lookupDiscoverer(source.Type)
+		if !ok {
+			return nil, fmt.Errorf("unknown discovery source type %q", source.Type)
+		}
+		discoverer, err := factory(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s discovery for %s: %w", source.Type, source.Zone, err)
+		}
+		state.discoverers = append(state.discoverers, discoverer)
+	}
+	return state, nil
+}
+
+// monitoredHostnames returns the configured hostnames followed by any
+// discovered ones.
+func (r *DNSResolver) monitoredHostnames() []string {
+	config := r.currentConfig()
+	if r.discovery == nil {
+		return config.Hostnames
+	}
+	r.discovery.mu.RLock()
+	defer r.discovery.mu.RUnlock()
+	if len(r.discovery.hostnames) == 0 {
+		return config.Hostnames
+	}
+	hostnames := make([]string, 0, len(config.Hostnames)+len(r.discovery.hostnames))
+	hostnames = append(hostnames, config.Hostnames...)
+	return append(hostnames, r.discovery.hostnames...)
+}
+
+// DiscoveredHostnames returns the hostnames added by discovery sources.
+func (r *DNSResolver) DiscoveredHostnames() []string {
+	if r.discovery == nil {
+		return nil
+	}
+	r.discovery.mu.RLock()
+	defer r.discovery.mu.RUnlock()
+	return append([]string(nil), r.discovery.hostnames...)
+}
+
+// HostnameLabels returns the discovery labels attached to hostname, or nil.
+func (r *DNSResolver) HostnameLabels(hostname string) map[string]string {
+	if r.discovery == nil {
+		return nil
+	}
+	r.discovery.mu.RLock()
+	defer r.discovery.mu.RUnlock()
+	return r.discovery.labels[hostname]
+}
+
+// runDiscovery refreshes discovered hostnames on the configured schedule until
+// ctx is canceled. The first refresh is done by Start before the first cycle.
+func (r *DNSResolver) runDiscovery(ctx context.Context) {
+	ticker := time.NewTicker(r.currentConfig().discoveryInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.refreshDiscovery(ctx)
+		}
+	}
+}
+
+// refreshDiscovery queries every discoverer and replaces the discovered
+// hostname set. A failing source keeps its previous hostnames.
+func (r *DNSResolver) refreshDiscovery(ctx context.Context) {
+	config := r.currentConfig()
+	if r.discovery == nil {
+		return
+	}
+
+	for _, discoverer := range r.discovery.discoverers {
+		requestCtx, cancel := context.WithTimeout(ctx, discoveryRequestTimeout)
+		names, err := discoverer.Discover(requestCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.errorLog.Printf("Discovery from %s failed: %v", discoverer.Name(), err)
+			r.appLogf(instrumentation.Medium, "discovery failed source=%s err=%v", discoverer.Name(), err)
+			continue
+		}
+		for i, name := range names {
+			names[i] = NormalizeHostname(name)
+		}
+		metrics.DNSResDiscoveredHostnames.WithLabelValues(discoverer.Name()).Set(float64(len(names)))
+		r.appLogf(instrumentation.Low, "discovery refreshed source=%s hostnames=%d", discoverer.Name(), len(names))
+		r.discovery.mu.Lock()
+		r.discovery.bySource[discoverer.Name()] = names
+		r.discovery.mu.Unlock()
+	}
+
+	labels := make(map[string]map[string]string)
+	for _, discoverer := range r.discovery.discoverers {
+		labeling, ok := discoverer.(LabelingDiscoverer)
+		if !ok {
+			continue
+		}
+		for hostname, values := range labeling.Labels() {
+			hostname = NormalizeHostname(hostname)
+			if _, seen := labels[hostname]; !seen {
+				labels[hostname] = values
+			}
+		}
+	}
+
+	configured := make(map[string]bool, len(config.Hostnames))
+	for _, hostname := range config.Hostnames {
+		configured[hostname] = true
+	}
+	limit := config.discoveryMaxHostnames()
+
+	r.discovery.mu.Lock()
+	defer r.discovery.mu.Unlock()
+	previous := make(map[string]bool, len(r.discovery.hostnames))
+	for _, hostname := range r.discovery.hostnames {
+		previous[hostname] = true
+	}
+	var hostnames []string
+collect:
+	for _, discoverer := range r.discovery.discoverers {
+		for _, hostname := range r.discovery.bySource[discoverer.Name()] {
+			if configured[hostname] {
+				continue
+			}
+			if len(hostnames) >= limit {
+				r.appLogf(instrumentation.Medium, "discovery limit reached max_hostnames=%d", limit)
+				break collect
+			}
+			configured[hostname] = true
+			hostnames = append(hostnames, hostname)
+		}
+	}
+
+	added := 0
+	for _, hostname := range hostnames {
+		if !previous[hostname] {
+			added++
+		}
+	}
+	removed := len(previous) - (len(hostnames) - added)
+	r.discovery.hostnames = hostnames
+	r.discovery.labels = labels
+	if added > 0 || removed > 0 {
+		r.outputf("Discovery updated monitored hostnames (added %d, removed %d, total discovered %d)\n", added, removed, len(hostnames))
+		r.appLogf(instrumentation.Low, "discovery updated added=%d removed=%d total=%d", added, removed, len(hostnames))
+	}
+}
+
+// crtshDiscoverer lists names found in certificates logged for a zone,
+// using the crt.sh certificate transparency search.
+type crtshDiscoverer struct {
+	zone   string
+	url    string
+	client *http.Client
+}
+
+func newCRTShDiscoverer(source DiscoverySource) (Discoverer, error) {
+	if normalizeZone(source.Zone) == "" {
+		return nil, fmt.Errorf("a zone is required")
+	}
+	endpoint := source.URL
+	if endpoint == "" {
+		endpoint = defaultCRTShURL
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	return &crtshDiscoverer{
+		zone:   normalizeZone(source.Zone),
+		url:    endpoint,
+		client: &http.Client{Timeout: discoveryRequestTimeout},
+	}, nil
+}
+
+func (d *crtshDiscoverer) Name() string {
+	return "crtsh:" + d.zone
+}
+
+func (d *crtshDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	query := url.Values{"q": {"%." + d.zone}, "output": {"json"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var entries []struct {
+		NameValue string `json:"name_value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, strings.Split(entry.NameValue, "\n")...)
+	}
+	return zoneHostnames(d.zone, names), nil
+}
+
+// zoneHostnames normalizes names, dropping wildcards, duplicates and anything
+// outside zone, and returns them sorted.
+func zoneHostnames(zone string, names []string) []string {
+	seen := make(map[string]bool)
+	var hostnames []string
+	for _, name := range names {
+		name = normalizeZone(name)
+		if name == "" || strings.HasPrefix(name, "*") || seen[name] {
+			continue
+		}
+		if name != zone && !strings.HasSuffix(name, "."+zone) {
+			continue
+		}
+		seen[name] = true
+		hostnames = append(hostnames, name)
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
+
+func normalizeZone(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
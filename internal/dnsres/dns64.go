@@ -0,0 +1,154 @@
+package dnsres
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"dnsres/dnsanalysis"
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// ipv4OnlyName is the RFC 7050 well-known name used to discover DNS64.
+const ipv4OnlyName = "ipv4only.arpa."
+
+// wellKnownDNS64Prefix is the RFC 6052 well-known prefix 64:ff9b::/96.
+var wellKnownDNS64Prefix = net.ParseIP("64:ff9b::")
+
+// dns64Tracker records the synthesis prefix discovered for each server.
+type dns64Tracker struct {
+	mu       sync.RWMutex
+	prefixes map[string]net.IP
+}
+
+func newDNS64Tracker() *dns64Tracker {
+	return &dns64Tracker{prefixes: make(map[string]net.IP)}
+}
+
+func (t *dns64Tracker) set(server string, prefix net.IP) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if prefix == nil {
+		delete(t.prefixes, server)
+		return
+	}
+	t.prefixes[server] = prefix
+}
+
+func (t *dns64Tracker) prefix(server string) net.IP {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.prefixes[server]
+}
+
+// DNS64Snapshot returns the /96 synthesis prefix detected per server.
+func (r *DNSResolver) DNS64Snapshot() map[string]string {
+	snapshot := map[string]string{}
+	if r.dns64 == nil {
+		return snapshot
+	}
+	r.dns64.mu.RLock()
+	defer r.dns64.mu.RUnlock()
+	for server, prefix := range r.dns64.prefixes {
+		snapshot[server] = prefix.String() + "/96"
+	}
+	return snapshot
+}
+
+// detectDNS64 queries ipv4only.arpa AAAA on every server (RFC 7050) and
+// records which servers synthesize IPv6 answers.
+func (r *DNSResolver) detectDNS64(ctx context.Context) {
+	config := r.currentConfig()
+	if r.dns64 == nil || !config.dns64Enabled() {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, server := range config.DNSServers {
+		wg.Add(1)
+		go func(s string) {
+			defer wg.Done()
+			client, err := r.getClient(s)
+			if err != nil {
+				return
+			}
+			defer r.putClient(s, client)
+
+			msg := new(dns.Msg)
+			msg.SetQuestion(ipv4OnlyName, dns.TypeAAAA)
+			response, _, err := client.ExchangeContext(ctx, msg, s)
+			if err != nil {
+				r.appLogf(instrumentation.Medium, "dns64 probe failed server=%s err=%v", s, err)
+				return
+			}
+
+			var prefix net.IP
+			for _, answer := range response.Answer {
+				if aaaa, ok := answer.(*dns.AAAA); ok {
+					prefix = make(net.IP, net.IPv6len)
+					copy(prefix, aaaa.AAAA.To16()[:12])
+					break
+				}
+			}
+			r.dns64.set(s, prefix)
+			metrics.DNSServerDNS64.WithLabelValues(s).Set(boolToFloat64(prefix != nil))
+			if prefix != nil {
+				r.appLogf(instrumentation.High, "dns64 detected server=%s prefix=%s/96", s, prefix)
+			}
+		}(server)
+	}
+	wg.Wait()
+}
+
+// isSynthesized reports whether ip carries an embedded IPv4 address under the
+// server's discovered prefix or the well-known prefix.
+func isSynthesized(ip, prefix net.IP) bool {
+	ip16 := ip.To16()
+	if ip16 == nil || ip.To4() != nil {
+		return false
+	}
+	for _, candidate := range []net.IP{prefix, wellKnownDNS64Prefix} {
+		if candidate == nil {
+			continue
+		}
+		if ip16[:12].Equal(candidate.To16()[:12]) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectAAAA queries hostname's AAAA records and splits them into native
+// addresses (compared across servers) and DNS64-synthesized ones (labeled
+// and excluded from the comparison).
+func (r *DNSResolver) collectAAAA(ctx context.Context, client dnsClient, server, hostname string, recursionDesired bool, result *dnsanalysis.DNSResponse) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(hostname), dns.TypeAAAA)
+	msg.RecursionDesired = recursionDesired
+
+	response, _, err := client.ExchangeContext(ctx, msg, server)
+	if err != nil {
+		r.appLogf(instrumentation.Medium, "AAAA query failed hostname=%s server=%s err=%v", hostname, server, err)
+		return
+	}
+
+	prefix := r.dns64.prefix(server)
+	for _, answer := range response.Answer {
+		aaaa, ok := answer.(*dns.AAAA)
+		if !ok {
+			continue
+		}
+		if isSynthesized(aaaa.AAAA, prefix) {
+			result.DNS64 = true
+			result.Synthesized = append(result.Synthesized, aaaa.AAAA.String())
+			continue
+		}
+		result.Addresses = append(result.Addresses, aaaa.AAAA.String())
+	}
+	if result.DNS64 {
+		metrics.DNSResolutionDNS64.WithLabelValues(server, r.metricHostname(hostname)).Inc()
+	}
+}
@@ -2,15 +2,30 @@ package dnsres
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"dnsres/circuitbreaker"
 	"dnsres/dnsanalysis"
+	"dnsres/health"
+	"dnsres/instrumentation"
+	"dnsres/internal/geoip"
+	"dnsres/internal/kafka"
 	"dnsres/metrics"
 
+	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 )
@@ -70,3 +85,1425 @@ func getHistogramCount(t *testing.T, name string) uint64 {
 	}
 	return 0
 }
+
+func TestResolveAllMarksReadyAfterSuccessfulCycle(t *testing.T) {
+	hostname := "ready.example.com"
+	server := "1.1.1.1:53"
+
+	failing := true
+	resolver := &DNSResolver{
+		config:     &Config{Hostnames: []string{hostname}, DNSServers: []string{server}},
+		breakers:   map[string]*circuitbreaker.CircuitBreaker{server: circuitbreaker.NewCircuitBreaker(100, time.Minute, server)},
+		successLog: log.New(io.Discard, "", 0),
+		errorLog:   log.New(io.Discard, "", 0),
+		stats:      &ResolutionStats{Stats: map[string]*ServerStats{server: {}}, StartTime: time.Now()},
+		health:     health.NewHealthChecker(nil, nil, instrumentation.None),
+		resolveWithServerFunc: func(_ context.Context, server, host string) (*dnsanalysis.DNSResponse, error) {
+			if failing {
+				return nil, errors.New("timeout")
+			}
+			return &dnsanalysis.DNSResponse{Server: server, Hostname: host, Addresses: []string{"10.0.0.1"}}, nil
+		},
+	}
+	readyz := func() int {
+		response := httptest.NewRecorder()
+		resolver.apiHandler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return response.Code
+	}
+
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected /readyz 503 before any cycle, got %d", code)
+	}
+	resolver.resolveAll(context.Background())
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected /readyz 503 after a failed cycle, got %d", code)
+	}
+	failing = false
+	resolver.resolveAll(context.Background())
+	if code := readyz(); code != http.StatusOK {
+		t.Fatalf("expected /readyz 200 after a successful cycle, got %d", code)
+	}
+}
+
+func TestResolveAllSequentialMode(t *testing.T) {
+	hostname := "sequential.example.com"
+	servers := []string{"1.1.1.1:53", "2.2.2.2:53", "3.3.3.3:53"}
+
+	breakers := make(map[string]*circuitbreaker.CircuitBreaker)
+	stats := make(map[string]*ServerStats)
+	for _, server := range servers {
+		breakers[server] = circuitbreaker.NewCircuitBreaker(2, time.Minute, server)
+		stats[server] = &ServerStats{}
+	}
+
+	config := &Config{Hostnames: []string{hostname}, DNSServers: servers}
+	config.Querying.Mode = QueryModeSequential
+	config.Querying.Stagger = Duration{10 * time.Millisecond}
+
+	var order []string
+	var times []time.Time
+	inFlight := 0
+	var successLog strings.Builder
+	resolver := &DNSResolver{
+		config:     config,
+		breakers:   breakers,
+		successLog: log.New(&successLog, "", 0),
+		errorLog:   log.New(io.Discard, "", 0),
+		stats:      &ResolutionStats{Stats: stats, StartTime: time.Now()},
+		resolveWithServerFunc: func(_ context.Context, server, host string) (*dnsanalysis.DNSResponse, error) {
+			inFlight++
+			defer func() { inFlight-- }()
+			if inFlight > 1 {
+				t.Errorf("expected one query in flight, got %d", inFlight)
+			}
+			order = append(order, server)
+			times = append(times, time.Now())
+			return &dnsanalysis.DNSResponse{Server: server, Hostname: host, Addresses: []string{"10.0.0.1"}}, nil
+		},
+	}
+
+	resolver.resolveAll(context.Background())
+
+	if strings.Join(order, ",") != strings.Join(servers, ",") {
+		t.Fatalf("expected servers queried in order %v, got %v", servers, order)
+	}
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < 10*time.Millisecond {
+			t.Fatalf("expected stagger between servers, got %s", gap)
+		}
+	}
+	if !strings.Contains(successLog.String(), "mode: sequential") {
+		t.Fatalf("expected mode in success log, got %q", successLog.String())
+	}
+}
+
+func TestResolveAllCancelsStragglersAtCycleTimeout(t *testing.T) {
+	hostname := "hung.example.com"
+	servers := []string{"1.1.1.1:53", "2.2.2.2:53"}
+	breakers := make(map[string]*circuitbreaker.CircuitBreaker)
+	stats := make(map[string]*ServerStats)
+	for _, server := range servers {
+		breakers[server] = circuitbreaker.NewCircuitBreaker(5, time.Minute, server)
+		stats[server] = &ServerStats{}
+	}
+	config := &Config{
+		Hostnames:     []string{hostname},
+		DNSServers:    servers,
+		QueryInterval: Duration{time.Minute},
+		CycleTimeout:  Duration{50 * time.Millisecond},
+	}
+	resolver := &DNSResolver{
+		config:     config,
+		breakers:   breakers,
+		successLog: log.New(io.Discard, "", 0),
+		errorLog:   log.New(io.Discard, "", 0),
+		stats:      &ResolutionStats{Stats: stats, StartTime: time.Now()},
+		events:     newEventBus(),
+		history:    newEventHistory(0),
+		resolveWithServerFunc: func(ctx context.Context, server, host string) (*dnsanalysis.DNSResponse, error) {
+			if server == servers[1] {
+				// A blackholed server: the query only ends when canceled.
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return &dnsanalysis.DNSResponse{Server: server, Hostname: host, Addresses: []string{"10.0.0.1"}}, nil
+		},
+	}
+
+	before := testutil.ToFloat64(metrics.DNSResCycleTimeouts)
+	started := time.Now()
+	resolver.resolveAll(context.Background())
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("expected the cycle to end at its deadline, took %s", elapsed)
+	}
+	if got := testutil.ToFloat64(metrics.DNSResCycleTimeouts) - before; got != 1 {
+		t.Fatalf("expected one cycle timeout, got %v", got)
+	}
+	if stats[servers[1]].Failures != 1 || !strings.Contains(stats[servers[1]].LastError, "cycle deadline") {
+		t.Fatalf("expected the hung query recorded as a timeout, got %+v", stats[servers[1]])
+	}
+	if stats[servers[0]].Failures != 0 {
+		t.Fatalf("expected the answering server unaffected, got %+v", stats[servers[0]])
+	}
+	timeouts := resolver.RecentEvents(0, EventCycleTimeout)
+	if len(timeouts) != 1 || !strings.Contains(timeouts[0].Detail, hostname+" via "+servers[1]) {
+		t.Fatalf("expected a cycle_timeout event naming the straggler, got %+v", timeouts)
+	}
+	failures := resolver.RecentEvents(0, EventResolveFailure)
+	if len(failures) != 1 || failures[0].Source != "cycle_timeout" {
+		t.Fatalf("expected a cycle_timeout resolve failure, got %+v", failures)
+	}
+
+	// Shutdown is not a timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	resolver.resolveAll(ctx)
+	if got := testutil.ToFloat64(metrics.DNSResCycleTimeouts) - before; got != 1 {
+		t.Fatalf("expected shutdown not to count as a cycle timeout, got %v", got)
+	}
+}
+
+func TestValidateQueryMode(t *testing.T) {
+	config := DefaultConfig()
+	config.Hostnames = []string{"example.com"}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected default query mode to validate, got %v", err)
+	}
+	config.Querying.Mode = "Sequential"
+	if got := config.QueryMode(); got != QueryModeSequential {
+		t.Fatalf("expected mode to normalize, got %q", got)
+	}
+	config.Querying.Mode = "random"
+	if err := config.Validate(); err == nil {
+		t.Fatal("expected unknown query mode to be rejected")
+	}
+	config.Querying.Mode = QueryModeSequential
+	config.Querying.Stagger = Duration{-time.Second}
+	if err := config.Validate(); err == nil {
+		t.Fatal("expected negative stagger to be rejected")
+	}
+}
+
+func TestResolveAllQueriesFallbacksOnlyWhenPrimaryFails(t *testing.T) {
+	hostname := "fallback.example.com"
+	primary := "1.1.1.1:53"
+	fallbacks := []string{"2.2.2.2:53", "3.3.3.3:53"}
+	servers := append([]string{primary}, fallbacks...)
+
+	tests := []struct {
+		name        string
+		primaryErr  error
+		wantQueried []string
+	}{
+		{name: "primary ok", wantQueried: []string{primary}},
+		{name: "primary fails", primaryErr: errors.New("timeout"), wantQueried: []string{primary, fallbacks[0]}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breakers := make(map[string]*circuitbreaker.CircuitBreaker)
+			stats := make(map[string]*ServerStats)
+			for _, server := range servers {
+				breakers[server] = circuitbreaker.NewCircuitBreaker(2, time.Minute, server)
+				stats[server] = &ServerStats{}
+			}
+			config := &Config{
+				Hostnames:  []string{hostname},
+				DNSServers: servers,
+				ServerSettings: map[string]ServerSettings{
+					fallbacks[0]: {Role: ServerRoleFallback},
+					fallbacks[1]: {Role: ServerRoleFallback},
+				},
+			}
+
+			var queried []string
+			resolver := &DNSResolver{
+				config:     config,
+				breakers:   breakers,
+				successLog: log.New(io.Discard, "", 0),
+				errorLog:   log.New(io.Discard, "", 0),
+				stats:      &ResolutionStats{Stats: stats, StartTime: time.Now()},
+				resolveWithServerFunc: func(_ context.Context, server, host string) (*dnsanalysis.DNSResponse, error) {
+					queried = append(queried, server)
+					if server == primary && tt.primaryErr != nil {
+						return nil, tt.primaryErr
+					}
+					return &dnsanalysis.DNSResponse{Server: server, Hostname: host, Addresses: []string{"10.0.0.1"}}, nil
+				},
+			}
+
+			before := testutil.ToFloat64(metrics.DNSServerRoleQueries.WithLabelValues(fallbacks[0], ServerRoleFallback, "success"))
+			resolver.resolveAll(context.Background())
+
+			if strings.Join(queried, ",") != strings.Join(tt.wantQueried, ",") {
+				t.Fatalf("expected queries %v, got %v", tt.wantQueried, queried)
+			}
+			after := testutil.ToFloat64(metrics.DNSServerRoleQueries.WithLabelValues(fallbacks[0], ServerRoleFallback, "success"))
+			if want := float64(len(tt.wantQueried) - 1); after-before != want {
+				t.Fatalf("expected fallback role metric to grow by %v, got %v", want, after-before)
+			}
+
+			queried = nil
+			response, err := resolver.Lookup(context.Background(), hostname)
+			if err != nil {
+				t.Fatalf("Lookup failed: %v", err)
+			}
+			if want := tt.wantQueried[len(tt.wantQueried)-1]; response.Server != want {
+				t.Fatalf("expected Lookup answer from %s, got %s", want, response.Server)
+			}
+		})
+	}
+}
+
+func TestSelectServers(t *testing.T) {
+	servers := []string{"1.1.1.1:53", "2.2.2.2:53", "3.3.3.3:53", "9.9.9.9:53"}
+	config := &Config{
+		DNSServers:     servers,
+		QueryTimeout:   Duration{Duration: time.Second},
+		ServerSettings: map[string]ServerSettings{servers[3]: {Role: ServerRoleFallback}},
+	}
+	resolver := &DNSResolver{config: config, scores: newScoreTracker()}
+	selected := func() string { return strings.Join(resolver.selectServers(), ",") }
+
+	if got := selected(); got != strings.Join(servers, ",") {
+		t.Fatalf("expected configured order by default, got %s", got)
+	}
+
+	config.Querying.Selection = SelectionRoundRobin
+	for _, want := range []string{
+		"1.1.1.1:53,2.2.2.2:53,3.3.3.3:53,9.9.9.9:53",
+		"2.2.2.2:53,3.3.3.3:53,1.1.1.1:53,9.9.9.9:53",
+		"3.3.3.3:53,1.1.1.1:53,2.2.2.2:53,9.9.9.9:53",
+		"1.1.1.1:53,2.2.2.2:53,3.3.3.3:53,9.9.9.9:53",
+	} {
+		if got := selected(); got != want {
+			t.Fatalf("expected round-robin order %s, got %s", want, got)
+		}
+	}
+
+	config.Querying.Selection = SelectionFastest
+	resolver.scoreLatency(servers[0], 80*time.Millisecond)
+	resolver.scoreLatency(servers[1], 20*time.Millisecond)
+	if got, want := selected(), "3.3.3.3:53,2.2.2.2:53,1.1.1.1:53,9.9.9.9:53"; got != want {
+		t.Fatalf("expected unmeasured then fastest servers first, got %s, want %s", got, want)
+	}
+
+	config.Querying.Selection = SelectionScoreWeighted
+	for i := 0; i < 10; i++ {
+		resolver.scoreOutcome(servers[1], errors.New("timeout"))
+	}
+	for i := 0; i < 20; i++ {
+		// The failing server scores lowest, so it is last among the
+		// primaries unless picked first.
+		order := resolver.selectServers()
+		if order[3] != servers[3] || order[0] != servers[1] && order[2] != servers[1] {
+			t.Fatalf("expected fallbacks last and the rest best first, got %v", order)
+		}
+	}
+	if first := weightedPick([]string{"a", "b", "c"}, map[string]float64{"b": 50}); first != 1 {
+		t.Fatalf("expected only the server with weight to be picked, got %d", first)
+	}
+
+	config.Querying.Selection = "random"
+	if err := validateSelection(config); err == nil {
+		t.Fatal("expected an unknown selection policy to be rejected")
+	}
+}
+
+func TestLookupHedgesSlowServers(t *testing.T) {
+	servers := []string{"1.1.1.1:53", "2.2.2.2:53", "3.3.3.3:53"}
+	stall := make(chan struct{})
+	defer close(stall)
+	failing := map[string]bool{}
+	resolver := &DNSResolver{
+		config: &Config{DNSServers: servers},
+		resolveWithServerFunc: func(ctx context.Context, server, host string) (*dnsanalysis.DNSResponse, error) {
+			if failing[server] {
+				return nil, errors.New("refused")
+			}
+			if server == servers[0] {
+				select {
+				case <-stall:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			return &dnsanalysis.DNSResponse{Server: server, Hostname: host}, nil
+		},
+	}
+	won := func() float64 {
+		return testutil.ToFloat64(metrics.DNSResolutionHedges.WithLabelValues(servers[1], "won"))
+	}
+
+	resolver.config.Querying.HedgeDelay = Duration{Duration: 10 * time.Millisecond}
+	before := won()
+	response, err := resolver.Lookup(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if response.Server != servers[1] {
+		t.Fatalf("expected the hedge to %s to answer, got %s", servers[1], response.Server)
+	}
+	if after := won(); after-before != 1 {
+		t.Fatalf("expected the hedge to be counted as won, got %v", after-before)
+	}
+
+	// Failures pass the query on at once rather than after the delay.
+	resolver.config.Querying.HedgeDelay = Duration{Duration: time.Hour}
+	failing[servers[0]], failing[servers[1]] = true, true
+	if response, err := resolver.Lookup(context.Background(), "example.com"); err != nil || response.Server != servers[2] {
+		t.Fatalf("expected failover to %s, got %+v, %v", servers[2], response, err)
+	}
+	failing[servers[2]] = true
+	if _, err := resolver.Lookup(context.Background(), "example.com"); err == nil || !strings.Contains(err.Error(), "all DNS servers failed") {
+		t.Fatalf("expected every server to fail, got %v", err)
+	}
+}
+
+func TestAcquireSlotQueuesOverCap(t *testing.T) {
+	server := "1.1.1.1:53"
+	resolver := &DNSResolver{
+		config: &Config{
+			DNSServers:     []string{server},
+			ServerSettings: map[string]ServerSettings{server: {MaxInFlight: 1}},
+		},
+		inflight: newInflightLimiter(),
+	}
+	release, err := resolver.acquireSlot(context.Background(), server)
+	if err != nil {
+		t.Fatalf("acquireSlot failed: %v", err)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		next, err := resolver.acquireSlot(context.Background(), server)
+		if err != nil {
+			t.Errorf("queued acquireSlot failed: %v", err)
+			close(acquired)
+			return
+		}
+		acquired <- next
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected the second query to wait for a slot")
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	release() // releasing twice must not free a second slot
+	select {
+	case next := <-acquired:
+		if next == nil {
+			t.FailNow()
+		}
+		defer next()
+	case <-time.After(time.Second):
+		t.Fatal("expected the queued query to get the released slot")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := resolver.acquireSlot(ctx, server); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected waiting to end with the context, got %v", err)
+	}
+	if _, err := resolver.acquireSlot(ctx, "2.2.2.2:53"); err != nil {
+		t.Fatalf("expected servers without a cap to need no slot, got %v", err)
+	}
+}
+
+func TestValidateServerRoles(t *testing.T) {
+	config := DefaultConfig()
+	config.Hostnames = []string{"example.com"}
+	config.DNSServers = []string{"1.1.1.1:53"}
+	config.ServerSettings = map[string]ServerSettings{"1.1.1.1:53": {Role: ServerRoleFallback}}
+	if err := config.Validate(); err == nil {
+		t.Fatal("expected config without primaries to be rejected")
+	}
+	config.ServerSettings["1.1.1.1:53"] = ServerSettings{Role: "backup"}
+	if err := config.Validate(); err == nil {
+		t.Fatal("expected unknown role to be rejected")
+	}
+}
+
+type hostnameAnalyzer struct{}
+
+func (hostnameAnalyzer) Name() string { return "test_hostname" }
+
+func (hostnameAnalyzer) AnalyzeResponse(response *dnsanalysis.DNSResponse) []dnsanalysis.Finding {
+	return []dnsanalysis.Finding{{
+		Analyzer: "test_hostname",
+		Hostname: response.Hostname,
+		Server:   response.Server,
+		Severity: dnsanalysis.SeverityInfo,
+		Message:  "seen",
+	}}
+}
+
+func (hostnameAnalyzer) AnalyzeSet(dnsanalysis.ResponseSet) []dnsanalysis.Finding { return nil }
+
+func TestResolveHostnameRunsEnabledAnalyzers(t *testing.T) {
+	dnsanalysis.RegisterAnalyzer(hostnameAnalyzer{})
+	hostname := "analyzers.example.com"
+	servers := []string{"1.1.1.1:53", "2.2.2.2:53"}
+
+	breakers := make(map[string]*circuitbreaker.CircuitBreaker)
+	stats := make(map[string]*ServerStats)
+	for _, server := range servers {
+		breakers[server] = circuitbreaker.NewCircuitBreaker(2, time.Minute, server)
+		stats[server] = &ServerStats{}
+	}
+	config := &Config{Hostnames: []string{hostname}, DNSServers: servers}
+	config.Analyzers.Disabled = []string{dnsanalysis.AnalyzerConsistency}
+
+	resolver := &DNSResolver{
+		config:     config,
+		breakers:   breakers,
+		successLog: log.New(io.Discard, "", 0),
+		errorLog:   log.New(io.Discard, "", 0),
+		stats:      &ResolutionStats{Stats: stats, StartTime: time.Now()},
+		history:    newEventHistory(10),
+		resolveWithServerFunc: func(_ context.Context, server, host string) (*dnsanalysis.DNSResponse, error) {
+			return &dnsanalysis.DNSResponse{Server: server, Hostname: host, Addresses: []string{"10.0.0." + server[:1]}}, nil
+		},
+	}
+
+	before := testutil.ToFloat64(metrics.DNSResAnalyzerFindings.WithLabelValues("test_hostname", dnsanalysis.SeverityInfo))
+	resolver.resolveHostname(context.Background(), hostname)
+
+	if got := resolver.RecentEvents(0, EventInconsistent); len(got) != 0 {
+		t.Fatalf("expected disabled consistency analyzer to stay quiet, got %d events", len(got))
+	}
+	findings := resolver.RecentEvents(0, EventAnalyzerFinding)
+	if len(findings) != len(servers) {
+		t.Fatalf("expected one finding per response, got %d", len(findings))
+	}
+	if findings[0].Source != "test_hostname" || findings[0].Severity != dnsanalysis.SeverityInfo || findings[0].Detail != "seen" {
+		t.Fatalf("unexpected finding event %+v", findings[0])
+	}
+	after := testutil.ToFloat64(metrics.DNSResAnalyzerFindings.WithLabelValues("test_hostname", dnsanalysis.SeverityInfo))
+	if after != before+float64(len(servers)) {
+		t.Fatalf("expected findings metric to grow by %d, got %v -> %v", len(servers), before, after)
+	}
+}
+
+func TestValidateAnalyzers(t *testing.T) {
+	config := &Config{}
+	config.Analyzers.Disabled = []string{dnsanalysis.AnalyzerTTLDrift}
+	if err := validateAnalyzers(config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	config.Analyzers.Disabled = []string{"ttl-drift"}
+	if err := validateAnalyzers(config); err == nil || !strings.Contains(err.Error(), "unknown analyzer") {
+		t.Fatalf("expected unknown analyzer error, got %v", err)
+	}
+}
+
+func TestResolveHostnameComparesWithReference(t *testing.T) {
+	hostname := "reference.example.com"
+	servers := []string{"1.1.1.1:53", "2.2.2.2:53", "3.3.3.3:53"}
+
+	breakers := make(map[string]*circuitbreaker.CircuitBreaker)
+	stats := make(map[string]*ServerStats)
+	for _, server := range servers {
+		breakers[server] = circuitbreaker.NewCircuitBreaker(2, time.Minute, server)
+		stats[server] = &ServerStats{}
+	}
+	config := &Config{Hostnames: []string{hostname}, DNSServers: servers, ReferenceServer: "1.1.1.1:53"}
+
+	answers := map[string][]string{
+		"1.1.1.1:53": {"10.0.0.1", "10.0.0.2"},
+		"2.2.2.2:53": {"10.0.0.2", "10.0.0.1"},
+		"3.3.3.3:53": {"10.0.0.1", "10.0.0.9"},
+	}
+	latencies := map[string]time.Duration{
+		"1.1.1.1:53": 20 * time.Millisecond,
+		"2.2.2.2:53": 10 * time.Millisecond,
+		"3.3.3.3:53": 50 * time.Millisecond,
+	}
+	resolver := &DNSResolver{
+		config:     config,
+		breakers:   breakers,
+		successLog: log.New(io.Discard, "", 0),
+		errorLog:   log.New(io.Discard, "", 0),
+		stats:      &ResolutionStats{Stats: stats, StartTime: time.Now()},
+		history:    newEventHistory(10),
+		references: newReferenceTracker(),
+		resolveWithServerFunc: func(_ context.Context, server, host string) (*dnsanalysis.DNSResponse, error) {
+			return &dnsanalysis.DNSResponse{Server: server, Hostname: host, Addresses: answers[server], Duration: latencies[server]}, nil
+		},
+	}
+	resolver.resolveHostname(context.Background(), hostname)
+
+	var findings []ResolverEvent
+	for _, event := range resolver.RecentEvents(0, EventAnalyzerFinding) {
+		if event.Source == dnsanalysis.AnalyzerReference {
+			findings = append(findings, event)
+		}
+	}
+	if len(findings) != 1 || findings[0].Server != "3.3.3.3:53" || !strings.Contains(findings[0].Detail, "missing 10.0.0.2, extra 10.0.0.9") {
+		t.Fatalf("expected one reference finding for 3.3.3.3:53, got %+v", findings)
+	}
+
+	if got := testutil.ToFloat64(metrics.DNSReferenceDivergence.WithLabelValues("3.3.3.3:53", hostname)); got != 1 {
+		t.Fatalf("expected 3.3.3.3:53 to diverge, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.DNSReferenceDivergence.WithLabelValues("2.2.2.2:53", hostname)); got != 0 {
+		t.Fatalf("expected 2.2.2.2:53 to agree, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.DNSReferenceLatencyDelta.WithLabelValues("2.2.2.2:53", hostname)); got != -0.01 {
+		t.Fatalf("expected 2.2.2.2:53 to be 10ms faster, got %v", got)
+	}
+
+	reference := resolver.StatsSnapshot().Reference
+	if reference == nil || reference.Server != "1.1.1.1:53" {
+		t.Fatalf("expected reference stats for 1.1.1.1:53, got %+v", reference)
+	}
+	diverged := reference.Servers["3.3.3.3:53"]
+	if diverged.Compared != 1 || diverged.Divergent != 1 || diverged.AvgLatencyDeltaMs != 30 {
+		t.Fatalf("unexpected comparison for 3.3.3.3:53: %+v", diverged)
+	}
+	if last := diverged.LastDivergence; last == nil || last.Hostname != hostname || strings.Join(last.Missing, ",") != "10.0.0.2" || strings.Join(last.Extra, ",") != "10.0.0.9" {
+		t.Fatalf("unexpected last divergence %+v", diverged.LastDivergence)
+	}
+	if _, ok := reference.Servers["1.1.1.1:53"]; ok {
+		t.Fatal("expected the reference not to be compared with itself")
+	}
+}
+
+func TestValidateReferenceServer(t *testing.T) {
+	config := DefaultConfig()
+	config.Hostnames = []string{"example.com"}
+	config.ReferenceServer = "192.0.2.53"
+	normalizeConfig(config)
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "reference_server") {
+		t.Fatalf("expected unknown reference server to be rejected, got %v", err)
+	}
+	config.ReferenceServer = strings.TrimSuffix(config.DNSServers[0], ":53")
+	normalizeConfig(config)
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected configured server to be accepted, got %v", err)
+	}
+}
+
+func TestResolveHostnameDetectsFlapping(t *testing.T) {
+	hostname := "flapping.example.com"
+	servers := []string{"1.1.1.1:53", "2.2.2.2:53"}
+
+	breakers := make(map[string]*circuitbreaker.CircuitBreaker)
+	stats := make(map[string]*ServerStats)
+	for _, server := range servers {
+		breakers[server] = circuitbreaker.NewCircuitBreaker(2, time.Minute, server)
+		stats[server] = &ServerStats{}
+	}
+	config := &Config{Hostnames: []string{hostname}, DNSServers: servers}
+	config.Flapping.Window = 4
+
+	cycle := 0
+	resolver := &DNSResolver{
+		config:     config,
+		breakers:   breakers,
+		successLog: log.New(io.Discard, "", 0),
+		errorLog:   log.New(io.Discard, "", 0),
+		stats:      &ResolutionStats{Stats: stats, StartTime: time.Now()},
+		history:    newEventHistory(50),
+		flaps:      newFlapTracker(),
+		resolveWithServerFunc: func(_ context.Context, server, host string) (*dnsanalysis.DNSResponse, error) {
+			addresses := []string{"10.0.0.1"}
+			if server == "2.2.2.2:53" && cycle < 4 && cycle%2 == 1 {
+				addresses = []string{"10.0.0.2"}
+			}
+			return &dnsanalysis.DNSResponse{Server: server, Hostname: host, Addresses: addresses}, nil
+		},
+	}
+
+	// 2.2.2.2:53 alternates for four cycles, then settles.
+	for ; cycle < 8; cycle++ {
+		resolver.resolveHostname(context.Background(), hostname)
+		if cycle == 3 {
+			status, ok := resolver.FlapSnapshot()[hostname]
+			if !ok || strings.Join(status.Servers, ",") != "2.2.2.2:53" {
+				t.Fatalf("expected 2.2.2.2:53 flapping after four alternating cycles, got %+v", resolver.FlapSnapshot())
+			}
+			if got := testutil.ToFloat64(metrics.DNSResolutionFlapping.WithLabelValues(hostname)); got != 1 {
+				t.Fatalf("expected flapping metric 1, got %v", got)
+			}
+		}
+	}
+
+	starts := resolver.RecentEvents(0, EventFlapStart)
+	if len(starts) != 1 || starts[0].Server != "2.2.2.2:53" || !strings.Contains(starts[0].Detail, "alternated between 2 answers (3 changes in the last 4)") {
+		t.Fatalf("expected one flap_start for 2.2.2.2:53, got %+v", starts)
+	}
+	if ends := resolver.RecentEvents(0, EventFlapEnd); len(ends) != 1 {
+		t.Fatalf("expected flapping to end once answers settled, got %+v", ends)
+	}
+	if len(resolver.FlapSnapshot()) != 0 {
+		t.Fatalf("expected no flapping hostnames, got %+v", resolver.FlapSnapshot())
+	}
+}
+
+func TestFlappingIgnoresMigrations(t *testing.T) {
+	if changes, distinct := flapping([]string{"a", "b", "c", "d"}); changes != 3 || distinct != 0 {
+		t.Fatalf("expected a run of new answers not to flap, got %d changes, %d distinct", changes, distinct)
+	}
+	if changes, distinct := flapping([]string{"a", "b", "a", "c"}); changes != 3 || distinct != 3 {
+		t.Fatalf("expected a return to an earlier answer to flap, got %d changes, %d distinct", changes, distinct)
+	}
+}
+
+func TestHostnameRollup(t *testing.T) {
+	a, b := "192.0.2.1:53", "192.0.2.2:53"
+	resolver := &DNSResolver{config: &Config{}, hostnames: newHostnameTracker()}
+	answer := func(server string, addresses ...string) *dnsanalysis.DNSResponse {
+		return &dnsanalysis.DNSResponse{Server: server, Addresses: addresses, Duration: 12 * time.Millisecond}
+	}
+
+	resolver.rollupHostname("example.com", []*dnsanalysis.DNSResponse{answer(a, "192.0.2.7"), answer(b, "192.0.2.7")}, nil, true)
+	rollup, ok := resolver.HostnameRollup("example.com")
+	if !ok || rollup.Verdict != VerdictConsistent || rollup.LastChange != nil || rollup.Servers[0].LatencyMs != 12 {
+		t.Fatalf("expected a consistent rollup without changes, got %+v", rollup)
+	}
+
+	resolver.rollupHostname("example.com", []*dnsanalysis.DNSResponse{answer(a, "192.0.2.8")}, map[string]string{b: "timeout"}, true)
+	rollup, _ = resolver.HostnameRollup("example.com")
+	if rollup.Verdict != VerdictDegraded || rollup.LastChange == nil || rollup.Servers[0].ChangedAt == nil {
+		t.Fatalf("expected a degraded rollup with a's answer change, got %+v", rollup)
+	}
+	if rollup.Servers[1].Error != "timeout" || len(rollup.RecentFailures) != 1 || rollup.RecentFailures[0].Server != b {
+		t.Fatalf("expected b's failure to be recorded, got %+v", rollup)
+	}
+
+	for range hostnameFailureLimit {
+		resolver.rollupHostname("example.com", nil, map[string]string{a: "timeout", b: "timeout"}, true)
+	}
+	rec := httptest.NewRecorder()
+	resolver.apiHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/hostz/EXAMPLE.com.", nil))
+	if err := json.Unmarshal(rec.Body.Bytes(), &rollup); err != nil || rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while every server fails, got %d: %v", rec.Code, err)
+	}
+	if rollup.Verdict != VerdictFailing || len(rollup.RecentFailures) != hostnameFailureLimit || rollup.LastChange == nil {
+		t.Fatalf("expected a failing rollup keeping the last change, got %+v", rollup)
+	}
+
+	rec = httptest.NewRecorder()
+	resolver.apiHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/hostz/unknown.example", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unresolved hostname, got %d", rec.Code)
+	}
+
+	// A Unicode hostname finds the rollup of its ASCII form, and back.
+	resolver.rollupHostname("xn--bcher-kva.de", []*dnsanalysis.DNSResponse{answer(a, "192.0.2.9")}, nil, true)
+	rec = httptest.NewRecorder()
+	resolver.apiHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/hostz/b%C3%BCcher.de", nil))
+	if err := json.Unmarshal(rec.Body.Bytes(), &rollup); err != nil || rec.Code != http.StatusOK || rollup.Hostname != "xn--bcher-kva.de" {
+		t.Fatalf("expected /hostz/bücher.de to serve xn--bcher-kva.de, got %d: %+v", rec.Code, rollup)
+	}
+	resolver.rollupHostname("Bücher.de", []*dnsanalysis.DNSResponse{answer(a, "192.0.2.9")}, nil, true)
+	if rollup, ok := resolver.HostnameRollup("xn--bcher-kva.de"); !ok || len(rollup.Servers) != 1 {
+		t.Fatalf("expected one rollup for both spellings, got %+v", rollup)
+	}
+}
+
+func TestLatencyTrackerFlagsAnomalies(t *testing.T) {
+	tracker := newLatencyTracker()
+	var config LatencyAnomalyConfig
+	now := time.Now()
+	observe := func(latency time.Duration) (*LatencyAnomaly, bool) {
+		_, anomaly, changed := tracker.observe(config, "1.1.1.1:53", "example.com", latency, now)
+		return anomaly, changed
+	}
+
+	// Slow queries while the baseline is learning are not flagged.
+	for i := 0; i < defaultAnomalyMinSamples; i++ {
+		latency := 30 * time.Millisecond
+		if i == 0 {
+			latency = 300 * time.Millisecond
+		}
+		if anomaly, _ := observe(latency); anomaly != nil {
+			t.Fatalf("expected no anomaly while learning, got %+v", anomaly)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		observe(30 * time.Millisecond)
+	}
+
+	for i := 1; i < defaultAnomalyConsecutive; i++ {
+		if anomaly, changed := observe(200 * time.Millisecond); anomaly != nil || changed {
+			t.Fatalf("expected %d slow queries not to start an anomaly", i)
+		}
+	}
+	anomaly, changed := observe(200 * time.Millisecond)
+	if anomaly == nil || !changed {
+		t.Fatal("expected consecutive slow queries to start an anomaly")
+	}
+	if anomaly.LatencyMs != 200 || anomaly.BaselineMs < 29 || anomaly.BaselineMs > 40 {
+		t.Fatalf("expected a 200ms query against a ~30ms baseline, got %+v", anomaly)
+	}
+
+	// A lasting slowdown does not become the baseline.
+	for i := 0; i < 20; i++ {
+		if anomaly, _ := observe(200 * time.Millisecond); anomaly == nil {
+			t.Fatal("expected a lasting slowdown to stay anomalous")
+		}
+	}
+	if snapshot := tracker.snapshot(); len(snapshot) != 1 || snapshot[0].Hostname != "example.com" {
+		t.Fatalf("expected the anomaly in the snapshot, got %+v", snapshot)
+	}
+
+	for i := 1; i < defaultAnomalyConsecutive; i++ {
+		if anomaly, changed := observe(30 * time.Millisecond); anomaly == nil || changed {
+			t.Fatalf("expected %d normal queries not to end the anomaly", i)
+		}
+	}
+	if anomaly, changed := observe(30 * time.Millisecond); anomaly != nil || !changed {
+		t.Fatal("expected consecutive normal queries to end the anomaly")
+	}
+	if snapshot := tracker.snapshot(); len(snapshot) != 0 {
+		t.Fatalf("expected no anomalies after recovery, got %+v", snapshot)
+	}
+
+	// Fast servers are not flagged for jitter below min_latency.
+	for i := 0; i < 30; i++ {
+		if _, anomaly, _ := tracker.observe(config, "1.1.1.1:53", "fast.example.com", time.Millisecond, now); anomaly != nil {
+			t.Fatal("expected no anomaly while learning")
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if _, anomaly, _ := tracker.observe(config, "1.1.1.1:53", "fast.example.com", 10*time.Millisecond, now); anomaly != nil {
+			t.Fatal("expected jitter below min_latency not to be flagged")
+		}
+	}
+}
+
+func TestScoreSnapshotRanksServers(t *testing.T) {
+	servers := []string{"1.1.1.1:53", "2.2.2.2:53", "3.3.3.3:53", "4.4.4.4:53"}
+	config := &Config{DNSServers: servers, QueryTimeout: Duration{Duration: time.Second}}
+	resolver := &DNSResolver{config: config, scores: newScoreTracker()}
+	answer := func(server string, addresses ...string) *dnsanalysis.DNSResponse {
+		return &dnsanalysis.DNSResponse{Server: server, Addresses: addresses}
+	}
+
+	for i := 0; i < 30; i++ {
+		for _, server := range servers[:3] {
+			var err error
+			if server == servers[1] && i < 20 {
+				err = errors.New("timeout")
+			}
+			resolver.scoreOutcome(server, err)
+			resolver.scoreLatency(server, 100*time.Millisecond)
+		}
+		resolver.scoreAgreement("example.com", []*dnsanalysis.DNSResponse{
+			answer(servers[0], "192.0.2.1"),
+			answer(servers[1], "192.0.2.1"),
+			answer(servers[2], "192.0.2.9"),
+		})
+	}
+	resolver.scoreLatency(servers[0], 600*time.Millisecond)
+	resolver.scores.recordBreakerOpen(servers[2], time.Now().Add(-2*time.Hour))
+
+	scores := resolver.ScoreSnapshot()
+	if len(scores) != 3 {
+		t.Fatalf("expected a score for each queried server, got %+v", scores)
+	}
+	if scores[0].Server != servers[0] || scores[0].Rank != 1 || scores[1].Server != servers[2] || scores[2].Server != servers[1] {
+		t.Fatalf("expected servers ranked by score, got %+v", scores)
+	}
+	// 40 + 30*(1-0.1) + 20 + 10: the one slow answer of 31 is above the
+	// 95th percentile.
+	if first := scores[0]; first.Score != 97 || first.LatencyP95Ms != 100 || first.Availability != 1 || first.Agreement != 1 {
+		t.Fatalf("unexpected score for %s: %+v", first.Server, first)
+	}
+	// An old breaker opening no longer counts.
+	if disagreeing := scores[1]; disagreeing.Agreement != 0 || disagreeing.BreakerOpens != 0 || disagreeing.Score != 77 {
+		t.Fatalf("unexpected score for %s: %+v", disagreeing.Server, disagreeing)
+	}
+	if failing := scores[2]; failing.Availability != 1.0/3 || failing.Score != 70.3 {
+		t.Fatalf("unexpected score for %s: %+v", failing.Server, failing)
+	}
+
+	resolver.scores.recordBreakerOpen(servers[0], time.Now())
+	if score := resolver.ScoreSnapshot()[0]; score.BreakerOpens != 1 || score.Score != 92 {
+		t.Fatalf("expected a recent breaker opening to halve the breaker part, got %+v", score)
+	}
+}
+
+func TestResolveHostnameRunsChecks(t *testing.T) {
+	hostname := "checks.example.com"
+	servers := []string{"1.1.1.1:53", "2.2.2.2:53"}
+
+	breakers := make(map[string]*circuitbreaker.CircuitBreaker)
+	stats := make(map[string]*ServerStats)
+	for _, server := range servers {
+		breakers[server] = circuitbreaker.NewCircuitBreaker(2, time.Minute, server)
+		stats[server] = &ServerStats{}
+	}
+	internalOnly := `all(addr, addr.startsWith("10."))`
+	config := &Config{
+		Hostnames:  []string{hostname},
+		DNSServers: servers,
+		Checks: map[string][]string{
+			"*":      {"ttl > 30"},
+			hostname: {internalOnly},
+		},
+	}
+	config.Analyzers.Disabled = []string{dnsanalysis.AnalyzerConsistency}
+
+	resolver := &DNSResolver{
+		config:     config,
+		breakers:   breakers,
+		successLog: log.New(io.Discard, "", 0),
+		errorLog:   log.New(io.Discard, "", 0),
+		stats:      &ResolutionStats{Stats: stats, StartTime: time.Now()},
+		history:    newEventHistory(10),
+		resolveWithServerFunc: func(_ context.Context, server, host string) (*dnsanalysis.DNSResponse, error) {
+			address := "10.0.0.1"
+			if server == servers[1] {
+				address = "192.0.2.1"
+			}
+			return &dnsanalysis.DNSResponse{Server: server, Hostname: host, Addresses: []string{address}, TTL: 300}, nil
+		},
+	}
+
+	resolver.resolveHostname(context.Background(), hostname)
+
+	var failed []ResolverEvent
+	for _, event := range resolver.RecentEvents(0, EventAnalyzerFinding) {
+		if event.Source == checkAnalyzer {
+			failed = append(failed, event)
+		}
+	}
+	if len(failed) != 1 || failed[0].Server != servers[1] || !strings.Contains(failed[0].Detail, internalOnly) {
+		t.Fatalf("expected one failed check for %s, got %+v", servers[1], failed)
+	}
+	if got := testutil.ToFloat64(metrics.DNSResCheckPassing.WithLabelValues(hostname, "ttl > 30")); got != 1 {
+		t.Fatalf("expected wildcard check passing, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.DNSResCheckPassing.WithLabelValues(hostname, internalOnly)); got != 0 {
+		t.Fatalf("expected hostname check failing, got %v", got)
+	}
+}
+
+func TestValidateChecks(t *testing.T) {
+	config := &Config{Checks: map[string][]string{"*": {"answers.size() >= 1 && ttl > 30"}}}
+	if err := validateChecks(config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	config.Checks["www.example.com"] = []string{"answer.size() > 0"}
+	if err := validateChecks(config); err == nil || !strings.Contains(err.Error(), `unknown variable "answer"`) {
+		t.Fatalf("expected unknown variable error, got %v", err)
+	}
+}
+
+type staticGeo map[string]geoip.Info
+
+func (g staticGeo) Lookup(address string) geoip.Info {
+	return g[address]
+}
+
+func TestResolveHostnameFlagsUnexpectedGeo(t *testing.T) {
+	hostname := "geo.example.com"
+	servers := []string{"1.1.1.1:53", "2.2.2.2:53"}
+
+	breakers := make(map[string]*circuitbreaker.CircuitBreaker)
+	stats := make(map[string]*ServerStats)
+	for _, server := range servers {
+		breakers[server] = circuitbreaker.NewCircuitBreaker(2, time.Minute, server)
+		stats[server] = &ServerStats{}
+	}
+	config := &Config{Hostnames: []string{hostname}, DNSServers: servers}
+	config.Analyzers.Disabled = []string{dnsanalysis.AnalyzerConsistency}
+	config.GeoIP.Expected = map[string]GeoExpectation{"*": {Countries: []string{"US"}, ASNs: []uint32{64500}}}
+
+	var successLog strings.Builder
+	resolver := &DNSResolver{
+		config:     config,
+		breakers:   breakers,
+		successLog: log.New(&successLog, "", 0),
+		errorLog:   log.New(io.Discard, "", 0),
+		stats:      &ResolutionStats{Stats: stats, StartTime: time.Now()},
+		history:    newEventHistory(10),
+		geo: staticGeo{
+			"10.0.0.1":  {Country: "US", ASN: 64500},
+			"192.0.2.1": {Country: "RU", ASN: 64511, Organization: "Elsewhere"},
+		},
+		resolveWithServerFunc: func(_ context.Context, server, host string) (*dnsanalysis.DNSResponse, error) {
+			address := "10.0.0.1"
+			if server == servers[1] {
+				address = "192.0.2.1"
+			}
+			return &dnsanalysis.DNSResponse{Server: server, Hostname: host, Addresses: []string{address}}, nil
+		},
+	}
+
+	resolver.resolveHostname(context.Background(), hostname)
+
+	var findings []ResolverEvent
+	for _, event := range resolver.RecentEvents(0, EventAnalyzerFinding) {
+		if event.Source == geoAnalyzer {
+			findings = append(findings, event)
+		}
+	}
+	if len(findings) != 1 || findings[0].Server != servers[1] {
+		t.Fatalf("expected one geoip finding for %s, got %+v", servers[1], findings)
+	}
+	if !strings.Contains(findings[0].Detail, "country RU not in US") || !strings.Contains(findings[0].Detail, "AS64511") {
+		t.Fatalf("unexpected finding detail %q", findings[0].Detail)
+	}
+	if !strings.Contains(successLog.String(), "geo: 10.0.0.1=US AS64500") {
+		t.Fatalf("expected geo data in success log, got %q", successLog.String())
+	}
+}
+
+func TestValidateGeoIP(t *testing.T) {
+	config := &Config{}
+	config.GeoIP.Expected = map[string]GeoExpectation{"*": {Countries: []string{"US"}}}
+	if err := validateGeoIP(config); err == nil || !strings.Contains(err.Error(), "country_db") {
+		t.Fatalf("expected missing database error, got %v", err)
+	}
+	config.GeoIP.CountryDB = "/var/lib/GeoLite2-Country.mmdb"
+	if err := validateGeoIP(config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	config.GeoIP.Expected["*"] = GeoExpectation{Countries: []string{"us"}}
+	if err := validateGeoIP(config); err == nil || !strings.Contains(err.Error(), "two-letter") {
+		t.Fatalf("expected country code error, got %v", err)
+	}
+}
+
+func TestParseScreeningList(t *testing.T) {
+	list, err := parseScreeningList("ads", false, strings.NewReader(`# comment
+203.0.113.7
+198.51.100.0/24
+2001:db8::/32
+0.0.0.0 tracker.example.net # hosts-file style
+bad.example.com.
+`))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	for _, ip := range []string{"203.0.113.7", "198.51.100.42", "2001:db8::1"} {
+		if !list.matchIP(net.ParseIP(ip)) {
+			t.Errorf("expected %s to match", ip)
+		}
+	}
+	if list.matchIP(net.ParseIP("0.0.0.0")) || list.matchIP(net.ParseIP("203.0.113.8")) {
+		t.Error("unexpected address match")
+	}
+	if !list.matchDomain("cdn.bad.example.com") || !list.matchDomain("tracker.example.net.") {
+		t.Error("expected listed domains and their subdomains to match")
+	}
+	if list.matchDomain("example.com") {
+		t.Error("parent of a listed domain should not match")
+	}
+}
+
+func TestResolveHostnameScreensAnswers(t *testing.T) {
+	hostname := "screen.example.com"
+	servers := []string{"1.1.1.1:53", "2.2.2.2:53"}
+	dir := t.TempDir()
+	blockPath := filepath.Join(dir, "block.txt")
+	allowPath := filepath.Join(dir, "allow.txt")
+	if err := os.WriteFile(blockPath, []byte("192.0.2.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(allowPath, []byte("192.0.2.10\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	breakers := make(map[string]*circuitbreaker.CircuitBreaker)
+	stats := make(map[string]*ServerStats)
+	for _, server := range servers {
+		breakers[server] = circuitbreaker.NewCircuitBreaker(2, time.Minute, server)
+		stats[server] = &ServerStats{}
+	}
+	config := &Config{Hostnames: []string{hostname}, DNSServers: servers}
+	config.Analyzers.Disabled = []string{dnsanalysis.AnalyzerConsistency}
+	config.Screening.Lists = []ScreeningSource{
+		{Name: "malware", Kind: ScreeningBlock, Source: blockPath},
+		{Name: "known-good", Kind: ScreeningAllow, Source: allowPath},
+	}
+
+	resolver := &DNSResolver{
+		config:     config,
+		breakers:   breakers,
+		successLog: log.New(io.Discard, "", 0),
+		errorLog:   log.New(io.Discard, "", 0),
+		stats:      &ResolutionStats{Stats: stats, StartTime: time.Now()},
+		history:    newEventHistory(10),
+		screening:  newScreeningState(config),
+		resolveWithServerFunc: func(_ context.Context, server, host string) (*dnsanalysis.DNSResponse, error) {
+			addresses := []string{"10.0.0.1", "192.0.2.10"}
+			if server == servers[1] {
+				addresses = []string{"192.0.2.66"}
+			}
+			return &dnsanalysis.DNSResponse{Server: server, Hostname: host, Addresses: addresses}, nil
+		},
+	}
+	resolver.refreshScreening(context.Background())
+	resolver.resolveHostname(context.Background(), hostname)
+
+	events := resolver.RecentEvents(0, EventBlockedAnswer)
+	if len(events) != 1 {
+		t.Fatalf("expected one blocked answer event, got %+v", events)
+	}
+	if events[0].Server != servers[1] || events[0].Source != "malware" || !strings.Contains(events[0].Detail, "192.0.2.66") {
+		t.Fatalf("unexpected blocked answer event %+v", events[0])
+	}
+}
+
+func TestValidateScreening(t *testing.T) {
+	config := &Config{}
+	config.Screening.Lists = []ScreeningSource{{Name: "ads", Source: "/etc/dnsres/ads.txt"}}
+	if err := validateScreening(config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	config.Screening.Lists = append(config.Screening.Lists, ScreeningSource{Name: "ads", Source: "https://example.com/ads.txt"})
+	if err := validateScreening(config); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Fatalf("expected duplicate name error, got %v", err)
+	}
+	config.Screening.Lists = []ScreeningSource{{Name: "ads", Kind: "deny", Source: "/etc/dnsres/ads.txt"}}
+	if err := validateScreening(config); err == nil || !strings.Contains(err.Error(), "unknown kind") {
+		t.Fatalf("expected unknown kind error, got %v", err)
+	}
+}
+
+func TestResolveHostnameBurstsOnFailure(t *testing.T) {
+	hostname := "burst.example.com"
+	servers := []string{"1.1.1.1:53", "2.2.2.2:53"}
+
+	breakers := make(map[string]*circuitbreaker.CircuitBreaker)
+	stats := make(map[string]*ServerStats)
+	for _, server := range servers {
+		breakers[server] = circuitbreaker.NewCircuitBreaker(100, time.Minute, server)
+		stats[server] = &ServerStats{}
+	}
+	config := &Config{Hostnames: []string{hostname}, DNSServers: servers}
+	config.Burst.Enabled = true
+	config.Burst.Duration = Duration{Duration: time.Minute}
+
+	failing := true
+	resolver := &DNSResolver{
+		config:     config,
+		breakers:   breakers,
+		successLog: log.New(io.Discard, "", 0),
+		errorLog:   log.New(io.Discard, "", 0),
+		stats:      &ResolutionStats{Stats: stats, StartTime: time.Now()},
+		history:    newEventHistory(10),
+		bursts:     newBurstState(config),
+		resolveWithServerFunc: func(_ context.Context, server, host string) (*dnsanalysis.DNSResponse, error) {
+			if failing && server == servers[1] {
+				return nil, errors.New("timeout")
+			}
+			return &dnsanalysis.DNSResponse{Server: server, Hostname: host, Addresses: []string{"10.0.0.1"}}, nil
+		},
+	}
+
+	resolver.resolveHostname(context.Background(), hostname)
+	resolver.resolveHostname(context.Background(), hostname)
+	starts := resolver.RecentEvents(0, EventBurstStart)
+	if len(starts) != 1 || starts[0].Hostname != hostname || starts[0].Detail != "1 of 2 servers failed" {
+		t.Fatalf("expected one burst start, got %+v", starts)
+	}
+	if active := resolver.activeBursts(time.Now()); len(active) != 1 || active[0] != hostname {
+		t.Fatalf("expected %s bursting, got %v", hostname, active)
+	}
+
+	// Recovery does not end the burst early; it runs out the duration.
+	failing = false
+	resolver.resolveHostname(context.Background(), hostname)
+	if active := resolver.activeBursts(time.Now()); len(active) != 1 {
+		t.Fatalf("expected burst to continue after recovery, got %v", active)
+	}
+	if active := resolver.activeBursts(time.Now().Add(2 * time.Minute)); len(active) != 0 {
+		t.Fatalf("expected burst to end after its duration, got %v", active)
+	}
+	if ends := resolver.RecentEvents(0, EventBurstEnd); len(ends) != 1 || ends[0].Hostname != hostname {
+		t.Fatalf("expected one burst end, got %+v", ends)
+	}
+}
+
+func TestValidateBurst(t *testing.T) {
+	config := &Config{}
+	config.Burst.Factor = 1
+	if err := validateBurst(config); err == nil || !strings.Contains(err.Error(), "at least 2") {
+		t.Fatalf("expected factor error, got %v", err)
+	}
+	config.Burst.Factor = 0
+	if err := validateBurst(config); err != nil {
+		t.Fatalf("unexpected error for default factor: %v", err)
+	}
+	if got := config.burstFactor(); got != defaultBurstFactor {
+		t.Fatalf("expected default factor %d, got %d", defaultBurstFactor, got)
+	}
+}
+
+func TestSamplerCoversEveryHostnameEachRound(t *testing.T) {
+	var hostnames []string
+	for i := range 10 {
+		hostnames = append(hostnames, fmt.Sprintf("host%d.example", i))
+	}
+	s := newSampler(&Config{Sampling: SamplingConfig{Fraction: 0.3}})
+	if s.cycles != 4 {
+		t.Fatalf("expected rounds of 4 cycles, got %d", s.cycles)
+	}
+
+	for round := range 2 {
+		seen := make(map[string]int)
+		for cycle := range 4 {
+			sample, coverage, done := s.next(hostnames)
+			if len(sample) > 3 {
+				t.Fatalf("round %d cycle %d: expected at most 3 hostnames, got %v", round, cycle, sample)
+			}
+			for _, hostname := range sample {
+				seen[hostname]++
+			}
+			if want := float64(len(seen)) / 10; coverage != want {
+				t.Fatalf("round %d cycle %d: expected coverage %v, got %v", round, cycle, want, coverage)
+			}
+			if done != (cycle == 3) {
+				t.Fatalf("round %d cycle %d: unexpected round end %v", round, cycle, done)
+			}
+		}
+		if len(seen) != 10 {
+			t.Fatalf("round %d: expected every hostname once, got %v", round, seen)
+		}
+		for hostname, n := range seen {
+			if n != 1 {
+				t.Fatalf("round %d: %s resolved %d times", round, hostname, n)
+			}
+		}
+	}
+
+	// Hostnames added during a round are covered by it; removed ones are
+	// not resolved.
+	seen := make(map[string]bool)
+	sample, _, _ := s.next(hostnames)
+	for _, hostname := range sample {
+		seen[hostname] = true
+	}
+	changed := append([]string{"new.example"}, hostnames[1:]...)
+	for range 3 {
+		sample, _, _ := s.next(changed)
+		for _, hostname := range sample {
+			seen[hostname] = true
+		}
+	}
+	if !seen["new.example"] || len(seen) < 10 {
+		t.Fatalf("expected the changed list covered, got %v", seen)
+	}
+}
+
+func TestValidateSampling(t *testing.T) {
+	for _, fraction := range []float64{-0.1, 1.5} {
+		if err := validateSampling(&Config{Sampling: SamplingConfig{Fraction: fraction}}); err == nil {
+			t.Fatalf("expected fraction %v rejected", fraction)
+		}
+	}
+	if newSampler(&Config{Sampling: SamplingConfig{Fraction: 1}}) != nil {
+		t.Fatal("expected a fraction of 1 to resolve every hostname each cycle")
+	}
+}
+
+func TestResolveHostnameTracksIncidents(t *testing.T) {
+	hostname := "incident.example.com"
+	servers := []string{"1.1.1.1:53", "2.2.2.2:53"}
+
+	webhooks := make(chan incidentWebhookPayload, 2)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var payload incidentWebhookPayload
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			t.Errorf("invalid webhook body: %v", err)
+		}
+		webhooks <- payload
+	}))
+	defer webhook.Close()
+
+	breakers := make(map[string]*circuitbreaker.CircuitBreaker)
+	stats := make(map[string]*ServerStats)
+	for _, server := range servers {
+		breakers[server] = circuitbreaker.NewCircuitBreaker(100, time.Minute, server)
+		stats[server] = &ServerStats{}
+	}
+	config := &Config{Hostnames: []string{hostname}, DNSServers: servers}
+	config.Incidents.WebhookURL = webhook.URL
+
+	failing := true
+	var resolver *DNSResolver
+	resolver = &DNSResolver{
+		config:     config,
+		breakers:   breakers,
+		successLog: log.New(io.Discard, "", 0),
+		errorLog:   log.New(io.Discard, "", 0),
+		stats:      &ResolutionStats{Stats: stats, StartTime: time.Now()},
+		history:    newEventHistory(50),
+		incidents:  newIncidentTracker(),
+		resolveWithServerFunc: func(_ context.Context, server, host string) (*dnsanalysis.DNSResponse, error) {
+			if failing && server == servers[1] {
+				err := errors.New("timeout")
+				resolver.emitEvent(ResolverEvent{Type: EventResolveFailure, Time: time.Now(), Hostname: host, Server: server, Error: err.Error()})
+				return nil, err
+			}
+			return &dnsanalysis.DNSResponse{Server: server, Hostname: host, Addresses: []string{"10.0.0.1"}}, nil
+		},
+	}
+
+	resolver.resolveHostname(context.Background(), hostname)
+	resolver.resolveHostname(context.Background(), hostname)
+	open := resolver.Incidents(0, true)
+	if len(open) != 1 || open[0].Servers[0] != servers[1] || open[0].Causes[0] != IncidentCauseFailure {
+		t.Fatalf("expected one open failure incident on %s, got %+v", servers[1], open)
+	}
+	failuresSeen := 0
+	for _, event := range open[0].Events {
+		if event.Type == EventResolveFailure {
+			failuresSeen++
+		}
+	}
+	if failuresSeen != 2 {
+		t.Fatalf("expected both failures in the incident timeline, got %+v", open[0].Events)
+	}
+
+	failing = false
+	resolver.resolveHostname(context.Background(), hostname)
+	if open := resolver.Incidents(0, true); len(open) != 0 {
+		t.Fatalf("expected incident closed after recovery, got %+v", open)
+	}
+
+	response := httptest.NewRecorder()
+	resolver.apiHandler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/incidents?limit=5", nil))
+	var incidents []Incident
+	if err := json.Unmarshal(response.Body.Bytes(), &incidents); err != nil {
+		t.Fatalf("invalid /incidents response: %v", err)
+	}
+	if len(incidents) != 1 || incidents[0].Ended == nil {
+		t.Fatalf("expected one closed incident from /incidents, got %+v", incidents)
+	}
+	if report := resolver.GenerateReport(); !strings.Contains(report, hostname) {
+		t.Fatalf("expected incident in report, got %q", report)
+	}
+
+	// Deliveries are queued in order and posted one at a time.
+	for _, want := range []string{"open", "close"} {
+		select {
+		case delivery := <-resolver.incidents.webhooks:
+			resolver.postIncidentWebhook(context.Background(), delivery)
+		default:
+			t.Fatalf("expected %s webhook queued", want)
+		}
+		if payload := <-webhooks; payload.Action != want || payload.Incident.Hostname != hostname {
+			t.Fatalf("expected %s webhook for %s, got %+v", want, hostname, payload)
+		}
+	}
+}
+
+type recordingProducer struct {
+	topics   []string
+	messages []kafka.Message
+	err      error
+}
+
+func (p *recordingProducer) Produce(_ context.Context, topic string, messages []kafka.Message) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.topics = append(p.topics, topic)
+	p.messages = append(p.messages, messages...)
+	return nil
+}
+
+func (p *recordingProducer) Close() error { return nil }
+
+func TestRecordResultsWritesKafkaBatches(t *testing.T) {
+	registered := 0
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/subjects/results-value/versions" {
+			t.Errorf("unexpected registry path %s", req.URL.Path)
+		}
+		registered++
+		io.WriteString(w, `{"id":42}`)
+	}))
+	defer registry.Close()
+
+	config := &Config{}
+	config.Kafka.Brokers = []string{"127.0.0.1:9092"}
+	config.Kafka.Topic = "results"
+	config.Kafka.BufferSize = 2
+	if err := validateKafka(config); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	producer := &recordingProducer{}
+	resolver := &DNSResolver{
+		config:   config,
+		errorLog: log.New(io.Discard, "", 0),
+		results: &resultSink{
+			config:   config.Kafka,
+			records:  make(chan ResolutionResult, config.Kafka.bufferSize()),
+			producer: producer,
+			client:   registry.Client(),
+		},
+	}
+
+	responses := []*dnsanalysis.DNSResponse{{Server: "1.1.1.1:53", Hostname: "www.example.com", Addresses: []string{"10.0.0.1"}, TTL: 300, Duration: 5 * time.Millisecond, Protocol: "udp"}}
+	failures := map[string]string{"8.8.8.8:53": "timeout", "9.9.9.9:53": "timeout"}
+	resolver.recordResults(context.Background(), "www.example.com", responses, failures, true)
+	if got := len(resolver.results.records); got != 2 {
+		t.Fatalf("expected the full buffer to drop the third result, got %d queued", got)
+	}
+
+	batch := []ResolutionResult{<-resolver.results.records, <-resolver.results.records}
+	resolver.writeResults(context.Background(), batch)
+	if len(producer.messages) != 2 || producer.topics[0] != "results" || string(producer.messages[0].Key) != "www.example.com" {
+		t.Fatalf("expected two messages keyed by hostname, got %+v", producer.messages)
+	}
+	var decoded ResolutionResult
+	if err := json.Unmarshal(producer.messages[0].Value, &decoded); err != nil || !decoded.Success || decoded.Rcode != "NOERROR" || decoded.TTL != 300 {
+		t.Fatalf("unexpected JSON result %s (%v)", producer.messages[0].Value, err)
+	}
+	if err := json.Unmarshal(producer.messages[1].Value, &decoded); err != nil || decoded.Success || decoded.Error != "timeout" || decoded.Server != "8.8.8.8:53" {
+		t.Fatalf("unexpected JSON failure %s (%v)", producer.messages[1].Value, err)
+	}
+
+	// Avro values carry the registered schema ID in the wire format header.
+	resolver.results.config.Format = ResultFormatAvro
+	resolver.results.config.SchemaRegistryURL = registry.URL
+	resolver.writeResults(context.Background(), batch)
+	value := producer.messages[2].Value
+	if registered != 1 || value[0] != 0 || binary.BigEndian.Uint32(value[1:5]) != 42 {
+		t.Fatalf("expected schema ID 42 after one registration, got %x (registrations %d)", value[:5], registered)
+	}
+	if !strings.Contains(string(value), "www.example.com") {
+		t.Fatalf("expected hostname in Avro record, got %x", value)
+	}
+
+	config.Kafka.Format = ResultFormatAvro
+	if err := validateKafka(config); err == nil {
+		t.Fatal("expected avro without a schema registry to fail validation")
+	}
+}
+
+func TestRecordResultsWritesResultsFile(t *testing.T) {
+	logDir := t.TempDir()
+	config := &Config{}
+	config.ResultsFile.Path = "results.jsonl"
+	file, err := openResultsFile(config, logDir)
+	if err != nil {
+		t.Fatalf("unexpected error opening results file: %v", err)
+	}
+	resolver := &DNSResolver{config: config, errorLog: log.New(io.Discard, "", 0), resultsFile: file}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	msg.SetEdns0(4096, true)
+	msg.Response, msg.RecursionAvailable = true, true
+	responses := []*dnsanalysis.DNSResponse{{Server: "1.1.1.1:53", Hostname: "www.example.com", Addresses: []string{"10.0.0.1"}, TTL: 300, Duration: 5 * time.Millisecond, Protocol: "udp", Response: msg}}
+	failures := map[string]string{"8.8.8.8:53": "timeout"}
+	resolver.recordResults(context.Background(), "www.example.com", responses, failures, false)
+
+	data, err := os.ReadFile(filepath.Join(logDir, "results.jsonl"))
+	if err != nil {
+		t.Fatalf("expected results file in the log directory: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected one line per server, got %q", data)
+	}
+	var result ResolutionResult
+	if err := json.Unmarshal([]byte(lines[0]), &result); err != nil {
+		t.Fatalf("invalid result line %q: %v", lines[0], err)
+	}
+	if !result.Success || result.Consistent || result.DurationMS != 5 || strings.Join(result.Flags, " ") != "qr rd ra do" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if full := result.Result; full == nil || full.Server != "1.1.1.1:53" || full.Transport != "udp" || full.Timings.TotalMs != 5 || full.Validation != dnsanalysis.ValidationUnsigned {
+		t.Fatalf("expected the full answer on the result line, got %+v", full)
+	}
+	var failure ResolutionResult
+	if err := json.Unmarshal([]byte(lines[1]), &failure); err != nil || failure.Success || failure.Error != "timeout" || failure.Flags != nil || failure.Result != nil {
+		t.Fatalf("unexpected failure line %q (%v)", lines[1], err)
+	}
+
+	config.ResultsFile.Rotation.MaxSizeMB = -1
+	if err := validateLogRotation(config); err == nil || !strings.Contains(err.Error(), "results") {
+		t.Fatalf("expected negative results rotation to fail validation, got %v", err)
+	}
+}
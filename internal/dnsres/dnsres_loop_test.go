@@ -2,9 +2,29 @@ package dnsres
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"dnsres/cache"
+	"dnsres/circuitbreaker"
+	"dnsres/dnsanalysis"
+	"dnsres/internal/cron"
+	"dnsres/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestRunLoopTicksAndStops(t *testing.T) {
@@ -52,3 +72,847 @@ func TestRunLoopTicksAndStops(t *testing.T) {
 		t.Fatalf("expected runLoop to stop after cancel")
 	}
 }
+
+func TestTriggerCycleRunsImmediately(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cycles := make(chan struct{}, 2)
+	resolver := &DNSResolver{
+		config:   &Config{QueryInterval: Duration{Duration: time.Minute}},
+		triggers: make(chan string, 1),
+		resolveAllFunc: func(context.Context) {
+			cycles <- struct{}{}
+		},
+	}
+	if !resolver.NextCycle().IsZero() {
+		t.Fatalf("expected no next cycle before the loop starts, got %s", resolver.NextCycle())
+	}
+
+	if err := resolver.TriggerCycle("test"); err != nil {
+		t.Fatalf("TriggerCycle() error = %v", err)
+	}
+	if err := resolver.TriggerCycle("test"); err == nil {
+		t.Fatal("expected an error while a triggered cycle is pending")
+	}
+
+	ticks := make(chan time.Time, 1)
+	tick := time.Now()
+	go resolver.runLoop(ctx, ticks)
+	select {
+	case <-cycles:
+	case <-time.After(time.Second):
+		t.Fatal("triggered cycle did not run")
+	}
+
+	ticks <- tick
+	select {
+	case <-cycles:
+	case <-time.After(time.Second):
+		t.Fatal("scheduled cycle did not run")
+	}
+	if next := resolver.NextCycle(); !next.Equal(tick.Add(time.Minute).Round(0)) {
+		t.Fatalf("NextCycle() = %s, want %s", next, tick.Add(time.Minute))
+	}
+}
+
+func TestRunCycleCountsOverlaps(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		work     time.Duration
+		want     float64
+	}{
+		{name: "within interval", interval: time.Second, want: 0},
+		{name: "overran interval", interval: time.Millisecond, work: 10 * time.Millisecond, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &DNSResolver{
+				config: &Config{QueryInterval: Duration{Duration: tt.interval}},
+				resolveAllFunc: func(context.Context) {
+					time.Sleep(tt.work)
+				},
+			}
+			before := testutil.ToFloat64(metrics.DNSResCycleOverlaps)
+			resolver.runCycle(context.Background(), time.Now())
+			if got := testutil.ToFloat64(metrics.DNSResCycleOverlaps) - before; got != tt.want {
+				t.Fatalf("expected %v overlaps, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRunSummaryCountsCycles(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	resolver := &DNSResolver{
+		config:         &Config{QueryInterval: Duration{Duration: time.Minute}},
+		stats:          &ResolutionStats{StartTime: start, Stats: map[string]*ServerStats{}},
+		resolveAllFunc: func(context.Context) {},
+	}
+
+	// The third tick comes three intervals after the second: two were
+	// dropped while a cycle ran.
+	for _, tick := range []time.Time{start, start.Add(time.Minute), start.Add(4 * time.Minute)} {
+		resolver.runCycle(context.Background(), tick)
+	}
+	resolver.stats.recordCycle(time.Second)
+	resolver.stats.recordCycle(2 * time.Second)
+
+	summary := resolver.RunSummary()
+	if summary.Cycles.Completed != 2 || summary.Cycles.Skipped != 2 || summary.Cycles.AverageDuration.Duration != 1500*time.Millisecond {
+		t.Fatalf("unexpected cycle counters %+v", summary.Cycles)
+	}
+	if summary.Uptime != time.Hour {
+		t.Fatalf("expected an hour of uptime, got %s", summary.Uptime)
+	}
+
+	response := httptest.NewRecorder()
+	resolver.apiHandler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats StatsSnapshot
+	if err := json.Unmarshal(response.Body.Bytes(), &stats); err != nil || stats.Cycles != summary.Cycles || stats.Uptime != "1h0m0s" {
+		t.Fatalf("expected cycle counters in /stats, got %s (%v)", response.Body.String(), err)
+	}
+	if report := resolver.GenerateReport(); !strings.HasPrefix(report, "Uptime 1h0m0s since ") || !strings.Contains(report, "2 cycles completed, 2 skipped, average 1.5s") {
+		t.Fatalf("expected the run summary in the report header, got %q", report)
+	}
+}
+
+func TestSchedulerBackpressureMetrics(t *testing.T) {
+	server := "1.1.1.1:53"
+	var hostnames []string
+	for i := range 20 {
+		hostnames = append(hostnames, fmt.Sprintf("host%d.example.com", i))
+	}
+	var maxDepth atomic.Int64
+	resolver := &DNSResolver{
+		config: &Config{
+			Hostnames:     hostnames,
+			DNSServers:    []string{server},
+			QueryInterval: Duration{Duration: time.Minute},
+		},
+		breakers: map[string]*circuitbreaker.CircuitBreaker{
+			server: circuitbreaker.NewCircuitBreaker(5, time.Minute, server),
+		},
+		successLog: log.New(io.Discard, "", 0),
+		errorLog:   log.New(io.Discard, "", 0),
+		stats:      &ResolutionStats{Stats: map[string]*ServerStats{server: {}}, StartTime: time.Now()},
+		resolveWithServerFunc: func(ctx context.Context, server, host string) (*dnsanalysis.DNSResponse, error) {
+			depth := int64(testutil.ToFloat64(metrics.DNSResSchedulerQueueDepth.WithLabelValues(tierInterval)))
+			if depth > maxDepth.Load() {
+				maxDepth.Store(depth)
+			}
+			time.Sleep(5 * time.Millisecond)
+			return &dnsanalysis.DNSResponse{Server: server, Hostname: host, Addresses: []string{"10.0.0.1"}}, nil
+		},
+	}
+	resolver.resolveAllFunc = resolver.resolveAll
+
+	// Twenty hostnames share ten slots, so some wait in the queue.
+	skipped := testutil.ToFloat64(metrics.DNSResSchedulerDropped.WithLabelValues(tierInterval, "tick_skipped"))
+	start := time.Now()
+	resolver.runCycle(context.Background(), start)
+	resolver.runCycle(context.Background(), start.Add(3*time.Minute))
+	if maxDepth.Load() == 0 {
+		t.Fatal("expected hostnames queued for a slot")
+	}
+	if depth := testutil.ToFloat64(metrics.DNSResSchedulerQueueDepth.WithLabelValues(tierInterval)); depth != 0 {
+		t.Fatalf("expected an empty queue after the cycles, got %v", depth)
+	}
+	if got := testutil.ToFloat64(metrics.DNSResSchedulerDropped.WithLabelValues(tierInterval, "tick_skipped")) - skipped; got != 2 {
+		t.Fatalf("expected 2 skipped ticks, got %v", got)
+	}
+
+	schedule, err := cron.Parse("* * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tick := time.Date(2024, 3, 14, 10, 0, 0, 0, time.UTC)
+	if missed := missedFirings(schedule, tick, tick.Add(3*time.Minute+30*time.Second)); missed != 3 {
+		t.Fatalf("expected 3 firings missed by a 3.5 minute run, got %d", missed)
+	}
+}
+
+func newRemoteConfigTestResolver(backend, address string) *DNSResolver {
+	config := DefaultConfig()
+	config.Hostnames = []string{"local.example.com"}
+	config.DNSServers = []string{"192.0.2.1:53"}
+	config.RemoteConfig.Backend = backend
+	config.RemoteConfig.Address = address
+	config.RemoteConfig.Key = "dnsres/probe"
+	config.RemoteConfig.PollInterval = Duration{10 * time.Millisecond}
+	return &DNSResolver{
+		config:   config,
+		errorLog: log.New(io.Discard, "", 0),
+		breakers: map[string]*circuitbreaker.CircuitBreaker{
+			"192.0.2.1:53": circuitbreaker.NewCircuitBreaker(5, time.Minute, "192.0.2.1:53"),
+		},
+		stats:   &ResolutionStats{Stats: map[string]*ServerStats{"192.0.2.1:53": {}}},
+		reloads: make(chan configReload, 1),
+	}
+}
+
+func TestScheduledHostnamesLeaveIntervalCycle(t *testing.T) {
+	server := "1.1.1.1:53"
+	config := &Config{
+		Hostnames:  []string{"interval.example.com", "scheduled.example.com"},
+		DNSServers: []string{server},
+		Schedules:  map[string]string{"scheduled.example.com": "@every 1s"},
+	}
+	schedules, err := compileSchedules(config)
+	if err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+
+	var mu sync.Mutex
+	resolved := make(map[string]int)
+	resolver := &DNSResolver{
+		config:     config,
+		schedules:  schedules,
+		breakers:   map[string]*circuitbreaker.CircuitBreaker{server: circuitbreaker.NewCircuitBreaker(100, time.Minute, server)},
+		successLog: log.New(io.Discard, "", 0),
+		errorLog:   log.New(io.Discard, "", 0),
+		stats:      &ResolutionStats{Stats: map[string]*ServerStats{server: {}}, StartTime: time.Now()},
+		resolveWithServerFunc: func(_ context.Context, server, host string) (*dnsanalysis.DNSResponse, error) {
+			mu.Lock()
+			resolved[host]++
+			mu.Unlock()
+			return &dnsanalysis.DNSResponse{Server: server, Hostname: host, Addresses: []string{"10.0.0.1"}}, nil
+		},
+	}
+	count := func(host string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return resolved[host]
+	}
+
+	resolver.resolveAll(context.Background())
+	if count("interval.example.com") != 1 || count("scheduled.example.com") != 0 {
+		t.Fatalf("expected only the unscheduled hostname in the cycle, got %v", resolved)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		resolver.runSchedules(ctx)
+		close(done)
+	}()
+	deadline := time.After(3 * time.Second)
+	for count("scheduled.example.com") == 0 {
+		select {
+		case <-deadline:
+			t.Fatal("expected the schedule to resolve its hostname")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	cancel()
+	<-done
+	if count("interval.example.com") != 1 {
+		t.Fatalf("schedule resolved an unscheduled hostname: %v", resolved)
+	}
+}
+
+func TestValidateSchedules(t *testing.T) {
+	config := &Config{
+		Hostnames: []string{"example.com"},
+		Schedules: map[string]string{"example.com": "*/15 9-17 * * MON-FRI"},
+	}
+	if err := validateSchedules(config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	config.Schedules = map[string]string{"other.example.com": "@hourly"}
+	if err := validateSchedules(config); err == nil || !strings.Contains(err.Error(), "not in hostnames") {
+		t.Fatalf("expected unknown hostname error, got %v", err)
+	}
+	config.Schedules = map[string]string{"example.com": "* * *"}
+	if err := validateSchedules(config); err == nil || !strings.Contains(err.Error(), "invalid schedule") {
+		t.Fatalf("expected parse error, got %v", err)
+	}
+}
+
+func TestRemoteConfigFromConsul(t *testing.T) {
+	documents := []string{
+		`{"hostnames": ["web{1..2}.example.com"], "dns_servers": ["192.0.2.1", "192.0.2.2"]}`,
+		`{"hostnames": ["api.example.com"], "circuit_breaker": {"threshold": 0, "timeout": "30s"}}`,
+		`{"hostnames": ["api.example.com"], "query_interval": "1s"}`,
+	}
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/kv/dnsres/probe" {
+			http.NotFound(w, req)
+			return
+		}
+		n := int(requests.Add(1)) - 1
+		if n >= len(documents) {
+			<-req.Context().Done()
+			return
+		}
+		if n > 0 && req.URL.Query().Get("index") != strconv.Itoa(n) {
+			t.Errorf("expected blocking query with index %d, got %q", n, req.URL.RawQuery)
+		}
+		w.Header().Set("X-Consul-Index", strconv.Itoa(n+1))
+		_, _ = w.Write([]byte(documents[n]))
+	}))
+	defer server.Close()
+
+	resolver := newRemoteConfigTestResolver("consul", server.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := resolver.startRemoteConfig(ctx); err != nil {
+		t.Fatalf("startRemoteConfig failed: %v", err)
+	}
+
+	if got := strings.Join(resolver.config.Hostnames, ","); got != "web1.example.com,web2.example.com" {
+		t.Fatalf("expected remote hostnames applied, got %q", got)
+	}
+	if _, ok := resolver.breakers["192.0.2.2:53"]; !ok {
+		t.Fatal("expected breaker for added server")
+	}
+	if _, ok := resolver.stats.Stats["192.0.2.2:53"]; !ok {
+		t.Fatal("expected stats for added server")
+	}
+
+	// The second document is invalid and skipped; the third is queued.
+	select {
+	case reload := <-resolver.reloads:
+		config := reload.config
+		if got := strings.Join(config.Hostnames, ","); got != "api.example.com" {
+			t.Fatalf("unexpected reloaded hostnames %q", got)
+		}
+		resolver.applyConfig(config, "consul")
+		if resolver.config.QueryInterval.Duration != 30*time.Second {
+			t.Fatalf("expected query interval to stay fixed, got %s", resolver.config.QueryInterval.Duration)
+		}
+		if len(resolver.config.DNSServers) != 1 {
+			t.Fatalf("expected servers missing from the remote document to use local values, got %v", resolver.config.DNSServers)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for reloaded config")
+	}
+}
+
+func TestReloadAppliesBetweenCycles(t *testing.T) {
+	resolver := newRemoteConfigTestResolver("", "")
+	resolver.reloads = make(chan configReload)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		_ = resolver.runLoop(ctx, nil)
+		close(done)
+	}()
+
+	config, err := EditConfig(resolver.config, map[string]any{"hostnames": []string{"edited.example.com"}})
+	if err != nil {
+		t.Fatalf("EditConfig returned error: %v", err)
+	}
+	if err := resolver.Reload(ctx, config, "tui"); err != nil {
+		t.Fatalf("Reload returned error: %v", err)
+	}
+	cancel()
+	<-done
+	if got := strings.Join(resolver.config.Hostnames, ","); got != "edited.example.com" {
+		t.Fatalf("expected edited hostnames applied, got %q", got)
+	}
+
+	if err := resolver.Reload(ctx, config, "tui"); err == nil {
+		t.Fatal("expected Reload to fail once the run loop has stopped")
+	}
+}
+
+func TestApplyConfigWhileServing(t *testing.T) {
+	resolver := newRemoteConfigTestResolver("", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			resolver.StatsSnapshot()
+			resolver.ServerTargets()
+			resolver.BreakerSnapshot()
+			resolver.stats.recordFailure("192.0.2.1:53", "timeout")
+			resolver.recordBreakerFailure("192.0.2.2:53", errors.New("timeout"))
+		}
+	}()
+
+	// Run under -race: reloads swap the config, breakers and stats while
+	// the goroutine above reads them.
+	for i := range 50 {
+		config := DefaultConfig()
+		config.Hostnames = []string{"local.example.com"}
+		config.DNSServers = []string{"192.0.2.1:53"}
+		if i%2 == 0 {
+			config.DNSServers = append(config.DNSServers, fmt.Sprintf("192.0.2.%d:53", 2+i%3))
+		}
+		resolver.applyConfig(config, "test")
+	}
+	cancel()
+	wg.Wait()
+
+	if resolver.breaker("192.0.2.2:53") != nil {
+		t.Fatal("expected the removed server to have no breaker")
+	}
+	if _, ok := resolver.StatsSnapshot().Servers["192.0.2.4:53"]; !ok {
+		t.Fatal("expected stats kept for a server added by a reload")
+	}
+}
+
+func TestRemoteConfigFallsBackToLocal(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	resolver := newRemoteConfigTestResolver("etcd", server.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := resolver.startRemoteConfig(ctx); err != nil {
+		t.Fatalf("startRemoteConfig failed: %v", err)
+	}
+	if got := strings.Join(resolver.config.Hostnames, ","); got != "local.example.com" {
+		t.Fatalf("expected local config kept, got %q", got)
+	}
+}
+
+func TestConfigFromURL(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	var mu sync.Mutex
+	const common = `"query_timeout": "5s", "query_interval": "30s", "circuit_breaker": {"threshold": 5, "timeout": "30s"}, "cache": {"max_size": 1000}`
+	document := `{"hostnames": ["v1.example.com"], "dns_servers": ["192.0.2.1"], "remote_config": {"poll_interval": "10ms"}, ` + common + `}`
+	version := 1
+	var notModified atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		etag := fmt.Sprintf(`"v%d"`, version)
+		if req.Header.Get("If-None-Match") == etag {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(document))
+	}))
+
+	config, err := LoadConfig(server.URL + "/dnsres.json")
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if got := strings.Join(config.Hostnames, ","); got != "v1.example.com" {
+		t.Fatalf("unexpected hostnames %q", got)
+	}
+
+	resolver := newRemoteConfigTestResolver("", "")
+	resolver.config = config
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := resolver.startRemoteConfig(ctx); err != nil {
+		t.Fatalf("startRemoteConfig failed: %v", err)
+	}
+	deadline := time.After(2 * time.Second)
+	for notModified.Load() == 0 {
+		select {
+		case <-deadline:
+			t.Fatal("expected the config to be revalidated with If-None-Match")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+
+	mu.Lock()
+	document = `{"hostnames": ["v2.example.com"], "dns_servers": ["192.0.2.2"], ` + common + `}`
+	version = 2
+	mu.Unlock()
+	select {
+	case reload := <-resolver.reloads:
+		config := reload.config
+		if got := strings.Join(config.Hostnames, ","); got != "v2.example.com" {
+			t.Fatalf("unexpected reloaded hostnames %q", got)
+		}
+		if config.RemoteConfig.PollInterval.Duration != 0 {
+			t.Fatal("expected the new version to replace the config instead of overlaying it")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for reloaded config")
+	}
+	cancel()
+
+	// Offline, the last-good copy is used.
+	server.Close()
+	config, err = LoadConfig(server.URL + "/dnsres.json")
+	if err != nil {
+		t.Fatalf("LoadConfig from last-good copy failed: %v", err)
+	}
+	if got := strings.Join(config.Hostnames, ","); got != "v2.example.com" || config.download.stale == nil {
+		t.Fatalf("expected stale last-good copy, got %q (stale %v)", got, config.download.stale)
+	}
+	if _, err := LoadConfig(server.URL + "/other.json"); err == nil {
+		t.Fatal("expected an error for an unreachable URL without a last-good copy")
+	}
+}
+
+func TestEtcdSourceFetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Key string `json:"key"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || req.URL.Path != "/v3/kv/range" {
+			t.Errorf("unexpected request %s: %v", req.URL.Path, err)
+		}
+		key, _ := base64.StdEncoding.DecodeString(body.Key)
+		value := base64.StdEncoding.EncodeToString([]byte(`{"hostnames": ["etcd.example.com"]}`))
+		_, _ = fmt.Fprintf(w, `{"kvs": [{"key": %q, "value": %q}]}`, base64.StdEncoding.EncodeToString(key), value)
+	}))
+	defer server.Close()
+
+	source := &etcdSource{address: server.URL, key: "dnsres/probe", client: server.Client(), poll: time.Millisecond}
+	data, err := source.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if !strings.Contains(string(data), "etcd.example.com") {
+		t.Fatalf("unexpected document %s", data)
+	}
+}
+
+func TestMemoryBudgetSheddingAndRecovery(t *testing.T) {
+	resolver := &DNSResolver{
+		config:   &Config{Memory: MemoryConfig{BudgetMB: 1}},
+		cache:    cache.NewShardedCache(1<<20, 1),
+		history:  newEventHistory(16),
+		errorLog: log.New(io.Discard, "", 0),
+	}
+	for i := 0; i < 10; i++ {
+		host := fmt.Sprintf("host%d.example.com", i)
+		resolver.cache.Set(host, &dnsanalysis.DNSResponse{Hostname: host}, time.Duration(i+1)*time.Minute)
+		resolver.history.add(ResolverEvent{Type: EventResolveSuccess, Hostname: host})
+	}
+	metrics.DNSResolutionConsistency.WithLabelValues("host9.example.com").Set(1)
+	metrics.DNSResolutionFlapping.WithLabelValues("host9.example.com").Set(1)
+
+	resolver.enforceMemoryBudget(2 << 20)
+	if got := testutil.ToFloat64(metrics.DNSResMemoryPressure); got != 2 {
+		t.Fatalf("expected pressure 2, got %v", got)
+	}
+	if _, ok := resolver.cache.Get("host0.example.com"); ok {
+		t.Fatal("expected the entry closest to expiry to be evicted")
+	}
+	if _, ok := resolver.cache.Get("host9.example.com"); !ok {
+		t.Fatal("expected the entry furthest from expiry to be kept")
+	}
+	events := resolver.history.recent(0, "")
+	if len(events) != 5 || events[0].Hostname != "host5.example.com" {
+		t.Fatalf("expected the newest half of the history kept, got %d events", len(events))
+	}
+	if got := resolver.metricHostname("host9.example.com"); got != metrics.AggregatedHostname {
+		t.Fatalf("expected aggregated hostname label, got %q", got)
+	}
+	if got := testutil.CollectAndCount(metrics.DNSResolutionConsistency); got != 0 {
+		t.Fatalf("expected per-hostname consistency series dropped, got %d", got)
+	}
+	if got := testutil.CollectAndCount(metrics.DNSResolutionFlapping); got != 0 {
+		t.Fatalf("expected per-hostname flapping series dropped, got %d", got)
+	}
+
+	resolver.enforceMemoryBudget(900 << 10)
+	if got := resolver.metricHostname("host9.example.com"); got != metrics.AggregatedHostname {
+		t.Fatalf("expected labels to stay aggregated just under budget, got %q", got)
+	}
+	resolver.enforceMemoryBudget(100 << 10)
+	if got := resolver.metricHostname("host9.example.com"); got != "host9.example.com" {
+		t.Fatalf("expected hostname label restored, got %q", got)
+	}
+}
+
+func TestFileElectorHandsOverLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader.lock")
+	a, err := newFileElector(path, "probe-a")
+	if err != nil {
+		t.Skipf("file elector unavailable: %v", err)
+	}
+	b, _ := newFileElector(path, "probe-b")
+	ctx := context.Background()
+
+	if leading, _, err := a.Campaign(ctx); err != nil || !leading {
+		t.Fatalf("expected probe-a to lead, got %t, %v", leading, err)
+	}
+	if leading, _, err := a.Campaign(ctx); err != nil || !leading {
+		t.Fatalf("expected probe-a to keep leading, got %t, %v", leading, err)
+	}
+	leading, holder, err := b.Campaign(ctx)
+	if err != nil || leading || holder != "probe-a" {
+		t.Fatalf("expected probe-b to stand by for probe-a, got %t %q, %v", leading, holder, err)
+	}
+	if err := a.Resign(ctx); err != nil {
+		t.Fatalf("resign failed: %v", err)
+	}
+	if leading, _, err := b.Campaign(ctx); err != nil || !leading {
+		t.Fatalf("expected probe-b to lead after probe-a resigned, got %t, %v", leading, err)
+	}
+	b.Resign(ctx)
+}
+
+// fakeLeaseServer serves one Lease with optimistic concurrency.
+func fakeLeaseServer(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	var lease *kubernetesLease
+	version := 0
+	const path = "/apis/coordination.k8s.io/v1/namespaces/monitoring/leases"
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var body kubernetesLease
+		if req.Body != nil {
+			_ = json.NewDecoder(req.Body).Decode(&body)
+		}
+		switch {
+		case req.Method == http.MethodGet && req.URL.Path == path+"/dnsres":
+			if lease == nil {
+				http.NotFound(w, req)
+				return
+			}
+		case req.Method == http.MethodPost && req.URL.Path == path:
+			if lease != nil {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			lease = &body
+		case req.Method == http.MethodPut && req.URL.Path == path+"/dnsres":
+			if lease == nil || body.Metadata.ResourceVersion != lease.Metadata.ResourceVersion {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			lease = &body
+		default:
+			t.Errorf("unexpected request %s %s", req.Method, req.URL.Path)
+			http.NotFound(w, req)
+			return
+		}
+		if req.Method != http.MethodGet {
+			version++
+			lease.Metadata.ResourceVersion = strconv.Itoa(version)
+		}
+		_ = json.NewEncoder(w).Encode(lease)
+	}))
+}
+
+func TestLeaseElectorTakesOverExpiredLease(t *testing.T) {
+	server := fakeLeaseServer(t)
+	defer server.Close()
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	api := kubernetesAPI{server: server.URL, namespace: "monitoring", client: server.Client(), token: func() (string, error) { return "", nil }}
+	a := &leaseElector{api: api, name: "dnsres", identity: "probe-a", duration: 15 * time.Second, now: clock}
+	b := &leaseElector{api: api, name: "dnsres", identity: "probe-b", duration: 15 * time.Second, now: clock}
+	ctx := context.Background()
+
+	if leading, _, err := a.Campaign(ctx); err != nil || !leading {
+		t.Fatalf("expected probe-a to create the lease, got %t, %v", leading, err)
+	}
+	leading, holder, err := b.Campaign(ctx)
+	if err != nil || leading || holder != "probe-a" {
+		t.Fatalf("expected probe-b to stand by for probe-a, got %t %q, %v", leading, holder, err)
+	}
+
+	// probe-a renews within the lease, so probe-b keeps waiting.
+	now = now.Add(10 * time.Second)
+	if leading, _, err := a.Campaign(ctx); err != nil || !leading {
+		t.Fatalf("expected probe-a to renew, got %t, %v", leading, err)
+	}
+	now = now.Add(10 * time.Second)
+	if leading, _, _ := b.Campaign(ctx); leading {
+		t.Fatal("expected probe-b to wait for a renewed lease")
+	}
+
+	// probe-a stops renewing and probe-b takes over once the lease expires.
+	now = now.Add(16 * time.Second)
+	if leading, _, err := b.Campaign(ctx); err != nil || !leading {
+		t.Fatalf("expected probe-b to take the expired lease, got %t, %v", leading, err)
+	}
+	leading, holder, err = a.Campaign(ctx)
+	if err != nil || leading || holder != "probe-b" {
+		t.Fatalf("expected probe-a to stand by for probe-b, got %t %q, %v", leading, holder, err)
+	}
+
+	// Resigning frees the lease for the next campaign.
+	if err := b.Resign(ctx); err != nil {
+		t.Fatalf("resign failed: %v", err)
+	}
+	if leading, _, err := a.Campaign(ctx); err != nil || !leading {
+		t.Fatalf("expected probe-a to take the released lease, got %t, %v", leading, err)
+	}
+}
+
+// fakeEtcdGateway implements the lease and transaction calls of the etcd
+// v3 JSON gateway used by etcdElector.
+func fakeEtcdGateway(t *testing.T) (*httptest.Server, func(id string)) {
+	var mu sync.Mutex
+	leases := map[string]bool{}
+	var holder, holderLease string
+	nextID := 0
+	expire := func(id string) {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(leases, id)
+		if holderLease == id {
+			holder, holderLease = "", ""
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]json.RawMessage
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		var id string
+		_ = json.Unmarshal(body["ID"], &id)
+		mu.Lock()
+		defer mu.Unlock()
+		switch req.URL.Path {
+		case "/v3/lease/grant":
+			nextID++
+			id = strconv.Itoa(nextID)
+			leases[id] = true
+			fmt.Fprintf(w, `{"ID":%q,"TTL":"15"}`, id)
+		case "/v3/lease/keepalive":
+			ttl := "0"
+			if leases[id] {
+				ttl = "15"
+			}
+			fmt.Fprintf(w, `{"result":{"ID":%q,"TTL":%q}}`, id, ttl)
+		case "/v3/lease/revoke":
+			delete(leases, id)
+			if holderLease == id {
+				holder, holderLease = "", ""
+			}
+			fmt.Fprint(w, `{}`)
+		case "/v3/kv/txn":
+			var txn struct {
+				Success []struct {
+					RequestPut struct {
+						Value string `json:"value"`
+						Lease string `json:"lease"`
+					} `json:"request_put"`
+				} `json:"success"`
+			}
+			raw, _ := json.Marshal(body)
+			_ = json.Unmarshal(raw, &txn)
+			if holder == "" {
+				put := txn.Success[0].RequestPut
+				value, _ := base64.StdEncoding.DecodeString(put.Value)
+				holder, holderLease = string(value), put.Lease
+				fmt.Fprint(w, `{"succeeded":true}`)
+				return
+			}
+			fmt.Fprintf(w, `{"responses":[{"response_range":{"kvs":[{"value":%q,"lease":%q}]}}]}`,
+				base64.StdEncoding.EncodeToString([]byte(holder)), holderLease)
+		default:
+			t.Errorf("unexpected request %s", req.URL.Path)
+			http.NotFound(w, req)
+		}
+	}))
+	return server, expire
+}
+
+func TestEtcdElectorFollowsLease(t *testing.T) {
+	server, expire := fakeEtcdGateway(t)
+	defer server.Close()
+	a := newEtcdElector(server.URL+"/", "dnsres/leader", "probe-a", 15*time.Second)
+	b := newEtcdElector(server.URL, "dnsres/leader", "probe-b", 15*time.Second)
+	ctx := context.Background()
+
+	if leading, _, err := a.Campaign(ctx); err != nil || !leading {
+		t.Fatalf("expected probe-a to lead, got %t, %v", leading, err)
+	}
+	if leading, _, err := a.Campaign(ctx); err != nil || !leading {
+		t.Fatalf("expected probe-a to keep leading on its lease, got %t, %v", leading, err)
+	}
+	leading, holder, err := b.Campaign(ctx)
+	if err != nil || leading || holder != "probe-a" {
+		t.Fatalf("expected probe-b to stand by for probe-a, got %t %q, %v", leading, holder, err)
+	}
+
+	// probe-a's lease expires, taking the key with it.
+	expire(strconv.FormatInt(a.lease, 10))
+	if leading, _, err := b.Campaign(ctx); err != nil || !leading {
+		t.Fatalf("expected probe-b to lead after the lease expired, got %t, %v", leading, err)
+	}
+	leading, holder, err = a.Campaign(ctx)
+	if err != nil || leading || holder != "probe-b" {
+		t.Fatalf("expected probe-a to stand by with a new lease, got %t %q, %v", leading, holder, err)
+	}
+
+	if err := b.Resign(ctx); err != nil {
+		t.Fatalf("resign failed: %v", err)
+	}
+	if leading, _, err := a.Campaign(ctx); err != nil || !leading {
+		t.Fatalf("expected probe-a to lead after probe-b resigned, got %t, %v", leading, err)
+	}
+}
+
+// stubElector returns queued campaign outcomes.
+type stubElector struct {
+	outcomes []error
+	leading  []bool
+}
+
+func (e *stubElector) Campaign(ctx context.Context) (bool, string, error) {
+	leading, err := e.leading[0], e.outcomes[0]
+	e.leading, e.outcomes = e.leading[1:], e.outcomes[1:]
+	if leading {
+		return true, "probe-a", err
+	}
+	return false, "probe-b", err
+}
+
+func (e *stubElector) Resign(ctx context.Context) error {
+	return nil
+}
+
+func TestLeaderElectionGatesIncidentWebhooks(t *testing.T) {
+	elector := &stubElector{
+		leading:  []bool{false, true, false, false},
+		outcomes: []error{nil, nil, fmt.Errorf("backend down"), fmt.Errorf("backend down")},
+	}
+	config := &Config{}
+	config.Incidents.WebhookURL = "http://127.0.0.1/incidents"
+	resolver := &DNSResolver{
+		config:    config,
+		errorLog:  log.New(io.Discard, "", 0),
+		incidents: newIncidentTracker(),
+		leader:    &leaderState{elector: elector, duration: time.Hour, status: LeaderStatus{Backend: LeaderBackendEtcd, Identity: "probe-a"}},
+	}
+	ctx := context.Background()
+
+	resolver.campaign(ctx)
+	if resolver.leading() {
+		t.Fatal("expected to stand by")
+	}
+	if status := resolver.LeaderSnapshot(); status.Leader || status.Holder != "probe-b" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	resolver.notifyIncident("open", Incident{ID: 1})
+
+	resolver.campaign(ctx)
+	if !resolver.leading() {
+		t.Fatal("expected to lead")
+	}
+	resolver.notifyIncident("open", Incident{ID: 2})
+	if queued := len(resolver.incidents.webhooks); queued != 1 {
+		t.Fatalf("expected only the leader's incident webhook queued, got %d", queued)
+	}
+
+	// A failed campaign keeps the leader leading within its lease.
+	resolver.campaign(ctx)
+	if !resolver.leading() || resolver.LeaderSnapshot().LastError != "backend down" {
+		t.Fatalf("expected to keep leading after an error, got %+v", resolver.LeaderSnapshot())
+	}
+	resolver.leader.renewed = time.Now().Add(-2 * time.Hour)
+	resolver.campaign(ctx)
+	if resolver.leading() {
+		t.Fatal("expected to step down once the lease would have expired")
+	}
+	resolver.notifyIncident("close", Incident{ID: 2})
+	if queued := len(resolver.incidents.webhooks); queued != 1 {
+		t.Fatalf("expected no webhook queued after stepping down, got %d", queued-1)
+	}
+}
@@ -0,0 +1,1089 @@
+package dnsres
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dnsres/cache"
+	"dnsres/circuitbreaker"
+	"dnsres/dnsanalysis"
+	"dnsres/internal/grpc"
+	"dnsres/pkg/client"
+
+	"github.com/miekg/dns"
+)
+
+func TestClassifyFingerprint(t *testing.T) {
+	tests := []struct {
+		name    string
+		answers map[string]string
+		rcodes  map[string]string
+		want    string
+	}{
+		{
+			name:    "version string identifies unbound",
+			answers: map[string]string{"version.bind.": "unbound 1.19.0"},
+			rcodes:  map[string]string{"version.bind.": "NOERROR", "version.server.": "NOERROR", "authors.bind.": "REFUSED"},
+			want:    "Unbound",
+		},
+		{
+			name:    "authors.bind implies BIND",
+			answers: map[string]string{"authors.bind.": "Mark Andrews"},
+			rcodes:  map[string]string{"version.bind.": "REFUSED", "version.server.": "REFUSED", "authors.bind.": "NOERROR"},
+			want:    "BIND",
+		},
+		{
+			name:   "refused version is hidden",
+			rcodes: map[string]string{"version.bind.": "REFUSED", "version.server.": "REFUSED", "authors.bind.": "REFUSED"},
+			want:   "hidden",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answers := tt.answers
+			if answers == nil {
+				answers = map[string]string{}
+			}
+			fp := classifyFingerprint(answers, tt.rcodes)
+			if fp.Implementation != tt.want {
+				t.Fatalf("expected %s, got %s (signature %s)", tt.want, fp.Implementation, fp.Signature)
+			}
+			if fp.Signature == "" {
+				t.Fatalf("expected signature to be populated")
+			}
+		})
+	}
+}
+
+func TestRecordFingerprintFlagsChanges(t *testing.T) {
+	server := "192.0.2.53:53"
+	resolver := &DNSResolver{
+		errorLog:     log.New(io.Discard, "", 0),
+		events:       newEventBus(),
+		fingerprints: newFingerprintTracker(),
+	}
+	events, unsubscribe := resolver.SubscribeEvents(4)
+	defer unsubscribe()
+
+	resolver.recordFingerprint(server, Fingerprint{Implementation: "BIND", Signature: "a"})
+	resolver.recordFingerprint(server, Fingerprint{Implementation: "BIND", Signature: "a"})
+	resolver.recordFingerprint(server, Fingerprint{Implementation: "Unbound", Signature: "b"})
+
+	if got := resolver.FingerprintSnapshot()[server]; got.Implementation != "Unbound" || got.Changes != 1 {
+		t.Fatalf("expected one change to Unbound, got %+v", got)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected a single fingerprint change event, got %d", len(events))
+	}
+	if event := <-events; event.Type != EventFingerprintChange || event.Source != "Unbound" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+}
+
+// fingerprintDNSClient answers the CHAOS version probes as BIND would,
+// timing out on the names in drop.
+type fingerprintDNSClient struct {
+	drop map[string]bool
+}
+
+func (c *fingerprintDNSClient) ExchangeContext(ctx context.Context, msg *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	name := msg.Question[0].Name
+	if c.drop[name] {
+		return nil, 0, context.DeadlineExceeded
+	}
+	response := new(dns.Msg)
+	response.SetReply(msg)
+	if name == "version.bind." {
+		response.Answer = append(response.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: []string{"9.18.24"},
+		})
+	} else {
+		response.Rcode = dns.RcodeRefused
+	}
+	return response, 0, nil
+}
+
+func TestFingerprintIgnoresTransientProbeFailures(t *testing.T) {
+	server := "192.0.2.53:53"
+	client := &fingerprintDNSClient{}
+	resolver := &DNSResolver{
+		config: &Config{
+			DNSServers:     []string{server},
+			ServerSettings: map[string]ServerSettings{server: {Fingerprint: true}},
+		},
+		errorLog:     log.New(io.Discard, "", 0),
+		events:       newEventBus(),
+		fingerprints: newFingerprintTracker(),
+		getClient: func(string) (dnsClient, error) {
+			return client, nil
+		},
+		putClient: func(string, dnsClient) {},
+	}
+	events, unsubscribe := resolver.SubscribeEvents(4)
+	defer unsubscribe()
+
+	resolver.fingerprintServers(context.Background())
+	client.drop = map[string]bool{"authors.bind.": true}
+	resolver.fingerprintServers(context.Background())
+	client.drop = nil
+	resolver.fingerprintServers(context.Background())
+
+	if got := resolver.FingerprintSnapshot()[server]; got.Version != "9.18.24" || got.Changes != 0 {
+		t.Fatalf("expected an unchanged fingerprint, got %+v", got)
+	}
+	if len(events) != 0 {
+		t.Fatalf("expected no fingerprint change events, got %d", len(events))
+	}
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	server := "192.0.2.53:53"
+	resolver := &DNSResolver{
+		stats: &ResolutionStats{
+			StartTime: time.Now().Add(-time.Minute),
+			Stats:     map[string]*ServerStats{server: {Total: 3, Failures: 1}},
+		},
+		fingerprints: newFingerprintTracker(),
+	}
+	resolver.fingerprints.record(server, Fingerprint{Implementation: "PowerDNS", Signature: "x"})
+
+	response := httptest.NewRecorder()
+	resolver.apiHandler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", response.Code)
+	}
+
+	var snapshot StatsSnapshot
+	if err := json.NewDecoder(response.Body).Decode(&snapshot); err != nil {
+		t.Fatalf("failed to decode stats: %v", err)
+	}
+	if snapshot.Servers[server].Total != 3 {
+		t.Fatalf("expected server totals in stats, got %+v", snapshot.Servers)
+	}
+	if snapshot.Fingerprints[server].Implementation != "PowerDNS" {
+		t.Fatalf("expected fingerprint in stats, got %+v", snapshot.Fingerprints)
+	}
+}
+
+func TestRecentEventsEndpoint(t *testing.T) {
+	resolver := &DNSResolver{history: newEventHistory(10)}
+	resolver.emitEvent(ResolverEvent{Type: EventResolveSuccess, Hostname: "a.example"})
+	resolver.emitEvent(ResolverEvent{Type: EventResolveFailure, Hostname: "b.example"})
+	resolver.emitEvent(ResolverEvent{Type: EventResolveSuccess, Hostname: "c.example"})
+
+	tests := []struct {
+		name  string
+		query string
+		code  int
+		want  []string
+	}{
+		{name: "all", query: "", code: http.StatusOK, want: []string{"a.example", "b.example", "c.example"}},
+		{name: "limit", query: "?limit=1", code: http.StatusOK, want: []string{"c.example"}},
+		{name: "type", query: "?type=resolve_failure", code: http.StatusOK, want: []string{"b.example"}},
+		{name: "bad limit", query: "?limit=x", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			resolver.apiHandler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/events/recent"+tt.query, nil))
+			if response.Code != tt.code {
+				t.Fatalf("expected %d, got %d", tt.code, response.Code)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			var events []ResolverEvent
+			if err := json.NewDecoder(response.Body).Decode(&events); err != nil {
+				t.Fatalf("failed to decode events: %v", err)
+			}
+			if len(events) != len(tt.want) {
+				t.Fatalf("expected %d events, got %+v", len(tt.want), events)
+			}
+			for i, event := range events {
+				if event.Hostname != tt.want[i] {
+					t.Fatalf("event %d: expected %s, got %s", i, tt.want[i], event.Hostname)
+				}
+			}
+		})
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsres-audit.log")
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatalf("openAuditLog() error = %v", err)
+	}
+	resolver := &DNSResolver{audit: audit}
+	resolver.RecordAudit("tui", "pause", "", "running", "paused")
+	resolver.RecordAudit("api 192.0.2.1:5000", "reload", "config.json", "", "")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 audit lines, got %q", data)
+	}
+	var first AuditEntry
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatalf("failed to decode audit line: %v", err)
+	}
+	if first.Actor != "tui" || first.OldValue != "running" || first.NewValue != "paused" {
+		t.Fatalf("unexpected audit entry %+v", first)
+	}
+
+	response := httptest.NewRecorder()
+	resolver.apiHandler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/audit?limit=1", nil))
+	var entries []AuditEntry
+	if err := json.NewDecoder(response.Body).Decode(&entries); err != nil {
+		t.Fatalf("failed to decode audit entries: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Action != "reload" {
+		t.Fatalf("expected latest audit entry, got %+v", entries)
+	}
+}
+
+func TestGRPCAPI(t *testing.T) {
+	audit, err := openAuditLog(filepath.Join(t.TempDir(), "dnsres-audit.log"))
+	if err != nil {
+		t.Fatalf("openAuditLog() error = %v", err)
+	}
+	config := &Config{Hostnames: []string{"a.example"}}
+	config.Burst.Enabled = true
+	server := "192.0.2.53:53"
+	resolver := &DNSResolver{
+		config: config,
+		stats: &ResolutionStats{
+			StartTime: time.Now().Add(-time.Minute),
+			Stats:     map[string]*ServerStats{server: {Total: 3, Failures: 1}},
+		},
+		history:  newEventHistory(10),
+		events:   newEventBus(),
+		audit:    audit,
+		bursts:   newBurstState(config),
+		logDir:   t.TempDir(),
+		captures: newCaptureState(),
+		triggers: make(chan string, 1),
+	}
+	resolver.emitEvent(ResolverEvent{Type: EventResolveFailure, Hostname: "a.example", Server: server, Error: "timeout"})
+
+	ts := httptest.NewUnstartedServer(resolver.grpcHandler())
+	ts.Config.Protocols = new(http.Protocols)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	defer ts.Close()
+	client := grpc.NewClient(strings.TrimPrefix(ts.URL, "http://"), grpcService, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	out, err := client.Call(ctx, "GetStats", nil)
+	if err != nil {
+		t.Fatalf("GetStats error = %v", err)
+	}
+	stats, err := parseRequest(out)
+	if err != nil || len(stats.bytes[3]) != 1 {
+		t.Fatalf("GetStats servers = %v, %v", stats.bytes[3], err)
+	}
+	entry, _ := parseRequest([]byte(stats.bytes[3][0]))
+	serverStats, _ := parseRequest([]byte(entry.string(2)))
+	if entry.string(1) != server || serverStats.varints[1] != 3 || serverStats.varints[2] != 1 {
+		t.Fatalf("GetStats server entry = %q %v", entry.string(1), serverStats.varints)
+	}
+
+	out, err = client.Call(ctx, "ListEvents", appendString(nil, 2, string(EventResolveFailure)))
+	if err != nil {
+		t.Fatalf("ListEvents error = %v", err)
+	}
+	events, _ := parseRequest(out)
+	if len(events.bytes[1]) != 1 {
+		t.Fatalf("ListEvents returned %d events", len(events.bytes[1]))
+	}
+	event, _ := parseRequest([]byte(events.bytes[1][0]))
+	if event.string(1) != "resolve_failure" || event.string(6) != "timeout" {
+		t.Fatalf("ListEvents event type=%q error=%q", event.string(1), event.string(6))
+	}
+
+	streamed := make(chan string, 1)
+	streamCtx, stopStream := context.WithCancel(ctx)
+	defer stopStream()
+	go client.Stream(streamCtx, "StreamEvents", appendString(nil, 1, string(EventBurstStart)), func(message []byte) error {
+		event, _ := parseRequest(message)
+		streamed <- event.string(3)
+		return nil
+	})
+	for len(resolver.EventSubscriberStats()) == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("StreamEvents never subscribed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := client.Call(ctx, "TriggerBurst", appendString(nil, 1, "b.example")); grpc.CodeOf(err) != grpc.NotFound {
+		t.Fatalf("TriggerBurst(unmonitored) error = %v, want NotFound", err)
+	}
+	out, err = client.Call(ctx, "TriggerBurst", appendString(nil, 1, "a.example"))
+	if err != nil {
+		t.Fatalf("TriggerBurst error = %v", err)
+	}
+	if response, _ := parseRequest(out); len(response.bytes[1]) != 1 {
+		t.Fatal("TriggerBurst response has no until")
+	}
+	select {
+	case hostname := <-streamed:
+		if hostname != "a.example" {
+			t.Fatalf("streamed burst_start for %q", hostname)
+		}
+	case <-ctx.Done():
+		t.Fatal("no burst_start event streamed")
+	}
+
+	entries := resolver.RecentAudit(0)
+	if len(entries) != 1 || entries[0].Action != "burst" || entries[0].Target != "a.example" || !strings.HasPrefix(entries[0].Actor, "grpc ") {
+		t.Fatalf("unexpected audit entries %+v", entries)
+	}
+	if _, err := client.Call(ctx, "ListAudit", appendVarint(nil, 1, uint64(1<<64-1))); grpc.CodeOf(err) != grpc.InvalidArgument {
+		t.Fatalf("ListAudit(limit -1) error = %v, want InvalidArgument", err)
+	}
+
+	if _, err := client.Call(ctx, "CaptureQueries", appendString(nil, 1, "b.example")); grpc.CodeOf(err) != grpc.NotFound {
+		t.Fatalf("CaptureQueries(unmonitored) error = %v, want NotFound", err)
+	}
+	out, err = client.Call(ctx, "CaptureQueries", appendInt(appendString(nil, 1, "a.example"), 2, 3))
+	if err != nil {
+		t.Fatalf("CaptureQueries error = %v", err)
+	}
+	if response, _ := parseRequest(out); response.string(1) != resolver.captureDir() || resolver.PendingCaptures()["a.example"] != 3 {
+		t.Fatalf("CaptureQueries dir = %q, pending %v", response.string(1), resolver.PendingCaptures())
+	}
+	if entries := resolver.RecentAudit(0); entries[len(entries)-1].Action != "capture" || entries[len(entries)-1].NewValue != "3" {
+		t.Fatalf("unexpected audit entries %+v", entries)
+	}
+
+	config.QueryInterval.Duration = time.Minute
+	resolver.scheduleNextCycle(time.Now())
+	out, err = client.Call(ctx, "TriggerCycle", nil)
+	if err != nil {
+		t.Fatalf("TriggerCycle error = %v", err)
+	}
+	if response, _ := parseRequest(out); len(response.bytes[1]) != 1 || len(resolver.triggers) != 1 {
+		t.Fatal("TriggerCycle did not queue a cycle or return the next one")
+	}
+	if _, err := client.Call(ctx, "TriggerCycle", nil); grpc.CodeOf(err) != grpc.FailedPrecondition {
+		t.Fatalf("TriggerCycle(pending) error = %v, want FailedPrecondition", err)
+	}
+	if entries := resolver.RecentAudit(0); entries[len(entries)-1].Action != "trigger_cycle" || !strings.HasPrefix(entries[len(entries)-1].Actor, "grpc ") {
+		t.Fatalf("unexpected audit entries %+v", entries)
+	}
+}
+
+func TestOpenAPIDocumentMatchesAPI(t *testing.T) {
+	server := "192.0.2.53:53"
+	audit, err := openAuditLog(filepath.Join(t.TempDir(), "dnsres-audit.log"))
+	if err != nil {
+		t.Fatalf("openAuditLog() error = %v", err)
+	}
+	resolver := &DNSResolver{
+		config:   &Config{},
+		errorLog: log.New(io.Discard, "", 0),
+		stats: &ResolutionStats{
+			StartTime: time.Now().Add(-time.Minute),
+			Stats:     map[string]*ServerStats{server: {Total: 3, Failures: 1, LastError: "timeout"}},
+		},
+		history:   newEventHistory(10),
+		audit:     audit,
+		incidents: newIncidentTracker(),
+		nodes:     newNodeTracker(),
+		hostnames: newHostnameTracker(),
+	}
+	resolver.recordNode(server, "fra1", "nsid")
+	resolver.trackIncident("a.example", time.Now(), map[string]string{server: "timeout"}, 0, true)
+	resolver.rollupHostname("a.example", []*dnsanalysis.DNSResponse{{Server: server, Addresses: []string{"192.0.2.7"}}}, nil, true)
+	consistent := false
+	resolver.emitEvent(ResolverEvent{Type: EventInconsistent, Hostname: "a.example", Consistent: &consistent, Duration: time.Second})
+	resolver.RecordAudit("tui", "pause", "", "running", "paused")
+
+	ts := httptest.NewServer(resolver.apiHandler())
+	defer ts.Close()
+	c := client.New(ts.URL)
+	ctx := context.Background()
+
+	raw, err := c.GetOpenAPI(ctx)
+	if err != nil {
+		t.Fatalf("GetOpenAPI() error = %v", err)
+	}
+	var document struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			OperationID string `json:"operationId"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(raw, &document); err != nil || document.OpenAPI == "" {
+		t.Fatalf("invalid OpenAPI document: %v", err)
+	}
+	clientType := reflect.TypeOf(c)
+	for path, operations := range document.Paths {
+		operation, ok := operations["get"]
+		if !ok {
+			t.Errorf("%s: no get operation", path)
+			continue
+		}
+		name := strings.ToUpper(operation.OperationID[:1]) + operation.OperationID[1:]
+		if _, ok := clientType.MethodByName(name); !ok {
+			t.Errorf("%s: client has no %s method", path, name)
+		}
+		// The health endpoints need a health checker; the rest must exist.
+		if path == "/" || strings.HasSuffix(path, "z") {
+			continue
+		}
+		resp, err := http.Get(ts.URL + strings.ReplaceAll(path, "{hostname}", "a.example"))
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s = %d, want 200", path, resp.StatusCode)
+		}
+	}
+
+	stats, err := c.GetStats(ctx)
+	if err != nil {
+		t.Fatalf("GetStats() error = %v", err)
+	}
+	if got := stats.Servers[server]; got.Total != 3 || got.Failures != 1 || got.LastError != "timeout" {
+		t.Errorf("GetStats() servers = %+v", stats.Servers)
+	}
+	if stats.Nodes[server].Node != "fra1" {
+		t.Errorf("GetStats() nodes = %+v", stats.Nodes)
+	}
+	events, err := c.ListRecentEvents(ctx, client.ListRecentEventsParams{Type: client.EventType(EventInconsistent)})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("ListRecentEvents() = %+v, %v", events, err)
+	}
+	if events[0].Hostname != "a.example" || events[0].Consistent == nil || *events[0].Consistent || events[0].Duration() != time.Second || events[0].SchemaVersion != EventSchemaVersion {
+		t.Errorf("ListRecentEvents() event = %+v", events[0])
+	}
+	entries, err := c.ListAudit(ctx, 1)
+	if err != nil || len(entries) != 1 || entries[0].NewValue != "paused" {
+		t.Errorf("ListAudit() = %+v, %v", entries, err)
+	}
+	incidents, err := c.ListIncidents(ctx, client.ListIncidentsParams{Open: true})
+	if err != nil || len(incidents) != 1 || incidents[0].Hostname != "a.example" || incidents[0].Causes[0] != IncidentCauseFailure {
+		t.Errorf("ListIncidents() = %+v, %v", incidents, err)
+	}
+	rollup, err := c.GetHostnameRollup(ctx, "A.example.")
+	if err != nil || rollup.Verdict != VerdictConsistent || len(rollup.Servers) != 1 || rollup.Servers[0].Addresses[0] != "192.0.2.7" {
+		t.Errorf("GetHostnameRollup() = %+v, %v", rollup, err)
+	}
+	var apiErr *client.Error
+	if _, err := c.GetHostnameRollup(ctx, "b.example"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("GetHostnameRollup() for an unknown hostname error = %v", err)
+	}
+}
+
+func TestServiceDiscoveryTargets(t *testing.T) {
+	config := &Config{
+		Hostnames:  []string{"a.example"},
+		DNSServers: []string{"192.0.2.1:53", "192.0.2.2:53"},
+		Schedules:  map[string]string{"a.example": "@hourly"},
+		ServerSettings: map[string]ServerSettings{
+			"192.0.2.2:53": {Role: ServerRoleFallback},
+		},
+	}
+	resolver := &DNSResolver{
+		config: config,
+		discovery: &discoveryState{
+			hostnames: []string{"svc.example"},
+			labels:    map[string]map[string]string{"svc.example": {"k8s.namespace": "prod"}},
+		},
+		nodes: newNodeTracker(),
+	}
+	resolver.recordNode("192.0.2.1:53", "fra1", "nsid")
+
+	response := httptest.NewRecorder()
+	resolver.apiHandler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/sd/hostnames", nil))
+	var hostnames []TargetGroup
+	if err := json.NewDecoder(response.Body).Decode(&hostnames); err != nil {
+		t.Fatalf("failed to decode hostname targets: %v", err)
+	}
+	if len(hostnames) != 2 {
+		t.Fatalf("expected 2 hostname target groups, got %+v", hostnames)
+	}
+	if got := hostnames[0].Labels; hostnames[0].Targets[0] != "a.example" || got["__meta_dnsres_source"] != "config" || got["__meta_dnsres_schedule"] != "@hourly" {
+		t.Fatalf("unexpected configured hostname group %+v", hostnames[0])
+	}
+	if got := hostnames[1].Labels; got["__meta_dnsres_source"] != "discovery" || got["__meta_dnsres_label_k8s_namespace"] != "prod" {
+		t.Fatalf("unexpected discovered hostname group %+v", hostnames[1])
+	}
+
+	response = httptest.NewRecorder()
+	resolver.apiHandler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/sd/servers", nil))
+	var servers []TargetGroup
+	if err := json.NewDecoder(response.Body).Decode(&servers); err != nil {
+		t.Fatalf("failed to decode server targets: %v", err)
+	}
+	if len(servers) != 2 {
+		t.Fatalf("expected 2 server target groups, got %+v", servers)
+	}
+	if got := servers[0].Labels; got["__meta_dnsres_role"] != ServerRolePrimary || got["__meta_dnsres_node"] != "fra1" {
+		t.Fatalf("unexpected primary server group %+v", servers[0])
+	}
+	if got := servers[1].Labels; got["__meta_dnsres_role"] != ServerRoleFallback || got["__meta_dnsres_node"] != "" {
+		t.Fatalf("unexpected fallback server group %+v", servers[1])
+	}
+}
+
+type dns64DNSClient struct {
+	aaaa []string
+}
+
+func (c *dns64DNSClient) ExchangeContext(ctx context.Context, msg *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	response := new(dns.Msg)
+	response.SetReply(msg)
+	question := msg.Question[0]
+	switch question.Qtype {
+	case dns.TypeA:
+		response.Answer = append(response.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.10"),
+		})
+	case dns.TypeAAAA:
+		for _, addr := range c.aaaa {
+			response.Answer = append(response.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: question.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+				AAAA: net.ParseIP(addr),
+			})
+		}
+	}
+	return response, 0, nil
+}
+
+func TestDNS64SynthesisExcludedFromConsistency(t *testing.T) {
+	plain := "192.0.2.1:53"
+	nat64 := "192.0.2.2:53"
+	clients := map[string]dnsClient{
+		plain: &dns64DNSClient{aaaa: []string{"2001:db8::10"}},
+		nat64: &dns64DNSClient{aaaa: []string{"2001:db8::10", "64:ff9b::c000:20a"}},
+	}
+
+	config := &Config{DNSServers: []string{plain, nat64}}
+	config.DNS64.Enabled = true
+	resolver := &DNSResolver{
+		config: config,
+		breakers: map[string]*circuitbreaker.CircuitBreaker{
+			plain: circuitbreaker.NewCircuitBreaker(2, time.Minute, plain),
+			nat64: circuitbreaker.NewCircuitBreaker(2, time.Minute, nat64),
+		},
+		cache: cache.NewShardedCache(1024, 1),
+		stats: &ResolutionStats{Stats: map[string]*ServerStats{plain: {}, nat64: {}}},
+		dns64: newDNS64Tracker(),
+		getClient: func(server string) (dnsClient, error) {
+			return clients[server], nil
+		},
+		putClient: func(string, dnsClient) {},
+	}
+
+	var responses []*dnsanalysis.DNSResponse
+	for _, server := range []string{plain, nat64} {
+		resolver.cache.Clear()
+		response, err := resolver.resolveWithServer(context.Background(), server, "dual.example.com")
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %v", server, err)
+		}
+		responses = append(responses, response)
+	}
+
+	if responses[0].DNS64 {
+		t.Fatalf("expected plain server response not labeled DNS64")
+	}
+	if !responses[1].DNS64 || len(responses[1].Synthesized) != 1 {
+		t.Fatalf("expected synthesized AAAA labeled, got %+v", responses[1])
+	}
+	if !dnsanalysis.CompareResponses(responses) {
+		t.Fatalf("expected DNS64 synthesis not to break consistency: %v vs %v", responses[0].Addresses, responses[1].Addresses)
+	}
+}
+
+func TestIsSynthesized(t *testing.T) {
+	discovered := net.ParseIP("2001:db8:64::")
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"64:ff9b::c000:20a", true},
+		{"2001:db8:64::c000:20a", true},
+		{"2001:db8::10", false},
+		{"192.0.2.10", false},
+	}
+	for _, tt := range tests {
+		if got := isSynthesized(net.ParseIP(tt.addr), discovered); got != tt.want {
+			t.Fatalf("isSynthesized(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// fakeMDNSQuerier answers multicast queries with fixed A records.
+type fakeMDNSQuerier struct {
+	addresses map[string][]string
+}
+
+func (q *fakeMDNSQuerier) Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	name := msg.Question[0].Name
+	addresses, ok := q.addresses[name]
+	if !ok {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	response := new(dns.Msg)
+	response.SetReply(msg)
+	for _, address := range addresses {
+		response.Answer = append(response.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120},
+			A:   net.ParseIP(address),
+		})
+	}
+	return response, nil
+}
+
+func TestProbeMDNSComparesWithUnicast(t *testing.T) {
+	config := &Config{Hostnames: []string{"printer.example.com"}, DNSServers: []string{"192.0.2.1:53"}}
+	config.MDNS.Enabled = true
+	config.MDNS.Hostnames = []string{"printer.local", "missing.local"}
+	config.MDNS.Timeout = Duration{20 * time.Millisecond}
+	config.MDNS.Compare = map[string]string{"printer.local": "printer.example.com"}
+
+	resolver := &DNSResolver{
+		config:      config,
+		cache:       cache.NewShardedCache(1024, 1),
+		successLog:  log.New(io.Discard, "", 0),
+		errorLog:    log.New(io.Discard, "", 0),
+		history:     newEventHistory(10),
+		mdns:        newMDNSTracker(),
+		mdnsQuerier: &fakeMDNSQuerier{addresses: map[string][]string{"printer.local.": {"192.168.1.20"}}},
+	}
+	resolver.cache.Set(cacheKey("192.0.2.1:53", "printer.example.com"), &dnsanalysis.DNSResponse{
+		Server:    "192.0.2.1:53",
+		Hostname:  "printer.example.com",
+		Addresses: []string{"192.168.1.21"},
+	}, time.Minute)
+
+	resolver.probeMDNS(context.Background())
+
+	snapshot := resolver.MDNSSnapshot()
+	if got := snapshot["printer.local"].Addresses; len(got) != 1 || got[0] != "192.168.1.20" {
+		t.Fatalf("expected mdns answer recorded, got %+v", snapshot["printer.local"])
+	}
+	if snapshot["missing.local"].Error == "" {
+		t.Fatalf("expected timeout recorded for missing.local, got %+v", snapshot["missing.local"])
+	}
+	inconsistent := resolver.RecentEvents(0, EventInconsistent)
+	if len(inconsistent) != 1 || !strings.Contains(inconsistent[0].Detail, "192.168.1.21") {
+		t.Fatalf("expected mdns/unicast inconsistency event, got %+v", inconsistent)
+	}
+}
+
+func TestValidateMDNS(t *testing.T) {
+	config := DefaultConfig()
+	config.Hostnames = []string{"example.com"}
+	config.MDNS.Hostnames = []string{"printer.example.com"}
+	if err := config.Validate(); err == nil {
+		t.Fatal("expected non-.local mdns hostname to be rejected")
+	}
+	config.MDNS.Hostnames = []string{"printer.local"}
+	config.MDNS.Compare = map[string]string{"printer.local": "other.example.com"}
+	if err := config.Validate(); err == nil {
+		t.Fatal("expected compare against unmonitored hostname to be rejected")
+	}
+	config.MDNS.Compare = map[string]string{"printer.local": "example.com"}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected valid mdns config, got %v", err)
+	}
+}
+
+func TestCRTShDiscoverer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if got := req.URL.Query().Get("q"); got != "%.example.com" {
+			t.Errorf("unexpected query %q", got)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`[
+			{"name_value": "www.example.com\n*.example.com"},
+			{"name_value": "API.example.com."},
+			{"name_value": "www.example.com"},
+			{"name_value": "example.org"}
+		]`))
+	}))
+	defer server.Close()
+
+	discoverer, err := newCRTShDiscoverer(DiscoverySource{Type: "crtsh", Zone: "Example.com.", URL: server.URL})
+	if err != nil {
+		t.Fatalf("newCRTShDiscoverer failed: %v", err)
+	}
+	names, err := discoverer.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	if got := strings.Join(names, ","); got != "api.example.com,www.example.com" {
+		t.Fatalf("unexpected discovered names %q", got)
+	}
+}
+
+// staticDiscoverer returns fixed hostnames, or err when set.
+type staticDiscoverer struct {
+	name  string
+	names []string
+	err   error
+}
+
+func (d *staticDiscoverer) Name() string { return d.name }
+
+func (d *staticDiscoverer) Discover(context.Context) ([]string, error) {
+	return d.names, d.err
+}
+
+func TestRefreshDiscoveryMergesSources(t *testing.T) {
+	config := &Config{Hostnames: []string{"www.example.com"}}
+	config.Discovery.MaxHostnames = 2
+	first := &staticDiscoverer{name: "first", names: []string{"www.example.com", "a.example.com"}}
+	second := &staticDiscoverer{name: "second", names: []string{"b.example.com", "c.example.com"}}
+	resolver := &DNSResolver{
+		config:   config,
+		errorLog: log.New(io.Discard, "", 0),
+		discovery: &discoveryState{
+			discoverers: []Discoverer{first, second},
+			bySource:    make(map[string][]string),
+		},
+	}
+
+	resolver.refreshDiscovery(context.Background())
+	if got := strings.Join(resolver.monitoredHostnames(), ","); got != "www.example.com,a.example.com,b.example.com" {
+		t.Fatalf("unexpected monitored hostnames %q", got)
+	}
+
+	second.err = errors.New("unavailable")
+	first.names = nil
+	resolver.refreshDiscovery(context.Background())
+	if got := strings.Join(resolver.DiscoveredHostnames(), ","); got != "b.example.com,c.example.com" {
+		t.Fatalf("expected failing source to keep previous names, got %q", got)
+	}
+}
+
+func TestKubernetesDiscoverer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if got := req.Header.Get("Authorization"); got != "Bearer test-token" {
+			t.Errorf("unexpected authorization header %q", got)
+		}
+		if got := req.URL.Query().Get("labelSelector"); got != "team=edge" {
+			t.Errorf("unexpected label selector %q", got)
+		}
+		switch req.URL.Path {
+		case "/apis/networking.k8s.io/v1/namespaces/web/ingresses":
+			_, _ = w.Write([]byte(`{"items": [{
+				"metadata": {"name": "shop", "namespace": "web", "labels": {"app": "shop"}},
+				"spec": {"rules": [{"host": "shop.example.com"}, {"host": "*.example.com"}], "tls": [{"hosts": ["shop.example.com"]}]}
+			}]}`))
+		case "/api/v1/namespaces/web/services":
+			_, _ = w.Write([]byte(`{"items": [
+				{"metadata": {"name": "db", "namespace": "web"}, "spec": {"type": "ExternalName", "externalName": "db.example.net"}},
+				{"metadata": {"name": "api", "namespace": "web"}, "spec": {"type": "ClusterIP"}}
+			]}`))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+
+	kubeconfigPath := filepath.Join(t.TempDir(), "kubeconfig.json")
+	kubeconfig := `{
+  "current-context": "lab",
+  "contexts": [{"name": "lab", "context": {"cluster": "lab", "user": "probe", "namespace": "web"}}],
+  "clusters": [{"name": "lab", "cluster": {"server": "` + server.URL + `"}}],
+  "users": [{"name": "probe", "user": {"token": "test-token"}}]
+}`
+	if err := os.WriteFile(kubeconfigPath, []byte(kubeconfig), 0600); err != nil {
+		t.Fatalf("failed to write kubeconfig: %v", err)
+	}
+
+	discoverer, err := newKubernetesDiscoverer(DiscoverySource{
+		Type:          "kubernetes",
+		Kubeconfig:    kubeconfigPath,
+		LabelSelector: "team=edge",
+	})
+	if err != nil {
+		t.Fatalf("newKubernetesDiscoverer failed: %v", err)
+	}
+	names, err := discoverer.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	if got := strings.Join(names, ","); got != "db.example.net,shop.example.com" {
+		t.Fatalf("unexpected discovered names %q", got)
+	}
+
+	labels := discoverer.(LabelingDiscoverer).Labels()
+	if shop := labels["shop.example.com"]; shop["k8s_kind"] != "Ingress" || shop["k8s_namespace"] != "web" || shop["k8s_label_app"] != "shop" {
+		t.Fatalf("unexpected ingress labels %v", shop)
+	}
+
+	resolver := &DNSResolver{
+		config:    &Config{},
+		errorLog:  log.New(io.Discard, "", 0),
+		history:   newEventHistory(10),
+		discovery: &discoveryState{discoverers: []Discoverer{discoverer}, bySource: make(map[string][]string)},
+	}
+	resolver.refreshDiscovery(context.Background())
+	resolver.emitEvent(ResolverEvent{Type: EventResolveSuccess, Hostname: "db.example.net"})
+	if events := resolver.RecentEvents(1, ""); len(events) != 1 || events[0].Labels["k8s_name"] != "db" {
+		t.Fatalf("expected event labeled with k8s metadata, got %+v", events)
+	}
+}
+
+// interceptingDNSClient answers probeHost with probeAddr and every other
+// name with redirect, or NXDOMAIN when redirect is empty.
+type interceptingDNSClient struct {
+	probeHost string
+	probeAddr string
+	redirect  string
+}
+
+func (c *interceptingDNSClient) ExchangeContext(ctx context.Context, msg *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	response := new(dns.Msg)
+	response.SetReply(msg)
+	question := msg.Question[0]
+	addr := c.redirect
+	if question.Name == dns.Fqdn(c.probeHost) {
+		addr = c.probeAddr
+	}
+	if addr == "" {
+		response.Rcode = dns.RcodeNameError
+		return response, 0, nil
+	}
+	response.Answer = append(response.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP(addr),
+	})
+	return response, 0, nil
+}
+
+func TestProbeInterceptionDetectsRedirectionAndPortal(t *testing.T) {
+	var portal atomic.Bool
+	probeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Host, "probe.test:") {
+			t.Errorf("expected probe Host header, got %q", r.Host)
+		}
+		if portal.Load() {
+			http.Redirect(w, r, "http://login.portal.test/", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer probeServer.Close()
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(probeServer.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := captivePortalProbes
+	captivePortalProbes = []captivePortalProbe{{url: "http://probe.test:" + port + "/generate_204", status: http.StatusNoContent}}
+	defer func() { captivePortalProbes = saved }()
+
+	honest := "192.0.2.1:53"
+	hijacked := "192.0.2.2:53"
+	clients := map[string]dnsClient{
+		honest:   &interceptingDNSClient{probeHost: "probe.test", probeAddr: "127.0.0.1"},
+		hijacked: &interceptingDNSClient{probeHost: "probe.test", probeAddr: "127.0.0.1", redirect: "198.51.100.80"},
+	}
+	config := &Config{DNSServers: []string{honest, hijacked}, QueryTimeout: Duration{Duration: 2 * time.Second}}
+	config.ServerSettings = map[string]ServerSettings{
+		honest:   {InterceptionProbe: true},
+		hijacked: {InterceptionProbe: true},
+	}
+	resolver := &DNSResolver{
+		config:        config,
+		errorLog:      log.New(io.Discard, "", 0),
+		history:       newEventHistory(10),
+		interceptions: newInterceptionTracker(),
+		getClient: func(server string) (dnsClient, error) {
+			return clients[server], nil
+		},
+		putClient: func(string, dnsClient) {},
+	}
+
+	resolver.detectInterception(context.Background())
+	if got := resolver.InterceptionSnapshot()[honest]; got.NXDOMAINRedirect || got.CaptivePortal {
+		t.Fatalf("expected no interception for honest server, got %+v", got)
+	}
+	got := resolver.InterceptionSnapshot()[hijacked]
+	if !got.NXDOMAINRedirect || len(got.RedirectAddrs) != len(nxdomainProbeZones) || got.CaptivePortal {
+		t.Fatalf("expected NXDOMAIN redirection only, got %+v", got)
+	}
+
+	portal.Store(true)
+	resolver.detectInterception(context.Background())
+	got = resolver.InterceptionSnapshot()[hijacked]
+	if !got.CaptivePortal || !strings.Contains(got.PortalDetail, "login.portal.test") {
+		t.Fatalf("expected captive portal redirect, got %+v", got)
+	}
+
+	events := resolver.RecentEvents(0, EventInterception)
+	kinds := make(map[string]int)
+	for _, event := range events {
+		kinds[event.Source]++
+	}
+	// Each server saw the portal; redirection was reported once, on first detection.
+	if kinds[InterceptionNXDOMAIN] != 1 || kinds[InterceptionCaptive] != 2 {
+		t.Fatalf("unexpected interception events %+v", events)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open listener: %v", err)
+	}
+	server := conn.LocalAddr().String()
+	dnsServer := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetRcode(req, dns.RcodeNameError)
+		_ = w.WriteMsg(reply)
+	})}
+	go func() { _ = dnsServer.ActivateAndServe() }()
+	defer dnsServer.Shutdown()
+
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open listener: %v", err)
+	}
+	defer silent.Close()
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to open listener: %v", err)
+	}
+	defer busy.Close()
+
+	config := &Config{
+		Hostnames:    []string{"example.com"},
+		DNSServers:   []string{server, silent.LocalAddr().String()},
+		QueryTimeout: Duration{200 * time.Millisecond},
+		HealthPort:   busy.Addr().(*net.TCPAddr).Port,
+	}
+	results := Preflight(context.Background(), config)
+	if len(results) != 3 {
+		t.Fatalf("expected two server checks and one port check, got %+v", results)
+	}
+	if !results[0].Passed() || !strings.HasPrefix(results[0].Detail, "NXDOMAIN example.com.") {
+		t.Fatalf("expected answering server to pass, got %+v", results[0])
+	}
+	if results[1].Passed() {
+		t.Fatalf("expected silent server to time out, got %+v", results[1])
+	}
+	if results[2].Passed() || !strings.HasPrefix(results[2].Name, "port health") {
+		t.Fatalf("expected bound health port to fail, got %+v", results[2])
+	}
+}
+
+func TestAuditRandomization(t *testing.T) {
+	config := &Config{DNSServers: []string{"127.0.0.1:53"}}
+	resolver := &DNSResolver{config: config, errorLog: log.New(io.Discard, "", 0)}
+	if resolver.RandomizationSnapshot() != nil {
+		t.Fatal("expected no audit before it runs")
+	}
+
+	resolver.auditRandomization(context.Background())
+	audit := resolver.RandomizationSnapshot()
+	if audit.IDSource != IDSourceCrypto || audit.IDEntropyBits < minIDEntropyBits {
+		t.Fatalf("expected crypto IDs to pass, got %+v", audit)
+	}
+	if audit.SourcePorts != "ephemeral" || audit.PortsSampled != auditPortSamples || audit.PortsDistinct != auditPortSamples {
+		t.Fatalf("expected every sampled ephemeral port to differ, got %+v", audit)
+	}
+
+	// A narrow pinned range and reused sockets are both reported.
+	config.Querying.SourcePorts = "50100-50355"
+	config.Querying.ReuseSockets = true
+	resolver.auditRandomization(context.Background())
+	audit = resolver.RandomizationSnapshot()
+	if audit.SourcePorts != "50100-50355" || audit.Effective || len(audit.Warnings) != 2 {
+		t.Fatalf("expected a narrow range and socket reuse to be flagged, got %+v", audit)
+	}
+
+	if bits := collisionBits([]int{7, 7, 7, 7}, 16); bits != 0 {
+		t.Fatalf("expected a constant ID to measure 0 bits, got %v", bits)
+	}
+	if bits := spreadBits([]int{40000, 40001, 40002, 40003, 40004}); bits > 2 {
+		t.Fatalf("expected sequential ports to measure under 2 bits, got %v", bits)
+	}
+}
+
+func TestIDSourceLeavesDNSPackageAlone(t *testing.T) {
+	defaultID := dns.Id
+	defer func() { dns.Id = defaultID }()
+	dns.Id = func() uint16 { return 7 }
+
+	config := DefaultConfig()
+	config.Hostnames = []string{"example.com"}
+	config.DNSServers = []string{"192.0.2.1:53"}
+	config.LogDir = t.TempDir()
+	config.Querying.IDSource = IDSourceMath
+	resolver, err := NewDNSResolver(config)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	if dns.Id() != 7 {
+		t.Fatal("expected dns.Id left as it was")
+	}
+	ids := make(map[uint16]bool)
+	for range 64 {
+		ids[resolver.queryID()] = true
+	}
+	if len(ids) < 32 {
+		t.Fatalf("expected the resolver to draw its own IDs, got %d distinct", len(ids))
+	}
+
+	// id_source is fixed at startup, so a reload keeps the one in use.
+	reloaded := DefaultConfig()
+	reloaded.Hostnames = config.Hostnames
+	reloaded.DNSServers = config.DNSServers
+	resolver.applyConfig(reloaded, "test")
+	if got := resolver.currentConfig().IDSource(); got != IDSourceMath {
+		t.Fatalf("expected a reload to keep the math id source, got %q", got)
+	}
+}
+
+func TestValidateSourcePorts(t *testing.T) {
+	for value, valid := range map[string]bool{
+		"":            true,
+		"40000-40999": true,
+		"40000":       false,
+		"40999-40000": false,
+		"0-100":       false,
+		"60000-70000": false,
+	} {
+		config := &Config{}
+		config.Querying.SourcePorts = value
+		if err := validateSourcePorts(config); (err == nil) != valid {
+			t.Errorf("source_ports %q: got error %v, want valid %t", value, err, valid)
+		}
+	}
+	config := &Config{}
+	config.Querying.IDSource = "sequential"
+	if err := validateIDSource(config); err == nil {
+		t.Fatal("expected an unknown id source to be rejected")
+	}
+}
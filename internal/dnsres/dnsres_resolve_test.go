@@ -2,13 +2,22 @@ package dnsres
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"dnsres/cache"
 	"dnsres/circuitbreaker"
+	"dnsres/dnsanalysis"
+	"dnsres/instrumentation"
 	"dnsres/metrics"
 
 	"github.com/miekg/dns"
@@ -89,11 +98,108 @@ func TestResolveWithServerQueryError(t *testing.T) {
 	}
 }
 
+func TestResolveWithServerBreakerChangeEvents(t *testing.T) {
+	server := "8.8.8.8:53"
+	fake := &fakeDNSClient{err: errors.New("i/o timeout")}
+	var errorLog strings.Builder
+	resolver := &DNSResolver{
+		config:   &Config{},
+		cache:    cache.NewShardedCache(1024, 1),
+		stats:    &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+		errorLog: log.New(&errorLog, "", 0),
+		appLog:   log.New(io.Discard, "", 0),
+		events:   newEventBus(),
+		history:  newEventHistory(0),
+		getClient: func(string) (dnsClient, error) {
+			return fake, nil
+		},
+		putClient: func(string, dnsClient) {},
+	}
+	resolver.breakers = map[string]*circuitbreaker.CircuitBreaker{
+		server: resolver.watchBreaker(circuitbreaker.NewCircuitBreaker(1, time.Millisecond, server)),
+	}
+
+	if _, err := resolver.resolveWithServer(context.Background(), server, "example.com"); err == nil {
+		t.Fatal("expected query error")
+	}
+	time.Sleep(2 * time.Millisecond)
+	fake.response, fake.err = new(dns.Msg).SetQuestion(dns.Fqdn("example.com"), dns.TypeA), nil
+	if _, err := resolver.resolveWithServer(context.Background(), server, "example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	changes := resolver.RecentEvents(0, EventBreakerChange)
+	var states []string
+	for _, change := range changes {
+		if change.Server != server {
+			t.Fatalf("expected changes of %s, got %+v", server, change)
+		}
+		states = append(states, change.Source)
+	}
+	if strings.Join(states, ",") != "open,half-open,closed" {
+		t.Fatalf("expected open, half-open and closed changes, got %v", states)
+	}
+	opened := changes[0]
+	if opened.Detail != "closed -> open, 1 consecutive failures" || !strings.Contains(opened.Error, "i/o timeout") {
+		t.Fatalf("expected the opening to carry its failure, got %+v", opened)
+	}
+	if !strings.Contains(errorLog.String(), "Circuit breaker for 8.8.8.8:53 opened after 1 consecutive failures") {
+		t.Fatalf("expected the opening in the error log, got %q", errorLog.String())
+	}
+}
+
+func TestResolveWithServerWarmUpSparesBreaker(t *testing.T) {
+	server := "8.8.8.8:53"
+	fake := &fakeDNSClient{err: errors.New("network is unreachable")}
+	resolver := &DNSResolver{
+		config: &Config{},
+		breakers: map[string]*circuitbreaker.CircuitBreaker{
+			server: circuitbreaker.NewCircuitBreaker(1, time.Minute, server),
+		},
+		cache:     cache.NewShardedCache(1024, 1),
+		stats:     &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+		incidents: newIncidentTracker(),
+		warmUntil: time.Now().Add(time.Minute),
+		getClient: func(string) (dnsClient, error) {
+			return fake, nil
+		},
+		putClient: func(string, dnsClient) {},
+	}
+
+	before := testutil.ToFloat64(metrics.DNSResolutionFailure.WithLabelValues(server, "example.com", "query_error"))
+	if _, err := resolver.resolveWithServer(context.Background(), server, "example.com"); err == nil {
+		t.Fatal("expected query error")
+	}
+	if state := resolver.breakers[server].GetState(); state != "closed" {
+		t.Fatalf("expected the breaker to stay closed during warm-up, got %s", state)
+	}
+	if resolver.stats.Stats[server].Failures != 1 {
+		t.Fatalf("expected the failure still counted, got %d", resolver.stats.Stats[server].Failures)
+	}
+	if got := testutil.ToFloat64(metrics.DNSResolutionFailure.WithLabelValues(server, "example.com", "query_error")) - before; got != 1 {
+		t.Fatalf("expected the failure metric incremented, got %v", got)
+	}
+	resolver.trackIncident("example.com", time.Now(), map[string]string{server: "network is unreachable"}, 0, true)
+	if incidents := resolver.Incidents(0, false); len(incidents) != 0 {
+		t.Fatalf("expected no incident during warm-up, got %+v", incidents)
+	}
+
+	resolver.warmUntil = time.Time{}
+	if _, err := resolver.resolveWithServer(context.Background(), server, "example.com"); err == nil {
+		t.Fatal("expected query error")
+	}
+	if state := resolver.breakers[server].GetState(); state != "open" {
+		t.Fatalf("expected the breaker to open after warm-up, got %s", state)
+	}
+}
+
 func TestResolveWithServerRcodeError(t *testing.T) {
 	server := "8.8.8.8:53"
 	response := new(dns.Msg)
 	response.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
 	response.Rcode = dns.RcodeNameError
+	soa, _ := dns.NewRR("example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 2024010101 7200 900 1209600 300")
+	response.Ns = append(response.Ns, soa)
 
 	fake := &fakeDNSClient{response: response}
 	resolver := &DNSResolver{
@@ -109,14 +215,47 @@ func TestResolveWithServerRcodeError(t *testing.T) {
 	}
 
 	_, err := resolver.resolveWithServer(context.Background(), server, "example.com")
-	if err == nil || !strings.Contains(err.Error(), "NXDOMAIN") {
-		t.Fatalf("expected NXDOMAIN error, got %v", err)
+	if err == nil || !strings.Contains(err.Error(), "NXDOMAIN (soa example.com serial 2024010101)") {
+		t.Fatalf("expected NXDOMAIN error naming the zone, got %v", err)
 	}
 	if resolver.stats.Stats[server].Failures != 1 {
 		t.Fatalf("expected failures incremented, got %d", resolver.stats.Stats[server].Failures)
 	}
 }
 
+func TestResolveWithServerCachesNoDataForNegativeTTL(t *testing.T) {
+	server := "8.8.8.8:53"
+	response := new(dns.Msg)
+	response.SetQuestion(dns.Fqdn("nodata.example.com"), dns.TypeA)
+	soa, _ := dns.NewRR("example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 2024010101 7200 900 1209600 300")
+	response.Ns = append(response.Ns, soa)
+
+	fake := &fakeDNSClient{response: response}
+	resolver := &DNSResolver{
+		config: &Config{},
+		breakers: map[string]*circuitbreaker.CircuitBreaker{
+			server: circuitbreaker.NewCircuitBreaker(2, time.Minute, server),
+		},
+		cache: cache.NewShardedCache(1024, 1),
+		stats: &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+		getClient: func(string) (dnsClient, error) {
+			return fake, nil
+		},
+		putClient: func(string, dnsClient) {},
+	}
+
+	answer, err := resolver.resolveWithServer(context.Background(), server, "nodata.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if answer.TTL != 300 || answer.Zone != "example.com" || answer.SOASerial != 2024010101 || len(answer.Authority) != 1 {
+		t.Fatalf("expected the SOA's negative TTL and authority, got ttl=%d zone=%q serial=%d authority=%v", answer.TTL, answer.Zone, answer.SOASerial, answer.Authority)
+	}
+	if _, ok := resolver.cache.Get(cacheKey(server, "nodata.example.com")); !ok {
+		t.Fatal("expected the empty answer cached for its negative TTL")
+	}
+}
+
 func TestResolveWithServerSuccessUpdatesMetrics(t *testing.T) {
 	server := "9.9.9.9:53"
 	response := new(dns.Msg)
@@ -161,7 +300,7 @@ func TestResolveWithServerSuccessUpdatesMetrics(t *testing.T) {
 	if resolver.stats.Stats[server].Failures != 0 {
 		t.Fatalf("expected no failures, got %d", resolver.stats.Stats[server].Failures)
 	}
-	if _, ok := resolver.cache.Get("example.com"); !ok {
+	if _, ok := resolver.cache.Get(cacheKey(server, "example.com")); !ok {
 		t.Fatalf("expected response cached")
 	}
 	afterSuccess := testutil.ToFloat64(metrics.DNSResolutionSuccess.WithLabelValues(server, "example.com"))
@@ -169,3 +308,1046 @@ func TestResolveWithServerSuccessUpdatesMetrics(t *testing.T) {
 		t.Fatalf("expected success metric increment")
 	}
 }
+
+func TestResolveWithServerClampsCacheTTL(t *testing.T) {
+	server := "9.9.9.9:53"
+	newResolver := func(config *Config) *DNSResolver {
+		response := new(dns.Msg)
+		response.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+		response.Answer = append(response.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: dns.Fqdn("example.com"), Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   []byte{1, 1, 1, 1},
+		})
+		fake := &fakeDNSClient{response: response}
+		return &DNSResolver{
+			config: config,
+			breakers: map[string]*circuitbreaker.CircuitBreaker{
+				server: circuitbreaker.NewCircuitBreaker(2, time.Minute, server),
+			},
+			cache:     cache.NewShardedCache(1024, 1),
+			stats:     &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+			getClient: func(string) (dnsClient, error) { return fake, nil },
+			putClient: func(string, dnsClient) {},
+		}
+	}
+
+	resolver := newResolver(&Config{})
+	if _, err := resolver.resolveWithServer(context.Background(), server, "example.com"); err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if _, ok := resolver.cache.Get(cacheKey(server, "example.com")); ok {
+		t.Fatalf("expected a zero-TTL response not to be cached")
+	}
+
+	config := &Config{}
+	config.Cache.MinTTL = Duration{Duration: 5 * time.Second}
+	resolver = newResolver(config)
+	if _, err := resolver.resolveWithServer(context.Background(), server, "example.com"); err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if _, ok := resolver.cache.Get(cacheKey(server, "example.com")); !ok {
+		t.Fatalf("expected the response cached for the minimum TTL")
+	}
+
+	config.Cache.TTLOverrides = map[string]Duration{"example.com": {}}
+	resolver = newResolver(config)
+	if _, err := resolver.resolveWithServer(context.Background(), server, "example.com"); err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if _, ok := resolver.cache.Get(cacheKey(server, "example.com")); ok {
+		t.Fatalf("expected a zero override to disable caching")
+	}
+}
+
+type countingDNSClient struct {
+	response *dns.Msg
+	delay    time.Duration
+	calls    atomic.Int32
+}
+
+func (c *countingDNSClient) ExchangeContext(ctx context.Context, msg *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	c.calls.Add(1)
+	time.Sleep(c.delay)
+	response := c.response.Copy()
+	response.Id = msg.Id
+	return response, 0, nil
+}
+
+func TestResolveWithServerCachePolicies(t *testing.T) {
+	server := "9.9.9.9:53"
+	answer := new(dns.Msg)
+	answer.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+	answer.Answer = append(answer.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: dns.Fqdn("example.com"), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   []byte{1, 1, 1, 1},
+	})
+	nxdomain := new(dns.Msg)
+	nxdomain.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+	nxdomain.Rcode = dns.RcodeNameError
+	nxdomain.Ns = append(nxdomain.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: dns.Fqdn("com"), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 900},
+		Minttl: 60,
+	})
+
+	tests := []struct {
+		policy    string
+		response  *dns.Msg
+		wantCalls int
+		wantErr   bool
+	}{
+		{CachePolicyNormal, answer, 1, false},
+		{CachePolicyBypass, answer, 2, false},
+		{CachePolicyNegativeOnly, answer, 2, false},
+		{CachePolicyNegativeOnly, nxdomain, 1, true},
+	}
+	for _, tt := range tests {
+		config := &Config{}
+		config.Cache.Policies = map[string]string{"example.com": tt.policy}
+		client := &countingDNSClient{response: tt.response}
+		resolver := &DNSResolver{
+			config: config,
+			breakers: map[string]*circuitbreaker.CircuitBreaker{
+				server: circuitbreaker.NewCircuitBreaker(5, time.Minute, server),
+			},
+			cache:     cache.NewShardedCache(1024, 1),
+			stats:     &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+			getClient: func(string) (dnsClient, error) { return client, nil },
+			putClient: func(string, dnsClient) {},
+		}
+		for range 2 {
+			_, err := resolver.resolveWithServer(context.Background(), server, "example.com")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("%s: unexpected error %v", tt.policy, err)
+			}
+		}
+		if got := int(client.calls.Load()); got != tt.wantCalls {
+			t.Errorf("%s with rcode %s: expected %d queries, got %d", tt.policy, dns.RcodeToString[tt.response.Rcode], tt.wantCalls, got)
+		}
+	}
+}
+
+func TestResolveWithServerQueriesOncePerExpiry(t *testing.T) {
+	answer := new(dns.Msg)
+	answer.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+	answer.Answer = append(answer.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: dns.Fqdn("example.com"), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   []byte{1, 1, 1, 1},
+	})
+	servers := []string{"192.0.2.1:53", "192.0.2.2:53"}
+	clients := map[string]*countingDNSClient{}
+	resolver := &DNSResolver{
+		config:    &Config{},
+		breakers:  make(map[string]*circuitbreaker.CircuitBreaker),
+		cache:     cache.NewShardedCache(1024, 1),
+		stats:     &ResolutionStats{Stats: make(map[string]*ServerStats)},
+		getClient: func(server string) (dnsClient, error) { return clients[server], nil },
+		putClient: func(string, dnsClient) {},
+	}
+	for _, server := range servers {
+		clients[server] = &countingDNSClient{response: answer, delay: 50 * time.Millisecond}
+		resolver.breakers[server] = circuitbreaker.NewCircuitBreaker(5, time.Minute, server)
+		resolver.stats.Stats[server] = &ServerStats{}
+	}
+
+	// Concurrent lookups on one server share its query; each server is
+	// still queried, so no server's answer stands in for another's.
+	const lookups = 4
+	errs := make(chan error, lookups*len(servers))
+	for _, server := range servers {
+		for range lookups {
+			go func() {
+				_, err := resolver.resolveWithServer(context.Background(), server, "example.com")
+				errs <- err
+			}()
+		}
+	}
+	for range lookups * len(servers) {
+		if err := <-errs; err != nil {
+			t.Fatalf("expected success, got %v", err)
+		}
+	}
+	for _, server := range servers {
+		if got := clients[server].calls.Load(); got != 1 {
+			t.Fatalf("expected one upstream query to %s for concurrent lookups, got %d", server, got)
+		}
+		cached, ok := resolver.cache.Get(cacheKey(server, "example.com"))
+		if !ok || cached.Server != server {
+			t.Fatalf("expected %s's own answer cached, got %+v", server, cached)
+		}
+	}
+}
+
+type recordingDNSClient struct {
+	queries []*dns.Msg
+	rcodes  map[string]int
+}
+
+func (c *recordingDNSClient) ExchangeContext(ctx context.Context, msg *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	c.queries = append(c.queries, msg.Copy())
+	response := new(dns.Msg)
+	response.SetReply(msg)
+	if rcode, ok := c.rcodes[msg.Question[0].Name]; ok {
+		response.Rcode = rcode
+	}
+	return response, 0, nil
+}
+
+func TestResolveWithServerHonorsServerSettings(t *testing.T) {
+	server := "192.0.2.53:53"
+	disabled := false
+	config := &Config{
+		DNSServers: []string{server},
+		ServerSettings: map[string]ServerSettings{
+			server: {RecursionDesired: &disabled, DelegationTrace: true},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		rcodes    map[string]int
+		wantNames []string
+		wantErr   string
+	}{
+		{
+			name:      "walks ancestors before full name",
+			wantNames: []string{"com.", "example.com.", "www.example.com."},
+		},
+		{
+			name:      "stops on NXDOMAIN ancestor",
+			rcodes:    map[string]int{"example.com.": dns.RcodeNameError},
+			wantNames: []string{"com.", "example.com."},
+			wantErr:   "NXDOMAIN",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &recordingDNSClient{rcodes: tt.rcodes}
+			resolver := &DNSResolver{
+				config: config,
+				breakers: map[string]*circuitbreaker.CircuitBreaker{
+					server: circuitbreaker.NewCircuitBreaker(2, time.Minute, server),
+				},
+				cache: cache.NewShardedCache(1024, 1),
+				stats: &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+				getClient: func(string) (dnsClient, error) {
+					return client, nil
+				},
+				putClient: func(string, dnsClient) {},
+			}
+
+			_, err := resolver.resolveWithServer(context.Background(), server, "www.example.com")
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+
+			if len(client.queries) != len(tt.wantNames) {
+				t.Fatalf("expected %d queries, got %d", len(tt.wantNames), len(client.queries))
+			}
+			for i, query := range client.queries {
+				if query.Question[0].Name != tt.wantNames[i] {
+					t.Fatalf("query %d: expected %s, got %s", i, tt.wantNames[i], query.Question[0].Name)
+				}
+				if query.RecursionDesired {
+					t.Fatalf("query %d: expected RD flag cleared", i)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveWithServerQueryHooks(t *testing.T) {
+	server := "192.0.2.53:53"
+	newResolver := func(client dnsClient) *DNSResolver {
+		return &DNSResolver{
+			config: &Config{DNSServers: []string{server}},
+			breakers: map[string]*circuitbreaker.CircuitBreaker{
+				server: circuitbreaker.NewCircuitBreaker(1, time.Minute, server),
+			},
+			cache: cache.NewShardedCache(1024, 1),
+			stats: &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+			getClient: func(string) (dnsClient, error) {
+				return client, nil
+			},
+			putClient: func(string, dnsClient) {},
+		}
+	}
+
+	t.Run("mutates query and shares metadata", func(t *testing.T) {
+		client := &recordingDNSClient{}
+		resolver := newResolver(client)
+		resolver.AddPreQueryHook(func(ctx context.Context, info QueryInfo) (*dns.Msg, error) {
+			if _, ok := QueryInfoFromContext(ctx); !ok {
+				t.Errorf("expected query info in hook context")
+			}
+			info.Msg.IsEdns0().Option = append(info.Msg.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: 65001, Data: []byte("tag")})
+			info.Metadata["trace"] = "abc"
+			return nil, nil
+		})
+		var result QueryResult
+		resolver.AddPostQueryHook(func(_ context.Context, r QueryResult) {
+			result = r
+		})
+
+		if _, err := resolver.resolveWithServer(context.Background(), server, "hooks.example.com"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(client.queries) != 1 {
+			t.Fatalf("expected one query, got %d", len(client.queries))
+		}
+		options := client.queries[0].IsEdns0().Option
+		if len(options) != 1 || options[0].Option() != 65001 {
+			t.Fatalf("expected hook EDNS option on the wire, got %v", options)
+		}
+		if result.Metadata["trace"] != "abc" || result.Response == nil || result.ShortCircuited {
+			t.Fatalf("unexpected post-query result %+v", result)
+		}
+	})
+
+	t.Run("short-circuits the exchange", func(t *testing.T) {
+		client := &recordingDNSClient{}
+		resolver := newResolver(client)
+		resolver.AddPreQueryHook(func(_ context.Context, info QueryInfo) (*dns.Msg, error) {
+			response := new(dns.Msg)
+			response.SetReply(info.Msg)
+			rr, _ := dns.NewRR("hooks.example.com. 60 IN A 10.1.2.3")
+			response.Answer = append(response.Answer, rr)
+			return response, nil
+		})
+		var shortCircuited bool
+		resolver.AddPostQueryHook(func(_ context.Context, r QueryResult) {
+			shortCircuited = r.ShortCircuited
+		})
+
+		response, err := resolver.resolveWithServer(context.Background(), server, "hooks.example.com")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(client.queries) != 0 {
+			t.Fatalf("expected no upstream query, got %d", len(client.queries))
+		}
+		if len(response.Addresses) != 1 || response.Addresses[0] != "10.1.2.3" || !shortCircuited {
+			t.Fatalf("expected hook answer, got %v (short-circuited %v)", response.Addresses, shortCircuited)
+		}
+	})
+
+	t.Run("hook error does not trip breaker", func(t *testing.T) {
+		resolver := newResolver(&recordingDNSClient{})
+		resolver.AddPreQueryHook(func(context.Context, QueryInfo) (*dns.Msg, error) {
+			return nil, errors.New("denied by policy")
+		})
+
+		_, err := resolver.resolveWithServer(context.Background(), server, "hooks.example.com")
+		if err == nil || !strings.Contains(err.Error(), "denied by policy") {
+			t.Fatalf("expected hook error, got %v", err)
+		}
+		if state := resolver.breakers[server].GetState(); state != "closed" {
+			t.Fatalf("expected breaker to stay closed, got %v", state)
+		}
+	})
+}
+
+type nodeDNSClient struct {
+	nsid string
+	txt  string
+}
+
+func (c *nodeDNSClient) ExchangeContext(ctx context.Context, msg *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	response := new(dns.Msg)
+	response.SetReply(msg)
+	if msg.Question[0].Qclass == dns.ClassCHAOS {
+		response.Answer = append(response.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: []string{c.txt},
+		})
+		return response, 0, nil
+	}
+	if opt := msg.IsEdns0(); opt != nil {
+		response.SetEdns0(4096, false)
+		response.IsEdns0().Option = append(response.IsEdns0().Option, &dns.EDNS0_NSID{
+			Code: dns.EDNS0NSID,
+			Nsid: hex.EncodeToString([]byte(c.nsid)),
+		})
+	}
+	return response, 0, nil
+}
+
+func TestAnycastNodeIdentification(t *testing.T) {
+	server := "192.0.2.53:53"
+	client := &nodeDNSClient{nsid: "fra1", txt: "ams2"}
+	config := &Config{
+		DNSServers: []string{server},
+		ServerSettings: map[string]ServerSettings{
+			server: {NSID: true, ChaosProbe: true},
+		},
+	}
+	resolver := &DNSResolver{
+		config: config,
+		breakers: map[string]*circuitbreaker.CircuitBreaker{
+			server: circuitbreaker.NewCircuitBreaker(2, time.Minute, server),
+		},
+		cache:  cache.NewShardedCache(1024, 1),
+		stats:  &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+		events: newEventBus(),
+		nodes:  newNodeTracker(),
+		getClient: func(string) (dnsClient, error) {
+			return client, nil
+		},
+		putClient: func(string, dnsClient) {},
+	}
+	events, unsubscribe := resolver.SubscribeEvents(4)
+	defer unsubscribe()
+
+	if _, err := resolver.resolveWithServer(context.Background(), server, "example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := resolver.NodeSnapshot()[server]; got.Node != "fra1" || got.Source != "nsid" {
+		t.Fatalf("expected nsid node fra1, got %+v", got)
+	}
+
+	// CHAOS names the node differently from NSID; that is not re-routing.
+	resolver.identifyNodes(context.Background())
+	got := resolver.NodeSnapshot()[server]
+	if got.Node != "ams2" || got.Source != "chaos" || got.Changes != 0 {
+		t.Fatalf("expected chaos node ams2 without a change, got %+v", got)
+	}
+
+	client.nsid = "lhr3"
+	if _, err := resolver.resolveWithServer(context.Background(), server, "example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resolver.identifyNodes(context.Background())
+	got = resolver.NodeSnapshot()[server]
+	if got.Node != "ams2" || got.Changes != 1 {
+		t.Fatalf("expected one node change, got %+v", got)
+	}
+
+	var changes []ResolverEvent
+	for len(events) > 0 {
+		event := <-events
+		if event.Type == EventNodeChange {
+			changes = append(changes, event)
+		}
+	}
+	if len(changes) != 1 || changes[0].PreviousNode != "fra1" || changes[0].Node != "lhr3" || changes[0].Source != "nsid" {
+		t.Fatalf("expected one nsid node change event fra1 -> lhr3, got %+v", changes)
+	}
+
+	if report := resolver.GenerateReport(); !strings.Contains(report, "ams2") {
+		t.Fatalf("expected report to include anycast node, got %s", report)
+	}
+}
+
+// blockingDNSClient waits for the query context to end, like an unresponsive
+// server.
+type blockingDNSClient struct{}
+
+func (c *blockingDNSClient) ExchangeContext(ctx context.Context, msg *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	<-ctx.Done()
+	return nil, 0, ctx.Err()
+}
+
+func TestResolveWithServerDeadlines(t *testing.T) {
+	server := "192.0.2.53:53"
+	config := &Config{
+		DNSServers:     []string{server},
+		QueryTimeout:   Duration{time.Minute},
+		ServerSettings: map[string]ServerSettings{server: {Timeout: Duration{20 * time.Millisecond}}},
+	}
+
+	tests := []struct {
+		name         string
+		cancelParent bool
+		wantFailures int
+		wantErr      string
+	}{
+		{name: "per-server timeout counts as failure", wantFailures: 1, wantErr: "deadline exceeded"},
+		{name: "parent cancellation is not a failure", cancelParent: true, wantFailures: 0, wantErr: "canceled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker := circuitbreaker.NewCircuitBreaker(5, time.Minute, server)
+			resolver := &DNSResolver{
+				config:   config,
+				breakers: map[string]*circuitbreaker.CircuitBreaker{server: breaker},
+				cache:    cache.NewShardedCache(1024, 1),
+				stats:    &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+				getClient: func(string) (dnsClient, error) {
+					return &blockingDNSClient{}, nil
+				},
+				putClient: func(string, dnsClient) {},
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancelParent {
+				cancel()
+			}
+
+			start := time.Now()
+			_, err := resolver.resolveWithServer(ctx, server, "www.example.com")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("expected prompt return, took %s", elapsed)
+			}
+			if got := resolver.stats.Stats[server].Failures; got != tt.wantFailures {
+				t.Fatalf("expected %d failures, got %d", tt.wantFailures, got)
+			}
+		})
+	}
+}
+
+func TestResolveWithServerCanceledMidExchange(t *testing.T) {
+	// A real socket to a server that never answers: only the deadline, not
+	// cancellation, would otherwise end the read.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open listener: %v", err)
+	}
+	defer conn.Close()
+	server := conn.LocalAddr().String()
+
+	resolver := &DNSResolver{
+		config: &Config{QueryTimeout: Duration{time.Minute}},
+		breakers: map[string]*circuitbreaker.CircuitBreaker{
+			server: circuitbreaker.NewCircuitBreaker(5, time.Minute, server),
+		},
+		cache: cache.NewShardedCache(1024, 1),
+		stats: &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+		getClient: func(string) (dnsClient, error) {
+			return &dns.Client{Timeout: time.Minute}, nil
+		},
+		putClient: func(string, dnsClient) {},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = resolver.resolveWithServer(ctx, server, "silent.example.com")
+	if err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Fatalf("expected a canceled query, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected prompt return, took %s", elapsed)
+	}
+	if got := resolver.stats.Stats[server].Failures; got != 0 {
+		t.Fatalf("expected no failures, got %d", got)
+	}
+}
+
+func TestForwarderAnswersWithConsensus(t *testing.T) {
+	servers := []string{"192.0.2.1:53", "192.0.2.2:53", "192.0.2.3:53"}
+	answers := map[string]string{
+		servers[0]: "10.0.0.1",
+		servers[1]: "10.0.0.1",
+		servers[2]: "10.0.0.9",
+	}
+
+	breakers := make(map[string]*circuitbreaker.CircuitBreaker)
+	stats := make(map[string]*ServerStats)
+	for _, server := range servers {
+		breakers[server] = circuitbreaker.NewCircuitBreaker(2, time.Minute, server)
+		stats[server] = &ServerStats{}
+	}
+	passThrough := &recordingDNSClient{}
+	resolver := &DNSResolver{
+		config:     &Config{Hostnames: []string{"forward.example.com"}, DNSServers: servers},
+		breakers:   breakers,
+		cache:      cache.NewShardedCache(1024, 1),
+		successLog: log.New(io.Discard, "", 0),
+		errorLog:   log.New(io.Discard, "", 0),
+		stats:      &ResolutionStats{Stats: stats},
+		resolveWithServerFunc: func(_ context.Context, server, host string) (*dnsanalysis.DNSResponse, error) {
+			return &dnsanalysis.DNSResponse{Server: server, Hostname: host, Addresses: []string{answers[server]}, TTL: 60}, nil
+		},
+		getClient: func(string) (dnsClient, error) {
+			return passThrough, nil
+		},
+		putClient: func(string, dnsClient) {},
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("Forward.Example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	reply := resolver.answerForwarded(context.Background(), req)
+
+	if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 {
+		t.Fatalf("expected one answer, got rcode=%d answers=%v", reply.Rcode, reply.Answer)
+	}
+	if a, ok := reply.Answer[0].(*dns.A); !ok || a.A.String() != "10.0.0.1" {
+		t.Fatalf("expected consensus answer 10.0.0.1, got %v", reply.Answer[0])
+	}
+	var flagged bool
+	for _, option := range reply.IsEdns0().Option {
+		if ede, ok := option.(*dns.EDNS0_EDE); ok && ede.ExtraText == forwarderDisagreementText {
+			flagged = true
+		}
+	}
+	if !flagged {
+		t.Fatal("expected disagreement to be flagged with an extended DNS error")
+	}
+
+	txt := new(dns.Msg)
+	txt.SetQuestion("forward.example.com.", dns.TypeTXT)
+	if reply := resolver.answerForwarded(context.Background(), txt); reply.Rcode != dns.RcodeSuccess || reply.Id != txt.Id {
+		t.Fatalf("expected pass-through reply, got rcode=%d id=%d", reply.Rcode, reply.Id)
+	}
+	if len(passThrough.queries) != 1 || passThrough.queries[0].Question[0].Qtype != dns.TypeTXT {
+		t.Fatalf("expected TXT query passed through, got %v", passThrough.queries)
+	}
+
+	unmonitored := new(dns.Msg)
+	unmonitored.SetQuestion("other.example.com.", dns.TypeA)
+	if reply := resolver.answerForwarded(context.Background(), unmonitored); reply.Rcode != dns.RcodeSuccess || reply.Id != unmonitored.Id {
+		t.Fatalf("expected pass-through reply, got rcode=%d id=%d", reply.Rcode, reply.Id)
+	}
+	if len(passThrough.queries) != 2 || passThrough.queries[1].Question[0].Name != "other.example.com." {
+		t.Fatalf("expected unmonitored A query passed through, got %v", passThrough.queries)
+	}
+	for server, stat := range stats {
+		if stat.Total != 1 {
+			t.Fatalf("expected only the monitored query counted for %s, got %d", server, stat.Total)
+		}
+	}
+}
+
+func TestResolveWithServerLatencyBreakdown(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open listener: %v", err)
+	}
+	server := conn.LocalAddr().String()
+	dnsServer := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(req)
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.7"),
+		})
+		time.Sleep(5 * time.Millisecond)
+		_ = w.WriteMsg(reply)
+	})}
+	go func() { _ = dnsServer.ActivateAndServe() }()
+	defer dnsServer.Shutdown()
+
+	resolver := &DNSResolver{
+		config: &Config{},
+		breakers: map[string]*circuitbreaker.CircuitBreaker{
+			server: circuitbreaker.NewCircuitBreaker(2, time.Minute, server),
+		},
+		cache: cache.NewShardedCache(1024, 1),
+		stats: &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+		getClient: func(string) (dnsClient, error) {
+			return &dns.Client{Timeout: 2 * time.Second}, nil
+		},
+		putClient: func(string, dnsClient) {},
+	}
+
+	response, err := resolver.resolveWithServer(context.Background(), server, "timed.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.NetworkLatency < 5*time.Millisecond {
+		t.Fatalf("expected network latency to include server delay, got %s", response.NetworkLatency)
+	}
+	if response.ConnectTime <= 0 || response.ConnectTime >= response.NetworkLatency {
+		t.Fatalf("expected connect time measured separately, got %s", response.ConnectTime)
+	}
+	if response.Duration < response.ConnectTime+response.NetworkLatency {
+		t.Fatalf("expected duration %s to cover connect and network phases", response.Duration)
+	}
+
+	// Clients that cannot dial separately report the whole exchange as
+	// network latency.
+	resolver.cache.Clear()
+	resolver.getClient = func(string) (dnsClient, error) {
+		return &fakeDNSClient{response: response.Response}, nil
+	}
+	response, err = resolver.resolveWithServer(context.Background(), server, "timed.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.ConnectTime != 0 {
+		t.Fatalf("expected no connect time without a dialer, got %s", response.ConnectTime)
+	}
+}
+
+func TestResolveWithServerSlowQueryLog(t *testing.T) {
+	server := "9.9.9.9:53"
+	response := new(dns.Msg)
+	response.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+	response.Response, response.RecursionAvailable = true, true
+	response.Answer = append(response.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: dns.Fqdn("example.com"), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+
+	var slow strings.Builder
+	fake := &fakeDNSClient{err: errors.New("i/o timeout")}
+	resolver := &DNSResolver{
+		config: &Config{SlowQueryLog: SlowQueryLogConfig{Threshold: Duration{Duration: time.Nanosecond}}},
+		breakers: map[string]*circuitbreaker.CircuitBreaker{
+			server: circuitbreaker.NewCircuitBreaker(5, time.Minute, server),
+		},
+		cache:   cache.NewShardedCache(1024, 1),
+		stats:   &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+		appLog:  log.New(io.Discard, "", 0),
+		slowLog: log.New(&slow, "", 0),
+		getClient: func(string) (dnsClient, error) {
+			return fake, nil
+		},
+		putClient: func(string, dnsClient) {},
+	}
+
+	before := testutil.ToFloat64(metrics.DNSResSlowQueries.WithLabelValues(server))
+	if _, err := resolver.resolveWithServer(context.Background(), server, "example.com"); err == nil {
+		t.Fatal("expected query error")
+	}
+	fake.response, fake.err = response, nil
+	if _, err := resolver.resolveWithServer(context.Background(), server, "example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(slow.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected two slow queries, got %q", slow.String())
+	}
+	for _, want := range []string{"hostname=example.com", "server=9.9.9.9:53", "transport=udp", "breaker=closed failures=0", `err="i/o timeout"`} {
+		if !strings.Contains(lines[0], want) {
+			t.Fatalf("expected %q in failed query line %q", want, lines[0])
+		}
+	}
+	// The breaker state is the one the query was sent in, before its own
+	// result was recorded.
+	for _, want := range []string{"breaker=closed failures=1", "rcode=NOERROR", "flags=qr,rd,ra", "answers=[192.0.2.1]", "network="} {
+		if !strings.Contains(lines[1], want) {
+			t.Fatalf("expected %q in answered query line %q", want, lines[1])
+		}
+	}
+	if got := testutil.ToFloat64(metrics.DNSResSlowQueries.WithLabelValues(server)) - before; got != 2 {
+		t.Fatalf("expected 2 slow queries counted, got %v", got)
+	}
+
+	// Queries under the threshold are not logged.
+	slow.Reset()
+	resolver.cache.Clear()
+	resolver.config.SlowQueryLog.Threshold.Duration = time.Hour
+	if _, err := resolver.resolveWithServer(context.Background(), server, "example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if slow.Len() != 0 {
+		t.Fatalf("expected fast query not logged, got %q", slow.String())
+	}
+}
+
+func TestResolveWithServerMalformedResponses(t *testing.T) {
+	server := "192.0.2.53:53"
+	// A response whose question name is a compression pointer to itself.
+	loop := []byte{0x12, 0x34, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 0x0c, 0, 1, 0, 1}
+	partial := new(dns.Msg)
+	unpackErr := partial.Unpack(loop)
+	if unpackErr == nil {
+		t.Fatal("expected the looping pointer to fail to unpack")
+	}
+	mismatched := new(dns.Msg)
+	mismatched.SetQuestion("other.example.", dns.TypeA)
+	mismatched.Response = true
+	empty := &dns.Msg{MsgHdr: dns.MsgHdr{Response: true}}
+
+	fake := &fakeDNSClient{}
+	resolver := &DNSResolver{
+		config: &Config{},
+		breakers: map[string]*circuitbreaker.CircuitBreaker{
+			server: circuitbreaker.NewCircuitBreaker(10, time.Minute, server),
+		},
+		cache:     cache.NewShardedCache(1024, 1),
+		stats:     &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+		appLog:    log.New(io.Discard, "", 0),
+		malformed: &malformedSamples{},
+		getClient: func(string) (dnsClient, error) {
+			return fake, nil
+		},
+		putClient: func(string, dnsClient) {},
+	}
+
+	tests := []struct {
+		response *dns.Msg
+		err      error
+		class    string
+	}{
+		{partial, unpackErr, "bad_compression"},
+		{mismatched, nil, "question_mismatch"},
+		{empty, nil, "unexpected_qdcount"},
+		{partial, dns.ErrId, "id_mismatch"},
+	}
+	for _, tt := range tests {
+		before := testutil.ToFloat64(metrics.DNSResolutionMalformed.WithLabelValues(server, tt.class))
+		fake.response, fake.err = tt.response, tt.err
+		_, err := resolver.resolveWithServer(context.Background(), server, "example.com")
+		if err == nil || !strings.Contains(err.Error(), "malformed response ("+tt.class+")") {
+			t.Fatalf("%s: expected malformed response error, got %v", tt.class, err)
+		}
+		if got := testutil.ToFloat64(metrics.DNSResolutionMalformed.WithLabelValues(server, tt.class)) - before; got != 1 {
+			t.Fatalf("%s: expected 1 malformed response counted, got %v", tt.class, got)
+		}
+	}
+	if got := resolver.stats.Stats[server].Failures; got != len(tests) {
+		t.Fatalf("expected %d failures, got %d", len(tests), got)
+	}
+
+	samples := resolver.MalformedSamples(2)
+	if len(samples) != 2 || samples[0].Class != "unexpected_qdcount" || samples[1].Class != "id_mismatch" {
+		t.Fatalf("expected the two latest samples, got %+v", samples)
+	}
+	if first := resolver.MalformedSamples(0)[0]; first.Server != server || first.Hostname != "example.com" || !strings.Contains(first.Error, "compression pointers") || first.Response == "" {
+		t.Fatalf("unexpected bad compression sample %+v", first)
+	}
+
+	// Errors without a response are ordinary query errors.
+	fake.response, fake.err = nil, errors.New("i/o timeout")
+	if _, err := resolver.resolveWithServer(context.Background(), server, "example.com"); err == nil || !strings.Contains(err.Error(), "DNS query failed") {
+		t.Fatalf("expected DNS query error, got %v", err)
+	}
+	if got := len(resolver.MalformedSamples(0)); got != len(tests) {
+		t.Fatalf("expected timeout not sampled, got %d samples", got)
+	}
+}
+
+func TestResolveWithServerMismatchedReplies(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open listener: %v", err)
+	}
+	defer conn.Close()
+	server := conn.LocalAddr().String()
+	// The server answers every query with a reply to another transaction,
+	// followed by the real reply unless silent is set.
+	var silent atomic.Bool
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := new(dns.Msg)
+			if query.Unpack(buf[:n]) != nil {
+				continue
+			}
+			reply := new(dns.Msg)
+			reply.SetReply(query)
+			reply.Answer = append(reply.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.7"),
+			})
+			spoofed := reply.Copy()
+			spoofed.Id = query.Id + 1
+			packed, _ := spoofed.Pack()
+			conn.WriteTo(packed, addr)
+			if !silent.Load() {
+				packed, _ = reply.Pack()
+				conn.WriteTo(packed, addr)
+			}
+		}
+	}()
+
+	var appLog strings.Builder
+	resolver := &DNSResolver{
+		config: &Config{},
+		breakers: map[string]*circuitbreaker.CircuitBreaker{
+			server: circuitbreaker.NewCircuitBreaker(5, time.Minute, server),
+		},
+		cache:                cache.NewShardedCache(1024, 1),
+		stats:                &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+		appLog:               log.New(&appLog, "", 0),
+		instrumentationLevel: instrumentation.High,
+		getClient: func(string) (dnsClient, error) {
+			return &dns.Client{Timeout: 200 * time.Millisecond}, nil
+		},
+		putClient: func(string, dnsClient) {},
+	}
+
+	before := testutil.ToFloat64(metrics.DNSResolutionMismatched.WithLabelValues(server, "id"))
+	response, err := resolver.resolveWithServer(context.Background(), server, "spoofed.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(response.Addresses) != 1 || response.Addresses[0] != "192.0.2.7" {
+		t.Fatalf("expected the real reply, got %v", response.Addresses)
+	}
+	if got := testutil.ToFloat64(metrics.DNSResolutionMismatched.WithLabelValues(server, "id")) - before; got != 1 {
+		t.Fatalf("expected 1 mismatched reply counted, got %v", got)
+	}
+	if !strings.Contains(appLog.String(), "mismatched reply dump hostname=spoofed.example.com") || !strings.Contains(appLog.String(), "00000000  ") {
+		t.Fatalf("expected a hex dump in the app log, got %q", appLog.String())
+	}
+
+	// A query answered only by replies to other transactions fails as a
+	// mismatch rather than a plain timeout.
+	silent.Store(true)
+	resolver.cache.Clear()
+	failures := metrics.DNSResolutionFailure.WithLabelValues(server, "spoofed.example.com", "mismatched_reply")
+	beforeFailures := testutil.ToFloat64(failures)
+	_, err = resolver.resolveWithServer(context.Background(), server, "spoofed.example.com")
+	if err == nil || !strings.Contains(err.Error(), "after 1 replies with mismatched IDs") {
+		t.Fatalf("expected mismatched reply error, got %v", err)
+	}
+	if got := testutil.ToFloat64(failures) - beforeFailures; got != 1 {
+		t.Fatalf("expected failure counted as mismatched_reply, got %v", got)
+	}
+}
+
+func TestResolveWithServerCapturesQueries(t *testing.T) {
+	server := "192.0.2.53:53"
+	resolver := &DNSResolver{
+		config: &Config{},
+		breakers: map[string]*circuitbreaker.CircuitBreaker{
+			server: circuitbreaker.NewCircuitBreaker(5, time.Minute, server),
+		},
+		cache:    cache.NewShardedCache(1024, 1),
+		stats:    &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+		logDir:   t.TempDir(),
+		captures: newCaptureState(),
+		getClient: func(string) (dnsClient, error) {
+			return &recordingDNSClient{}, nil
+		},
+		putClient: func(string, dnsClient) {},
+	}
+
+	if _, err := resolver.CaptureQueries("", maxCaptureQueries+1); err == nil {
+		t.Fatal("expected an oversized capture to be rejected")
+	}
+	dir, err := resolver.CaptureQueries("a.example", 1)
+	if err != nil {
+		t.Fatalf("CaptureQueries() error = %v", err)
+	}
+	for _, hostname := range []string{"b.example", "a.example", "a.example"} {
+		resolver.cache.Clear()
+		if _, err := resolver.resolveWithServer(context.Background(), server, hostname); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if pending := resolver.PendingCaptures(); len(pending) != 0 {
+		t.Fatalf("expected the capture used up, got %v", pending)
+	}
+
+	queries, _ := filepath.Glob(filepath.Join(dir, "*-a.example-192.0.2.53_53-query.bin"))
+	responses, _ := filepath.Glob(filepath.Join(dir, "*-response.bin"))
+	if len(queries) != 1 || len(responses) != 1 {
+		t.Fatalf("expected one captured query for a.example, got %v and %v", queries, responses)
+	}
+	raw, err := os.ReadFile(responses[0])
+	if err != nil {
+		t.Fatalf("failed to read capture: %v", err)
+	}
+	captured := new(dns.Msg)
+	if err := captured.Unpack(raw); err != nil || captured.Question[0].Name != "a.example." {
+		t.Fatalf("unexpected captured response %v: %v", captured, err)
+	}
+}
+
+func TestResolveWithServerBurstQueriesSkipCache(t *testing.T) {
+	server := "9.9.9.9:53"
+	client := &recordingDNSClient{}
+	resolver := &DNSResolver{
+		config: &Config{},
+		breakers: map[string]*circuitbreaker.CircuitBreaker{
+			server: circuitbreaker.NewCircuitBreaker(2, time.Minute, server),
+		},
+		cache: cache.NewShardedCache(1024, 1),
+		stats: &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+		getClient: func(string) (dnsClient, error) {
+			return client, nil
+		},
+		putClient: func(string, dnsClient) {},
+	}
+	resolver.cache.Set(cacheKey(server, "example.com"), &dnsanalysis.DNSResponse{Server: server, Hostname: "example.com"}, time.Minute)
+
+	if _, err := resolver.resolveWithServer(context.Background(), server, "example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(client.queries) != 0 {
+		t.Fatalf("expected a cache hit outside bursts, got %d queries", len(client.queries))
+	}
+	burstCtx := context.WithValue(context.Background(), burstKey{}, true)
+	if _, err := resolver.resolveWithServer(burstCtx, server, "example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(client.queries) != 1 {
+		t.Fatalf("expected burst query to reach the server, got %d queries", len(client.queries))
+	}
+}
+
+// newBenchmarkResolver returns a resolver whose queries to server are
+// answered by a fake client without touching the network.
+func newBenchmarkResolver(server string) *DNSResolver {
+	response := new(dns.Msg)
+	response.SetQuestion("example.com.", dns.TypeA)
+	response.Response = true
+	response.Answer = append(response.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+		A:   net.ParseIP("192.0.2.7"),
+	})
+	client := &fakeDNSClient{response: response}
+	return &DNSResolver{
+		config: &Config{QueryTimeout: Duration{time.Second}},
+		breakers: map[string]*circuitbreaker.CircuitBreaker{
+			server: circuitbreaker.NewCircuitBreaker(5, time.Minute, server),
+		},
+		cache:     cache.NewShardedCache(1<<20, 16),
+		stats:     &ResolutionStats{Stats: map[string]*ServerStats{server: {}}},
+		history:   newEventHistory(1024),
+		getClient: func(string) (dnsClient, error) { return client, nil },
+		putClient: func(string, dnsClient) {},
+	}
+}
+
+// BenchmarkResolveWithServer measures a query that misses the cache; the
+// answer's zero TTL keeps every iteration a miss.
+func BenchmarkResolveWithServer(b *testing.B) {
+	server := "192.0.2.53:53"
+	resolver := newBenchmarkResolver(server)
+	ctx := context.Background()
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := resolver.resolveWithServer(ctx, server, "example.com"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkResolveWithServerCacheHit measures a query answered from the cache.
+func BenchmarkResolveWithServerCacheHit(b *testing.B) {
+	server := "192.0.2.53:53"
+	resolver := newBenchmarkResolver(server)
+	resolver.cache.Set(cacheKey(server, "example.com"), &dnsanalysis.DNSResponse{Hostname: "example.com", Addresses: []string{"192.0.2.7"}}, time.Hour)
+	ctx := context.Background()
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := resolver.resolveWithServer(ctx, server, "example.com"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestQueryMsgReuseResetsOptions(t *testing.T) {
+	msg := newQueryMsg(1, "first.example.com", true)
+	requestNSID(msg)
+	releaseQueryMsg(msg)
+
+	msg = newQueryMsg(2, "second.example.com", false)
+	defer releaseQueryMsg(msg)
+	if msg.Id != 2 || msg.Question[0].Name != "second.example.com." || msg.RecursionDesired {
+		t.Fatalf("unexpected query %v", msg.Question)
+	}
+	opt := msg.IsEdns0()
+	if opt == nil || len(msg.Extra) != 1 || !opt.Do() || opt.UDPSize() != 4096 || len(opt.Option) != 0 {
+		t.Fatalf("expected a fresh OPT record, got %v", msg.Extra)
+	}
+}
@@ -2,8 +2,15 @@ package dnsres
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -39,6 +46,124 @@ func TestValidateConfigInstrumentationLevel(t *testing.T) {
 	}
 }
 
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"hostnames": ["example.com"], "dns_servers": ["8.8.8.8"], "query_timeout": "5s", "query_interval": "30s",
+		"circuit_breaker": {"threshold": 5, "timeout": "-1s"}, "cache": {"max_size": 0}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	_, err := LoadConfig(path)
+	var problems ConfigErrors
+	if !errors.As(err, &problems) {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	want := ConfigErrors{
+		{Path: "circuit_breaker.timeout", Message: "must be positive"},
+		{Path: "cache.max_size", Message: "must be positive"},
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Fatalf("problems = %v, want %v", problems, want)
+	}
+
+	data = `{"hostnames": ["example.com"], "dns_servers": ["8.8.8.8"], "query_timeout": "5s", "query_interval": "30s",
+		"circuit_breaker": {"threshold": 5, "timeout": "30s"}, "cache": {"max_size": 1000},
+		"querying": {"mode": "bogus", "stagger": "-1s"}, "kafka": {"brokers": ["kafka:9092"], "batch_size": -1}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	_, err = LoadConfig(path)
+	if !errors.As(err, &problems) {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	var paths []string
+	for _, problem := range problems {
+		paths = append(paths, problem.Path)
+	}
+	if want := []string{"querying.mode", "querying.stagger", "kafka.topic", "kafka.batch_size"}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("problem paths = %v, want %v", paths, want)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"circuit_breaker": {"threshold": "five"}}`), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	_, err = LoadConfig(path)
+	if !errors.As(err, &problems) || problems[0].Path != "circuit_breaker.threshold" {
+		t.Fatalf("expected a type error at circuit_breaker.threshold, got %v", err)
+	}
+}
+
+func TestLoadConfigNormalizesNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"hostnames": ["Example.COM", "example.com.", "www.example.com", "bücher.example"],
+		"dns_servers": ["8.8.8.8", "8.8.8.8:53", "2001:4860:4860:0:0:0:0:8888", "DNS.Example.net:5353"],
+		"query_timeout": "5s", "query_interval": "30s", "circuit_breaker": {"threshold": 5, "timeout": "30s"},
+		"cache": {"max_size": 100, "policies": {"WWW.example.com": "bypass"}},
+		"server_settings": {"8.8.8.8": {"nsid": true}}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig returned error: %v", err)
+	}
+	if want := []string{"example.com", "www.example.com", "xn--bcher-kva.example"}; !reflect.DeepEqual(config.Hostnames, want) {
+		t.Errorf("hostnames = %q, want %q", config.Hostnames, want)
+	}
+	if want := []string{"8.8.8.8:53", "[2001:4860:4860::8888]:53", "dns.example.net:5353"}; !reflect.DeepEqual(config.DNSServers, want) {
+		t.Errorf("servers = %q, want %q", config.DNSServers, want)
+	}
+	if config.cachePolicy("www.example.com") != CachePolicyBypass || !config.Settings("8.8.8.8:53").NSID {
+		t.Errorf("expected per-hostname and per-server settings to follow their names")
+	}
+	want := []string{
+		"hostnames: ignoring duplicate example.com. (example.com)",
+		"dns_servers: ignoring duplicate 8.8.8.8:53",
+	}
+	if !reflect.DeepEqual(config.Warnings(), want) {
+		t.Errorf("warnings = %q, want %q", config.Warnings(), want)
+	}
+}
+
+func TestDisplayHostname(t *testing.T) {
+	tests := []struct {
+		name        string
+		wantUnicode bool
+	}{
+		{"bücher.example", true},
+		{"пример.испытание", true},
+		{"例え.テスト", true},
+		{"東京abc.jp", true},
+		{"www.example.com", true},
+		// Cyrillic "а" in a Latin word.
+		{"pаypal.com", false},
+		// Greek "ο" in a Latin word.
+		{"gοogle.com", false},
+	}
+	for _, tt := range tests {
+		normalized := NormalizeHostname(strings.ToUpper(tt.name) + ".")
+		if !isASCII(normalized) {
+			t.Errorf("NormalizeHostname(%q) = %q, want ASCII", tt.name, normalized)
+			continue
+		}
+		display := DisplayHostname(normalized)
+		if tt.wantUnicode && display != tt.name {
+			t.Errorf("DisplayHostname(%q) = %q, want %q", normalized, display, tt.name)
+		}
+		if !tt.wantUnicode && display != normalized {
+			t.Errorf("DisplayHostname(%q) = %q, want punycode kept for mixed scripts", normalized, display)
+		}
+	}
+
+	data, err := json.Marshal(ResolverEvent{Type: EventBurstEnd, Hostname: NormalizeHostname("bücher.example")})
+	if err != nil {
+		t.Fatalf("failed to marshal event: %v", err)
+	}
+	if !strings.Contains(string(data), `"hostname":"xn--bcher-kva.example","hostname_display":"bücher.example"`) {
+		t.Errorf("unexpected event JSON %s", data)
+	}
+}
+
 func TestLoadConfigNormalizesDNSServerPorts(t *testing.T) {
 	configJSON := []byte(`{
   "hostnames": ["example.com"],
@@ -77,10 +202,121 @@ func TestLoadConfigNormalizesDNSServerPorts(t *testing.T) {
 	}
 }
 
+func TestLoadConfigServerSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr bool
+	}{
+		{
+			name: "settings key normalized to configured server",
+			json: `{"server_settings": {"192.0.2.1": {"recursion_desired": false}}}`,
+		},
+		{
+			name:    "unknown server rejected",
+			json:    `{"server_settings": {"192.0.2.99:53": {"delegation_trace": true}}}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configJSON := `{
+  "hostnames": ["example.com"],
+  "dns_servers": ["192.0.2.1"],
+  "query_timeout": "5s",
+  "query_interval": "30s",
+  "circuit_breaker": {"threshold": 1, "timeout": "30s"},
+  "cache": {"max_size": 10},
+  ` + strings.TrimSuffix(strings.TrimPrefix(tt.json, "{"), "}") + `
+}`
+			configPath := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+
+			cfg, err := LoadConfig(configPath)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error for unknown server settings")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig returned error: %v", err)
+			}
+			if cfg.Settings("192.0.2.1:53").recursionDesired() {
+				t.Fatalf("expected recursion disabled for normalized server key")
+			}
+		})
+	}
+}
+
+func TestExpandHostnames(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "plain", input: []string{"example.com"}, want: []string{"example.com"}},
+		{name: "padded range", input: []string{"web{08..10}.example.com"}, want: []string{"web08.example.com", "web09.example.com", "web10.example.com"}},
+		{name: "unpadded range", input: []string{"web{9..10}.example.com"}, want: []string{"web9.example.com", "web10.example.com"}},
+		{name: "list", input: []string{"{eu,us}.api.example.com"}, want: []string{"eu.api.example.com", "us.api.example.com"}},
+		{name: "combined", input: []string{"{eu,us}-{1..2}.example.com"}, want: []string{"eu-1.example.com", "eu-2.example.com", "us-1.example.com", "us-2.example.com"}},
+		{name: "duplicates removed", input: []string{"a.example.com", "{a,b}.example.com"}, want: []string{"a.example.com", "b.example.com"}},
+		{name: "unmatched brace", input: []string{"web{1..2.example.com"}, wantErr: true},
+		{name: "descending range", input: []string{"web{5..1}.example.com"}, wantErr: true},
+		{name: "single alternative", input: []string{"{eu}.example.com"}, wantErr: true},
+		{name: "too large", input: []string{"{0..99}{0..99}{0..9}.example.com"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExpandHostnames(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Fatalf("ExpandHostnames(%v) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigExpandsHostnameTemplates(t *testing.T) {
+	configJSON := `{
+  "hostnames": ["web{01..20}.example.com", "{eu,us}.api.example.com"],
+  "dns_servers": ["192.0.2.1"],
+  "query_timeout": "5s",
+  "query_interval": "30s",
+  "circuit_breaker": {"threshold": 1, "timeout": "30s"},
+  "cache": {"max_size": 10}
+}`
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig returned error: %v", err)
+	}
+	if len(cfg.Hostnames) != 22 || cfg.Hostnames[0] != "web01.example.com" || cfg.Hostnames[21] != "us.api.example.com" {
+		t.Fatalf("unexpected expanded hostnames: %v", cfg.Hostnames)
+	}
+}
+
 func TestResolveWithServerUsesCache(t *testing.T) {
 	entry := &dnsanalysis.DNSResponse{Hostname: "example.com"}
 	shardedCache := cache.NewShardedCache(1024, 1)
-	shardedCache.Set("example.com", entry, time.Minute)
+	shardedCache.Set(cacheKey("8.8.8.8:53", "example.com"), entry, time.Minute)
 
 	resolver := &DNSResolver{cache: shardedCache}
 	got, err := resolver.resolveWithServer(context.Background(), "8.8.8.8:53", "example.com")
@@ -92,6 +328,42 @@ func TestResolveWithServerUsesCache(t *testing.T) {
 	}
 }
 
+func TestConfigCacheTTL(t *testing.T) {
+	config := &Config{Hostnames: []string{"a.example.com", "b.example.com"}}
+	config.Cache.MinTTL = Duration{Duration: 10 * time.Second}
+	config.Cache.MaxTTL = Duration{Duration: time.Hour}
+	config.Cache.TTLOverrides = map[string]Duration{"b.example.com": {Duration: 2 * time.Second}}
+
+	tests := []struct {
+		hostname string
+		ttl      uint32
+		want     time.Duration
+	}{
+		{"a.example.com", 0, 10 * time.Second},
+		{"a.example.com", 300, 300 * time.Second},
+		{"a.example.com", 86400, time.Hour},
+		{"b.example.com", 300, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := config.cacheTTL(tt.hostname, tt.ttl); got != tt.want {
+			t.Errorf("cacheTTL(%s, %d) = %s, want %s", tt.hostname, tt.ttl, got, tt.want)
+		}
+	}
+	if err := validateCacheTTL(config); err != nil {
+		t.Fatalf("validateCacheTTL returned error: %v", err)
+	}
+
+	config.Cache.MinTTL = Duration{Duration: 2 * time.Hour}
+	if err := validateCacheTTL(config); err == nil {
+		t.Fatal("expected an error when min TTL exceeds max TTL")
+	}
+	config.Cache.MinTTL = Duration{}
+	config.Cache.TTLOverrides["c.example.com"] = Duration{Duration: time.Second}
+	if err := validateCacheTTL(config); err == nil || !strings.Contains(err.Error(), "c.example.com") {
+		t.Fatalf("expected an error for an override of an unmonitored hostname, got %v", err)
+	}
+}
+
 func TestNormalizeInstrumentationLevel(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -124,40 +396,103 @@ func TestGenerateReport(t *testing.T) {
 	stats := &ResolutionStats{
 		StartTime: time.Date(2025, 1, 2, 15, 4, 0, 0, time.UTC),
 		Stats: map[string]*ServerStats{
-			"8.8.8.8:53": {Total: 10, Failures: 2},
-			"1.1.1.1:53": {Total: 0, Failures: 0},
+			"8.8.8.8:53": {},
+			"1.1.1.1:53": {},
 		},
 	}
-	resolver := &DNSResolver{stats: stats}
+	store, err := openStatsStore(filepath.Join(t.TempDir(), "dnsres-stats.json"))
+	if err != nil {
+		t.Fatalf("unexpected error opening stats store: %v", err)
+	}
+	first := time.Date(2025, 1, 2, 15, 4, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		store.record(first, "a.example.com", "8.8.8.8:53", i < 2)
+	}
+	for i := 0; i < 4; i++ {
+		store.record(first.Add(time.Hour), "b.example.com", "8.8.8.8:53", i == 0)
+	}
+	resolver := &DNSResolver{stats: stats, statsStore: store}
 
 	report := resolver.GenerateReport()
-	if !strings.Contains(report, "8.8.8.8:53") {
-		t.Fatalf("expected report to include server, got %s", report)
+	for _, want := range []string{
+		first.Truncate(time.Hour).Local().Format("2006-01-02 15:04") + " | 8.8.8.8:53",
+		first.Truncate(time.Hour).Add(time.Hour).Local().Format("2006-01-02 15:04") + " | all servers",
+		"20.00%",
+		"25.00%",
+		"Total            |                | 14       | 3        |  21.43%",
+	} {
+		if !strings.Contains(report, want) {
+			t.Fatalf("expected hourly report to include %q, got %s", want, report)
+		}
+	}
+
+	report = resolver.GenerateReportBy(ReportByServer)
+	if !strings.Contains(report, "8.8.8.8:53     | 14       | 3") {
+		t.Fatalf("expected server totals, got %s", report)
+	}
+	if !strings.Contains(report, "1.1.1.1:53") || !strings.Contains(report, "  0.00%") {
+		t.Fatalf("expected zero percent for a server without queries, got %s", report)
+	}
+
+	report = resolver.GenerateReportBy(ReportByHostname)
+	if !strings.Contains(report, "a.example.com            | 10       | 2") || !strings.Contains(report, "b.example.com            | 4        | 1") {
+		t.Fatalf("expected hostname totals, got %s", report)
 	}
-	if !strings.Contains(report, "20.00%") {
-		t.Fatalf("expected failure percentage in report, got %s", report)
+}
+
+func TestStatsStoreSavesAndExpiresBuckets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsres-stats.json")
+	store, err := openStatsStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error opening stats store: %v", err)
 	}
-	if !strings.Contains(report, "1.1.1.1:53") {
-		t.Fatalf("expected report to include zero-total server, got %s", report)
+	now := time.Now()
+	store.record(now.Add(-statsRetention-time.Hour), "old.example.com", "8.8.8.8:53", false)
+	store.record(now, "www.example.com", "8.8.8.8:53", true)
+	if err := store.save(now, false); err != nil {
+		t.Fatalf("unexpected save error: %v", err)
 	}
-	if !strings.Contains(report, "  0.00%") {
-		t.Fatalf("expected zero percent for empty totals, got %s", report)
+	store.record(now, "www.example.com", "8.8.8.8:53", false)
+	if err := store.save(now.Add(time.Second), false); err != nil {
+		t.Fatalf("unexpected save error: %v", err)
+	}
+
+	reopened, err := openStatsStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error reopening stats store: %v", err)
+	}
+	buckets := reopened.snapshot()
+	if len(buckets) != 1 || buckets[0].Hostname != "www.example.com" || buckets[0].Queries != 1 || buckets[0].Failures != 1 {
+		t.Fatalf("expected only the recent bucket as of the first save, got %+v", buckets)
+	}
+
+	if err := store.save(now.Add(time.Second), true); err != nil {
+		t.Fatalf("unexpected save error: %v", err)
+	}
+	if reopened, _ = openStatsStore(path); reopened.snapshot()[0].Queries != 2 {
+		t.Fatalf("expected a forced save to write the second query, got %+v", reopened.snapshot())
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if reopened, err = openStatsStore(path); err == nil || len(reopened.snapshot()) != 0 {
+		t.Fatalf("expected a corrupt store to open empty with an error, got %v", err)
 	}
 }
+
 func TestResolveConfigPath(t *testing.T) {
 	tests := []struct {
 		name         string
 		explicitPath string
 		setupFunc    func(t *testing.T, tempDir string)
 		wantContains string // substring that should be in the path
-		wantCreated  bool
-		wantEmpty    bool // expect empty string return
+		wantEmpty    bool   // expect empty string return
 	}{
 		{
 			name:         "explicit path provided",
 			explicitPath: "/custom/path/config.json",
 			wantContains: "/custom/path/config.json",
-			wantCreated:  false,
 		},
 		{
 			name:         "local config.json exists",
@@ -186,17 +521,15 @@ func TestResolveConfigPath(t *testing.T) {
 				}
 			},
 			wantContains: "config.json",
-			wantCreated:  false,
 		},
 		{
-			name:         "XDG config auto-created",
+			name:         "no config file is not auto-created",
 			explicitPath: "",
 			setupFunc: func(t *testing.T, tempDir string) {
 				// Set XDG_CONFIG_HOME to temp dir
 				os.Setenv("XDG_CONFIG_HOME", tempDir)
 			},
-			wantContains: "dnsres/config.json",
-			wantCreated:  true,
+			wantEmpty: true,
 		},
 		{
 			name:         "XDG config already exists",
@@ -221,7 +554,6 @@ func TestResolveConfigPath(t *testing.T) {
 				}
 			},
 			wantContains: "dnsres/config.json",
-			wantCreated:  false,
 		},
 	}
 
@@ -237,7 +569,7 @@ func TestResolveConfigPath(t *testing.T) {
 				tt.setupFunc(t, tempDir)
 			}
 
-			gotPath, gotCreated, err := ResolveConfigPath(tt.explicitPath)
+			gotPath, err := ResolveConfigPath(tt.explicitPath)
 
 			if err != nil {
 				t.Fatalf("ResolveConfigPath returned error: %v", err)
@@ -247,27 +579,15 @@ func TestResolveConfigPath(t *testing.T) {
 				if gotPath != "" {
 					t.Errorf("expected empty path, got %s", gotPath)
 				}
+				if _, err := os.Stat(DefaultConfigPath()); !os.IsNotExist(err) {
+					t.Errorf("expected no config file created, stat error = %v", err)
+				}
 				return
 			}
 
 			if !strings.Contains(gotPath, tt.wantContains) {
 				t.Errorf("expected path to contain %q, got %q", tt.wantContains, gotPath)
 			}
-
-			if gotCreated != tt.wantCreated {
-				t.Errorf("expected wasCreated=%v, got %v", tt.wantCreated, gotCreated)
-			}
-
-			// If created, verify the file exists and is valid JSON
-			if gotCreated && gotPath != "" {
-				if _, err := os.Stat(gotPath); err != nil {
-					t.Errorf("created config file doesn't exist: %v", err)
-				}
-				// Try to load it to verify it's valid
-				if _, err := LoadConfig(gotPath); err != nil {
-					t.Errorf("created config file is invalid: %v", err)
-				}
-			}
 		})
 	}
 }
@@ -305,7 +625,7 @@ func TestBackwardCompatibility(t *testing.T) {
 			t.Fatalf("failed to write XDG config: %v", err)
 		}
 
-		gotPath, _, _ := ResolveConfigPath("")
+		gotPath, _ := ResolveConfigPath("")
 
 		// Should use ./config.json
 		if !strings.HasSuffix(gotPath, "config.json") || strings.Contains(gotPath, "dnsres") {
@@ -328,7 +648,7 @@ func TestBackwardCompatibility(t *testing.T) {
 			t.Fatalf("failed to write custom config: %v", err)
 		}
 
-		gotPath, _, _ := ResolveConfigPath(explicitPath)
+		gotPath, _ := ResolveConfigPath(explicitPath)
 
 		if gotPath != explicitPath {
 			t.Errorf("expected %s, got %s", explicitPath, gotPath)
@@ -336,6 +656,69 @@ func TestBackwardCompatibility(t *testing.T) {
 	})
 }
 
+func TestLoadConfigIncludes(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.json": `{
+  "include": ["servers.json", "hosts/*.json"],
+  "hostnames": ["main.example.com"],
+  "query_timeout": "5s",
+  "query_interval": "30s",
+  "circuit_breaker": {"threshold": 1, "timeout": "30s"},
+  "cache": {"max_size": 10}
+}`,
+		"servers.json": `{
+  "dns_servers": ["192.0.2.1", "192.0.2.2"],
+  "server_settings": {"192.0.2.1": {"role": "primary"}},
+  "query_timeout": "1s"
+}`,
+		"hosts/b.json":    `{"hostnames": ["b.example.com", "main.example.com"]}`,
+		"hosts/a.json":    `{"include": ["../extra/*.json"], "hostnames": ["a.example.com"]}`,
+		"extra/zone.json": `{"server_settings": {"192.0.2.1": {"role": "fallback"}, "192.0.2.2": {"role": "primary"}}}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	cfg, err := LoadConfig(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatalf("LoadConfig returned error: %v", err)
+	}
+	if got := strings.Join(cfg.Hostnames, " "); got != "a.example.com b.example.com main.example.com" {
+		t.Fatalf("hostnames = %q", got)
+	}
+	if got := strings.Join(cfg.DNSServers, " "); got != "192.0.2.1:53 192.0.2.2:53" {
+		t.Fatalf("dns_servers = %q", got)
+	}
+	if cfg.QueryTimeout.Duration != 5*time.Second {
+		t.Fatalf("expected the including file to win, got query_timeout %s", cfg.QueryTimeout.Duration)
+	}
+	if got := cfg.Role("192.0.2.1:53"); got != "fallback" {
+		t.Fatalf("expected later includes to override earlier ones, got role %q", got)
+	}
+
+	cycle := filepath.Join(dir, "cycle.json")
+	if err := os.WriteFile(cycle, []byte(`{"include": ["cycle.json"]}`), 0644); err != nil {
+		t.Fatalf("failed to write cycle.json: %v", err)
+	}
+	if _, err := LoadConfig(cycle); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("expected include cycle error, got %v", err)
+	}
+	missing := filepath.Join(dir, "missing.json")
+	if err := os.WriteFile(missing, []byte(`{"include": ["nope.json"]}`), 0644); err != nil {
+		t.Fatalf("failed to write missing.json: %v", err)
+	}
+	if _, err := LoadConfig(missing); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected missing include error, got %v", err)
+	}
+}
+
 func TestConfigPathEdgeCases(t *testing.T) {
 	t.Run("config file is a directory not a file", func(t *testing.T) {
 		tempDir := t.TempDir()
@@ -383,6 +766,185 @@ func TestConfigPathEdgeCases(t *testing.T) {
 	})
 }
 
+func TestEditConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Hostnames = []string{"example.com"}
+
+	edited, err := EditConfig(config, map[string]any{
+		"hostnames":                 []string{"web{1..2}.example.com"},
+		"dns_servers":               []string{"192.0.2.1"},
+		"circuit_breaker.threshold": 7,
+		"query_timeout":             "2s",
+	})
+	if err != nil {
+		t.Fatalf("EditConfig returned error: %v", err)
+	}
+	if got := strings.Join(edited.Hostnames, ","); got != "web1.example.com,web2.example.com" {
+		t.Errorf("hostnames = %q", got)
+	}
+	if got := strings.Join(edited.DNSServers, ","); got != "192.0.2.1:53" {
+		t.Errorf("servers = %q", got)
+	}
+	if edited.CircuitBreaker.Threshold != 7 || edited.CircuitBreaker.Timeout.Duration != 30*time.Second {
+		t.Errorf("circuit breaker = %+v", edited.CircuitBreaker)
+	}
+	if edited.QueryTimeout.Duration != 2*time.Second {
+		t.Errorf("query timeout = %s", edited.QueryTimeout.Duration)
+	}
+	if got := strings.Join(config.Hostnames, ","); got != "example.com" {
+		t.Errorf("original config modified: hostnames = %q", got)
+	}
+
+	if _, err := EditConfig(config, map[string]any{"circuit_breaker.threshold": 0}); err == nil {
+		t.Error("expected invalid threshold to be rejected")
+	}
+}
+
+func TestSaveConfigSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	original := `{
+  "hostnames": ["web{1..3}.example.com"],
+  "dns_servers": ["192.0.2.1:53"],
+  "query_timeout": "5s",
+  "query_interval": "30s",
+  "circuit_breaker": {"threshold": 5, "timeout": "30s"},
+  "cache": {"max_size": 1000},
+  "metrics_port": 9990
+}`
+	if err := os.WriteFile(path, []byte(original), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	if err := SaveConfigSettings(path, map[string]any{"circuit_breaker.threshold": 0}); err == nil {
+		t.Fatal("expected invalid settings to be rejected")
+	}
+	if data, _ := os.ReadFile(path); string(data) != original {
+		t.Fatalf("rejected edit changed the file:\n%s", data)
+	}
+
+	settings := map[string]any{
+		"dns_servers":                      []string{"192.0.2.2:53"},
+		"circuit_breaker.threshold":        3,
+		"health_check.unhealthy_threshold": 4,
+	}
+	if err := SaveConfigSettings(path, settings); err != nil {
+		t.Fatalf("SaveConfigSettings returned error: %v", err)
+	}
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("edited config does not load: %v", err)
+	}
+	if got := strings.Join(config.DNSServers, ","); got != "192.0.2.2:53" {
+		t.Errorf("servers = %q", got)
+	}
+	if config.CircuitBreaker.Threshold != 3 || config.HealthCheck.UnhealthyThreshold != 4 {
+		t.Errorf("thresholds not written: breaker %d, unhealthy %d", config.CircuitBreaker.Threshold, config.HealthCheck.UnhealthyThreshold)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	if !strings.Contains(string(data), "web{1..3}.example.com") || !strings.Contains(string(data), `"metrics_port": 9990`) {
+		t.Errorf("unedited keys not kept:\n%s", data)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected file mode kept, got %v (err %v)", info.Mode().Perm(), err)
+	}
+
+	includer := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(includer, []byte(`{"include": ["base.json"]}`), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	if err := SaveConfigSettings(includer, settings); err == nil || !strings.Contains(err.Error(), "includes") {
+		t.Errorf("expected config with includes to be refused, got %v", err)
+	}
+}
+
+func TestRunSetupWizard(t *testing.T) {
+	tempDir := t.TempDir()
+	resolv := filepath.Join(tempDir, "resolv.conf")
+	if err := os.WriteFile(resolv, []byte("nameserver 192.0.2.1\nnameserver 8.8.8.8\n"), 0644); err != nil {
+		t.Fatalf("failed to write resolv.conf: %v", err)
+	}
+	oldResolv := resolvConfPath
+	resolvConfPath = resolv
+	defer func() { resolvConfPath = oldResolv }()
+
+	t.Run("suggested servers", func(t *testing.T) {
+		path := filepath.Join(tempDir, "suggested", "config.json")
+		var out strings.Builder
+		config, err := RunSetupWizard(strings.NewReader("\nwww.test.com api.test.com\n\n"), &out, path)
+		if err != nil {
+			t.Fatalf("RunSetupWizard returned error: %v", err)
+		}
+		if !strings.Contains(out.String(), "At least one hostname is required") {
+			t.Errorf("expected empty hostname answer to be rejected, output: %s", out.String())
+		}
+		if got := strings.Join(config.Hostnames, " "); got != "www.test.com api.test.com" {
+			t.Errorf("hostnames = %q", got)
+		}
+		want := "192.0.2.1:53 8.8.8.8:53 1.1.1.1:53 9.9.9.9:53"
+		if got := strings.Join(config.DNSServers, " "); got != want {
+			t.Errorf("servers = %q, want %q", got, want)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("config file not written: %v", err)
+		}
+	})
+
+	t.Run("explicit servers", func(t *testing.T) {
+		path := filepath.Join(tempDir, "explicit", "config.json")
+		config, err := RunSetupWizard(strings.NewReader("www.test.com\n10.0.0.1 10.0.0.2:5353\n"), io.Discard, path)
+		if err != nil {
+			t.Fatalf("RunSetupWizard returned error: %v", err)
+		}
+		if got := strings.Join(config.DNSServers, " "); got != "10.0.0.1:53 10.0.0.2:5353" {
+			t.Errorf("servers = %q", got)
+		}
+	})
+
+	t.Run("invalid answers are asked again", func(t *testing.T) {
+		path := filepath.Join(tempDir, "retry", "config.json")
+		var out strings.Builder
+		config, err := RunSetupWizard(strings.NewReader("web{3..1}.test.com\n\nweb{1..3}.test.com\n\n"), &out, path)
+		if err != nil {
+			t.Fatalf("RunSetupWizard returned error: %v", err)
+		}
+		if !strings.Contains(out.String(), "  hostnames: invalid hostname template") {
+			t.Errorf("expected the problem to be listed, output: %s", out.String())
+		}
+		if len(config.Hostnames) != 3 {
+			t.Errorf("hostnames = %q", config.Hostnames)
+		}
+	})
+
+	t.Run("input ends early", func(t *testing.T) {
+		path := filepath.Join(tempDir, "aborted", "config.json")
+		if _, err := RunSetupWizard(strings.NewReader("www.test.com\n"), io.Discard, path); err == nil {
+			t.Fatal("expected error when input ends before servers are given")
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected no config file, stat error = %v", err)
+		}
+	})
+}
+
+func TestFirstRunConfigRequiresTerminal(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	in, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", os.DevNull, err)
+	}
+	defer in.Close()
+
+	if _, err := FirstRunConfig(in, io.Discard); err == nil || !strings.Contains(err.Error(), "no configuration file found") {
+		t.Fatalf("expected missing config error, got %v", err)
+	}
+	if _, err := os.Stat(DefaultConfigPath()); !os.IsNotExist(err) {
+		t.Errorf("expected no config file created, stat error = %v", err)
+	}
+}
+
 func TestResolverGetLogDir(t *testing.T) {
 	tests := []struct {
 		name         string
@@ -438,6 +1000,115 @@ func TestResolverGetLogDir(t *testing.T) {
 	}
 }
 
+func newListenTestResolver(t *testing.T, healthPort int) *DNSResolver {
+	t.Helper()
+	config := &Config{
+		Hostnames:     []string{"example.com"},
+		DNSServers:    []string{"8.8.8.8:53"},
+		QueryTimeout:  Duration{Duration: 5 * time.Second},
+		QueryInterval: Duration{Duration: time.Hour},
+		HealthPort:    healthPort,
+		LogDir:        t.TempDir(),
+	}
+	config.CircuitBreaker.Threshold = 1
+	config.CircuitBreaker.Timeout = Duration{Duration: 30 * time.Second}
+	config.Cache.MaxSize = 10
+	resolver, err := NewDNSResolver(config)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	resolver.SetOutputWriter(io.Discard)
+	resolver.resolveAllFunc = func(context.Context) {}
+	return resolver
+}
+
+func TestStartFailsWhenPortIsTaken(t *testing.T) {
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to open listener: %v", err)
+	}
+	defer busy.Close()
+
+	resolver := newListenTestResolver(t, busy.Addr().(*net.TCPAddr).Port)
+	err = resolver.Start(context.Background())
+	var listenErr *ListenError
+	if !errors.As(err, &listenErr) {
+		t.Fatalf("expected a ListenError, got %v", err)
+	}
+	if listenErr.Listener != "health" || !listenErr.AddrInUse() {
+		t.Errorf("expected the health port to be reported in use, got %+v", listenErr)
+	}
+	if ports := resolver.ListenPorts(); len(ports) != 0 {
+		t.Errorf("expected no listeners after a failed start, got %v", ports)
+	}
+}
+
+func TestStartBindsEveryListenerFirst(t *testing.T) {
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to open listener: %v", err)
+	}
+	defer busy.Close()
+
+	resolver := newListenTestResolver(t, 0)
+	resolver.config.GRPC.Port = busy.Addr().(*net.TCPAddr).Port
+	resolver.resolveAllFunc = func(context.Context) {
+		t.Error("expected no resolution before every listener is bound")
+	}
+	err = resolver.Start(context.Background())
+	var listenErr *ListenError
+	if !errors.As(err, &listenErr) || listenErr.Listener != "grpc" {
+		t.Fatalf("expected a grpc ListenError, got %v", err)
+	}
+
+	// The listeners bound before the failure are released.
+	for name, port := range resolver.ListenPorts() {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			t.Errorf("expected the %s port to be released: %v", name, err)
+			continue
+		}
+		listener.Close()
+	}
+}
+
+func TestStartReportsChosenPorts(t *testing.T) {
+	resolver := newListenTestResolver(t, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- resolver.Start(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Start returned %v", err)
+		}
+	}()
+
+	var ports map[string]int
+	for deadline := time.Now().Add(5 * time.Second); len(ports) < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("listeners not started, got %v", ports)
+		}
+		ports = resolver.ListenPorts()
+	}
+	if ports["health"] == 0 || ports["metrics"] == 0 || ports["health"] == ports["metrics"] {
+		t.Fatalf("expected distinct chosen ports, got %v", ports)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/stats", ports["health"]))
+	if err != nil {
+		t.Fatalf("failed to fetch stats: %v", err)
+	}
+	defer resp.Body.Close()
+	var stats StatsSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("failed to decode stats: %v", err)
+	}
+	if !reflect.DeepEqual(stats.Listeners, ports) {
+		t.Errorf("expected /stats listeners %v, got %v", ports, stats.Listeners)
+	}
+}
+
 func TestResolverLogDirWasFallback(t *testing.T) {
 	t.Run("returns false for custom log directory", func(t *testing.T) {
 		tempDir := t.TempDir()
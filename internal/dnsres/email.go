@@ -0,0 +1,373 @@
+package dnsres
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+)
+
+// Email TLS modes.
+const (
+	EmailTLSStartTLS = "starttls"
+	EmailTLSImplicit = "tls"
+	EmailTLSNone     = "none"
+)
+
+const (
+	defaultEmailRateLimit    = 10
+	defaultEmailRateInterval = time.Hour
+	emailSendTimeout         = 30 * time.Second
+
+	defaultEmailSubject = `[dnsres] {{.Type}} {{.Hostname}}{{if .Server}} on {{.Server}}{{end}}`
+	defaultEmailBody    = `{{.Type}} at {{.Time.Format "2006-01-02 15:04:05 MST"}}
+Hostname: {{.Hostname}}
+{{- if .Server}}
+Server: {{.Server}}
+{{- end}}
+{{- if .Error}}
+Error: {{.Error}}
+{{- end}}
+{{- if .Addresses}}
+Addresses: {{join .Addresses ", "}}
+{{- end}}
+{{- if .Detail}}
+
+{{.Detail}}
+{{- end}}
+{{- if .Suppressed}}
+
+{{.Suppressed}} earlier alerts were suppressed by the rate limit.
+{{- end}}
+`
+)
+
+// defaultEmailEvents are the event types emailed when events is unset.
+var defaultEmailEvents = []string{
+	string(EventInconsistent),
+	string(EventIncidentOpen),
+	string(EventIncidentClose),
+	string(EventInterception),
+	string(EventBlockedAnswer),
+}
+
+// EmailConfig configures the SMTP alert sink. Alerts are sent only when
+// Host is set.
+type EmailConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// TLS is "starttls" (default), "tls" for implicit TLS, or "none".
+	TLS                string   `json:"tls"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify"`
+	From               string   `json:"from"`
+	To                 []string `json:"to"`
+	// Events lists the event types to alert on.
+	Events []string `json:"events,omitempty"`
+	// Subject and Body are text/template templates executed with the event.
+	Subject string `json:"subject,omitempty"`
+	Body    string `json:"body,omitempty"`
+	// At most RateLimit alerts are sent per RateInterval; the rest are
+	// counted and mentioned in the next alert sent.
+	RateLimit    int      `json:"rate_limit"`
+	RateInterval Duration `json:"rate_interval"`
+}
+
+func (c EmailConfig) tlsMode() string {
+	if c.TLS == "" {
+		return EmailTLSStartTLS
+	}
+	return c.TLS
+}
+
+func (c EmailConfig) port() int {
+	if c.Port > 0 {
+		return c.Port
+	}
+	switch c.tlsMode() {
+	case EmailTLSImplicit:
+		return 465
+	case EmailTLSNone:
+		return 25
+	}
+	return 587
+}
+
+func (c EmailConfig) events() []string {
+	if len(c.Events) == 0 {
+		return defaultEmailEvents
+	}
+	return c.Events
+}
+
+func (c EmailConfig) rateLimit() int {
+	if c.RateLimit <= 0 {
+		return defaultEmailRateLimit
+	}
+	return c.RateLimit
+}
+
+func (c EmailConfig) rateInterval() time.Duration {
+	if c.RateInterval.Duration <= 0 {
+		return defaultEmailRateInterval
+	}
+	return c.RateInterval.Duration
+}
+
+// templates parses the subject and body templates, falling back to the
+// defaults.
+func (c EmailConfig) templates() (*template.Template, *template.Template, error) {
+	subject, err := parseEmailTemplate("subject", c.Subject, defaultEmailSubject)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := parseEmailTemplate("body", c.Body, defaultEmailBody)
+	if err != nil {
+		return nil, nil, err
+	}
+	return subject, body, nil
+}
+
+// parseEmailTemplate parses the named template from text, or from fallback
+// when text is empty.
+func parseEmailTemplate(name, text, fallback string) (*template.Template, error) {
+	if text == "" {
+		text = fallback
+	}
+	tmpl, err := template.New(name).Funcs(template.FuncMap{"join": strings.Join}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email %s template: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+func validateEmail(c *Config) error {
+	email := c.Email
+	if email.Host == "" {
+		return nil
+	}
+	var problems configProblems
+	switch email.tlsMode() {
+	case EmailTLSStartTLS, EmailTLSImplicit, EmailTLSNone:
+	default:
+		problems.add("email.tls", fmt.Errorf("invalid email tls %q: must be %q, %q or %q", email.TLS, EmailTLSStartTLS, EmailTLSImplicit, EmailTLSNone))
+	}
+	problems.check(email.Port >= 0 && email.Port <= 65535, "email.port", "must be between 0 and 65535")
+	problems.check(email.From != "", "email.from", "must be set")
+	problems.check(len(email.To) > 0, "email.to", "needs at least one address")
+	problems.check(email.Password == "" || email.Username != "", "email.username", "must be set with email.password")
+	problems.check(email.RateLimit >= 0, "email.rate_limit", "must not be negative")
+	problems.check(email.RateInterval.Duration >= 0, "email.rate_interval", "must not be negative")
+	for i, event := range email.Events {
+		problems.check(event != "", elementPath("email.events", i), "must not be empty")
+	}
+	_, err := parseEmailTemplate("subject", email.Subject, defaultEmailSubject)
+	problems.add("email.subject", err)
+	_, err = parseEmailTemplate("body", email.Body, defaultEmailBody)
+	problems.add("email.body", err)
+	return problems.err()
+}
+
+// emailAlert is the data the subject and body templates are executed with.
+type emailAlert struct {
+	ResolverEvent
+	// Suppressed is the number of alerts dropped by the rate limit since
+	// the last one sent.
+	Suppressed int
+}
+
+// emailAlerter renders events as email and sends them within the rate
+// limit.
+type emailAlerter struct {
+	config  EmailConfig
+	subject *template.Template
+	body    *template.Template
+	send    func(ctx context.Context, config EmailConfig, message []byte) error
+
+	mu         sync.Mutex
+	sent       []time.Time
+	suppressed int
+}
+
+func newEmailAlerter(config *Config) (*emailAlerter, error) {
+	if config.Email.Host == "" {
+		return nil, nil
+	}
+	subject, body, err := config.Email.templates()
+	if err != nil {
+		return nil, err
+	}
+	return &emailAlerter{
+		config:  config.Email,
+		subject: subject,
+		body:    body,
+		send:    sendSMTP,
+	}, nil
+}
+
+// allow reports whether an alert may be sent at now, and how many were
+// suppressed since the last one sent.
+func (a *emailAlerter) allow(now time.Time) (bool, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cutoff := now.Add(-a.config.rateInterval())
+	a.sent = slices.DeleteFunc(a.sent, func(at time.Time) bool { return !at.After(cutoff) })
+	if len(a.sent) >= a.config.rateLimit() {
+		a.suppressed++
+		return false, 0
+	}
+	a.sent = append(a.sent, now)
+	suppressed := a.suppressed
+	a.suppressed = 0
+	return true, suppressed
+}
+
+// render builds the RFC 5322 message for alert.
+func (a *emailAlerter) render(alert emailAlert) ([]byte, error) {
+	var subject, body bytes.Buffer
+	if err := a.subject.Execute(&subject, alert); err != nil {
+		return nil, fmt.Errorf("email subject template: %w", err)
+	}
+	if err := a.body.Execute(&body, alert); err != nil {
+		return nil, fmt.Errorf("email body template: %w", err)
+	}
+
+	return a.config.message(subject.String(), alert.Time, body.String()), nil
+}
+
+// message builds a plain-text RFC 5322 message to the configured recipients.
+func (c EmailConfig) message(subject string, date time.Time, body string) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.Join(strings.Fields(subject), " "))
+	fmt.Fprintf(&msg, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("\r\n")
+	lines := strings.Split(strings.TrimRight(body, "\n"), "\n")
+	for _, line := range lines {
+		// Dot-stuffing is left to net/smtp's data writer.
+		msg.WriteString(strings.TrimRight(line, "\r"))
+		msg.WriteString("\r\n")
+	}
+	return msg.Bytes()
+}
+
+// runEmailAlerts emails the configured event types until ctx is canceled.
+func (r *DNSResolver) runEmailAlerts(ctx context.Context) {
+	types := r.email.config.events()
+	events, unsubscribe := r.SubscribeEventsWithOptions(SubscribeOptions{Durable: true, Name: "email", Filter: EventFilter{Types: eventTypes(types)}})
+	defer unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			// The filter passes dropped-event notices too.
+			if slices.Contains(types, string(event.Type)) && !r.warmingUp(event.Time) {
+				r.emailEvent(ctx, event)
+			}
+		}
+	}
+}
+
+// emailEvent sends one alert for event unless the rate limit is reached.
+func (r *DNSResolver) emailEvent(ctx context.Context, event ResolverEvent) {
+	if !r.leading() {
+		metrics.DNSResEmailAlerts.WithLabelValues("standby").Inc()
+		r.appLogf(instrumentation.Medium, "email alert skipped on standby type=%s hostname=%s", event.Type, event.Hostname)
+		return
+	}
+	allowed, suppressed := r.email.allow(time.Now())
+	if !allowed {
+		metrics.DNSResEmailAlerts.WithLabelValues("suppressed").Inc()
+		r.appLogf(instrumentation.Medium, "email alert suppressed type=%s hostname=%s", event.Type, event.Hostname)
+		return
+	}
+	message, err := r.email.render(emailAlert{ResolverEvent: event, Suppressed: suppressed})
+	if err == nil {
+		sendCtx, cancel := context.WithTimeout(ctx, emailSendTimeout)
+		err = r.email.send(sendCtx, r.email.config, message)
+		cancel()
+	}
+	if err != nil {
+		metrics.DNSResEmailAlerts.WithLabelValues("failed").Inc()
+		r.errorLog.Printf("Email alert for %s %s failed: %v", event.Type, event.Hostname, err)
+		return
+	}
+	metrics.DNSResEmailAlerts.WithLabelValues("sent").Inc()
+	r.appLogf(instrumentation.Low, "email alert sent type=%s hostname=%s to=%d", event.Type, event.Hostname, len(r.email.config.To))
+}
+
+// sendSMTP delivers message to the configured recipients.
+func sendSMTP(ctx context.Context, config EmailConfig, message []byte) error {
+	addr := net.JoinHostPort(config.Host, strconv.Itoa(config.port()))
+	tlsConfig := &tls.Config{ServerName: config.Host, InsecureSkipVerify: config.InsecureSkipVerify}
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if config.tlsMode() == EmailTLSImplicit {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	client, err := smtp.NewClient(conn, config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if config.tlsMode() == EmailTLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not offer STARTTLS", addr)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if config.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", config.Username, config.Password, config.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(config.From); err != nil {
+		return err
+	}
+	for _, to := range config.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := data.Write(message); err != nil {
+		return err
+	}
+	if err := data.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
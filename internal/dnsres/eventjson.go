@@ -0,0 +1,148 @@
+package dnsres
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"dnsres/internal/geoip"
+)
+
+// EventSchemaVersion is the schema_version of events marshaled as JSON, as
+// served at /events/recent and published to brokers. It changes only when
+// a field is removed or its meaning changes; new fields do not bump it.
+const EventSchemaVersion = 1
+
+// SuccessDetails are the JSON fields of a resolve_success event.
+type SuccessDetails struct {
+	Addresses []string              `json:"addresses"`
+	Geo       map[string]geoip.Info `json:"geo,omitempty"`
+	// Source is where the answer came from, e.g. "cache".
+	Source string `json:"source,omitempty"`
+}
+
+// FailureDetails are the JSON fields of a resolve_failure event.
+type FailureDetails struct {
+	Error string `json:"error"`
+	// Source classifies the failure, e.g. "timeout" or "cycle_timeout".
+	Source string `json:"source,omitempty"`
+}
+
+// CycleDetails are the JSON fields of cycle_start, cycle_complete and
+// cycle_timeout events.
+type CycleDetails struct {
+	HostnameCount int    `json:"hostname_count"`
+	ServerCount   int    `json:"server_count"`
+	QueryMode     string `json:"query_mode,omitempty"`
+	Detail        string `json:"detail,omitempty"`
+}
+
+// eventJSON is the JSON form of a ResolverEvent. Fields that only success,
+// failure or cycle events carry are grouped under those keys; the other
+// event types use the flat optional fields.
+type eventJSON struct {
+	SchemaVersion int       `json:"schema_version"`
+	Type          EventType `json:"type"`
+	Time          time.Time `json:"time"`
+	Hostname      string    `json:"hostname,omitempty"`
+	// HostnameDisplay is Hostname with its punycode labels shown in
+	// Unicode, set only when the two differ.
+	HostnameDisplay string            `json:"hostname_display,omitempty"`
+	Server          string            `json:"server,omitempty"`
+	DurationMS      float64           `json:"duration_ms,omitempty"`
+	Success         *SuccessDetails   `json:"success,omitempty"`
+	Failure         *FailureDetails   `json:"failure,omitempty"`
+	Cycle           *CycleDetails     `json:"cycle,omitempty"`
+	Error           string            `json:"error,omitempty"`
+	Source          string            `json:"source,omitempty"`
+	Consistent      *bool             `json:"consistent,omitempty"`
+	Node            string            `json:"node,omitempty"`
+	PreviousNode    string            `json:"previous_node,omitempty"`
+	Detail          string            `json:"detail,omitempty"`
+	Dropped         int               `json:"dropped,omitempty"`
+	Severity        string            `json:"severity,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+// MarshalJSON encodes the event with lowercase keys, omitting fields the
+// event type does not use.
+func (e ResolverEvent) MarshalJSON() ([]byte, error) {
+	out := eventJSON{
+		SchemaVersion: EventSchemaVersion,
+		Type:          e.Type,
+		Time:          e.Time,
+		Hostname:      e.Hostname,
+		Server:        e.Server,
+		DurationMS:    float64(e.Duration) / float64(time.Millisecond),
+		Labels:        e.Labels,
+	}
+	if display := DisplayHostname(e.Hostname); display != e.Hostname {
+		out.HostnameDisplay = display
+	}
+	switch e.Type {
+	case EventResolveSuccess:
+		out.Success = &SuccessDetails{Addresses: e.Addresses, Geo: e.Geo, Source: e.Source}
+		if out.Success.Addresses == nil {
+			out.Success.Addresses = []string{}
+		}
+	case EventResolveFailure:
+		out.Failure = &FailureDetails{Error: e.Error, Source: e.Source}
+	case EventCycleStart, EventCycleComplete, EventCycleTimeout:
+		out.Cycle = &CycleDetails{
+			HostnameCount: e.HostnameCount,
+			ServerCount:   e.ServerCount,
+			QueryMode:     e.QueryMode,
+			Detail:        e.Detail,
+		}
+	default:
+		out.Error = e.Error
+		out.Source = e.Source
+		out.Consistent = e.Consistent
+		out.Node = e.Node
+		out.PreviousNode = e.PreviousNode
+		out.Detail = e.Detail
+		out.Dropped = e.Dropped
+		out.Severity = e.Severity
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes an event encoded by MarshalJSON.
+func (e *ResolverEvent) UnmarshalJSON(data []byte) error {
+	var in eventJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	*e = ResolverEvent{
+		Type:         in.Type,
+		Time:         in.Time,
+		Hostname:     in.Hostname,
+		Server:       in.Server,
+		Duration:     time.Duration(math.Round(in.DurationMS * float64(time.Millisecond))),
+		Error:        in.Error,
+		Source:       in.Source,
+		Consistent:   in.Consistent,
+		Node:         in.Node,
+		PreviousNode: in.PreviousNode,
+		Detail:       in.Detail,
+		Dropped:      in.Dropped,
+		Severity:     in.Severity,
+		Labels:       in.Labels,
+	}
+	if in.Success != nil {
+		e.Addresses = in.Success.Addresses
+		e.Geo = in.Success.Geo
+		e.Source = in.Success.Source
+	}
+	if in.Failure != nil {
+		e.Error = in.Failure.Error
+		e.Source = in.Failure.Source
+	}
+	if in.Cycle != nil {
+		e.HostnameCount = in.Cycle.HostnameCount
+		e.ServerCount = in.Cycle.ServerCount
+		e.QueryMode = in.Cycle.QueryMode
+		e.Detail = in.Cycle.Detail
+	}
+	return nil
+}
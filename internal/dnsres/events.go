@@ -1,22 +1,44 @@
 package dnsres
 
 import (
+	"slices"
+	"strconv"
 	"sync"
 	"time"
+
+	"dnsres/internal/geoip"
+	"dnsres/metrics"
 )
 
 // EventType identifies the kind of resolver event.
 type EventType string
 
 const (
-	EventCycleStart     EventType = "cycle_start"
-	EventCycleComplete  EventType = "cycle_complete"
-	EventResolveSuccess EventType = "resolve_success"
-	EventResolveFailure EventType = "resolve_failure"
-	EventInconsistent   EventType = "inconsistent"
+	EventCycleStart        EventType = "cycle_start"
+	EventCycleComplete     EventType = "cycle_complete"
+	EventCycleTimeout      EventType = "cycle_timeout"
+	EventResolveSuccess    EventType = "resolve_success"
+	EventResolveFailure    EventType = "resolve_failure"
+	EventInconsistent      EventType = "inconsistent"
+	EventNodeChange        EventType = "node_change"
+	EventFingerprintChange EventType = "fingerprint_change"
+	EventDropped           EventType = "dropped"
+	EventAnalyzerFinding   EventType = "analyzer_finding"
+	EventBlockedAnswer     EventType = "blocked_answer"
+	EventInterception      EventType = "interception"
+	EventBurstStart        EventType = "burst_start"
+	EventBurstEnd          EventType = "burst_end"
+	EventIncidentOpen      EventType = "incident_open"
+	EventIncidentClose     EventType = "incident_close"
+	EventBreakerChange     EventType = "breaker_change"
+	EventFlapStart         EventType = "flap_start"
+	EventFlapEnd           EventType = "flap_end"
+	EventAnomalyStart      EventType = "latency_anomaly_start"
+	EventAnomalyEnd        EventType = "latency_anomaly_end"
 )
 
-// ResolverEvent captures resolver activity for observers.
+// ResolverEvent captures resolver activity for observers. Its JSON form is
+// versioned by EventSchemaVersion; see MarshalJSON.
 type ResolverEvent struct {
 	Type          EventType
 	Time          time.Time
@@ -25,49 +47,354 @@ type ResolverEvent struct {
 	Duration      time.Duration
 	Error         string
 	Addresses     []string
+	Geo           map[string]geoip.Info
 	Consistent    *bool
 	HostnameCount int
 	ServerCount   int
 	Source        string
+	Node          string
+	PreviousNode  string
+	Detail        string
+	Dropped       int
+	QueryMode     string
+	Severity      string
+	Labels        map[string]string
+}
+
+// EventFilter selects the events a subscription receives. Each non-empty
+// list must contain the event's value. Events not about any hostname or
+// server, such as cycle events, pass the hostname and server lists, and
+// dropped-event notices always pass.
+type EventFilter struct {
+	Types     []EventType
+	Hostnames []string
+	Servers   []string
+}
+
+// matches reports whether event passes the filter.
+func (f EventFilter) matches(event ResolverEvent) bool {
+	if event.Type == EventDropped {
+		return true
+	}
+	if len(f.Types) > 0 && !slices.Contains(f.Types, event.Type) {
+		return false
+	}
+	if len(f.Hostnames) > 0 && event.Hostname != "" && !slices.Contains(f.Hostnames, event.Hostname) {
+		return false
+	}
+	if len(f.Servers) > 0 && event.Server != "" && !slices.Contains(f.Servers, event.Server) {
+		return false
+	}
+	return true
+}
+
+// eventTypes converts configured or requested event type names.
+func eventTypes(names []string) []EventType {
+	types := make([]EventType, 0, len(names))
+	for _, name := range names {
+		types = append(types, EventType(name))
+	}
+	return types
+}
+
+// SubscribeOptions controls how events are delivered to a subscriber.
+type SubscribeOptions struct {
+	// Buffer is the channel capacity (default 64).
+	Buffer int
+	// Durable queues events in a ring buffer instead of dropping them when
+	// the channel is full. Only when the ring overflows are the oldest
+	// events discarded.
+	Durable bool
+	// RingSize is the durable ring capacity (default 1024).
+	RingSize int
+	// Name identifies the subscriber in metrics and stats, e.g. "tui"
+	// (default "other"). Keep the set of names small: each one is a
+	// metric label value.
+	Name string
+	// Filter drops unwanted events before they are queued, so they neither
+	// fill the channel nor count as dropped.
+	Filter EventFilter
+}
+
+// SubscriberStats reports delivery accounting for one subscriber.
+type SubscriberStats struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Buffer  int    `json:"buffer"`
+	Durable bool   `json:"durable"`
+	Queued  int    `json:"queued"`
+	Dropped uint64 `json:"dropped"`
+}
+
+type subscriber struct {
+	id      int
+	name    string
+	filter  EventFilter
+	ch      chan ResolverEvent
+	durable bool
+
+	mu      sync.Mutex
+	dropped uint64
+	pending int // drops not yet reported with an EventDropped
+
+	// Durable subscribers only.
+	ring   []ResolverEvent
+	head   int
+	count  int
+	notify chan struct{}
+	done   chan struct{}
+	pumped sync.WaitGroup
 }
 
 type eventBus struct {
-	mu   sync.RWMutex
-	subs map[chan ResolverEvent]struct{}
+	mu     sync.RWMutex
+	subs   map[*subscriber]struct{}
+	nextID int
 }
 
 func newEventBus() *eventBus {
 	return &eventBus{
-		subs: make(map[chan ResolverEvent]struct{}),
+		subs: make(map[*subscriber]struct{}),
 	}
 }
 
 func (b *eventBus) subscribe(buffer int) (<-chan ResolverEvent, func()) {
-	if buffer <= 0 {
-		buffer = 64
+	return b.subscribeWithOptions(SubscribeOptions{Buffer: buffer})
+}
+
+func (b *eventBus) subscribeWithOptions(opts SubscribeOptions) (<-chan ResolverEvent, func()) {
+	if opts.Buffer <= 0 {
+		opts.Buffer = 64
+	}
+	if opts.Name == "" {
+		opts.Name = "other"
+	}
+
+	sub := &subscriber{
+		name:    opts.Name,
+		filter:  opts.Filter,
+		ch:      make(chan ResolverEvent, opts.Buffer),
+		durable: opts.Durable,
+	}
+	if sub.durable {
+		if opts.RingSize <= 0 {
+			opts.RingSize = 1024
+		}
+		sub.ring = make([]ResolverEvent, opts.RingSize)
+		sub.notify = make(chan struct{}, 1)
+		sub.done = make(chan struct{})
+		sub.pumped.Add(1)
+		go sub.pump()
 	}
 
-	ch := make(chan ResolverEvent, buffer)
 	b.mu.Lock()
-	b.subs[ch] = struct{}{}
+	b.nextID++
+	sub.id = b.nextID
+	b.subs[sub] = struct{}{}
 	b.mu.Unlock()
+	metrics.DNSResEventBusSubscribers.WithLabelValues(sub.name).Inc()
 
-	return ch, func() {
-		b.mu.Lock()
-		delete(b.subs, ch)
-		b.mu.Unlock()
-		close(ch)
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, sub)
+			b.mu.Unlock()
+			metrics.DNSResEventBusSubscribers.WithLabelValues(sub.name).Dec()
+			if sub.durable {
+				close(sub.done)
+				sub.pumped.Wait()
+			}
+			close(sub.ch)
+		})
 	}
 }
 
 func (b *eventBus) publish(event ResolverEvent) {
+	metrics.DNSResEventBusPublished.WithLabelValues(string(event.Type)).Inc()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subs {
+		if sub.filter.matches(event) {
+			sub.deliver(event)
+		}
+	}
+}
+
+// stats returns delivery accounting for every active subscriber.
+func (b *eventBus) stats() []SubscriberStats {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
-	for ch := range b.subs {
+	stats := make([]SubscriberStats, 0, len(b.subs))
+	for sub := range b.subs {
+		sub.mu.Lock()
+		stats = append(stats, SubscriberStats{
+			ID:      sub.id,
+			Name:    sub.name,
+			Buffer:  cap(sub.ch),
+			Durable: sub.durable,
+			Queued:  len(sub.ch) + sub.count,
+			Dropped: sub.dropped,
+		})
+		sub.mu.Unlock()
+	}
+	return stats
+}
+
+// deliver hands event to the subscriber without ever blocking the publisher.
+func (s *subscriber) deliver(event ResolverEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.durable {
+		if s.count == len(s.ring) {
+			s.head = (s.head + 1) % len(s.ring)
+			s.count--
+			s.drop()
+		}
+		s.ring[(s.head+s.count)%len(s.ring)] = event
+		s.count++
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+		return
+	}
+
+	if s.pending > 0 {
 		select {
-		case ch <- event:
+		case s.ch <- droppedEvent(s.pending):
+			s.pending = 0
 		default:
+			s.drop()
+			return
+		}
+	}
+	select {
+	case s.ch <- event:
+	default:
+		s.drop()
+	}
+}
+
+// drop counts one lost event; callers hold s.mu.
+func (s *subscriber) drop() {
+	s.dropped++
+	s.pending++
+	metrics.DNSResEventBusDropped.WithLabelValues(s.name, strconv.FormatBool(s.durable)).Inc()
+}
+
+// pump drains a durable subscriber's ring into its channel, blocking on the
+// consumer rather than on the publisher.
+func (s *subscriber) pump() {
+	defer s.pumped.Done()
+	for {
+		event, ok := s.next()
+		if !ok {
+			select {
+			case <-s.notify:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		select {
+		case s.ch <- event:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// next pops the oldest queued event, reporting ring overflow first.
+func (s *subscriber) next() (ResolverEvent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending > 0 {
+		event := droppedEvent(s.pending)
+		s.pending = 0
+		return event, true
+	}
+	if s.count == 0 {
+		return ResolverEvent{}, false
+	}
+	event := s.ring[s.head]
+	s.ring[s.head] = ResolverEvent{}
+	s.head = (s.head + 1) % len(s.ring)
+	s.count--
+	return event, true
+}
+
+// eventHistory keeps the most recent events in a fixed-size ring.
+type eventHistory struct {
+	mu     sync.Mutex
+	events []ResolverEvent
+	head   int
+	count  int
+}
+
+func newEventHistory(size int) *eventHistory {
+	if size <= 0 {
+		size = defaultEventHistorySize
+	}
+	return &eventHistory{events: make([]ResolverEvent, size)}
+}
+
+func (h *eventHistory) add(event ResolverEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.count == len(h.events) {
+		h.events[h.head] = event
+		h.head = (h.head + 1) % len(h.events)
+		return
+	}
+	h.events[(h.head+h.count)%len(h.events)] = event
+	h.count++
+}
+
+// truncate drops the oldest events until at most keep (0 to 1) of them remain,
+// and returns how many were dropped.
+func (h *eventHistory) truncate(keep float64) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	dropped := h.count - int(float64(h.count)*keep)
+	for i := 0; i < dropped; i++ {
+		h.events[h.head] = ResolverEvent{}
+		h.head = (h.head + 1) % len(h.events)
+	}
+	h.count -= dropped
+	return dropped
+}
+
+// recent returns up to limit events, oldest first, that match eventType
+// (empty matches all).
+func (h *eventHistory) recent(limit int, eventType EventType) []ResolverEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	result := make([]ResolverEvent, 0, h.count)
+	for i := 0; i < h.count; i++ {
+		event := h.events[(h.head+i)%len(h.events)]
+		if eventType != "" && event.Type != eventType {
+			continue
 		}
+		result = append(result, event)
+	}
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result
+}
+
+func droppedEvent(count int) ResolverEvent {
+	return ResolverEvent{
+		Type:    EventDropped,
+		Time:    time.Now(),
+		Dropped: count,
 	}
 }
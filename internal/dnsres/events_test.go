@@ -0,0 +1,520 @@
+package dnsres
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"dnsres/internal/pubsub"
+	"dnsres/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEventBusDropAccounting(t *testing.T) {
+	bus := newEventBus()
+	events, unsubscribe := bus.subscribe(2)
+	defer unsubscribe()
+
+	for i := 0; i < 5; i++ {
+		bus.publish(ResolverEvent{Type: EventResolveSuccess})
+	}
+
+	stats := bus.stats()
+	if len(stats) != 1 || stats[0].Dropped != 3 {
+		t.Fatalf("expected 3 dropped events, got %+v", stats)
+	}
+
+	// Drain and publish again: the subscriber is told what it missed first.
+	<-events
+	<-events
+	bus.publish(ResolverEvent{Type: EventCycleStart})
+
+	dropped := <-events
+	if dropped.Type != EventDropped || dropped.Dropped != 3 {
+		t.Fatalf("expected dropped notification for 3 events, got %+v", dropped)
+	}
+	if next := <-events; next.Type != EventCycleStart {
+		t.Fatalf("expected published event after notification, got %+v", next)
+	}
+}
+
+func TestEventBusMetrics(t *testing.T) {
+	bus := newEventBus()
+	subscribers := metrics.DNSResEventBusSubscribers.WithLabelValues("metrics-test")
+	dropped := metrics.DNSResEventBusDropped.WithLabelValues("metrics-test", "false")
+	published := metrics.DNSResEventBusPublished.WithLabelValues(string(EventBurstEnd))
+	publishedBefore := testutil.ToFloat64(published)
+
+	_, unsubscribe := bus.subscribeWithOptions(SubscribeOptions{Buffer: 1, Name: "metrics-test"})
+	if got := testutil.ToFloat64(subscribers); got != 1 {
+		t.Fatalf("expected 1 subscriber, got %v", got)
+	}
+	for i := 0; i < 3; i++ {
+		bus.publish(ResolverEvent{Type: EventBurstEnd})
+	}
+	if got := testutil.ToFloat64(published) - publishedBefore; got != 3 {
+		t.Fatalf("expected 3 published events, got %v", got)
+	}
+	if got := testutil.ToFloat64(dropped); got != 2 {
+		t.Fatalf("expected 2 dropped events, got %v", got)
+	}
+	if stats := bus.stats(); stats[0].Name != "metrics-test" {
+		t.Fatalf("expected named subscriber stats, got %+v", stats)
+	}
+
+	unsubscribe()
+	if got := testutil.ToFloat64(subscribers); got != 0 {
+		t.Fatalf("expected no subscribers after unsubscribe, got %v", got)
+	}
+}
+
+func TestSubscribeEventsFiltered(t *testing.T) {
+	resolver := &DNSResolver{events: newEventBus()}
+	events, unsubscribe := resolver.SubscribeEventsFiltered(EventFilter{
+		Types:     []EventType{EventResolveFailure, EventCycleStart},
+		Hostnames: []string{"a.example"},
+		Servers:   []string{"192.0.2.53:53"},
+	}, 1)
+	defer unsubscribe()
+
+	for _, event := range []ResolverEvent{
+		{Type: EventResolveSuccess, Hostname: "a.example", Server: "192.0.2.53:53"},
+		{Type: EventResolveFailure, Hostname: "b.example", Server: "192.0.2.53:53"},
+		{Type: EventResolveFailure, Hostname: "a.example", Server: "198.51.100.53:53"},
+		{Type: EventResolveFailure, Hostname: "a.example", Server: "192.0.2.53:53"},
+	} {
+		resolver.events.publish(event)
+	}
+	if got := <-events; got.Type != EventResolveFailure || got.Hostname != "a.example" || got.Server != "192.0.2.53:53" {
+		t.Fatalf("expected only the matching failure, got %+v", got)
+	}
+	if stats := resolver.EventSubscriberStats(); stats[0].Dropped != 0 {
+		t.Fatalf("filtered events must not count as dropped, got %+v", stats)
+	}
+
+	// Events about no hostname or server pass those filters.
+	resolver.events.publish(ResolverEvent{Type: EventCycleStart})
+	if got := <-events; got.Type != EventCycleStart {
+		t.Fatalf("expected cycle_start, got %+v", got)
+	}
+}
+
+func TestResolverEventJSON(t *testing.T) {
+	at := time.Date(2024, 3, 14, 11, 0, 0, 0, time.UTC)
+	events := []ResolverEvent{
+		{Type: EventResolveSuccess, Time: at, Hostname: "a.example", Server: "192.0.2.53:53", Duration: 1500 * time.Microsecond, Addresses: []string{"192.0.2.1"}, Source: "cache"},
+		{Type: EventResolveFailure, Time: at, Hostname: "a.example", Server: "192.0.2.53:53", Error: "i/o timeout", Source: "timeout"},
+		{Type: EventCycleComplete, Time: at, Duration: time.Second, HostnameCount: 2, ServerCount: 3, QueryMode: "all"},
+		{Type: EventNodeChange, Time: at, Server: "192.0.2.53:53", Node: "fra1", PreviousNode: "ams1", Source: "nsid"},
+	}
+	wantKeys := []string{"success", "failure", "cycle", "node"}
+	for i, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			t.Fatalf("Marshal(%s) error = %v", event.Type, err)
+		}
+		var object map[string]any
+		if err := json.Unmarshal(data, &object); err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", event.Type, err)
+		}
+		if object["schema_version"] != float64(EventSchemaVersion) || object["type"] != string(event.Type) || object[wantKeys[i]] == nil {
+			t.Fatalf("unexpected JSON for %s: %s", event.Type, data)
+		}
+		if _, ok := object["Type"]; ok || object["error"] != nil && event.Type == EventResolveFailure {
+			t.Fatalf("expected lowercase keys without repeated fields: %s", data)
+		}
+
+		var decoded ResolverEvent
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", event.Type, err)
+		}
+		if !reflect.DeepEqual(decoded, event) {
+			t.Fatalf("round trip of %s = %+v, want %+v", event.Type, decoded, event)
+		}
+	}
+}
+
+func TestEventBusDurableSubscription(t *testing.T) {
+	tests := []struct {
+		name        string
+		ringSize    int
+		publish     int
+		wantDropped bool
+	}{
+		{name: "ring absorbs burst", ringSize: 16, publish: 10},
+		{name: "ring overflow reports drops", ringSize: 4, publish: 10, wantDropped: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := newEventBus()
+			events, unsubscribe := bus.subscribeWithOptions(SubscribeOptions{Buffer: 1, Durable: true, RingSize: tt.ringSize})
+			defer unsubscribe()
+
+			// Hold the pump on a full channel while the burst is published.
+			bus.publish(ResolverEvent{Type: EventCycleStart})
+			deadline := time.Now().Add(time.Second)
+			for len(events) == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			for i := 0; i < tt.publish; i++ {
+				bus.publish(ResolverEvent{Type: EventResolveSuccess})
+			}
+
+			if first := <-events; first.Type != EventCycleStart {
+				t.Fatalf("expected first event delivered, got %+v", first)
+			}
+
+			// Every published event is either delivered or reported dropped.
+			dropped := 0
+			received := 0
+			for received+dropped < tt.publish {
+				select {
+				case event := <-events:
+					if event.Type == EventDropped {
+						dropped += event.Dropped
+						continue
+					}
+					received++
+				case <-time.After(time.Second):
+					t.Fatalf("timed out after %d events", received)
+				}
+			}
+			if (dropped > 0) != tt.wantDropped {
+				t.Fatalf("expected drops=%v, got %d dropped", tt.wantDropped, dropped)
+			}
+		})
+	}
+}
+
+func TestEventBusUnsubscribeIsIdempotent(t *testing.T) {
+	bus := newEventBus()
+	_, unsubscribe := bus.subscribeWithOptions(SubscribeOptions{Durable: true})
+	unsubscribe()
+	unsubscribe()
+	if len(bus.stats()) != 0 {
+		t.Fatalf("expected no subscribers after unsubscribe")
+	}
+}
+
+func TestEventHistoryKeepsMostRecent(t *testing.T) {
+	history := newEventHistory(3)
+	for i := 0; i < 5; i++ {
+		eventType := EventResolveSuccess
+		if i%2 == 1 {
+			eventType = EventResolveFailure
+		}
+		history.add(ResolverEvent{Type: eventType, HostnameCount: i})
+	}
+
+	tests := []struct {
+		name      string
+		limit     int
+		eventType EventType
+		want      []int
+	}{
+		{name: "all", want: []int{2, 3, 4}},
+		{name: "limit", limit: 2, want: []int{3, 4}},
+		{name: "type filter", eventType: EventResolveFailure, want: []int{3}},
+		{name: "limit above size", limit: 10, want: []int{2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := history.recent(tt.limit, tt.eventType)
+			if len(events) != len(tt.want) {
+				t.Fatalf("expected %d events, got %d", len(tt.want), len(events))
+			}
+			for i, event := range events {
+				if event.HostnameCount != tt.want[i] {
+					t.Fatalf("event %d: expected %d, got %d", i, tt.want[i], event.HostnameCount)
+				}
+			}
+		})
+	}
+}
+
+func TestEmailAlertsRenderDiffAndRateLimit(t *testing.T) {
+	config := &Config{}
+	config.Email.Host = "smtp.example.com"
+	config.Email.From = "dnsres@example.com"
+	config.Email.To = []string{"ops@example.com", "oncall@example.com"}
+	config.Email.RateLimit = 2
+	if err := validateEmail(config); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	alerter, err := newEmailAlerter(config)
+	if err != nil {
+		t.Fatalf("newEmailAlerter: %v", err)
+	}
+	var sent []string
+	alerter.send = func(_ context.Context, _ EmailConfig, message []byte) error {
+		sent = append(sent, string(message))
+		return nil
+	}
+	resolver := &DNSResolver{config: config, email: alerter, errorLog: log.New(io.Discard, "", 0)}
+
+	event := ResolverEvent{
+		Type:     EventInconsistent,
+		Time:     time.Now(),
+		Hostname: "www.example.com",
+		Detail:   "1.1.1.1:53: 10.0.0.1\n8.8.8.8:53: 10.0.0.2",
+	}
+	for i := 0; i < 3; i++ {
+		resolver.emailEvent(context.Background(), event)
+	}
+	if len(sent) != 2 {
+		t.Fatalf("expected the rate limit to allow 2 alerts, got %d", len(sent))
+	}
+	message := sent[0]
+	for _, want := range []string{
+		"To: ops@example.com, oncall@example.com\r\n",
+		"Subject: [dnsres] inconsistent www.example.com\r\n",
+		"8.8.8.8:53: 10.0.0.2\r\n",
+	} {
+		if !strings.Contains(message, want) {
+			t.Fatalf("expected message to contain %q, got:\n%s", want, message)
+		}
+	}
+
+	// Once the window passes, the next alert reports what was suppressed.
+	alerter.sent = nil
+	resolver.emailEvent(context.Background(), event)
+	if len(sent) != 3 || !strings.Contains(sent[2], "1 earlier alerts were suppressed") {
+		t.Fatalf("expected suppressed count in next alert, got %q", sent[len(sent)-1])
+	}
+
+	config.Email.TLS = "ssl"
+	if err := validateEmail(config); err == nil {
+		t.Fatal("expected invalid tls mode to fail validation")
+	}
+	config.Email.TLS = ""
+	config.Email.Body = "{{.Hostname"
+	if err := validateEmail(config); err == nil || !strings.Contains(err.Error(), "body template") {
+		t.Fatalf("expected body template error, got %v", err)
+	}
+}
+
+func TestSendSMTP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	received := make(chan []string, 1)
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+		reply("220 test ESMTP")
+		var commands []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			commands = append(commands, line)
+			switch {
+			case strings.HasPrefix(line, "EHLO"):
+				reply("250 test")
+			case line == "DATA":
+				reply("354 go ahead")
+				for {
+					data, err := reader.ReadString('\n')
+					if err != nil || data == ".\r\n" {
+						break
+					}
+				}
+				reply("250 queued")
+			case line == "QUIT":
+				reply("221 bye")
+				received <- commands
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	config := EmailConfig{Host: host, TLS: EmailTLSNone, From: "dnsres@example.com", To: []string{"ops@example.com"}}
+	config.Port, _ = strconv.Atoi(port)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sendSMTP(ctx, config, []byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("sendSMTP: %v", err)
+	}
+	commands := <-received
+	want := []string{"MAIL FROM:<dnsres@example.com>", "RCPT TO:<ops@example.com>", "DATA", "QUIT"}
+	for _, command := range want {
+		found := false
+		for _, got := range commands {
+			if strings.HasPrefix(got, command) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("expected %q in SMTP session, got %v", command, commands)
+		}
+	}
+
+	config.TLS = EmailTLSStartTLS
+	if err := sendSMTP(ctx, config, nil); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("expected an error from a server without STARTTLS, got %v", err)
+	}
+}
+
+func TestDeliverScheduledReport(t *testing.T) {
+	posted := make(map[string]map[string]any)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var payload map[string]any
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			t.Errorf("decode %s: %v", req.URL.Path, err)
+		}
+		posted[req.URL.Path] = payload
+	}))
+	defer server.Close()
+
+	config := &Config{}
+	config.Email.Host = "smtp.example.com"
+	config.Email.From = "dnsres@example.com"
+	config.Email.To = []string{"ops@example.com"}
+	config.Reports.Schedule = "@weekly"
+	config.Reports.By = ReportByServer
+	config.Reports.Email = true
+	config.Reports.WebhookURL = server.URL + "/report"
+	config.Reports.SlackWebhookURL = server.URL + "/slack"
+	if err := validateReports(config); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	alerter, err := newEmailAlerter(config)
+	if err != nil {
+		t.Fatalf("newEmailAlerter: %v", err)
+	}
+	var sent []string
+	alerter.send = func(_ context.Context, _ EmailConfig, message []byte) error {
+		sent = append(sent, string(message))
+		return nil
+	}
+	resolver := &DNSResolver{
+		config:   config,
+		email:    alerter,
+		errorLog: log.New(io.Discard, "", 0),
+		stats:    &ResolutionStats{StartTime: time.Now(), Stats: map[string]*ServerStats{"1.1.1.1:53": {Total: 10}}},
+	}
+
+	resolver.deliverReport(context.Background(), time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local))
+	if len(sent) != 1 || !strings.Contains(sent[0], "Subject: [dnsres] dnsres report 2026-10-18 00:00\r\n") || !strings.Contains(sent[0], "1.1.1.1:53") {
+		t.Fatalf("expected the report to be emailed, got %q", sent)
+	}
+	if report, _ := posted["/report"]["report"].(string); !strings.Contains(report, "DNS Server") || posted["/report"]["by"] != ReportByServer {
+		t.Fatalf("expected the report posted to the webhook, got %v", posted["/report"])
+	}
+	if text, _ := posted["/slack"]["text"].(string); !strings.Contains(text, "```\n") || !strings.Contains(text, "1.1.1.1:53") {
+		t.Fatalf("expected the report posted to slack in a code block, got %v", posted["/slack"])
+	}
+
+	config.Email.Host = ""
+	if err := validateReports(config); err == nil {
+		t.Fatal("expected reports email without an email host to fail validation")
+	}
+	config.Email.Host = "smtp.example.com"
+	config.Reports.SlackWebhookURL = "hooks.slack.com/services/x"
+	if err := validateReports(config); err == nil || !strings.Contains(err.Error(), "slack_webhook_url") {
+		t.Fatalf("expected invalid slack webhook error, got %v", err)
+	}
+}
+
+type recordingPublisher struct {
+	topics   []string
+	payloads [][]byte
+	err      error
+	closed   bool
+}
+
+func (p *recordingPublisher) Publish(topic string, payload []byte) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.topics = append(p.topics, topic)
+	p.payloads = append(p.payloads, payload)
+	return nil
+}
+
+func (p *recordingPublisher) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestPublishEventRedialsAfterFailure(t *testing.T) {
+	config := &Config{}
+	config.Publish.Backend = pubsub.NATS
+	config.Publish.Address = "127.0.0.1:4222"
+	config.Publish.Topic = "dnsres.{type}"
+	if err := validatePublish(config); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	resolver := &DNSResolver{config: config, errorLog: log.New(io.Discard, "", 0)}
+
+	conn := &recordingPublisher{}
+	dials := 0
+	publisher := &eventPublisher{
+		config: config.Publish,
+		dial: func(_ context.Context, backend string, opts pubsub.Options) (pubsub.Publisher, error) {
+			dials++
+			if backend != pubsub.NATS || opts.Address != "127.0.0.1:4222" {
+				t.Errorf("unexpected dial %s %+v", backend, opts)
+			}
+			return conn, nil
+		},
+	}
+	event := ResolverEvent{Type: EventInconsistent, Hostname: "www.example.com"}
+	resolver.publishEvent(context.Background(), publisher, event)
+	resolver.publishEvent(context.Background(), publisher, event)
+	if dials != 1 || len(conn.topics) != 2 || conn.topics[0] != "dnsres.inconsistent" {
+		t.Fatalf("expected two publishes to dnsres.inconsistent over one connection, got dials=%d topics=%v", dials, conn.topics)
+	}
+	var decoded ResolverEvent
+	if err := json.Unmarshal(conn.payloads[0], &decoded); err != nil || decoded.Hostname != "www.example.com" {
+		t.Fatalf("expected JSON event payload, got %s (%v)", conn.payloads[0], err)
+	}
+
+	// A failed publish drops the connection and the next event redials.
+	conn.err = errors.New("broken pipe")
+	resolver.publishEvent(context.Background(), publisher, event)
+	if !conn.closed || publisher.conn != nil {
+		t.Fatal("expected the failed connection to be closed")
+	}
+	conn.err = nil
+	resolver.publishEvent(context.Background(), publisher, event)
+	if dials != 2 || len(conn.topics) != 3 {
+		t.Fatalf("expected a redial and publish, got dials=%d topics=%v", dials, conn.topics)
+	}
+
+	config.Publish.Backend = "kafka"
+	if err := validatePublish(config); err == nil {
+		t.Fatal("expected unknown backend to fail validation")
+	}
+}
@@ -0,0 +1,227 @@
+package dnsres
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// fingerprintProbeNames are the CHAOS TXT names used to identify resolver
+// software. Servers that hide their version still answer with distinctive
+// rcodes, which become part of the behavioral signature.
+var fingerprintProbeNames = []string{"version.bind.", "version.server.", "authors.bind."}
+
+// implementationMarkers maps substrings of version strings to implementations.
+var implementationMarkers = []struct {
+	marker string
+	name   string
+}{
+	{"unbound", "Unbound"},
+	{"powerdns", "PowerDNS"},
+	{"knot", "Knot Resolver"},
+	{"dnsmasq", "dnsmasq"},
+	{"nsd", "NSD"},
+	{"coredns", "CoreDNS"},
+	{"microsoft", "Microsoft DNS"},
+	{"bind", "BIND"},
+}
+
+// Fingerprint describes the resolver software inferred for a server.
+type Fingerprint struct {
+	Implementation string    `json:"implementation"`
+	Version        string    `json:"version,omitempty"`
+	Signature      string    `json:"signature"`
+	Changes        int       `json:"changes"`
+	LastChecked    time.Time `json:"last_checked"`
+}
+
+// fingerprintTracker keeps the latest fingerprint per server.
+type fingerprintTracker struct {
+	mu           sync.Mutex
+	fingerprints map[string]*Fingerprint
+}
+
+func newFingerprintTracker() *fingerprintTracker {
+	return &fingerprintTracker{fingerprints: make(map[string]*Fingerprint)}
+}
+
+// record stores fp for server and returns the previous fingerprint when the
+// signature changed.
+func (t *fingerprintTracker) record(server string, fp Fingerprint) (Fingerprint, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current, ok := t.fingerprints[server]
+	if !ok {
+		stored := fp
+		t.fingerprints[server] = &stored
+		return Fingerprint{}, false
+	}
+	previous := *current
+	changes := current.Changes
+	*current = fp
+	current.Changes = changes
+	if previous.Signature == fp.Signature {
+		return Fingerprint{}, false
+	}
+	current.Changes++
+	return previous, true
+}
+
+func (t *fingerprintTracker) snapshot() map[string]Fingerprint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := make(map[string]Fingerprint, len(t.fingerprints))
+	for server, fp := range t.fingerprints {
+		snapshot[server] = *fp
+	}
+	return snapshot
+}
+
+// FingerprintSnapshot returns the resolver software inferred for each server.
+func (r *DNSResolver) FingerprintSnapshot() map[string]Fingerprint {
+	if r.fingerprints == nil {
+		return map[string]Fingerprint{}
+	}
+	return r.fingerprints.snapshot()
+}
+
+// probeFingerprint runs the CHAOS version probes against server and
+// classifies the answers. It fails when any probe gets no answer, since a
+// signature missing a probe would read as a change of software.
+func (r *DNSResolver) probeFingerprint(ctx context.Context, server string) (Fingerprint, error) {
+	client, err := r.getClient(server)
+	if err != nil {
+		return Fingerprint{}, fmt.Errorf("failed to get client from pool: %w", err)
+	}
+	defer r.putClient(server, client)
+
+	answers := make(map[string]string, len(fingerprintProbeNames))
+	rcodes := make(map[string]string, len(fingerprintProbeNames))
+	for _, name := range fingerprintProbeNames {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeTXT)
+		msg.Question[0].Qclass = dns.ClassCHAOS
+		msg.RecursionDesired = false
+
+		response, _, err := client.ExchangeContext(ctx, msg, server)
+		if err != nil {
+			return Fingerprint{}, fmt.Errorf("fingerprint probe %s failed: %w", strings.TrimSuffix(name, "."), err)
+		}
+		rcodes[name] = dns.RcodeToString[response.Rcode]
+		for _, answer := range response.Answer {
+			if txt, ok := answer.(*dns.TXT); ok && len(txt.Txt) > 0 {
+				answers[name] = strings.Join(txt.Txt, " ")
+				break
+			}
+		}
+	}
+	return classifyFingerprint(answers, rcodes), nil
+}
+
+// classifyFingerprint infers the implementation from version strings, falling
+// back to the rcode pattern when the server hides its version.
+func classifyFingerprint(answers, rcodes map[string]string) Fingerprint {
+	names := make([]string, 0, len(rcodes))
+	for name := range rcodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		value := rcodes[name]
+		if answer, ok := answers[name]; ok {
+			value = fmt.Sprintf("%q", answer)
+		}
+		parts = append(parts, fmt.Sprintf("%s=%s", strings.TrimSuffix(name, "."), value))
+	}
+
+	fp := Fingerprint{
+		Implementation: "unknown",
+		Signature:      strings.Join(parts, ","),
+		LastChecked:    time.Now(),
+	}
+
+	version := answers["version.bind."]
+	if version == "" {
+		version = answers["version.server."]
+	}
+	if version != "" {
+		fp.Version = version
+		lower := strings.ToLower(version)
+		for _, candidate := range implementationMarkers {
+			if strings.Contains(lower, candidate.marker) {
+				fp.Implementation = candidate.name
+				break
+			}
+		}
+		return fp
+	}
+	if _, ok := answers["authors.bind."]; ok {
+		fp.Implementation = "BIND"
+		return fp
+	}
+	if rcodes["version.bind."] == "REFUSED" || rcodes["version.bind."] == "NOTIMP" {
+		fp.Implementation = "hidden"
+	}
+	return fp
+}
+
+// fingerprintServers probes every server that enables fingerprinting.
+func (r *DNSResolver) fingerprintServers(ctx context.Context) {
+	config := r.currentConfig()
+	var wg sync.WaitGroup
+	for _, server := range config.DNSServers {
+		if !config.Settings(server).Fingerprint {
+			continue
+		}
+		wg.Add(1)
+		go func(s string) {
+			defer wg.Done()
+			fp, err := r.probeFingerprint(ctx, s)
+			if err != nil {
+				r.appLogf(instrumentation.Medium, "fingerprint probe failed server=%s err=%v", s, err)
+				return
+			}
+			r.recordFingerprint(s, fp)
+		}(server)
+	}
+	wg.Wait()
+}
+
+// recordFingerprint stores fp and flags silent resolver migrations.
+func (r *DNSResolver) recordFingerprint(server string, fp Fingerprint) {
+	if r.fingerprints == nil {
+		return
+	}
+	previous, changed := r.fingerprints.record(server, fp)
+	if !changed {
+		return
+	}
+	metrics.DNSServerFingerprintChanges.WithLabelValues(server).Inc()
+	r.appLogf(
+		instrumentation.Low,
+		"resolver fingerprint change server=%s from=%s to=%s",
+		server,
+		previous.Implementation,
+		fp.Implementation,
+	)
+	r.errorLog.Printf("Resolver software for %s changed: %s -> %s", server, previous.Signature, fp.Signature)
+	r.emitEvent(ResolverEvent{
+		Type:   EventFingerprintChange,
+		Time:   fp.LastChecked,
+		Server: server,
+		Detail: fmt.Sprintf("%s -> %s", previous.Signature, fp.Signature),
+		Source: fp.Implementation,
+	})
+}
@@ -0,0 +1,205 @@
+package dnsres
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dnsres/dnsanalysis"
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+)
+
+// Flap detection defaults used when the flapping section leaves them unset.
+const (
+	defaultFlapWindow  = 10
+	defaultFlapChanges = 3
+)
+
+// flapWindow returns how many recent answers per server flap detection
+// examines.
+func (c *Config) flapWindow() int {
+	if c.Flapping.Window <= 0 {
+		return defaultFlapWindow
+	}
+	return c.Flapping.Window
+}
+
+// flapChanges returns how many answer changes within the window mark a
+// server flapping.
+func (c *Config) flapChanges() int {
+	if c.Flapping.Changes <= 0 {
+		return defaultFlapChanges
+	}
+	return c.Flapping.Changes
+}
+
+func validateFlapping(c *Config) error {
+	var problems configProblems
+	problems.check(c.Flapping.Window >= 0, "flapping.window", "must not be negative")
+	problems.check(c.Flapping.Changes >= 0, "flapping.changes", "must not be negative")
+	problems.check(c.Flapping.Changes != 1, "flapping.changes", "must be at least 2")
+	if c.Flapping.Window >= 0 && c.Flapping.Changes >= 0 {
+		problems.check(c.flapChanges() < c.flapWindow(), "flapping.changes", fmt.Sprintf("must be less than the window of %d", c.flapWindow()))
+	}
+	return problems.err()
+}
+
+// FlapStatus describes a hostname whose answers are flapping.
+type FlapStatus struct {
+	Since time.Time `json:"since"`
+	// Servers are the servers whose answers alternate.
+	Servers []string `json:"servers"`
+	Detail  string   `json:"detail"`
+}
+
+// flapHistory holds a hostname's recent answers, oldest first, per server.
+type flapHistory struct {
+	answers map[string][]string
+	status  *FlapStatus
+}
+
+// flapTracker classifies hostnames as flapping from their answer history.
+type flapTracker struct {
+	mu        sync.Mutex
+	hostnames map[string]*flapHistory
+}
+
+func newFlapTracker() *flapTracker {
+	return &flapTracker{hostnames: make(map[string]*flapHistory)}
+}
+
+// record adds each server's answer for hostname, keeping the last window,
+// and returns the hostname's status afterwards (nil when it is not flapping)
+// and whether it started or stopped flapping.
+func (t *flapTracker) record(hostname string, responses []*dnsanalysis.DNSResponse, window, changes int, now time.Time) (*FlapStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	history, ok := t.hostnames[hostname]
+	if !ok {
+		history = &flapHistory{answers: make(map[string][]string)}
+		t.hostnames[hostname] = history
+	}
+
+	for _, response := range responses {
+		addresses := slices.Clone(response.Addresses)
+		sort.Strings(addresses)
+		answers := append(history.answers[response.Server], strings.Join(addresses, " "))
+		if len(answers) > window {
+			answers = answers[len(answers)-window:]
+		}
+		history.answers[response.Server] = answers
+	}
+
+	var servers, details []string
+	for server, answers := range history.answers {
+		if count, distinct := flapping(answers); count >= changes && distinct > 0 {
+			servers = append(servers, server)
+			details = append(details, fmt.Sprintf("%s alternated between %d answers (%d changes in the last %d)", server, distinct, count, len(answers)))
+		}
+	}
+	sort.Strings(servers)
+	sort.Strings(details)
+
+	was := history.status
+	if len(servers) == 0 {
+		history.status = nil
+		return nil, was != nil
+	}
+	status := &FlapStatus{Since: now, Servers: servers, Detail: strings.Join(details, "; ")}
+	if was != nil {
+		status.Since = was.Since
+	}
+	history.status = status
+	copied := *status
+	return &copied, was == nil
+}
+
+// flapping counts the changes between consecutive answers and, when at
+// least one change returned to an answer seen before it, the distinct
+// answers. A run of new answers, as during a migration, is not flapping and
+// counts 0 distinct answers.
+func flapping(answers []string) (changes, distinct int) {
+	revisited := false
+	for i := 1; i < len(answers); i++ {
+		if answers[i] == answers[i-1] {
+			continue
+		}
+		changes++
+		if slices.Contains(answers[:i-1], answers[i]) {
+			revisited = true
+		}
+	}
+	if !revisited {
+		return changes, 0
+	}
+	seen := make(map[string]struct{}, len(answers))
+	for _, answer := range answers {
+		seen[answer] = struct{}{}
+	}
+	return changes, len(seen)
+}
+
+func (t *flapTracker) snapshot() map[string]FlapStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	snapshot := make(map[string]FlapStatus)
+	for hostname, history := range t.hostnames {
+		if history.status != nil {
+			snapshot[hostname] = *history.status
+		}
+	}
+	return snapshot
+}
+
+// FlapSnapshot returns the hostnames whose answers are currently flapping.
+func (r *DNSResolver) FlapSnapshot() map[string]FlapStatus {
+	if r.flaps == nil {
+		return map[string]FlapStatus{}
+	}
+	return r.flaps.snapshot()
+}
+
+// detectFlapping records hostname's answers and raises flap_start when a
+// server's answers begin alternating between sets, and flap_end when they
+// settle.
+func (r *DNSResolver) detectFlapping(hostname string, responses []*dnsanalysis.DNSResponse) {
+	config := r.currentConfig()
+	if r.flaps == nil || len(responses) == 0 {
+		return
+	}
+	now := time.Now()
+	status, changed := r.flaps.record(hostname, responses, config.flapWindow(), config.flapChanges(), now)
+	if status != nil {
+		metrics.DNSResolutionFlapping.WithLabelValues(r.metricHostname(hostname)).Set(1)
+	} else {
+		metrics.DNSResolutionFlapping.WithLabelValues(r.metricHostname(hostname)).Set(0)
+	}
+	if !changed {
+		return
+	}
+	if status == nil {
+		r.appLogf(instrumentation.Low, "flapping end hostname=%s", hostname)
+		r.emitEvent(ResolverEvent{
+			Type:     EventFlapEnd,
+			Time:     now,
+			Hostname: hostname,
+		})
+		return
+	}
+	r.appLogf(instrumentation.Low, "flapping start hostname=%s servers=%s", hostname, strings.Join(status.Servers, ","))
+	r.errorLog.Printf("Flapping answers for %s: %s", hostname, status.Detail)
+	event := ResolverEvent{
+		Type:     EventFlapStart,
+		Time:     now,
+		Hostname: hostname,
+		Detail:   status.Detail,
+	}
+	if len(status.Servers) == 1 {
+		event.Server = status.Servers[0]
+	}
+	r.emitEvent(event)
+}
@@ -0,0 +1,187 @@
+package dnsres
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"dnsres/dnsanalysis"
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// forwarderDisagreementText is attached as an extended DNS error (RFC 8914)
+// when the upstreams did not agree on the answer.
+const forwarderDisagreementText = "dnsres: upstream answers disagree"
+
+// startForwarder serves DNS on conn (UDP) and listener (TCP) until ctx is
+// canceled. A queries for monitored hostnames are answered from the cache or
+// by the consensus of the upstreams; other queries are passed through to the
+// first upstream that answers.
+func (r *DNSResolver) startForwarder(ctx context.Context, conn net.PacketConn, listener net.Listener) {
+	addr := r.currentConfig().forwarderAddr()
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if err := w.WriteMsg(r.answerForwarded(ctx, req)); err != nil {
+			r.appLogf(instrumentation.Medium, "forwarder write failed err=%v", err)
+		}
+	})
+
+	servers := []*dns.Server{
+		{PacketConn: conn, Net: "udp", Handler: handler},
+		{Listener: listener, Net: "tcp", Handler: handler},
+	}
+	r.outputf("DNS forwarder listening on %s (udp, tcp)\n", addr)
+	r.appLogf(instrumentation.Low, "dns forwarder starting on %s", addr)
+
+	for _, server := range servers {
+		go func(s *dns.Server) {
+			if err := s.ActivateAndServe(); err != nil {
+				r.appLog.Printf("DNS forwarder %s error: %v", s.Net, err)
+			}
+		}(server)
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, server := range servers {
+			if err := server.ShutdownContext(shutdownCtx); err != nil {
+				r.appLog.Printf("DNS forwarder %s shutdown error: %v", server.Net, err)
+			}
+		}
+	}()
+}
+
+// answerForwarded builds the reply to a client query received by the
+// forwarder.
+func (r *DNSResolver) answerForwarded(ctx context.Context, req *dns.Msg) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.RecursionAvailable = true
+	if len(req.Question) != 1 {
+		reply.Rcode = dns.RcodeFormatError
+		return reply
+	}
+
+	question := req.Question[0]
+	if question.Qtype != dns.TypeA || question.Qclass != dns.ClassINET {
+		return r.passThrough(ctx, req)
+	}
+
+	// Only monitored hostnames go through resolveHostname: it records
+	// per-hostname metrics, stats and incidents, which would grow without
+	// bound if every name a client asks for were tracked.
+	hostname := strings.ToLower(strings.TrimSuffix(question.Name, "."))
+	if !slices.Contains(r.monitoredHostnames(), hostname) {
+		return r.passThrough(ctx, req)
+	}
+	if cached, ok := r.cachedAnswer(hostname); ok {
+		metrics.DNSResForwarderQueries.WithLabelValues("cache").Inc()
+		r.appLogf(instrumentation.High, "forwarder cache hit hostname=%s", hostname)
+		reply.Rcode = cachedRcode(cached)
+		reply.Answer = answerRecords(question.Name, cached.Addresses, cached.TTL)
+		return reply
+	}
+
+	responses := r.resolveHostname(ctx, hostname)
+	if len(responses) == 0 {
+		metrics.DNSResForwarderQueries.WithLabelValues("servfail").Inc()
+		r.appLogf(instrumentation.Medium, "forwarder no upstream answer hostname=%s", hostname)
+		reply.Rcode = dns.RcodeServerFailure
+		return reply
+	}
+
+	// Answer with the majority address set; resolveHostname has already
+	// logged and emitted any inconsistency.
+	diff := dnsanalysis.DiffResponses(hostname, responses, nil)
+	reply.Answer = answerRecords(question.Name, diff.BaselineAddresses, diff.BaselineTTL)
+	if diff.Consistent() {
+		metrics.DNSResForwarderQueries.WithLabelValues("consensus").Inc()
+		return reply
+	}
+
+	metrics.DNSResForwarderQueries.WithLabelValues("disagreement").Inc()
+	r.appLogf(instrumentation.Medium, "forwarder answered with consensus despite disagreement hostname=%s", hostname)
+	if req.IsEdns0() != nil {
+		reply.SetEdns0(4096, false)
+		opt := reply.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeOther,
+			ExtraText: forwarderDisagreementText,
+		})
+	}
+	return reply
+}
+
+// passThrough relays req to the primaries, in the order the selection policy
+// picks, then the fallbacks, returning the first upstream reply.
+func (r *DNSResolver) passThrough(ctx context.Context, req *dns.Msg) *dns.Msg {
+	answer, _, err := r.queryHedged(ctx, r.selectServers(), r.currentConfig().Querying.HedgeDelay.Duration, func(ctx context.Context, server string) (any, error) {
+		breaker := r.breaker(server)
+		if breaker == nil {
+			return nil, fmt.Errorf("%s is no longer configured", server)
+		}
+		if !breaker.Allow() {
+			return nil, fmt.Errorf("circuit breaker open for %s", server)
+		}
+		release, err := r.acquireSlot(ctx, server)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		client, err := r.getClient(server)
+		if err != nil {
+			return nil, err
+		}
+		response, err := r.exchangeWithDeadline(ctx, client, server, req.Copy())
+		r.putClient(server, client)
+		if err != nil && ctx.Err() == nil {
+			r.appLogf(instrumentation.Medium, "forwarder pass-through failed server=%s err=%v", server, err)
+		}
+		return response, err
+	})
+	if err == nil {
+		metrics.DNSResForwarderQueries.WithLabelValues("forwarded").Inc()
+		response := answer.(*dns.Msg)
+		response.Id = req.Id
+		return response
+	}
+
+	metrics.DNSResForwarderQueries.WithLabelValues("servfail").Inc()
+	reply := new(dns.Msg)
+	reply.SetRcode(req, dns.RcodeServerFailure)
+	return reply
+}
+
+// exchangeWithDeadline sends msg to server bounded by its query timeout.
+func (r *DNSResolver) exchangeWithDeadline(ctx context.Context, client dnsClient, server string, msg *dns.Msg) (*dns.Msg, error) {
+	if timeout := r.currentConfig().QueryTimeoutFor(server); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	response, _, err := client.ExchangeContext(ctx, msg, server)
+	return response, err
+}
+
+// answerRecords builds A records for addresses, skipping any that are not
+// IPv4.
+func answerRecords(name string, addresses []string, ttl uint32) []dns.RR {
+	records := make([]dns.RR, 0, len(addresses))
+	for _, address := range addresses {
+		ip := net.ParseIP(address).To4()
+		if ip == nil {
+			continue
+		}
+		records = append(records, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   ip,
+		})
+	}
+	return records
+}
@@ -0,0 +1,91 @@
+package dnsres
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"dnsres/dnsanalysis"
+	"dnsres/internal/geoip"
+)
+
+// geoAnalyzer names unexpected-location findings.
+const geoAnalyzer = "geoip"
+
+// geoLookup resolves an address to its GeoIP data.
+type geoLookup interface {
+	Lookup(address string) geoip.Info
+}
+
+// lookupGeo returns GeoIP data for each address, or nil when no database is
+// configured.
+func (r *DNSResolver) lookupGeo(addresses []string) map[string]geoip.Info {
+	if r.geo == nil || len(addresses) == 0 {
+		return nil
+	}
+	geo := make(map[string]geoip.Info, len(addresses))
+	for _, address := range addresses {
+		geo[address] = r.geo.Lookup(address)
+	}
+	return geo
+}
+
+// FormatGeo renders per-address GeoIP data on one line, sorted by address,
+// e.g. "10.0.0.1=US AS64500".
+func FormatGeo(geo map[string]geoip.Info) string {
+	addresses := make([]string, 0, len(geo))
+	for address, info := range geo {
+		if info != (geoip.Info{}) {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+	parts := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		parts = append(parts, address+"="+geo[address].String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// geoLogSuffix is appended to success log lines when GeoIP data is known.
+func (r *DNSResolver) geoLogSuffix(addresses []string) string {
+	if formatted := FormatGeo(r.lookupGeo(addresses)); formatted != "" {
+		return " geo: " + formatted
+	}
+	return ""
+}
+
+// checkGeo flags answers located outside the countries or ASNs expected for
+// hostname. Addresses the databases do not know are not flagged.
+func (r *DNSResolver) checkGeo(hostname string, responses []*dnsanalysis.DNSResponse) {
+	if r.geo == nil {
+		return
+	}
+	expected, ok := r.currentConfig().geoExpectation(hostname)
+	if !ok {
+		return
+	}
+	for _, response := range responses {
+		for _, address := range response.Addresses {
+			info := r.geo.Lookup(address)
+			var problems []string
+			if len(expected.Countries) > 0 && info.Country != "" && !slices.Contains(expected.Countries, info.Country) {
+				problems = append(problems, fmt.Sprintf("country %s not in %s", info.Country, strings.Join(expected.Countries, ",")))
+			}
+			if len(expected.ASNs) > 0 && info.ASN != 0 && !slices.Contains(expected.ASNs, info.ASN) {
+				problems = append(problems, fmt.Sprintf("AS%d (%s) not expected", info.ASN, info.Organization))
+			}
+			if len(problems) == 0 {
+				continue
+			}
+			r.reportFinding(dnsanalysis.Finding{
+				Analyzer: geoAnalyzer,
+				Hostname: hostname,
+				Server:   response.Server,
+				Severity: dnsanalysis.SeverityWarning,
+				Message:  fmt.Sprintf("answer %s: %s", address, strings.Join(problems, "; ")),
+			})
+		}
+	}
+}
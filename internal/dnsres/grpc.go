@@ -0,0 +1,265 @@
+package dnsres
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/internal/grpc"
+	"dnsres/metrics"
+)
+
+// grpcService is the service name in proto/dnsres/v1/dnsres.proto.
+const grpcService = "dnsres.v1.Resolver"
+
+// GRPCConfig configures the gRPC API. It is served only when Port is set.
+type GRPCConfig struct {
+	Port int `json:"port"`
+	// CertFile and KeyFile, when set, serve TLS; otherwise the API speaks
+	// cleartext HTTP/2.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+}
+
+func validateGRPC(c *Config) error {
+	g := c.GRPC
+	var problems configProblems
+	problems.check(g.Port >= 0 && g.Port <= 65535, "grpc.port", "must be between 0 and 65535")
+	problems.check(g.Port == 0 || (g.Port != c.HealthPort && g.Port != c.MetricsPort), "grpc.port", "must differ from health_port and metrics_port")
+	problems.check(g.CertFile != "" || g.KeyFile == "", "grpc.cert_file", "must be set with grpc.key_file")
+	problems.check(g.KeyFile != "" || g.CertFile == "", "grpc.key_file", "must be set with grpc.cert_file")
+	return problems.err()
+}
+
+// startGRPC serves the gRPC API on listener until ctx is canceled.
+func (r *DNSResolver) startGRPC(ctx context.Context, listener net.Listener) error {
+	g := r.currentConfig().GRPC
+	server := &http.Server{
+		Handler:           r.grpcHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+		Protocols:         new(http.Protocols),
+		// Calls, including event streams, end when ctx is canceled.
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	if g.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(g.CertFile, g.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load grpc certificate: %w", err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		server.Protocols.SetHTTP2(true)
+	} else {
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	r.outputf("gRPC API listening on :%d\n", g.Port)
+	r.appLogf(instrumentation.Low, "grpc server starting on :%d tls=%t", g.Port, g.CertFile != "")
+
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			r.appLog.Printf("gRPC server error: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			r.appLog.Printf("gRPC server shutdown error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// grpcHandler routes the methods of the Resolver service.
+func (r *DNSResolver) grpcHandler() http.Handler {
+	server := grpc.NewServer(grpcService)
+	server.Observe = func(method string, code grpc.Code, elapsed time.Duration) {
+		metrics.DNSResGRPCRequests.WithLabelValues(method, code.String()).Inc()
+		r.appLogf(instrumentation.High, "grpc call method=%s code=%s duration=%s", method, code, elapsed)
+	}
+	server.Unary("GetStats", func(ctx context.Context, req []byte) ([]byte, error) {
+		return encodeStats(r.StatsSnapshot()), nil
+	})
+	server.Unary("GetHealth", func(ctx context.Context, req []byte) ([]byte, error) {
+		return encodeHealth(r.HealthSnapshot()), nil
+	})
+	server.Unary("ListEvents", r.grpcListEvents)
+	server.Stream("StreamEvents", r.grpcStreamEvents)
+	server.Unary("ListAudit", func(ctx context.Context, req []byte) ([]byte, error) {
+		fields, err := parseRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		limit, err := fields.limit(1)
+		if err != nil {
+			return nil, err
+		}
+		return encodeAudit(r.RecentAudit(limit)), nil
+	})
+	server.Unary("ListIncidents", func(ctx context.Context, req []byte) ([]byte, error) {
+		fields, err := parseRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		limit, err := fields.limit(1)
+		if err != nil {
+			return nil, err
+		}
+		return encodeIncidents(r.Incidents(limit, fields.bool(2))), nil
+	})
+	server.Unary("Lookup", r.grpcLookup)
+	server.Unary("TriggerBurst", r.grpcTriggerBurst)
+	server.Unary("CaptureQueries", r.grpcCaptureQueries)
+	server.Unary("TriggerCycle", r.grpcTriggerCycle)
+	return server
+}
+
+func (r *DNSResolver) grpcListEvents(ctx context.Context, req []byte) ([]byte, error) {
+	fields, err := parseRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := fields.limit(1)
+	if err != nil {
+		return nil, err
+	}
+	return encodeEvents(r.RecentEvents(limit, EventType(fields.string(2)))), nil
+}
+
+// grpcStreamEvents sends the events that pass the request's filter until the
+// call is canceled. Events are dropped, and counted as such, when the client
+// reads too slowly.
+func (r *DNSResolver) grpcStreamEvents(ctx context.Context, req []byte, send func([]byte) error) error {
+	fields, err := parseRequest(req)
+	if err != nil {
+		return err
+	}
+	filter := EventFilter{Types: eventTypes(fields.bytes[1]), Hostnames: fields.bytes[2], Servers: fields.bytes[3]}
+	events, unsubscribe := r.SubscribeEventsWithOptions(SubscribeOptions{Name: "grpc", Filter: filter})
+	defer unsubscribe()
+	if events == nil {
+		return grpc.Errorf(grpc.Unavailable, "events are not available")
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := send(encodeEvent(event)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *DNSResolver) grpcLookup(ctx context.Context, req []byte) ([]byte, error) {
+	fields, err := parseRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	hostname := NormalizeHostname(fields.string(1))
+	if hostname == "" {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "hostname must be set")
+	}
+	response, err := r.Lookup(ctx, hostname)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, grpc.Errorf(grpc.Unavailable, "%v", err)
+	}
+	return encodeLookup(response), nil
+}
+
+// grpcTriggerBurst starts or extends a burst for a monitored hostname and
+// records the action in the audit log.
+func (r *DNSResolver) grpcTriggerBurst(ctx context.Context, req []byte) ([]byte, error) {
+	fields, err := parseRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if r.bursts == nil {
+		return nil, grpc.Errorf(grpc.FailedPrecondition, "bursts are disabled")
+	}
+	hostname := NormalizeHostname(fields.string(1))
+	if !slices.Contains(r.monitoredHostnames(), hostname) {
+		return nil, grpc.Errorf(grpc.NotFound, "hostname %q is not monitored", hostname)
+	}
+	reason := fields.string(2)
+	if reason == "" {
+		reason = "requested over grpc"
+	}
+
+	r.triggerBurst(hostname, reason)
+	r.bursts.mu.Lock()
+	until := r.bursts.until[hostname]
+	r.bursts.mu.Unlock()
+
+	actor := "grpc"
+	if host, _, err := net.SplitHostPort(grpc.Peer(ctx)); err == nil {
+		actor += " " + host
+	}
+	r.RecordAudit(actor, "burst", hostname, "", "until "+until.Format(time.RFC3339)+" ("+reason+")")
+	return appendTimestamp(nil, 1, until), nil
+}
+
+// grpcCaptureQueries arms or cancels a wire-format capture and records the
+// action in the audit log.
+func (r *DNSResolver) grpcCaptureQueries(ctx context.Context, req []byte) ([]byte, error) {
+	fields, err := parseRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	hostname := NormalizeHostname(fields.string(1))
+	if hostname != "" && !slices.Contains(r.monitoredHostnames(), hostname) {
+		return nil, grpc.Errorf(grpc.NotFound, "hostname %q is not monitored", hostname)
+	}
+	count := int(int32(fields.varints[2]))
+	previous := r.PendingCaptures()[hostname]
+	dir, err := r.CaptureQueries(hostname, count)
+	if err != nil {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "%v", err)
+	}
+
+	actor := "grpc"
+	if host, _, err := net.SplitHostPort(grpc.Peer(ctx)); err == nil {
+		actor += " " + host
+	}
+	target := hostname
+	if target == "" {
+		target = "*"
+	}
+	r.RecordAudit(actor, "capture", target, strconv.Itoa(previous), strconv.Itoa(count))
+	return appendString(nil, 1, dir), nil
+}
+
+// grpcTriggerCycle starts a resolution cycle now and returns when the next
+// scheduled one is due.
+func (r *DNSResolver) grpcTriggerCycle(ctx context.Context, req []byte) ([]byte, error) {
+	if _, err := parseRequest(req); err != nil {
+		return nil, err
+	}
+	actor := "grpc"
+	if host, _, err := net.SplitHostPort(grpc.Peer(ctx)); err == nil {
+		actor += " " + host
+	}
+	if err := r.TriggerCycle(actor); err != nil {
+		return nil, grpc.Errorf(grpc.FailedPrecondition, "%v", err)
+	}
+	return appendTimestamp(nil, 1, r.NextCycle()), nil
+}
@@ -0,0 +1,346 @@
+package dnsres
+
+import (
+	"sort"
+	"time"
+
+	"dnsres/dnsanalysis"
+	"dnsres/health"
+	"dnsres/internal/geoip"
+	"dnsres/internal/grpc"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Protobuf encoding of the messages in proto/dnsres/v1/dnsres.proto. Field
+// numbers here must match the .proto file. Scalars at their zero value are
+// omitted, as proto3 does.
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendStrings(b []byte, num protowire.Number, values []string) []byte {
+	for _, v := range values {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+	return b
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendInt(b []byte, num protowire.Number, v int) []byte {
+	return appendVarint(b, num, uint64(int64(v)))
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	return appendVarint(b, num, protowire.EncodeBool(v))
+}
+
+func appendMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+// appendTimestamp encodes t as a google.protobuf.Timestamp, omitting the
+// zero time.
+func appendTimestamp(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	var m []byte
+	m = appendVarint(m, 1, uint64(t.Unix()))
+	m = appendVarint(m, 2, uint64(t.Nanosecond()))
+	return appendMessage(b, num, m)
+}
+
+// appendDuration encodes d as a google.protobuf.Duration, omitting zero.
+func appendDuration(b []byte, num protowire.Number, d time.Duration) []byte {
+	if d == 0 {
+		return b
+	}
+	var m []byte
+	m = appendVarint(m, 1, uint64(int64(d/time.Second)))
+	m = appendVarint(m, 2, uint64(int64(d%time.Second)))
+	return appendMessage(b, num, m)
+}
+
+// appendMapEntry encodes one map entry; value is the entry's encoded value
+// field.
+func appendMapEntry(b []byte, num protowire.Number, key string, value []byte) []byte {
+	entry := protowire.AppendTag(nil, 1, protowire.BytesType)
+	entry = protowire.AppendString(entry, key)
+	return appendMessage(b, num, append(entry, value...))
+}
+
+// sortedKeys returns m's keys in order, so encodings are deterministic.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func appendStringMap(b []byte, num protowire.Number, m map[string]string) []byte {
+	for _, key := range sortedKeys(m) {
+		b = appendMapEntry(b, num, key, appendString(nil, 2, m[key]))
+	}
+	return b
+}
+
+func encodeStats(s StatsSnapshot) []byte {
+	var b []byte
+	b = appendTimestamp(b, 1, s.StartTime)
+	if !s.StartTime.IsZero() {
+		b = appendDuration(b, 2, time.Since(s.StartTime))
+	}
+	for _, server := range sortedKeys(s.Servers) {
+		stats := s.Servers[server]
+		var m []byte
+		m = appendInt(m, 1, stats.Total)
+		m = appendInt(m, 2, stats.Failures)
+		m = appendString(m, 3, stats.LastError)
+		b = appendMapEntry(b, 3, server, appendMessage(nil, 2, m))
+	}
+	for _, server := range sortedKeys(s.Nodes) {
+		node := s.Nodes[server]
+		var m []byte
+		m = appendString(m, 1, node.Node)
+		m = appendString(m, 2, node.Source)
+		m = appendInt(m, 3, node.Changes)
+		m = appendTimestamp(m, 4, node.LastSeen)
+		b = appendMapEntry(b, 4, server, appendMessage(nil, 2, m))
+	}
+	for _, server := range sortedKeys(s.Fingerprints) {
+		fp := s.Fingerprints[server]
+		var m []byte
+		m = appendString(m, 1, fp.Implementation)
+		m = appendString(m, 2, fp.Version)
+		m = appendString(m, 3, fp.Signature)
+		m = appendInt(m, 4, fp.Changes)
+		m = appendTimestamp(m, 5, fp.LastChecked)
+		b = appendMapEntry(b, 5, server, appendMessage(nil, 2, m))
+	}
+	b = appendStringMap(b, 6, s.DNS64)
+	for _, server := range sortedKeys(s.Interception) {
+		result := s.Interception[server]
+		var m []byte
+		m = appendBool(m, 1, result.NXDOMAINRedirect)
+		m = appendStrings(m, 2, result.RedirectAddrs)
+		m = appendBool(m, 3, result.CaptivePortal)
+		m = appendString(m, 4, result.PortalDetail)
+		m = appendTimestamp(m, 5, result.LastChecked)
+		b = appendMapEntry(b, 7, server, appendMessage(nil, 2, m))
+	}
+	for _, hostname := range sortedKeys(s.MDNS) {
+		result := s.MDNS[hostname]
+		var m []byte
+		m = appendStrings(m, 1, result.Addresses)
+		m = appendString(m, 2, result.Error)
+		m = appendString(m, 3, result.Duration)
+		m = appendTimestamp(m, 4, result.LastSeen)
+		b = appendMapEntry(b, 8, hostname, appendMessage(nil, 2, m))
+	}
+	for _, sub := range s.Subscribers {
+		var m []byte
+		m = appendInt(m, 1, sub.ID)
+		m = appendInt(m, 2, sub.Buffer)
+		m = appendBool(m, 3, sub.Durable)
+		m = appendInt(m, 4, sub.Queued)
+		m = appendVarint(m, 5, sub.Dropped)
+		b = appendMessage(b, 9, m)
+	}
+	var cycles []byte
+	cycles = appendInt(cycles, 1, s.Cycles.Completed)
+	cycles = appendInt(cycles, 2, s.Cycles.Skipped)
+	cycles = appendDuration(cycles, 3, s.Cycles.AverageDuration.Duration)
+	return appendMessage(b, 10, cycles)
+}
+
+func encodeHealth(snapshot map[string]health.ServerHealth) []byte {
+	var b []byte
+	for _, server := range sortedKeys(snapshot) {
+		b = appendMapEntry(b, 1, server, appendBool(nil, 2, snapshot[server].Healthy))
+	}
+	for _, server := range sortedKeys(snapshot) {
+		result := snapshot[server]
+		var m []byte
+		m = appendBool(m, 1, result.Healthy)
+		m = appendTimestamp(m, 2, result.LastCheck)
+		m = appendInt(m, 3, result.ConsecutiveFailures)
+		m = appendString(m, 4, result.LastLatency)
+		m = appendString(m, 5, result.LastError)
+		b = appendMapEntry(b, 2, server, appendMessage(nil, 2, m))
+	}
+	return b
+}
+
+func encodeEvent(event ResolverEvent) []byte {
+	var b []byte
+	b = appendString(b, 1, string(event.Type))
+	b = appendTimestamp(b, 2, event.Time)
+	b = appendString(b, 3, event.Hostname)
+	b = appendString(b, 4, event.Server)
+	b = appendDuration(b, 5, event.Duration)
+	b = appendString(b, 6, event.Error)
+	b = appendStrings(b, 7, event.Addresses)
+	for _, address := range sortedKeys(event.Geo) {
+		b = appendMapEntry(b, 8, address, appendMessage(nil, 2, encodeGeo(event.Geo[address])))
+	}
+	if event.Consistent != nil {
+		// An optional field is written even when false.
+		b = protowire.AppendTag(b, 9, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(*event.Consistent))
+	}
+	b = appendInt(b, 10, event.HostnameCount)
+	b = appendInt(b, 11, event.ServerCount)
+	b = appendString(b, 12, event.Source)
+	b = appendString(b, 13, event.Node)
+	b = appendString(b, 14, event.PreviousNode)
+	b = appendString(b, 15, event.Detail)
+	b = appendInt(b, 16, event.Dropped)
+	b = appendString(b, 17, event.QueryMode)
+	b = appendString(b, 18, event.Severity)
+	b = appendStringMap(b, 19, event.Labels)
+	return b
+}
+
+func encodeGeo(info geoip.Info) []byte {
+	var b []byte
+	b = appendString(b, 1, info.Country)
+	b = appendVarint(b, 2, uint64(info.ASN))
+	b = appendString(b, 3, info.Organization)
+	return b
+}
+
+func encodeEvents(events []ResolverEvent) []byte {
+	var b []byte
+	for _, event := range events {
+		b = appendMessage(b, 1, encodeEvent(event))
+	}
+	return b
+}
+
+func encodeAudit(entries []AuditEntry) []byte {
+	var b []byte
+	for _, entry := range entries {
+		var m []byte
+		m = appendTimestamp(m, 1, entry.Time)
+		m = appendString(m, 2, entry.Actor)
+		m = appendString(m, 3, entry.Action)
+		m = appendString(m, 4, entry.Target)
+		m = appendString(m, 5, entry.OldValue)
+		m = appendString(m, 6, entry.NewValue)
+		b = appendMessage(b, 1, m)
+	}
+	return b
+}
+
+func encodeIncidents(incidents []Incident) []byte {
+	var b []byte
+	for _, incident := range incidents {
+		var m []byte
+		m = appendInt(m, 1, incident.ID)
+		m = appendString(m, 2, incident.Hostname)
+		m = appendTimestamp(m, 3, incident.Started)
+		if incident.Ended != nil {
+			m = appendTimestamp(m, 4, *incident.Ended)
+		}
+		m = appendStrings(m, 5, incident.Causes)
+		m = appendStrings(m, 6, incident.Servers)
+		for _, event := range incident.Events {
+			m = appendMessage(m, 7, encodeEvent(event))
+		}
+		m = appendInt(m, 8, incident.DroppedEvents)
+		b = appendMessage(b, 1, m)
+	}
+	return b
+}
+
+func encodeLookup(response *dnsanalysis.DNSResponse) []byte {
+	var b []byte
+	b = appendString(b, 1, response.Server)
+	b = appendString(b, 2, response.Hostname)
+	b = appendStrings(b, 3, response.Addresses)
+	b = appendVarint(b, 4, uint64(response.TTL))
+	b = appendString(b, 5, response.Protocol)
+	b = appendDuration(b, 6, response.Duration)
+	b = appendBool(b, 7, response.DNSSEC)
+	return b
+}
+
+// protoRequest holds the fields of a request message: varints and
+// length-delimited values by field number. Repeated fields keep every value.
+type protoRequest struct {
+	varints map[protowire.Number]uint64
+	bytes   map[protowire.Number][]string
+}
+
+func parseRequest(b []byte) (protoRequest, error) {
+	req := protoRequest{varints: make(map[protowire.Number]uint64), bytes: make(map[protowire.Number][]string)}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return req, grpc.Errorf(grpc.InvalidArgument, "malformed request: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return req, grpc.Errorf(grpc.InvalidArgument, "malformed request: %v", protowire.ParseError(n))
+			}
+			req.varints[num] = v
+			b = b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return req, grpc.Errorf(grpc.InvalidArgument, "malformed request: %v", protowire.ParseError(n))
+			}
+			req.bytes[num] = append(req.bytes[num], string(v))
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return req, grpc.Errorf(grpc.InvalidArgument, "malformed request: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return req, nil
+}
+
+// string returns the last value of a string field.
+func (r protoRequest) string(num protowire.Number) string {
+	values := r.bytes[num]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+func (r protoRequest) bool(num protowire.Number) bool {
+	return r.varints[num] != 0
+}
+
+// limit returns an int32 limit field, rejecting negative values.
+func (r protoRequest) limit(num protowire.Number) (int, error) {
+	limit := int32(r.varints[num])
+	if limit < 0 {
+		return 0, grpc.Errorf(grpc.InvalidArgument, "invalid limit %d", limit)
+	}
+	return int(limit), nil
+}
@@ -0,0 +1,99 @@
+package dnsres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+)
+
+func validateHedge(c *Config) error {
+	if c.Querying.HedgeDelay.Duration < 0 {
+		return fmt.Errorf("invalid hedge delay: must not be negative")
+	}
+	return nil
+}
+
+// errNoServers is returned when there is no server to query.
+var errNoServers = errors.New("no DNS servers configured")
+
+// hedgedResult is one server's answer to a hedged query.
+type hedgedResult struct {
+	server string
+	value  any
+	err    error
+}
+
+// queryHedged queries servers in order until one answers, returning the first
+// answer and the server it came from. A server that fails passes the query
+// on to the next. With a positive delay, the query is also sent to the next
+// server once if the first has not answered within delay, and whichever
+// answers first wins. Queries still running when one wins are canceled.
+func (r *DNSResolver) queryHedged(ctx context.Context, servers []string, delay time.Duration, query func(context.Context, string) (any, error)) (any, string, error) {
+	if len(servers) == 0 {
+		return nil, "", errNoServers
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgedResult, len(servers))
+	next, running := 0, 0
+	send := func() {
+		server := servers[next]
+		next++
+		running++
+		go func() {
+			value, err := query(ctx, server)
+			results <- hedgedResult{server: server, value: value, err: err}
+		}()
+	}
+
+	send()
+	var hedge <-chan time.Time
+	if delay > 0 && next < len(servers) {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		hedge = timer.C
+	}
+	hedged := ""
+	var lastErr error
+	for running > 0 {
+		select {
+		case <-hedge:
+			hedge = nil
+			if next < len(servers) {
+				hedged = servers[next]
+				r.appLogf(instrumentation.Medium, "hedging query server=%s after=%s", hedged, delay)
+				send()
+			}
+		case result := <-results:
+			running--
+			if result.err == nil {
+				r.countHedge(hedged, result.server)
+				return result.value, result.server, nil
+			}
+			lastErr = result.err
+			if running == 0 && next < len(servers) && ctx.Err() == nil {
+				send()
+			}
+		}
+	}
+	r.countHedge(hedged, "")
+	return nil, "", lastErr
+}
+
+// countHedge counts a hedge sent to hedged, if any, by whether it answered
+// first.
+func (r *DNSResolver) countHedge(hedged, winner string) {
+	if hedged == "" {
+		return
+	}
+	result := "lost"
+	if hedged == winner {
+		result = "won"
+	}
+	metrics.DNSResolutionHedges.WithLabelValues(hedged, result).Inc()
+}
@@ -0,0 +1,103 @@
+package dnsres
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QueryInfo describes one upstream query. Msg is the message about to be
+// sent; pre-query hooks may modify it, for example to add EDNS options. Msg
+// is reused once the query completes, so hooks must copy it to keep it.
+// Metadata is shared by every hook for the query, so a pre-query hook can
+// leave values for a post-query hook.
+type QueryInfo struct {
+	Hostname string
+	Server   string
+	Msg      *dns.Msg
+	Metadata map[string]string
+}
+
+// QueryResult is the outcome of a query, passed to post-query hooks.
+// Response is nil when Err is set.
+type QueryResult struct {
+	QueryInfo
+	Response *dns.Msg
+	Duration time.Duration
+	// ShortCircuited is true when a pre-query hook supplied the response.
+	ShortCircuited bool
+	Err            error
+}
+
+// PreQueryHook runs before a query is sent. Returning a non-nil response
+// skips the network exchange and uses that response instead; returning an
+// error fails the query without counting against the server's circuit
+// breaker.
+type PreQueryHook func(ctx context.Context, info QueryInfo) (*dns.Msg, error)
+
+// PostQueryHook runs after every query, including short-circuited and
+// failed ones.
+type PostQueryHook func(ctx context.Context, result QueryResult)
+
+// queryHooks holds the hooks registered on a resolver, run in registration
+// order.
+type queryHooks struct {
+	mu   sync.RWMutex
+	pre  []PreQueryHook
+	post []PostQueryHook
+}
+
+// AddPreQueryHook registers a hook run before each upstream query.
+func (r *DNSResolver) AddPreQueryHook(hook PreQueryHook) {
+	r.hooks.mu.Lock()
+	defer r.hooks.mu.Unlock()
+	r.hooks.pre = append(r.hooks.pre, hook)
+}
+
+// AddPostQueryHook registers a hook run after each upstream query.
+func (r *DNSResolver) AddPostQueryHook(hook PostQueryHook) {
+	r.hooks.mu.Lock()
+	defer r.hooks.mu.Unlock()
+	r.hooks.post = append(r.hooks.post, hook)
+}
+
+// registered reports whether any hook is registered.
+func (h *queryHooks) registered() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.pre) > 0 || len(h.post) > 0
+}
+
+type queryInfoKey struct{}
+
+// QueryInfoFromContext returns the query a hook is running for, if any.
+func QueryInfoFromContext(ctx context.Context) (QueryInfo, bool) {
+	info, ok := ctx.Value(queryInfoKey{}).(QueryInfo)
+	return info, ok
+}
+
+// runPreQueryHooks runs the pre-query hooks in order, stopping at the first
+// one that short-circuits or fails.
+func (r *DNSResolver) runPreQueryHooks(ctx context.Context, info QueryInfo) (*dns.Msg, error) {
+	r.hooks.mu.RLock()
+	hooks := r.hooks.pre
+	r.hooks.mu.RUnlock()
+	for _, hook := range hooks {
+		response, err := hook(ctx, info)
+		if response != nil || err != nil {
+			return response, err
+		}
+	}
+	return nil, nil
+}
+
+func (r *DNSResolver) runPostQueryHooks(ctx context.Context, result QueryResult) {
+	r.hooks.mu.RLock()
+	hooks := r.hooks.post
+	r.hooks.mu.RUnlock()
+	for _, hook := range hooks {
+		hook(ctx, result)
+	}
+}
@@ -0,0 +1,123 @@
+package dnsres
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxExpandedHostnames caps how many names one template may produce so a typo
+// like {1..1000000} fails loudly instead of exhausting memory.
+const maxExpandedHostnames = 10000
+
+// ExpandHostnames expands brace templates in hostnames, removing duplicates
+// while keeping the first occurrence. Two forms are supported and may be
+// combined in one entry:
+//
+//	web{01..20}.example.com   numeric range, zero-padded to the width of the bounds
+//	{eu,us}.api.example.com   comma-separated alternatives
+func ExpandHostnames(hostnames []string) ([]string, error) {
+	seen := make(map[string]bool, len(hostnames))
+	expanded := make([]string, 0, len(hostnames))
+	for _, hostname := range hostnames {
+		names, err := expandHostname(hostname)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hostname template %q: %w", hostname, err)
+		}
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			expanded = append(expanded, name)
+		}
+	}
+	return expanded, nil
+}
+
+// expandHostname expands the first brace group in template and recurses on
+// the rest.
+func expandHostname(template string) ([]string, error) {
+	open := strings.IndexByte(template, '{')
+	if open < 0 {
+		if strings.IndexByte(template, '}') >= 0 {
+			return nil, fmt.Errorf("unmatched '}'")
+		}
+		return []string{template}, nil
+	}
+	end := strings.IndexByte(template[open:], '}')
+	if end < 0 {
+		return nil, fmt.Errorf("unmatched '{'")
+	}
+	closeIdx := open + end
+	prefix, body, suffix := template[:open], template[open+1:closeIdx], template[closeIdx+1:]
+	if strings.IndexByte(prefix, '}') >= 0 || strings.IndexByte(body, '{') >= 0 {
+		return nil, fmt.Errorf("nested or unmatched braces")
+	}
+
+	alternatives, err := braceAlternatives(body)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := expandHostname(suffix)
+	if err != nil {
+		return nil, err
+	}
+	if len(alternatives)*len(rest) > maxExpandedHostnames {
+		return nil, fmt.Errorf("expands to more than %d hostnames", maxExpandedHostnames)
+	}
+
+	names := make([]string, 0, len(alternatives)*len(rest))
+	for _, alternative := range alternatives {
+		for _, tail := range rest {
+			names = append(names, prefix+alternative+tail)
+		}
+	}
+	return names, nil
+}
+
+// braceAlternatives returns the values of one brace group: either a numeric
+// range "a..b" or a comma-separated list.
+func braceAlternatives(body string) ([]string, error) {
+	if from, to, ok := strings.Cut(body, ".."); ok {
+		return numericRange(from, to)
+	}
+	alternatives := strings.Split(body, ",")
+	if len(alternatives) < 2 {
+		return nil, fmt.Errorf("brace group {%s} needs a range or at least two alternatives", body)
+	}
+	for _, alternative := range alternatives {
+		if alternative == "" {
+			return nil, fmt.Errorf("empty alternative in {%s}", body)
+		}
+	}
+	return alternatives, nil
+}
+
+func numericRange(from, to string) ([]string, error) {
+	start, err := strconv.Atoi(from)
+	if err != nil || start < 0 {
+		return nil, fmt.Errorf("invalid range start %q", from)
+	}
+	stop, err := strconv.Atoi(to)
+	if err != nil || stop < 0 {
+		return nil, fmt.Errorf("invalid range end %q", to)
+	}
+	if stop < start {
+		return nil, fmt.Errorf("range %s..%s is descending", from, to)
+	}
+	if stop-start >= maxExpandedHostnames {
+		return nil, fmt.Errorf("expands to more than %d hostnames", maxExpandedHostnames)
+	}
+
+	// Pad only when a bound is written with a leading zero, as in {01..20}.
+	width := 0
+	if (len(from) > 1 && from[0] == '0') || (len(to) > 1 && to[0] == '0') {
+		width = max(len(from), len(to))
+	}
+	values := make([]string, 0, stop-start+1)
+	for i := start; i <= stop; i++ {
+		values = append(values, fmt.Sprintf("%0*d", width, i))
+	}
+	return values, nil
+}
@@ -0,0 +1,221 @@
+package dnsres
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dnsres/dnsanalysis"
+)
+
+// hostnameFailureLimit is how many recent failures a hostname rollup keeps.
+const hostnameFailureLimit = 10
+
+// Verdicts of a HostnameRollup.
+const (
+	// VerdictConsistent means every queried server answered the same.
+	VerdictConsistent = "consistent"
+	// VerdictInconsistent means the servers that answered disagree.
+	VerdictInconsistent = "inconsistent"
+	// VerdictDegraded means some servers failed and the rest agree.
+	VerdictDegraded = "degraded"
+	// VerdictFailing means no server answered.
+	VerdictFailing = "failing"
+)
+
+// HostnameRollup is the latest state of one hostname across servers, served
+// at /hostz/{hostname} for services deciding whether to fail over.
+type HostnameRollup struct {
+	Hostname string `json:"hostname"`
+	// CheckedAt is when the hostname's last resolution finished.
+	CheckedAt time.Time `json:"checked_at"`
+	// Verdict is VerdictConsistent, VerdictInconsistent, VerdictDegraded or
+	// VerdictFailing.
+	Verdict string           `json:"verdict"`
+	Servers []HostnameServer `json:"servers"`
+	// LastChange is when any server's answer last changed, if one has.
+	LastChange *time.Time `json:"last_change,omitempty"`
+	// Flapping is set while the hostname's answers alternate between sets.
+	Flapping       *FlapStatus       `json:"flapping,omitempty"`
+	RecentFailures []HostnameFailure `json:"recent_failures"`
+}
+
+// HostnameServer is one server's latest result for a hostname.
+type HostnameServer struct {
+	Server    string    `json:"server"`
+	CheckedAt time.Time `json:"checked_at"`
+	Addresses []string  `json:"addresses,omitempty"`
+	// LatencyMs is the query's latency; cached answers report the latency
+	// of the query that cached them.
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	// ChangedAt is when this server's answer last changed, if it has.
+	ChangedAt *time.Time `json:"changed_at,omitempty"`
+}
+
+// HostnameFailure is one failed query for a hostname.
+type HostnameFailure struct {
+	Time   time.Time `json:"time"`
+	Server string    `json:"server"`
+	Error  string    `json:"error"`
+}
+
+// hostnameState holds what a hostname's rollup is built from.
+type hostnameState struct {
+	hostname  string
+	checkedAt time.Time
+	verdict   string
+	servers   map[string]*HostnameServer
+	// answers is each server's last answer, sorted and joined, for spotting
+	// changes.
+	answers  map[string]string
+	failures []HostnameFailure
+}
+
+// hostnameTracker keeps the latest state of each resolved hostname.
+type hostnameTracker struct {
+	mu        sync.Mutex
+	hostnames map[string]*hostnameState
+}
+
+func newHostnameTracker() *hostnameTracker {
+	return &hostnameTracker{hostnames: make(map[string]*hostnameState)}
+}
+
+// record stores the outcome of one resolution of hostname. Servers not
+// queried this time keep their earlier result.
+func (t *hostnameTracker) record(hostname string, responses []*dnsanalysis.DNSResponse, failures map[string]string, consistent bool, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := NormalizeHostname(hostname)
+	state, ok := t.hostnames[key]
+	if !ok {
+		state = &hostnameState{servers: make(map[string]*HostnameServer), answers: make(map[string]string)}
+		t.hostnames[key] = state
+	}
+	state.hostname = key
+	state.checkedAt = now
+	switch {
+	case len(responses) == 0:
+		state.verdict = VerdictFailing
+	case !consistent:
+		state.verdict = VerdictInconsistent
+	case len(failures) > 0:
+		state.verdict = VerdictDegraded
+	default:
+		state.verdict = VerdictConsistent
+	}
+
+	for _, response := range responses {
+		addresses := slices.Clone(response.Addresses)
+		sort.Strings(addresses)
+		server := &HostnameServer{
+			Server:    response.Server,
+			CheckedAt: now,
+			Addresses: addresses,
+			LatencyMs: milliseconds(response.Duration),
+		}
+		if previous, ok := state.servers[response.Server]; ok {
+			server.ChangedAt = previous.ChangedAt
+		}
+		answer := strings.Join(addresses, " ")
+		if previous, ok := state.answers[response.Server]; ok && previous != answer {
+			changed := now
+			server.ChangedAt = &changed
+		}
+		state.answers[response.Server] = answer
+		state.servers[response.Server] = server
+	}
+
+	servers := make([]string, 0, len(failures))
+	for server := range failures {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		result := &HostnameServer{Server: server, CheckedAt: now, Error: failures[server]}
+		if previous, ok := state.servers[server]; ok {
+			result.ChangedAt = previous.ChangedAt
+		}
+		state.servers[server] = result
+		state.failures = append(state.failures, HostnameFailure{Time: now, Server: server, Error: failures[server]})
+	}
+	if len(state.failures) > hostnameFailureLimit {
+		state.failures = state.failures[len(state.failures)-hostnameFailureLimit:]
+	}
+}
+
+// rollup returns hostname's rollup, or false when it has not been resolved.
+func (t *hostnameTracker) rollup(hostname string) (HostnameRollup, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state, ok := t.hostnames[NormalizeHostname(hostname)]
+	if !ok {
+		return HostnameRollup{}, false
+	}
+	rollup := HostnameRollup{
+		Hostname:       state.hostname,
+		CheckedAt:      state.checkedAt,
+		Verdict:        state.verdict,
+		Servers:        make([]HostnameServer, 0, len(state.servers)),
+		RecentFailures: slices.Clone(state.failures),
+	}
+	if rollup.RecentFailures == nil {
+		rollup.RecentFailures = []HostnameFailure{}
+	}
+	for _, server := range state.servers {
+		copied := *server
+		copied.Addresses = slices.Clone(server.Addresses)
+		rollup.Servers = append(rollup.Servers, copied)
+		if server.ChangedAt != nil && (rollup.LastChange == nil || server.ChangedAt.After(*rollup.LastChange)) {
+			changed := *server.ChangedAt
+			rollup.LastChange = &changed
+		}
+	}
+	sort.Slice(rollup.Servers, func(i, j int) bool { return rollup.Servers[i].Server < rollup.Servers[j].Server })
+	return rollup, true
+}
+
+// HostnameRollup returns the latest state of hostname across servers, or
+// false when it has not been resolved yet.
+func (r *DNSResolver) HostnameRollup(hostname string) (HostnameRollup, bool) {
+	if r.hostnames == nil {
+		return HostnameRollup{}, false
+	}
+	rollup, ok := r.hostnames.rollup(hostname)
+	if !ok {
+		return rollup, false
+	}
+	if status, flapping := r.FlapSnapshot()[rollup.Hostname]; flapping {
+		rollup.Flapping = &status
+	}
+	return rollup, true
+}
+
+// rollupHostname records the outcome of one resolution of hostname for
+// /hostz.
+func (r *DNSResolver) rollupHostname(hostname string, responses []*dnsanalysis.DNSResponse, failures map[string]string, consistent bool) {
+	if r.hostnames == nil {
+		return
+	}
+	r.hostnames.record(hostname, responses, failures, consistent, time.Now())
+}
+
+// handleHostz serves a hostname's rollup, answering 404 for hostnames not
+// resolved yet and 503 while no server answers for it, so callers checking
+// only the status code still notice an outage.
+func (r *DNSResolver) handleHostz(w http.ResponseWriter, req *http.Request) {
+	rollup, ok := r.HostnameRollup(req.PathValue("hostname"))
+	if !ok {
+		http.Error(w, "unknown hostname", http.StatusNotFound)
+		return
+	}
+	status := http.StatusOK
+	if rollup.Verdict == VerdictFailing {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, rollup)
+}
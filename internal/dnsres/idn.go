@@ -0,0 +1,100 @@
+package dnsres
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+)
+
+// DisplayHostname returns hostname, a normalized name whose internationalized
+// labels are punycode, for showing to people: each xn-- label is converted
+// back to Unicode unless it mixes scripts in a way that could pass for
+// another name, such as Cyrillic letters in a Latin word, in which case it
+// stays punycode. Stats, metrics labels and the cache keep using the
+// punycode form.
+func DisplayHostname(hostname string) string {
+	if !strings.Contains(hostname, "xn--") {
+		return hostname
+	}
+	labels := strings.Split(hostname, ".")
+	for i, label := range labels {
+		if !strings.HasPrefix(label, "xn--") {
+			continue
+		}
+		unicodeLabel, err := idna.Display.ToUnicode(label)
+		if err != nil || !singleScript(unicodeLabel) {
+			continue
+		}
+		labels[i] = unicodeLabel
+	}
+	return strings.Join(labels, ".")
+}
+
+// idnScripts are the scripts an internationalized label is checked
+// against. Letters in none of them keep a label in punycode.
+var idnScripts = map[string]*unicode.RangeTable{
+	"Latin":      unicode.Latin,
+	"Greek":      unicode.Greek,
+	"Cyrillic":   unicode.Cyrillic,
+	"Armenian":   unicode.Armenian,
+	"Hebrew":     unicode.Hebrew,
+	"Arabic":     unicode.Arabic,
+	"Devanagari": unicode.Devanagari,
+	"Bengali":    unicode.Bengali,
+	"Tamil":      unicode.Tamil,
+	"Thai":       unicode.Thai,
+	"Georgian":   unicode.Georgian,
+	"Hangul":     unicode.Hangul,
+	"Han":        unicode.Han,
+	"Hiragana":   unicode.Hiragana,
+	"Katakana":   unicode.Katakana,
+	"Bopomofo":   unicode.Bopomofo,
+}
+
+// idnScriptMixes are the combinations of scripts a single label may use,
+// beyond a single script: Latin with the scripts of Chinese, Japanese and
+// Korean, which are routinely written together.
+var idnScriptMixes = []map[string]bool{
+	{"Latin": true, "Han": true, "Hiragana": true, "Katakana": true},
+	{"Latin": true, "Han": true, "Bopomofo": true},
+	{"Latin": true, "Han": true, "Hangul": true},
+}
+
+// singleScript reports whether the letters of label, ignoring digits,
+// hyphens and marks, come from one script or an allowed mix.
+func singleScript(label string) bool {
+	scripts := make(map[string]bool)
+	for _, r := range label {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		script := ""
+		for name, table := range idnScripts {
+			if unicode.Is(table, r) {
+				script = name
+				break
+			}
+		}
+		if script == "" {
+			return false
+		}
+		scripts[script] = true
+	}
+	if len(scripts) <= 1 {
+		return true
+	}
+	for _, mix := range idnScriptMixes {
+		allowed := true
+		for script := range scripts {
+			if !mix[script] {
+				allowed = false
+				break
+			}
+		}
+		if allowed {
+			return true
+		}
+	}
+	return false
+}
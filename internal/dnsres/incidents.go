@@ -0,0 +1,302 @@
+package dnsres
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+)
+
+const (
+	// maxIncidentEvents caps the related events kept per incident.
+	maxIncidentEvents = 100
+	// closedIncidentHistory is how many closed incidents are kept.
+	closedIncidentHistory  = 100
+	incidentWebhookTimeout = 10 * time.Second
+	// incidentWebhookQueue is how many webhook deliveries can wait for the
+	// one before them.
+	incidentWebhookQueue = 100
+)
+
+// Incident causes.
+const (
+	IncidentCauseFailure      = "failure"
+	IncidentCauseInconsistent = "inconsistent"
+)
+
+// Incident is a period during which a hostname had failing servers or
+// inconsistent answers. It opens on the first bad cycle and closes on the
+// first cycle where every server answered consistently.
+type Incident struct {
+	ID       int        `json:"id"`
+	Hostname string     `json:"hostname"`
+	Started  time.Time  `json:"started"`
+	Ended    *time.Time `json:"ended,omitempty"`
+	Causes   []string   `json:"causes"`
+	Servers  []string   `json:"servers"`
+	// Events are the hostname's events while the incident was open, other
+	// than successful resolutions, up to maxIncidentEvents.
+	Events        []ResolverEvent `json:"events"`
+	DroppedEvents int             `json:"dropped_events,omitempty"`
+}
+
+// Open reports whether the incident is still ongoing.
+func (i Incident) Open() bool {
+	return i.Ended == nil
+}
+
+// Duration returns how long the incident lasted, or has lasted so far.
+func (i Incident) Duration() time.Duration {
+	if i.Ended != nil {
+		return i.Ended.Sub(i.Started)
+	}
+	return time.Since(i.Started)
+}
+
+func (i Incident) copy() Incident {
+	i.Causes = append([]string(nil), i.Causes...)
+	i.Servers = append([]string(nil), i.Servers...)
+	i.Events = append([]ResolverEvent(nil), i.Events...)
+	return i
+}
+
+// incidentTracker holds open incidents by hostname and recently closed ones.
+type incidentTracker struct {
+	mu     sync.Mutex
+	nextID int
+	open   map[string]*Incident
+	closed []Incident
+	// webhooks queues deliveries for runIncidentWebhooks, which posts them
+	// one at a time so an incident's close never overtakes its open.
+	webhooks chan incidentWebhook
+}
+
+func newIncidentTracker() *incidentTracker {
+	return &incidentTracker{
+		open:     make(map[string]*Incident),
+		webhooks: make(chan incidentWebhook, incidentWebhookQueue),
+	}
+}
+
+// update opens or extends hostname's incident when causes is non-empty and
+// closes it otherwise. It returns the incident and whether it just opened or
+// closed.
+func (t *incidentTracker) update(hostname string, causes, servers []string, now time.Time) (Incident, bool, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	incident, ok := t.open[hostname]
+	if len(causes) == 0 {
+		if !ok {
+			return Incident{}, false, false
+		}
+		ended := now
+		incident.Ended = &ended
+		delete(t.open, hostname)
+		t.closed = append(t.closed, *incident)
+		if len(t.closed) > closedIncidentHistory {
+			t.closed = t.closed[len(t.closed)-closedIncidentHistory:]
+		}
+		return incident.copy(), false, true
+	}
+
+	opened := !ok
+	if opened {
+		t.nextID++
+		incident = &Incident{ID: t.nextID, Hostname: hostname, Started: now}
+		t.open[hostname] = incident
+	}
+	for _, cause := range causes {
+		if !slices.Contains(incident.Causes, cause) {
+			incident.Causes = append(incident.Causes, cause)
+		}
+	}
+	for _, server := range servers {
+		if !slices.Contains(incident.Servers, server) {
+			incident.Servers = append(incident.Servers, server)
+		}
+	}
+	slices.Sort(incident.Servers)
+	return incident.copy(), opened, false
+}
+
+// seed prepends events that happened before hostname's incident opened,
+// such as the failures of the resolution that opened it.
+func (t *incidentTracker) seed(hostname string, events []ResolverEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	incident, ok := t.open[hostname]
+	if !ok {
+		return
+	}
+	room := maxIncidentEvents - len(incident.Events)
+	if len(events) > room {
+		incident.DroppedEvents += len(events) - room
+		events = events[len(events)-room:]
+	}
+	incident.Events = append(append([]ResolverEvent(nil), events...), incident.Events...)
+}
+
+// observe attaches event to the open incident for its hostname.
+func (t *incidentTracker) observe(event ResolverEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	incident, ok := t.open[event.Hostname]
+	if !ok {
+		return
+	}
+	if len(incident.Events) >= maxIncidentEvents {
+		incident.DroppedEvents++
+		return
+	}
+	incident.Events = append(incident.Events, event)
+}
+
+// list returns open incidents followed by closed ones, newest first.
+func (t *incidentTracker) list(limit int, openOnly bool) []Incident {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	incidents := make([]Incident, 0, len(t.open)+len(t.closed))
+	for _, incident := range t.open {
+		incidents = append(incidents, incident.copy())
+	}
+	slices.SortFunc(incidents, func(a, b Incident) int { return b.ID - a.ID })
+	if !openOnly {
+		for i := len(t.closed) - 1; i >= 0; i-- {
+			incidents = append(incidents, t.closed[i].copy())
+		}
+	}
+	if limit > 0 && len(incidents) > limit {
+		incidents = incidents[:limit]
+	}
+	return incidents
+}
+
+// Incidents returns up to limit incidents, open ones first and then the most
+// recently closed. A limit of zero returns all kept in memory.
+func (r *DNSResolver) Incidents(limit int, openOnly bool) []Incident {
+	if r.incidents == nil {
+		return []Incident{}
+	}
+	return r.incidents.list(limit, openOnly)
+}
+
+// trackIncident opens, extends or closes hostname's incident from the
+// outcome of one resolution that began at started.
+func (r *DNSResolver) trackIncident(hostname string, started time.Time, failures map[string]string, responses int, consistent bool) {
+	if r.incidents == nil || r.warmingUp(started) {
+		return
+	}
+	var causes, servers []string
+	if len(failures) > 0 {
+		causes = append(causes, IncidentCauseFailure)
+		for server := range failures {
+			servers = append(servers, server)
+		}
+	}
+	if !consistent {
+		causes = append(causes, IncidentCauseInconsistent)
+	}
+	if len(causes) == 0 && responses == 0 {
+		// Nothing was resolved, so nothing has recovered either.
+		return
+	}
+
+	incident, opened, closed := r.incidents.update(hostname, causes, servers, time.Now())
+	switch {
+	case opened:
+		var earlier []ResolverEvent
+		for _, event := range r.RecentEvents(0, "") {
+			if event.Hostname == hostname && event.Type != EventResolveSuccess && !event.Time.Before(started) {
+				earlier = append(earlier, event)
+			}
+		}
+		r.incidents.seed(hostname, earlier)
+		metrics.DNSResIncidentsOpen.Inc()
+		r.errorLog.Printf("Incident %d opened for %s: %v on %v", incident.ID, hostname, incident.Causes, incident.Servers)
+		r.appLogf(instrumentation.Low, "incident open id=%d hostname=%s causes=%v servers=%v", incident.ID, hostname, incident.Causes, incident.Servers)
+		r.emitEvent(ResolverEvent{
+			Type:     EventIncidentOpen,
+			Time:     incident.Started,
+			Hostname: hostname,
+			Detail:   fmt.Sprintf("incident %d: %v", incident.ID, incident.Causes),
+		})
+		r.notifyIncident("open", incident)
+	case closed:
+		metrics.DNSResIncidentsOpen.Dec()
+		r.errorLog.Printf("Incident %d closed for %s after %s", incident.ID, hostname, incident.Duration().Round(time.Second))
+		r.appLogf(instrumentation.Low, "incident close id=%d hostname=%s duration=%s", incident.ID, hostname, incident.Duration())
+		r.emitEvent(ResolverEvent{
+			Type:     EventIncidentClose,
+			Time:     *incident.Ended,
+			Hostname: hostname,
+			Duration: incident.Duration(),
+			Detail:   fmt.Sprintf("incident %d", incident.ID),
+		})
+		r.notifyIncident("close", incident)
+	}
+}
+
+func validateIncidents(c *Config) error {
+	var problems configProblems
+	problems.add("incidents.webhook_url", validateWebhookURL(c.Incidents.WebhookURL))
+	return problems.err()
+}
+
+// incidentWebhookPayload is the JSON body posted to incidents.webhook_url.
+type incidentWebhookPayload struct {
+	Action   string   `json:"action"`
+	Incident Incident `json:"incident"`
+}
+
+// incidentWebhook is one queued delivery to incidents.webhook_url.
+type incidentWebhook struct {
+	url     string
+	payload incidentWebhookPayload
+}
+
+// notifyIncident queues the incident for the configured webhook, unless
+// another instance leads. A full queue drops the delivery with a log entry.
+func (r *DNSResolver) notifyIncident(action string, incident Incident) {
+	webhook := r.currentConfig().Incidents.WebhookURL
+	if webhook == "" || r.incidents == nil {
+		return
+	}
+	if !r.leading() {
+		r.appLogf(instrumentation.Medium, "incident webhook skipped on standby id=%d action=%s", incident.ID, action)
+		return
+	}
+	select {
+	case r.incidents.webhooks <- incidentWebhook{url: webhook, payload: incidentWebhookPayload{Action: action, Incident: incident}}:
+	default:
+		r.errorLog.Printf("Incident webhook queue full, dropped %s of incident %d", action, incident.ID)
+	}
+}
+
+// runIncidentWebhooks posts queued incident webhooks in order until ctx is
+// canceled. Failures are logged and not retried.
+func (r *DNSResolver) runIncidentWebhooks(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case delivery := <-r.incidents.webhooks:
+			r.postIncidentWebhook(ctx, delivery)
+		}
+	}
+}
+
+func (r *DNSResolver) postIncidentWebhook(ctx context.Context, delivery incidentWebhook) {
+	ctx, cancel := context.WithTimeout(ctx, incidentWebhookTimeout)
+	defer cancel()
+	if err := postJSON(ctx, delivery.url, delivery.payload); err != nil {
+		r.errorLog.Printf("Incident webhook failed: %v", err)
+		return
+	}
+	r.appLogf(instrumentation.Medium, "incident webhook sent id=%d action=%s", delivery.payload.Incident.ID, delivery.payload.Action)
+}
@@ -0,0 +1,135 @@
+package dnsres
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// readConfigFile returns the JSON document at path with the files named by
+// its "include" list merged in. Included files are merged in order, glob
+// matches sorted by name, and the including file is merged last so its own
+// keys take precedence. Includes may nest; paths are relative to the file
+// that names them.
+func readConfigFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %v", err)
+	}
+	var probe struct {
+		Include json.RawMessage `json:"include"`
+	}
+	if json.Unmarshal(data, &probe) != nil || probe.Include == nil {
+		return data, nil
+	}
+	doc, err := loadConfigDocument(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// loadConfigDocument decodes path and its includes into one JSON object.
+// stack holds the files being loaded, to reject include cycles.
+func loadConfigDocument(path string, stack []string) (map[string]any, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(stack, abs) {
+		return nil, fmt.Errorf("config include cycle at %s", path)
+	}
+	stack = append(stack, abs)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc map[string]any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode config file %s: %v", path, err)
+	}
+
+	var includes []string
+	if raw, ok := doc["include"]; ok {
+		delete(doc, "include")
+		list, ok := raw.([]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid include in %s: must be a list of paths", path)
+		}
+		for _, item := range list {
+			pattern, ok := item.(string)
+			if !ok || pattern == "" {
+				return nil, fmt.Errorf("invalid include in %s: must be a list of paths", path)
+			}
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid include %q in %s: %v", item, path, err)
+			}
+			if len(matches) == 0 && !hasGlobMeta(pattern) {
+				return nil, fmt.Errorf("included config file %s not found", pattern)
+			}
+			includes = append(includes, matches...)
+		}
+	}
+
+	merged := map[string]any{}
+	for _, include := range includes {
+		included, err := loadConfigDocument(include, stack)
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeConfigValues(merged, included).(map[string]any)
+	}
+	return mergeConfigValues(merged, doc).(map[string]any), nil
+}
+
+// mergeConfigValues merges override into base: objects merge key by key,
+// lists are concatenated without duplicates, and any other value in
+// override replaces the one in base.
+func mergeConfigValues(base, override any) any {
+	switch o := override.(type) {
+	case map[string]any:
+		b, ok := base.(map[string]any)
+		if !ok {
+			return o
+		}
+		for key, value := range o {
+			if existing, ok := b[key]; ok {
+				value = mergeConfigValues(existing, value)
+			}
+			b[key] = value
+		}
+		return b
+	case []any:
+		b, ok := base.([]any)
+		if !ok {
+			return o
+		}
+		seen := make(map[string]bool, len(b)+len(o))
+		merged := make([]any, 0, len(b)+len(o))
+		for _, item := range slices.Concat(b, o) {
+			key, _ := json.Marshal(item)
+			if !seen[string(key)] {
+				seen[string(key)] = true
+				merged = append(merged, item)
+			}
+		}
+		return merged
+	default:
+		return override
+	}
+}
+
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
@@ -0,0 +1,77 @@
+package dnsres
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+)
+
+// inflightLimiter holds the query slots of each server with a max_in_flight
+// cap. It is separate from the scheduler's global concurrency limits, which
+// do not know which server a query goes to.
+type inflightLimiter struct {
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newInflightLimiter() *inflightLimiter {
+	return &inflightLimiter{slots: make(map[string]chan struct{})}
+}
+
+// slotsFor returns server's slots for limit, replacing them when a reload
+// changed the limit. Queries holding a slot of the old set release it there.
+func (l *inflightLimiter) slotsFor(server string, limit int) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slots, ok := l.slots[server]
+	if !ok || cap(slots) != limit {
+		slots = make(chan struct{}, limit)
+		l.slots[server] = slots
+	}
+	return slots
+}
+
+// acquireSlot takes one of server's query slots, waiting in line while all
+// are in use, and returns the func that gives it back. Servers without a
+// max_in_flight cap need no slot. It fails only when ctx ends first.
+func (r *DNSResolver) acquireSlot(ctx context.Context, server string) (func(), error) {
+	config := r.currentConfig()
+	if r.inflight == nil || config == nil {
+		return func() {}, nil
+	}
+	limit := config.Settings(server).MaxInFlight
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	slots := r.inflight.slotsFor(server, limit)
+	start := time.Now()
+	select {
+	case slots <- struct{}{}:
+	default:
+		queued := metrics.DNSResolutionSlotQueueDepth.WithLabelValues(server)
+		queued.Inc()
+		r.appLogf(instrumentation.High, "waiting for query slot server=%s max_in_flight=%d", server, limit)
+		select {
+		case slots <- struct{}{}:
+			queued.Dec()
+		case <-ctx.Done():
+			queued.Dec()
+			metrics.DNSResolutionSlotWait.WithLabelValues(server).Observe(time.Since(start).Seconds())
+			return nil, fmt.Errorf("waiting for a query slot on %s: %w", server, ctx.Err())
+		}
+	}
+	metrics.DNSResolutionSlotWait.WithLabelValues(server).Observe(time.Since(start).Seconds())
+	inFlight := metrics.DNSResolutionInFlight.WithLabelValues(server)
+	inFlight.Inc()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			inFlight.Dec()
+			<-slots
+		})
+	}, nil
+}
@@ -0,0 +1,286 @@
+package dnsres
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// Kinds of answer interception reported by the interception probe.
+const (
+	InterceptionNXDOMAIN = "nxdomain_redirect"
+	InterceptionCaptive  = "captive_portal"
+)
+
+// nxdomainProbeZones are parents under which a random label cannot exist:
+// .invalid is reserved by RFC 6761 and example.com has no wildcard. A server
+// that answers with addresses is rewriting NXDOMAIN.
+var nxdomainProbeZones = []string{"invalid.", "example.com."}
+
+// captivePortalProbe is a well-known connectivity check URL and the answer
+// it gives when nothing sits in between.
+type captivePortalProbe struct {
+	url    string
+	status int
+	body   string
+}
+
+var captivePortalProbes = []captivePortalProbe{
+	{url: "http://connectivitycheck.gstatic.com/generate_204", status: http.StatusNoContent},
+	{url: "http://captive.apple.com/hotspot-detect.html", status: http.StatusOK, body: "Success"},
+}
+
+// captivePortalBodyLimit bounds how much of a probe response is read.
+const captivePortalBodyLimit = 4096
+
+// Interception describes what the interception probe found for a server.
+type Interception struct {
+	NXDOMAINRedirect bool      `json:"nxdomain_redirect"`
+	RedirectAddrs    []string  `json:"redirect_addresses,omitempty"`
+	CaptivePortal    bool      `json:"captive_portal"`
+	PortalDetail     string    `json:"portal_detail,omitempty"`
+	LastChecked      time.Time `json:"last_checked"`
+}
+
+// issues lists the interception kinds found.
+func (i Interception) issues() []string {
+	var issues []string
+	if i.NXDOMAINRedirect {
+		issues = append(issues, InterceptionNXDOMAIN)
+	}
+	if i.CaptivePortal {
+		issues = append(issues, InterceptionCaptive)
+	}
+	return issues
+}
+
+// interceptionTracker keeps the latest probe result per server.
+type interceptionTracker struct {
+	mu      sync.Mutex
+	results map[string]Interception
+}
+
+func newInterceptionTracker() *interceptionTracker {
+	return &interceptionTracker{results: make(map[string]Interception)}
+}
+
+// record stores result for server and returns the previous result.
+func (t *interceptionTracker) record(server string, result Interception) (Interception, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	previous, ok := t.results[server]
+	t.results[server] = result
+	return previous, ok
+}
+
+func (t *interceptionTracker) snapshot() map[string]Interception {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	snapshot := make(map[string]Interception, len(t.results))
+	for server, result := range t.results {
+		snapshot[server] = result
+	}
+	return snapshot
+}
+
+// InterceptionSnapshot returns the latest interception probe result for each
+// server that enables it.
+func (r *DNSResolver) InterceptionSnapshot() map[string]Interception {
+	if r.interceptions == nil {
+		return map[string]Interception{}
+	}
+	return r.interceptions.snapshot()
+}
+
+// randomLabel returns a label no real zone is expected to contain.
+func randomLabel() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("dnsres-%d", time.Now().UnixNano())
+	}
+	return "dnsres-" + hex.EncodeToString(buf)
+}
+
+// probeInterception checks server for NXDOMAIN rewriting and for a captive
+// portal in front of the well-known connectivity check URLs.
+func (r *DNSResolver) probeInterception(ctx context.Context, server string) (Interception, error) {
+	client, err := r.getClient(server)
+	if err != nil {
+		return Interception{}, fmt.Errorf("failed to get client from pool: %w", err)
+	}
+	defer r.putClient(server, client)
+
+	result := Interception{LastChecked: time.Now()}
+	reachable := false
+	for _, zone := range nxdomainProbeZones {
+		addrs, err := lookupA(ctx, client, server, randomLabel()+"."+zone)
+		if err != nil {
+			continue
+		}
+		reachable = true
+		if len(addrs) > 0 {
+			result.NXDOMAINRedirect = true
+			result.RedirectAddrs = append(result.RedirectAddrs, addrs...)
+		}
+	}
+	if !reachable {
+		return Interception{}, fmt.Errorf("no NXDOMAIN probe answered")
+	}
+
+	for _, probe := range captivePortalProbes {
+		detail, err := r.checkCaptivePortal(ctx, client, server, probe)
+		if err != nil {
+			r.appLogf(instrumentation.High, "captive portal probe skipped server=%s url=%s err=%v", server, probe.url, err)
+			continue
+		}
+		if detail != "" {
+			result.CaptivePortal = true
+			result.PortalDetail = detail
+			break
+		}
+	}
+	return result, nil
+}
+
+// lookupA returns the A records server gives for name.
+func lookupA(ctx context.Context, client dnsClient, server, name string) ([]string, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	response, _, err := client.ExchangeContext(ctx, msg, server)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, answer := range response.Answer {
+		if a, ok := answer.(*dns.A); ok {
+			addrs = append(addrs, a.A.String())
+		}
+	}
+	return addrs, nil
+}
+
+// checkCaptivePortal fetches probe.url from the address server resolves its
+// host to and returns a description of the response when it is not the
+// expected one. Redirects are not followed.
+func (r *DNSResolver) checkCaptivePortal(ctx context.Context, client dnsClient, server string, probe captivePortalProbe) (string, error) {
+	target, err := url.Parse(probe.url)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := lookupA(ctx, client, server, dns.Fqdn(target.Hostname()))
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no address for %s", target.Hostname())
+	}
+	port := target.Port()
+	if port == "" {
+		port = "80"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.currentConfig().QueryTimeout.Duration)
+	defer cancel()
+	direct := *target
+	direct.Host = net.JoinHostPort(addrs[0], port)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, direct.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Host = target.Host
+	httpClient := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, captivePortalBodyLimit))
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != probe.status {
+		detail := fmt.Sprintf("%s returned %s via %s", target.Host, resp.Status, addrs[0])
+		if location := resp.Header.Get("Location"); location != "" {
+			detail += " redirecting to " + location
+		}
+		return detail, nil
+	}
+	if probe.body != "" && !strings.Contains(string(body), probe.body) {
+		return fmt.Sprintf("%s returned unexpected content via %s", target.Host, addrs[0]), nil
+	}
+	return "", nil
+}
+
+// detectInterception probes every server that enables interception_probe.
+func (r *DNSResolver) detectInterception(ctx context.Context) {
+	config := r.currentConfig()
+	if r.interceptions == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, server := range config.DNSServers {
+		if !config.Settings(server).InterceptionProbe {
+			continue
+		}
+		wg.Add(1)
+		go func(s string) {
+			defer wg.Done()
+			result, err := r.probeInterception(ctx, s)
+			if err != nil {
+				r.appLogf(instrumentation.Medium, "interception probe failed server=%s err=%v", s, err)
+				return
+			}
+			r.recordInterception(s, result)
+		}(server)
+	}
+	wg.Wait()
+}
+
+// recordInterception stores result, updates metrics and health, and reports
+// interception that started since the previous probe.
+func (r *DNSResolver) recordInterception(server string, result Interception) {
+	previous, _ := r.interceptions.record(server, result)
+	metrics.DNSServerInterception.WithLabelValues(server, InterceptionNXDOMAIN).Set(boolToFloat64(result.NXDOMAINRedirect))
+	metrics.DNSServerInterception.WithLabelValues(server, InterceptionCaptive).Set(boolToFloat64(result.CaptivePortal))
+	if r.health != nil {
+		r.health.SetServerIssues(server, result.issues())
+	}
+
+	if result.NXDOMAINRedirect && !previous.NXDOMAINRedirect {
+		addrs := append([]string(nil), result.RedirectAddrs...)
+		sort.Strings(addrs)
+		r.reportInterception(server, InterceptionNXDOMAIN, "nonexistent names resolve to "+strings.Join(addrs, ","))
+	}
+	if result.CaptivePortal && !previous.CaptivePortal {
+		r.reportInterception(server, InterceptionCaptive, result.PortalDetail)
+	}
+}
+
+func (r *DNSResolver) reportInterception(server, kind, detail string) {
+	r.errorLog.Printf("Interception detected on %s: %s (%s)", server, kind, detail)
+	r.appLogf(instrumentation.Low, "interception detected server=%s kind=%s detail=%s", server, kind, detail)
+	r.emitEvent(ResolverEvent{
+		Type:   EventInterception,
+		Time:   time.Now(),
+		Server: server,
+		Source: kind,
+		Detail: detail,
+	})
+}
@@ -0,0 +1,413 @@
+package dnsres
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// In-cluster service account locations mounted into every pod.
+const (
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	// serviceAccountNamespaceFile holds the namespace of the pod.
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// kubernetesAPI reaches a Kubernetes API server with the credentials of a
+// kubeconfig file or, in a pod, its service account.
+type kubernetesAPI struct {
+	server    string
+	namespace string
+	client    *http.Client
+	// token returns the bearer token for each request; in-cluster tokens are
+	// rotated, so the file is re-read every time.
+	token func() (string, error)
+}
+
+// newKubernetesAPI configures access from kubeconfig, or in-cluster when it
+// is empty. server, when set, replaces the API server URL and namespace, when
+// set, the kubeconfig's namespace.
+func newKubernetesAPI(kubeconfig, server, namespace string) (kubernetesAPI, error) {
+	api := kubernetesAPI{namespace: namespace}
+	var err error
+	if kubeconfig != "" {
+		err = api.configureFromKubeconfig(kubeconfig)
+	} else {
+		err = api.configureInCluster()
+	}
+	if err != nil {
+		return kubernetesAPI{}, err
+	}
+	if server != "" {
+		api.server = server
+	}
+	api.server = strings.TrimSuffix(api.server, "/")
+	return api, nil
+}
+
+// kubernetesDiscoverer lists Ingress hosts and ExternalName services through
+// the Kubernetes API and labels each hostname with the object it came from.
+type kubernetesDiscoverer struct {
+	kubernetesAPI
+	labelSelector string
+	zone          string
+
+	mu     sync.Mutex
+	labels map[string]map[string]string
+}
+
+func newKubernetesDiscoverer(source DiscoverySource) (Discoverer, error) {
+	api, err := newKubernetesAPI(source.Kubeconfig, source.URL, source.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	return &kubernetesDiscoverer{
+		kubernetesAPI: api,
+		labelSelector: source.LabelSelector,
+		zone:          normalizeZone(source.Zone),
+	}, nil
+}
+
+func (d *kubernetesAPI) configureInCluster() error {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return fmt.Errorf("not running in a cluster: KUBERNETES_SERVICE_HOST/PORT unset; set kubeconfig")
+	}
+	caData, err := os.ReadFile(serviceAccountCAFile)
+	if err != nil {
+		return fmt.Errorf("failed to read service account CA: %w", err)
+	}
+	tlsConfig, err := kubernetesTLSConfig(caData, nil, nil, false)
+	if err != nil {
+		return err
+	}
+	d.server = "https://" + net.JoinHostPort(host, port)
+	d.client = &http.Client{Timeout: discoveryRequestTimeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	d.token = func() (string, error) {
+		token, err := os.ReadFile(serviceAccountTokenFile)
+		return strings.TrimSpace(string(token)), err
+	}
+	return nil
+}
+
+// kubeconfig is the subset of a kubeconfig file needed to reach the API
+// server. Only JSON is parsed (kubectl config view --raw --flatten -o json).
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Contexts       []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster   string `json:"cluster"`
+			User      string `json:"user"`
+			Namespace string `json:"namespace"`
+		} `json:"context"`
+	} `json:"contexts"`
+	Clusters []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server                   string `json:"server"`
+			CertificateAuthority     string `json:"certificate-authority"`
+			CertificateAuthorityData string `json:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			Token                 string `json:"token"`
+			TokenFile             string `json:"tokenFile"`
+			ClientCertificateData string `json:"client-certificate-data"`
+			ClientKeyData         string `json:"client-key-data"`
+		} `json:"user"`
+	} `json:"users"`
+}
+
+func (d *kubernetesAPI) configureFromKubeconfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read kubeconfig: %w", err)
+	}
+	var config kubeconfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("failed to parse kubeconfig (JSON required): %w", err)
+	}
+
+	contextFound := false
+	var clusterName, userName, namespace string
+	for _, c := range config.Contexts {
+		if c.Name == config.CurrentContext {
+			clusterName, userName, namespace = c.Context.Cluster, c.Context.User, c.Context.Namespace
+			contextFound = true
+			break
+		}
+	}
+	if !contextFound {
+		return fmt.Errorf("kubeconfig current-context %q not found", config.CurrentContext)
+	}
+	if d.namespace == "" {
+		d.namespace = namespace
+	}
+
+	clusterFound := false
+	var caData []byte
+	insecure := false
+	for _, c := range config.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		clusterFound = true
+		d.server = c.Cluster.Server
+		insecure = c.Cluster.InsecureSkipTLSVerify
+		switch {
+		case c.Cluster.CertificateAuthorityData != "":
+			if caData, err = base64.StdEncoding.DecodeString(c.Cluster.CertificateAuthorityData); err != nil {
+				return fmt.Errorf("invalid certificate-authority-data: %w", err)
+			}
+		case c.Cluster.CertificateAuthority != "":
+			if caData, err = os.ReadFile(c.Cluster.CertificateAuthority); err != nil {
+				return fmt.Errorf("failed to read certificate-authority: %w", err)
+			}
+		}
+		break
+	}
+	if !clusterFound || d.server == "" {
+		return fmt.Errorf("kubeconfig cluster %q not found", clusterName)
+	}
+
+	var certData, keyData []byte
+	d.token = func() (string, error) { return "", nil }
+	for _, u := range config.Users {
+		if u.Name != userName {
+			continue
+		}
+		switch {
+		case u.User.Token != "":
+			token := u.User.Token
+			d.token = func() (string, error) { return token, nil }
+		case u.User.TokenFile != "":
+			tokenFile := u.User.TokenFile
+			d.token = func() (string, error) {
+				token, err := os.ReadFile(tokenFile)
+				return strings.TrimSpace(string(token)), err
+			}
+		}
+		if u.User.ClientCertificateData != "" {
+			if certData, err = base64.StdEncoding.DecodeString(u.User.ClientCertificateData); err != nil {
+				return fmt.Errorf("invalid client-certificate-data: %w", err)
+			}
+			if keyData, err = base64.StdEncoding.DecodeString(u.User.ClientKeyData); err != nil {
+				return fmt.Errorf("invalid client-key-data: %w", err)
+			}
+		}
+		break
+	}
+
+	tlsConfig, err := kubernetesTLSConfig(caData, certData, keyData, insecure)
+	if err != nil {
+		return err
+	}
+	d.client = &http.Client{Timeout: discoveryRequestTimeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return nil
+}
+
+func kubernetesTLSConfig(caData, certData, keyData []byte, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if len(caData) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates found in cluster CA")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(certData) > 0 {
+		cert, err := tls.X509KeyPair(certData, keyData)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (d *kubernetesDiscoverer) Name() string {
+	if d.namespace == "" {
+		return "kubernetes"
+	}
+	return "kubernetes:" + d.namespace
+}
+
+// kubernetesObject holds the fields read from Ingress and Service objects.
+type kubernetesObject struct {
+	Metadata struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		Labels    map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		// Ingress
+		Rules []struct {
+			Host string `json:"host"`
+		} `json:"rules"`
+		TLS []struct {
+			Hosts []string `json:"hosts"`
+		} `json:"tls"`
+		// Service
+		Type         string `json:"type"`
+		ExternalName string `json:"externalName"`
+	} `json:"spec"`
+}
+
+func (d *kubernetesDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	ingresses, err := d.list(ctx, "/apis/networking.k8s.io/v1", "ingresses")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ingresses: %w", err)
+	}
+	services, err := d.list(ctx, "/api/v1", "services")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+
+	labels := make(map[string]map[string]string)
+	add := func(host, kind string, object kubernetesObject) {
+		host = normalizeZone(host)
+		if host == "" || strings.HasPrefix(host, "*") {
+			return
+		}
+		if d.zone != "" && host != d.zone && !strings.HasSuffix(host, "."+d.zone) {
+			return
+		}
+		if _, seen := labels[host]; seen {
+			return
+		}
+		values := map[string]string{
+			"k8s_kind":      kind,
+			"k8s_namespace": object.Metadata.Namespace,
+			"k8s_name":      object.Metadata.Name,
+		}
+		for key, value := range object.Metadata.Labels {
+			values["k8s_label_"+key] = value
+		}
+		labels[host] = values
+	}
+	for _, ingress := range ingresses {
+		for _, rule := range ingress.Spec.Rules {
+			add(rule.Host, "Ingress", ingress)
+		}
+		for _, tlsHosts := range ingress.Spec.TLS {
+			for _, host := range tlsHosts.Hosts {
+				add(host, "Ingress", ingress)
+			}
+		}
+	}
+	for _, service := range services {
+		if service.Spec.Type == "ExternalName" {
+			add(service.Spec.ExternalName, "Service", service)
+		}
+	}
+
+	hostnames := make([]string, 0, len(labels))
+	for host := range labels {
+		hostnames = append(hostnames, host)
+	}
+	sort.Strings(hostnames)
+
+	d.mu.Lock()
+	d.labels = labels
+	d.mu.Unlock()
+	return hostnames, nil
+}
+
+// Labels returns the Kubernetes metadata for hostnames from the last
+// successful Discover.
+func (d *kubernetesDiscoverer) Labels() map[string]map[string]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.labels
+}
+
+// list fetches every object of resource under the API group prefix, scoped to
+// the configured namespace and label selector.
+func (d *kubernetesDiscoverer) list(ctx context.Context, prefix, resource string) ([]kubernetesObject, error) {
+	path := prefix + "/" + resource
+	if d.namespace != "" {
+		path = prefix + "/namespaces/" + url.PathEscape(d.namespace) + "/" + resource
+	}
+	query := url.Values{}
+	if d.labelSelector != "" {
+		query.Set("labelSelector", d.labelSelector)
+	}
+
+	var objects []kubernetesObject
+	for {
+		pathQuery := path
+		if encoded := query.Encode(); encoded != "" {
+			pathQuery += "?" + encoded
+		}
+		resp, err := d.do(ctx, http.MethodGet, pathQuery, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Metadata struct {
+				Continue string `json:"continue"`
+			} `json:"metadata"`
+			Items []kubernetesObject `json:"items"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+		objects = append(objects, page.Items...)
+		if page.Metadata.Continue == "" {
+			return objects, nil
+		}
+		query.Set("continue", page.Metadata.Continue)
+	}
+}
+
+// do sends a request for path, which may carry a query, to the API server.
+// A non-nil body is sent as JSON.
+func (a *kubernetesAPI) do(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, a.server+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	token, err := a.token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token: %w", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return a.client.Do(req)
+}
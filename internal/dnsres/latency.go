@@ -0,0 +1,257 @@
+package dnsres
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+)
+
+// Latency anomaly defaults used when latency_anomaly leaves them unset.
+const (
+	defaultAnomalyFactor      = 3.0
+	defaultAnomalyAlpha       = 0.1
+	defaultAnomalyMinSamples  = 10
+	defaultAnomalyConsecutive = 3
+	defaultAnomalyMinLatency  = 20 * time.Millisecond
+)
+
+// LatencyAnomalyConfig configures latency anomaly detection, which learns a
+// baseline latency for each server and hostname and flags queries that take
+// a multiple of it, well before failures trip the circuit breaker.
+type LatencyAnomalyConfig struct {
+	// Disabled turns detection off.
+	Disabled bool `json:"disabled"`
+	// Factor is how many times the baseline a query must take to deviate
+	// (default 3).
+	Factor float64 `json:"factor"`
+	// Alpha weighs each new query in the baseline, an exponentially
+	// weighted moving average (default 0.1).
+	Alpha float64 `json:"alpha"`
+	// MinSamples is how many queries the baseline learns from before
+	// deviations are flagged (default 10).
+	MinSamples int `json:"min_samples"`
+	// Consecutive is how many deviating queries in a row start an anomaly,
+	// and how many normal ones end it (default 3).
+	Consecutive int `json:"consecutive"`
+	// MinLatency is the least latency that can deviate, so jitter on very
+	// fast servers is not flagged (default 20ms).
+	MinLatency Duration `json:"min_latency"`
+}
+
+func (c LatencyAnomalyConfig) factor() float64 {
+	if c.Factor <= 0 {
+		return defaultAnomalyFactor
+	}
+	return c.Factor
+}
+
+func (c LatencyAnomalyConfig) alpha() float64 {
+	if c.Alpha <= 0 {
+		return defaultAnomalyAlpha
+	}
+	return c.Alpha
+}
+
+func (c LatencyAnomalyConfig) minSamples() int {
+	if c.MinSamples <= 0 {
+		return defaultAnomalyMinSamples
+	}
+	return c.MinSamples
+}
+
+func (c LatencyAnomalyConfig) consecutive() int {
+	if c.Consecutive <= 0 {
+		return defaultAnomalyConsecutive
+	}
+	return c.Consecutive
+}
+
+func (c LatencyAnomalyConfig) minLatency() time.Duration {
+	if c.MinLatency.Duration <= 0 {
+		return defaultAnomalyMinLatency
+	}
+	return c.MinLatency.Duration
+}
+
+func validateLatencyAnomaly(c *Config) error {
+	l := c.LatencyAnomaly
+	var problems configProblems
+	problems.check(l.Factor == 0 || l.Factor > 1, "latency_anomaly.factor", "must be greater than 1")
+	problems.check(l.Alpha >= 0 && l.Alpha <= 1, "latency_anomaly.alpha", "must be between 0 and 1")
+	problems.check(l.MinSamples >= 0, "latency_anomaly.min_samples", "must not be negative")
+	problems.check(l.Consecutive >= 0, "latency_anomaly.consecutive", "must not be negative")
+	problems.check(l.MinLatency.Duration >= 0, "latency_anomaly.min_latency", "must not be negative")
+	return problems.err()
+}
+
+// LatencyAnomaly describes a server whose queries for a hostname take far
+// longer than its baseline.
+type LatencyAnomaly struct {
+	Server     string    `json:"server"`
+	Hostname   string    `json:"hostname"`
+	Since      time.Time `json:"since"`
+	BaselineMs float64   `json:"baseline_ms"`
+	LatencyMs  float64   `json:"latency_ms"`
+}
+
+// latencyBaseline is the learned latency of one server and hostname.
+type latencyBaseline struct {
+	ewma    float64
+	samples int
+	// deviating counts consecutive deviating queries, normal consecutive
+	// normal ones while anomalous.
+	deviating, normal int
+	anomaly           *LatencyAnomaly
+}
+
+// latencyTracker keeps a baseline per server and hostname.
+type latencyTracker struct {
+	mu        sync.Mutex
+	baselines map[[2]string]*latencyBaseline
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{baselines: make(map[[2]string]*latencyBaseline)}
+}
+
+// observe adds a query's latency and returns the baseline it was judged
+// against, the anomaly afterwards (nil when there is none) and whether one
+// started or ended. Deviating queries do not move the baseline, so a lasting
+// slowdown stays flagged until latency recovers.
+func (t *latencyTracker) observe(config LatencyAnomalyConfig, server, hostname string, latency time.Duration, now time.Time) (time.Duration, *LatencyAnomaly, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := [2]string{server, hostname}
+	b, ok := t.baselines[key]
+	if !ok {
+		b = &latencyBaseline{}
+		t.baselines[key] = b
+	}
+	baseline := time.Duration(b.ewma)
+	learning := b.samples < config.minSamples()
+	deviates := !learning && b.ewma > 0 && latency >= config.minLatency() && float64(latency) > config.factor()*b.ewma
+
+	if !deviates {
+		if b.samples == 0 {
+			b.ewma = float64(latency)
+		} else {
+			b.ewma += config.alpha() * (float64(latency) - b.ewma)
+		}
+		b.samples++
+		b.deviating = 0
+	} else {
+		b.deviating++
+		b.normal = 0
+	}
+
+	if b.anomaly == nil {
+		if b.deviating < config.consecutive() {
+			return baseline, nil, false
+		}
+		b.anomaly = &LatencyAnomaly{Server: server, Hostname: hostname, Since: now}
+		b.anomaly.BaselineMs = milliseconds(baseline)
+		b.anomaly.LatencyMs = milliseconds(latency)
+		anomaly := *b.anomaly
+		return baseline, &anomaly, true
+	}
+	if deviates {
+		b.anomaly.LatencyMs = milliseconds(latency)
+		anomaly := *b.anomaly
+		return baseline, &anomaly, false
+	}
+	b.normal++
+	if b.normal < config.consecutive() {
+		anomaly := *b.anomaly
+		return baseline, &anomaly, false
+	}
+	b.anomaly = nil
+	b.normal = 0
+	return baseline, nil, true
+}
+
+func (t *latencyTracker) snapshot() []LatencyAnomaly {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var anomalies []LatencyAnomaly
+	for _, b := range t.baselines {
+		if b.anomaly != nil {
+			anomalies = append(anomalies, *b.anomaly)
+		}
+	}
+	sort.Slice(anomalies, func(i, j int) bool {
+		if anomalies[i].Server != anomalies[j].Server {
+			return anomalies[i].Server < anomalies[j].Server
+		}
+		return anomalies[i].Hostname < anomalies[j].Hostname
+	})
+	return anomalies
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// LatencyAnomalySnapshot returns the servers and hostnames whose latency is
+// currently anomalous.
+func (r *DNSResolver) LatencyAnomalySnapshot() []LatencyAnomaly {
+	if r.latencies == nil {
+		return nil
+	}
+	return r.latencies.snapshot()
+}
+
+// detectLatencyAnomaly judges a query's latency against the baseline of
+// server and hostname, raising latency_anomaly_start when queries keep
+// taking a multiple of it and latency_anomaly_end when they recover.
+func (r *DNSResolver) detectLatencyAnomaly(server, hostname string, latency time.Duration) {
+	if r.latencies == nil {
+		return
+	}
+	config := r.currentConfig().LatencyAnomaly
+	if config.Disabled {
+		return
+	}
+	now := time.Now()
+	baseline, anomaly, changed := r.latencies.observe(config, server, hostname, latency, now)
+	label := r.metricHostname(hostname)
+	if baseline > 0 {
+		metrics.DNSResolutionLatencyBaseline.WithLabelValues(server, label).Set(baseline.Seconds())
+	}
+	if anomaly != nil {
+		metrics.DNSResolutionLatencyAnomaly.WithLabelValues(server, label).Set(1)
+	} else {
+		metrics.DNSResolutionLatencyAnomaly.WithLabelValues(server, label).Set(0)
+	}
+	if !changed {
+		return
+	}
+	if anomaly == nil {
+		detail := fmt.Sprintf("latency %s back within %gx the baseline of %s", latency.Round(time.Millisecond), config.factor(), baseline.Round(time.Millisecond))
+		r.appLogf(instrumentation.Low, "latency anomaly end hostname=%s server=%s latency=%s baseline=%s", hostname, server, latency, baseline)
+		r.emitEvent(ResolverEvent{
+			Type:     EventAnomalyEnd,
+			Time:     now,
+			Hostname: hostname,
+			Server:   server,
+			Duration: latency,
+			Detail:   detail,
+		})
+		return
+	}
+	metrics.DNSResolutionLatencyAnomalies.WithLabelValues(server).Inc()
+	detail := fmt.Sprintf("latency %s is %.1fx the baseline of %s", latency.Round(time.Millisecond), float64(latency)/float64(baseline), baseline.Round(time.Millisecond))
+	r.appLogf(instrumentation.Low, "latency anomaly start hostname=%s server=%s latency=%s baseline=%s", hostname, server, latency, baseline)
+	r.errorLog.Printf("Latency anomaly for %s using %s: %s", hostname, server, detail)
+	r.emitEvent(ResolverEvent{
+		Type:     EventAnomalyStart,
+		Time:     now,
+		Hostname: hostname,
+		Server:   server,
+		Duration: latency,
+		Detail:   detail,
+	})
+}
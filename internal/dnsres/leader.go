@@ -0,0 +1,309 @@
+package dnsres
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+)
+
+// Leader election backends for leader.backend.
+const (
+	LeaderBackendFile       = "file"
+	LeaderBackendKubernetes = "kubernetes"
+	LeaderBackendEtcd       = "etcd"
+)
+
+// Leader election defaults used when leader leaves them unset.
+const (
+	defaultLeaseDuration = 15 * time.Second
+	minLeaseDuration     = 3 * time.Second
+	defaultLeaseName     = "dnsres"
+	defaultLeaderKey     = "dnsres/leader"
+	leaderRequestTimeout = 5 * time.Second
+)
+
+// LeaderConfig configures leader election between instances probing the same
+// fleet. Only the leader sends email alerts and incident webhooks and
+// archives reports; every instance keeps resolving and exporting metrics.
+type LeaderConfig struct {
+	// Backend is "file", "kubernetes" or "etcd". Empty disables election,
+	// and the instance always leads.
+	Backend string `json:"backend,omitempty"`
+	// Identity names this instance in the lock. It defaults to the host
+	// name and process ID.
+	Identity string `json:"identity,omitempty"`
+	// LeaseDuration is how long the lock outlives a leader that stopped
+	// renewing it (kubernetes and etcd). The lock is renewed every third of
+	// it.
+	LeaseDuration Duration `json:"lease_duration"`
+	// Path is the lock file of the file backend, on storage every instance
+	// shares.
+	Path string `json:"path,omitempty"`
+	// Namespace and Name locate the Lease of the kubernetes backend, which
+	// connects like kubernetes discovery: through Kubeconfig when set,
+	// otherwise with the pod's service account, and to URL when set.
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	URL        string `json:"url,omitempty"`
+	// Address is the etcd v3 JSON gateway of the etcd backend and Key the
+	// key its leader holds.
+	Address string `json:"address,omitempty"`
+	Key     string `json:"key,omitempty"`
+}
+
+func (c LeaderConfig) leaseDuration() time.Duration {
+	if c.LeaseDuration.Duration <= 0 {
+		return defaultLeaseDuration
+	}
+	return c.LeaseDuration.Duration
+}
+
+func (c LeaderConfig) identity() string {
+	if c.Identity != "" {
+		return c.Identity
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "dnsres"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func validateLeader(c *Config) error {
+	l := c.Leader
+	if l.Backend == "" {
+		return nil
+	}
+	var problems configProblems
+	problems.check(l.LeaseDuration.Duration == 0 || l.LeaseDuration.Duration >= minLeaseDuration, "leader.lease_duration", fmt.Sprintf("must be at least %s", minLeaseDuration))
+	switch l.Backend {
+	case LeaderBackendFile:
+		problems.check(l.Path != "", "leader.path", "is required for the file backend")
+	case LeaderBackendKubernetes:
+	case LeaderBackendEtcd:
+		problems.check(l.Address != "", "leader.address", "is required for the etcd backend")
+	default:
+		problems.add("leader.backend", fmt.Errorf("unknown leader backend %q", l.Backend))
+	}
+	return problems.err()
+}
+
+// leaderElector campaigns for leadership through one backend. Campaign is
+// called every third of the lease duration; it takes the lock when it is
+// free or expired and renews it while held. Calls are not concurrent.
+type leaderElector interface {
+	Campaign(ctx context.Context) (leading bool, holder string, err error)
+	// Resign releases the lock if held, so another instance takes over
+	// without waiting for the lease to expire.
+	Resign(ctx context.Context) error
+}
+
+func newLeaderElector(config LeaderConfig) (leaderElector, error) {
+	identity := config.identity()
+	switch config.Backend {
+	case LeaderBackendFile:
+		return newFileElector(config.Path, identity)
+	case LeaderBackendKubernetes:
+		namespace := config.Namespace
+		if namespace == "" && config.Kubeconfig == "" {
+			if data, err := os.ReadFile(serviceAccountNamespaceFile); err == nil {
+				namespace = strings.TrimSpace(string(data))
+			}
+		}
+		api, err := newKubernetesAPI(config.Kubeconfig, config.URL, namespace)
+		if err != nil {
+			return nil, err
+		}
+		if api.namespace == "" {
+			api.namespace = "default"
+		}
+		name := config.Name
+		if name == "" {
+			name = defaultLeaseName
+		}
+		return &leaseElector{api: api, name: name, identity: identity, duration: config.leaseDuration(), now: time.Now}, nil
+	case LeaderBackendEtcd:
+		key := config.Key
+		if key == "" {
+			key = defaultLeaderKey
+		}
+		return newEtcdElector(config.Address, key, identity, config.leaseDuration()), nil
+	}
+	return nil, fmt.Errorf("unknown leader backend %q", config.Backend)
+}
+
+// LeaderStatus describes this instance's part in leader election.
+type LeaderStatus struct {
+	Backend  string `json:"backend"`
+	Identity string `json:"identity"`
+	Leader   bool   `json:"leader"`
+	// Holder is the identity of the current leader, when known.
+	Holder string `json:"holder,omitempty"`
+	// Since is when this instance last became leader or stood by.
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// leaderState tracks the outcome of the campaigns.
+type leaderState struct {
+	elector  leaderElector
+	duration time.Duration
+	leading  atomic.Bool
+
+	mu     sync.Mutex
+	status LeaderStatus
+	// decided is set by the first campaign's outcome.
+	decided bool
+	renewed time.Time
+}
+
+func newLeaderState(config *Config) (*leaderState, error) {
+	if config.Leader.Backend == "" {
+		return nil, nil
+	}
+	elector, err := newLeaderElector(config.Leader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up leader election: %w", err)
+	}
+	return &leaderState{
+		elector:  elector,
+		duration: config.Leader.leaseDuration(),
+		status: LeaderStatus{
+			Backend:  config.Leader.Backend,
+			Identity: config.Leader.identity(),
+			Since:    time.Now(),
+		},
+	}, nil
+}
+
+// leading reports whether this instance should send alerts and reports:
+// always when leader election is disabled.
+func (r *DNSResolver) leading() bool {
+	return r.leader == nil || r.leader.leading.Load()
+}
+
+// LeaderSnapshot returns this instance's leader election status, or nil when
+// leader election is disabled.
+func (r *DNSResolver) LeaderSnapshot() *LeaderStatus {
+	if r.leader == nil {
+		return nil
+	}
+	r.leader.mu.Lock()
+	defer r.leader.mu.Unlock()
+	status := r.leader.status
+	return &status
+}
+
+// startLeaderElection runs the first campaign, so alerts raised by the first
+// cycle go out from the leader, then campaigns in the background. The
+// returned func stops campaigning and resigns.
+func (r *DNSResolver) startLeaderElection(ctx context.Context) func() {
+	l := r.leader
+	r.campaign(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(l.duration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.campaign(ctx)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		l.leading.Store(false)
+		metrics.DNSResLeader.Set(0)
+		resignCtx, cancel := context.WithTimeout(context.Background(), leaderRequestTimeout)
+		defer cancel()
+		if err := l.elector.Resign(resignCtx); err != nil {
+			r.errorLog.Printf("Leader election resign failed: %v", err)
+		}
+	}
+}
+
+// campaign runs one campaign. After an error a leader keeps leading until
+// its lease would have expired, so a brief outage of the backend does not
+// drop alerts.
+func (r *DNSResolver) campaign(ctx context.Context) {
+	l := r.leader
+	ctx, cancel := context.WithTimeout(ctx, leaderRequestTimeout)
+	leading, holder, err := l.elector.Campaign(ctx)
+	cancel()
+	now := time.Now()
+
+	l.mu.Lock()
+	if err != nil {
+		l.status.LastError = err.Error()
+		expired := now.Sub(l.renewed) >= l.duration
+		l.mu.Unlock()
+		metrics.DNSResLeaderElectionErrors.Inc()
+		r.errorLog.Printf("Leader election campaign failed: %v", err)
+		if expired {
+			r.setLeading(false, "")
+		}
+		return
+	}
+	l.status.LastError = ""
+	if leading {
+		l.renewed = now
+	}
+	l.mu.Unlock()
+	r.setLeading(leading, holder)
+}
+
+// setLeading records the campaign's outcome and logs changes of leadership.
+func (r *DNSResolver) setLeading(leading bool, holder string) {
+	l := r.leader
+	l.mu.Lock()
+	transition := l.decided && l.status.Leader != leading
+	changed := !l.decided || transition
+	l.decided = true
+	l.status.Leader = leading
+	l.status.Holder = holder
+	if changed {
+		l.status.Since = time.Now()
+	}
+	l.mu.Unlock()
+	l.leading.Store(leading)
+
+	if leading {
+		metrics.DNSResLeader.Set(1)
+	} else {
+		metrics.DNSResLeader.Set(0)
+	}
+	if transition {
+		metrics.DNSResLeaderTransitions.Inc()
+	}
+	if !changed {
+		return
+	}
+	if leading {
+		r.outputf("Leader election: this instance is now the leader\n")
+		r.appLogf(instrumentation.Low, "leader election won backend=%s", l.status.Backend)
+		return
+	}
+	r.outputf("Leader election: standing by (leader %s)\n", orNone(holder))
+	r.appLogf(instrumentation.Low, "leader election standing by backend=%s holder=%s", l.status.Backend, holder)
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
@@ -0,0 +1,9 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package dnsres
+
+import "fmt"
+
+func newFileElector(path, identity string) (leaderElector, error) {
+	return nil, fmt.Errorf("the file leader backend is not supported on this platform; use kubernetes or etcd")
+}
@@ -0,0 +1,79 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package dnsres
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// fileElector leads while it holds an exclusive flock on a shared file. The
+// kernel drops the lock when the process exits, so the file needs no lease.
+// The leader writes its identity into the file for the others to report.
+type fileElector struct {
+	path     string
+	identity string
+	file     *os.File
+}
+
+func newFileElector(path, identity string) (leaderElector, error) {
+	return &fileElector{path: path, identity: identity}, nil
+}
+
+func (e *fileElector) Campaign(ctx context.Context) (bool, string, error) {
+	if e.file != nil {
+		// A lock on a file that was deleted or replaced no longer keeps
+		// others out.
+		held, errHeld := e.file.Stat()
+		current, errCurrent := os.Stat(e.path)
+		if errHeld == nil && errCurrent == nil && os.SameFile(held, current) {
+			return true, e.identity, nil
+		}
+		e.release()
+	}
+
+	f, err := os.OpenFile(e.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return false, "", err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		holder, _ := io.ReadAll(f)
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, strings.TrimSpace(string(holder)), nil
+		}
+		return false, "", err
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return false, "", err
+	}
+	if _, err := f.WriteAt([]byte(e.identity+"\n"), 0); err != nil {
+		f.Close()
+		return false, "", err
+	}
+	e.file = f
+	return true, e.identity, nil
+}
+
+func (e *fileElector) Resign(ctx context.Context) error {
+	if e.file == nil {
+		return nil
+	}
+	if err := e.file.Truncate(0); err != nil {
+		e.release()
+		return err
+	}
+	e.release()
+	return nil
+}
+
+// release closes the file, which drops the lock.
+func (e *fileElector) release() {
+	e.file.Close()
+	e.file = nil
+}
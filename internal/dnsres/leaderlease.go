@@ -0,0 +1,294 @@
+package dnsres
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kubernetesMicroTime is the layout of Lease timestamps.
+const kubernetesMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// kubernetesLease holds the fields of a coordination.k8s.io/v1 Lease.
+type kubernetesLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace,omitempty"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// leaseElector leads while it holds a Kubernetes Lease. Writes carry the
+// resourceVersion read, so of two instances taking an expired Lease only one
+// succeeds. Expiry is judged by when this instance last saw the Lease change,
+// not by its renewTime, so clock skew between instances does not matter.
+type leaseElector struct {
+	api      kubernetesAPI
+	name     string
+	identity string
+	duration time.Duration
+	now      func() time.Time
+
+	observedVersion string
+	observedAt      time.Time
+}
+
+func (e *leaseElector) path() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + url.PathEscape(e.api.namespace) + "/leases"
+}
+
+func (e *leaseElector) Campaign(ctx context.Context) (bool, string, error) {
+	lease, err := e.get(ctx)
+	if err != nil {
+		return false, "", err
+	}
+	now := e.now()
+	timestamp := now.UTC().Format(kubernetesMicroTime)
+	if lease == nil {
+		lease = &kubernetesLease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		lease.Metadata.Name = e.name
+		lease.Metadata.Namespace = e.api.namespace
+		lease.Spec.HolderIdentity = e.identity
+		lease.Spec.LeaseDurationSeconds = e.durationSeconds()
+		lease.Spec.AcquireTime = timestamp
+		lease.Spec.RenewTime = timestamp
+		ok, err := e.write(ctx, http.MethodPost, e.path(), lease)
+		if err != nil || !ok {
+			return false, "", err
+		}
+		return true, e.identity, nil
+	}
+
+	if lease.Metadata.ResourceVersion != e.observedVersion {
+		e.observedVersion, e.observedAt = lease.Metadata.ResourceVersion, now
+	}
+	holder := lease.Spec.HolderIdentity
+	held := time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second
+	if holder != "" && holder != e.identity && now.Before(e.observedAt.Add(held)) {
+		return false, holder, nil
+	}
+
+	if holder != e.identity {
+		lease.Spec.AcquireTime = timestamp
+		if holder != "" {
+			lease.Spec.LeaseTransitions++
+		}
+	}
+	lease.Spec.HolderIdentity = e.identity
+	lease.Spec.LeaseDurationSeconds = e.durationSeconds()
+	lease.Spec.RenewTime = timestamp
+	ok, err := e.write(ctx, http.MethodPut, e.path()+"/"+url.PathEscape(e.name), lease)
+	if err != nil {
+		return false, "", err
+	}
+	if !ok {
+		// Another instance wrote first.
+		return false, holder, nil
+	}
+	return true, e.identity, nil
+}
+
+func (e *leaseElector) Resign(ctx context.Context) error {
+	lease, err := e.get(ctx)
+	if err != nil || lease == nil || lease.Spec.HolderIdentity != e.identity {
+		return err
+	}
+	lease.Spec.HolderIdentity = ""
+	lease.Spec.LeaseDurationSeconds = 1
+	lease.Spec.RenewTime = e.now().UTC().Format(kubernetesMicroTime)
+	_, err = e.write(ctx, http.MethodPut, e.path()+"/"+url.PathEscape(e.name), lease)
+	return err
+}
+
+func (e *leaseElector) durationSeconds() int {
+	return int((e.duration + time.Second - 1) / time.Second)
+}
+
+// get returns the Lease, or nil when it does not exist yet.
+func (e *leaseElector) get(ctx context.Context) (*kubernetesLease, error) {
+	resp, err := e.api.do(ctx, http.MethodGet, e.path()+"/"+url.PathEscape(e.name), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s reading lease %s/%s", resp.Status, e.api.namespace, e.name)
+	}
+	var lease kubernetesLease
+	if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+		return nil, fmt.Errorf("failed to decode lease: %w", err)
+	}
+	return &lease, nil
+}
+
+// write creates or updates the Lease. It reports false when another
+// instance created or updated it first.
+func (e *leaseElector) write(ctx context.Context, method, path string, lease *kubernetesLease) (bool, error) {
+	resp, err := e.api.do(ctx, method, path, lease)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		return false, nil
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("unexpected status %s writing lease %s/%s", resp.Status, e.api.namespace, e.name)
+	}
+	var written kubernetesLease
+	if err := json.NewDecoder(resp.Body).Decode(&written); err == nil {
+		e.observedVersion, e.observedAt = written.Metadata.ResourceVersion, e.now()
+	}
+	return true, nil
+}
+
+// etcdElector leads while its lease-bound key holds the election key in
+// etcd, through the v3 JSON gateway. etcd deletes the key when the lease
+// expires, so a leader that stops renewing loses it after the lease
+// duration.
+type etcdElector struct {
+	address  string
+	key      string
+	identity string
+	ttl      int
+	client   *http.Client
+	// lease is the ID of the etcd lease, or 0 before one is granted.
+	lease int64
+}
+
+func newEtcdElector(address, key, identity string, duration time.Duration) *etcdElector {
+	return &etcdElector{
+		address:  strings.TrimSuffix(address, "/"),
+		key:      key,
+		identity: identity,
+		ttl:      int((duration + time.Second - 1) / time.Second),
+		client:   &http.Client{Timeout: leaderRequestTimeout},
+	}
+}
+
+func (e *etcdElector) Campaign(ctx context.Context) (bool, string, error) {
+	if e.lease != 0 {
+		var keepAlive struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+		if err := e.call(ctx, "/v3/lease/keepalive", map[string]string{"ID": strconv.FormatInt(e.lease, 10)}, &keepAlive); err != nil {
+			return false, "", err
+		}
+		if ttl, _ := strconv.Atoi(keepAlive.Result.TTL); ttl <= 0 {
+			// The lease expired and took the key with it.
+			e.lease = 0
+		}
+	}
+	if e.lease == 0 {
+		var grant struct {
+			ID string `json:"ID"`
+		}
+		if err := e.call(ctx, "/v3/lease/grant", map[string]string{"TTL": strconv.Itoa(e.ttl)}, &grant); err != nil {
+			return false, "", err
+		}
+		id, err := strconv.ParseInt(grant.ID, 10, 64)
+		if err != nil || id == 0 {
+			return false, "", fmt.Errorf("etcd granted no lease")
+		}
+		e.lease = id
+	}
+
+	key := base64.StdEncoding.EncodeToString([]byte(e.key))
+	lease := strconv.FormatInt(e.lease, 10)
+	txn := map[string]any{
+		"compare": []any{map[string]string{"key": key, "target": "CREATE", "result": "EQUAL", "create_revision": "0"}},
+		"success": []any{map[string]any{"request_put": map[string]string{
+			"key":   key,
+			"value": base64.StdEncoding.EncodeToString([]byte(e.identity)),
+			"lease": lease,
+		}}},
+		"failure": []any{map[string]any{"request_range": map[string]string{"key": key}}},
+	}
+	var result struct {
+		Succeeded bool `json:"succeeded"`
+		Responses []struct {
+			ResponseRange struct {
+				KVs []struct {
+					Value string `json:"value"`
+					Lease string `json:"lease"`
+				} `json:"kvs"`
+			} `json:"response_range"`
+		} `json:"responses"`
+	}
+	if err := e.call(ctx, "/v3/kv/txn", txn, &result); err != nil {
+		return false, "", err
+	}
+	if result.Succeeded {
+		return true, e.identity, nil
+	}
+	if len(result.Responses) == 0 || len(result.Responses[0].ResponseRange.KVs) == 0 {
+		// The key expired between the compare and the range.
+		return false, "", nil
+	}
+	kv := result.Responses[0].ResponseRange.KVs[0]
+	holder, _ := base64.StdEncoding.DecodeString(kv.Value)
+	if kv.Lease == lease {
+		return true, e.identity, nil
+	}
+	return false, string(holder), nil
+}
+
+func (e *etcdElector) Resign(ctx context.Context) error {
+	if e.lease == 0 {
+		return nil
+	}
+	// Revoking the lease deletes the key.
+	err := e.call(ctx, "/v3/lease/revoke", map[string]string{"ID": strconv.FormatInt(e.lease, 10)}, nil)
+	e.lease = 0
+	return err
+}
+
+// call posts request to the gateway and decodes the first JSON object of the
+// response into result.
+func (e *etcdElector) call(ctx context.Context, path string, request, result any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.address+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from etcd %s", resp.Status, path)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to decode etcd response: %w", err)
+	}
+	return nil
+}
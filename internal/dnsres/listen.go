@@ -0,0 +1,163 @@
+package dnsres
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// ListenError reports that Start could not bind one of the resolver's
+// listeners, typically because another process holds its port.
+type ListenError struct {
+	// Listener is "health", "metrics", "grpc" or "forwarder".
+	Listener string
+	Network  string
+	Address  string
+	Err      error
+}
+
+func (e *ListenError) Error() string {
+	return fmt.Sprintf("%s listener cannot bind %s/%s: %v", e.Listener, e.Address, e.Network, e.Err)
+}
+
+func (e *ListenError) Unwrap() error {
+	return e.Err
+}
+
+// AddrInUse reports whether the address was already bound.
+func (e *ListenError) AddrInUse() bool {
+	return errors.Is(e.Err, syscall.EADDRINUSE)
+}
+
+// listenerPorts records the port each listener bound, which differs from
+// the configured one when that is 0.
+type listenerPorts struct {
+	mu    sync.Mutex
+	ports map[string]int
+}
+
+func (l *listenerPorts) set(name string, addr net.Addr) {
+	var port int
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		port = addr.Port
+	case *net.UDPAddr:
+		port = addr.Port
+	default:
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ports == nil {
+		l.ports = make(map[string]int)
+	}
+	l.ports[name] = port
+}
+
+func (l *listenerPorts) snapshot() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return maps.Clone(l.ports)
+}
+
+// ListenPorts returns the port bound by each listener the resolver has
+// started, keyed by listener name. A port configured as 0 shows the port the
+// system chose.
+func (r *DNSResolver) ListenPorts() map[string]int {
+	return r.listeners.snapshot()
+}
+
+// listen binds a TCP listener for name, returning a *ListenError on failure.
+func (r *DNSResolver) listen(name, address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, &ListenError{Listener: name, Network: "tcp", Address: address, Err: err}
+	}
+	r.listeners.set(name, listener.Addr())
+	return listener, nil
+}
+
+// listenPacket binds a UDP socket for name, returning a *ListenError on
+// failure.
+func (r *DNSResolver) listenPacket(name, address string) (net.PacketConn, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, &ListenError{Listener: name, Network: "udp", Address: address, Err: err}
+	}
+	r.listeners.set(name, conn.LocalAddr())
+	return conn, nil
+}
+
+// boundListeners holds the sockets Start binds before anything else runs.
+// Those of disabled servers are nil.
+type boundListeners struct {
+	health       net.Listener
+	metrics      net.Listener
+	grpc         net.Listener
+	forwarderUDP net.PacketConn
+	forwarderTCP net.Listener
+}
+
+// bindListeners binds the listener of every enabled server, closing those
+// already bound when one fails.
+func (r *DNSResolver) bindListeners(config *Config) (*boundListeners, error) {
+	bound := &boundListeners{}
+	err := bound.bind(r, config)
+	if err != nil {
+		bound.close()
+		return nil, err
+	}
+	return bound, nil
+}
+
+func (b *boundListeners) bind(r *DNSResolver, config *Config) error {
+	var err error
+	if b.health, err = r.listen("health", fmt.Sprintf(":%d", config.HealthPort)); err != nil {
+		return err
+	}
+	if b.metrics, err = r.listen("metrics", fmt.Sprintf(":%d", config.MetricsPort)); err != nil {
+		return err
+	}
+	if config.GRPC.Port != 0 {
+		if b.grpc, err = r.listen("grpc", fmt.Sprintf(":%d", config.GRPC.Port)); err != nil {
+			return err
+		}
+	}
+	if config.Forwarder.Enabled {
+		addr := config.forwarderAddr()
+		if b.forwarderUDP, err = r.listenPacket("forwarder", addr); err != nil {
+			return err
+		}
+		if b.forwarderTCP, err = r.listen("forwarder", addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close closes every listener bound.
+func (b *boundListeners) close() {
+	b.closeDeferred()
+	for _, listener := range []net.Listener{b.health, b.metrics} {
+		if listener != nil {
+			listener.Close()
+		}
+	}
+}
+
+// closeDeferred closes the gRPC and forwarder listeners, which Start serves
+// only after remote config and leader election, when it returns before
+// serving them.
+func (b *boundListeners) closeDeferred() {
+	for _, listener := range []net.Listener{b.grpc, b.forwarderTCP} {
+		if listener != nil {
+			listener.Close()
+		}
+	}
+	if b.forwarderUDP != nil {
+		b.forwarderUDP.Close()
+	}
+}
@@ -9,9 +9,16 @@ import (
 	"dnsres/internal/xdg"
 )
 
-// setupLoggers initializes the loggers
+// setupLoggers initializes the loggers without rotation
 // Returns: (successLog, errorLog, appLog, actualPath, wasFallback, error)
 func setupLoggers(logDir string) (*log.Logger, *log.Logger, *log.Logger, string, bool, error) {
+	return setupRotatingLoggers(logDir, nil)
+}
+
+// setupRotatingLoggers initializes the loggers, rotating each stream per cfg
+// (nil disables rotation)
+// Returns: (successLog, errorLog, appLog, actualPath, wasFallback, error)
+func setupRotatingLoggers(logDir string, cfg *Config) (*log.Logger, *log.Logger, *log.Logger, string, bool, error) {
 	wasFallback := false
 
 	// If empty or default "logs", use XDG
@@ -29,29 +36,24 @@ func setupLoggers(logDir string) (*log.Logger, *log.Logger, *log.Logger, string,
 		}
 	}
 
-	successLogFile, err := os.OpenFile(
-		filepath.Join(logDir, "dnsres-success.log"),
-		os.O_APPEND|os.O_CREATE|os.O_WRONLY,
-		0644,
-	)
+	var successRotation, errorRotation, appRotation LogRotation
+	if cfg != nil {
+		successRotation = cfg.LogRotation.Success
+		errorRotation = cfg.LogRotation.Error
+		appRotation = cfg.LogRotation.App
+	}
+
+	successLogFile, err := openRotatingFile(filepath.Join(logDir, "dnsres-success.log"), "success", successRotation)
 	if err != nil {
 		return nil, nil, nil, "", false, fmt.Errorf("failed to open success log file: %w", err)
 	}
 
-	errorLogFile, err := os.OpenFile(
-		filepath.Join(logDir, "dnsres-error.log"),
-		os.O_APPEND|os.O_CREATE|os.O_WRONLY,
-		0644,
-	)
+	errorLogFile, err := openRotatingFile(filepath.Join(logDir, "dnsres-error.log"), "error", errorRotation)
 	if err != nil {
 		return nil, nil, nil, "", false, fmt.Errorf("failed to open error log file: %w", err)
 	}
 
-	appLogFile, err := os.OpenFile(
-		filepath.Join(logDir, "dnsres-app.log"),
-		os.O_APPEND|os.O_CREATE|os.O_WRONLY,
-		0644,
-	)
+	appLogFile, err := openRotatingFile(filepath.Join(logDir, "dnsres-app.log"), "app", appRotation)
 	if err != nil {
 		return nil, nil, nil, "", false, fmt.Errorf("failed to open app log file: %w", err)
 	}
@@ -1,11 +1,17 @@
 package dnsres
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"dnsres/internal/archive"
 )
 
 func TestSetupLoggers(t *testing.T) {
@@ -221,3 +227,212 @@ func TestLoggerEdgeCases(t *testing.T) {
 		}
 	})
 }
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		rotation    LogRotation
+		advance     time.Duration
+		wantBackups int
+		wantSuffix  string
+	}{
+		{name: "size limit", rotation: LogRotation{MaxSizeMB: 1}, wantBackups: 2},
+		{name: "retention", rotation: LogRotation{MaxSizeMB: 1, MaxBackups: 1}, wantBackups: 1},
+		{name: "compress", rotation: LogRotation{MaxSizeMB: 1, Compress: true}, wantBackups: 2, wantSuffix: ".gz"},
+		{name: "age limit", rotation: LogRotation{MaxAge: Duration{time.Hour}}, advance: 2 * time.Hour, wantBackups: 2},
+		{name: "disabled", wantBackups: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dnsres-test.log")
+			now := time.Date(2024, 3, 14, 10, 0, 0, 0, time.UTC)
+			f, err := openRotatingFile(path, "test", tt.rotation)
+			if err != nil {
+				t.Fatalf("openRotatingFile() error = %v", err)
+			}
+			defer f.Close()
+			f.now = func() time.Time { return now }
+			f.opened = now
+
+			chunk := []byte(strings.Repeat("x", 700*1024))
+			if tt.advance > 0 {
+				chunk = []byte("line\n")
+			}
+			for i := 0; i < 3; i++ {
+				if _, err := f.Write(chunk); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+				now = now.Add(time.Second + tt.advance)
+			}
+
+			backups, err := f.backups()
+			if err != nil {
+				t.Fatalf("backups() error = %v", err)
+			}
+			if len(backups) != tt.wantBackups {
+				t.Fatalf("expected %d backups, got %v", tt.wantBackups, backups)
+			}
+			for _, backup := range backups {
+				if !strings.HasSuffix(backup, tt.wantSuffix) {
+					t.Errorf("expected %s to end in %q", backup, tt.wantSuffix)
+				}
+			}
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("expected active log file to exist: %v", err)
+			}
+		})
+	}
+}
+
+func TestRotatingFileKeepsWritingWhenRotationStepsFail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsres-test.log")
+	now := time.Date(2024, 3, 14, 10, 0, 0, 0, time.UTC)
+	f, err := openRotatingFile(path, "test", LogRotation{MaxSizeMB: 1, MaxBackups: 1, Compress: true})
+	if err != nil {
+		t.Fatalf("openRotatingFile() error = %v", err)
+	}
+	defer f.Close()
+	var failures []string
+	f.logf = func(format string, args ...any) { failures = append(failures, fmt.Sprintf(format, args...)) }
+	f.now = func() time.Time { return now }
+
+	// A non-empty directory sorts as the oldest backup and cannot be
+	// pruned; another where the first rotation compresses to stops gzip.
+	if err := os.MkdirAll(filepath.Join(path+".0", "keep"), 0755); err != nil {
+		t.Fatalf("failed to create unprunable backup: %v", err)
+	}
+	firstRotation := now.Add(time.Second).Format(rotationTimeFormat)
+	if err := os.MkdirAll(path+"."+firstRotation+".gz.tmp", 0755); err != nil {
+		t.Fatalf("failed to block compression: %v", err)
+	}
+
+	chunk := []byte(strings.Repeat("x", 700*1024))
+	for i := 0; i < 3; i++ {
+		if _, err := f.Write(chunk); err != nil {
+			t.Fatalf("Write() %d error = %v", i, err)
+		}
+		now = now.Add(time.Second)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != int64(len(chunk)) {
+		t.Fatalf("expected the active file to hold the last write, got %v, %v", info, err)
+	}
+	var compressFailed, pruneFailed bool
+	for _, failure := range failures {
+		compressFailed = compressFailed || strings.Contains(failure, "failed to compress")
+		pruneFailed = pruneFailed || strings.Contains(failure, "failed to prune")
+	}
+	if !compressFailed || !pruneFailed {
+		t.Fatalf("expected compress and prune failures to be logged, got %q", failures)
+	}
+}
+
+// memoryStore is an archive.Store kept in memory.
+type memoryStore struct {
+	objects map[string]archive.Object
+	bodies  map[string]string
+}
+
+func (s *memoryStore) Put(_ context.Context, key string, body io.ReadSeeker, _ int64, _ string) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	s.objects[key] = archive.Object{Key: key, LastModified: time.Now()}
+	s.bodies[key] = string(data)
+	return nil
+}
+
+func (s *memoryStore) List(_ context.Context, prefix string) ([]archive.Object, error) {
+	var objects []archive.Object
+	for key, object := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
+func (s *memoryStore) Delete(_ context.Context, key string) error {
+	delete(s.objects, key)
+	return nil
+}
+
+func TestArchiveUploadsRotatedLogsAndReports(t *testing.T) {
+	logDir := t.TempDir()
+	files := map[string]string{
+		"dnsres-app.log":                              "current",
+		"dnsres-app.log.20261015T120000.000.gz":       "rotated app",
+		"dnsres-app.log.20261015T130000.000":          "still compressing",
+		"dnsres-error.log.20261015T120000.000":        "rotated error",
+		"dnsres-error.log.20261015T130000.000.gz.tmp": "partial",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(logDir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := &Config{}
+	config.LogRotation.App.Compress = true
+	config.Archive.Backend = "s3"
+	config.Archive.Bucket = "probes"
+	config.Archive.Retention = Duration{Duration: 24 * time.Hour}
+	if err := validateArchive(config); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	store := &memoryStore{objects: make(map[string]archive.Object), bodies: make(map[string]string)}
+	stats, _ := openStatsStore(filepath.Join(logDir, "dnsres-stats.json"))
+	stats.record(time.Now(), "www.example.com", "1.1.1.1:53", false)
+	resolver := &DNSResolver{
+		config:     config,
+		errorLog:   log.New(io.Discard, "", 0),
+		stats:      &ResolutionStats{StartTime: time.Now(), Stats: map[string]*ServerStats{"1.1.1.1:53": {Total: 10}}},
+		statsStore: stats,
+		archive: &archiver{
+			store:     store,
+			keyPrefix: "dnsres/probe-1",
+			retention: config.Archive.Retention.Duration,
+			logDir:    logDir,
+			rotation:  map[string]LogRotation{"dnsres-app.log": config.LogRotation.App, "dnsres-error.log": config.LogRotation.Error},
+			uploaded:  make(map[string]bool),
+		},
+	}
+
+	resolver.archiveLogs(context.Background())
+	want := map[string]string{
+		"dnsres/probe-1/logs/dnsres-app.log.20261015T120000.000.gz": "rotated app",
+		"dnsres/probe-1/logs/dnsres-error.log.20261015T120000.000":  "rotated error",
+	}
+	if len(store.bodies) != len(want) {
+		t.Fatalf("expected %d uploads, got %v", len(want), store.bodies)
+	}
+	for key, body := range want {
+		if store.bodies[key] != body {
+			t.Fatalf("expected %s to hold %q, got %q", key, body, store.bodies[key])
+		}
+	}
+
+	tick := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	resolver.archiveReport(context.Background(), tick)
+	report := store.bodies["dnsres/probe-1/reports/report-2026-10-16T000000.txt"]
+	if !strings.Contains(report, "1.1.1.1:53") {
+		t.Fatalf("expected the report to be archived, got %q", report)
+	}
+
+	// Objects past the retention are deleted; the rest stay.
+	store.objects["dnsres/probe-1/logs/dnsres-error.log.20261015T120000.000"] = archive.Object{
+		Key:          "dnsres/probe-1/logs/dnsres-error.log.20261015T120000.000",
+		LastModified: time.Now().Add(-48 * time.Hour),
+	}
+	resolver.expireArchive(context.Background(), time.Now())
+	if _, ok := store.objects["dnsres/probe-1/logs/dnsres-error.log.20261015T120000.000"]; ok || len(store.objects) != 2 {
+		t.Fatalf("expected only the expired object to be deleted, got %v", store.objects)
+	}
+
+	config.Archive.ReportSchedule = "not a schedule"
+	if err := validateArchive(config); err == nil {
+		t.Fatal("expected an invalid report schedule to fail validation")
+	}
+}
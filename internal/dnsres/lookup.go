@@ -0,0 +1,95 @@
+package dnsres
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"dnsres/dnsanalysis"
+
+	"github.com/miekg/dns"
+)
+
+// LookupResult is one server's answer to a one-shot lookup.
+type LookupResult struct {
+	Server string
+	// Rcode is the response code, empty when no response arrived.
+	Rcode     string
+	Addresses []string
+	TTL       uint32
+	Duration  time.Duration
+	Err       error
+}
+
+// Failed reports whether the server returned no usable answer: the query
+// failed or the rcode was not NOERROR.
+func (l LookupResult) Failed() bool {
+	return l.Err != nil || l.Rcode != dns.RcodeToString[dns.RcodeSuccess]
+}
+
+// Failure describes why the result failed.
+func (l LookupResult) Failure() string {
+	if l.Err != nil {
+		return l.Err.Error()
+	}
+	return l.Rcode
+}
+
+// Lookup resolves hostname's A records once through every server in config,
+// concurrently and without starting the resolver. Results are in config
+// order.
+func Lookup(ctx context.Context, config *Config, hostname string) []LookupResult {
+	results := make([]LookupResult, len(config.DNSServers))
+	var wg sync.WaitGroup
+	for i, server := range config.DNSServers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = lookupServer(ctx, server, hostname, config.QueryTimeoutFor(server))
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func lookupServer(ctx context.Context, server, hostname string, timeout time.Duration) LookupResult {
+	result := LookupResult{Server: server}
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(hostname), dns.TypeA)
+	msg.SetEdns0(4096, true)
+	client := &dns.Client{Timeout: timeout}
+	response, rtt, err := client.ExchangeContext(ctx, msg, server)
+	result.Duration = rtt
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Rcode = dns.RcodeToString[response.Rcode]
+	result.TTL = getMinTTL(response)
+	for _, answer := range response.Answer {
+		if a, ok := answer.(*dns.A); ok {
+			result.Addresses = append(result.Addresses, a.A.String())
+		}
+	}
+	return result
+}
+
+// LookupDiff compares the answers in results against the most common one,
+// as the resolver does for inconsistency reports.
+func LookupDiff(hostname string, results []LookupResult) *dnsanalysis.ResponseDiff {
+	var responses []*dnsanalysis.DNSResponse
+	failures := make(map[string]string)
+	for _, result := range results {
+		if result.Failed() {
+			failures[result.Server] = result.Failure()
+			continue
+		}
+		responses = append(responses, &dnsanalysis.DNSResponse{
+			Server:    result.Server,
+			Hostname:  hostname,
+			Addresses: result.Addresses,
+			TTL:       result.TTL,
+		})
+	}
+	return dnsanalysis.DiffResponses(hostname, responses, failures)
+}
@@ -0,0 +1,146 @@
+package dnsres
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// malformedSampleLimit is how many malformed responses are kept.
+	malformedSampleLimit = 100
+	// maxSampleResponseBytes caps the decoded response kept in a sample.
+	maxSampleResponseBytes = 4096
+)
+
+// MalformedSample is a response that could not be parsed or did not answer
+// its query, kept for debugging.
+type MalformedSample struct {
+	Time     time.Time `json:"time"`
+	Server   string    `json:"server"`
+	Hostname string    `json:"hostname"`
+	// Class is bad_compression, truncated, bad_rdata, long_name,
+	// id_mismatch, question_mismatch, unexpected_qdcount or malformed.
+	Class string `json:"class"`
+	Error string `json:"error"`
+	// Response is what could be decoded of the response, in dig's format.
+	Response string `json:"response,omitempty"`
+}
+
+// malformedSamples keeps the most recent malformed responses.
+type malformedSamples struct {
+	mu      sync.Mutex
+	samples []MalformedSample
+}
+
+func (s *malformedSamples) add(sample MalformedSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples = append(s.samples, sample)
+	if len(s.samples) > malformedSampleLimit {
+		s.samples = append(s.samples[:0:0], s.samples[len(s.samples)-malformedSampleLimit:]...)
+	}
+}
+
+func (s *malformedSamples) list(limit int) []MalformedSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	samples := s.samples
+	if limit > 0 && len(samples) > limit {
+		samples = samples[len(samples)-limit:]
+	}
+	return append([]MalformedSample{}, samples...)
+}
+
+// classifyMalformed returns the class of a response to msg that could not be
+// parsed or is not an answer to msg, and the error describing it. Responses
+// that failed to parse come back partially decoded along with the error;
+// errors without a response, such as timeouts, are not classified.
+func classifyMalformed(msg, response *dns.Msg, err error) (string, error) {
+	if response == nil {
+		return "", nil
+	}
+	if err != nil {
+		var dnsErr *dns.Error
+		if !errors.As(err, &dnsErr) {
+			return "", nil
+		}
+		switch {
+		case strings.Contains(err.Error(), "compression pointer"):
+			return "bad_compression", err
+		case errors.Is(err, dns.ErrBuf), errors.Is(err, dns.ErrShortRead):
+			return "truncated", err
+		case errors.Is(err, dns.ErrRdata):
+			return "bad_rdata", err
+		case errors.Is(err, dns.ErrLongDomain):
+			return "long_name", err
+		case errors.Is(err, dns.ErrId):
+			return "id_mismatch", err
+		}
+		return "malformed", err
+	}
+	if len(response.Question) != 1 {
+		return "unexpected_qdcount", fmt.Errorf("response has %d questions", len(response.Question))
+	}
+	got, want := response.Question[0], msg.Question[0]
+	if !strings.EqualFold(got.Name, want.Name) || got.Qtype != want.Qtype || got.Qclass != want.Qclass {
+		return "question_mismatch", fmt.Errorf("response is for %s %s %s", got.Name, dns.ClassToString[got.Qclass], dns.TypeToString[got.Qtype])
+	}
+	return "", nil
+}
+
+// recordMalformed counts a malformed response of server to hostname as a
+// failure, keeps a sample of it and returns the error it failed with.
+func (r *DNSResolver) recordMalformed(server, hostname, class string, response *dns.Msg, cause error, elapsed time.Duration) error {
+	err := fmt.Errorf("malformed response (%s): %w", class, cause)
+	r.recordBreakerFailure(server, err)
+	r.stats.recordFailure(server, err.Error())
+	metrics.DNSResolutionFailure.WithLabelValues(server, r.metricHostname(hostname), "malformed").Inc()
+	metrics.DNSResolutionMalformed.WithLabelValues(server, class).Inc()
+	if class == "id_mismatch" || class == "question_mismatch" {
+		if raw, packErr := response.Pack(); packErr == nil {
+			r.recordMismatch(server, hostname, strings.TrimSuffix(class, "_mismatch"), raw)
+		}
+	}
+	if r.malformed != nil {
+		decoded := response.String()
+		if len(decoded) > maxSampleResponseBytes {
+			decoded = decoded[:maxSampleResponseBytes]
+		}
+		r.malformed.add(MalformedSample{
+			Time:     time.Now(),
+			Server:   server,
+			Hostname: hostname,
+			Class:    class,
+			Error:    cause.Error(),
+			Response: decoded,
+		})
+	}
+	r.appLogf(instrumentation.Medium, "malformed response hostname=%s server=%s class=%s err=%v", hostname, server, class, cause)
+	r.emitEvent(ResolverEvent{
+		Type:     EventResolveFailure,
+		Time:     time.Now(),
+		Hostname: hostname,
+		Server:   server,
+		Duration: elapsed,
+		Error:    err.Error(),
+		Source:   "malformed",
+	})
+	return err
+}
+
+// MalformedSamples returns up to limit of the most recent malformed
+// responses, oldest first. A limit of zero returns every sample kept.
+func (r *DNSResolver) MalformedSamples(limit int) []MalformedSample {
+	if r.malformed == nil {
+		return []MalformedSample{}
+	}
+	return r.malformed.list(limit)
+}
@@ -0,0 +1,251 @@
+package dnsres
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"dnsres/dnsanalysis"
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// mdnsGroup is the IPv4 multicast DNS group and port (RFC 6762).
+const mdnsGroup = "224.0.0.251:5353"
+
+// mdnsServer labels mDNS results in metrics, events and logs where a unicast
+// server address would appear.
+const mdnsServer = "mdns"
+
+// defaultMDNSTimeout is used when mdns.timeout is unset.
+const defaultMDNSTimeout = time.Second
+
+// MDNSResult describes the most recent multicast lookup of a .local name.
+type MDNSResult struct {
+	Addresses []string  `json:"addresses,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Duration  string    `json:"duration"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// mdnsQuerier sends one query over multicast DNS and returns the first
+// response that answers it.
+type mdnsQuerier interface {
+	Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+}
+
+// multicastQuerier sends one-shot queries (RFC 6762 section 5.1) from an
+// ephemeral port; responders reply directly to that port.
+type multicastQuerier struct {
+	group string
+}
+
+func (q multicastQuerier) Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	group, err := net.ResolveUDPAddr("udp4", q.group)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(packed, group); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		response := new(dns.Msg)
+		if err := response.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		if answersQuestion(response, msg.Question[0]) {
+			return response, nil
+		}
+	}
+}
+
+// answersQuestion reports whether response carries a record for question;
+// other hosts' announcements on the same port are ignored.
+func answersQuestion(response *dns.Msg, question dns.Question) bool {
+	if !response.Response {
+		return false
+	}
+	for _, rr := range response.Answer {
+		header := rr.Header()
+		if header.Rrtype == question.Qtype && strings.EqualFold(header.Name, question.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// mdnsTracker keeps the latest result per .local name.
+type mdnsTracker struct {
+	mu      sync.RWMutex
+	results map[string]MDNSResult
+}
+
+func newMDNSTracker() *mdnsTracker {
+	return &mdnsTracker{results: make(map[string]MDNSResult)}
+}
+
+func (t *mdnsTracker) set(hostname string, result MDNSResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.results[hostname] = result
+}
+
+// MDNSSnapshot returns the latest multicast lookup result per .local name.
+func (r *DNSResolver) MDNSSnapshot() map[string]MDNSResult {
+	snapshot := map[string]MDNSResult{}
+	if r.mdns == nil {
+		return snapshot
+	}
+	r.mdns.mu.RLock()
+	defer r.mdns.mu.RUnlock()
+	for hostname, result := range r.mdns.results {
+		snapshot[hostname] = result
+	}
+	return snapshot
+}
+
+// probeMDNS resolves every configured .local name over multicast DNS and,
+// where a unicast counterpart is configured, compares the answers.
+func (r *DNSResolver) probeMDNS(ctx context.Context) {
+	config := r.currentConfig()
+	if r.mdns == nil || r.mdnsQuerier == nil || !config.mdnsEnabled() {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, hostname := range config.MDNS.Hostnames {
+		wg.Add(1)
+		go func(h string) {
+			defer wg.Done()
+			response, err := r.resolveMDNS(ctx, h)
+			if err != nil || ctx.Err() != nil {
+				return
+			}
+			if unicast := config.MDNS.Compare[h]; unicast != "" {
+				r.compareMDNS(response, unicast)
+			}
+		}(hostname)
+	}
+	wg.Wait()
+}
+
+// resolveMDNS looks up hostname's A records over multicast DNS.
+func (r *DNSResolver) resolveMDNS(ctx context.Context, hostname string) (*dnsanalysis.DNSResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.currentConfig().mdnsTimeout())
+	defer cancel()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(hostname), dns.TypeA)
+	msg.RecursionDesired = false
+
+	metrics.DNSResolutionTotal.WithLabelValues(mdnsServer, r.metricHostname(hostname)).Inc()
+	start := time.Now()
+	response, err := r.mdnsQuerier.Query(ctx, msg)
+	elapsed := time.Since(start)
+
+	if err != nil {
+		metrics.DNSResolutionFailure.WithLabelValues(mdnsServer, r.metricHostname(hostname), "mdns").Inc()
+		r.mdns.set(hostname, MDNSResult{Error: err.Error(), Duration: elapsed.String(), LastSeen: time.Now()})
+		r.errorLog.Printf("Failed to resolve %s using %s: %v", hostname, mdnsServer, err)
+		r.appLogf(instrumentation.Medium, "mdns query failed hostname=%s err=%v", hostname, err)
+		r.emitEvent(ResolverEvent{
+			Type:     EventResolveFailure,
+			Time:     time.Now(),
+			Hostname: hostname,
+			Server:   mdnsServer,
+			Duration: elapsed,
+			Error:    err.Error(),
+			Source:   "mdns",
+		})
+		return nil, err
+	}
+
+	result := &dnsanalysis.DNSResponse{
+		Server:   mdnsServer,
+		Hostname: hostname,
+		TTL:      getMinTTL(response),
+		Protocol: "mdns",
+		Duration: elapsed,
+	}
+	for _, answer := range response.Answer {
+		if a, ok := answer.(*dns.A); ok && strings.EqualFold(a.Hdr.Name, msg.Question[0].Name) {
+			result.Addresses = append(result.Addresses, a.A.String())
+		}
+	}
+
+	metrics.DNSResolutionSuccess.WithLabelValues(mdnsServer, r.metricHostname(hostname)).Inc()
+	metrics.DNSResolutionDuration.WithLabelValues(mdnsServer, r.metricHostname(hostname)).Observe(elapsed.Seconds())
+	r.mdns.set(hostname, MDNSResult{
+		Addresses: append([]string(nil), result.Addresses...),
+		Duration:  elapsed.String(),
+		LastSeen:  time.Now(),
+	})
+	r.successLog.Printf("Resolved %s using %s", hostname, mdnsServer)
+	r.appLogf(instrumentation.High, "mdns response ok hostname=%s duration=%s", hostname, elapsed)
+	r.emitEvent(ResolverEvent{
+		Type:      EventResolveSuccess,
+		Time:      time.Now(),
+		Hostname:  hostname,
+		Server:    mdnsServer,
+		Duration:  elapsed,
+		Addresses: append([]string(nil), result.Addresses...),
+		Source:    "mdns",
+	})
+	return result, nil
+}
+
+// compareMDNS checks the multicast answer against the cached unicast answer
+// for the configured counterpart name. Nothing is compared until unicast
+// resolution has cached an answer.
+func (r *DNSResolver) compareMDNS(response *dnsanalysis.DNSResponse, unicast string) {
+	cached, ok := r.cachedAnswer(unicast)
+	if !ok {
+		return
+	}
+
+	responses := []*dnsanalysis.DNSResponse{response, cached}
+	consistent := dnsanalysis.CompareResponses(responses)
+	metrics.DNSResolutionConsistency.WithLabelValues(r.metricHostname(response.Hostname)).Set(boolToFloat64(consistent))
+	if consistent {
+		return
+	}
+
+	label := response.Hostname + " / " + unicast
+	diff := dnsanalysis.DiffResponses(label, responses, nil)
+	consistentValue := false
+	r.emitEvent(ResolverEvent{
+		Type:       EventInconsistent,
+		Time:       time.Now(),
+		Hostname:   response.Hostname,
+		Consistent: &consistentValue,
+		Detail:     diff.String(),
+		Source:     "mdns",
+	})
+	r.appLogf(instrumentation.High, "mdns and unicast answers differ hostname=%s unicast=%s", response.Hostname, unicast)
+	r.errorLog.Printf("Inconsistent mDNS and unicast responses for %s: %s", label, diff.Summary())
+}
@@ -0,0 +1,109 @@
+package dnsres
+
+import (
+	"context"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+)
+
+// Memory budget defaults used when memory leaves them unset.
+const (
+	defaultMemoryCheckInterval = 10 * time.Second
+	// memoryRecoveredPressure is the pressure below which per-hostname
+	// metric labels are restored, so they do not flap around the budget.
+	memoryRecoveredPressure = 0.8
+)
+
+// MemoryConfig sets a heap budget for the whole process. It is enforced only
+// when BudgetMB is set.
+type MemoryConfig struct {
+	BudgetMB int `json:"budget_mb"`
+	// CheckInterval is how often heap usage is sampled (default 10s).
+	CheckInterval Duration `json:"check_interval"`
+}
+
+func (m MemoryConfig) budget() uint64 {
+	return uint64(m.BudgetMB) * 1024 * 1024
+}
+
+func (m MemoryConfig) checkInterval() time.Duration {
+	if m.CheckInterval.Duration <= 0 {
+		return defaultMemoryCheckInterval
+	}
+	return m.CheckInterval.Duration
+}
+
+func validateMemory(c *Config) error {
+	var problems configProblems
+	problems.check(c.Memory.BudgetMB >= 0, "memory.budget_mb", "must not be negative")
+	problems.check(c.Memory.CheckInterval.Duration >= 0, "memory.check_interval", "must not be negative")
+	return problems.err()
+}
+
+// runMemoryBudget samples heap usage until ctx is canceled. The budget is
+// also set as the runtime's soft memory limit, so garbage is collected before
+// live data is shed.
+func (r *DNSResolver) runMemoryBudget(ctx context.Context) {
+	config := r.currentConfig()
+	debug.SetMemoryLimit(int64(config.Memory.budget()))
+	ticker := time.NewTicker(config.Memory.checkInterval())
+	defer ticker.Stop()
+
+	var stats runtime.MemStats
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			runtime.ReadMemStats(&stats)
+			r.enforceMemoryBudget(stats.HeapAlloc)
+		}
+	}
+}
+
+// enforceMemoryBudget reacts to heap bytes in use. Over budget it halves the
+// cache and the event history and aggregates hostname metric labels; labels
+// are restored once usage falls well below the budget.
+func (r *DNSResolver) enforceMemoryBudget(heap uint64) {
+	config := r.currentConfig()
+	pressure := float64(heap) / float64(config.Memory.budget())
+	metrics.DNSResMemoryPressure.Set(pressure)
+	if pressure <= 1 {
+		if pressure < memoryRecoveredPressure && r.labelsAggregated.CompareAndSwap(true, false) {
+			r.outputf("Memory pressure relieved; per-hostname metric labels restored\n")
+			r.appLogf(instrumentation.Low, "memory budget recovered pressure=%.2f", pressure)
+		}
+		return
+	}
+
+	evicted := 0
+	if r.cache != nil {
+		evicted = r.cache.Shrink(0.5)
+	}
+	truncated := 0
+	if r.history != nil {
+		truncated = r.history.truncate(0.5)
+	}
+	if r.labelsAggregated.CompareAndSwap(false, true) {
+		metrics.ResetHostnameSeries()
+		r.queryMetricSets.reset()
+		r.outputf("Memory budget exceeded; hostname metric labels aggregated\n")
+	}
+	r.errorLog.Printf("Memory budget exceeded: heap %d MB of %d MB; evicted %d cache entries and %d events",
+		heap/(1024*1024), config.Memory.BudgetMB, evicted, truncated)
+	r.appLogf(instrumentation.Low, "memory budget exceeded pressure=%.2f cache_evicted=%d events_truncated=%d", pressure, evicted, truncated)
+}
+
+// metricHostname returns the hostname label for per-query metrics, which
+// collapses to metrics.AggregatedHostname while the memory budget is
+// exceeded.
+func (r *DNSResolver) metricHostname(hostname string) string {
+	if r.labelsAggregated.Load() {
+		return metrics.AggregatedHostname
+	}
+	return hostname
+}
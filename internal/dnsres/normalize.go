@@ -0,0 +1,148 @@
+package dnsres
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// NormalizeHostname returns hostname in the form stats, metrics and the
+// cache are keyed by: lower case, without a trailing dot, with
+// internationalized labels converted to punycode. Names that cannot be
+// converted are only lowered and trimmed, leaving the error to the query.
+func NormalizeHostname(hostname string) string {
+	hostname = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(hostname), "."))
+	if !isASCII(hostname) {
+		if ascii, err := idna.Lookup.ToASCII(hostname); err == nil {
+			return ascii
+		}
+	}
+	return hostname
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeServer returns server as host:port, adding the default port,
+// writing IP addresses in their canonical form and normalizing host names
+// like hostnames.
+func normalizeServer(server string) string {
+	server = ensurePort(strings.TrimSpace(server))
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return server
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		host = addr.String()
+	} else {
+		host = NormalizeHostname(host)
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// normalizeNames normalizes names with normalize and drops duplicates,
+// keeping the first occurrence. It returns a warning for each duplicate,
+// naming the setting at path.
+func normalizeNames(path string, names []string, normalize func(string) string) ([]string, []string) {
+	var warnings []string
+	out := make([]string, 0, len(names))
+	for _, name := range names {
+		normalized := normalize(name)
+		if slices.Contains(out, normalized) {
+			warnings = append(warnings, fmt.Sprintf("%s: ignoring duplicate %s", path, duplicateName(name, normalized)))
+			continue
+		}
+		out = append(out, normalized)
+	}
+	return out, warnings
+}
+
+// normalizeKeys normalizes the keys of m with normalize. When several keys
+// normalize to the same one, the first in sorted order is kept and the
+// others are reported as warnings naming the setting at path.
+func normalizeKeys[V any](path string, m map[string]V, normalize func(string) string) (map[string]V, []string) {
+	if len(m) == 0 {
+		return m, nil
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	var warnings []string
+	out := make(map[string]V, len(m))
+	for _, key := range keys {
+		normalized := normalize(key)
+		if _, ok := out[normalized]; ok {
+			warnings = append(warnings, fmt.Sprintf("%s: ignoring duplicate %s", path, duplicateName(key, normalized)))
+			continue
+		}
+		out[normalized] = m[key]
+	}
+	return out, warnings
+}
+
+func duplicateName(name, normalized string) string {
+	if name == normalized {
+		return name
+	}
+	return fmt.Sprintf("%s (%s)", name, normalized)
+}
+
+// normalizeConfig normalizes the hostnames and servers of a decoded config,
+// including those keying per-hostname and per-server settings, and drops
+// duplicates. Each duplicate is recorded as a config warning.
+func normalizeConfig(c *Config) {
+	keepWildcard := func(hostname string) string {
+		if hostname == allHostnames {
+			return hostname
+		}
+		return NormalizeHostname(hostname)
+	}
+	var warnings, w []string
+	c.Hostnames, w = normalizeNames("hostnames", c.Hostnames, NormalizeHostname)
+	warnings = append(warnings, w...)
+	c.DNSServers, w = normalizeNames("dns_servers", c.DNSServers, normalizeServer)
+	warnings = append(warnings, w...)
+	if c.ReferenceServer != "" {
+		c.ReferenceServer = normalizeServer(c.ReferenceServer)
+	}
+	c.MDNS.Hostnames, w = normalizeNames("mdns.hostnames", c.MDNS.Hostnames, NormalizeHostname)
+	warnings = append(warnings, w...)
+
+	c.ServerSettings, w = normalizeKeys("server_settings", c.ServerSettings, normalizeServer)
+	warnings = append(warnings, w...)
+	c.Checks, w = normalizeKeys("checks", c.Checks, keepWildcard)
+	warnings = append(warnings, w...)
+	c.Schedules, w = normalizeKeys("schedules", c.Schedules, NormalizeHostname)
+	warnings = append(warnings, w...)
+	c.GeoIP.Expected, w = normalizeKeys("geoip.expected", c.GeoIP.Expected, NormalizeHostname)
+	warnings = append(warnings, w...)
+	c.Cache.TTLOverrides, w = normalizeKeys("cache.ttl_overrides", c.Cache.TTLOverrides, NormalizeHostname)
+	warnings = append(warnings, w...)
+	c.Cache.Policies, w = normalizeKeys("cache.policies", c.Cache.Policies, NormalizeHostname)
+	warnings = append(warnings, w...)
+	c.MDNS.Compare, w = normalizeKeys("mdns.compare", c.MDNS.Compare, NormalizeHostname)
+	warnings = append(warnings, w...)
+	for name, unicast := range c.MDNS.Compare {
+		c.MDNS.Compare[name] = NormalizeHostname(unicast)
+	}
+	c.warnings = append(c.warnings, warnings...)
+}
+
+// Warnings returns the problems found while loading the config that did not
+// stop it loading, such as duplicate hostnames.
+func (c *Config) Warnings() []string {
+	return c.warnings
+}
@@ -0,0 +1,111 @@
+package dnsres
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// PreflightResult is the outcome of one preflight check.
+type PreflightResult struct {
+	// Name identifies the check, e.g. "server 8.8.8.8:53" or "port health".
+	Name string
+	// Detail describes a passing check, e.g. the probe's rcode and latency.
+	Detail string
+	Err    error
+}
+
+// Passed reports whether the check succeeded.
+func (p PreflightResult) Passed() bool {
+	return p.Err == nil
+}
+
+// Preflight checks that config can run without starting the resolver: every
+// DNS server must answer a probe query within its timeout and every listener
+// port must be free to bind. Server results come first, in config order.
+func Preflight(ctx context.Context, config *Config) []PreflightResult {
+	name := "."
+	qtype := dns.TypeNS
+	if len(config.Hostnames) > 0 {
+		name, qtype = dns.Fqdn(config.Hostnames[0]), dns.TypeA
+	}
+
+	results := make([]PreflightResult, len(config.DNSServers))
+	var wg sync.WaitGroup
+	for i, server := range config.DNSServers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = probeServer(ctx, server, name, qtype, config.QueryTimeoutFor(server))
+		}()
+	}
+	wg.Wait()
+
+	for _, listener := range preflightListeners(config) {
+		results = append(results, checkListener(listener))
+	}
+	return results
+}
+
+func probeServer(ctx context.Context, server, name string, qtype uint16, timeout time.Duration) PreflightResult {
+	result := PreflightResult{Name: "server " + server}
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	client := &dns.Client{Timeout: timeout}
+	response, rtt, err := client.ExchangeContext(ctx, msg, server)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Detail = fmt.Sprintf("%s %s in %s", dns.RcodeToString[response.Rcode], name, rtt.Round(time.Millisecond))
+	return result
+}
+
+// preflightListener is an address the resolver binds at startup.
+type preflightListener struct {
+	name    string
+	network string
+	address string
+}
+
+func preflightListeners(config *Config) []preflightListener {
+	var listeners []preflightListener
+	add := func(name string, port int) {
+		if port > 0 {
+			listeners = append(listeners, preflightListener{name, "tcp", fmt.Sprintf(":%d", port)})
+		}
+	}
+	add("health", config.HealthPort)
+	add("metrics", config.MetricsPort)
+	add("grpc", config.GRPC.Port)
+	if config.Forwarder.Enabled {
+		address := config.forwarderAddr()
+		listeners = append(listeners,
+			preflightListener{"forwarder", "udp", address},
+			preflightListener{"forwarder", "tcp", address},
+		)
+	}
+	return listeners
+}
+
+func checkListener(l preflightListener) PreflightResult {
+	result := PreflightResult{Name: fmt.Sprintf("port %s %s/%s", l.name, l.address, l.network)}
+	if l.network == "udp" {
+		conn, err := net.ListenPacket(l.network, l.address)
+		if err == nil {
+			conn.Close()
+		}
+		result.Err = err
+		return result
+	}
+	listener, err := net.Listen(l.network, l.address)
+	if err == nil {
+		listener.Close()
+	}
+	result.Err = err
+	return result
+}
@@ -0,0 +1,166 @@
+package dnsres
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/internal/pubsub"
+	"dnsres/metrics"
+)
+
+const (
+	publishDialTimeout = 10 * time.Second
+	// publishRedialDelay is how long events are dropped after a failed dial
+	// before connecting is tried again.
+	publishRedialDelay = 5 * time.Second
+)
+
+// PublishConfig configures publishing resolver events to an MQTT broker or
+// NATS server. Events are published only when Backend is set.
+type PublishConfig struct {
+	// Backend is "mqtt" or "nats".
+	Backend string `json:"backend"`
+	// Address is the broker's host:port.
+	Address string `json:"address"`
+	// Topic is the MQTT topic or NATS subject. "{type}" is replaced with the
+	// event type.
+	Topic              string `json:"topic"`
+	ClientID           string `json:"client_id,omitempty"`
+	Username           string `json:"username,omitempty"`
+	Password           string `json:"password,omitempty"`
+	TLS                bool   `json:"tls"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	// Events lists the event types to publish; empty publishes all.
+	Events []string `json:"events,omitempty"`
+}
+
+// topic returns the topic for eventType, defaulting to dnsres/events for
+// MQTT and dnsres.events for NATS.
+func (c PublishConfig) topic(eventType EventType) string {
+	topic := c.Topic
+	if topic == "" {
+		topic = "dnsres/events"
+		if c.Backend == pubsub.NATS {
+			topic = "dnsres.events"
+		}
+	}
+	return strings.ReplaceAll(topic, "{type}", string(eventType))
+}
+
+func (c PublishConfig) options() pubsub.Options {
+	opts := pubsub.Options{
+		Address:  c.Address,
+		Username: c.Username,
+		Password: c.Password,
+		ClientID: c.ClientID,
+	}
+	if opts.ClientID == "" {
+		opts.ClientID = "dnsres"
+	}
+	if c.TLS {
+		opts.TLS = &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	}
+	return opts
+}
+
+func validatePublish(c *Config) error {
+	publish := c.Publish
+	if publish.Backend == "" {
+		return nil
+	}
+	var problems configProblems
+	if publish.Backend != pubsub.MQTT && publish.Backend != pubsub.NATS {
+		problems.add("publish.backend", fmt.Errorf("invalid publish backend %q: must be %q or %q", publish.Backend, pubsub.MQTT, pubsub.NATS))
+	}
+	if _, _, err := net.SplitHostPort(publish.Address); err != nil {
+		problems.add("publish.address", fmt.Errorf("invalid publish address %q: %w", publish.Address, err))
+	}
+	if publish.Backend == pubsub.NATS && strings.ContainsAny(publish.Topic, " \t\r\n") {
+		problems.add("publish.topic", fmt.Errorf("invalid publish topic %q: nats subjects must not contain whitespace", publish.Topic))
+	}
+	problems.check(publish.Password == "" || publish.Username != "", "publish.username", "must be set with publish.password")
+	return problems.err()
+}
+
+// eventPublisher keeps one broker connection, redialing after failures.
+type eventPublisher struct {
+	config PublishConfig
+	dial   func(ctx context.Context, backend string, opts pubsub.Options) (pubsub.Publisher, error)
+
+	conn     pubsub.Publisher
+	nextDial time.Time
+}
+
+// runPublisher publishes the configured event types until ctx is canceled.
+func (r *DNSResolver) runPublisher(ctx context.Context) {
+	publisher := &eventPublisher{config: r.currentConfig().Publish, dial: pubsub.Dial}
+	filter := EventFilter{Types: eventTypes(publisher.config.Events)}
+	events, unsubscribe := r.SubscribeEventsWithOptions(SubscribeOptions{Durable: true, Name: "publish", Filter: filter})
+	defer unsubscribe()
+	defer func() {
+		if publisher.conn != nil {
+			publisher.conn.Close()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			// The filter passes dropped-event notices; publish them only
+			// when configured.
+			if types := publisher.config.Events; len(types) == 0 || slices.Contains(types, string(event.Type)) {
+				r.publishEvent(ctx, publisher, event)
+			}
+		}
+	}
+}
+
+// publishEvent publishes event as JSON, connecting first if needed. Events
+// are dropped, not queued, while the broker is unreachable.
+func (r *DNSResolver) publishEvent(ctx context.Context, publisher *eventPublisher, event ResolverEvent) {
+	if publisher.conn == nil {
+		if time.Now().Before(publisher.nextDial) {
+			metrics.DNSResPublishedEvents.WithLabelValues("dropped").Inc()
+			return
+		}
+		dialCtx, cancel := context.WithTimeout(ctx, publishDialTimeout)
+		conn, err := publisher.dial(dialCtx, publisher.config.Backend, publisher.config.options())
+		cancel()
+		if err != nil {
+			publisher.nextDial = time.Now().Add(publishRedialDelay)
+			metrics.DNSResPublishedEvents.WithLabelValues("dropped").Inc()
+			r.errorLog.Printf("Event publishing to %s %s failed: %v", publisher.config.Backend, publisher.config.Address, err)
+			return
+		}
+		publisher.conn = conn
+		r.appLogf(instrumentation.Low, "event publisher connected backend=%s address=%s", publisher.config.Backend, publisher.config.Address)
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		metrics.DNSResPublishedEvents.WithLabelValues("dropped").Inc()
+		r.errorLog.Printf("Event publishing encoding failed: %v", err)
+		return
+	}
+	topic := publisher.config.topic(event.Type)
+	if err := publisher.conn.Publish(topic, payload); err != nil {
+		publisher.conn.Close()
+		publisher.conn = nil
+		metrics.DNSResPublishedEvents.WithLabelValues("dropped").Inc()
+		r.errorLog.Printf("Event publishing to %s %s failed: %v", publisher.config.Backend, publisher.config.Address, err)
+		return
+	}
+	metrics.DNSResPublishedEvents.WithLabelValues("published").Inc()
+	r.appLogf(instrumentation.High, "event published type=%s topic=%s", event.Type, topic)
+}
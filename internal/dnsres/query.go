@@ -0,0 +1,112 @@
+package dnsres
+
+import (
+	"sync"
+
+	"dnsres/metrics"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// queryMsgPool recycles upstream query messages. A query is referenced only
+// until its exchange and hooks complete.
+var queryMsgPool = sync.Pool{New: func() any { return new(dns.Msg) }}
+
+// newQueryMsg returns a pooled A query for hostname with transaction ID id
+// and EDNS and the DO bit set. Return it with releaseQueryMsg.
+func newQueryMsg(id uint16, hostname string, recursionDesired bool) *dns.Msg {
+	msg := queryMsgPool.Get().(*dns.Msg)
+	opt, _ := lastRR(msg.Extra).(*dns.OPT)
+	*msg = dns.Msg{Question: msg.Question[:0], Extra: msg.Extra[:0]}
+	msg.Id = id
+	msg.RecursionDesired = recursionDesired
+	msg.Question = append(msg.Question, dns.Question{Name: dns.Fqdn(hostname), Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+	// Reuse the previous query's OPT record, dropping its options.
+	if opt == nil {
+		opt = new(dns.OPT)
+	}
+	*opt = dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}, Option: opt.Option[:0]}
+	opt.SetUDPSize(4096)
+	opt.SetDo()
+	msg.Extra = append(msg.Extra, opt)
+	return msg
+}
+
+func lastRR(rrs []dns.RR) dns.RR {
+	if len(rrs) == 0 {
+		return nil
+	}
+	return rrs[len(rrs)-1]
+}
+
+func releaseQueryMsg(msg *dns.Msg) {
+	queryMsgPool.Put(msg)
+}
+
+// latencyPhases are the phase labels of dns_resolution_phase_duration_seconds,
+// in queryMetricSet.phases order.
+var latencyPhases = [...]string{"queue", "connect", "network", "processing"}
+
+// queryMetricSet holds the per-query series of one server and hostname label,
+// so the hot path skips the label hashing of WithLabelValues.
+type queryMetricSet struct {
+	total, success, cacheHit, cacheMiss prometheus.Counter
+	duration, size                      prometheus.Observer
+	phases                              [len(latencyPhases)]prometheus.Observer
+}
+
+type queryMetricKey struct {
+	server, hostname string
+}
+
+// queryMetricCache maps server and hostname labels to their series. The zero
+// value is ready to use.
+type queryMetricCache struct {
+	mu   sync.RWMutex
+	sets map[queryMetricKey]*queryMetricSet
+}
+
+func (c *queryMetricCache) get(server, hostname string) *queryMetricSet {
+	key := queryMetricKey{server, hostname}
+	c.mu.RLock()
+	set, ok := c.sets[key]
+	c.mu.RUnlock()
+	if ok {
+		return set
+	}
+
+	set = &queryMetricSet{
+		total:     metrics.DNSResolutionTotal.WithLabelValues(server, hostname),
+		success:   metrics.DNSResolutionSuccess.WithLabelValues(server, hostname),
+		cacheHit:  metrics.DNSResolutionCacheHit.WithLabelValues(server, hostname),
+		cacheMiss: metrics.DNSResolutionCacheMiss.WithLabelValues(server, hostname),
+		duration:  metrics.DNSResolutionDuration.WithLabelValues(server, hostname),
+		size:      metrics.DNSResponseSize.WithLabelValues(server, hostname),
+	}
+	for i, phase := range latencyPhases {
+		set.phases[i] = metrics.DNSResolutionPhaseDuration.WithLabelValues(server, phase)
+	}
+	c.mu.Lock()
+	if c.sets == nil {
+		c.sets = make(map[queryMetricKey]*queryMetricSet)
+	}
+	c.sets[key] = set
+	c.mu.Unlock()
+	return set
+}
+
+// reset forgets every set; it must follow metrics.ResetHostnameSeries, which
+// detaches the series they hold.
+func (c *queryMetricCache) reset() {
+	c.mu.Lock()
+	c.sets = nil
+	c.mu.Unlock()
+}
+
+// queryMetrics returns the per-query series for server and hostname, with the
+// hostname label aggregated while the memory budget is exceeded.
+func (r *DNSResolver) queryMetrics(server, hostname string) *queryMetricSet {
+	return r.queryMetricSets.get(server, r.metricHostname(hostname))
+}
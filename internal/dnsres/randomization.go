@@ -0,0 +1,315 @@
+package dnsres
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// Transaction ID sources for querying.id_source.
+const (
+	// IDSourceCrypto draws IDs from crypto/rand, the dns package default.
+	IDSourceCrypto = "crypto"
+	// IDSourceMath draws IDs from math/rand/v2, which is cheaper but not
+	// meant to resist prediction.
+	IDSourceMath = "math"
+)
+
+func cryptoID() uint16 {
+	var b [2]byte
+	crand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+func mathID() uint16 {
+	return uint16(rand.Uint32())
+}
+
+// IDSource returns the configured transaction ID source, defaulting to
+// crypto.
+func (c *Config) IDSource() string {
+	if c == nil || strings.TrimSpace(c.Querying.IDSource) == "" {
+		return IDSourceCrypto
+	}
+	return strings.ToLower(strings.TrimSpace(c.Querying.IDSource))
+}
+
+// idGenerator returns the transaction ID generator for source. Each
+// resolver keeps its own rather than replacing dns.Id, which every user of
+// the dns package in the process shares.
+func idGenerator(source string) func() uint16 {
+	if source == IDSourceMath {
+		return mathID
+	}
+	return cryptoID
+}
+
+// queryID returns a transaction ID from the resolver's configured source.
+func (r *DNSResolver) queryID() uint16 {
+	if r.newID == nil {
+		return cryptoID()
+	}
+	return r.newID()
+}
+
+// portRange is a range of local UDP ports queries are sent from. The zero
+// value leaves the port to the operating system.
+type portRange struct {
+	low, high int
+}
+
+// sourcePorts parses querying.source_ports, written "low-high".
+func (c *Config) sourcePorts() (portRange, error) {
+	if c == nil || strings.TrimSpace(c.Querying.SourcePorts) == "" {
+		return portRange{}, nil
+	}
+	lowText, highText, ok := strings.Cut(strings.TrimSpace(c.Querying.SourcePorts), "-")
+	low, lowErr := strconv.Atoi(strings.TrimSpace(lowText))
+	high, highErr := strconv.Atoi(strings.TrimSpace(highText))
+	if !ok || lowErr != nil || highErr != nil {
+		return portRange{}, fmt.Errorf("invalid source port range %q: want \"low-high\"", c.Querying.SourcePorts)
+	}
+	if low < 1 || high > 65535 || low > high {
+		return portRange{}, fmt.Errorf("invalid source port range %q: ports must be from 1 to 65535, low first", c.Querying.SourcePorts)
+	}
+	return portRange{low: low, high: high}, nil
+}
+
+func (p portRange) pinned() bool {
+	return p.low > 0
+}
+
+func (p portRange) String() string {
+	if !p.pinned() {
+		return "ephemeral"
+	}
+	return fmt.Sprintf("%d-%d", p.low, p.high)
+}
+
+// portDialAttempts is how many random ports of a pinned range are tried
+// before giving up, in case some are in use.
+const portDialAttempts = 8
+
+// dial opens a UDP socket to server from a random port of the range.
+func (p portRange) dial(ctx context.Context, server string) (*dns.Conn, error) {
+	var err error
+	for range portDialAttempts {
+		dialer := net.Dialer{LocalAddr: &net.UDPAddr{Port: p.low + rand.IntN(p.high-p.low+1)}}
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, "udp", server); err == nil {
+			return &dns.Conn{Conn: conn}, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("no free source port in %s: %w", p, err)
+}
+
+func validateIDSource(c *Config) error {
+	switch c.IDSource() {
+	case IDSourceCrypto, IDSourceMath:
+		return nil
+	}
+	return fmt.Errorf("invalid id source %q", c.Querying.IDSource)
+}
+
+func validateSourcePorts(c *Config) error {
+	_, err := c.sourcePorts()
+	return err
+}
+
+// dialQuery opens the socket for a query to server, from the pinned source
+// port range when one is configured.
+func (r *DNSResolver) dialQuery(ctx context.Context, dialer connExchanger, server string) (*dns.Conn, error) {
+	if ports, _ := r.currentConfig().sourcePorts(); ports.pinned() {
+		return ports.dial(ctx, server)
+	}
+	return dialer.DialContext(ctx, server)
+}
+
+// Sample sizes and thresholds of the randomization audit. A uniform 16-bit
+// ID measures close to 16 bits; ports from a typical ephemeral range measure
+// about 14.
+const (
+	auditIDSamples     = 4096
+	auditPortSamples   = 64
+	minIDEntropyBits   = 14
+	minPortEntropyBits = 10
+)
+
+// RandomizationAudit is the outcome of the startup self-test of the two
+// values that make spoofed replies hard to forge: the transaction ID and
+// the source port.
+type RandomizationAudit struct {
+	CheckedAt time.Time `json:"checked_at"`
+	IDSource  string    `json:"id_source"`
+	// IDEntropyBits is the collision entropy measured over sampled IDs, at
+	// most 16.
+	IDEntropyBits float64 `json:"id_entropy_bits"`
+	// SourcePorts is the pinned source port range, or "ephemeral".
+	SourcePorts string `json:"source_ports"`
+	// PortEntropyBits estimates how unpredictable the next source port is
+	// from how far apart consecutively opened sockets' ports are.
+	PortEntropyBits float64 `json:"port_entropy_bits"`
+	PortsSampled    int     `json:"ports_sampled"`
+	PortsDistinct   int     `json:"ports_distinct"`
+	// SocketReuse reports querying.reuse_sockets, which keeps each
+	// server's source port fixed between queries.
+	SocketReuse bool `json:"socket_reuse"`
+	// Effective is false when either value measured below its threshold or
+	// source ports are reused.
+	Effective bool     `json:"effective"`
+	Warnings  []string `json:"warnings,omitempty"`
+}
+
+// auditRandomization runs the randomization self-test, publishes its result
+// and logs any weakness to the error log.
+func (r *DNSResolver) auditRandomization(ctx context.Context) {
+	config := r.currentConfig()
+	ports, _ := config.sourcePorts()
+	audit := &RandomizationAudit{
+		CheckedAt:   time.Now(),
+		IDSource:    config.IDSource(),
+		SourcePorts: ports.String(),
+		SocketReuse: config.Querying.ReuseSockets,
+	}
+
+	ids := make([]int, auditIDSamples)
+	for i := range ids {
+		ids[i] = int(r.queryID())
+	}
+	audit.IDEntropyBits = collisionBits(ids, 16)
+	if audit.IDEntropyBits < minIDEntropyBits {
+		audit.Warnings = append(audit.Warnings, fmt.Sprintf("transaction IDs measure %.1f bits, below %d", audit.IDEntropyBits, minIDEntropyBits))
+	}
+
+	sampled, err := r.sampleSourcePorts(ctx, ports)
+	if err != nil {
+		audit.Warnings = append(audit.Warnings, fmt.Sprintf("source ports could not be sampled: %v", err))
+	} else {
+		audit.PortsSampled = len(sampled)
+		audit.PortsDistinct = len(distinct(sampled))
+		audit.PortEntropyBits = spreadBits(sampled)
+		if audit.PortEntropyBits < minPortEntropyBits {
+			audit.Warnings = append(audit.Warnings, fmt.Sprintf("source ports measure %.1f bits, below %d", audit.PortEntropyBits, minPortEntropyBits))
+		}
+	}
+	if audit.SocketReuse {
+		audit.Warnings = append(audit.Warnings, "reuse_sockets keeps each server's source port fixed")
+	}
+	audit.Effective = len(audit.Warnings) == 0
+
+	r.randomization.Store(audit)
+	metrics.DNSResRandomizationBits.WithLabelValues("id").Set(audit.IDEntropyBits)
+	metrics.DNSResRandomizationBits.WithLabelValues("port").Set(audit.PortEntropyBits)
+	r.appLogf(instrumentation.Low, "randomization audit id_source=%s id_bits=%.1f source_ports=%s port_bits=%.1f effective=%t",
+		audit.IDSource, audit.IDEntropyBits, audit.SourcePorts, audit.PortEntropyBits, audit.Effective)
+	for _, warning := range audit.Warnings {
+		r.errorLog.Printf("Randomization audit: %s", warning)
+	}
+}
+
+// sampleSourcePorts opens auditPortSamples UDP sockets toward the first
+// server the way queries do, holding them all open so the operating system
+// cannot hand a port out twice, and returns their local ports in the order
+// they were opened. Opening a UDP socket sends nothing.
+func (r *DNSResolver) sampleSourcePorts(ctx context.Context, ports portRange) ([]int, error) {
+	config := r.currentConfig()
+	if len(config.DNSServers) == 0 {
+		return nil, errNoServers
+	}
+	server := config.DNSServers[0]
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	sampled := make([]int, 0, auditPortSamples)
+	var conns []*dns.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for range auditPortSamples {
+		var conn *dns.Conn
+		var err error
+		if ports.pinned() {
+			conn, err = ports.dial(ctx, server)
+		} else {
+			conn, err = new(dns.Client).DialContext(ctx, server)
+		}
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			sampled = append(sampled, addr.Port)
+		}
+	}
+	return sampled, nil
+}
+
+// collisionBits estimates the collision (Rényi order 2) entropy of values
+// from how many pairs of them are equal, capped at maxBits.
+func collisionBits(values []int, maxBits float64) float64 {
+	counts := make(map[int]int, len(values))
+	for _, v := range values {
+		counts[v]++
+	}
+	collisions := 0.0
+	for _, n := range counts {
+		collisions += float64(n*(n-1)) / 2
+	}
+	if collisions == 0 {
+		return maxBits
+	}
+	pairs := float64(len(values)*(len(values)-1)) / 2
+	return roundBits(math.Min(maxBits, math.Log2(pairs/collisions)))
+}
+
+// spreadBits estimates the unpredictability of the next port from the
+// median distance between consecutive ones: a sequential allocator measures
+// about 1 bit, a uniform one close to the bits of its range.
+func spreadBits(ports []int) float64 {
+	if len(ports) < 2 {
+		return 0
+	}
+	deltas := make([]int, 0, len(ports)-1)
+	for i := 1; i < len(ports); i++ {
+		deltas = append(deltas, max(ports[i]-ports[i-1], ports[i-1]-ports[i]))
+	}
+	slices.Sort(deltas)
+	median := deltas[len(deltas)/2]
+	return roundBits(math.Min(16, math.Log2(float64(1+2*median))))
+}
+
+func distinct(values []int) map[int]bool {
+	seen := make(map[int]bool, len(values))
+	for _, v := range values {
+		seen[v] = true
+	}
+	return seen
+}
+
+func roundBits(bits float64) float64 {
+	return math.Round(bits*10) / 10
+}
+
+// RandomizationSnapshot returns the result of the startup randomization
+// audit, or nil before it has run.
+func (r *DNSResolver) RandomizationSnapshot() *RandomizationAudit {
+	return r.randomization.Load()
+}
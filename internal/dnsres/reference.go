@@ -0,0 +1,130 @@
+package dnsres
+
+import (
+	"sync"
+	"time"
+
+	"dnsres/dnsanalysis"
+	"dnsres/metrics"
+)
+
+// ReferenceComparison summarizes how one server's answers compared with the
+// reference server's.
+type ReferenceComparison struct {
+	// Compared counts the answers compared, Divergent those whose addresses
+	// differed and Failed the queries that failed while the reference
+	// answered.
+	Compared  int64 `json:"compared"`
+	Divergent int64 `json:"divergent"`
+	Failed    int64 `json:"failed"`
+	// AvgLatencyDeltaMs is how much longer, on average, the server took to
+	// answer than the reference; negative when it was faster.
+	AvgLatencyDeltaMs float64 `json:"avg_latency_delta_ms"`
+	// LastDivergence is the latest answer that differed.
+	LastDivergence *ReferenceDivergence `json:"last_divergence,omitempty"`
+}
+
+// ReferenceDivergence is one answer that differed from the reference's.
+type ReferenceDivergence struct {
+	Hostname string    `json:"hostname"`
+	Missing  []string  `json:"missing,omitempty"`
+	Extra    []string  `json:"extra,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// ReferenceStats compares every server with the reference server.
+type ReferenceStats struct {
+	Server  string                         `json:"server"`
+	Servers map[string]ReferenceComparison `json:"servers"`
+}
+
+// referenceTracker accumulates the comparisons with the reference server.
+type referenceTracker struct {
+	mu     sync.Mutex
+	server string
+	// latencyTotal sums the latency deltas of each server's compared
+	// answers.
+	latencyTotal map[string]time.Duration
+	servers      map[string]ReferenceComparison
+}
+
+func newReferenceTracker() *referenceTracker {
+	return &referenceTracker{}
+}
+
+// record adds diffs against reference. A new reference starts the
+// comparisons afresh.
+func (t *referenceTracker) record(reference, hostname string, diffs []dnsanalysis.ServerDiff, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if reference != t.server || t.servers == nil {
+		t.server = reference
+		t.latencyTotal = make(map[string]time.Duration)
+		t.servers = make(map[string]ReferenceComparison)
+	}
+	for _, diff := range diffs {
+		comparison := t.servers[diff.Server]
+		if diff.Error != "" {
+			comparison.Failed++
+		} else {
+			comparison.Compared++
+			t.latencyTotal[diff.Server] += diff.LatencyDelta
+			comparison.AvgLatencyDeltaMs = float64(t.latencyTotal[diff.Server].Microseconds()) / 1000 / float64(comparison.Compared)
+			if diff.Differs() {
+				comparison.Divergent++
+				comparison.LastDivergence = &ReferenceDivergence{
+					Hostname: hostname,
+					Missing:  diff.Removed,
+					Extra:    diff.Added,
+					Time:     now,
+				}
+			}
+		}
+		t.servers[diff.Server] = comparison
+	}
+}
+
+func (t *referenceTracker) snapshot() *ReferenceStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.server == "" {
+		return nil
+	}
+	stats := &ReferenceStats{Server: t.server, Servers: make(map[string]ReferenceComparison, len(t.servers))}
+	for server, comparison := range t.servers {
+		stats.Servers[server] = comparison
+	}
+	return stats
+}
+
+// ReferenceSnapshot returns how each server compared with the reference
+// server, or nil when none is configured or none has answered yet.
+func (r *DNSResolver) ReferenceSnapshot() *ReferenceStats {
+	if r.references == nil {
+		return nil
+	}
+	return r.references.snapshot()
+}
+
+// compareWithReference compares every other server's answer for hostname
+// with the reference server's, when one is configured and answered, and
+// records the divergence and latency delta of each.
+func (r *DNSResolver) compareWithReference(hostname string, responses []*dnsanalysis.DNSResponse, failures map[string]string) {
+	reference := r.currentConfig().ReferenceServer
+	if reference == "" || r.references == nil {
+		return
+	}
+	diffs := dnsanalysis.DiffReference(reference, responses, failures)
+	if diffs == nil {
+		return
+	}
+	label := r.metricHostname(hostname)
+	for _, diff := range diffs {
+		if diff.Error != "" {
+			continue
+		}
+		metrics.DNSReferenceDivergence.WithLabelValues(diff.Server, label).Set(boolToFloat64(diff.Differs()))
+		metrics.DNSReferenceLatencyDelta.WithLabelValues(diff.Server, label).Set(diff.LatencyDelta.Seconds())
+	}
+	r.references.record(reference, hostname, diffs, time.Now())
+}
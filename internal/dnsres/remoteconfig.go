@@ -0,0 +1,344 @@
+package dnsres
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"dnsres/circuitbreaker"
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+)
+
+// Remote config defaults used when remote_config leaves them unset.
+const (
+	defaultRemotePollInterval = 30 * time.Second
+	remoteInitialFetchTimeout = 10 * time.Second
+	// consulBlockingWait bounds each Consul blocking query.
+	consulBlockingWait = 5 * time.Minute
+)
+
+// remoteConfigSource fetches the JSON config overlay stored under a key.
+type remoteConfigSource interface {
+	// Name identifies the backend in logs, metrics and the audit log.
+	Name() string
+	// Fetch returns the current document. Sources pace themselves: Consul
+	// blocks until the value changes, etcd waits one poll interval between
+	// calls.
+	Fetch(ctx context.Context) ([]byte, error)
+}
+
+func newRemoteConfigSource(config *Config) (remoteConfigSource, error) {
+	remote := config.RemoteConfig
+	address := strings.TrimSuffix(remote.Address, "/")
+	client := &http.Client{}
+	switch remote.Backend {
+	case "":
+		if download := config.download; download != nil {
+			return &urlSource{
+				url:       download.url,
+				etag:      download.etag,
+				last:      download.data,
+				cachePath: configCachePath(download.url),
+				client:    client,
+				poll:      config.remotePollInterval(),
+			}, nil
+		}
+		return nil, nil
+	case "consul":
+		return &consulSource{address: address, key: remote.Key, token: remote.Token, client: client}, nil
+	case "etcd":
+		return &etcdSource{address: address, key: remote.Key, client: client, poll: config.remotePollInterval()}, nil
+	default:
+		return nil, fmt.Errorf("unknown remote config backend %q", remote.Backend)
+	}
+}
+
+// consulSource reads a key from the Consul KV HTTP API using blocking
+// queries, so changes are picked up as soon as they are written.
+type consulSource struct {
+	address string
+	key     string
+	token   string
+	client  *http.Client
+	index   uint64
+}
+
+func (s *consulSource) Name() string {
+	return "consul"
+}
+
+func (s *consulSource) Fetch(ctx context.Context) ([]byte, error) {
+	query := url.Values{"raw": {""}}
+	if s.index > 0 {
+		query.Set("index", strconv.FormatUint(s.index, 10))
+		query.Set("wait", consulBlockingWait.String())
+	}
+	endpoint := s.address + "/v1/kv/" + strings.TrimPrefix(s.key, "/") + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("key %s not found", s.key)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	// Reset the index if it goes backwards, as Consul recommends.
+	if index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64); err == nil {
+		if index < s.index {
+			index = 0
+		}
+		s.index = index
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// etcdSource reads a key through the etcd v3 JSON gateway, polling for
+// changes.
+type etcdSource struct {
+	address string
+	key     string
+	client  *http.Client
+	poll    time.Duration
+	fetched bool
+}
+
+func (s *etcdSource) Name() string {
+	return "etcd"
+}
+
+func (s *etcdSource) Fetch(ctx context.Context) ([]byte, error) {
+	if s.fetched && !sleepContext(ctx, s.poll) {
+		return nil, ctx.Err()
+	}
+	s.fetched = true
+
+	body, err := json.Marshal(map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(s.key))})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.address+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var result struct {
+		KVs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if len(result.KVs) == 0 {
+		return nil, fmt.Errorf("key %s not found", s.key)
+	}
+	return base64.StdEncoding.DecodeString(result.KVs[0].Value)
+}
+
+// configReload is a validated config queued for the run loop to apply
+// between cycles, and who changed it.
+type configReload struct {
+	config *Config
+	actor  string
+}
+
+// startRemoteConfig applies the remote overlay before the first cycle when the
+// backend answers, then watches it for changes until ctx is canceled. When the
+// backend is unreachable the local config stays in effect. A config loaded
+// from a URL is only watched; each new version replaces it whole.
+func (r *DNSResolver) startRemoteConfig(ctx context.Context) error {
+	source, err := newRemoteConfigSource(r.config)
+	if err != nil || source == nil {
+		return err
+	}
+	if download := r.config.download; download != nil {
+		if download.stale != nil {
+			r.outputf("Config URL unavailable; using last-good copy\n")
+			r.errorLog.Printf("Config URL %s unavailable, using last-good copy: %v", download.url, download.stale)
+		}
+		go r.watchRemoteConfig(ctx, source, nil, download.data, r.config.remotePollInterval())
+		return nil
+	}
+	base, err := json.Marshal(r.config)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot local config: %w", err)
+	}
+
+	var last []byte
+	fetchCtx, cancel := context.WithTimeout(ctx, remoteInitialFetchTimeout)
+	data, err := source.Fetch(fetchCtx)
+	cancel()
+	if err != nil {
+		r.outputf("Remote config from %s unavailable; using local config\n", source.Name())
+		r.errorLog.Printf("Remote config from %s unavailable, using local config: %v", source.Name(), err)
+	} else {
+		last = data
+		if config, err := r.overlayRemoteConfig(base, data, source.Name()); err == nil {
+			r.applyConfig(config, source.Name())
+		}
+	}
+
+	go r.watchRemoteConfig(ctx, source, base, last, r.config.remotePollInterval())
+	return nil
+}
+
+// watchRemoteConfig queues each changed, valid remote config for the run loop
+// to apply between cycles.
+func (r *DNSResolver) watchRemoteConfig(ctx context.Context, source remoteConfigSource, base, last []byte, retry time.Duration) {
+	for {
+		data, err := source.Fetch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			r.appLogf(instrumentation.Medium, "remote config fetch failed backend=%s err=%v", source.Name(), err)
+			if !sleepContext(ctx, retry) {
+				return
+			}
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+
+		config, err := r.overlayRemoteConfig(base, data, source.Name())
+		if err != nil {
+			continue
+		}
+		select {
+		case r.reloads <- configReload{config: config, actor: source.Name()}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// overlayRemoteConfig decodes data on top of the local config snapshot base,
+// so keys missing from the remote document keep their local values. A nil
+// base decodes data as a complete config.
+func (r *DNSResolver) overlayRemoteConfig(base, data []byte, backend string) (*Config, error) {
+	config := &Config{}
+	var err error
+	if base != nil {
+		err = json.Unmarshal(base, config)
+	}
+	if err == nil {
+		err = json.Unmarshal(data, config)
+	}
+	if err == nil {
+		err = prepareConfig(config)
+	}
+	if err == nil {
+		err = validateConfig(config)
+	}
+	if err != nil {
+		metrics.DNSResConfigReloads.WithLabelValues("failure").Inc()
+		r.errorLog.Printf("Rejected remote config from %s: %v", backend, err)
+		r.appLogf(instrumentation.Low, "remote config rejected backend=%s err=%v", backend, err)
+		return nil, err
+	}
+	return config, nil
+}
+
+// currentConfig returns the config in effect. A reload can replace it at
+// any time, so an operation takes it once and uses that copy throughout.
+func (r *DNSResolver) currentConfig() *Config {
+	r.configMu.RLock()
+	defer r.configMu.RUnlock()
+	return r.config
+}
+
+// applyConfig swaps in config between cycles. Listener, logging, cache and
+// interval settings are fixed at startup and keep their current values.
+func (r *DNSResolver) applyConfig(config *Config, actor string) {
+	old := r.config
+	config.QueryInterval = old.QueryInterval
+	config.HealthPort = old.HealthPort
+	config.MetricsPort = old.MetricsPort
+	config.LogDir = old.LogDir
+	config.LogRotation = old.LogRotation
+	config.HealthCheck = old.HealthCheck
+	config.Cache = old.Cache
+	config.Events = old.Events
+	config.Forwarder = old.Forwarder
+	config.Leader = old.Leader
+	config.Discovery = old.Discovery
+	config.GeoIP.CountryDB = old.GeoIP.CountryDB
+	config.GeoIP.ASNDB = old.GeoIP.ASNDB
+	config.Screening = old.Screening
+	config.Schedules = old.Schedules
+	config.Burst = old.Burst
+	config.Email = old.Email
+	config.Publish = old.Publish
+	config.Kafka = old.Kafka
+	config.ResultsFile = old.ResultsFile
+	config.WarmUp = old.WarmUp
+	config.Sampling = old.Sampling
+	config.SlowQueryLog = old.SlowQueryLog
+	config.Archive = old.Archive
+	config.GRPC = old.GRPC
+	config.Memory = old.Memory
+	config.InstrumentationLevel = old.InstrumentationLevel
+	config.Querying.IDSource = old.Querying.IDSource
+	config.RemoteConfig = old.RemoteConfig
+	config.download = old.download
+
+	// Keep breaker state for unchanged servers unless the thresholds moved.
+	thresholdsChanged := config.CircuitBreaker != old.CircuitBreaker
+	breakers := make(map[string]*circuitbreaker.CircuitBreaker, len(config.DNSServers))
+	for _, server := range config.DNSServers {
+		if breaker, ok := r.breakers[server]; ok && !thresholdsChanged {
+			breakers[server] = breaker
+			continue
+		}
+		breakers[server] = r.watchBreaker(circuitbreaker.NewCircuitBreaker(
+			config.CircuitBreaker.Threshold,
+			config.CircuitBreaker.Timeout.Duration,
+			server,
+		))
+	}
+	r.stats.addServers(config.DNSServers)
+
+	r.configMu.Lock()
+	r.breakers = breakers
+	r.config = config
+	r.configMu.Unlock()
+	metrics.DNSResConfigReloads.WithLabelValues("success").Inc()
+
+	summary := func(c *Config) string {
+		return fmt.Sprintf("hostnames=%d servers=%d", len(c.Hostnames), len(c.DNSServers))
+	}
+	r.outputf("Configuration reloaded from %s (%s)\n", actor, summary(config))
+	r.appLogf(instrumentation.Low, "config reloaded backend=%s %s", actor, summary(config))
+	r.RecordAudit(actor, "config_reload", config.RemoteConfig.Key, summary(old), summary(config))
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,39 +15,312 @@ type ResolutionStats struct {
 	LastError string
 	StartTime time.Time
 	Stats     map[string]*ServerStats
+
+	// mu guards Stats and the cycle counters.
+	mu        sync.Mutex
+	cycles    CycleStats
+	cycleTime time.Duration
+	lastTick  time.Time
+}
+
+// CycleStats counts resolution cycles.
+type CycleStats struct {
+	Completed int `json:"completed"`
+	// Skipped counts scheduler ticks dropped because the previous cycle was
+	// still running.
+	Skipped int `json:"skipped"`
+	// AverageDuration is the mean duration of completed cycles, rounded to
+	// milliseconds and zero until one completes.
+	AverageDuration Duration `json:"average_duration"`
+}
+
+// RunSummary describes the running process: when it started and how its
+// cycles went.
+type RunSummary struct {
+	StartTime time.Time
+	Uptime    time.Duration
+	Cycles    CycleStats
+}
+
+// recordCycle counts a completed cycle that took duration.
+func (s *ResolutionStats) recordCycle(duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cycles.Completed++
+	s.cycleTime += duration
+	s.cycles.AverageDuration = Duration{Duration: (s.cycleTime / time.Duration(s.cycles.Completed)).Round(time.Millisecond)}
+}
+
+// recordSuccess counts a successful query of server.
+func (s *ResolutionStats) recordSuccess(server string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.server(server).Total++
+}
+
+// recordFailure counts a failed query of server and keeps message as its
+// last error.
+func (s *ResolutionStats) recordFailure(server, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.server(server)
+	stats.Failures++
+	stats.LastError = message
+}
+
+// addServers gives servers not yet counted an empty entry, so they are
+// listed before their first query.
+func (s *ResolutionStats) addServers(servers []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, server := range servers {
+		s.server(server)
+	}
+}
+
+// server returns server's entry, adding it if missing. The caller holds
+// s.mu.
+func (s *ResolutionStats) server(server string) *ServerStats {
+	if s.Stats == nil {
+		s.Stats = make(map[string]*ServerStats)
+	}
+	stats, ok := s.Stats[server]
+	if !ok {
+		stats = &ServerStats{}
+		s.Stats[server] = stats
+	}
+	return stats
+}
+
+// serverSnapshot returns a copy of each server's counters.
+func (s *ResolutionStats) serverSnapshot() map[string]ServerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := make(map[string]ServerStats, len(s.Stats))
+	for server, stats := range s.Stats {
+		snapshot[server] = *stats
+	}
+	return snapshot
+}
+
+// recordTick counts the ticks dropped since the previous one. Tickers drop
+// ticks a busy receiver misses, so a gap of n intervals skipped n-1 cycles,
+// which it returns.
+func (s *ResolutionStats) recordTick(tick time.Time, interval time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	missed := missedTicks(s.lastTick, tick, interval)
+	s.cycles.Skipped += missed
+	s.lastTick = tick
+	return missed
+}
+
+// RunSummary returns the process uptime and cycle counters shown by the
+// TUI, /stats and the report.
+func (r *DNSResolver) RunSummary() RunSummary {
+	if r.stats == nil {
+		return RunSummary{}
+	}
+	r.stats.mu.Lock()
+	defer r.stats.mu.Unlock()
+	return RunSummary{
+		StartTime: r.stats.StartTime,
+		Uptime:    time.Since(r.stats.StartTime).Round(time.Second),
+		Cycles:    r.stats.cycles,
+	}
 }
 
 // ServerStats tracks statistics for a single server
 type ServerStats struct {
-	Total     int
-	Failures  int
-	LastError string
+	Total     int    `json:"total"`
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
 }
 
-// GenerateReport generates a statistics report
+// Report groupings for GenerateReportBy.
+const (
+	ReportByHour     = "hour"
+	ReportByServer   = "server"
+	ReportByHostname = "hostname"
+)
+
+// ReportGroupings lists the groupings GenerateReportBy accepts.
+var ReportGroupings = []string{ReportByHour, ReportByServer, ReportByHostname}
+
+// GenerateReport generates a statistics report grouped by hour
 func (r *DNSResolver) GenerateReport() string {
+	return r.GenerateReportBy(ReportByHour)
+}
+
+// GenerateReportBy generates a statistics report whose query counts are
+// grouped by hour (a row per hour and server, with a subtotal per hour), by
+// server or by hostname, and ends with the total. Unknown groupings group by
+// hour. Once a cycle has completed, the report starts with the run summary.
+func (r *DNSResolver) GenerateReportBy(by string) string {
 	var report strings.Builder
-	report.WriteString("Hour              | DNS Server     | Total    | Fails    | Fail %  \n")
-	report.WriteString("-----------------------------------------------------------------\n")
+	if summary := r.RunSummary(); summary.Cycles.Completed > 0 {
+		report.WriteString(fmt.Sprintf("Uptime %s since %s; %d cycles completed, %d skipped, average %s\n\n",
+			summary.Uptime, summary.StartTime.Format("2006-01-02 15:04"), summary.Cycles.Completed,
+			summary.Cycles.Skipped, summary.Cycles.AverageDuration))
+	}
+	r.writeQueryCounts(&report, by)
 
-	// Sort stats by time
-	keys := make([]string, 0, len(r.stats.Stats))
-	for k := range r.stats.Stats {
-		keys = append(keys, k)
+	scores := r.ScoreSnapshot()
+	if len(scores) > 0 {
+		report.WriteString("\nRank | DNS Server     | Score  | Avail   | p95 ms   | Agree   | Breaker opens\n")
+		report.WriteString("-----------------------------------------------------------------\n")
+		for _, score := range scores {
+			report.WriteString(fmt.Sprintf("%-4d | %-14s | %6.1f | %6.2f%% | %-8.1f | %6.2f%% | %d\n",
+				score.Rank, score.Server, score.Score, score.Availability*100, score.LatencyP95Ms,
+				score.Agreement*100, score.BreakerOpens))
+		}
 	}
-	sort.Strings(keys)
 
-	for _, key := range keys {
-		stats := r.stats.Stats[key]
-		server := key
-		hour := r.stats.StartTime.Format("2006-01-02 15:04")
-		failPercent := 0.0
-		if stats.Total > 0 {
-			failPercent = float64(stats.Failures) / float64(stats.Total) * 100
+	nodes := r.NodeSnapshot()
+	if len(nodes) > 0 {
+		servers := make([]string, 0, len(nodes))
+		for server := range nodes {
+			servers = append(servers, server)
+		}
+		sort.Strings(servers)
+
+		report.WriteString("\nDNS Server     | Anycast Node             | Source | Changes\n")
+		report.WriteString("-----------------------------------------------------------------\n")
+		for _, server := range servers {
+			info := nodes[server]
+			report.WriteString(fmt.Sprintf("%-14s | %-24s | %-6s | %d\n",
+				server, info.Node, info.Source, info.Changes))
+		}
+	}
+
+	fingerprints := r.FingerprintSnapshot()
+	if len(fingerprints) > 0 {
+		servers := make([]string, 0, len(fingerprints))
+		for server := range fingerprints {
+			servers = append(servers, server)
+		}
+		sort.Strings(servers)
+
+		report.WriteString("\nDNS Server     | Software         | Version                  | Changes\n")
+		report.WriteString("-----------------------------------------------------------------\n")
+		for _, server := range servers {
+			fp := fingerprints[server]
+			version := fp.Version
+			if version == "" {
+				version = "-"
+			}
+			report.WriteString(fmt.Sprintf("%-14s | %-16s | %-24s | %d\n",
+				server, fp.Implementation, version, fp.Changes))
+		}
+	}
+
+	incidents := r.Incidents(10, false)
+	if len(incidents) > 0 {
+		report.WriteString("\nIncident | Hostname                 | Started          | Duration | Causes / Servers\n")
+		report.WriteString("-----------------------------------------------------------------\n")
+		for _, incident := range incidents {
+			duration := incident.Duration().Round(time.Second).String()
+			if incident.Open() {
+				duration += " (open)"
+			}
+			report.WriteString(fmt.Sprintf("%-8d | %-24s | %s | %-8s | %s / %s\n",
+				incident.ID, incident.Hostname, incident.Started.Format("2006-01-02 15:04"), duration,
+				strings.Join(incident.Causes, ","), strings.Join(incident.Servers, ",")))
 		}
-		report.WriteString(fmt.Sprintf("%s | %-12s | %-8d | %-8d | %6.2f%%\n",
-			hour, server, stats.Total, stats.Failures, failPercent))
 	}
 
 	return report.String()
 }
+
+// writeQueryCounts writes the hourly stats store's query counts, grouped as
+// for GenerateReportBy.
+func (r *DNSResolver) writeQueryCounts(report *strings.Builder, by string) {
+	var buckets []StatsBucket
+	if r.statsStore != nil {
+		buckets = r.statsStore.snapshot()
+	}
+	row := func(label string, queries, failures int) {
+		failPercent := 0.0
+		if queries > 0 {
+			failPercent = float64(failures) / float64(queries) * 100
+		}
+		report.WriteString(fmt.Sprintf("%s | %-8d | %-8d | %6.2f%%\n", label, queries, failures, failPercent))
+	}
+	queries, failures := 0, 0
+	for _, bucket := range buckets {
+		queries += bucket.Queries
+		failures += bucket.Failures
+	}
+
+	switch by {
+	case ReportByServer, ReportByHostname:
+		header, width := "DNS Server", 14
+		key := func(b StatsBucket) string { return b.Server }
+		counts := make(map[string]*[2]int)
+		if by == ReportByHostname {
+			header, width = "Hostname", 24
+			key = func(b StatsBucket) string { return b.Hostname }
+		} else if r.stats != nil {
+			// Servers that were never queried still get a row.
+			for server := range r.stats.serverSnapshot() {
+				counts[server] = &[2]int{}
+			}
+		}
+		for _, bucket := range buckets {
+			count, ok := counts[key(bucket)]
+			if !ok {
+				count = &[2]int{}
+				counts[key(bucket)] = count
+			}
+			count[0] += bucket.Queries
+			count[1] += bucket.Failures
+		}
+		keys := make([]string, 0, len(counts))
+		for k := range counts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		report.WriteString(fmt.Sprintf("%-*s | Total    | Fails    | Fail %%  \n", width, header))
+		report.WriteString("-----------------------------------------------------------------\n")
+		for _, k := range keys {
+			row(fmt.Sprintf("%-*s", width, k), counts[k][0], counts[k][1])
+		}
+		report.WriteString("-----------------------------------------------------------------\n")
+		row(fmt.Sprintf("%-*s", width, "Total"), queries, failures)
+	default:
+		report.WriteString("Hour             | DNS Server     | Total    | Fails    | Fail %  \n")
+		report.WriteString("-----------------------------------------------------------------\n")
+		// Buckets are ordered by hour, so each hour's servers are summed
+		// and written before the next hour starts.
+		for i := 0; i < len(buckets); {
+			hour := buckets[i].Hour
+			servers := make(map[string]*[2]int)
+			hourQueries, hourFailures := 0, 0
+			for ; i < len(buckets) && buckets[i].Hour.Equal(hour); i++ {
+				count, ok := servers[buckets[i].Server]
+				if !ok {
+					count = &[2]int{}
+					servers[buckets[i].Server] = count
+				}
+				count[0] += buckets[i].Queries
+				count[1] += buckets[i].Failures
+				hourQueries += buckets[i].Queries
+				hourFailures += buckets[i].Failures
+			}
+			keys := make([]string, 0, len(servers))
+			for server := range servers {
+				keys = append(keys, server)
+			}
+			sort.Strings(keys)
+
+			label := hour.Local().Format("2006-01-02 15:04")
+			for _, server := range keys {
+				row(fmt.Sprintf("%-16s | %-14s", label, server), servers[server][0], servers[server][1])
+			}
+			row(fmt.Sprintf("%-16s | %-14s", label, "all servers"), hourQueries, hourFailures)
+		}
+		report.WriteString("-----------------------------------------------------------------\n")
+		row(fmt.Sprintf("%-16s | %-14s", "Total", ""), queries, failures)
+	}
+}
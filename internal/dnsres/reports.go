@@ -0,0 +1,196 @@
+package dnsres
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/internal/cron"
+	"dnsres/metrics"
+)
+
+const (
+	defaultReportSchedule = "@daily"
+	reportDeliveryTimeout = 30 * time.Second
+)
+
+// Report destinations, as counted by dnsres_reports_total.
+const (
+	reportToEmail   = "email"
+	reportToWebhook = "webhook"
+	reportToSlack   = "slack"
+)
+
+// ReportsConfig configures sending the statistics report on a schedule.
+// Reports are sent only when at least one destination is set.
+type ReportsConfig struct {
+	// Schedule is the cron expression reports are sent on; "@daily"
+	// (default) and "@weekly" are the usual choices.
+	Schedule string `json:"schedule"`
+	// By groups the report's query counts by hour (default), server or
+	// hostname.
+	By string `json:"by,omitempty"`
+	// Email sends the report to the email alert sink's recipients.
+	Email bool `json:"email"`
+	// WebhookURL receives the report as a JSON POST.
+	WebhookURL string `json:"webhook_url,omitempty"`
+	// SlackWebhookURL is a Slack incoming webhook the report is posted to.
+	SlackWebhookURL string `json:"slack_webhook_url,omitempty"`
+}
+
+func (c ReportsConfig) enabled() bool {
+	return c.Email || c.WebhookURL != "" || c.SlackWebhookURL != ""
+}
+
+func (c ReportsConfig) schedule() string {
+	if c.Schedule == "" {
+		return defaultReportSchedule
+	}
+	return c.Schedule
+}
+
+func (c ReportsConfig) by() string {
+	if c.By == "" {
+		return ReportByHour
+	}
+	return c.By
+}
+
+func validateReports(c *Config) error {
+	reports := c.Reports
+	if !reports.enabled() {
+		return nil
+	}
+	var problems configProblems
+	if _, err := cron.Parse(reports.schedule()); err != nil {
+		problems.add("reports.schedule", fmt.Errorf("invalid reports schedule %q: %w", reports.Schedule, err))
+	}
+	problems.check(slices.Contains(ReportGroupings, reports.by()), "reports.by", fmt.Sprintf("invalid reports by %q: must be one of %s", reports.By, strings.Join(ReportGroupings, ", ")))
+	problems.check(!reports.Email || c.Email.Host != "", "reports.email", "needs email.host to be set")
+	problems.add("reports.webhook_url", validateWebhookURL(reports.WebhookURL))
+	problems.add("reports.slack_webhook_url", validateWebhookURL(reports.SlackWebhookURL))
+	return problems.err()
+}
+
+// validateWebhookURL accepts an empty webhook or an http(s) URL.
+func validateWebhookURL(webhook string) error {
+	if webhook == "" {
+		return nil
+	}
+	u, err := url.Parse(webhook)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook %q: must be an http(s) URL", webhook)
+	}
+	return nil
+}
+
+// newReportSchedule parses the report schedule, returning nil when no
+// destination is set.
+func newReportSchedule(config *Config) (*cron.Schedule, error) {
+	if !config.Reports.enabled() {
+		return nil, nil
+	}
+	return cron.Parse(config.Reports.schedule())
+}
+
+// reportWebhookPayload is the body POSTed to reports.webhook_url.
+type reportWebhookPayload struct {
+	Time   time.Time `json:"time"`
+	By     string    `json:"by"`
+	Report string    `json:"report"`
+}
+
+// runReports sends the report on schedule until ctx is canceled.
+func (r *DNSResolver) runReports(ctx context.Context) {
+	for {
+		next := r.reports.Next(time.Now())
+		if next.IsZero() {
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case tick := <-timer.C:
+			r.deliverReport(ctx, tick)
+		}
+	}
+}
+
+// deliverReport sends the report generated at tick to each configured
+// destination, unless another instance leads. A destination that fails is
+// logged and not retried.
+func (r *DNSResolver) deliverReport(ctx context.Context, tick time.Time) {
+	config := r.currentConfig().Reports
+	var destinations []string
+	if config.Email && r.email != nil {
+		destinations = append(destinations, reportToEmail)
+	}
+	if config.WebhookURL != "" {
+		destinations = append(destinations, reportToWebhook)
+	}
+	if config.SlackWebhookURL != "" {
+		destinations = append(destinations, reportToSlack)
+	}
+	if !r.leading() {
+		for _, destination := range destinations {
+			metrics.DNSResReports.WithLabelValues(destination, "standby").Inc()
+		}
+		r.appLogf(instrumentation.Medium, "scheduled report skipped on standby")
+		return
+	}
+
+	report := r.GenerateReportBy(config.by())
+	title := "dnsres report " + tick.Local().Format("2006-01-02 15:04")
+	for _, destination := range destinations {
+		sendCtx, cancel := context.WithTimeout(ctx, reportDeliveryTimeout)
+		var err error
+		switch destination {
+		case reportToEmail:
+			err = r.email.send(sendCtx, r.email.config, r.email.config.message("[dnsres] "+title, tick, report))
+		case reportToWebhook:
+			err = postJSON(sendCtx, config.WebhookURL, reportWebhookPayload{Time: tick, By: config.by(), Report: report})
+		case reportToSlack:
+			// Slack renders the fixed-width tables only inside a code block.
+			err = postJSON(sendCtx, config.SlackWebhookURL, map[string]string{"text": "*" + title + "*\n```\n" + report + "```"})
+		}
+		cancel()
+		if err != nil {
+			metrics.DNSResReports.WithLabelValues(destination, "failed").Inc()
+			r.errorLog.Printf("Sending scheduled report to %s failed: %v", destination, err)
+			continue
+		}
+		metrics.DNSResReports.WithLabelValues(destination, "sent").Inc()
+		r.appLogf(instrumentation.Low, "scheduled report sent destination=%s", destination)
+	}
+}
+
+// postJSON POSTs payload as JSON to target, failing on a non-2xx status.
+func postJSON(ctx context.Context, target string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -2,12 +2,15 @@ package dnsres
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"dnsres/cache"
@@ -16,12 +19,21 @@ import (
 	"dnsres/dnspool"
 	"dnsres/health"
 	"dnsres/instrumentation"
+	"dnsres/internal/cron"
+	"dnsres/internal/geoip"
 	"dnsres/metrics"
 
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Client pool settings. server_settings.pool_size overrides the size per
+// server.
+const (
+	defaultClientPoolSize = 100
+	clientIdleTimeout     = 5 * time.Minute
+)
+
 // DNSResolver represents a DNS resolution tool
 type DNSResolver struct {
 	config                *Config
@@ -34,20 +46,79 @@ type DNSResolver struct {
 	appLog                *log.Logger
 	output                io.Writer
 	stats                 *ResolutionStats
+	statsStore            *statsStore
 	instrumentationLevel  instrumentation.Level
 	resolveAllFunc        func(context.Context)
 	resolveWithServerFunc func(context.Context, string, string) (*dnsanalysis.DNSResponse, error)
 	getClient             func(string) (dnsClient, error)
+	newID                 func() uint16
 	putClient             func(string, dnsClient)
 	events                *eventBus
+	history               *eventHistory
+	audit                 *auditLog
+	nodes                 *nodeTracker
+	fingerprints          *fingerprintTracker
+	interceptions         *interceptionTracker
+	references            *referenceTracker
+	flaps                 *flapTracker
+	latencies             *latencyTracker
+	scores                *scoreTracker
+	inflight              *inflightLimiter
+	hostnames             *hostnameTracker
+	dns64                 *dns64Tracker
+	mdns                  *mdnsTracker
+	discovery             *discoveryState
+	reloads               chan configReload
+	triggers              chan string
+	mdnsQuerier           mdnsQuerier
+	hooks                 queryHooks
+	checks                checkPrograms
+	geo                   geoLookup
+	screening             *screeningState
+	schedules             map[string]*cron.Schedule
+	bursts                *burstState
+	incidents             *incidentTracker
+	malformed             *malformedSamples
+	captures              *captureState
+	email                 *emailAlerter
+	leader                *leaderState
+	results               *resultSink
+	resultsFile           *resultsFile
+	slowLog               *log.Logger
+	warmUntil             time.Time
+	sampling              *sampler
+	archive               *archiver
+	reports               *cron.Schedule
 	logDir                string
 	logDirFallback        bool
+	// configMu guards config and breakers, which applyConfig replaces while
+	// other goroutines read them through currentConfig and breaker.
+	configMu sync.RWMutex
+	// labelsAggregated is set while the memory budget is exceeded.
+	labelsAggregated atomic.Bool
+	// nextCycle is when the next scheduled cycle is due, in Unix
+	// nanoseconds.
+	nextCycle       atomic.Int64
+	queryMetricSets queryMetricCache
+	listeners       listenerPorts
+	// roundRobin counts the queries ordered by the round-robin selection
+	// policy.
+	roundRobin atomic.Uint64
+	// randomization is the result of the startup randomization audit.
+	randomization atomic.Pointer[RandomizationAudit]
 }
 
 type dnsClient interface {
 	ExchangeContext(context.Context, *dns.Msg, string) (*dns.Msg, time.Duration, error)
 }
 
+// connExchanger is implemented by clients that can dial separately from the
+// exchange, which lets connection setup be timed on its own.
+type connExchanger interface {
+	DialContext(context.Context, string) (*dns.Conn, error)
+	ExchangeWithConnContext(context.Context, *dns.Msg, *dns.Conn) (*dns.Msg, time.Duration, error)
+}
+
 // NewDNSResolver creates a new DNS resolver
 func NewDNSResolver(config *Config) (*DNSResolver, error) {
 	config.InstrumentationLevel = normalizeInstrumentationLevel(config.InstrumentationLevel)
@@ -56,13 +127,24 @@ func NewDNSResolver(config *Config) (*DNSResolver, error) {
 	}
 
 	// Initialize loggers
-	successLog, errorLog, appLog, actualLogDir, wasFallback, err := setupLoggers(config.LogDir)
+	successLog, errorLog, appLog, actualLogDir, wasFallback, err := setupRotatingLoggers(config.LogDir, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to setup loggers: %w", err)
 	}
 
+	audit, err := openAuditLog(filepath.Join(actualLogDir, "dnsres-audit.log"))
+	if err != nil {
+		return nil, err
+	}
+
 	// Initialize client pool
-	clientPool := dnspool.NewClientPool(100, config.QueryTimeout.Duration)
+	clientPool := dnspool.NewClientPool(defaultClientPoolSize, config.QueryTimeout.Duration)
+	clientPool.IdleTimeout = clientIdleTimeout
+	for server, settings := range config.ServerSettings {
+		if settings.PoolSize > 0 {
+			clientPool.SetServerMaxSize(server, settings.PoolSize)
+		}
+	}
 
 	// Initialize circuit breakers
 	breakers := make(map[string]*circuitbreaker.CircuitBreaker)
@@ -75,7 +157,7 @@ func NewDNSResolver(config *Config) (*DNSResolver, error) {
 	}
 
 	// Initialize sharded cache
-	cache := cache.NewShardedCache(config.Cache.MaxSize, 16)
+	cache := cache.New(cache.Limits{MaxEntries: int(config.Cache.MaxSize), MaxBytes: config.Cache.MaxBytes}, 16)
 
 	// Initialize health checker
 	level, err := instrumentation.ParseLevel(config.InstrumentationLevel)
@@ -84,6 +166,8 @@ func NewDNSResolver(config *Config) (*DNSResolver, error) {
 	}
 
 	healthChecker := health.NewHealthChecker(config.DNSServers, appLog, level)
+	healthChecker.SetThresholds(config.HealthCheck.UnhealthyThreshold, config.HealthCheck.HealthyThreshold)
+	healthChecker.SetFailOnUpstreamDown(config.HealthCheck.FailOnUpstreamDown)
 
 	// Initialize stats
 	stats := &ResolutionStats{
@@ -93,6 +177,65 @@ func NewDNSResolver(config *Config) (*DNSResolver, error) {
 	for _, server := range config.DNSServers {
 		stats.Stats[server] = &ServerStats{}
 	}
+	statsStore, err := openStatsStore(filepath.Join(actualLogDir, "dnsres-stats.json"))
+	if err != nil {
+		// Start over rather than refuse to monitor.
+		errorLog.Printf("%v; report history starts empty", err)
+	}
+
+	discovery, err := newDiscoveryState(config)
+	if err != nil {
+		return nil, err
+	}
+
+	schedules, err := compileSchedules(config)
+	if err != nil {
+		return nil, err
+	}
+
+	email, err := newEmailAlerter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	leader, err := newLeaderState(config)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := newResultSink(config)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsFile, err := openResultsFile(config, actualLogDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open results file: %w", err)
+	}
+
+	slowLog, err := openSlowQueryLog(config, actualLogDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open slow query log: %w", err)
+	}
+
+	archiver, err := newArchiver(config, actualLogDir)
+	if err != nil {
+		return nil, err
+	}
+
+	reports, err := newReportSchedule(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var geo geoLookup
+	if config.GeoIP.CountryDB != "" || config.GeoIP.ASNDB != "" {
+		db, err := geoip.OpenDB(config.GeoIP.CountryDB, config.GeoIP.ASNDB)
+		if err != nil {
+			return nil, err
+		}
+		geo = db
+	}
 
 	resolver := &DNSResolver{
 		config:                config,
@@ -105,15 +248,52 @@ func NewDNSResolver(config *Config) (*DNSResolver, error) {
 		appLog:                appLog,
 		output:                os.Stdout,
 		stats:                 stats,
+		statsStore:            statsStore,
 		instrumentationLevel:  level,
 		resolveAllFunc:        nil,
 		resolveWithServerFunc: nil,
 		getClient:             nil,
 		putClient:             nil,
+		newID:                 idGenerator(config.IDSource()),
 		events:                newEventBus(),
+		history:               newEventHistory(config.Events.HistorySize),
+		audit:                 audit,
+		nodes:                 newNodeTracker(),
+		fingerprints:          newFingerprintTracker(),
+		interceptions:         newInterceptionTracker(),
+		references:            newReferenceTracker(),
+		flaps:                 newFlapTracker(),
+		latencies:             newLatencyTracker(),
+		scores:                newScoreTracker(),
+		inflight:              newInflightLimiter(),
+		hostnames:             newHostnameTracker(),
+		dns64:                 newDNS64Tracker(),
+		mdns:                  newMDNSTracker(),
+		discovery:             discovery,
+		geo:                   geo,
+		screening:             newScreeningState(config),
+		schedules:             schedules,
+		bursts:                newBurstState(config),
+		sampling:              newSampler(config),
+		incidents:             newIncidentTracker(),
+		malformed:             &malformedSamples{},
+		captures:              newCaptureState(),
+		email:                 email,
+		leader:                leader,
+		results:               results,
+		resultsFile:           resultsFile,
+		slowLog:               slowLog,
+		archive:               archiver,
+		reports:               reports,
+		reloads:               make(chan configReload),
+		triggers:              make(chan string, 1),
+		mdnsQuerier:           multicastQuerier{group: mdnsGroup},
 		logDir:                actualLogDir,
 		logDirFallback:        wasFallback,
 	}
+	for _, breaker := range breakers {
+		resolver.watchBreaker(breaker)
+	}
 	resolver.resolveAllFunc = resolver.resolveAll
 	resolver.resolveWithServerFunc = resolver.resolveWithServer
 	resolver.getClient = func(server string) (dnsClient, error) {
@@ -136,6 +316,9 @@ func NewDNSResolver(config *Config) (*DNSResolver, error) {
 		config.QueryTimeout.Duration,
 		level.String(),
 	)
+	for _, warning := range config.Warnings() {
+		resolver.appLogf(instrumentation.Low, "config warning: %s", warning)
+	}
 
 	return resolver, nil
 }
@@ -148,19 +331,69 @@ func (r *DNSResolver) SubscribeEvents(buffer int) (<-chan ResolverEvent, func())
 	return r.events.subscribe(buffer)
 }
 
+// SubscribeEventsWithOptions subscribes with explicit delivery options, such
+// as a durable ring-buffered subscription that does not lose bursts.
+func (r *DNSResolver) SubscribeEventsWithOptions(opts SubscribeOptions) (<-chan ResolverEvent, func()) {
+	if r.events == nil {
+		return nil, func() {}
+	}
+	return r.events.subscribeWithOptions(opts)
+}
+
+// RecentEvents returns up to limit of the most recently emitted events,
+// oldest first. A limit of zero returns the whole history; eventType filters
+// by type when non-empty.
+func (r *DNSResolver) RecentEvents(limit int, eventType EventType) []ResolverEvent {
+	if r.history == nil {
+		return []ResolverEvent{}
+	}
+	return r.history.recent(limit, eventType)
+}
+
+// SubscribeEventsFiltered subscribes to the events that pass filter, so
+// consumers interested in a few hostnames or servers do not have to receive
+// and discard everything else.
+func (r *DNSResolver) SubscribeEventsFiltered(filter EventFilter, buffer int) (<-chan ResolverEvent, func()) {
+	return r.SubscribeEventsWithOptions(SubscribeOptions{Buffer: buffer, Filter: filter})
+}
+
+// EventSubscriberStats returns per-subscriber delivery and drop counters.
+func (r *DNSResolver) EventSubscriberStats() []SubscriberStats {
+	if r.events == nil {
+		return []SubscriberStats{}
+	}
+	return r.events.stats()
+}
+
 // SetOutputWriter controls where resolver status output is written.
 func (r *DNSResolver) SetOutputWriter(writer io.Writer) {
 	r.output = writer
 }
 
-// HealthSnapshot returns the latest health check status.
-func (r *DNSResolver) HealthSnapshot() map[string]bool {
+// HealthSnapshot returns the latest health check result of every configured
+// server; servers not yet checked have a zero LastCheck.
+func (r *DNSResolver) HealthSnapshot() map[string]health.ServerHealth {
 	if r.health == nil {
-		return map[string]bool{}
+		return map[string]health.ServerHealth{}
 	}
 	return r.health.StatusSnapshot()
 }
 
+// CacheStats describes the response cache and each of its shards. Counters
+// cover the cache's lifetime.
+type CacheStats = cache.Stats
+
+// CacheShardStats describes one response cache shard.
+type CacheShardStats = cache.ShardStats
+
+// CacheSnapshot returns the response cache statistics.
+func (r *DNSResolver) CacheSnapshot() CacheStats {
+	if r.cache == nil {
+		return CacheStats{}
+	}
+	return r.cache.GetStats()
+}
+
 // GetLogDir returns the actual log directory being used.
 func (r *DNSResolver) GetLogDir() string {
 	return r.logDir
@@ -173,33 +406,46 @@ func (r *DNSResolver) LogDirWasFallback() bool {
 
 // Start begins the DNS resolution monitoring
 func (r *DNSResolver) Start(ctx context.Context) error {
+	if r.clientPool != nil {
+		defer r.clientPool.Close()
+	}
+	defer r.saveStats(true)
+
+	// Bind every listener before anything else starts so a port conflict
+	// stops Start instead of leaving the resolver running without one.
+	listeners, err := r.bindListeners(r.config)
+	if err != nil {
+		return err
+	}
+	r.startWarmUp(ctx)
+	r.auditRandomization(ctx)
+
 	// Create HTTP servers
 	healthServer := &http.Server{
-		Addr:         fmt.Sprintf(":%d", r.config.HealthPort),
-		Handler:      r.health,
+		Handler:      r.apiHandler(),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
 	metricsServer := &http.Server{
-		Addr:         fmt.Sprintf(":%d", r.config.MetricsPort),
 		Handler:      promhttp.Handler(),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
 
-	r.outputf("Health endpoint listening on :%d\n", r.config.HealthPort)
-	r.outputf("Metrics endpoint listening on :%d\n", r.config.MetricsPort)
-	r.appLogf(instrumentation.Low, "health server starting on :%d", r.config.HealthPort)
-	r.appLogf(instrumentation.Low, "metrics server starting on :%d", r.config.MetricsPort)
+	ports := r.ListenPorts()
+	r.outputf("Health endpoint listening on :%d\n", ports["health"])
+	r.outputf("Metrics endpoint listening on :%d\n", ports["metrics"])
+	r.appLogf(instrumentation.Low, "health server starting on :%d", ports["health"])
+	r.appLogf(instrumentation.Low, "metrics server starting on :%d", ports["metrics"])
 
 	// Start servers
 	go func() {
-		if err := healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := healthServer.Serve(listeners.health); err != nil && err != http.ErrServerClosed {
 			r.appLog.Printf("Health server error: %v", err)
 		}
 	}()
 	go func() {
-		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := metricsServer.Serve(listeners.metrics); err != nil && err != http.ErrServerClosed {
 			r.appLog.Printf("Metrics server error: %v", err)
 		}
 	}()
@@ -217,6 +463,70 @@ func (r *DNSResolver) Start(ctx context.Context) error {
 		}
 	}()
 
+	// Serve /startupz before loading remote config so probes can see it.
+	if err := r.startRemoteConfig(ctx); err != nil {
+		listeners.closeDeferred()
+		return err
+	}
+	if r.health != nil {
+		r.health.MarkConfigLoaded()
+	}
+	if r.leader != nil {
+		resign := r.startLeaderElection(ctx)
+		defer resign()
+	}
+
+	if listeners.grpc != nil {
+		if err := r.startGRPC(ctx, listeners.grpc); err != nil {
+			listeners.closeDeferred()
+			return err
+		}
+	}
+	if listeners.forwarderTCP != nil {
+		r.startForwarder(ctx, listeners.forwarderUDP, listeners.forwarderTCP)
+	}
+
+	if r.discovery != nil {
+		r.refreshDiscovery(ctx) // Include discovered hostnames in the first cycle
+		go r.runDiscovery(ctx)
+	}
+
+	if r.screening != nil {
+		r.refreshScreening(ctx) // Screen the first cycle's answers too
+		go r.runScreening(ctx)
+	}
+
+	if len(r.schedules) > 0 {
+		go r.runSchedules(ctx)
+	}
+	if r.bursts != nil {
+		go r.runBursts(ctx)
+	}
+	if r.email != nil {
+		go r.runEmailAlerts(ctx)
+	}
+	if r.incidents != nil {
+		go r.runIncidentWebhooks(ctx)
+	}
+	if r.config.Publish.Backend != "" {
+		go r.runPublisher(ctx)
+	}
+	if r.results != nil {
+		go r.runResultSink(ctx)
+	}
+	if r.archive != nil {
+		go r.runArchive(ctx)
+	}
+	if r.reports != nil {
+		go r.runReports(ctx)
+	}
+	if r.config.Memory.BudgetMB > 0 {
+		go r.runMemoryBudget(ctx)
+	}
+	if r.cache != nil {
+		go r.cache.RunCleanup(ctx, r.config.cacheCleanupInterval())
+	}
+
 	// Start resolution loop
 	r.resolveAllFunc(ctx) // Run initial resolution immediately
 	r.outputf("Resolution loop started (interval %s)\n", r.config.QueryInterval.Duration)
@@ -224,6 +534,7 @@ func (r *DNSResolver) Start(ctx context.Context) error {
 
 	ticker := time.NewTicker(r.config.QueryInterval.Duration)
 	defer ticker.Stop()
+	r.scheduleNextCycle(time.Now())
 
 	return r.runLoop(ctx, ticker.C)
 }
@@ -233,120 +544,296 @@ func (r *DNSResolver) runLoop(ctx context.Context, ticks <-chan time.Time) error
 		select {
 		case <-ctx.Done():
 			return nil
-		case <-ticks:
-			r.appLogf(instrumentation.Low, "resolution tick fired interval=%s", r.config.QueryInterval.Duration)
+		case tick := <-ticks:
+			r.appLogf(instrumentation.Low, "resolution tick fired interval=%s", r.currentConfig().QueryInterval.Duration)
+			r.scheduleNextCycle(tick)
+			r.runCycle(ctx, tick)
+		case actor := <-r.triggers:
+			r.appLogf(instrumentation.Low, "resolution cycle starting on request actor=%s", actor)
 			r.resolveAllFunc(ctx)
+		case reload := <-r.reloads:
+			r.applyConfig(reload.config, reload.actor)
 		}
 	}
 }
 
-// resolveAll resolves all hostnames against all DNS servers concurrently
+// runCycle runs one resolution cycle for tick, recording how late it started
+// and whether it ran past the next tick.
+func (r *DNSResolver) runCycle(ctx context.Context, tick time.Time) {
+	config := r.currentConfig()
+	start := time.Now()
+	metrics.DNSResSchedulerLag.Observe(start.Sub(tick).Seconds())
+	if r.stats != nil {
+		skipTicks(tierInterval, r.stats.recordTick(tick, config.QueryInterval.Duration))
+	}
+	r.resolveAllFunc(ctx)
+	if interval := config.QueryInterval.Duration; interval > 0 && time.Since(start) > interval {
+		metrics.DNSResCycleOverlaps.Inc()
+		r.appLogf(instrumentation.Low, "resolution cycle overran interval=%s", interval)
+	}
+}
+
+// resolveAll runs one resolution cycle over all configured and discovered
+// hostnames
 func (r *DNSResolver) resolveAll(ctx context.Context) {
+	config := r.currentConfig()
 	start := time.Now()
-	r.outputf("Resolution cycle starting (hostnames %d, servers %d)\n", len(r.config.Hostnames), len(r.config.DNSServers))
+	mode := config.QueryMode()
+	hostnames := r.sampleHostnames(r.intervalHostnames())
+	r.outputf("Resolution cycle starting (hostnames %d, servers %d, mode %s)\n", len(hostnames), len(config.DNSServers), mode)
 	r.emitEvent(ResolverEvent{
 		Type:          EventCycleStart,
 		Time:          start,
-		HostnameCount: len(r.config.Hostnames),
-		ServerCount:   len(r.config.DNSServers),
+		HostnameCount: len(hostnames),
+		ServerCount:   len(config.DNSServers),
+		QueryMode:     mode,
 	})
 	r.appLogf(
 		instrumentation.Low,
-		"resolution cycle start hostnames=%d servers=%d",
-		len(r.config.Hostnames),
-		len(r.config.DNSServers),
+		"resolution cycle start hostnames=%d servers=%d mode=%s",
+		len(hostnames),
+		len(config.DNSServers),
+		mode,
 	)
 
+	cycleCtx, deadline, cancel := withCycleDeadline(ctx, config.cycleTimeout())
+	defer cancel()
+
+	r.identifyNodes(cycleCtx)
+	r.fingerprintServers(cycleCtx)
+	r.detectInterception(cycleCtx)
+	r.detectDNS64(cycleCtx)
+
 	var wg sync.WaitGroup
+	var resolved, unqueried atomic.Int64
 	sem := make(chan struct{}, 10) // Limit concurrent resolutions
 
-	for _, hostname := range r.config.Hostnames {
+	queued := time.Now()
+	queueWork(tierInterval, len(hostnames))
+	for _, hostname := range hostnames {
 		wg.Add(1)
 		go func(h string) {
 			defer wg.Done()
-			sem <- struct{}{}        // Acquire semaphore
+			select {
+			case sem <- struct{}{}: // Acquire semaphore
+				startWork(tierInterval, queued)
+			case <-cycleCtx.Done():
+				if cycleTimedOut(cycleCtx) {
+					dropWork(tierInterval, "cycle_timeout")
+				} else {
+					dropWork(tierInterval, "")
+				}
+				unqueried.Add(1)
+				return
+			}
 			defer func() { <-sem }() // Release semaphore
 
-			var responses []*dnsanalysis.DNSResponse
-			var responseMu sync.Mutex
-
-			// Resolve against all servers concurrently
-			var serverWg sync.WaitGroup
-			for _, server := range r.config.DNSServers {
-				serverWg.Add(1)
-				go func(s string) {
-					defer serverWg.Done()
-					response, err := r.resolveWithServerFunc(ctx, s, h)
-					if err != nil {
-						r.errorLog.Printf("Failed to resolve %s using %s: %v", h, s, err)
-						r.stats.Stats[s].Failures++
-						r.stats.Stats[s].LastError = err.Error()
-						return
-					}
-					r.successLog.Printf("Resolved %s using %s (state: %s)", h, s, r.breakers[s].GetState())
-					r.stats.Stats[s].Total++
-
-					responseMu.Lock()
-					responses = append(responses, response)
-					responseMu.Unlock()
-				}(server)
-			}
-			serverWg.Wait()
-
-			// Check response consistency
-			if len(responses) > 1 {
-				consistent := dnsanalysis.CompareResponses(responses)
-				metrics.DNSResolutionConsistency.WithLabelValues(h).Set(boolToFloat64(consistent))
-				if !consistent {
-					consistentValue := false
-					r.emitEvent(ResolverEvent{
-						Type:       EventInconsistent,
-						Time:       time.Now(),
-						Hostname:   h,
-						Consistent: &consistentValue,
-					})
-					r.appLogf(instrumentation.High, "inconsistent responses hostname=%s", h)
-					r.errorLog.Printf("Inconsistent responses for %s", h)
-				}
+			if len(r.resolveHostname(cycleCtx, h)) > 0 {
+				resolved.Add(1)
 			}
 		}(hostname)
 	}
 	wg.Wait()
+	if cycleTimedOut(cycleCtx) {
+		r.reportCycleTimeout(deadline, int(unqueried.Load()))
+	}
+	if resolved.Load() > 0 && r.health != nil {
+		r.health.MarkReady()
+	}
+	r.probeMDNS(ctx)
+	r.saveStats(false)
 	duration := time.Since(start)
 	metrics.DNSResolutionCycleDuration.Observe(duration.Seconds())
+	r.stats.recordCycle(duration)
 	r.outputf("Resolution cycle complete (duration %s)\n", duration)
 	r.emitEvent(ResolverEvent{
 		Type:          EventCycleComplete,
 		Time:          time.Now(),
 		Duration:      duration,
-		HostnameCount: len(r.config.Hostnames),
-		ServerCount:   len(r.config.DNSServers),
+		HostnameCount: len(hostnames),
+		ServerCount:   len(config.DNSServers),
+		QueryMode:     mode,
 	})
 	r.appLogf(instrumentation.Low, "resolution cycle complete duration=%s", duration)
 }
 
+// resolveHostname queries hostname against the primary servers, and the
+// fallbacks when a primary fails, flags inconsistent answers and returns the
+// responses collected. It returns nil when ctx is canceled mid-query, except
+// at a cycle deadline: queries still running then are recorded as timeouts.
+func (r *DNSResolver) resolveHostname(ctx context.Context, h string) []*dnsanalysis.DNSResponse {
+	config := r.currentConfig()
+	started := time.Now()
+	mode := config.QueryMode()
+	primaries, fallbacks := config.ServersByRole()
+
+	var responses []*dnsanalysis.DNSResponse
+	failures := make(map[string]string)
+	var responseMu sync.Mutex
+
+	resolveOne := func(s string) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		response, err := r.resolveWithServerFunc(ctx, s, h)
+		if err != nil && ctx.Err() != nil {
+			if !cycleTimedOut(ctx) {
+				// Shutting down; the server is not at fault.
+				return false
+			}
+			err = r.recordStraggler(ctx, h, s)
+		}
+		r.recordRoleResult(s, err)
+		r.scoreOutcome(s, err)
+		if r.statsStore != nil {
+			r.statsStore.record(time.Now(), h, s, err != nil)
+		}
+		if err != nil {
+			r.errorLog.Printf("Failed to resolve %s using %s (mode: %s): %v", h, s, mode, err)
+			r.stats.recordFailure(s, err.Error())
+			responseMu.Lock()
+			failures[s] = err.Error()
+			responseMu.Unlock()
+			return false
+		}
+		state := "removed"
+		if breaker := r.breaker(s); breaker != nil {
+			state = breaker.GetState()
+		}
+		r.successLog.Printf("Resolved %s using %s (state: %s, mode: %s)%s", h, s, state, mode, r.geoLogSuffix(response.Addresses))
+		r.stats.recordSuccess(s)
+
+		responseMu.Lock()
+		responses = append(responses, response)
+		responseMu.Unlock()
+		return true
+	}
+
+	if mode == QueryModeSequential {
+		// Query servers in order so earlier lookups can warm
+		// caches shared with later ones.
+		for i, server := range primaries {
+			if i > 0 && !sleepContext(ctx, config.Querying.Stagger.Duration) {
+				break
+			}
+			resolveOne(server)
+		}
+	} else {
+		// Resolve against all primaries concurrently
+		var serverWg sync.WaitGroup
+		for _, server := range primaries {
+			serverWg.Add(1)
+			go func(s string) {
+				defer serverWg.Done()
+				resolveOne(s)
+			}(server)
+		}
+		serverWg.Wait()
+	}
+	if ctx.Err() != nil && (!cycleTimedOut(ctx) || len(failures)+len(responses) == 0) {
+		return nil
+	}
+
+	// Fall back in configured order until one fallback answers.
+	if len(failures) > 0 && len(fallbacks) > 0 {
+		metrics.DNSResolutionFallbacks.WithLabelValues(r.metricHostname(h)).Inc()
+		r.appLogf(instrumentation.Medium, "querying fallbacks hostname=%s failed_primaries=%d", h, len(failures))
+		for _, server := range fallbacks {
+			if resolveOne(server) || ctx.Err() != nil {
+				break
+			}
+		}
+		if ctx.Err() != nil && !cycleTimedOut(ctx) {
+			return nil
+		}
+	}
+
+	// Check response consistency, then let analyzers flag anything else
+	consistent := true
+	if len(responses) > 1 {
+		consistent = dnsanalysis.CompareResponses(responses)
+		metrics.DNSResolutionConsistency.WithLabelValues(r.metricHostname(h)).Set(boolToFloat64(consistent))
+	}
+	r.trackIncident(h, started, failures, len(responses), consistent)
+	r.rollupHostname(h, responses, failures, consistent)
+	r.recordResults(ctx, h, responses, failures, consistent)
+	if len(failures) > 0 {
+		r.triggerBurst(h, fmt.Sprintf("%d of %d servers failed", len(failures), len(failures)+len(responses)))
+	} else if !consistent {
+		r.triggerBurst(h, "inconsistent answers")
+	}
+	r.compareWithReference(h, responses, failures)
+	r.detectFlapping(h, responses)
+	r.scoreAgreement(h, responses)
+	r.runAnalyzers(dnsanalysis.ResponseSet{Hostname: h, Responses: responses, Failures: failures, Reference: config.ReferenceServer})
+	r.runChecks(h, responses)
+	r.checkGeo(h, responses)
+	r.screenAnswers(h, responses)
+	return responses
+}
+
 // resolveWithServer resolves a hostname using a specific DNS server
 func (r *DNSResolver) resolveWithServer(ctx context.Context, server, hostname string) (*dnsanalysis.DNSResponse, error) {
-	// Check cache first
-	if cached, ok := r.cache.Get(hostname); ok {
-		metrics.DNSResolutionCacheHit.WithLabelValues(server, hostname).Inc()
-		r.appLogf(instrumentation.Low, "cache hit hostname=%s server=%s", hostname, server)
-		r.emitEvent(ResolverEvent{
-			Type:      EventResolveSuccess,
-			Time:      time.Now(),
-			Hostname:  hostname,
-			Server:    server,
-			Addresses: append([]string(nil), cached.Addresses...),
-			Source:    "cache",
-		})
-		return cached, nil
+	config := r.currentConfig()
+	entered := time.Now()
+	series := r.queryMetrics(server, hostname)
+
+	// Check cache first; burst queries must reach the server, and bypassed
+	// hostnames count as neither hits nor misses. Answers are cached per
+	// server. On a miss under the normal policy, the refresh lock makes
+	// concurrent queries for the hostname on this server wait for this one's
+	// answer instead of all querying upstream.
+	policy := config.cachePolicy(hostname)
+	if policy != CachePolicyBypass {
+		var cached *dnsanalysis.DNSResponse
+		var ok bool
+		if policy == CachePolicyNormal {
+			var release func()
+			cached, release, ok = r.cache.GetOrLock(ctx, cacheKey(server, hostname))
+			defer release()
+		} else {
+			cached, ok = r.cache.Get(cacheKey(server, hostname))
+		}
+		if ok && !isBurstQuery(ctx) {
+			series.cacheHit.Inc()
+			if r.appLogEnabled(instrumentation.Low) {
+				r.appLogf(instrumentation.Low, "cache hit hostname=%s server=%s", hostname, server)
+			}
+			if rcode := cachedRcode(cached); rcode != dns.RcodeSuccess {
+				r.emitEvent(ResolverEvent{
+					Type:     EventResolveFailure,
+					Time:     time.Now(),
+					Hostname: hostname,
+					Server:   server,
+					Error:    dns.RcodeToString[rcode],
+					Source:   "cache",
+				})
+				return nil, fmt.Errorf("DNS query returned error code: %s (cached)", dns.RcodeToString[rcode])
+			}
+			r.emitEvent(ResolverEvent{
+				Type:      EventResolveSuccess,
+				Time:      time.Now(),
+				Hostname:  hostname,
+				Server:    server,
+				Addresses: append([]string(nil), cached.Addresses...),
+				Geo:       r.lookupGeo(cached.Addresses),
+				Source:    "cache",
+			})
+			return cached, nil
+		}
+		series.cacheMiss.Inc()
+		if r.appLogEnabled(instrumentation.Low) {
+			r.appLogf(instrumentation.Low, "cache miss hostname=%s server=%s", hostname, server)
+		}
 	}
-	metrics.DNSResolutionCacheMiss.WithLabelValues(server, hostname).Inc()
-	r.appLogf(instrumentation.Low, "cache miss hostname=%s server=%s", hostname, server)
 
-	// Check circuit breaker
-	if !r.breakers[server].Allow() {
-		metrics.DNSResolutionFailure.WithLabelValues(server, hostname, "circuit_breaker").Inc()
+	// Check circuit breaker. A server a reload removed has none left.
+	breaker := r.breaker(server)
+	if breaker == nil {
+		return nil, fmt.Errorf("%s is no longer configured", server)
+	}
+	if !breaker.Allow() {
+		metrics.DNSResolutionFailure.WithLabelValues(server, r.metricHostname(hostname), "circuit_breaker").Inc()
 		r.appLogf(instrumentation.Medium, "circuit breaker open server=%s", server)
 		r.emitEvent(ResolverEvent{
 			Type:     EventResolveFailure,
@@ -358,6 +845,20 @@ func (r *DNSResolver) resolveWithServer(ctx context.Context, server, hostname st
 		})
 		return nil, fmt.Errorf("circuit breaker open for %s", server)
 	}
+	var breakerState string
+	var breakerFailures int
+	if r.slowLog != nil {
+		breakerState, breakerFailures = breaker.GetState(), breaker.GetFailures()
+	}
+
+	// Wait for a query slot when the server caps queries in flight; the wait
+	// counts toward the query's queue time.
+	release, err := r.acquireSlot(ctx, server)
+	if err != nil {
+		r.appLogf(instrumentation.Medium, "DNS query canceled hostname=%s server=%s", hostname, server)
+		return nil, fmt.Errorf("DNS query canceled: %w", err)
+	}
+	defer release()
 
 	// Get client from pool
 	client, err := r.getClient(server)
@@ -375,25 +876,132 @@ func (r *DNSResolver) resolveWithServer(ctx context.Context, server, hostname st
 	}
 	defer r.putClient(server, client)
 
+	// Bound the whole exchange by the per-server deadline while still
+	// honoring cancellation of the cycle.
+	parent := ctx
+	if timeout := config.QueryTimeoutFor(server); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	settings := config.Settings(server)
+	if settings.DelegationTrace {
+		if err := r.traceDelegation(ctx, client, server, hostname, settings.recursionDesired()); err != nil {
+			r.recordBreakerFailure(server, err)
+			r.stats.recordFailure(server, err.Error())
+			metrics.DNSResolutionFailure.WithLabelValues(server, r.metricHostname(hostname), "delegation_trace").Inc()
+			r.appLogf(instrumentation.Medium, "delegation trace failed hostname=%s server=%s err=%v", hostname, server, err)
+			r.emitEvent(ResolverEvent{
+				Type:     EventResolveFailure,
+				Time:     time.Now(),
+				Hostname: hostname,
+				Server:   server,
+				Error:    err.Error(),
+				Source:   "delegation_trace",
+			})
+			return nil, err
+		}
+	}
+
 	// Create DNS message
-	msg := new(dns.Msg)
-	msg.SetQuestion(dns.Fqdn(hostname), dns.TypeA)
-	msg.RecursionDesired = true
-	msg.SetEdns0(4096, true) // Enable EDNS with DNSSEC
+	msg := newQueryMsg(r.queryID(), hostname, settings.recursionDesired())
+	defer releaseQueryMsg(msg)
+	if settings.NSID {
+		requestNSID(msg)
+	}
 
 	// Increment total resolution attempts
-	metrics.DNSResolutionTotal.WithLabelValues(server, hostname).Inc()
+	series.total.Inc()
 
-	// Send query
+	// Send query, letting hooks rewrite it or answer it themselves. Queries
+	// without hooks skip the metadata map and context value.
+	info := QueryInfo{Hostname: hostname, Server: server, Msg: msg}
+	if r.hooks.registered() {
+		info.Metadata = make(map[string]string)
+		ctx = context.WithValue(ctx, queryInfoKey{}, info)
+	}
 	start := time.Now()
-	response, _, err := client.ExchangeContext(ctx, msg, server)
-	elapsed := time.Since(start)
+	response, err := r.runPreQueryHooks(ctx, info)
+	shortCircuited := response != nil
+	if err != nil {
+		elapsed := time.Since(start)
+		r.runPostQueryHooks(ctx, QueryResult{QueryInfo: info, Duration: elapsed, Err: err})
+		metrics.DNSResolutionFailure.WithLabelValues(server, r.metricHostname(hostname), "hook").Inc()
+		r.appLogf(instrumentation.Medium, "pre-query hook failed hostname=%s server=%s err=%v", hostname, server, err)
+		r.emitEvent(ResolverEvent{
+			Type:     EventResolveFailure,
+			Time:     time.Now(),
+			Hostname: hostname,
+			Server:   server,
+			Duration: elapsed,
+			Error:    err.Error(),
+			Source:   "hook",
+		})
+		return nil, fmt.Errorf("pre-query hook failed: %w", err)
+	}
+	queued := time.Since(entered)
+	var connect, network time.Duration
+	var replies [][]byte
+	if !shortCircuited {
+		response, connect, network, replies, err = r.exchangeTimed(ctx, client, msg, server)
+		if r.captures != nil && r.captures.take(hostname) {
+			r.writeCapture(hostname, server, msg, response, replies)
+		}
+	}
+	mismatched := mismatchedReplies(replies, msg.Id)
+	received := time.Now()
+	elapsed := received.Sub(start)
+	r.runPostQueryHooks(ctx, QueryResult{
+		QueryInfo:      info,
+		Response:       response,
+		Duration:       elapsed,
+		ShortCircuited: shortCircuited,
+		Err:            err,
+	})
 
+	if err != nil && parent.Err() != nil {
+		r.appLogf(instrumentation.Medium, "DNS query canceled hostname=%s server=%s", hostname, server)
+		return nil, fmt.Errorf("DNS query canceled: %w", parent.Err())
+	}
+	for _, reply := range mismatched {
+		r.recordMismatch(server, hostname, "id", reply)
+	}
+	if !shortCircuited {
+		if class, cause := classifyMalformed(msg, response, err); class != "" {
+			return nil, r.recordMalformed(server, hostname, class, response, cause, elapsed)
+		}
+	}
+	if r.slowLog != nil {
+		transport := queryTransport(client)
+		if shortCircuited {
+			transport = "hook"
+		}
+		r.logSlowQuery(slowQuery{
+			hostname:  hostname,
+			server:    server,
+			transport: transport,
+			breaker:   breakerState,
+			failures:  breakerFailures,
+			elapsed:   elapsed,
+			queue:     queued,
+			connect:   connect,
+			network:   network,
+			response:  response,
+			err:       err,
+		})
+	}
 	if err != nil {
-		r.breakers[server].RecordFailure()
-		r.stats.Stats[server].Failures++
-		r.stats.Stats[server].LastError = err.Error()
-		metrics.DNSResolutionFailure.WithLabelValues(server, hostname, "query_error").Inc()
+		// A query that only drew replies to other transactions did not
+		// simply time out.
+		errorType := "query_error"
+		if len(mismatched) > 0 {
+			errorType = "mismatched_reply"
+			err = fmt.Errorf("%w after %d replies with mismatched IDs", err, len(mismatched))
+		}
+		r.recordBreakerFailure(server, err)
+		r.stats.recordFailure(server, err.Error())
+		metrics.DNSResolutionFailure.WithLabelValues(server, r.metricHostname(hostname), errorType).Inc()
 		r.appLogf(instrumentation.Medium, "DNS query failed hostname=%s server=%s err=%v", hostname, server, err)
 		r.emitEvent(ResolverEvent{
 			Type:     EventResolveFailure,
@@ -402,22 +1010,25 @@ func (r *DNSResolver) resolveWithServer(ctx context.Context, server, hostname st
 			Server:   server,
 			Duration: elapsed,
 			Error:    err.Error(),
-			Source:   "query_error",
+			Source:   errorType,
 		})
 		return nil, fmt.Errorf("DNS query failed: %w", err)
 	}
 
 	// Record metrics
 	duration := elapsed.Seconds()
-	metrics.DNSResolutionDuration.WithLabelValues(server, hostname).Observe(duration)
-	metrics.DNSResponseSize.WithLabelValues(server, hostname).Observe(float64(response.Len()))
+	series.duration.Observe(duration)
+	series.size.Observe(float64(response.Len()))
 
 	// Process response
 	if response.Rcode != dns.RcodeSuccess {
-		r.breakers[server].RecordFailure()
-		r.stats.Stats[server].Failures++
-		r.stats.Stats[server].LastError = dns.RcodeToString[response.Rcode]
-		metrics.DNSResolutionFailure.WithLabelValues(server, hostname, dns.RcodeToString[response.Rcode]).Inc()
+		rcodeErr := fmt.Errorf("DNS query returned error code: %s", dns.RcodeToString[response.Rcode])
+		if authority := dnsanalysis.AuthoritySummary(response); authority != "" {
+			rcodeErr = fmt.Errorf("DNS query returned error code: %s (%s)", dns.RcodeToString[response.Rcode], authority)
+		}
+		r.recordBreakerFailure(server, rcodeErr)
+		r.stats.recordFailure(server, dns.RcodeToString[response.Rcode])
+		metrics.DNSResolutionFailure.WithLabelValues(server, r.metricHostname(hostname), dns.RcodeToString[response.Rcode]).Inc()
 		r.appLogf(
 			instrumentation.Medium,
 			"DNS response error hostname=%s server=%s rcode=%s",
@@ -434,27 +1045,35 @@ func (r *DNSResolver) resolveWithServer(ctx context.Context, server, hostname st
 			Error:    dns.RcodeToString[response.Rcode],
 			Source:   "rcode",
 		})
-		return nil, fmt.Errorf("DNS query returned error code: %s", dns.RcodeToString[response.Rcode])
+		if response.Rcode == dns.RcodeNameError {
+			r.cacheNegative(hostname, server, response)
+		}
+		return nil, rcodeErr
 	}
 
-	r.breakers[server].RecordSuccess()
-	r.stats.Stats[server].Total++
-	metrics.DNSResolutionSuccess.WithLabelValues(server, hostname).Inc()
-	r.appLogf(
-		instrumentation.High,
-		"DNS response ok hostname=%s server=%s duration=%s",
-		hostname,
-		server,
-		elapsed,
-	)
+	breaker.RecordSuccess()
+	r.stats.recordSuccess(server)
+	if settings.NSID {
+		r.recordNode(server, responseNSID(response), "nsid")
+	}
+	series.success.Inc()
 
-	// Create DNS response
+	// Create DNS response. A response without answers is cached for the
+	// SOA's negative TTL.
 	ttl := getMinTTL(response)
+	if len(response.Answer) == 0 {
+		ttl = dnsanalysis.NegativeTTL(response)
+	}
 	dnsResponse := &dnsanalysis.DNSResponse{
-		Server:    server,
-		Hostname:  hostname,
-		Addresses: make([]string, 0),
-		TTL:       ttl,
+		Server:         server,
+		Hostname:       hostname,
+		Addresses:      make([]string, 0, len(response.Answer)),
+		Response:       response,
+		TTL:            ttl,
+		Duration:       elapsed,
+		QueueTime:      queued,
+		ConnectTime:    connect,
+		NetworkLatency: network,
 	}
 
 	// Extract IP addresses
@@ -463,9 +1082,45 @@ func (r *DNSResolver) resolveWithServer(ctx context.Context, server, hostname st
 			dnsResponse.Addresses = append(dnsResponse.Addresses, a.A.String())
 		}
 	}
+	dnsanalysis.CaptureSections(dnsResponse, response)
+	dnsResponse.ProcessingTime = time.Since(received)
+	series.observeLatencyBreakdown(dnsResponse)
+	r.detectLatencyAnomaly(server, hostname, elapsed)
+	r.scoreLatency(server, elapsed)
+	if r.appLogEnabled(instrumentation.High) {
+		r.appLogf(
+			instrumentation.High,
+			"DNS response ok hostname=%s server=%s duration=%s queue=%s connect=%s network=%s processing=%s",
+			hostname,
+			server,
+			elapsed,
+			dnsResponse.QueueTime,
+			dnsResponse.ConnectTime,
+			dnsResponse.NetworkLatency,
+			dnsResponse.ProcessingTime,
+		)
+	}
+	if config.dns64Enabled() && r.dns64 != nil {
+		r.collectAAAA(ctx, client, server, hostname, settings.recursionDesired(), dnsResponse)
+	}
 
-	// Cache the response
-	r.cache.Set(hostname, dnsResponse, time.Duration(ttl)*time.Second)
+	// Cache the response. A zero TTL would expire at once but occupy the
+	// cache until the next sweep.
+	switch policy {
+	case CachePolicyNormal:
+		if cacheTTL := config.cacheTTL(hostname, ttl); cacheTTL > 0 {
+			r.cache.Set(cacheKey(server, hostname), dnsResponse, cacheTTL)
+		}
+	case CachePolicyNegativeOnly:
+		if len(dnsResponse.Addresses) == 0 {
+			r.cacheNegative(hostname, server, response)
+		}
+	}
+
+	source := "query"
+	if shortCircuited {
+		source = "hook"
+	}
 
 	r.emitEvent(ResolverEvent{
 		Type:      EventResolveSuccess,
@@ -474,12 +1129,65 @@ func (r *DNSResolver) resolveWithServer(ctx context.Context, server, hostname st
 		Server:    server,
 		Duration:  elapsed,
 		Addresses: append([]string(nil), dnsResponse.Addresses...),
-		Source:    "query",
+		Geo:       r.lookupGeo(dnsResponse.Addresses),
+		Source:    source,
 	})
 
 	return dnsResponse, nil
 }
 
+// Lookup resolves hostname for library use: primaries are tried in the order
+// the selection policy picks, then fallbacks, and the first successful answer
+// is returned.
+func (r *DNSResolver) Lookup(ctx context.Context, hostname string) (*dnsanalysis.DNSResponse, error) {
+	config := r.currentConfig()
+	var fallingBack sync.Once
+	answer, _, err := r.queryHedged(ctx, r.selectServers(), config.Querying.HedgeDelay.Duration, func(ctx context.Context, server string) (any, error) {
+		if config.Role(server) == ServerRoleFallback {
+			fallingBack.Do(func() {
+				metrics.DNSResolutionFallbacks.WithLabelValues(r.metricHostname(hostname)).Inc()
+				r.appLogf(instrumentation.Medium, "querying fallbacks hostname=%s", hostname)
+			})
+		}
+		response, err := r.resolveWithServerFunc(ctx, server, hostname)
+		if err != nil && ctx.Err() != nil {
+			// Canceled; the server is not at fault.
+			return nil, err
+		}
+		r.recordRoleResult(server, err)
+		return response, err
+	})
+	switch {
+	case err == nil:
+		return answer.(*dnsanalysis.DNSResponse), nil
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case errors.Is(err, errNoServers):
+		return nil, err
+	}
+	return nil, fmt.Errorf("all DNS servers failed for %s: %w", hostname, err)
+}
+
+// Resolve is Lookup returning the full answer: every record in typed form,
+// the header flags, rcode, size, transport, timings and DNSSEC validation
+// status.
+func (r *DNSResolver) Resolve(ctx context.Context, hostname string) (*dnsanalysis.Result, error) {
+	response, err := r.Lookup(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	return response.Result(), nil
+}
+
+// recordRoleResult counts a query outcome against the server's role.
+func (r *DNSResolver) recordRoleResult(server string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metrics.DNSServerRoleQueries.WithLabelValues(server, r.currentConfig().Role(server), result).Inc()
+}
+
 // getMinTTL returns the minimum TTL from a DNS response
 func getMinTTL(msg *dns.Msg) uint32 {
 	if len(msg.Answer) == 0 {
@@ -496,6 +1204,21 @@ func getMinTTL(msg *dns.Msg) uint32 {
 }
 
 // Helper functions
+
+// sleepContext waits for d and reports whether ctx is still live afterwards.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 func boolToFloat64(b bool) float64 {
 	if b {
 		return 1
@@ -504,13 +1227,28 @@ func boolToFloat64(b bool) float64 {
 }
 
 func (r *DNSResolver) appLogf(level instrumentation.Level, format string, args ...any) {
-	if r.appLog == nil || r.instrumentationLevel < level {
+	if !r.appLogEnabled(level) {
 		return
 	}
 	r.appLog.Printf(format, args...)
 }
 
+// appLogEnabled reports whether appLogf writes at level. Hot paths check it
+// first so disabled messages do not allocate their arguments.
+func (r *DNSResolver) appLogEnabled(level instrumentation.Level) bool {
+	return r.appLog != nil && r.instrumentationLevel >= level
+}
+
 func (r *DNSResolver) emitEvent(event ResolverEvent) {
+	if event.Labels == nil && event.Hostname != "" {
+		event.Labels = r.HostnameLabels(event.Hostname)
+	}
+	if r.history != nil {
+		r.history.add(event)
+	}
+	if r.incidents != nil && event.Hostname != "" && event.Type != EventResolveSuccess {
+		r.incidents.observe(event)
+	}
 	if r.events == nil {
 		return
 	}
@@ -523,3 +1261,75 @@ func (r *DNSResolver) outputf(format string, args ...any) {
 	}
 	fmt.Fprintf(r.output, format, args...)
 }
+
+// exchangeTimed sends msg to server and returns the connection setup and
+// query round-trip times, along with every UDP reply read, including those
+// dropped for carrying another transaction ID. Clients that cannot dial
+// separately report the whole exchange as round trip. With socket reuse, the
+// query goes over an idle connected socket when there is one, and the socket
+// is kept for reuse if the exchange succeeds.
+func (r *DNSResolver) exchangeTimed(ctx context.Context, client dnsClient, msg *dns.Msg, server string) (*dns.Msg, time.Duration, time.Duration, [][]byte, error) {
+	dialer, ok := client.(connExchanger)
+	if !ok {
+		start := time.Now()
+		response, _, err := client.ExchangeContext(ctx, msg, server)
+		return response, 0, time.Since(start), nil, err
+	}
+
+	start := time.Now()
+	sockets := r.socketPool()
+	var conn *dns.Conn
+	if sockets != nil {
+		conn = sockets.GetConn(server)
+	}
+	if conn == nil {
+		var err error
+		conn, err = r.dialQuery(ctx, dialer, server)
+		if err != nil {
+			return nil, time.Since(start), 0, nil, err
+		}
+	}
+	connect := time.Since(start)
+	recorder := recordReplies(conn)
+
+	// The exchange only applies ctx's deadline to the socket, so close it
+	// when ctx is canceled to end a read that would otherwise wait it out.
+	stop := context.AfterFunc(ctx, func() { recorder.Conn.Close() })
+	start = time.Now()
+	response, _, err := dialer.ExchangeWithConnContext(ctx, msg, conn)
+	network := time.Since(start)
+	closed := !stop()
+	if closed && err != nil {
+		err = ctx.Err()
+	}
+	conn.Conn = recorder.Conn
+	if sockets != nil && err == nil && !closed {
+		sockets.PutConn(server, conn)
+	} else {
+		conn.Close()
+	}
+	return response, connect, network, recorder.replies, err
+}
+
+// socketPool returns the pool to reuse sockets from, or nil when
+// querying.reuse_sockets is off.
+func (r *DNSResolver) socketPool() *dnspool.ClientPool {
+	config := r.currentConfig()
+	if r.clientPool == nil || config == nil || !config.Querying.ReuseSockets {
+		return nil
+	}
+	return r.clientPool
+}
+
+// observeLatencyBreakdown records each phase of response's query.
+func (s *queryMetricSet) observeLatencyBreakdown(response *dnsanalysis.DNSResponse) {
+	durations := [len(latencyPhases)]time.Duration{
+		response.QueueTime,
+		response.ConnectTime,
+		response.NetworkLatency,
+		response.ProcessingTime,
+	}
+	for i, duration := range durations {
+		s.phases[i].Observe(duration.Seconds())
+	}
+}
@@ -0,0 +1,437 @@
+package dnsres
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"dnsres/dnsanalysis"
+	"dnsres/instrumentation"
+	"dnsres/internal/kafka"
+	"dnsres/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// Result sink formats.
+const (
+	ResultFormatJSON = "json"
+	ResultFormatAvro = "avro"
+)
+
+const (
+	defaultKafkaBatchSize     = 100
+	defaultKafkaBatchInterval = time.Second
+	defaultKafkaMaxRetries    = 3
+	defaultKafkaBufferSize    = 10000
+	// kafkaFlushTimeout bounds each batch, retries included.
+	kafkaFlushTimeout = time.Minute
+)
+
+// resultAvroSchema describes ResolutionResult for the schema registry.
+const resultAvroSchema = `{"type":"record","name":"ResolutionResult","namespace":"dnsres","fields":[` +
+	`{"name":"time","type":{"type":"long","logicalType":"timestamp-millis"}},` +
+	`{"name":"hostname","type":"string"},` +
+	`{"name":"server","type":"string"},` +
+	`{"name":"success","type":"boolean"},` +
+	`{"name":"addresses","type":{"type":"array","items":"string"}},` +
+	`{"name":"ttl","type":"long"},` +
+	`{"name":"rcode","type":"string"},` +
+	`{"name":"duration_ms","type":"double"},` +
+	`{"name":"protocol","type":"string"},` +
+	`{"name":"consistent","type":"boolean"},` +
+	`{"name":"error","type":["null","string"],"default":null}]}`
+
+// KafkaConfig configures writing every resolution result to a Kafka topic.
+// Results are written only when Brokers is set.
+type KafkaConfig struct {
+	// Brokers are bootstrap host:port addresses.
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+	// Format is "json" (default) or "avro". Avro records use the schema
+	// registry wire format, so SchemaRegistryURL is required.
+	Format             string `json:"format"`
+	SchemaRegistryURL  string `json:"schema_registry_url,omitempty"`
+	ClientID           string `json:"client_id,omitempty"`
+	Acks               string `json:"acks"`
+	TLS                bool   `json:"tls"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	// Results are written in batches of up to BatchSize, at least every
+	// BatchInterval.
+	BatchSize     int      `json:"batch_size"`
+	BatchInterval Duration `json:"batch_interval"`
+	MaxRetries    int      `json:"max_retries"`
+	// BufferSize is how many results wait for Kafka. When the buffer is full
+	// new results are dropped, or with BlockWhenFull, resolution waits.
+	BufferSize    int  `json:"buffer_size"`
+	BlockWhenFull bool `json:"block_when_full"`
+}
+
+func (c KafkaConfig) format() string {
+	if c.Format == "" {
+		return ResultFormatJSON
+	}
+	return c.Format
+}
+
+func (c KafkaConfig) batchSize() int {
+	if c.BatchSize <= 0 {
+		return defaultKafkaBatchSize
+	}
+	return c.BatchSize
+}
+
+func (c KafkaConfig) batchInterval() time.Duration {
+	if c.BatchInterval.Duration <= 0 {
+		return defaultKafkaBatchInterval
+	}
+	return c.BatchInterval.Duration
+}
+
+func (c KafkaConfig) bufferSize() int {
+	if c.BufferSize <= 0 {
+		return defaultKafkaBufferSize
+	}
+	return c.BufferSize
+}
+
+func (c KafkaConfig) producerConfig() kafka.Config {
+	config := kafka.Config{
+		Brokers:    c.Brokers,
+		ClientID:   c.ClientID,
+		MaxRetries: c.MaxRetries,
+	}
+	if config.ClientID == "" {
+		config.ClientID = "dnsres"
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = defaultKafkaMaxRetries
+	}
+	if c.Acks == "leader" {
+		config.RequiredAcks = kafka.AcksLeader
+	}
+	if c.TLS {
+		config.TLS = &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	}
+	return config
+}
+
+func validateKafka(c *Config) error {
+	k := c.Kafka
+	if len(k.Brokers) == 0 {
+		return nil
+	}
+	var problems configProblems
+	for i, broker := range k.Brokers {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			problems.add(elementPath("kafka.brokers", i), fmt.Errorf("invalid kafka broker %q: %w", broker, err))
+		}
+	}
+	problems.check(k.Topic != "", "kafka.topic", "must be set")
+	switch k.format() {
+	case ResultFormatJSON:
+	case ResultFormatAvro:
+		u, err := url.Parse(k.SchemaRegistryURL)
+		problems.check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "kafka.schema_registry_url", "must be an http(s) URL for the avro format")
+	default:
+		problems.add("kafka.format", fmt.Errorf("invalid kafka format %q: must be %q or %q", k.Format, ResultFormatJSON, ResultFormatAvro))
+	}
+	problems.check(k.Acks == "" || k.Acks == "all" || k.Acks == "leader", "kafka.acks", fmt.Sprintf("invalid kafka acks %q: must be \"all\" or \"leader\"", k.Acks))
+	problems.check(k.BatchSize >= 0, "kafka.batch_size", "must not be negative")
+	problems.check(k.BatchInterval.Duration >= 0, "kafka.batch_interval", "must not be negative")
+	problems.check(k.MaxRetries >= 0, "kafka.max_retries", "must not be negative")
+	problems.check(k.BufferSize >= 0, "kafka.buffer_size", "must not be negative")
+	return problems.err()
+}
+
+// ResolutionResult is one server's answer, or failure, for one hostname, as
+// written to Kafka and the results file.
+type ResolutionResult struct {
+	Time       time.Time `json:"time"`
+	Hostname   string    `json:"hostname"`
+	Server     string    `json:"server"`
+	Success    bool      `json:"success"`
+	Addresses  []string  `json:"addresses"`
+	TTL        uint32    `json:"ttl"`
+	Rcode      string    `json:"rcode"`
+	DurationMS float64   `json:"duration_ms"`
+	Protocol   string    `json:"protocol"`
+	// Consistent is whether all servers answered the hostname alike.
+	Consistent bool   `json:"consistent"`
+	Error      string `json:"error,omitempty"`
+	// Flags are the response's header flags as dig prints them, plus "do"
+	// when the DNSSEC OK bit is set. They are not in the Avro schema.
+	Flags []string `json:"flags,omitempty"`
+	// Result is the full answer of a successful query, with every record
+	// and the response's wire fields. It is not in the Avro schema.
+	Result *dnsanalysis.Result `json:"result,omitempty"`
+}
+
+// resultProducer is the part of kafka.Producer the sink uses.
+type resultProducer interface {
+	Produce(ctx context.Context, topic string, messages []kafka.Message) error
+	Close() error
+}
+
+// resultSink buffers resolution results and writes them to Kafka in
+// batches.
+type resultSink struct {
+	config   KafkaConfig
+	records  chan ResolutionResult
+	producer resultProducer
+	// schemaID is the registry ID of resultAvroSchema, once registered.
+	schemaID int32
+	client   *http.Client
+}
+
+func newResultSink(config *Config) (*resultSink, error) {
+	if len(config.Kafka.Brokers) == 0 {
+		return nil, nil
+	}
+	producer, err := kafka.NewProducer(config.Kafka.producerConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &resultSink{
+		config:   config.Kafka,
+		records:  make(chan ResolutionResult, config.Kafka.bufferSize()),
+		producer: producer,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// recordResults writes the outcome of each server's query for hostname to
+// the results file and queues it for Kafka.
+func (r *DNSResolver) recordResults(ctx context.Context, hostname string, responses []*dnsanalysis.DNSResponse, failures map[string]string, consistent bool) {
+	if r.results == nil && r.resultsFile == nil {
+		return
+	}
+	now := time.Now()
+	results := make([]ResolutionResult, 0, len(responses)+len(failures))
+	for _, response := range responses {
+		result := ResolutionResult{
+			Time:       now,
+			Hostname:   hostname,
+			Server:     response.Server,
+			Success:    true,
+			Addresses:  append([]string{}, response.Addresses...),
+			TTL:        response.TTL,
+			Rcode:      dns.RcodeToString[dns.RcodeSuccess],
+			DurationMS: float64(response.Duration) / float64(time.Millisecond),
+			Protocol:   response.Protocol,
+			Consistent: consistent,
+			Result:     response.Result(),
+		}
+		if response.Response != nil {
+			result.Rcode = dns.RcodeToString[response.Response.Rcode]
+			result.Flags = dnsanalysis.Flags(response.Response)
+		}
+		results = append(results, result)
+	}
+	servers := make([]string, 0, len(failures))
+	for server := range failures {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		results = append(results, ResolutionResult{
+			Time:       now,
+			Hostname:   hostname,
+			Server:     server,
+			Addresses:  []string{},
+			Consistent: consistent,
+			Error:      failures[server],
+		})
+	}
+
+	if r.resultsFile != nil {
+		r.writeResultLines(results)
+	}
+	if r.results == nil {
+		return
+	}
+	for _, result := range results {
+		if r.results.config.BlockWhenFull {
+			select {
+			case r.results.records <- result:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		select {
+		case r.results.records <- result:
+		default:
+			metrics.DNSResKafkaRecords.WithLabelValues("dropped").Inc()
+			r.appLogf(instrumentation.Medium, "kafka buffer full, result dropped hostname=%s server=%s", hostname, result.Server)
+		}
+	}
+}
+
+// runResultSink writes queued results to Kafka until ctx is canceled, then
+// flushes what is left.
+func (r *DNSResolver) runResultSink(ctx context.Context) {
+	sink := r.results
+	defer sink.producer.Close()
+	ticker := time.NewTicker(sink.config.batchInterval())
+	defer ticker.Stop()
+
+	batch := make([]ResolutionResult, 0, sink.config.batchSize())
+	flush := func(ctx context.Context) {
+		if len(batch) > 0 {
+			r.writeResults(ctx, batch)
+			batch = batch[:0]
+		}
+		metrics.DNSResKafkaBuffered.Set(float64(len(sink.records)))
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			for {
+				select {
+				case result := <-sink.records:
+					batch = append(batch, result)
+					if len(batch) >= sink.config.batchSize() {
+						flush(shutdownCtx)
+					}
+				default:
+					flush(shutdownCtx)
+					return
+				}
+			}
+		case result := <-sink.records:
+			batch = append(batch, result)
+			if len(batch) >= sink.config.batchSize() {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		}
+	}
+}
+
+// writeResults encodes and produces one batch. Results that cannot be
+// written after the producer's retries are counted as failed and dropped.
+func (r *DNSResolver) writeResults(ctx context.Context, batch []ResolutionResult) {
+	sink := r.results
+	ctx, cancel := context.WithTimeout(ctx, kafkaFlushTimeout)
+	defer cancel()
+
+	messages := make([]kafka.Message, 0, len(batch))
+	var err error
+	for _, result := range batch {
+		var value []byte
+		if value, err = sink.encode(ctx, result); err != nil {
+			break
+		}
+		messages = append(messages, kafka.Message{Key: []byte(result.Hostname), Value: value, Time: result.Time})
+	}
+	if err == nil {
+		err = sink.producer.Produce(ctx, sink.config.Topic, messages)
+	}
+	if err != nil {
+		metrics.DNSResKafkaRecords.WithLabelValues("failed").Add(float64(len(batch)))
+		r.errorLog.Printf("Writing %d results to kafka topic %s failed: %v", len(batch), sink.config.Topic, err)
+		return
+	}
+	metrics.DNSResKafkaRecords.WithLabelValues("written").Add(float64(len(batch)))
+	r.appLogf(instrumentation.Medium, "kafka results written topic=%s records=%d", sink.config.Topic, len(batch))
+}
+
+// encode renders result in the configured format.
+func (s *resultSink) encode(ctx context.Context, result ResolutionResult) ([]byte, error) {
+	if s.config.format() != ResultFormatAvro {
+		return json.Marshal(result)
+	}
+	if s.schemaID == 0 {
+		id, err := s.registerSchema(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.schemaID = id
+	}
+	// Schema registry wire format: magic byte, schema ID, Avro binary.
+	value := []byte{0}
+	value = binary.BigEndian.AppendUint32(value, uint32(s.schemaID))
+	return appendResultAvro(value, result), nil
+}
+
+// registerSchema registers resultAvroSchema under the topic's value subject
+// and returns its ID. Registering an existing schema returns its ID again.
+func (s *resultSink) registerSchema(ctx context.Context) (int32, error) {
+	body, err := json.Marshal(map[string]string{"schema": resultAvroSchema})
+	if err != nil {
+		return 0, err
+	}
+	endpoint := strings.TrimSuffix(s.config.SchemaRegistryURL, "/") + "/subjects/" + url.PathEscape(s.config.Topic+"-value") + "/versions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("schema registration failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("schema registration failed: %s", resp.Status)
+	}
+	var registered struct {
+		ID int32 `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&registered); err != nil {
+		return 0, fmt.Errorf("schema registration failed: %w", err)
+	}
+	return registered.ID, nil
+}
+
+// appendResultAvro appends result's Avro binary encoding under
+// resultAvroSchema.
+func appendResultAvro(b []byte, result ResolutionResult) []byte {
+	b = binary.AppendVarint(b, result.Time.UnixMilli())
+	b = appendAvroString(b, result.Hostname)
+	b = appendAvroString(b, result.Server)
+	b = appendAvroBool(b, result.Success)
+	if len(result.Addresses) > 0 {
+		b = binary.AppendVarint(b, int64(len(result.Addresses)))
+		for _, address := range result.Addresses {
+			b = appendAvroString(b, address)
+		}
+	}
+	b = binary.AppendVarint(b, 0) // End of the addresses array
+	b = binary.AppendVarint(b, int64(result.TTL))
+	b = appendAvroString(b, result.Rcode)
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(result.DurationMS))
+	b = appendAvroString(b, result.Protocol)
+	b = appendAvroBool(b, result.Consistent)
+	if result.Error == "" {
+		return binary.AppendVarint(b, 0) // The union's null branch
+	}
+	b = binary.AppendVarint(b, 1)
+	return appendAvroString(b, result.Error)
+}
+
+func appendAvroString(b []byte, s string) []byte {
+	b = binary.AppendVarint(b, int64(len(s)))
+	return append(b, s...)
+}
+
+func appendAvroBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
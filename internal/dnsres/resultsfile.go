@@ -0,0 +1,69 @@
+package dnsres
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+)
+
+// ResultsFileStdout is the results file path that writes to standard output.
+const ResultsFileStdout = "-"
+
+// ResultsFileConfig configures writing every resolution result as one JSON
+// line, apart from the logs, for offline analysis. Results are written only
+// when Path is set.
+type ResultsFileConfig struct {
+	// Path is the file results are appended to, relative to the log
+	// directory, or "-" for standard output.
+	Path string `json:"path"`
+	// Rotation applies to files; standard output is never rotated.
+	Rotation LogRotation `json:"rotation"`
+}
+
+// resultsFile writes resolution results as JSON lines.
+type resultsFile struct {
+	path string
+	out  io.Writer
+}
+
+func openResultsFile(config *Config, logDir string) (*resultsFile, error) {
+	path := config.ResultsFile.Path
+	switch path {
+	case "":
+		return nil, nil
+	case ResultsFileStdout:
+		return &resultsFile{path: path, out: os.Stdout}, nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(logDir, path)
+	}
+	file, err := openRotatingFile(path, "results", config.ResultsFile.Rotation)
+	if err != nil {
+		return nil, err
+	}
+	return &resultsFile{path: path, out: file}, nil
+}
+
+// writeResultLines appends one JSON line per result. A hostname's results
+// are written at once, so they stay together in the file.
+func (r *DNSResolver) writeResultLines(results []ResolutionResult) {
+	var lines []byte
+	for _, result := range results {
+		line, err := json.Marshal(result)
+		if err != nil {
+			continue
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	if _, err := r.resultsFile.out.Write(lines); err != nil {
+		metrics.DNSResResultsFileRecords.WithLabelValues("failed").Add(float64(len(results)))
+		r.errorLog.Printf("Writing %d results to %s failed: %v", len(results), r.resultsFile.path, err)
+		return
+	}
+	metrics.DNSResResultsFileRecords.WithLabelValues("written").Add(float64(len(results)))
+	r.appLogf(instrumentation.High, "results written path=%s records=%d", r.resultsFile.path, len(results))
+}
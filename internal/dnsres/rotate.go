@@ -0,0 +1,195 @@
+package dnsres
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dnsres/metrics"
+)
+
+// rotationTimeFormat is appended to rotated file names; it sorts
+// lexically in creation order.
+const rotationTimeFormat = "20060102T150405.000"
+
+// rotatingFile is an append-only log file that rotates on size or age,
+// keeps a bounded number of backups, and optionally gzips them.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	stream   string
+	rotation LogRotation
+	file     *os.File
+	size     int64
+	opened   time.Time
+	now      func() time.Time
+	// logf reports rotation steps that failed without stopping writes.
+	logf func(format string, args ...any)
+}
+
+func openRotatingFile(path, stream string, rotation LogRotation) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, stream: stream, rotation: rotation, now: time.Now, logf: log.Printf}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = f.now()
+	metrics.DNSResLogFileBytes.WithLabelValues(f.stream).Set(float64(f.size))
+	return nil
+}
+
+// Write appends p, rotating first when it would exceed the size limit or
+// the current file is older than the age limit. The active file is reopened
+// on the next write when reopening it after a rotation failed.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.shouldRotate(int64(len(p))) {
+		f.rotate()
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, fmt.Errorf("failed to reopen %s: %w", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	metrics.DNSResLogFileBytes.WithLabelValues(f.stream).Set(float64(f.size))
+	return n, err
+}
+
+func (f *rotatingFile) shouldRotate(incoming int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if limit := f.rotation.maxBytes(); limit > 0 && f.size+incoming > limit {
+		return true
+	}
+	if f.rotation.MaxAge.Duration > 0 && f.now().Sub(f.opened) >= f.rotation.MaxAge.Duration {
+		return true
+	}
+	return false
+}
+
+// rotate closes the active file and moves it aside, then compresses and
+// prunes the backups. Each step is best effort: a failure is logged and
+// Write reopens the active file regardless, so a full disk or a bad backup
+// does not stop logging.
+func (f *rotatingFile) rotate() {
+	if err := f.file.Close(); err != nil {
+		f.logf("dnsres: failed to close %s for rotation: %v", f.path, err)
+	}
+	f.file = nil
+	rotated := f.path + "." + f.now().Format(rotationTimeFormat)
+	if err := os.Rename(f.path, rotated); err != nil {
+		f.logf("dnsres: failed to rotate %s: %v", f.path, err)
+		return
+	}
+	if f.rotation.Compress {
+		if err := gzipFile(rotated); err != nil {
+			f.logf("dnsres: failed to compress %s: %v", rotated, err)
+		}
+	}
+	if err := f.prune(); err != nil {
+		f.logf("dnsres: failed to prune backups of %s: %v", f.path, err)
+	}
+}
+
+// prune removes the oldest backups beyond the retention count.
+func (f *rotatingFile) prune() error {
+	if f.rotation.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := f.backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > f.rotation.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// backups lists rotated files for this log, oldest first.
+func (f *rotatingFile) backups() ([]string, error) {
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	backups := matches[:0]
+	for _, match := range matches {
+		if !strings.HasSuffix(match, ".tmp") {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// gzipFile compresses path to path.gz and removes the original.
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(dst)
+	if _, err := io.Copy(writer, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,117 @@
+package dnsres
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+)
+
+// SamplingConfig spreads the hostnames of large fleets over several cycles
+// to reduce the load on the servers. Each cycle resolves a random sample of
+// Fraction of the hostnames, and every hostname is resolved once per round
+// of ceil(1/Fraction) cycles. Sampling is off when Fraction is 0 or 1.
+type SamplingConfig struct {
+	Fraction float64 `json:"fraction"`
+}
+
+// cycles returns the number of cycles in a sampling round.
+func (s SamplingConfig) cycles() int {
+	return int(math.Ceil(1 / s.Fraction))
+}
+
+func validateSampling(c *Config) error {
+	var problems configProblems
+	problems.check(c.Sampling.Fraction >= 0 && c.Sampling.Fraction <= 1, "sampling.fraction", "must be between 0 and 1")
+	return problems.err()
+}
+
+// sampler picks each cycle's hostnames. A round starts with the hostnames in
+// random order and each cycle takes its share of those still pending, so a
+// round covers every hostname however the list changes during it.
+type sampler struct {
+	mu     sync.Mutex
+	cycles int
+	// cycle counts the cycles of the current round so far.
+	cycle   int
+	pending []string
+	// planned holds the hostnames of the current round, resolved or not.
+	planned map[string]bool
+}
+
+func newSampler(config *Config) *sampler {
+	if config.Sampling.Fraction <= 0 || config.Sampling.Fraction >= 1 {
+		return nil
+	}
+	return &sampler{cycles: config.Sampling.cycles()}
+}
+
+// next returns the sample of hostnames to resolve this cycle, the fraction
+// of hostnames resolved so far in the round, this sample included, and
+// whether this cycle ends the round.
+func (s *sampler) next(hostnames []string) ([]string, float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cycle == 0 {
+		s.pending = append(s.pending[:0], hostnames...)
+		rand.Shuffle(len(s.pending), func(i, j int) {
+			s.pending[i], s.pending[j] = s.pending[j], s.pending[i]
+		})
+		s.planned = make(map[string]bool, len(hostnames))
+		for _, hostname := range hostnames {
+			s.planned[hostname] = true
+		}
+	}
+
+	// Hostnames added during the round are still covered by it; removed ones
+	// are dropped.
+	current := make(map[string]bool, len(hostnames))
+	for _, hostname := range hostnames {
+		current[hostname] = true
+		if !s.planned[hostname] {
+			s.planned[hostname] = true
+			s.pending = append(s.pending, hostname)
+		}
+	}
+	pending := s.pending[:0]
+	for _, hostname := range s.pending {
+		if current[hostname] {
+			pending = append(pending, hostname)
+		}
+	}
+	s.pending = pending
+
+	remaining := s.cycles - s.cycle
+	take := (len(s.pending) + remaining - 1) / remaining
+	sample := append([]string(nil), s.pending[:take]...)
+	s.pending = s.pending[take:]
+
+	coverage := 1.0
+	if len(hostnames) > 0 {
+		coverage = float64(len(hostnames)-len(s.pending)) / float64(len(hostnames))
+	}
+	s.cycle++
+	if s.cycle < s.cycles {
+		return sample, coverage, false
+	}
+	s.cycle = 0
+	return sample, coverage, true
+}
+
+// sampleHostnames returns the hostnames to resolve this cycle: all of them,
+// or a sample when sampling is on.
+func (r *DNSResolver) sampleHostnames(hostnames []string) []string {
+	if r.sampling == nil {
+		return hostnames
+	}
+	sample, coverage, roundDone := r.sampling.next(hostnames)
+	metrics.DNSResSampledHostnames.Set(float64(len(sample)))
+	metrics.DNSResSamplingCoverage.Set(coverage)
+	if roundDone {
+		metrics.DNSResSamplingRounds.Inc()
+	}
+	r.appLogf(instrumentation.Medium, "sampling hostnames=%d of=%d coverage=%.2f", len(sample), len(hostnames), coverage)
+	return sample
+}
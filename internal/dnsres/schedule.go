@@ -0,0 +1,151 @@
+package dnsres
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/internal/cron"
+	"dnsres/metrics"
+)
+
+// compileSchedules parses the per-hostname cron schedules.
+func compileSchedules(c *Config) (map[string]*cron.Schedule, error) {
+	if len(c.Schedules) == 0 {
+		return nil, nil
+	}
+	schedules := make(map[string]*cron.Schedule, len(c.Schedules))
+	for hostname, expr := range c.Schedules {
+		schedule, err := cron.Parse(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule for %s %q: %w", hostname, expr, err)
+		}
+		schedules[hostname] = schedule
+	}
+	return schedules, nil
+}
+
+func validateSchedules(c *Config) error {
+	var problems configProblems
+	for _, hostname := range slices.Sorted(maps.Keys(c.Schedules)) {
+		path := elementPath("schedules", hostname)
+		problems.check(slices.Contains(c.Hostnames, hostname), path, "is not in hostnames")
+		if _, err := cron.Parse(c.Schedules[hostname]); err != nil {
+			problems.add(path, fmt.Errorf("invalid schedule %q: %w", c.Schedules[hostname], err))
+		}
+	}
+	return problems.err()
+}
+
+// intervalHostnames returns the monitored hostnames resolved every
+// query_interval, leaving out those with their own schedule.
+func (r *DNSResolver) intervalHostnames() []string {
+	hostnames := r.monitoredHostnames()
+	if len(r.schedules) == 0 {
+		return hostnames
+	}
+	filtered := make([]string, 0, len(hostnames))
+	for _, hostname := range hostnames {
+		if _, ok := r.schedules[hostname]; !ok {
+			filtered = append(filtered, hostname)
+		}
+	}
+	return filtered
+}
+
+// runSchedules resolves each scheduled hostname whenever its cron schedule
+// fires, until ctx is canceled. Firings missed while a run was still in
+// progress are skipped.
+func (r *DNSResolver) runSchedules(ctx context.Context) {
+	next := make(map[string]time.Time, len(r.schedules))
+	now := time.Now()
+	for hostname, schedule := range r.schedules {
+		r.scheduleNext(next, hostname, schedule, now)
+	}
+
+	for len(next) > 0 {
+		var due time.Time
+		for _, at := range next {
+			if due.IsZero() || at.Before(due) {
+				due = at
+			}
+		}
+		timer := time.NewTimer(time.Until(due))
+		var tick time.Time
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case tick = <-timer.C:
+		}
+
+		var hostnames []string
+		for hostname, at := range next {
+			if !at.After(tick) {
+				hostnames = append(hostnames, hostname)
+			}
+		}
+		slices.Sort(hostnames)
+		r.resolveScheduled(ctx, tick, hostnames)
+
+		now := time.Now()
+		for _, hostname := range hostnames {
+			if missed := missedFirings(r.schedules[hostname], tick, now); missed > 0 {
+				metrics.DNSResSchedulerDropped.WithLabelValues(tierScheduled, "firing_skipped").Add(float64(missed))
+			}
+			r.scheduleNext(next, hostname, r.schedules[hostname], now)
+		}
+	}
+}
+
+// scheduleNext records when hostname next fires after now, dropping it when
+// its schedule never fires again.
+func (r *DNSResolver) scheduleNext(next map[string]time.Time, hostname string, schedule *cron.Schedule, now time.Time) {
+	at := schedule.Next(now)
+	if at.IsZero() {
+		delete(next, hostname)
+		r.appLogf(instrumentation.Low, "schedule has no future runs hostname=%s schedule=%q", hostname, schedule)
+		return
+	}
+	next[hostname] = at
+}
+
+// resolveScheduled resolves hostnames whose schedules fired at tick.
+func (r *DNSResolver) resolveScheduled(ctx context.Context, tick time.Time, hostnames []string) {
+	start := time.Now()
+	metrics.DNSResSchedulerLag.Observe(start.Sub(tick).Seconds())
+	r.appLogf(instrumentation.Low, "scheduled resolution start hostnames=%d", len(hostnames))
+
+	var wg sync.WaitGroup
+	var resolved atomic.Int64
+	sem := make(chan struct{}, 10) // Limit concurrent resolutions, as in resolveAll
+	queueWork(tierScheduled, len(hostnames))
+	for _, hostname := range hostnames {
+		wg.Add(1)
+		go func(h string) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				startWork(tierScheduled, tick)
+			case <-ctx.Done():
+				dropWork(tierScheduled, "")
+				return
+			}
+			defer func() { <-sem }()
+
+			if len(r.resolveHostname(ctx, h)) > 0 {
+				resolved.Add(1)
+			}
+		}(hostname)
+	}
+	wg.Wait()
+	if resolved.Load() > 0 && r.health != nil {
+		r.health.MarkReady()
+	}
+	r.appLogf(instrumentation.Low, "scheduled resolution complete hostnames=%d duration=%s", len(hostnames), time.Since(start))
+}
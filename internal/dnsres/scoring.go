@@ -0,0 +1,243 @@
+package dnsres
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"dnsres/circuitbreaker"
+	"dnsres/dnsanalysis"
+	"dnsres/metrics"
+)
+
+const (
+	// scoreWindow is how many recent queries, latencies and answers each
+	// part of a server's score is computed from.
+	scoreWindow = 100
+	// scoreBreakerWindow is how far back breaker openings count against a
+	// server.
+	scoreBreakerWindow = time.Hour
+)
+
+// Weights of the parts of a server's score, which add up to 100.
+const (
+	scoreWeightAvailability = 40
+	scoreWeightLatency      = 30
+	scoreWeightAgreement    = 20
+	scoreWeightBreaker      = 10
+)
+
+// ServerScore is a server's composite health score and the parts it is
+// computed from. Parts without data yet count as perfect.
+type ServerScore struct {
+	Server string `json:"server"`
+	// Rank is the server's place by score, 1 being the best.
+	Rank int `json:"rank"`
+	// Score ranges from 0 to 100.
+	Score float64 `json:"score"`
+	// Availability is the share of recent queries that succeeded.
+	Availability float64 `json:"availability"`
+	// LatencyP95Ms is the 95th percentile latency of recent answers from the
+	// server itself, not the cache.
+	LatencyP95Ms float64 `json:"latency_p95_ms"`
+	// Agreement is the share of recent answers that matched the majority.
+	Agreement float64 `json:"agreement"`
+	// BreakerOpens counts the breaker openings in the last hour.
+	BreakerOpens int  `json:"breaker_opens"`
+	BreakerOpen  bool `json:"breaker_open"`
+}
+
+// serverHistory holds the recent outcomes a server's score is computed from,
+// oldest first.
+type serverHistory struct {
+	outcomes  []bool
+	latencies []time.Duration
+	agreed    []bool
+	opens     []time.Time
+}
+
+// scoreTracker keeps the history of each server.
+type scoreTracker struct {
+	mu      sync.Mutex
+	servers map[string]*serverHistory
+}
+
+func newScoreTracker() *scoreTracker {
+	return &scoreTracker{servers: make(map[string]*serverHistory)}
+}
+
+func (t *scoreTracker) history(server string) *serverHistory {
+	h, ok := t.servers[server]
+	if !ok {
+		h = &serverHistory{}
+		t.servers[server] = h
+	}
+	return h
+}
+
+// keepLast appends value to window, dropping the oldest beyond scoreWindow.
+func keepLast[T any](window []T, value T) []T {
+	window = append(window, value)
+	if len(window) > scoreWindow {
+		window = window[len(window)-scoreWindow:]
+	}
+	return window
+}
+
+func (t *scoreTracker) recordOutcome(server string, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.history(server)
+	h.outcomes = keepLast(h.outcomes, ok)
+}
+
+func (t *scoreTracker) recordLatency(server string, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.history(server)
+	h.latencies = keepLast(h.latencies, latency)
+}
+
+func (t *scoreTracker) recordAgreement(server string, agreed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.history(server)
+	h.agreed = keepLast(h.agreed, agreed)
+}
+
+func (t *scoreTracker) recordBreakerOpen(server string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.history(server)
+	h.opens = append(h.opens, at)
+}
+
+// score computes server's score, or returns false when it has no history.
+// timeout is the query timeout latency is judged against.
+func (t *scoreTracker) score(server string, timeout time.Duration, breakerOpen bool, now time.Time) (ServerScore, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.servers[server]
+	if !ok {
+		return ServerScore{}, false
+	}
+	h.opens = slices.DeleteFunc(h.opens, func(at time.Time) bool { return now.Sub(at) > scoreBreakerWindow })
+
+	score := ServerScore{
+		Server:       server,
+		Availability: share(h.outcomes),
+		Agreement:    share(h.agreed),
+		BreakerOpens: len(h.opens),
+		BreakerOpen:  breakerOpen,
+	}
+	latencyPart := 1.0
+	if len(h.latencies) > 0 {
+		p95 := percentile(h.latencies, 0.95)
+		score.LatencyP95Ms = milliseconds(p95)
+		if timeout > 0 {
+			latencyPart = math.Max(0, 1-float64(p95)/float64(timeout))
+		}
+	}
+	breakerPart := 1 / float64(1+len(h.opens))
+	if breakerOpen {
+		breakerPart = 0
+	}
+	total := scoreWeightAvailability*score.Availability +
+		scoreWeightLatency*latencyPart +
+		scoreWeightAgreement*score.Agreement +
+		scoreWeightBreaker*breakerPart
+	score.Score = math.Round(total*10) / 10
+	return score, true
+}
+
+// share returns the share of true values, or 1 for none.
+func share(values []bool) float64 {
+	if len(values) == 0 {
+		return 1
+	}
+	n := 0
+	for _, v := range values {
+		if v {
+			n++
+		}
+	}
+	return float64(n) / float64(len(values))
+}
+
+// percentile returns the p-th percentile of latencies by the nearest rank.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(rank, 0)]
+}
+
+// ScoreSnapshot returns the score of every server that has been queried,
+// best first.
+func (r *DNSResolver) ScoreSnapshot() []ServerScore {
+	config := r.currentConfig()
+	if r.scores == nil {
+		return nil
+	}
+	now := time.Now()
+	var scores []ServerScore
+	for _, server := range config.DNSServers {
+		if score, ok := r.scores.score(server, config.QueryTimeoutFor(server), r.breakerOpen(server), now); ok {
+			scores = append(scores, score)
+		}
+	}
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].Score > scores[j].Score })
+	for i := range scores {
+		scores[i].Rank = i + 1
+	}
+	return scores
+}
+
+func (r *DNSResolver) breakerOpen(server string) bool {
+	breaker := r.breaker(server)
+	return breaker != nil && breaker.GetState() == circuitbreaker.Open.String()
+}
+
+// updateScore publishes server's current score.
+func (r *DNSResolver) updateScore(server string) {
+	if score, ok := r.scores.score(server, r.currentConfig().QueryTimeoutFor(server), r.breakerOpen(server), time.Now()); ok {
+		metrics.DNSServerScore.WithLabelValues(server).Set(score.Score)
+	}
+}
+
+// scoreOutcome counts a query to server toward its availability.
+func (r *DNSResolver) scoreOutcome(server string, err error) {
+	if r.scores == nil {
+		return
+	}
+	r.scores.recordOutcome(server, err == nil)
+	r.updateScore(server)
+}
+
+// scoreLatency counts the latency of an answer from server itself.
+func (r *DNSResolver) scoreLatency(server string, latency time.Duration) {
+	if r.scores == nil {
+		return
+	}
+	r.scores.recordLatency(server, latency)
+}
+
+// scoreAgreement counts whether each server's answer for hostname matched
+// the majority, when more than one server answered.
+func (r *DNSResolver) scoreAgreement(hostname string, responses []*dnsanalysis.DNSResponse) {
+	if r.scores == nil || len(responses) < 2 {
+		return
+	}
+	disagreed := make(map[string]bool)
+	for _, diff := range dnsanalysis.DiffResponses(hostname, responses, nil).Servers {
+		if diff.Differs() {
+			disagreed[diff.Server] = true
+		}
+	}
+	for _, response := range responses {
+		r.scores.recordAgreement(response.Server, !disagreed[response.Server])
+		r.updateScore(response.Server)
+	}
+}
@@ -0,0 +1,273 @@
+package dnsres
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"dnsres/dnsanalysis"
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// Screening defaults used when the screening section leaves them unset.
+const (
+	defaultScreeningInterval = time.Hour
+	screeningFetchTimeout    = 30 * time.Second
+)
+
+// Screening list kinds.
+const (
+	ScreeningBlock = "block"
+	ScreeningAllow = "allow"
+)
+
+// screeningList is one parsed blocklist or allowlist.
+type screeningList struct {
+	name    string
+	allow   bool
+	nets    []*net.IPNet
+	domains map[string]bool
+}
+
+// matchIP reports whether ip falls in one of the list's addresses or CIDRs.
+func (l *screeningList) matchIP(ip net.IP) bool {
+	for _, network := range l.nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain reports whether name or one of its parent domains is listed.
+func (l *screeningList) matchDomain(name string) bool {
+	name = normalizeZone(name)
+	for name != "" {
+		if l.domains[name] {
+			return true
+		}
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			return false
+		}
+		name = parent
+	}
+	return false
+}
+
+// parseScreeningList reads one entry per line: an IP address, a CIDR, or a
+// domain. Hosts-file lines such as "0.0.0.0 ads.example.com" list the domain.
+// Blank lines and # comments are ignored.
+func parseScreeningList(name string, allow bool, r io.Reader) (*screeningList, error) {
+	list := &screeningList{name: name, allow: allow, domains: make(map[string]bool)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		entry := fields[0]
+		if len(fields) > 1 && net.ParseIP(entry) != nil {
+			entry = fields[1]
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			list.nets = append(list.nets, network)
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			list.nets = append(list.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		list.domains[normalizeZone(entry)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// screeningState holds the most recently loaded lists by name.
+type screeningState struct {
+	mu    sync.RWMutex
+	lists map[string]*screeningList
+}
+
+func newScreeningState(config *Config) *screeningState {
+	if len(config.Screening.Lists) == 0 {
+		return nil
+	}
+	return &screeningState{lists: make(map[string]*screeningList)}
+}
+
+// loaded returns the lists loaded so far, in the order of sources.
+func (s *screeningState) loaded(sources []ScreeningSource) []*screeningList {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	lists := make([]*screeningList, 0, len(sources))
+	for _, source := range sources {
+		if list, ok := s.lists[source.Name]; ok {
+			lists = append(lists, list)
+		}
+	}
+	return lists
+}
+
+// fetchScreeningList reads source, an http(s) URL or a local file path.
+func fetchScreeningList(ctx context.Context, source string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.Open(source)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// refreshScreening reloads every list. A list that fails to load keeps its
+// previous contents.
+func (r *DNSResolver) refreshScreening(ctx context.Context) {
+	if r.screening == nil {
+		return
+	}
+	for _, source := range r.currentConfig().Screening.Lists {
+		fetchCtx, cancel := context.WithTimeout(ctx, screeningFetchTimeout)
+		body, err := fetchScreeningList(fetchCtx, source.Source)
+		var list *screeningList
+		if err == nil {
+			list, err = parseScreeningList(source.Name, source.Kind == ScreeningAllow, body)
+			body.Close()
+		}
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.errorLog.Printf("Screening list %s failed to load: %v", source.Name, err)
+			r.appLogf(instrumentation.Medium, "screening list load failed list=%s err=%v", source.Name, err)
+			continue
+		}
+		r.appLogf(instrumentation.Low, "screening list loaded list=%s kind=%s networks=%d domains=%d", source.Name, source.Kind, len(list.nets), len(list.domains))
+		r.screening.mu.Lock()
+		r.screening.lists[source.Name] = list
+		r.screening.mu.Unlock()
+	}
+}
+
+// runScreening refreshes the lists on the configured schedule until ctx is
+// canceled. The first load is done by Start before the first cycle.
+func (r *DNSResolver) runScreening(ctx context.Context) {
+	ticker := time.NewTicker(r.currentConfig().screeningInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.refreshScreening(ctx)
+		}
+	}
+}
+
+// screenAnswers raises a blocked_answer event for each answer address or CNAME
+// target on a blocklist and not on an allowlist.
+func (r *DNSResolver) screenAnswers(hostname string, responses []*dnsanalysis.DNSResponse) {
+	if r.screening == nil {
+		return
+	}
+	lists := r.screening.loaded(r.currentConfig().Screening.Lists)
+	var allow, block []*screeningList
+	for _, list := range lists {
+		if list.allow {
+			allow = append(allow, list)
+		} else {
+			block = append(block, list)
+		}
+	}
+	if len(block) == 0 {
+		return
+	}
+
+	for _, response := range responses {
+		for _, address := range response.Addresses {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				continue
+			}
+			if screenMatch(allow, func(l *screeningList) bool { return l.matchIP(ip) }) != nil {
+				continue
+			}
+			if list := screenMatch(block, func(l *screeningList) bool { return l.matchIP(ip) }); list != nil {
+				r.reportBlockedAnswer(hostname, response.Server, address, list.name)
+			}
+		}
+		for _, target := range cnameTargets(response) {
+			if screenMatch(allow, func(l *screeningList) bool { return l.matchDomain(target) }) != nil {
+				continue
+			}
+			if list := screenMatch(block, func(l *screeningList) bool { return l.matchDomain(target) }); list != nil {
+				r.reportBlockedAnswer(hostname, response.Server, target, list.name)
+			}
+		}
+	}
+}
+
+func screenMatch(lists []*screeningList, match func(*screeningList) bool) *screeningList {
+	for _, list := range lists {
+		if match(list) {
+			return list
+		}
+	}
+	return nil
+}
+
+// cnameTargets returns the CNAME targets in the raw answer, if it was kept.
+func cnameTargets(response *dnsanalysis.DNSResponse) []string {
+	if response.Response == nil {
+		return nil
+	}
+	var targets []string
+	for _, rr := range response.Response.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			targets = append(targets, normalizeZone(cname.Target))
+		}
+	}
+	return targets
+}
+
+func (r *DNSResolver) reportBlockedAnswer(hostname, server, answer, list string) {
+	metrics.DNSResBlockedAnswers.WithLabelValues(server, list).Inc()
+	r.errorLog.Printf("Blocked answer for %s using %s: %s is on blocklist %s", hostname, server, answer, list)
+	r.appLogf(instrumentation.Low, "blocked answer hostname=%s server=%s answer=%s list=%s", hostname, server, answer, list)
+	r.emitEvent(ResolverEvent{
+		Type:     EventBlockedAnswer,
+		Time:     time.Now(),
+		Hostname: hostname,
+		Server:   server,
+		Detail:   fmt.Sprintf("%s is on blocklist %s", answer, list),
+		Source:   list,
+	})
+}
@@ -0,0 +1,73 @@
+package dnsres
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// sdLabelPrefix starts every label in service discovery responses. Prometheus
+// drops __meta_ labels after relabeling, so jobs keep only what they map.
+const sdLabelPrefix = "__meta_dnsres_"
+
+// TargetGroup is one entry of a Prometheus HTTP service discovery response.
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// HostnameTargets returns one target group per monitored hostname, labeled
+// with where it came from, its schedule and its discovery labels.
+func (r *DNSResolver) HostnameTargets() []TargetGroup {
+	config := r.currentConfig()
+	groups := []TargetGroup{}
+	for _, hostname := range r.monitoredHostnames() {
+		labels := map[string]string{sdLabelPrefix + "source": "discovery"}
+		if slices.Contains(config.Hostnames, hostname) {
+			labels[sdLabelPrefix+"source"] = "config"
+		}
+		if schedule, ok := config.Schedules[hostname]; ok {
+			labels[sdLabelPrefix+"schedule"] = schedule
+		}
+		for name, value := range r.HostnameLabels(hostname) {
+			labels[sdLabelPrefix+"label_"+invalidLabelChars.ReplaceAllString(name, "_")] = value
+		}
+		groups = append(groups, TargetGroup{Targets: []string{hostname}, Labels: labels})
+	}
+	return groups
+}
+
+// ServerTargets returns one target group per configured DNS server, labeled
+// with its role, health, anycast node and implementation when known.
+func (r *DNSResolver) ServerTargets() []TargetGroup {
+	config := r.currentConfig()
+	health := r.HealthSnapshot()
+	nodes := r.NodeSnapshot()
+	fingerprints := r.FingerprintSnapshot()
+	groups := []TargetGroup{}
+	for _, server := range config.DNSServers {
+		labels := map[string]string{sdLabelPrefix + "role": config.Role(server)}
+		if result, ok := health[server]; ok && result.Checked() {
+			labels[sdLabelPrefix+"healthy"] = strconv.FormatBool(result.Healthy)
+		}
+		if node, ok := nodes[server]; ok {
+			labels[sdLabelPrefix+"node"] = node.Node
+		}
+		if fp, ok := fingerprints[server]; ok {
+			labels[sdLabelPrefix+"implementation"] = fp.Implementation
+		}
+		groups = append(groups, TargetGroup{Targets: []string{server}, Labels: labels})
+	}
+	return groups
+}
+
+func (r *DNSResolver) handleHostnameTargets(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, r.HostnameTargets())
+}
+
+func (r *DNSResolver) handleServerTargets(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, r.ServerTargets())
+}
@@ -0,0 +1,115 @@
+package dnsres
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Selection policies for querying.selection, which order the primaries that
+// Lookup and the forwarder's pass-through try. Monitoring cycles query every
+// server whatever the policy.
+const (
+	// SelectionOrdered tries the primaries in dns_servers order.
+	SelectionOrdered = "ordered"
+	// SelectionFastest tries the primary with the lowest 95th percentile
+	// latency first. Servers without latency data yet come first so they
+	// get measured.
+	SelectionFastest = "fastest"
+	// SelectionRoundRobin starts each query at the next primary in turn.
+	SelectionRoundRobin = "round-robin"
+	// SelectionScoreWeighted picks the first primary at random, weighted by
+	// server score, and tries the rest best first.
+	SelectionScoreWeighted = "score-weighted"
+)
+
+// SelectionPolicy returns the configured selection policy, defaulting to
+// ordered.
+func (c *Config) SelectionPolicy() string {
+	if c == nil || strings.TrimSpace(c.Querying.Selection) == "" {
+		return SelectionOrdered
+	}
+	return strings.ToLower(strings.TrimSpace(c.Querying.Selection))
+}
+
+func validateSelection(c *Config) error {
+	switch c.SelectionPolicy() {
+	case SelectionOrdered, SelectionFastest, SelectionRoundRobin, SelectionScoreWeighted:
+		return nil
+	}
+	return fmt.Errorf("invalid selection policy %q", c.Querying.Selection)
+}
+
+// selectServers returns the servers to try for one query, in order: the
+// primaries as the selection policy orders them, then the fallbacks in
+// configured order.
+func (r *DNSResolver) selectServers() []string {
+	config := r.currentConfig()
+	primaries, fallbacks := config.ServersByRole()
+	primaries = slices.Clone(primaries)
+	if len(primaries) > 1 {
+		switch config.SelectionPolicy() {
+		case SelectionFastest:
+			latency := r.selectionScores(func(s ServerScore) float64 { return s.LatencyP95Ms }, 0)
+			slices.SortStableFunc(primaries, func(a, b string) int {
+				return cmp.Compare(latency[a], latency[b])
+			})
+		case SelectionRoundRobin:
+			start := int((r.roundRobin.Add(1) - 1) % uint64(len(primaries)))
+			primaries = append(primaries[start:], primaries[:start]...)
+		case SelectionScoreWeighted:
+			score := r.selectionScores(func(s ServerScore) float64 { return s.Score }, 100)
+			slices.SortStableFunc(primaries, func(a, b string) int {
+				return cmp.Compare(score[b], score[a])
+			})
+			first := weightedPick(primaries, score)
+			picked := primaries[first]
+			copy(primaries[1:first+1], primaries[:first])
+			primaries[0] = picked
+		}
+	}
+	return append(primaries, fallbacks...)
+}
+
+// selectionScores returns value of each scored server's score, or missing
+// for servers without one.
+func (r *DNSResolver) selectionScores(value func(ServerScore) float64, missing float64) map[string]float64 {
+	config := r.currentConfig()
+	values := make(map[string]float64, len(config.DNSServers))
+	for _, server := range config.DNSServers {
+		values[server] = missing
+	}
+	if r.scores == nil {
+		return values
+	}
+	now := time.Now()
+	for _, server := range config.DNSServers {
+		if score, ok := r.scores.score(server, config.QueryTimeoutFor(server), r.breakerOpen(server), now); ok {
+			values[server] = value(score)
+		}
+	}
+	return values
+}
+
+// weightedPick returns the index of a server picked at random with a
+// probability proportional to its weight, or 0 when no weight is positive.
+func weightedPick(servers []string, weights map[string]float64) int {
+	total := 0.0
+	for _, server := range servers {
+		total += max(weights[server], 0)
+	}
+	if total <= 0 {
+		return 0
+	}
+	pick := rand.Float64() * total
+	for i, server := range servers {
+		pick -= max(weights[server], 0)
+		if pick < 0 {
+			return i
+		}
+	}
+	return len(servers) - 1
+}
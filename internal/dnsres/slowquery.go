@@ -0,0 +1,82 @@
+package dnsres
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dnsres/dnsanalysis"
+	"dnsres/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// SlowQueryLogConfig configures the slow query log, which records every query
+// that takes at least Threshold in dnsres-slow.log, apart from the error log.
+// The log is written only when Threshold is set.
+type SlowQueryLogConfig struct {
+	Threshold Duration    `json:"threshold"`
+	Rotation  LogRotation `json:"rotation"`
+}
+
+// slowQuery is what is known about one query when it completes.
+type slowQuery struct {
+	hostname, server string
+	transport        string
+	// Breaker state and consecutive failures when the query was sent.
+	breaker  string
+	failures int
+	elapsed  time.Duration
+	// Latency breakdown, as on dnsanalysis.DNSResponse.
+	queue, connect, network time.Duration
+	response                *dns.Msg
+	err                     error
+}
+
+func openSlowQueryLog(config *Config, logDir string) (*log.Logger, error) {
+	if config.SlowQueryLog.Threshold.Duration <= 0 {
+		return nil, nil
+	}
+	file, err := openRotatingFile(filepath.Join(logDir, "dnsres-slow.log"), "slow", config.SlowQueryLog.Rotation)
+	if err != nil {
+		return nil, err
+	}
+	return log.New(file, "", log.LstdFlags), nil
+}
+
+// queryTransport names the transport client sends queries over.
+func queryTransport(client dnsClient) string {
+	if c, ok := client.(*dns.Client); ok && c.Net != "" {
+		return c.Net
+	}
+	return "udp"
+}
+
+// logSlowQuery writes q to the slow query log when it took at least the
+// threshold.
+func (r *DNSResolver) logSlowQuery(q slowQuery) {
+	threshold := r.currentConfig().SlowQueryLog.Threshold.Duration
+	if r.slowLog == nil || q.elapsed < threshold {
+		return
+	}
+	metrics.DNSResSlowQueries.WithLabelValues(q.server).Inc()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Slow query hostname=%s server=%s duration=%s threshold=%s transport=%s breaker=%s failures=%d",
+		q.hostname, q.server, q.elapsed, threshold, q.transport, q.breaker, q.failures)
+	fmt.Fprintf(&b, " queue=%s connect=%s network=%s", q.queue, q.connect, q.network)
+	switch {
+	case q.err != nil:
+		fmt.Fprintf(&b, " err=%q", q.err.Error())
+	case q.response != nil:
+		answers := make([]string, 0, len(q.response.Answer))
+		for _, answer := range q.response.Answer {
+			answers = append(answers, strings.TrimPrefix(answer.String(), answer.Header().String()))
+		}
+		fmt.Fprintf(&b, " rcode=%s flags=%s size=%d answers=[%s]",
+			dns.RcodeToString[q.response.Rcode], strings.Join(dnsanalysis.Flags(q.response), ","), q.response.Len(), strings.Join(answers, " "))
+	}
+	r.slowLog.Print(b.String())
+}
@@ -0,0 +1,76 @@
+package dnsres
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// replyRecorder keeps the datagrams read from a UDP connection. The dns
+// package silently drops replies whose transaction ID does not match the
+// query, which would otherwise make spoofing attempts and broken middleboxes
+// look like timeouts.
+type replyRecorder struct {
+	net.Conn
+	replies [][]byte
+}
+
+// recordReplies makes conn keep the replies read from it. Connections that
+// are not packet oriented are left alone; the dns package reports ID
+// mismatches on those itself.
+func recordReplies(conn *dns.Conn) *replyRecorder {
+	recorder := &replyRecorder{Conn: conn.Conn}
+	if _, ok := conn.Conn.(net.PacketConn); ok {
+		conn.Conn = recorder
+	}
+	return recorder
+}
+
+func (c *replyRecorder) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.replies = append(c.replies, append([]byte(nil), p[:n]...))
+	}
+	return n, err
+}
+
+// ReadFrom and WriteTo keep the recorder a net.PacketConn, which is how the
+// dns package tells datagram connections from streams.
+func (c *replyRecorder) ReadFrom(p []byte) (int, net.Addr, error) {
+	return c.Conn.(net.PacketConn).ReadFrom(p)
+}
+
+func (c *replyRecorder) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.Conn.(net.PacketConn).WriteTo(p, addr)
+}
+
+// mismatchedReplies returns the replies whose transaction ID is not id.
+func mismatchedReplies(replies [][]byte, id uint16) [][]byte {
+	var mismatched [][]byte
+	for _, reply := range replies {
+		if len(reply) >= 2 && binary.BigEndian.Uint16(reply) != id {
+			mismatched = append(mismatched, reply)
+		}
+	}
+	return mismatched
+}
+
+// recordMismatch counts a reply of server that does not match the
+// outstanding query for hostname, by reason id or question. The reply is
+// dumped in full to the app log at high instrumentation.
+func (r *DNSResolver) recordMismatch(server, hostname, reason string, reply []byte) {
+	metrics.DNSResolutionMismatched.WithLabelValues(server, reason).Inc()
+	var id uint16
+	if len(reply) >= 2 {
+		id = binary.BigEndian.Uint16(reply)
+	}
+	r.appLogf(instrumentation.Medium, "mismatched reply hostname=%s server=%s reason=%s id=%d size=%d", hostname, server, reason, id, len(reply))
+	if r.appLogEnabled(instrumentation.High) {
+		r.appLogf(instrumentation.High, "mismatched reply dump hostname=%s server=%s\n%s", hostname, server, hex.Dump(reply))
+	}
+}
@@ -0,0 +1,144 @@
+package dnsres
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// statsRetention is how long hourly buckets are kept.
+	statsRetention = 48 * time.Hour
+	// statsSaveInterval limits how often the store is written during a run.
+	statsSaveInterval = time.Minute
+)
+
+// StatsBucket counts one hour of queries for one hostname on one server.
+type StatsBucket struct {
+	Hour     time.Time `json:"hour"`
+	Hostname string    `json:"hostname"`
+	Server   string    `json:"server"`
+	Queries  int       `json:"queries"`
+	Failures int       `json:"failures"`
+}
+
+type statsKey struct {
+	hour             time.Time
+	hostname, server string
+}
+
+// statsStore keeps hourly query counts for reports. It is saved to a JSON
+// file in the log directory, so a report run separately from the monitor
+// sees its history.
+type statsStore struct {
+	mu      sync.Mutex
+	path    string
+	buckets map[statsKey]*StatsBucket
+	saved   time.Time
+}
+
+// openStatsStore loads the store at path. A missing file starts an empty
+// store; an unreadable one is returned empty with the error.
+func openStatsStore(path string) (*statsStore, error) {
+	s := &statsStore{path: path, buckets: make(map[statsKey]*StatsBucket)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("failed to read stats store: %w", err)
+	}
+	var buckets []StatsBucket
+	if err := json.Unmarshal(data, &buckets); err != nil {
+		return s, fmt.Errorf("failed to decode stats store %s: %w", path, err)
+	}
+	for _, bucket := range buckets {
+		bucket.Hour = bucket.Hour.UTC()
+		s.buckets[statsKey{bucket.Hour, bucket.Hostname, bucket.Server}] = &bucket
+	}
+	return s, nil
+}
+
+// record counts one query of hostname on server at now.
+func (s *statsStore) record(now time.Time, hostname, server string, failed bool) {
+	key := statsKey{now.UTC().Truncate(time.Hour), hostname, server}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &StatsBucket{Hour: key.hour, Hostname: hostname, Server: server}
+		s.buckets[key] = bucket
+	}
+	bucket.Queries++
+	if failed {
+		bucket.Failures++
+	}
+}
+
+// snapshot returns the buckets ordered by hour, hostname and server.
+func (s *statsStore) snapshot() []StatsBucket {
+	s.mu.Lock()
+	buckets := make([]StatsBucket, 0, len(s.buckets))
+	for _, bucket := range s.buckets {
+		buckets = append(buckets, *bucket)
+	}
+	s.mu.Unlock()
+	sort.Slice(buckets, func(i, j int) bool {
+		a, b := buckets[i], buckets[j]
+		if !a.Hour.Equal(b.Hour) {
+			return a.Hour.Before(b.Hour)
+		}
+		if a.Hostname != b.Hostname {
+			return a.Hostname < b.Hostname
+		}
+		return a.Server < b.Server
+	})
+	return buckets
+}
+
+// save drops buckets older than statsRetention and writes the rest to the
+// store's file. Unless force is set, it does nothing within
+// statsSaveInterval of the last save.
+func (s *statsStore) save(now time.Time, force bool) error {
+	s.mu.Lock()
+	if !force && now.Sub(s.saved) < statsSaveInterval {
+		s.mu.Unlock()
+		return nil
+	}
+	s.saved = now
+	cutoff := now.UTC().Add(-statsRetention)
+	for key := range s.buckets {
+		if key.hour.Before(cutoff) {
+			delete(s.buckets, key)
+		}
+	}
+	s.mu.Unlock()
+
+	data, err := json.Marshal(s.snapshot())
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write stats store: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write stats store: %w", err)
+	}
+	return nil
+}
+
+// saveStats writes the stats store, logging failures.
+func (r *DNSResolver) saveStats(force bool) {
+	if r.statsStore == nil {
+		return
+	}
+	if err := r.statsStore.save(time.Now(), force); err != nil {
+		r.errorLog.Printf("Saving report statistics failed: %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package dnsres
+
+import (
+	"fmt"
+	"time"
+)
+
+// TriggerCycle asks the run loop to start a resolution cycle now, outside
+// the query interval, and records the request in the audit log under actor.
+// The interval schedule is unchanged. It fails when a triggered cycle is
+// already waiting to run.
+func (r *DNSResolver) TriggerCycle(actor string) error {
+	if r.triggers == nil {
+		return fmt.Errorf("cycle triggers are not available")
+	}
+	select {
+	case r.triggers <- actor:
+	default:
+		return fmt.Errorf("a triggered cycle is already pending")
+	}
+	r.RecordAudit(actor, "trigger_cycle", "*", "", "")
+	return nil
+}
+
+// NextCycle returns when the next scheduled resolution cycle is due, or the
+// zero time before the resolution loop has started.
+func (r *DNSResolver) NextCycle() time.Time {
+	next := r.nextCycle.Load()
+	if next == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, next)
+}
+
+// scheduleNextCycle records that the cycle after tick is due one query
+// interval later.
+func (r *DNSResolver) scheduleNextCycle(tick time.Time) {
+	r.nextCycle.Store(tick.Add(r.currentConfig().QueryInterval.Duration).UnixNano())
+}
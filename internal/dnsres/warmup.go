@@ -0,0 +1,39 @@
+package dnsres
+
+import (
+	"context"
+	"time"
+
+	"dnsres/instrumentation"
+	"dnsres/metrics"
+)
+
+// startWarmUp begins the warm_up window, during which failures are logged
+// and counted but neither trip circuit breakers nor raise alerts, so a
+// network blip at startup does not lock out every server. The window ends
+// after warm_up or when ctx is canceled.
+func (r *DNSResolver) startWarmUp(ctx context.Context) {
+	window := r.currentConfig().WarmUp.Duration
+	if window <= 0 {
+		return
+	}
+	r.warmUntil = time.Now().Add(window)
+	metrics.DNSResWarmingUp.Set(1)
+	r.outputf("Warm-up for %s: failures do not trip circuit breakers or raise alerts\n", window)
+	r.appLogf(instrumentation.Low, "warm-up started duration=%s", window)
+	go func() {
+		timer := time.NewTimer(window)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+			r.appLogf(instrumentation.Low, "warm-up ended")
+		}
+		metrics.DNSResWarmingUp.Set(0)
+	}()
+}
+
+// warmingUp reports whether t falls in the warm_up window.
+func (r *DNSResolver) warmingUp(t time.Time) bool {
+	return t.Before(r.warmUntil)
+}
@@ -0,0 +1,121 @@
+package dnsres
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"dnsres/internal/xdg"
+
+	"github.com/mattn/go-isatty"
+	"github.com/miekg/dns"
+)
+
+// publicDNSServers are suggested after the system's own resolvers.
+var publicDNSServers = []string{"1.1.1.1:53", "8.8.8.8:53", "9.9.9.9:53"}
+
+// resolvConfPath lists the system's resolvers; tests replace it.
+var resolvConfPath = "/etc/resolv.conf"
+
+// errSetupAborted is returned when input ends before the wizard completes.
+var errSetupAborted = errors.New("setup aborted: no answer given")
+
+// FirstRunConfig returns the config for a run with no config file and no
+// hostname on the command line. On a terminal it runs the setup wizard,
+// which writes the config to DefaultConfigPath; otherwise it fails, so
+// unattended runs never monitor a placeholder hostname.
+func FirstRunConfig(in *os.File, out io.Writer) (*Config, error) {
+	path := DefaultConfigPath()
+	if !isTerminal(in) {
+		return nil, fmt.Errorf("no configuration file found: provide a hostname as the first argument or with -host, or create %s", path)
+	}
+	return RunSetupWizard(in, out, path)
+}
+
+// RunSetupWizard asks for the hostnames to monitor and the DNS servers to
+// query, suggesting the system's resolvers and well-known public ones,
+// then writes a config file to path and returns it loaded. When the answers
+// do not make a valid config, it lists the problems and asks again.
+func RunSetupWizard(in io.Reader, out io.Writer, path string) (*Config, error) {
+	scanner := bufio.NewScanner(in)
+	fmt.Fprintf(out, "No configuration file found. Answer two questions to create %s.\n\n", path)
+	for {
+		config, err := runSetupQuestions(scanner, out, path)
+		var problems ConfigErrors
+		if !errors.As(err, &problems) {
+			return config, err
+		}
+		fmt.Fprintln(out, "\nThose answers do not make a valid config:")
+		for _, problem := range problems {
+			fmt.Fprintf(out, "  %s\n", problem)
+		}
+		fmt.Fprintln(out, "Please try again.")
+		fmt.Fprintln(out)
+	}
+}
+
+// runSetupQuestions asks the wizard's questions once and writes and loads
+// the config. The file is removed again when it does not load.
+func runSetupQuestions(scanner *bufio.Scanner, out io.Writer, path string) (*Config, error) {
+	var hostnames []string
+	for len(hostnames) == 0 {
+		fmt.Fprint(out, "Hostnames to monitor, separated by spaces (e.g. www.yourdomain.com api{1..3}.yourdomain.com): ")
+		if !scanner.Scan() {
+			return nil, errSetupAborted
+		}
+		hostnames = strings.Fields(scanner.Text())
+		if len(hostnames) == 0 {
+			fmt.Fprintln(out, "At least one hostname is required.")
+		}
+	}
+
+	suggested := SuggestedDNSServers()
+	fmt.Fprintf(out, "DNS servers to query, separated by spaces [%s]: ", strings.Join(suggested, " "))
+	if !scanner.Scan() {
+		return nil, errSetupAborted
+	}
+	servers := strings.Fields(scanner.Text())
+	if len(servers) == 0 {
+		servers = suggested
+	}
+	for i, server := range servers {
+		servers[i] = ensurePort(server)
+	}
+
+	if err := xdg.WriteConfig(path, hostnames, servers); err != nil {
+		return nil, err
+	}
+	config, err := LoadConfig(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	fmt.Fprintf(out, "\nWrote %s; edit it to change hostnames, servers or other settings.\n\n", path)
+	return config, nil
+}
+
+// SuggestedDNSServers returns the system's resolvers followed by well-known
+// public ones, without duplicates.
+func SuggestedDNSServers() []string {
+	var servers []string
+	if resolv, err := dns.ClientConfigFromFile(resolvConfPath); err == nil {
+		for _, server := range resolv.Servers {
+			servers = append(servers, ensurePort(server))
+		}
+	}
+	for _, server := range publicDNSServers {
+		if !slices.Contains(servers, server) {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// isTerminal reports whether f is an interactive terminal.
+func isTerminal(f *os.File) bool {
+	return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+}
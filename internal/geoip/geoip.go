@@ -0,0 +1,84 @@
+package geoip
+
+import (
+	"fmt"
+	"net"
+)
+
+// Info is the location and network data reported for an address.
+type Info struct {
+	Country      string `json:"country,omitempty"`
+	ASN          uint32 `json:"asn,omitempty"`
+	Organization string `json:"organization,omitempty"`
+}
+
+// String renders info compactly for logs, e.g. "US AS15169".
+func (i Info) String() string {
+	switch {
+	case i.Country != "" && i.ASN != 0:
+		return fmt.Sprintf("%s AS%d", i.Country, i.ASN)
+	case i.ASN != 0:
+		return fmt.Sprintf("AS%d", i.ASN)
+	}
+	return i.Country
+}
+
+// DB combines an optional country (or city) database with an optional ASN
+// database.
+type DB struct {
+	country *Reader
+	asn     *Reader
+}
+
+// OpenDB opens the databases at the given paths; either may be empty.
+func OpenDB(countryPath, asnPath string) (*DB, error) {
+	db := &DB{}
+	var err error
+	if countryPath != "" {
+		if db.country, err = Open(countryPath); err != nil {
+			return nil, fmt.Errorf("failed to open country database: %w", err)
+		}
+	}
+	if asnPath != "" {
+		if db.asn, err = Open(asnPath); err != nil {
+			return nil, fmt.Errorf("failed to open ASN database: %w", err)
+		}
+	}
+	return db, nil
+}
+
+// Lookup returns what the databases know about address. Unknown or invalid
+// addresses return the zero Info.
+func (db *DB) Lookup(address string) Info {
+	var info Info
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return info
+	}
+	if db.country != nil {
+		if record, err := db.country.Lookup(ip); err == nil && record != nil {
+			info.Country = isoCode(record, "country")
+			if info.Country == "" {
+				info.Country = isoCode(record, "registered_country")
+			}
+		}
+	}
+	if db.asn != nil {
+		if record, err := db.asn.Lookup(ip); err == nil && record != nil {
+			if asn, ok := record["autonomous_system_number"].(uint32); ok {
+				info.ASN = asn
+			}
+			info.Organization, _ = record["autonomous_system_organization"].(string)
+		}
+	}
+	return info
+}
+
+func isoCode(record map[string]any, key string) string {
+	section, ok := record[key].(map[string]any)
+	if !ok {
+		return ""
+	}
+	code, _ := section["iso_code"].(string)
+	return code
+}
@@ -0,0 +1,194 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// testNetwork maps a CIDR to the record stored for it.
+type testNetwork struct {
+	cidr   string
+	record map[string]any
+}
+
+// writeTestDB builds a minimal MaxMind DB for networks.
+func writeTestDB(t *testing.T, ipVersion uint16, recordSize uint16, networks []testNetwork) []byte {
+	t.Helper()
+	const empty, data = -1, -2
+	type record struct{ kind, value int }
+	nodes := [][2]record{{{kind: empty}, {kind: empty}}}
+
+	var section bytes.Buffer
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network.cidr)
+		if err != nil {
+			t.Fatalf("invalid cidr %s: %v", network.cidr, err)
+		}
+		ip := ipNet.IP.To4()
+		prefix, _ := ipNet.Mask.Size()
+		if ipVersion == 6 {
+			// IPv4 networks live under ::/96, not the ::ffff:0:0/96 mapping.
+			ip = append(make(net.IP, 12), ip...)
+			prefix += 96
+		}
+		offset := section.Len()
+		section.Write(encodeTestValue(network.record))
+
+		node := 0
+		for i := 0; i < prefix; i++ {
+			bit := int(ip[i/8]>>(7-i%8)) & 1
+			if i == prefix-1 {
+				nodes[node][bit] = record{kind: data, value: offset}
+				break
+			}
+			if nodes[node][bit].kind == empty {
+				nodes = append(nodes, [2]record{{kind: empty}, {kind: empty}})
+				nodes[node][bit] = record{value: len(nodes) - 1}
+			}
+			node = nodes[node][bit].value
+		}
+	}
+
+	nodeCount := len(nodes)
+	var tree bytes.Buffer
+	for _, node := range nodes {
+		var values [2]uint32
+		for bit, r := range node {
+			switch r.kind {
+			case empty:
+				values[bit] = uint32(nodeCount)
+			case data:
+				values[bit] = uint32(nodeCount + 16 + r.value)
+			default:
+				values[bit] = uint32(r.value)
+			}
+		}
+		switch recordSize {
+		case 24:
+			tree.Write([]byte{byte(values[0] >> 16), byte(values[0] >> 8), byte(values[0]),
+				byte(values[1] >> 16), byte(values[1] >> 8), byte(values[1])})
+		case 28:
+			tree.Write([]byte{byte(values[0] >> 16), byte(values[0] >> 8), byte(values[0]),
+				byte(values[0]>>20)&0xf0 | byte(values[1]>>24)&0x0f,
+				byte(values[1] >> 16), byte(values[1] >> 8), byte(values[1])})
+		default:
+			tree.Write(binary.BigEndian.AppendUint32(nil, values[0]))
+			tree.Write(binary.BigEndian.AppendUint32(nil, values[1]))
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write(tree.Bytes())
+	buf.Write(make([]byte, 16))
+	buf.Write(section.Bytes())
+	buf.Write(metadataMarker)
+	buf.Write(encodeTestValue(map[string]any{
+		"node_count":    uint32(nodeCount),
+		"record_size":   recordSize,
+		"ip_version":    ipVersion,
+		"database_type": "Test",
+	}))
+	return buf.Bytes()
+}
+
+func encodeTestValue(value any) []byte {
+	var out []byte
+	switch v := value.(type) {
+	case string:
+		if len(v) < 29 {
+			out = append(out, byte(typeString<<5|len(v)))
+		} else {
+			out = append(out, byte(typeString<<5|29), byte(len(v)-29))
+		}
+		out = append(out, v...)
+	case uint16:
+		out = append(out, byte(typeUint16<<5|2), byte(v>>8), byte(v))
+	case uint32:
+		out = append(out, byte(typeUint32<<5|4))
+		out = binary.BigEndian.AppendUint32(out, v)
+	case map[string]any:
+		out = append(out, byte(typeMap<<5|len(v)))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			out = append(out, encodeTestValue(key)...)
+			out = append(out, encodeTestValue(v[key])...)
+		}
+	}
+	return out
+}
+
+func TestReaderLookup(t *testing.T) {
+	networks := []testNetwork{
+		{cidr: "10.0.0.0/8", record: map[string]any{"country": map[string]any{"iso_code": "US"}}},
+		{cidr: "192.0.2.0/24", record: map[string]any{"registered_country": map[string]any{"iso_code": "DE"}}},
+	}
+
+	for _, tt := range []struct {
+		ipVersion, recordSize uint16
+	}{{4, 24}, {6, 28}, {6, 32}} {
+		reader, err := New(writeTestDB(t, tt.ipVersion, tt.recordSize, networks))
+		if err != nil {
+			t.Fatalf("ip_version=%d record_size=%d: open failed: %v", tt.ipVersion, tt.recordSize, err)
+		}
+		record, err := reader.Lookup(net.ParseIP("10.1.2.3"))
+		if err != nil {
+			t.Fatalf("lookup failed: %v", err)
+		}
+		if isoCode(record, "country") != "US" {
+			t.Fatalf("ip_version=%d record_size=%d: expected US, got %v", tt.ipVersion, tt.recordSize, record)
+		}
+		record, err = reader.Lookup(net.ParseIP("203.0.113.1"))
+		if err != nil || record != nil {
+			t.Fatalf("expected no record for unknown address, got %v (%v)", record, err)
+		}
+	}
+
+	if _, err := New([]byte("not a database")); err == nil {
+		t.Fatalf("expected error for missing metadata")
+	}
+}
+
+func TestDBLookup(t *testing.T) {
+	dir := t.TempDir()
+	countryPath := filepath.Join(dir, "country.mmdb")
+	asnPath := filepath.Join(dir, "asn.mmdb")
+	country := writeTestDB(t, 6, 24, []testNetwork{
+		{cidr: "192.0.2.0/24", record: map[string]any{"registered_country": map[string]any{"iso_code": "DE"}}},
+	})
+	asn := writeTestDB(t, 4, 24, []testNetwork{
+		{cidr: "192.0.2.0/25", record: map[string]any{
+			"autonomous_system_number":       uint32(64500),
+			"autonomous_system_organization": "Example Net",
+		}},
+	})
+	if err := os.WriteFile(countryPath, country, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(asnPath, asn, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenDB(countryPath, asnPath)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	info := db.Lookup("192.0.2.10")
+	if info.Country != "DE" || info.ASN != 64500 || info.Organization != "Example Net" {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	if info.String() != "DE AS64500" {
+		t.Fatalf("unexpected string %q", info.String())
+	}
+	if other := db.Lookup("192.0.2.200"); other.ASN != 0 || other.Country != "DE" {
+		t.Fatalf("expected country only outside the ASN network, got %+v", other)
+	}
+}
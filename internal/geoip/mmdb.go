@@ -0,0 +1,344 @@
+// Package geoip reads MaxMind DB (.mmdb) files such as GeoLite2-Country and
+// GeoLite2-ASN.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// metadataMarker precedes the metadata map at the end of every MaxMind DB.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// dataSectionSeparator is the run of zero bytes between tree and data.
+const dataSectionSeparator = 16
+
+// maxDecodeDepth bounds nesting so a corrupt file cannot recurse forever.
+const maxDecodeDepth = 64
+
+// Reader looks up addresses in a MaxMind DB loaded into memory.
+type Reader struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dataStart  uint
+	ipv4Start  uint
+	// DatabaseType is the metadata database_type, e.g. "GeoLite2-ASN".
+	DatabaseType string
+}
+
+// Open reads the database at path.
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(buf)
+}
+
+// New parses a database held in buf.
+func New(buf []byte) (*Reader, error) {
+	index := bytes.LastIndex(buf, metadataMarker)
+	if index < 0 {
+		return nil, errors.New("not a MaxMind DB: metadata marker not found")
+	}
+	metaStart := uint(index + len(metadataMarker))
+	d := decoder{buf: buf, base: metaStart}
+	value, _, err := d.decode(metaStart, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+	metadata, ok := value.(map[string]any)
+	if !ok {
+		return nil, errors.New("invalid metadata: not a map")
+	}
+
+	r := &Reader{buf: buf}
+	r.nodeCount = metadataUint(metadata, "node_count")
+	r.recordSize = metadataUint(metadata, "record_size")
+	r.ipVersion = metadataUint(metadata, "ip_version")
+	r.DatabaseType, _ = metadata["database_type"].(string)
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported ip version %d", r.ipVersion)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	r.dataStart = treeSize + dataSectionSeparator
+	if r.dataStart > uint(index) {
+		return nil, errors.New("search tree extends past the data section")
+	}
+
+	// IPv4 addresses live under ::/96 in IPv6 databases.
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+func metadataUint(metadata map[string]any, key string) uint {
+	switch v := metadata[key].(type) {
+	case uint64:
+		return uint(v)
+	case uint32:
+		return uint(v)
+	case uint16:
+		return uint(v)
+	}
+	return 0
+}
+
+// Lookup returns the record for ip, or nil when the database has none.
+func (r *Reader) Lookup(ip net.IP) (map[string]any, error) {
+	node := uint(0)
+	bits := ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = ip4
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, fmt.Errorf("IPv6 address %s in an IPv4-only database", ip)
+	}
+	if bits == nil {
+		return nil, fmt.Errorf("invalid IP address")
+	}
+
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-i%8)) & 1
+		node = r.record(node, bit)
+	}
+	if node <= r.nodeCount {
+		return nil, nil
+	}
+
+	offset := node - r.nodeCount - dataSectionSeparator + r.dataStart
+	d := decoder{buf: r.buf, base: r.dataStart}
+	value, _, err := d.decode(offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	record, ok := value.(map[string]any)
+	if !ok {
+		return nil, errors.New("record is not a map")
+	}
+	return record, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (r *Reader) record(node, bit uint) uint {
+	b := r.buf
+	switch r.recordSize {
+	case 24:
+		offset := node*6 + bit*3
+		return uint(b[offset])<<16 | uint(b[offset+1])<<8 | uint(b[offset+2])
+	case 28:
+		offset := node * 7
+		if bit == 0 {
+			return uint(b[offset+3]&0xf0)<<20 | uint(b[offset])<<16 | uint(b[offset+1])<<8 | uint(b[offset+2])
+		}
+		return uint(b[offset+3]&0x0f)<<24 | uint(b[offset+4])<<16 | uint(b[offset+5])<<8 | uint(b[offset+6])
+	default:
+		offset := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(b[offset:]))
+	}
+}
+
+// Data section field types.
+const (
+	typeExtended  = 0
+	typePointer   = 1
+	typeString    = 2
+	typeDouble    = 3
+	typeBytes     = 4
+	typeUint16    = 5
+	typeUint32    = 6
+	typeMap       = 7
+	typeInt32     = 8
+	typeUint64    = 9
+	typeUint128   = 10
+	typeArray     = 11
+	typeContainer = 12
+	typeEndMarker = 13
+	typeBool      = 14
+	typeFloat     = 15
+)
+
+type decoder struct {
+	buf []byte
+	// base is where pointers are resolved from.
+	base uint
+}
+
+// decode returns the value at offset and the offset just past it.
+func (d decoder) decode(offset uint, depth int) (any, uint, error) {
+	if depth > maxDecodeDepth {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+	ctrl, err := d.byteAt(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+	kind := uint(ctrl >> 5)
+
+	if kind == typePointer {
+		sizeBits := uint(ctrl>>3) & 0x3
+		value := uint(ctrl & 0x7)
+		raw, err := d.bytes(offset, sizeBits+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var pointer uint
+		switch sizeBits {
+		case 0:
+			pointer = value<<8 | uint(raw[0])
+		case 1:
+			pointer = (value<<16 | uint(raw[0])<<8 | uint(raw[1])) + 2048
+		case 2:
+			pointer = (value<<24 | uint(raw[0])<<16 | uint(raw[1])<<8 | uint(raw[2])) + 526336
+		default:
+			pointer = uint(binary.BigEndian.Uint32(raw))
+		}
+		target, _, err := d.decode(d.base+pointer, depth+1)
+		return target, offset + sizeBits + 1, err
+	}
+
+	if kind == typeExtended {
+		next, err := d.byteAt(offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + uint(next)
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		raw, err := d.bytes(offset, extra)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += extra
+		switch size {
+		case 29:
+			size = 29 + uint(raw[0])
+		case 30:
+			size = 285 + (uint(raw[0])<<8 | uint(raw[1]))
+		default:
+			size = 65821 + (uint(raw[0])<<16 | uint(raw[1])<<8 | uint(raw[2]))
+		}
+	}
+
+	switch kind {
+	case typeMap:
+		values := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			value, after, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values[name] = value
+			offset = after
+		}
+		return values, offset, nil
+	case typeArray:
+		values := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, after, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, value)
+			offset = after
+		}
+		return values, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	raw, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch kind {
+	case typeString:
+		return string(raw), offset, nil
+	case typeBytes, typeUint128:
+		return append([]byte(nil), raw...), offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(raw)), offset, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid integer size %d", size)
+		}
+		var value uint64
+		for _, b := range raw {
+			value = value<<8 | uint64(b)
+		}
+		switch kind {
+		case typeUint16:
+			return uint16(value), offset, nil
+		case typeUint32:
+			return uint32(value), offset, nil
+		}
+		return value, offset, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid integer size %d", size)
+		}
+		var value uint32
+		for _, b := range raw {
+			value = value<<8 | uint32(b)
+		}
+		return int32(value), offset, nil
+	case typeContainer, typeEndMarker:
+		return nil, 0, fmt.Errorf("unexpected field type %d", kind)
+	}
+	return nil, 0, fmt.Errorf("unknown field type %d", kind)
+}
+
+func (d decoder) byteAt(offset uint) (byte, error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, errors.New("unexpected end of database")
+	}
+	return d.buf[offset], nil
+}
+
+func (d decoder) bytes(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.buf)) || offset+n < offset {
+		return nil, errors.New("unexpected end of database")
+	}
+	return d.buf[offset : offset+n], nil
+}
@@ -0,0 +1,118 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls one service's methods on one server.
+type Client struct {
+	// base is the server's URL followed by the service name.
+	base   string
+	client *http.Client
+}
+
+// NewClient returns a client for service at address (host:port). A nil
+// tlsConfig talks cleartext HTTP/2.
+func NewClient(address, service string, tlsConfig *tls.Config) *Client {
+	protocols := new(http.Protocols)
+	scheme := "https"
+	if tlsConfig == nil {
+		protocols.SetUnencryptedHTTP2(true)
+		scheme = "http"
+	} else {
+		protocols.SetHTTP2(true)
+	}
+	transport := &http.Transport{TLSClientConfig: tlsConfig, Protocols: protocols}
+	return &Client{
+		base:   scheme + "://" + address + "/" + service + "/",
+		client: &http.Client{Transport: transport},
+	}
+}
+
+// Call invokes a unary method and returns its response message.
+func (c *Client) Call(ctx context.Context, method string, req []byte) ([]byte, error) {
+	var out []byte
+	err := c.Stream(ctx, method, req, func(message []byte) error {
+		if out != nil {
+			return Errorf(Internal, "unary method %s sent more than one message", method)
+		}
+		out = message
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		return nil, Errorf(Internal, "unary method %s sent no message", method)
+	}
+	return out, nil
+}
+
+// Stream invokes a method and passes each response message to recv until
+// the server ends the call. An error from recv ends the call early.
+func (c *Client) Stream(ctx context.Context, method string, req []byte, recv func([]byte) error) error {
+	var body bytes.Buffer
+	if err := writeMessage(&body, req); err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base+method, &body)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/grpc+proto")
+	httpReq.Header.Set("Te", "trailers")
+	if deadline, ok := ctx.Deadline(); ok {
+		httpReq.Header.Set("Grpc-Timeout", formatTimeout(time.Until(deadline)))
+	}
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Errorf(Unavailable, "unexpected HTTP status %s", resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !isGRPCContentType(contentType) {
+		return Errorf(Internal, "unexpected content type %q", contentType)
+	}
+	for {
+		message, err := readMessage(resp.Body)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := recv(message); err != nil {
+			return err
+		}
+	}
+	return responseStatus(resp)
+}
+
+// responseStatus returns the call's status from the trailers, or from the
+// headers of a trailers-only response.
+func responseStatus(resp *http.Response) error {
+	value, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if value == "" {
+		value, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if value == "" {
+		return Errorf(Internal, "response has no grpc-status")
+	}
+	code, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+	if err != nil {
+		return Errorf(Internal, "invalid grpc-status %q", value)
+	}
+	if code == uint64(OK) {
+		return nil
+	}
+	return &Status{Code: Code(code), Message: decodeMessage(message)}
+}
@@ -0,0 +1,324 @@
+// Package grpc serves and calls gRPC methods over net/http's HTTP/2.
+//
+// It implements only the wire protocol: length-prefixed messages, the
+// grpc-status and grpc-message trailers, and grpc-timeout deadlines. Unary
+// and server-streaming methods are supported; compression is not. Messages
+// are passed as encoded protobuf bytes, so callers own the encoding.
+package grpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxMessageSize bounds a single message in either direction.
+const maxMessageSize = 4 << 20
+
+// Code is a gRPC status code.
+type Code uint32
+
+// Status codes used by this package and its callers.
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	DeadlineExceeded   Code = 4
+	NotFound           Code = 5
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+)
+
+var codeNames = map[Code]string{
+	OK:                 "OK",
+	Canceled:           "Canceled",
+	Unknown:            "Unknown",
+	InvalidArgument:    "InvalidArgument",
+	DeadlineExceeded:   "DeadlineExceeded",
+	NotFound:           "NotFound",
+	ResourceExhausted:  "ResourceExhausted",
+	FailedPrecondition: "FailedPrecondition",
+	Unimplemented:      "Unimplemented",
+	Internal:           "Internal",
+	Unavailable:        "Unavailable",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return "Code(" + strconv.Itoa(int(c)) + ")"
+}
+
+// Status is an error carrying a gRPC status code.
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("grpc: %s: %s", s.Code, s.Message)
+}
+
+// Errorf returns a Status error with the given code.
+func Errorf(code Code, format string, args ...any) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// CodeOf returns err's status code: OK for nil, the code of a Status,
+// Canceled or DeadlineExceeded for context errors and Unknown otherwise.
+func CodeOf(err error) Code {
+	var status *Status
+	switch {
+	case err == nil:
+		return OK
+	case errors.As(err, &status):
+		return status.Code
+	case errors.Is(err, context.Canceled):
+		return Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return DeadlineExceeded
+	}
+	return Unknown
+}
+
+type peerKey struct{}
+
+// Peer returns the address of the client making the call handled under ctx.
+func Peer(ctx context.Context) string {
+	peer, _ := ctx.Value(peerKey{}).(string)
+	return peer
+}
+
+// UnaryHandler answers one request message with one response message.
+type UnaryHandler func(ctx context.Context, req []byte) ([]byte, error)
+
+// StreamHandler answers one request message with any number of response
+// messages passed to send, until it returns.
+type StreamHandler func(ctx context.Context, req []byte, send func([]byte) error) error
+
+type method struct {
+	unary  UnaryHandler
+	stream StreamHandler
+}
+
+// Server routes /<service>/<method> requests to handlers. Register every
+// method before serving.
+type Server struct {
+	service string
+	methods map[string]method
+	// Observe, when set, is called after each call with the method name,
+	// the status code and how long the call took.
+	Observe func(method string, code Code, elapsed time.Duration)
+}
+
+// NewServer returns a server for the fully qualified service name, e.g.
+// "dnsres.v1.Resolver".
+func NewServer(service string) *Server {
+	return &Server{service: service, methods: make(map[string]method)}
+}
+
+// Unary registers a unary method.
+func (s *Server) Unary(name string, handler UnaryHandler) {
+	s.methods[name] = method{unary: handler}
+}
+
+// Stream registers a server-streaming method.
+func (s *Server) Stream(name string, handler StreamHandler) {
+	s.methods[name] = method{stream: handler}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || !isGRPCContentType(req.Header.Get("Content-Type")) {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	start := time.Now()
+	w.Header().Set("Content-Type", "application/grpc+proto")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	// Send headers before any message so the status always follows as
+	// trailers.
+	w.WriteHeader(http.StatusOK)
+
+	name, err := s.route(req.URL.Path)
+	if err == nil {
+		err = s.serve(w, req, s.methods[name])
+	}
+	code := CodeOf(err)
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(code)))
+	if err != nil {
+		message := err.Error()
+		var status *Status
+		if errors.As(err, &status) {
+			message = status.Message
+		}
+		w.Header().Set("Grpc-Message", encodeMessage(message))
+	}
+	if s.Observe != nil {
+		s.Observe(name, code, time.Since(start))
+	}
+}
+
+// route returns the method name of path, which must be /<service>/<method>
+// for a registered method.
+func (s *Server) route(path string) (string, error) {
+	service, name, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok || service != s.service {
+		return "", Errorf(Unimplemented, "unknown service %s", service)
+	}
+	if _, ok := s.methods[name]; !ok {
+		return "", Errorf(Unimplemented, "unknown method %s for service %s", name, service)
+	}
+	return name, nil
+}
+
+func (s *Server) serve(w http.ResponseWriter, req *http.Request, m method) error {
+	if encoding := req.Header.Get("Grpc-Encoding"); encoding != "" && encoding != "identity" {
+		return Errorf(Unimplemented, "compression %q is not supported", encoding)
+	}
+	ctx := context.WithValue(req.Context(), peerKey{}, req.RemoteAddr)
+	if timeout := req.Header.Get("Grpc-Timeout"); timeout != "" {
+		d, err := parseTimeout(timeout)
+		if err != nil {
+			return Errorf(InvalidArgument, "%v", err)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	in, err := readMessage(req.Body)
+	if err == io.EOF {
+		return Errorf(Internal, "missing request message")
+	}
+	if err != nil {
+		return err
+	}
+
+	flusher, _ := w.(http.Flusher)
+	send := func(out []byte) error {
+		if err := writeMessage(w, out); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	if m.stream != nil {
+		return m.stream(ctx, in, send)
+	}
+	out, err := m.unary(ctx, in)
+	if err != nil {
+		return err
+	}
+	return send(out)
+}
+
+func isGRPCContentType(contentType string) bool {
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// readMessage reads one length-prefixed message.
+func readMessage(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, Errorf(Internal, "truncated message header")
+		}
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, Errorf(Unimplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxMessageSize {
+		return nil, Errorf(ResourceExhausted, "message of %d bytes exceeds %d", size, maxMessageSize)
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, Errorf(Internal, "truncated message: %v", err)
+	}
+	return message, nil
+}
+
+// writeMessage writes one uncompressed length-prefixed message.
+func writeMessage(w io.Writer, message []byte) error {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	_, err := w.Write(append(frame, message...))
+	return err
+}
+
+var timeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// parseTimeout parses a grpc-timeout header value such as "250m".
+func parseTimeout(value string) (time.Duration, error) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+	unit, ok := timeoutUnits[value[len(value)-1]]
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// formatTimeout encodes d as a grpc-timeout header value, which allows at
+// most eight digits.
+func formatTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "0n"
+	}
+	for _, unit := range []struct {
+		suffix   string
+		duration time.Duration
+	}{{"n", time.Nanosecond}, {"u", time.Microsecond}, {"m", time.Millisecond}, {"S", time.Second}, {"M", time.Minute}} {
+		if n := (d + unit.duration - 1) / unit.duration; n < 1e8 {
+			return strconv.FormatInt(int64(n), 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64((d+time.Hour-1)/time.Hour), 10) + "H"
+}
+
+// encodeMessage percent-encodes a grpc-message value.
+func encodeMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func decodeMessage(message string) string {
+	decoded, err := url.PathUnescape(message)
+	if err != nil {
+		return message
+	}
+	return decoded
+}
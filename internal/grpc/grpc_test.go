@@ -0,0 +1,146 @@
+package grpc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serve starts an h2c test server for server and returns a client for it.
+func serve(t *testing.T, server *Server) *Client {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(server)
+	ts.Config.Protocols = new(http.Protocols)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return NewClient(strings.TrimPrefix(ts.URL, "http://"), "test.v1.Echo", nil)
+}
+
+func callContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestUnaryAndStream(t *testing.T) {
+	server := NewServer("test.v1.Echo")
+	var mu sync.Mutex
+	observed := map[string]Code{}
+	server.Observe = func(method string, code Code, elapsed time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		observed[method] = code
+	}
+	var deadline bool
+	server.Unary("Echo", func(ctx context.Context, req []byte) ([]byte, error) {
+		_, deadline = ctx.Deadline()
+		return append([]byte("echo:"), req...), nil
+	})
+	server.Unary("Fail", func(ctx context.Context, req []byte) ([]byte, error) {
+		return nil, Errorf(NotFound, "no such thing: %s 100%%\n", req)
+	})
+	server.Stream("Repeat", func(ctx context.Context, req []byte, send func([]byte) error) error {
+		for i := 0; i < 3; i++ {
+			if err := send(req); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	client := serve(t, server)
+	ctx := callContext(t)
+
+	out, err := client.Call(ctx, "Echo", []byte("hi"))
+	if err != nil || string(out) != "echo:hi" {
+		t.Fatalf("Echo = %q, %v", out, err)
+	}
+	if !deadline {
+		t.Error("handler context has no deadline from grpc-timeout")
+	}
+	out, err = client.Call(ctx, "Echo", nil)
+	if err != nil || string(out) != "echo:" {
+		t.Fatalf("Echo(empty) = %q, %v", out, err)
+	}
+
+	_, err = client.Call(ctx, "Fail", []byte("x"))
+	status, ok := err.(*Status)
+	if !ok || status.Code != NotFound || status.Message != "no such thing: x 100%\n" {
+		t.Fatalf("Fail error = %#v", err)
+	}
+
+	var messages []string
+	err = client.Stream(ctx, "Repeat", []byte("again"), func(message []byte) error {
+		messages = append(messages, string(message))
+		return nil
+	})
+	if err != nil || len(messages) != 3 || messages[2] != "again" {
+		t.Fatalf("Repeat = %q, %v", messages, err)
+	}
+
+	if _, err := client.Call(ctx, "Missing", nil); CodeOf(err) != Unimplemented {
+		t.Fatalf("Missing error = %v, want Unimplemented", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if observed["Echo"] != OK || observed["Fail"] != NotFound || observed["Repeat"] != OK {
+		t.Errorf("observed = %v", observed)
+	}
+}
+
+func TestStreamEndsWhenClientCancels(t *testing.T) {
+	server := NewServer("test.v1.Echo")
+	done := make(chan error, 1)
+	server.Stream("Forever", func(ctx context.Context, req []byte, send func([]byte) error) error {
+		for {
+			if err := send(req); err != nil {
+				done <- err
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				done <- ctx.Err()
+				return ctx.Err()
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	})
+	client := serve(t, server)
+
+	ctx, cancel := context.WithCancel(callContext(t))
+	received := 0
+	err := client.Stream(ctx, "Forever", []byte("tick"), func(message []byte) error {
+		received++
+		if received == 2 {
+			cancel()
+		}
+		return nil
+	})
+	if err == nil {
+		t.Fatal("Stream returned nil after cancel")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler still running after the client canceled")
+	}
+}
+
+func TestTimeoutHeader(t *testing.T) {
+	for _, d := range []time.Duration{time.Nanosecond, 1500 * time.Millisecond, 90 * time.Second, 1000 * time.Hour} {
+		parsed, err := parseTimeout(formatTimeout(d))
+		if err != nil || parsed < d {
+			t.Errorf("parseTimeout(formatTimeout(%v)) = %v, %v", d, parsed, err)
+		}
+	}
+	for _, value := range []string{"", "5", "5x", "-1S", "123456789S"} {
+		if _, err := parseTimeout(value); err == nil {
+			t.Errorf("parseTimeout(%q) succeeded", value)
+		}
+	}
+}
@@ -149,7 +149,7 @@ func runEndToEnd(t *testing.T, interval string, runDuration time.Duration, expec
 	wg.Wait()
 
 	stdout := stdoutBuf.String()
-	if !strings.Contains(stdout, "Loading configuration") {
+	if !strings.Contains(stdout, "Configuration loaded from "+configPath) {
 		t.Fatalf("expected config load output, got:\n%s", stdout)
 	}
 	if !strings.Contains(stdout, "Resolver initialized") {
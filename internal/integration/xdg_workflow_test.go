@@ -3,6 +3,7 @@
 package integration
 
 import (
+	"bytes"
 	"encoding/json"
 	"os"
 	"os/exec"
@@ -33,7 +34,7 @@ func TestXDGWorkflowEndToEnd(t *testing.T) {
 		t.Fatalf("build failed: %v\n%s", err, string(output))
 	}
 
-	t.Run("fresh install creates XDG config automatically", func(t *testing.T) {
+	t.Run("fresh install with -host writes no config", func(t *testing.T) {
 		testDir := t.TempDir()
 		xdgConfig := filepath.Join(testDir, "config")
 		xdgState := filepath.Join(testDir, "state")
@@ -44,6 +45,9 @@ func TestXDGWorkflowEndToEnd(t *testing.T) {
 			"XDG_STATE_HOME="+xdgState,
 		)
 		cmd.Dir = testDir // Change to temp dir so no local config.json exists
+		var output bytes.Buffer
+		cmd.Stdout = &output
+		cmd.Stderr = &output
 
 		// Run for 2 seconds then kill
 		if err := cmd.Start(); err != nil {
@@ -54,28 +58,14 @@ func TestXDGWorkflowEndToEnd(t *testing.T) {
 		cmd.Process.Kill()
 		cmd.Wait()
 
-		// Verify XDG config was created
-		configPath := filepath.Join(xdgConfig, "dnsres", "config.json")
-		if _, err := os.Stat(configPath); err != nil {
-			t.Errorf("expected XDG config to be created at %s: %v", configPath, err)
-		}
-
-		// Verify config has required fields
-		data, err := os.ReadFile(configPath)
-		if err != nil {
-			t.Fatalf("failed to read config: %v", err)
-		}
-
-		var cfg map[string]interface{}
-		if err := json.Unmarshal(data, &cfg); err != nil {
-			t.Fatalf("failed to parse config: %v", err)
+		if !strings.Contains(output.String(), "No configuration file found; using built-in defaults") {
+			t.Errorf("expected built-in defaults to be used, got:\n%s", output.String())
 		}
 
-		requiredFields := []string{"hostnames", "dns_servers", "query_interval"}
-		for _, field := range requiredFields {
-			if _, ok := cfg[field]; !ok {
-				t.Errorf("expected config to have field %q", field)
-			}
+		// Verify no XDG config was written
+		configPath := filepath.Join(xdgConfig, "dnsres", "config.json")
+		if _, err := os.Stat(configPath); !os.IsNotExist(err) {
+			t.Errorf("expected no config at %s, got %v", configPath, err)
 		}
 
 		// Verify XDG state directory for logs was created
@@ -94,6 +84,32 @@ func TestXDGWorkflowEndToEnd(t *testing.T) {
 		}
 	})
 
+	t.Run("fresh install without a terminal fails without writing a config", func(t *testing.T) {
+		testDir := t.TempDir()
+		xdgConfig := filepath.Join(testDir, "config")
+		xdgState := filepath.Join(testDir, "state")
+
+		// Stdin is /dev/null, so the setup wizard cannot run.
+		cmd := exec.Command(binPath)
+		cmd.Env = append(os.Environ(),
+			"XDG_CONFIG_HOME="+xdgConfig,
+			"XDG_STATE_HOME="+xdgState,
+		)
+		cmd.Dir = testDir
+		output, err := cmd.CombinedOutput()
+		if err == nil {
+			t.Fatalf("expected dnsres to fail without a config or terminal, got:\n%s", output)
+		}
+		if !strings.Contains(string(output), "no configuration file found") {
+			t.Errorf("expected a missing config error, got:\n%s", output)
+		}
+
+		configPath := filepath.Join(xdgConfig, "dnsres", "config.json")
+		if _, err := os.Stat(configPath); !os.IsNotExist(err) {
+			t.Errorf("expected no config at %s, got %v", configPath, err)
+		}
+	})
+
 	t.Run("existing local config.json takes precedence", func(t *testing.T) {
 		testDir := t.TempDir()
 		xdgConfig := filepath.Join(testDir, "config")
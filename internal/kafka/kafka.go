@@ -0,0 +1,462 @@
+// Package kafka is a minimal Kafka producer.
+//
+// It speaks just enough of the protocol to write records: Metadata to find
+// partition leaders and Produce with uncompressed v2 record batches. Keyed
+// records are partitioned like the Java client's default partitioner;
+// records without a key are spread round-robin.
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Acknowledgement levels.
+const (
+	AcksAll    int16 = -1
+	AcksLeader int16 = 1
+)
+
+// maxResponseSize bounds the responses read from a broker.
+const maxResponseSize = 64 << 20
+
+// Error is a Kafka protocol error code.
+type Error int16
+
+var errorNames = map[Error]string{
+	1:  "offset out of range",
+	2:  "corrupt message",
+	3:  "unknown topic or partition",
+	5:  "leader not available",
+	6:  "not leader or follower",
+	7:  "request timed out",
+	10: "message too large",
+	13: "network exception",
+	14: "coordinator load in progress",
+	19: "not enough replicas",
+	20: "not enough replicas after append",
+	29: "topic authorization failed",
+	31: "cluster authorization failed",
+	35: "unsupported version",
+	87: "invalid record",
+}
+
+func (e Error) Error() string {
+	if name, ok := errorNames[e]; ok {
+		return "kafka: " + name
+	}
+	return fmt.Sprintf("kafka: error code %d", int16(e))
+}
+
+// Retriable reports whether the request may succeed if retried, usually
+// after refreshing metadata.
+func (e Error) Retriable() bool {
+	switch e {
+	case 2, 3, 5, 6, 7, 13, 14, 19, 20:
+		return true
+	}
+	return false
+}
+
+// Config configures a Producer.
+type Config struct {
+	// Brokers are bootstrap host:port addresses.
+	Brokers  []string
+	ClientID string
+	// RequiredAcks is AcksAll (the default when zero) or AcksLeader.
+	RequiredAcks int16
+	// Timeout bounds dialing and each request. Zero uses 10 seconds.
+	Timeout time.Duration
+	// TLS, when set, connects to brokers over TLS.
+	TLS *tls.Config
+	// MaxRetries is how many times records that failed with a retriable
+	// error are resent.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubled for each
+	// later one. Zero uses 100 milliseconds.
+	RetryBackoff time.Duration
+}
+
+func (c Config) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return c.Timeout
+}
+
+func (c Config) acks() int16 {
+	if c.RequiredAcks == 0 {
+		return AcksAll
+	}
+	return c.RequiredAcks
+}
+
+type partition struct {
+	id     int32
+	leader int32
+}
+
+// Producer writes records to Kafka topics. It is safe for concurrent use,
+// though requests are sent one at a time.
+type Producer struct {
+	config Config
+
+	mu            sync.Mutex
+	correlationID int32
+	brokers       map[int32]string
+	conns         map[string]*brokerConn
+	topics        map[string][]partition
+	next          int
+}
+
+// NewProducer returns a producer for the cluster. It connects lazily, on
+// the first Produce.
+func NewProducer(config Config) (*Producer, error) {
+	if len(config.Brokers) == 0 {
+		return nil, errors.New("kafka: no brokers")
+	}
+	if acks := config.acks(); acks != AcksAll && acks != AcksLeader {
+		return nil, fmt.Errorf("kafka: unsupported required acks %d", acks)
+	}
+	return &Producer{
+		config:  config,
+		brokers: make(map[int32]string),
+		conns:   make(map[string]*brokerConn),
+		topics:  make(map[string][]partition),
+	}, nil
+}
+
+// Close closes all broker connections.
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, conn := range p.conns {
+		conn.close()
+		delete(p.conns, addr)
+	}
+	return nil
+}
+
+// Produce writes messages to topic, retrying those that fail with retriable
+// errors. It returns once every message is acknowledged or the retries are
+// used up.
+func (p *Producer) Produce(ctx context.Context, topic string, messages []Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pending := messages
+	backoff := p.config.RetryBackoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	for attempt := 0; ; attempt++ {
+		failed, err := p.produceOnce(ctx, topic, pending)
+		if err == nil {
+			return nil
+		}
+		var kafkaErr Error
+		if errors.As(err, &kafkaErr) && !kafkaErr.Retriable() {
+			return err
+		}
+		if attempt >= p.config.MaxRetries || ctx.Err() != nil {
+			return fmt.Errorf("%d of %d records not written: %w", len(failed), len(messages), err)
+		}
+		// Leadership may have moved; look it up again before retrying.
+		delete(p.topics, topic)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff << attempt):
+		}
+		pending = failed
+	}
+}
+
+// produceOnce sends one produce request per partition leader and returns
+// the messages that were not written.
+func (p *Producer) produceOnce(ctx context.Context, topic string, messages []Message) ([]Message, error) {
+	partitions, err := p.partitions(ctx, topic)
+	if err != nil {
+		return messages, err
+	}
+
+	byPartition := make(map[int32][]Message)
+	for _, message := range messages {
+		var index int
+		if message.Key != nil {
+			index = int(partitionFor(message.Key, len(partitions)))
+		} else {
+			index = p.next % len(partitions)
+			p.next++
+		}
+		id := partitions[index].id
+		byPartition[id] = append(byPartition[id], message)
+	}
+	byLeader := make(map[int32][]int32)
+	for _, part := range partitions {
+		if _, ok := byPartition[part.id]; ok {
+			byLeader[part.leader] = append(byLeader[part.leader], part.id)
+		}
+	}
+
+	var failed []Message
+	var lastErr error
+	for leader, ids := range byLeader {
+		errs, err := p.produceTo(ctx, leader, topic, ids, byPartition)
+		if err != nil {
+			lastErr = err
+			for _, id := range ids {
+				failed = append(failed, byPartition[id]...)
+			}
+			continue
+		}
+		for id, code := range errs {
+			lastErr = code
+			failed = append(failed, byPartition[id]...)
+		}
+	}
+	return failed, lastErr
+}
+
+// produceTo sends the partitions' records to leader, returning the
+// partitions that failed with their error codes.
+func (p *Producer) produceTo(ctx context.Context, leader int32, topic string, ids []int32, byPartition map[int32][]Message) (map[int32]Error, error) {
+	if leader < 0 {
+		return nil, Error(5)
+	}
+	addr, ok := p.brokers[leader]
+	if !ok {
+		return nil, fmt.Errorf("kafka: unknown leader %d", leader)
+	}
+
+	var body encoder
+	body.nullableString("") // Transactional ID
+	body.int16(p.config.acks())
+	body.int32(int32(p.config.timeout() / time.Millisecond))
+	body.int32(1)
+	body.string(topic)
+	body.int32(int32(len(ids)))
+	for _, id := range ids {
+		body.int32(id)
+		body.bytes(encodeRecordBatch(byPartition[id]))
+	}
+	response, err := p.roundTrip(ctx, addr, apiProduce, produceVersion, body.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make(map[int32]Error)
+	acked := make(map[int32]bool)
+	d := &decoder{buf: response}
+	for i, topics := 0, d.arrayLen(); i < topics; i++ {
+		d.string()
+		for j, parts := 0, d.arrayLen(); j < parts; j++ {
+			id := d.int32()
+			code := Error(d.int16())
+			d.int64() // Base offset
+			d.int64() // Log append time
+			acked[id] = true
+			if code != 0 {
+				errs[id] = code
+			}
+		}
+	}
+	if d.err != nil {
+		p.dropConn(addr)
+		return nil, d.err
+	}
+	for _, id := range ids {
+		if !acked[id] {
+			errs[id] = Error(13)
+		}
+	}
+	return errs, nil
+}
+
+// partitions returns topic's partitions, fetching metadata when they are
+// not known.
+func (p *Producer) partitions(ctx context.Context, topic string) ([]partition, error) {
+	if partitions, ok := p.topics[topic]; ok {
+		return partitions, nil
+	}
+
+	var body encoder
+	body.int32(1)
+	body.string(topic)
+	body.bool(false) // Do not auto-create the topic
+
+	addrs := append([]string(nil), p.config.Brokers...)
+	for _, addr := range p.brokers {
+		addrs = append(addrs, addr)
+	}
+	var lastErr error
+	for _, addr := range addrs {
+		response, err := p.roundTrip(ctx, addr, apiMetadata, metadataVersion, body.buf)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		partitions, err := p.parseMetadata(response, topic)
+		if err != nil {
+			return nil, err
+		}
+		p.topics[topic] = partitions
+		return partitions, nil
+	}
+	return nil, fmt.Errorf("kafka metadata: %w", lastErr)
+}
+
+func (p *Producer) parseMetadata(response []byte, topic string) ([]partition, error) {
+	d := &decoder{buf: response}
+	d.int32() // Throttle time
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		node := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // Rack
+		p.brokers[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // Cluster ID
+	d.int32()  // Controller ID
+
+	var partitions []partition
+	var topicErr Error
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		code := Error(d.int16())
+		name := d.string()
+		d.bool() // Internal
+		for j, parts := 0, d.arrayLen(); j < parts; j++ {
+			d.int16() // Partition error, e.g. no leader; reported on produce
+			part := partition{id: d.int32(), leader: d.int32()}
+			for k, replicas := 0, d.arrayLen(); k < replicas; k++ {
+				d.int32()
+			}
+			for k, isr := 0, d.arrayLen(); k < isr; k++ {
+				d.int32()
+			}
+			if name == topic {
+				partitions = append(partitions, part)
+			}
+		}
+		if name == topic {
+			topicErr = code
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if topicErr != 0 {
+		return nil, topicErr
+	}
+	if len(partitions) == 0 {
+		return nil, Error(3)
+	}
+	return partitions, nil
+}
+
+// roundTrip sends one request to addr and returns the response body after
+// the correlation ID.
+func (p *Producer) roundTrip(ctx context.Context, addr string, apiKey, apiVersion int16, body []byte) ([]byte, error) {
+	conn, err := p.conn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	p.correlationID++
+	id := p.correlationID
+
+	var request encoder
+	request.int32(0) // Size, filled in below
+	requestHeader(&request, apiKey, apiVersion, id, p.config.ClientID)
+	request.buf = append(request.buf, body...)
+	binary.BigEndian.PutUint32(request.buf, uint32(len(request.buf)-4))
+
+	deadline := time.Now().Add(p.config.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.conn.SetDeadline(deadline)
+	response, err := conn.exchange(request.buf)
+	if err != nil {
+		p.dropConn(addr)
+		return nil, err
+	}
+	if got := int32(binary.BigEndian.Uint32(response)); got != id {
+		p.dropConn(addr)
+		return nil, fmt.Errorf("kafka: correlation ID %d, expected %d", got, id)
+	}
+	return response[4:], nil
+}
+
+func (p *Producer) conn(ctx context.Context, addr string) (*brokerConn, error) {
+	if conn, ok := p.conns[addr]; ok {
+		return conn, nil
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, p.config.timeout())
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(dialCtx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if p.config.TLS != nil {
+		config := p.config.TLS.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(dialCtx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	broker := &brokerConn{conn: conn, reader: bufio.NewReader(conn)}
+	p.conns[addr] = broker
+	return broker, nil
+}
+
+func (p *Producer) dropConn(addr string) {
+	if conn, ok := p.conns[addr]; ok {
+		conn.close()
+		delete(p.conns, addr)
+	}
+}
+
+type brokerConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// exchange writes a size-prefixed request and reads the size-prefixed
+// response.
+func (c *brokerConn) exchange(request []byte) ([]byte, error) {
+	if _, err := c.conn.Write(request); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.reader, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > maxResponseSize {
+		return nil, fmt.Errorf("kafka: invalid response size %d", n)
+	}
+	response := make([]byte, n)
+	if _, err := io.ReadFull(c.reader, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *brokerConn) close() {
+	c.conn.Close()
+}
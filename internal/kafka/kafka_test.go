@@ -0,0 +1,250 @@
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMurmur2(t *testing.T) {
+	// Vectors from Kafka's own partitioner tests.
+	tests := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+	for input, want := range tests {
+		if got := murmur2([]byte(input)); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", input, got, want)
+		}
+	}
+}
+
+type produced struct {
+	partition  int32
+	key, value string
+}
+
+// fakeBroker answers Metadata with itself as the leader of two partitions
+// and records the records it is sent. The first failures produce requests
+// are rejected with failCode.
+type fakeBroker struct {
+	t        *testing.T
+	addr     string
+	failures int
+	failCode int16
+
+	mu       sync.Mutex
+	produces int
+	records  []produced
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	broker := &fakeBroker{t: t, addr: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		d := &decoder{buf: request}
+		apiKey, _, correlationID := d.int16(), d.int16(), d.int32()
+		d.string() // Client ID
+
+		var response encoder
+		response.int32(0)
+		response.int32(correlationID)
+		switch apiKey {
+		case apiMetadata:
+			host, portText, _ := net.SplitHostPort(b.addr)
+			port, _ := strconv.Atoi(portText)
+			d.arrayLen()
+			topic := d.string()
+			response.int32(0) // Throttle
+			response.int32(1)
+			response.int32(7)
+			response.string(host)
+			response.int32(int32(port))
+			response.nullableString("")
+			response.nullableString("cluster")
+			response.int32(7)
+			response.int32(1)
+			response.int16(0)
+			response.string(topic)
+			response.bool(false)
+			response.int32(2)
+			for id := int32(0); id < 2; id++ {
+				response.int16(0)
+				response.int32(id)
+				response.int32(7)
+				response.int32(0)
+				response.int32(0)
+			}
+		case apiProduce:
+			response.buf = append(response.buf, b.produce(d)...)
+		}
+		binary.BigEndian.PutUint32(response.buf, uint32(len(response.buf)-4))
+		if _, err := conn.Write(response.buf); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) produce(d *decoder) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.produces++
+	fail := b.produces <= b.failures
+
+	d.string() // Transactional ID
+	if acks := d.int16(); acks != AcksAll {
+		b.t.Errorf("expected acks=all, got %d", acks)
+	}
+	d.int32() // Timeout
+	var response encoder
+	response.int32(int32(d.arrayLen()))
+	topic := d.string()
+	response.string(topic)
+	parts := d.arrayLen()
+	response.int32(int32(parts))
+	for i := 0; i < parts; i++ {
+		id := d.int32()
+		batch := d.bytes()
+		code := int16(0)
+		if fail {
+			code = b.failCode
+		} else {
+			b.records = append(b.records, decodeBatch(b.t, id, batch)...)
+		}
+		response.int32(id)
+		response.int16(code)
+		response.int64(0)
+		response.int64(-1)
+	}
+	response.int32(0) // Throttle
+	return response.buf
+}
+
+func decodeBatch(t *testing.T, partition int32, batch []byte) []produced {
+	d := &decoder{buf: batch}
+	d.int64() // Base offset
+	length := d.int32()
+	d.int32() // Leader epoch
+	if magic := d.int8(); magic != 2 {
+		t.Errorf("expected magic 2, got %d", magic)
+	}
+	crc := uint32(d.int32())
+	if int(length) != len(batch)-12 {
+		t.Errorf("batch length %d does not match %d bytes", length, len(batch)-12)
+	}
+	if got := crc32.Checksum(d.buf, castagnoli); got != crc {
+		t.Errorf("batch CRC %#x, computed %#x", crc, got)
+	}
+	d.int16() // Attributes
+	d.int32() // Last offset delta
+	d.int64()
+	d.int64()
+	d.int64()
+	d.int16()
+	d.int32()
+	var records []produced
+	for i, n := 0, int(d.int32()); i < n; i++ {
+		d.varint() // Length
+		d.int8()
+		d.varint()
+		d.varint()
+		key := d.varbytes()
+		value := d.varbytes()
+		d.varint() // Headers
+		records = append(records, produced{partition: partition, key: string(key), value: string(value)})
+	}
+	if d.err != nil {
+		t.Errorf("decoding batch: %v", d.err)
+	}
+	return records
+}
+
+func TestProducerProduce(t *testing.T) {
+	broker := newFakeBroker(t)
+	producer, err := NewProducer(Config{Brokers: []string{broker.addr}, ClientID: "dnsres"})
+	if err != nil {
+		t.Fatalf("NewProducer: %v", err)
+	}
+	defer producer.Close()
+
+	now := time.Now()
+	messages := []Message{
+		{Key: []byte("a.example.com"), Value: []byte("1"), Time: now},
+		{Key: []byte("b.example.com"), Value: []byte("2"), Time: now.Add(time.Millisecond)},
+		{Key: []byte("a.example.com"), Value: []byte("3"), Time: now.Add(2 * time.Millisecond)},
+	}
+	if err := producer.Produce(context.Background(), "results", messages); err != nil {
+		t.Fatalf("Produce: %v", err)
+	}
+	if len(broker.records) != 3 {
+		t.Fatalf("expected 3 records, got %+v", broker.records)
+	}
+	partitions := make(map[string]int32)
+	for _, record := range broker.records {
+		if p, ok := partitions[record.key]; ok && p != record.partition {
+			t.Fatalf("records for %s landed on partitions %d and %d", record.key, p, record.partition)
+		}
+		partitions[record.key] = record.partition
+		if want := partitionFor([]byte(record.key), 2); record.partition != want {
+			t.Fatalf("record for %s on partition %d, want %d", record.key, record.partition, want)
+		}
+	}
+}
+
+func TestProducerRetries(t *testing.T) {
+	broker := newFakeBroker(t)
+	broker.failures, broker.failCode = 1, 6 // Not leader
+	producer, _ := NewProducer(Config{Brokers: []string{broker.addr}, MaxRetries: 2, RetryBackoff: time.Millisecond})
+	defer producer.Close()
+
+	message := []Message{{Key: []byte("a"), Value: []byte("v"), Time: time.Now()}}
+	if err := producer.Produce(context.Background(), "results", message); err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	if broker.produces != 2 || len(broker.records) != 1 {
+		t.Fatalf("expected one failed and one successful produce, got %d produces and %d records", broker.produces, len(broker.records))
+	}
+
+	// Errors that retrying cannot fix are returned at once.
+	broker.failures, broker.failCode, broker.produces = 5, 10, 0 // Message too large
+	err := producer.Produce(context.Background(), "results", message)
+	if err != Error(10) || broker.produces != 1 {
+		t.Fatalf("expected an immediate message too large error, got %v after %d produces", err, broker.produces)
+	}
+}
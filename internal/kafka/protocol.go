@@ -0,0 +1,273 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"time"
+)
+
+// API keys and the versions this client speaks.
+const (
+	apiProduce      = 0
+	apiMetadata     = 3
+	produceVersion  = 3
+	metadataVersion = 4
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var errShortBuffer = errors.New("kafka: short response")
+
+// encoder appends Kafka protocol primitives to a buffer.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) int8(v int8)   { e.buf = append(e.buf, byte(v)) }
+func (e *encoder) int16(v int16) { e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v)) }
+func (e *encoder) int32(v int32) { e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v)) }
+func (e *encoder) int64(v int64) { e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v)) }
+func (e *encoder) bool(v bool) {
+	if v {
+		e.int8(1)
+	} else {
+		e.int8(0)
+	}
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// nullableString writes -1 for the empty string.
+func (e *encoder) nullableString(s string) {
+	if s == "" {
+		e.int16(-1)
+		return
+	}
+	e.string(s)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) varint(v int64) { e.buf = binary.AppendVarint(e.buf, v) }
+
+// varbytes writes a varint length, -1 for nil, and b.
+func (e *encoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// decoder reads Kafka protocol primitives, remembering the first error.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.buf) < n {
+		d.err = errShortBuffer
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) bool() bool { return d.int8() != 0 }
+
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// arrayLen reads an array length, treating null arrays as empty.
+func (d *decoder) arrayLen() int {
+	n := d.int32()
+	if n < 0 || d.err != nil {
+		return 0
+	}
+	if int(n) > len(d.buf) {
+		// Every element takes at least a byte.
+		d.err = errShortBuffer
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errShortBuffer
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) varbytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// requestHeader starts a request (header v1) in e.
+func requestHeader(e *encoder, apiKey, apiVersion int16, correlationID int32, clientID string) {
+	e.int16(apiKey)
+	e.int16(apiVersion)
+	e.int32(correlationID)
+	e.nullableString(clientID)
+}
+
+// Message is one record to produce.
+type Message struct {
+	Key   []byte
+	Value []byte
+	Time  time.Time
+}
+
+// encodeRecordBatch encodes messages as an uncompressed v2 record batch.
+func encodeRecordBatch(messages []Message) []byte {
+	first, last := messages[0].Time, messages[0].Time
+	for _, message := range messages {
+		if message.Time.Before(first) {
+			first = message.Time
+		}
+		if message.Time.After(last) {
+			last = message.Time
+		}
+	}
+
+	var records encoder
+	for i, message := range messages {
+		var record encoder
+		record.int8(0) // Attributes
+		record.varint(message.Time.Sub(first).Milliseconds())
+		record.varint(int64(i))
+		record.varbytes(message.Key)
+		record.varbytes(message.Value)
+		record.varint(0) // Headers
+		records.varint(int64(len(record.buf)))
+		records.buf = append(records.buf, record.buf...)
+	}
+
+	// The CRC covers everything from the attributes on.
+	var body encoder
+	body.int16(0) // Attributes: no compression, create time
+	body.int32(int32(len(messages) - 1))
+	body.int64(first.UnixMilli())
+	body.int64(last.UnixMilli())
+	body.int64(-1) // Producer ID
+	body.int16(-1) // Producer epoch
+	body.int32(-1) // Base sequence
+	body.int32(int32(len(messages)))
+	body.buf = append(body.buf, records.buf...)
+
+	var batch encoder
+	batch.int64(0) // Base offset, assigned by the broker
+	batch.int32(int32(4 + 1 + 4 + len(body.buf)))
+	batch.int32(-1) // Partition leader epoch
+	batch.int8(2)   // Magic
+	batch.buf = binary.BigEndian.AppendUint32(batch.buf, crc32.Checksum(body.buf, castagnoli))
+	batch.buf = append(batch.buf, body.buf...)
+	return batch.buf
+}
+
+// murmur2 is the hash Kafka's default partitioner applies to keys, so
+// records land on the same partitions as they would from the Java client.
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+	length := len(data)
+	h := seed ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// partitionFor maps key onto one of n partitions like Kafka's default
+// partitioner.
+func partitionFor(key []byte, n int) int32 {
+	return int32((murmur2(key) & math.MaxInt32) % int32(n))
+}
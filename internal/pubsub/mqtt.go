@@ -0,0 +1,252 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MQTT control packet types, already shifted into the fixed header's high
+// nibble.
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPingreq    = 0xc0
+	mqttPingresp   = 0xd0
+	mqttDisconnect = 0xe0
+)
+
+// mqttMaxRemaining is the largest remaining length a packet can encode.
+const mqttMaxRemaining = 268435455
+
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// mqttClient publishes with QoS 0 over an MQTT 3.1.1 connection.
+type mqttClient struct {
+	conn net.Conn
+
+	mu        sync.Mutex
+	err       error
+	lastWrite time.Time
+
+	done chan struct{}
+	once sync.Once
+}
+
+// DialMQTT connects to an MQTT broker and waits for it to accept the
+// session.
+func DialMQTT(ctx context.Context, opts Options) (Publisher, error) {
+	conn, err := dial(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	reader := bufio.NewReader(conn)
+	if err := mqttHandshake(conn, reader, opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := &mqttClient{conn: conn, lastWrite: time.Now(), done: make(chan struct{})}
+	go client.read(reader)
+	go client.keepAlive(opts.keepAlive())
+	return client, nil
+}
+
+func mqttHandshake(conn net.Conn, reader *bufio.Reader, opts Options) error {
+	var flags byte = 0x02 // Clean session
+	if opts.Username != "" {
+		flags |= 0x80
+		if opts.Password != "" {
+			flags |= 0x40
+		}
+	}
+	keepAlive := opts.keepAlive() / time.Second
+	if keepAlive > 0xffff {
+		keepAlive = 0xffff
+	}
+
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	body = append(body, 4, flags) // Protocol level 4 is MQTT 3.1.1
+	body = binary.BigEndian.AppendUint16(body, uint16(keepAlive))
+	body = appendMQTTString(body, opts.ClientID)
+	if opts.Username != "" {
+		body = appendMQTTString(body, opts.Username)
+		if opts.Password != "" {
+			body = appendMQTTString(body, opts.Password)
+		}
+	}
+	packet, err := mqttPacket(mqttConnect, body)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(packet); err != nil {
+		return err
+	}
+
+	kind, payload, err := readMQTTPacket(reader)
+	if err != nil {
+		return fmt.Errorf("mqtt connect: %w", err)
+	}
+	if kind != mqttConnack || len(payload) != 2 {
+		return fmt.Errorf("mqtt connect: unexpected packet type %#x", kind)
+	}
+	if code := payload[1]; code != 0 {
+		reason, ok := mqttConnackErrors[code]
+		if !ok {
+			reason = fmt.Sprintf("code %d", code)
+		}
+		return fmt.Errorf("mqtt connect refused: %s", reason)
+	}
+	return nil
+}
+
+// Publish sends payload to topic with QoS 0.
+func (c *mqttClient) Publish(topic string, payload []byte) error {
+	if topic == "" {
+		return errors.New("mqtt topic must not be empty")
+	}
+	body := appendMQTTString(nil, topic)
+	body = append(body, payload...)
+	packet, err := mqttPacket(mqttPublish, body)
+	if err != nil {
+		return err
+	}
+	return c.write(packet)
+}
+
+// Close disconnects from the broker.
+func (c *mqttClient) Close() error {
+	c.write([]byte{mqttDisconnect, 0})
+	c.once.Do(func() { close(c.done) })
+	return c.conn.Close()
+}
+
+func (c *mqttClient) write(packet []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	if _, err := c.conn.Write(packet); err != nil {
+		c.err = err
+		return err
+	}
+	c.lastWrite = time.Now()
+	return nil
+}
+
+func (c *mqttClient) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.conn.Close()
+}
+
+// read consumes ping responses until the connection fails, so a broker
+// that hangs up is noticed on the next publish.
+func (c *mqttClient) read(reader *bufio.Reader) {
+	for {
+		kind, _, err := readMQTTPacket(reader)
+		if err != nil {
+			c.fail(fmt.Errorf("mqtt connection lost: %w", err))
+			return
+		}
+		if kind != mqttPingresp {
+			c.fail(fmt.Errorf("mqtt: unexpected packet type %#x", kind))
+			return
+		}
+	}
+}
+
+// keepAlive pings the broker when nothing has been sent for interval.
+func (c *mqttClient) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			idle := time.Since(c.lastWrite) >= interval/2
+			c.mu.Unlock()
+			if idle && c.write([]byte{mqttPingreq, 0}) != nil {
+				return
+			}
+		}
+	}
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttPacket prepends the fixed header to body.
+func mqttPacket(kind byte, body []byte) ([]byte, error) {
+	if len(body) > mqttMaxRemaining {
+		return nil, fmt.Errorf("mqtt packet of %d bytes is too large", len(body))
+	}
+	packet := []byte{kind}
+	for n := len(body); ; {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...), nil
+}
+
+// readMQTTPacket reads one packet, returning its type (the high nibble of
+// the first byte) and body.
+func readMQTTPacket(reader *bufio.Reader) (byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header & 0xf0, body, nil
+}
@@ -0,0 +1,173 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsClient publishes over the NATS text protocol.
+type natsClient struct {
+	conn net.Conn
+
+	mu  sync.Mutex
+	err error
+}
+
+// natsConnect is the CONNECT options document.
+type natsConnect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name,omitempty"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+	Lang     string `json:"lang"`
+	Version  string `json:"version"`
+	Protocol int    `json:"protocol"`
+}
+
+// DialNATS connects to a NATS server and waits for it to accept the
+// credentials.
+func DialNATS(ctx context.Context, opts Options) (Publisher, error) {
+	conn, err := dial(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	reader := bufio.NewReader(conn)
+	if err := natsHandshake(conn, reader, opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := &natsClient{conn: conn}
+	go client.read(reader)
+	return client, nil
+}
+
+func natsHandshake(conn net.Conn, reader *bufio.Reader, opts Options) error {
+	line, err := readNATSLine(reader)
+	if err != nil {
+		return fmt.Errorf("nats connect: %w", err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("nats connect: expected INFO, got %q", line)
+	}
+
+	connect, err := json.Marshal(natsConnect{
+		Name:     opts.ClientID,
+		User:     opts.Username,
+		Pass:     opts.Password,
+		Lang:     "go",
+		Version:  "dnsres",
+		Protocol: 1,
+	})
+	if err != nil {
+		return err
+	}
+	// The PING's PONG confirms the server accepted CONNECT; a rejected one
+	// is answered with -ERR instead.
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		return err
+	}
+	for {
+		line, err := readNATSLine(reader)
+		if err != nil {
+			return fmt.Errorf("nats connect: %w", err)
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats connect refused: %s", natsError(line))
+		}
+	}
+}
+
+// Publish sends payload to the subject topic.
+func (c *natsClient) Publish(topic string, payload []byte) error {
+	if topic == "" || strings.ContainsAny(topic, " \t\r\n") {
+		return fmt.Errorf("invalid nats subject %q", topic)
+	}
+	msg := make([]byte, 0, len(topic)+len(payload)+32)
+	msg = append(msg, "PUB "...)
+	msg = append(msg, topic...)
+	msg = append(msg, ' ')
+	msg = strconv.AppendInt(msg, int64(len(payload)), 10)
+	msg = append(msg, "\r\n"...)
+	msg = append(msg, payload...)
+	msg = append(msg, "\r\n"...)
+	return c.write(msg)
+}
+
+// Close closes the connection.
+func (c *natsClient) Close() error {
+	c.fail(errors.New("nats connection closed"))
+	return nil
+}
+
+func (c *natsClient) write(msg []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	if _, err := c.conn.Write(msg); err != nil {
+		c.err = err
+		return err
+	}
+	return nil
+}
+
+func (c *natsClient) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.conn.Close()
+}
+
+// read answers server pings and records errors the server reports, such as
+// a permissions violation, so the next publish returns them.
+func (c *natsClient) read(reader *bufio.Reader) {
+	for {
+		line, err := readNATSLine(reader)
+		if err != nil {
+			c.fail(fmt.Errorf("nats connection lost: %w", err))
+			return
+		}
+		switch {
+		case line == "PING":
+			if c.write([]byte("PONG\r\n")) != nil {
+				return
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			c.fail(fmt.Errorf("nats: %s", natsError(line)))
+			return
+		}
+	}
+}
+
+func readNATSLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// natsError extracts the message from a "-ERR 'message'" line.
+func natsError(line string) string {
+	return strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")), "'")
+}
@@ -0,0 +1,83 @@
+// Package pubsub publishes messages to MQTT brokers and NATS servers.
+//
+// Both clients implement only what publishing needs: MQTT 3.1.1 with QoS 0
+// and the NATS text protocol's PUB. Neither subscribes or retries; callers
+// redial after an error.
+package pubsub
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Backends.
+const (
+	MQTT = "mqtt"
+	NATS = "nats"
+)
+
+// Options configures a connection.
+type Options struct {
+	// Address is the broker's host:port.
+	Address  string
+	Username string
+	Password string
+	// ClientID identifies the MQTT client; NATS reports it as the
+	// connection name.
+	ClientID string
+	// TLS, when set, wraps the connection in TLS with this configuration.
+	TLS *tls.Config
+	// KeepAlive is how often the connection is pinged while idle. Zero
+	// uses 30 seconds.
+	KeepAlive time.Duration
+}
+
+// Publisher sends messages over one broker connection. It is safe for
+// concurrent use.
+type Publisher interface {
+	Publish(topic string, payload []byte) error
+	Close() error
+}
+
+// Dial connects to a broker of the given backend.
+func Dial(ctx context.Context, backend string, opts Options) (Publisher, error) {
+	switch backend {
+	case MQTT:
+		return DialMQTT(ctx, opts)
+	case NATS:
+		return DialNATS(ctx, opts)
+	}
+	return nil, fmt.Errorf("unknown pubsub backend %q", backend)
+}
+
+func (o Options) keepAlive() time.Duration {
+	if o.KeepAlive <= 0 {
+		return 30 * time.Second
+	}
+	return o.KeepAlive
+}
+
+// dial opens the TCP connection, with TLS when configured.
+func dial(ctx context.Context, opts Options) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", opts.Address)
+	if err != nil {
+		return nil, err
+	}
+	if opts.TLS == nil {
+		return conn, nil
+	}
+	config := opts.TLS.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(opts.Address)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
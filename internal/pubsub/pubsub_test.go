@@ -0,0 +1,153 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listen starts a one-connection fake broker running serve.
+func listen(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}()
+	return listener.Addr().String()
+}
+
+func dialContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestMQTTPublish(t *testing.T) {
+	type published struct {
+		topic, payload string
+	}
+	connects := make(chan []byte, 1)
+	publishes := make(chan published, 1)
+	addr := listen(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		kind, body, err := readMQTTPacket(reader)
+		if err != nil || kind != mqttConnect {
+			return
+		}
+		connects <- body
+		conn.Write([]byte{mqttConnack, 2, 0, 0})
+		kind, body, err = readMQTTPacket(reader)
+		if err != nil || kind != mqttPublish {
+			return
+		}
+		n := binary.BigEndian.Uint16(body)
+		publishes <- published{topic: string(body[2 : 2+n]), payload: string(body[2+n:])}
+	})
+
+	client, err := DialMQTT(dialContext(t), Options{Address: addr, ClientID: "dnsres-test", Username: "user", Password: "secret"})
+	if err != nil {
+		t.Fatalf("DialMQTT: %v", err)
+	}
+	defer client.Close()
+
+	connect := <-connects
+	if !strings.Contains(string(connect), "dnsres-test") || connect[7]&0xc0 != 0xc0 {
+		t.Fatalf("expected client id and credentials in CONNECT, got %q", connect)
+	}
+	payload := strings.Repeat("x", 200) // Needs a two-byte remaining length
+	if err := client.Publish("dnsres/events", []byte(payload)); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	got := <-publishes
+	if got.topic != "dnsres/events" || got.payload != payload {
+		t.Fatalf("unexpected publish %+v", got)
+	}
+}
+
+func TestMQTTConnectRefused(t *testing.T) {
+	addr := listen(t, func(conn net.Conn) {
+		readMQTTPacket(bufio.NewReader(conn))
+		conn.Write([]byte{mqttConnack, 2, 0, 5})
+	})
+	_, err := DialMQTT(dialContext(t), Options{Address: addr})
+	if err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Fatalf("expected not authorized error, got %v", err)
+	}
+}
+
+func TestNATSPublish(t *testing.T) {
+	lines := make(chan string, 8)
+	addr := listen(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		io.WriteString(conn, "INFO {\"server_id\":\"test\"}\r\n")
+		for {
+			line, err := readNATSLine(reader)
+			if err != nil {
+				return
+			}
+			lines <- line
+			switch {
+			case line == "PING":
+				io.WriteString(conn, "PONG\r\nPING\r\n")
+			case strings.HasPrefix(line, "PUB "):
+				payload, _ := readNATSLine(reader)
+				lines <- payload
+			}
+		}
+	})
+
+	client, err := DialNATS(dialContext(t), Options{Address: addr, ClientID: "dnsres-test", Username: "user", Password: "secret"})
+	if err != nil {
+		t.Fatalf("DialNATS: %v", err)
+	}
+	defer client.Close()
+
+	if connect := <-lines; !strings.HasPrefix(connect, "CONNECT ") || !strings.Contains(connect, `"user":"user"`) {
+		t.Fatalf("expected CONNECT with credentials, got %q", connect)
+	}
+	if ping := <-lines; ping != "PING" {
+		t.Fatalf("expected PING after CONNECT, got %q", ping)
+	}
+	// The client answers the server's PING.
+	if pong := <-lines; pong != "PONG" {
+		t.Fatalf("expected PONG, got %q", pong)
+	}
+	if err := client.Publish("dnsres.events", []byte(`{"Type":"inconsistent"}`)); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if pub := <-lines; pub != "PUB dnsres.events 23" {
+		t.Fatalf("unexpected PUB line %q", pub)
+	}
+	if payload := <-lines; payload != `{"Type":"inconsistent"}` {
+		t.Fatalf("unexpected payload %q", payload)
+	}
+	if err := client.Publish("bad subject", nil); err == nil {
+		t.Fatal("expected an error for a subject with whitespace")
+	}
+}
+
+func TestNATSConnectRefused(t *testing.T) {
+	addr := listen(t, func(conn net.Conn) {
+		io.WriteString(conn, "INFO {}\r\n")
+		readNATSLine(bufio.NewReader(conn))
+		io.WriteString(conn, "-ERR 'Authorization Violation'\r\n")
+	})
+	_, err := DialNATS(dialContext(t), Options{Address: addr})
+	if err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Fatalf("expected authorization error, got %v", err)
+	}
+}
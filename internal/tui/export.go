@@ -0,0 +1,96 @@
+package tui
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/x/ansi"
+)
+
+// exportFormats are the file formats "x" writes, in the order "X" cycles
+// through them.
+var exportFormats = []string{"txt", "json", "csv"}
+
+// exportDir returns where exports are written.
+func (m *model) exportDir() string {
+	return filepath.Join(m.resolver.GetLogDir(), "exports")
+}
+
+// exportView writes the servers and hostnames tables and the recent activity
+// to a timestamped file in the export format, for pasting into tickets, and
+// returns its path.
+func (m *model) exportView(now time.Time) (string, error) {
+	activity := make([]string, len(m.activity))
+	for i, line := range m.activity {
+		activity[i] = ansi.Strip(line)
+	}
+	servers, hostnames := m.serverRows(), m.hostnameRows()
+
+	var buf bytes.Buffer
+	switch exportFormats[m.exportFormat] {
+	case "txt":
+		fmt.Fprintf(&buf, "dnsres export %s\n\nServers\n", now.Format(time.RFC3339))
+		buf.WriteString(strings.Join(alignRows(serverColumns, servers), "\n"))
+		buf.WriteString("\n\nHostnames\n")
+		buf.WriteString(strings.Join(alignRows(hostnameColumns, hostnames), "\n"))
+		buf.WriteString("\n\nActivity\n")
+		buf.WriteString(strings.Join(activity, "\n"))
+		buf.WriteString("\n")
+	case "json":
+		document := struct {
+			Time      time.Time           `json:"time"`
+			Servers   []map[string]string `json:"servers"`
+			Hostnames []map[string]string `json:"hostnames"`
+			Activity  []string            `json:"activity"`
+		}{now, exportObjects(serverColumns, servers), exportObjects(hostnameColumns, hostnames), activity}
+		encoder := json.NewEncoder(&buf)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(document); err != nil {
+			return "", err
+		}
+	case "csv":
+		// One table after another, each under its own header row.
+		writer := csv.NewWriter(&buf)
+		writer.WriteAll(append([][]string{serverColumns}, servers...))
+		writer.Write(nil)
+		writer.WriteAll(append([][]string{hostnameColumns}, hostnames...))
+		writer.Write(nil)
+		writer.Write([]string{"Activity"})
+		for _, line := range activity {
+			writer.Write([]string{line})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return "", err
+		}
+	}
+
+	dir := m.exportDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "dnsres-export-"+now.Format("20060102-150405")+"."+exportFormats[m.exportFormat])
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// exportObjects turns rows into objects keyed by the snake_case column name.
+func exportObjects(columns []string, rows [][]string) []map[string]string {
+	objects := make([]map[string]string, 0, len(rows))
+	for _, row := range rows {
+		object := make(map[string]string, len(columns))
+		for i, column := range columns {
+			object[strings.ReplaceAll(strings.ToLower(column), " ", "_")] = row[i]
+		}
+		objects = append(objects, object)
+	}
+	return objects
+}
@@ -7,10 +7,12 @@ import (
 	"strings"
 	"time"
 
+	"dnsres/health"
 	"dnsres/internal/dnsres"
 
 	"github.com/charmbracelet/bubbles/spinner"
 	"github.com/charmbracelet/bubbles/table"
+	"github.com/charmbracelet/bubbles/textinput"
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
@@ -46,9 +48,12 @@ type model struct {
 	table        table.Model
 	viewport     viewport.Model
 	activity     []string
+	diffs        []string
+	showDetail   bool
+	showHistory  bool
 	servers      map[string]*serverState
 	serverOrder  []string
-	health       map[string]bool
+	health       map[string]health.ServerHealth
 	cycleRunning bool
 	cycleStart   time.Time
 	lastCycle    time.Time
@@ -57,6 +62,29 @@ type model struct {
 	height       int
 	ready        bool
 	statusMsg    string
+	// configPath is the config file the settings screen writes to; empty
+	// when the config did not come from a local file.
+	configPath     string
+	ctx            context.Context
+	settings       *settingsForm
+	restartPending bool
+	// notify raises desktop notifications when set; answers holds the
+	// last answer of each hostname and server pair for it.
+	notify  *notifier
+	answers map[string]string
+	// tab is the screen shown; each tab other than the overview, which
+	// scrolls the activity viewport, has its own pane.
+	tab       tab
+	panes     [tabCount]viewport.Model
+	hostnames map[string]*hostnameState
+	// exportFormat indexes exportFormats.
+	exportFormat int
+	// selected is the first column of the row picked with the mouse on
+	// each table tab; the overview table shares the servers tab's.
+	selected [tabCount]string
+	// onActivity, when set, receives each new activity line; plain mode
+	// prints them.
+	onActivity func(string)
 }
 
 func newModel(resolver *dnsres.DNSResolver, config *dnsres.Config, cancel context.CancelFunc, events <-chan dnsres.ResolverEvent, unsubscribe func(), errs <-chan error) *model {
@@ -76,10 +104,7 @@ func newModel(resolver *dnsres.DNSResolver, config *dnsres.Config, cancel contex
 		table.WithRows(rows),
 		table.WithFocused(false),
 	)
-	styles := table.DefaultStyles()
-	styles.Header = styles.Header.BorderStyle(asciiBorder).BorderBottom(true).Bold(true)
-	styles.Selected = styles.Selected.Foreground(lipgloss.Color("")).Background(lipgloss.Color(""))
-	tableModel.SetStyles(styles)
+	tableModel.SetStyles(tableStyles(false))
 
 	vp := viewport.New(0, 0)
 	serverOrder := make([]string, 0, len(config.DNSServers))
@@ -102,7 +127,11 @@ func newModel(resolver *dnsres.DNSResolver, config *dnsres.Config, cancel contex
 		activity:     []string{},
 		servers:      servers,
 		serverOrder:  serverOrder,
-		health:       map[string]bool{},
+		health:       map[string]health.ServerHealth{},
+		ctx:          context.Background(),
+		answers:      map[string]string{},
+		panes:        newPanes(),
+		hostnames:    map[string]*hostnameState{},
 	}
 
 	// Show log directory location
@@ -123,6 +152,9 @@ func (m *model) Init() tea.Cmd {
 func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch typed := msg.(type) {
 	case tea.KeyMsg:
+		if m.settings != nil && typed.String() != "ctrl+c" {
+			return m, m.handleSettingsKey(typed)
+		}
 		switch typed.String() {
 		case "q", "ctrl+c":
 			if m.cancel != nil {
@@ -132,7 +164,50 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.unsubscribe()
 			}
 			return m, tea.Quit
+		case "1", "2", "3", "4", "5", "6", "7":
+			m.selectTab(tab(typed.String()[0] - '1'))
+			return m, nil
+		case "tab":
+			m.selectTab(m.tab + 1)
+			return m, nil
+		case "shift+tab":
+			m.selectTab(m.tab - 1)
+			return m, nil
+		case "d":
+			m.showDetail = !m.showDetail
+			m.showHistory = false
+			m.refreshViewport()
+		case "h":
+			m.showHistory = !m.showHistory
+			m.showDetail = false
+			m.refreshViewport()
+		case "r":
+			if err := m.resolver.TriggerCycle("tui"); err != nil {
+				m.appendActivity(warnStyle.Render(fmt.Sprintf("cycle not triggered: %v", err)))
+			} else {
+				m.appendActivity("cycle triggered")
+			}
+		case "x":
+			if path, err := m.exportView(time.Now()); err != nil {
+				m.appendActivity(badStyle.Render(fmt.Sprintf("export failed: %v", err)))
+			} else {
+				m.appendActivity(fmt.Sprintf("view exported to %s", path))
+			}
+		case "X":
+			m.exportFormat = (m.exportFormat + 1) % len(exportFormats)
+			m.appendActivity(fmt.Sprintf("export format %s", exportFormats[m.exportFormat]))
+		case "e":
+			m.settings = newSettingsForm(m.config)
+			m.selectTab(tabConfig)
+			return m, textinput.Blink
+		default:
+			return m, m.scroll(typed)
 		}
+	case settingsSavedMsg:
+		m.applySettingsSaved(typed)
+		return m, nil
+	case tea.MouseMsg:
+		return m, m.handleMouse(typed)
 	case tea.WindowSizeMsg:
 		m.width = typed.Width
 		m.height = typed.Height
@@ -141,10 +216,14 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case resolverEventMsg:
 		m.applyEvent(dnsres.ResolverEvent(typed))
 		m.updateTableRows()
+		m.refreshPane()
 		return m, waitForEvent(m.events)
 	case healthTickMsg:
-		m.health = m.resolver.HealthSnapshot()
+		current := m.resolver.HealthSnapshot()
+		m.notifyHealthChange(m.health, current)
+		m.health = current
 		m.updateTableRows()
+		m.refreshPane()
 		return m, tickHealth()
 	case resolverErrMsg:
 		if typed.err != nil {
@@ -168,16 +247,25 @@ func (m *model) View() string {
 	if !m.ready {
 		return "Initializing..."
 	}
+	if m.tab != tabOverview {
+		return lipgloss.JoinVertical(lipgloss.Left, m.tabBar(), m.tabView())
+	}
 
+	top, _ := m.overviewTop()
+
+	activityPanel := panelStyle.Width(m.width).Render(m.viewport.View())
+	return lipgloss.JoinVertical(lipgloss.Left, m.tabBar(), top, activityPanel)
+}
+
+// overviewTop renders the summary and server table panels side by side and
+// returns the column where the table panel starts.
+func (m *model) overviewTop() (string, int) {
 	summaryWidth := clamp(m.width/3, 32, 48)
 	tableWidth := max(m.width-summaryWidth-1, 20)
 
 	summary := panelStyle.Width(summaryWidth).Render(m.summaryView())
 	tablePanel := panelStyle.Width(tableWidth).Render(m.table.View())
-	top := lipgloss.JoinHorizontal(lipgloss.Top, summary, tablePanel)
-
-	activityPanel := panelStyle.Width(m.width).Render(m.viewport.View())
-	return lipgloss.JoinVertical(lipgloss.Left, top, activityPanel)
+	return lipgloss.JoinHorizontal(lipgloss.Top, summary, tablePanel), lipgloss.Width(summary)
 }
 
 func (m *model) summaryView() string {
@@ -196,15 +284,38 @@ func (m *model) summaryView() string {
 		lastCompleted = m.lastCycle.Format("15:04:05")
 	}
 
+	interval := m.config.QueryInterval.Duration.String()
+	if m.restartPending {
+		interval += " (restart)"
+	}
+
+	nextCycle := "n/a"
+	if next := m.resolver.NextCycle(); !next.IsZero() {
+		nextCycle = "due"
+		if remaining := time.Until(next).Round(time.Second); remaining > 0 {
+			nextCycle = "in " + remaining.String()
+		}
+	}
+
+	run := m.resolver.RunSummary()
+	avgCycle := "n/a"
+	if run.Cycles.Completed > 0 {
+		avgCycle = run.Cycles.AverageDuration.String()
+	}
+
 	healthyCount, unhealthyCount := m.healthCounts()
 	lines := []string{
 		titleStyle.Render("dnsres TUI"),
 		fmt.Sprintf("Status: %s", status),
 		fmt.Sprintf("Hostnames: %d", len(m.config.Hostnames)),
 		fmt.Sprintf("Servers: %d", len(m.config.DNSServers)),
-		fmt.Sprintf("Interval: %s", m.config.QueryInterval.Duration),
+		fmt.Sprintf("Interval: %s", interval),
 		fmt.Sprintf("Last cycle: %s", lastCycle),
 		fmt.Sprintf("Last done: %s", lastCompleted),
+		fmt.Sprintf("Next cycle: %s", nextCycle),
+		fmt.Sprintf("Uptime: %s", run.Uptime),
+		fmt.Sprintf("Cycles: %d done, %d skipped", run.Cycles.Completed, run.Cycles.Skipped),
+		fmt.Sprintf("Avg cycle: %s", avgCycle),
 		fmt.Sprintf("Health: %s / %s", goodStyle.Render(fmt.Sprintf("%d up", healthyCount)), badStyle.Render(fmt.Sprintf("%d down", unhealthyCount))),
 	}
 
@@ -217,7 +328,7 @@ func (m *model) summaryView() string {
 		}
 	}
 
-	lines = append(lines, mutedStyle.Render("q to quit"))
+	lines = append(lines, mutedStyle.Render("1-7/tab switch tabs, d detail view, h history, r run now, x export (X format), e settings, q to quit"))
 	return strings.Join(lines, "\n")
 }
 
@@ -226,10 +337,10 @@ func (m *model) healthCounts() (int, int) {
 	unhealthy := 0
 	for _, server := range m.serverOrder {
 		status, ok := m.health[server]
-		if !ok {
+		if !ok || !status.Checked() {
 			continue
 		}
-		if status {
+		if status.Healthy {
 			healthy++
 		} else {
 			unhealthy++
@@ -238,13 +349,26 @@ func (m *model) healthCounts() (int, int) {
 	return healthy, unhealthy
 }
 
+// tableStyles returns the overview table's styles, which only highlight the
+// cursor row once a row has been selected.
+func tableStyles(selected bool) table.Styles {
+	styles := table.DefaultStyles()
+	styles.Header = styles.Header.BorderStyle(asciiBorder).BorderBottom(true).Bold(true)
+	styles.Selected = styles.Selected.Foreground(lipgloss.Color("")).Background(lipgloss.Color(""))
+	if selected {
+		styles.Selected = selectedRowStyle
+	}
+	return styles
+}
+
 func (m *model) resize() {
 	if m.width == 0 || m.height == 0 {
 		return
 	}
 
-	topHeight := clamp(len(m.serverOrder)+4, 8, m.height-6)
-	activityHeight := max(m.height-topHeight-2, 3)
+	// One line goes to the tab bar.
+	topHeight := clamp(len(m.serverOrder)+4, 8, m.height-7)
+	activityHeight := max(m.height-topHeight-3, 3)
 
 	innerWidth := max(m.width-2, 10)
 	innerActivityWidth := max(innerWidth, 10)
@@ -255,6 +379,7 @@ func (m *model) resize() {
 
 	m.viewport.Width = innerActivityWidth
 	m.viewport.Height = activityHeight
+	m.resizePanes()
 }
 
 func (m *model) setTableColumns(width int) {
@@ -281,12 +406,18 @@ func (m *model) applyEvent(event dnsres.ResolverEvent) {
 	case dnsres.EventCycleStart:
 		m.cycleRunning = true
 		m.cycleStart = event.Time
-		m.appendActivity(fmt.Sprintf("cycle start hostnames=%d servers=%d", event.HostnameCount, event.ServerCount))
+		activity := fmt.Sprintf("cycle start hostnames=%d servers=%d", event.HostnameCount, event.ServerCount)
+		if event.QueryMode != "" {
+			activity += " mode=" + event.QueryMode
+		}
+		m.appendActivity(activity)
 	case dnsres.EventCycleComplete:
 		m.cycleRunning = false
 		m.lastCycleDur = event.Duration
 		m.lastCycle = event.Time
 		m.appendActivity(fmt.Sprintf("cycle complete duration=%s", event.Duration.Round(time.Millisecond)))
+	case dnsres.EventCycleTimeout:
+		m.appendActivity(warnStyle.Render(fmt.Sprintf("cycle timed out after %s: %s", event.Duration, event.Detail)))
 	case dnsres.EventResolveSuccess:
 		state := m.ensureServer(event.Server)
 		state.lastHostname = event.Hostname
@@ -295,7 +426,13 @@ func (m *model) applyEvent(event dnsres.ResolverEvent) {
 		state.lastSuccess = event.Time
 		state.total++
 		state.lastSource = event.Source
-		m.appendActivity(fmt.Sprintf("resolved %s via %s (%s)", event.Hostname, event.Server, formatDuration(event.Duration, event.Source)))
+		activity := fmt.Sprintf("resolved %s via %s (%s)", dnsres.DisplayHostname(event.Hostname), event.Server, formatDuration(event.Duration, event.Source))
+		if geo := dnsres.FormatGeo(event.Geo); geo != "" {
+			activity += " [" + geo + "]"
+		}
+		m.appendActivity(activity)
+		m.applyHostnameEvent(event)
+		m.notifyAnswerChange(event)
 	case dnsres.EventResolveFailure:
 		state := m.ensureServer(event.Server)
 		state.lastHostname = event.Hostname
@@ -304,9 +441,57 @@ func (m *model) applyEvent(event dnsres.ResolverEvent) {
 		state.lastFailure = event.Time
 		state.failures++
 		state.lastSource = event.Source
-		m.appendActivity(fmt.Sprintf("failed %s via %s (%s)", event.Hostname, event.Server, formatFailure(event)))
+		m.appendActivity(fmt.Sprintf("failed %s via %s (%s)", dnsres.DisplayHostname(event.Hostname), event.Server, formatFailure(event)))
+		m.applyHostnameEvent(event)
 	case dnsres.EventInconsistent:
-		m.appendActivity(fmt.Sprintf("inconsistent responses for %s", event.Hostname))
+		if event.Detail != "" {
+			m.appendDiff(event.Time, event.Detail)
+		}
+		m.appendActivity(fmt.Sprintf("inconsistent responses for %s (d for details)", dnsres.DisplayHostname(event.Hostname)))
+	case dnsres.EventNodeChange:
+		m.appendActivity(fmt.Sprintf("anycast node for %s changed %s -> %s (%s)", event.Server, event.PreviousNode, event.Node, event.Source))
+	case dnsres.EventDropped:
+		m.appendActivity(warnStyle.Render(fmt.Sprintf("%d events dropped (TUI fell behind)", event.Dropped)))
+	case dnsres.EventAnalyzerFinding:
+		target := dnsres.DisplayHostname(event.Hostname)
+		if event.Server != "" {
+			target += " via " + event.Server
+		}
+		m.appendActivity(fmt.Sprintf("%s %s: %s (%s)", event.Source, event.Severity, target, event.Detail))
+	case dnsres.EventBlockedAnswer:
+		m.appendActivity(fmt.Sprintf("blocked answer for %s via %s: %s", dnsres.DisplayHostname(event.Hostname), event.Server, event.Detail))
+	case dnsres.EventIncidentOpen:
+		m.appendActivity(fmt.Sprintf("%s opened for %s", event.Detail, dnsres.DisplayHostname(event.Hostname)))
+	case dnsres.EventIncidentClose:
+		m.appendActivity(fmt.Sprintf("%s closed for %s after %s", event.Detail, dnsres.DisplayHostname(event.Hostname), event.Duration.Round(time.Second)))
+	case dnsres.EventBurstStart:
+		m.appendActivity(fmt.Sprintf("burst polling %s for %s (%s)", dnsres.DisplayHostname(event.Hostname), event.Duration, event.Detail))
+	case dnsres.EventBurstEnd:
+		m.appendActivity(fmt.Sprintf("burst polling %s ended", dnsres.DisplayHostname(event.Hostname)))
+	case dnsres.EventFlapStart:
+		m.appendActivity(warnStyle.Render(fmt.Sprintf("answers for %s are flapping: %s", dnsres.DisplayHostname(event.Hostname), event.Detail)))
+	case dnsres.EventFlapEnd:
+		m.appendActivity(fmt.Sprintf("answers for %s stopped flapping", dnsres.DisplayHostname(event.Hostname)))
+	case dnsres.EventAnomalyStart:
+		m.appendActivity(warnStyle.Render(fmt.Sprintf("%s slow for %s: %s", event.Server, dnsres.DisplayHostname(event.Hostname), event.Detail)))
+	case dnsres.EventAnomalyEnd:
+		m.appendActivity(fmt.Sprintf("%s latency for %s back to normal", event.Server, dnsres.DisplayHostname(event.Hostname)))
+	case dnsres.EventInterception:
+		m.appendActivity(fmt.Sprintf("%s detected on %s: %s", event.Source, event.Server, event.Detail))
+	case dnsres.EventBreakerChange:
+		activity := fmt.Sprintf("%s breaker %s at %s (%s)", event.Server, event.Source, event.Time.Format("15:04:05"), event.Detail)
+		if event.Error != "" {
+			activity += ": " + event.Error
+		}
+		switch event.Source {
+		case "open":
+			activity = badStyle.Render(activity)
+		case "closed":
+			activity = goodStyle.Render(activity)
+		}
+		m.appendActivity(activity)
+	case dnsres.EventFingerprintChange:
+		m.appendActivity(fmt.Sprintf("resolver software for %s changed (now %s)", event.Server, event.Source))
 	}
 }
 
@@ -321,6 +506,34 @@ func (m *model) ensureServer(server string) *serverState {
 	return state
 }
 
+// healthLabel renders a server's health column: "pending" until its first
+// check, "stale" once checks stop arriving, then "up" or "down".
+func healthLabel(status health.ServerHealth, now time.Time) string {
+	label := healthStatus(status, now)
+	switch label {
+	case "up":
+		return goodStyle.Render(label)
+	case "down":
+		return badStyle.Render(label)
+	default:
+		return warnStyle.Render(label)
+	}
+}
+
+// healthStatus is healthLabel without styling.
+func healthStatus(status health.ServerHealth, now time.Time) string {
+	switch {
+	case !status.Checked():
+		return "pending"
+	case status.Stale(now):
+		return "stale"
+	case status.Healthy:
+		return "up"
+	default:
+		return "down"
+	}
+}
+
 func (m *model) updateTableRows() {
 	rows := make([]table.Row, 0, len(m.serverOrder))
 	for _, server := range m.serverOrder {
@@ -328,16 +541,7 @@ func (m *model) updateTableRows() {
 		if state == nil {
 			state = &serverState{}
 		}
-		healthValue := "?"
-		if status, ok := m.health[server]; ok {
-			if status {
-				healthValue = goodStyle.Render("up")
-			} else {
-				healthValue = badStyle.Render("down")
-			}
-		} else {
-			healthValue = warnStyle.Render("unknown")
-		}
+		healthValue := healthLabel(m.health[server], time.Now())
 
 		lastOK := "-"
 		if !state.lastSuccess.IsZero() {
@@ -361,13 +565,88 @@ func (m *model) appendActivity(entry string) {
 	stamp := time.Now().Format("15:04:05")
 	line := fmt.Sprintf("%s %s", stamp, entry)
 	m.activity = append(m.activity, line)
+	if m.onActivity != nil {
+		m.onActivity(line)
+	}
 	if len(m.activity) > 200 {
 		m.activity = m.activity[len(m.activity)-200:]
 	}
-	m.viewport.SetContent(strings.Join(m.activity, "\n"))
+	// Keep the reader's place when they have scrolled up.
+	offset, follow := m.viewport.YOffset, m.viewport.AtBottom()
+	m.refreshViewport()
+	if !follow {
+		m.viewport.SetYOffset(offset)
+	}
+}
+
+// appendDiff keeps the most recent inconsistency diffs for the detail view.
+func (m *model) appendDiff(at time.Time, detail string) {
+	m.diffs = append(m.diffs, fmt.Sprintf("%s %s", at.Format("15:04:05"), detail))
+	if len(m.diffs) > 20 {
+		m.diffs = m.diffs[len(m.diffs)-20:]
+	}
+	if m.showDetail {
+		m.refreshViewport()
+	}
+}
+
+// refreshViewport renders the activity log, the detail view or the resolver's
+// event history.
+func (m *model) refreshViewport() {
+	if m.showHistory {
+		m.viewport.SetContent(m.historyView())
+		m.viewport.GotoBottom()
+		return
+	}
+	if m.showDetail {
+		content := "No inconsistencies recorded"
+		if len(m.diffs) > 0 {
+			content = strings.Join(m.diffs, "\n\n")
+		}
+		m.viewport.SetContent(content)
+	} else {
+		m.viewport.SetContent(strings.Join(m.activity, "\n"))
+	}
 	m.viewport.GotoBottom()
 }
 
+// historyView renders the resolver's recent event history, which predates
+// this TUI's own subscription.
+func (m *model) historyView() string {
+	if m.resolver == nil {
+		return "No events recorded"
+	}
+	events := m.resolver.RecentEvents(0, "")
+	if len(events) == 0 {
+		return "No events recorded"
+	}
+	lines := make([]string, 0, len(events))
+	for _, event := range events {
+		lines = append(lines, formatHistoryEvent(event))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatHistoryEvent(event dnsres.ResolverEvent) string {
+	parts := []string{event.Time.Format("15:04:05"), string(event.Type)}
+	if event.Hostname != "" {
+		parts = append(parts, dnsres.DisplayHostname(event.Hostname))
+	}
+	if event.Server != "" {
+		parts = append(parts, "via "+event.Server)
+	}
+	if event.Duration > 0 {
+		parts = append(parts, event.Duration.Round(time.Millisecond).String())
+	}
+	if event.Error != "" {
+		parts = append(parts, "error="+event.Error)
+	}
+	if event.Dropped > 0 {
+		parts = append(parts, fmt.Sprintf("dropped=%d", event.Dropped))
+	}
+	return strings.Join(parts, " ")
+}
+
 func waitForEvent(events <-chan dnsres.ResolverEvent) tea.Cmd {
 	return func() tea.Msg {
 		if events == nil {
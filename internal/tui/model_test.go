@@ -1,13 +1,20 @@
 package tui
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"dnsres/health"
 	"dnsres/internal/dnsres"
+
+	tea "github.com/charmbracelet/bubbletea"
 )
 
 // TestModelStatusMessage tests that the TUI model correctly displays
@@ -196,8 +203,457 @@ func TestModelCreation(t *testing.T) {
 	})
 }
 
+// TestDetailViewShowsInconsistencyDiff tests that inconsistency diffs are kept
+// for the detail view toggled with "d"
+func TestDetailViewShowsInconsistencyDiff(t *testing.T) {
+	config := dnsres.DefaultConfig()
+	config.Hostnames = []string{"example.com"}
+	config.LogDir = t.TempDir()
+
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolver, err := dnsres.NewDNSResolver(config)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+
+	m := newModel(resolver, config, cancel, nil, nil, nil)
+	m.viewport.Width = 80
+	m.viewport.Height = 20
+
+	m.applyEvent(dnsres.ResolverEvent{
+		Type:     dnsres.EventInconsistent,
+		Time:     time.Now(),
+		Hostname: "example.com",
+		Detail:   "example.com\n  8.8.8.8:53 +10.0.0.9",
+	})
+	if strings.Contains(m.viewport.View(), "+10.0.0.9") {
+		t.Fatalf("expected activity view by default")
+	}
+
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("d")})
+	if !m.showDetail {
+		t.Fatalf("expected detail view after pressing d")
+	}
+	if !strings.Contains(m.viewport.View(), "+10.0.0.9") {
+		t.Fatalf("expected diff in detail view, got %q", m.viewport.View())
+	}
+}
+
+// TestHistoryViewToggle tests that "h" swaps the viewport to the resolver's
+// event history and back
+func TestHistoryViewToggle(t *testing.T) {
+	config := dnsres.DefaultConfig()
+	config.Hostnames = []string{"example.com"}
+	config.LogDir = t.TempDir()
+
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolver, err := dnsres.NewDNSResolver(config)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+
+	m := newModel(resolver, config, cancel, nil, nil, nil)
+	m.viewport.Width = 80
+	m.viewport.Height = 20
+
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("h")})
+	if !m.showHistory || m.showDetail {
+		t.Fatalf("expected history view after pressing h")
+	}
+	if !strings.Contains(m.viewport.View(), "No events recorded") {
+		t.Fatalf("expected empty history, got %q", m.viewport.View())
+	}
+
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("d")})
+	if m.showHistory || !m.showDetail {
+		t.Fatalf("expected detail view to replace history view")
+	}
+}
+
+// TestDesktopNotifications tests that answer changes and servers going down
+// are written as terminal notification sequences
+func TestDesktopNotifications(t *testing.T) {
+	if _, err := newNotifier("bell", nil); err == nil {
+		t.Fatalf("expected unknown notify format to be rejected")
+	}
+	config := dnsres.DefaultConfig()
+	config.Hostnames = []string{"example.com"}
+	config.DNSServers = []string{"8.8.8.8:53"}
+	config.LogDir = t.TempDir()
+
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolver, err := dnsres.NewDNSResolver(config)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+
+	var out strings.Builder
+	m := newModel(resolver, config, cancel, nil, nil, nil)
+	m.notify = &notifier{out: &out, format: NotifyOSC777}
+
+	resolved := func(source string, addresses ...string) {
+		m.applyEvent(dnsres.ResolverEvent{
+			Type:      dnsres.EventResolveSuccess,
+			Time:      time.Now(),
+			Hostname:  "example.com",
+			Server:    "8.8.8.8:53",
+			Addresses: addresses,
+			Source:    source,
+		})
+	}
+	resolved("", "192.0.2.2", "192.0.2.1")
+	resolved("", "192.0.2.1", "192.0.2.2")
+	resolved("cache", "192.0.2.9")
+	if out.Len() != 0 {
+		t.Fatalf("expected no notification for unchanged answers, got %q", out.String())
+	}
+	resolved("", "192.0.2.3")
+	want := "\x1b]777;notify;dnsres: example.com changed;8.8.8.8:53 now answers 192.0.2.3 (was 192.0.2.1, 192.0.2.2)\x07"
+	if out.String() != want {
+		t.Fatalf("notification = %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	now := time.Now()
+	up := map[string]health.ServerHealth{"8.8.8.8:53": {Healthy: true, LastCheck: now}}
+	down := map[string]health.ServerHealth{"8.8.8.8:53": {LastCheck: now, LastError: "connection refused"}}
+	m.notifyHealthChange(map[string]health.ServerHealth{}, down)
+	m.notifyHealthChange(up, up)
+	if out.Len() != 0 {
+		t.Fatalf("expected no notification without a server going down, got %q", out.String())
+	}
+	m.notifyHealthChange(up, down)
+	if !strings.Contains(out.String(), "resolver down;8.8.8.8:53 is down: connection refused") {
+		t.Fatalf("expected server down notification, got %q", out.String())
+	}
+}
+
+// TestTabNavigation tests that number keys switch tabs, each of which keeps
+// its own scroll position
+func TestTabNavigation(t *testing.T) {
+	config := dnsres.DefaultConfig()
+	config.DNSServers = []string{"8.8.8.8:53"}
+	config.LogDir = t.TempDir()
+	for i := 0; i < 40; i++ {
+		config.Hostnames = append(config.Hostnames, fmt.Sprintf("host%02d.example.com", i))
+	}
+
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolver, err := dnsres.NewDNSResolver(config)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+
+	m := newModel(resolver, config, cancel, nil, nil, nil)
+	m.Update(tea.WindowSizeMsg{Width: 120, Height: 20})
+	m.applyEvent(dnsres.ResolverEvent{
+		Type:      dnsres.EventResolveSuccess,
+		Time:      time.Now(),
+		Hostname:  "host00.example.com",
+		Server:    "8.8.8.8:53",
+		Addresses: []string{"192.0.2.1"},
+		Duration:  12 * time.Millisecond,
+	})
+	if !strings.Contains(m.View(), "1 Overview") {
+		t.Fatalf("expected tab bar on the overview, got %q", m.View())
+	}
+
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("3")})
+	if m.tab != tabHostnames || !strings.Contains(m.View(), "192.0.2.1") {
+		t.Fatalf("expected hostnames tab with the last answer, got %q", m.View())
+	}
+	for i := 0; i < 3; i++ {
+		m.Update(tea.KeyMsg{Type: tea.KeyDown})
+	}
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("2")})
+	if m.tab != tabServers || !strings.Contains(m.View(), "8.8.8.8:53") || m.panes[tabServers].YOffset != 0 {
+		t.Fatalf("expected servers tab at the top, got %q", m.View())
+	}
+	m.Update(tea.KeyMsg{Type: tea.KeyShiftTab})
+	if m.tab != tabOverview {
+		t.Fatalf("expected shift+tab back to the overview, got tab %d", m.tab)
+	}
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("3")})
+	if m.panes[tabHostnames].YOffset != 3 {
+		t.Fatalf("expected hostnames tab to keep its scroll position, got offset %d", m.panes[tabHostnames].YOffset)
+	}
+
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("e")})
+	if m.tab != tabConfig || m.settings == nil {
+		t.Fatalf("expected e to open settings on the config tab")
+	}
+}
+
+// TestMouseNavigation tests clicking tabs and rows and scrolling with the
+// wheel
+func TestMouseNavigation(t *testing.T) {
+	config := dnsres.DefaultConfig()
+	config.DNSServers = []string{"8.8.8.8:53", "1.1.1.1:53"}
+	config.LogDir = t.TempDir()
+	for i := 0; i < 40; i++ {
+		config.Hostnames = append(config.Hostnames, fmt.Sprintf("host%02d.example.com", i))
+	}
+
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolver, err := dnsres.NewDNSResolver(config)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+
+	m := newModel(resolver, config, cancel, nil, nil, nil)
+	m.Update(tea.WindowSizeMsg{Width: 120, Height: 20})
+	click := func(x, y int) {
+		m.Update(tea.MouseMsg{X: x, Y: y, Action: tea.MouseActionPress, Button: tea.MouseButtonLeft})
+	}
+
+	// " 1 Overview " " 2 Servers " " 3 Hostnames "
+	click(27, 0)
+	if m.tab != tabHostnames {
+		t.Fatalf("expected a click on the tab bar to select hostnames, got tab %d", m.tab)
+	}
+	m.Update(tea.MouseMsg{X: 10, Y: 5, Action: tea.MouseActionPress, Button: tea.MouseButtonWheelDown})
+	if m.panes[tabHostnames].YOffset != 3 {
+		t.Fatalf("expected the wheel to scroll the hostnames tab, got offset %d", m.panes[tabHostnames].YOffset)
+	}
+	click(10, 2)
+	if m.selected[tabHostnames] != "host02.example.com" || !strings.Contains(m.View(), selectedRowStyle.Render("host02.example.com")) {
+		t.Fatalf("expected host02 selected, got %q", m.selected[tabHostnames])
+	}
+
+	click(2, 0)
+	if m.tab != tabOverview {
+		t.Fatalf("expected a click on the tab bar to select the overview, got tab %d", m.tab)
+	}
+	_, tableX := m.overviewTop()
+	click(tableX+3, 5)
+	if m.table.Cursor() != 1 || m.selected[tabServers] != "1.1.1.1:53" {
+		t.Fatalf("expected the second server selected, got cursor %d (%q)", m.table.Cursor(), m.selected[tabServers])
+	}
+	m.Update(tea.MouseMsg{X: tableX + 3, Y: 5, Action: tea.MouseActionPress, Button: tea.MouseButtonWheelUp})
+	if m.table.Cursor() != 0 || m.selected[tabServers] != "8.8.8.8:53" {
+		t.Fatalf("expected the wheel to move to the first server, got cursor %d", m.table.Cursor())
+	}
+}
+
+// TestPlainMode tests that plain mode prints activity and status blocks
+// without escape sequences or box drawing
+func TestPlainMode(t *testing.T) {
+	config := dnsres.DefaultConfig()
+	config.Hostnames = []string{"example.com"}
+	config.DNSServers = []string{"8.8.8.8:53"}
+	config.LogDir = t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolver, err := dnsres.NewDNSResolver(config)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+
+	events := make(chan dnsres.ResolverEvent, 4)
+	m := newModel(resolver, config, cancel, events, nil, nil)
+	events <- dnsres.ResolverEvent{Type: dnsres.EventCycleStart, Time: time.Now(), HostnameCount: 1, ServerCount: 1}
+	events <- dnsres.ResolverEvent{Type: dnsres.EventResolveSuccess, Time: time.Now(), Hostname: "example.com", Server: "8.8.8.8:53", Addresses: []string{"192.0.2.1"}}
+	events <- dnsres.ResolverEvent{Type: dnsres.EventBreakerChange, Time: time.Now(), Server: "8.8.8.8:53", Source: "open", Detail: "5 failures"}
+	events <- dnsres.ResolverEvent{Type: dnsres.EventCycleComplete, Time: time.Now(), Duration: time.Second}
+	close(events)
+
+	var out bytes.Buffer
+	if err := m.runPlain(ctx, &out); err != nil {
+		t.Fatalf("runPlain() error = %v", err)
+	}
+	output := out.String()
+	for _, want := range []string{"8.8.8.8:53 breaker open", "Status at", "Last cycle took 1s.", "example.com  192.0.2.1"} {
+		if !strings.Contains(output, want) {
+			t.Fatalf("expected %q in plain output:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "\x1b") || strings.Contains(output, "+-") || strings.Contains(output, "resolved example.com") {
+		t.Fatalf("unexpected styling or per-query lines in plain output:\n%s", output)
+	}
+}
+
+// TestExportView tests that "x" writes the tables and activity to a file in
+// the export format "X" selects
+func TestExportView(t *testing.T) {
+	config := dnsres.DefaultConfig()
+	config.Hostnames = []string{"example.com"}
+	config.DNSServers = []string{"8.8.8.8:53"}
+	config.LogDir = t.TempDir()
+
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolver, err := dnsres.NewDNSResolver(config)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+
+	m := newModel(resolver, config, cancel, nil, nil, nil)
+	m.applyEvent(dnsres.ResolverEvent{
+		Type:     dnsres.EventResolveFailure,
+		Time:     time.Now(),
+		Hostname: "example.com",
+		Server:   "8.8.8.8:53",
+		Error:    "i/o timeout",
+	})
+	m.applyEvent(dnsres.ResolverEvent{Type: dnsres.EventCycleTimeout, Duration: time.Second, Detail: "1 query running"})
+
+	now := time.Date(2024, 3, 14, 11, 0, 0, 0, time.UTC)
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("X")})
+	path, err := m.exportView(now)
+	if err != nil {
+		t.Fatalf("exportView() error = %v", err)
+	}
+	if filepath.Base(path) != "dnsres-export-20240314-110000.json" {
+		t.Fatalf("unexpected export path %s", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read export: %v", err)
+	}
+	var document struct {
+		Servers   []map[string]string `json:"servers"`
+		Hostnames []map[string]string `json:"hostnames"`
+		Activity  []string            `json:"activity"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		t.Fatalf("export is not JSON: %v", err)
+	}
+	if len(document.Servers) != 1 || document.Servers[0]["last_error"] != "i/o timeout" || document.Servers[0]["failed"] != "1" {
+		t.Fatalf("unexpected servers %v", document.Servers)
+	}
+	if len(document.Hostnames) != 1 || document.Hostnames[0]["hostname"] != "example.com" {
+		t.Fatalf("unexpected hostnames %v", document.Hostnames)
+	}
+	if last := document.Activity[len(document.Activity)-1]; strings.Contains(last, "\x1b") || !strings.Contains(last, "export format json") {
+		t.Fatalf("expected plain activity, got %q", last)
+	}
+
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("X")})
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("x")})
+	exports, _ := filepath.Glob(filepath.Join(m.exportDir(), "*.csv"))
+	if len(exports) != 1 {
+		t.Fatalf("expected a CSV export, got %v", exports)
+	}
+	data, _ = os.ReadFile(exports[0])
+	if !strings.HasPrefix(string(data), "Server,Health,OK,Failed") || !strings.Contains(string(data), "\n\nHostname,Last Answer") {
+		t.Fatalf("unexpected CSV export %q", data)
+	}
+}
+
 // Note: Full TUI integration testing (with Bubble Tea message passing and
 // rendering) requires a more complex setup. These tests validate the core
 // logic of status message formatting and model initialization.
 // Visual rendering tests would require mocking the Bubble Tea terminal
 // and are better suited for manual testing or screenshot-based integration tests.
+
+func TestHealthLabel(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		status health.ServerHealth
+		want   string
+	}{
+		{health.ServerHealth{}, "pending"},
+		{health.ServerHealth{Healthy: true, LastCheck: now.Add(-time.Hour)}, "stale"},
+		{health.ServerHealth{Healthy: true, LastCheck: now}, "up"},
+		{health.ServerHealth{LastCheck: now, ConsecutiveFailures: 1}, "down"},
+	}
+	for _, tt := range tests {
+		if got := healthLabel(tt.status, now); !strings.Contains(got, tt.want) {
+			t.Errorf("healthLabel(%+v) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
+
+// TestSettingsScreen tests that "e" opens the settings editor, which validates
+// fields, writes changed ones to the config file and closes once applied
+func TestSettingsScreen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"hostnames": ["example.com"], "dns_servers": ["8.8.8.8:53"], "query_timeout": "5s", "query_interval": "30s", "circuit_breaker": {"threshold": 5, "timeout": "30s"}, "cache": {"max_size": 1000}}`), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	config, err := dnsres.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	config.LogDir = t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resolver, err := dnsres.NewDNSResolver(config)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	m := newModel(resolver, config, cancel, nil, nil, nil)
+	m.configPath = path
+	m.ctx = ctx
+	m.viewport.Width = 80
+	m.viewport.Height = 20
+
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("e")})
+	if m.settings == nil {
+		t.Fatal("expected settings screen after pressing e")
+	}
+	m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("q")})
+	if m.settings == nil || m.settings.inputs[0].Value() != "example.comq" {
+		t.Fatalf("expected q to be typed into the hostnames field")
+	}
+
+	// Move to the breaker threshold and enter an invalid value.
+	m.settings.inputs[0].SetValue("example.com www.example.com")
+	for m.settings.focus != 4 {
+		m.Update(tea.KeyMsg{Type: tea.KeyTab})
+	}
+	m.settings.inputs[4].SetValue("none")
+	if _, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter}); cmd != nil || !strings.Contains(m.settings.err, "breaker threshold") {
+		t.Fatalf("expected threshold error, got %q", m.settings.err)
+	}
+
+	m.settings.inputs[4].SetValue("3")
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if cmd == nil {
+		t.Fatalf("expected save command, got error %q", m.settings.err)
+	}
+	// The resolver is not running, so the change is saved but not applied.
+	cancel()
+	msg := cmd()
+	saved, ok := msg.(settingsSavedMsg)
+	if !ok || saved.err == nil {
+		t.Fatalf("expected apply error from stopped resolver, got %#v", msg)
+	}
+	loaded, err := dnsres.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("saved config does not load: %v", err)
+	}
+	if loaded.CircuitBreaker.Threshold != 3 || len(loaded.Hostnames) != 2 {
+		t.Fatalf("expected edits written, got threshold %d hostnames %v", loaded.CircuitBreaker.Threshold, loaded.Hostnames)
+	}
+	m.Update(saved)
+	if m.settings == nil || m.settings.saving || m.settings.err == "" {
+		t.Fatal("expected settings screen to stay open with the error")
+	}
+
+	loaded.DNSServers = []string{"1.1.1.1:53"}
+	m.Update(settingsSavedMsg{config: loaded, saved: true})
+	if m.settings != nil {
+		t.Fatal("expected settings screen to close once applied")
+	}
+	if len(m.serverOrder) != 1 || m.serverOrder[0] != "1.1.1.1:53" {
+		t.Fatalf("expected server table to follow the new config, got %v", m.serverOrder)
+	}
+	if !strings.Contains(strings.Join(m.activity, "\n"), "settings saved to "+path) {
+		t.Fatalf("expected save in activity log, got %v", m.activity)
+	}
+}
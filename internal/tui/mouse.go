@@ -0,0 +1,144 @@
+package tui
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+)
+
+// Panel content starts below the tab bar and the panel's top border.
+const panelContentTop = 2
+
+// handleMouse selects tabs and table rows on click and scrolls whatever is
+// under the pointer with the wheel.
+func (m *model) handleMouse(msg tea.MouseMsg) tea.Cmd {
+	if m.settings != nil {
+		return nil
+	}
+	click := msg.Action == tea.MouseActionPress && msg.Button == tea.MouseButtonLeft
+	if msg.Y == 0 {
+		if t, ok := m.tabAt(msg.X); ok && click {
+			m.selectTab(t)
+		}
+		return nil
+	}
+
+	if m.tab != tabOverview {
+		if click {
+			m.selectPaneRow(msg.Y - panelContentTop + m.panes[m.tab].YOffset)
+			return nil
+		}
+		var cmd tea.Cmd
+		m.panes[m.tab], cmd = m.panes[m.tab].Update(msg)
+		return cmd
+	}
+
+	top, tableX := m.overviewTop()
+	if msg.Y > lipgloss.Height(top) {
+		var cmd tea.Cmd
+		m.viewport, cmd = m.viewport.Update(msg)
+		return cmd
+	}
+	if msg.X < tableX {
+		// The summary panel has nothing to pick or scroll.
+		return nil
+	}
+	switch {
+	case click:
+		lines := strings.Split(m.table.View(), "\n")
+		if line := msg.Y - panelContentTop; line >= 0 && line < len(lines) {
+			m.selectServer(serverAt(m.serverOrder, lines[line]))
+		}
+	case msg.Action == tea.MouseActionPress && msg.Button == tea.MouseButtonWheelUp:
+		m.table.MoveUp(1)
+		m.selectServer(m.table.Cursor())
+	case msg.Action == tea.MouseActionPress && msg.Button == tea.MouseButtonWheelDown:
+		m.table.MoveDown(1)
+		m.selectServer(m.table.Cursor())
+	}
+	return nil
+}
+
+// tabAt returns the tab whose label in the tab bar covers column x.
+func (m *model) tabAt(x int) (tab, bool) {
+	start := 0
+	for t, name := range tabNames {
+		end := start + lipgloss.Width(fmt.Sprintf(" %d %s ", t+1, name))
+		if x >= start && x < end {
+			return tab(t), true
+		}
+		start = end + 1
+	}
+	return 0, false
+}
+
+// selectPaneRow selects the table row on line of the active tab's content.
+// Lines that are not table rows leave the selection alone.
+func (m *model) selectPaneRow(line int) {
+	var rows [][]string
+	switch m.tab {
+	case tabServers:
+		rows = m.serverRows()
+	case tabHostnames:
+		rows = m.hostnameRows()
+	case tabBreakers:
+		rows = m.breakerRows()
+	default:
+		return
+	}
+	lines := strings.Split(m.paneContent(m.tab), "\n")
+	if line < 0 || line >= len(lines) {
+		return
+	}
+	fields := strings.Fields(ansi.Strip(lines[line]))
+	if len(fields) == 0 {
+		return
+	}
+	for _, row := range rows {
+		if row[0] == fields[0] {
+			m.selected[m.tab] = row[0]
+			if m.tab == tabServers {
+				m.selectServer(slices.Index(m.serverOrder, row[0]))
+			}
+			m.refreshPane()
+			return
+		}
+	}
+}
+
+// selectServer moves the overview table's cursor to the server at index and
+// highlights it there and on the servers tab.
+func (m *model) selectServer(index int) {
+	if index < 0 || index >= len(m.serverOrder) {
+		return
+	}
+	m.table.SetStyles(tableStyles(true))
+	m.table.SetCursor(index)
+	m.selected[tabServers] = m.serverOrder[index]
+}
+
+// serverAt returns the index of the server shown on a line of the overview
+// table, whose server column may be truncated, or -1.
+func serverAt(servers []string, line string) int {
+	fields := strings.Fields(ansi.Strip(line))
+	if len(fields) == 0 {
+		return -1
+	}
+	if index := slices.Index(servers, fields[0]); index >= 0 {
+		return index
+	}
+	prefix, truncated := strings.CutSuffix(fields[0], "…")
+	if !truncated {
+		return -1
+	}
+	for i, server := range servers {
+		if strings.HasPrefix(server, prefix) {
+			return i
+		}
+	}
+	return -1
+}
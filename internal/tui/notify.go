@@ -0,0 +1,106 @@
+package tui
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"dnsres/health"
+	"dnsres/internal/dnsres"
+)
+
+// Desktop notification formats, named after the terminal escape sequence
+// that carries them. OSC 9 is understood by iTerm2, Windows Terminal,
+// WezTerm and kitty; OSC 777 by foot, Ghostty, WezTerm and rxvt.
+const (
+	NotifyOSC9   = "osc9"
+	NotifyOSC777 = "osc777"
+)
+
+// notifier raises desktop notifications through terminal escape sequences,
+// so a TUI in a background tab or window can still get the user's attention.
+type notifier struct {
+	out    io.Writer
+	format string
+	// tmux wraps sequences for tmux to pass through to the outer terminal.
+	tmux bool
+}
+
+// newNotifier returns a notifier writing format sequences to out, or nil
+// when format is empty.
+func newNotifier(format string, out io.Writer) (*notifier, error) {
+	switch format {
+	case "":
+		return nil, nil
+	case NotifyOSC9, NotifyOSC777:
+		return &notifier{out: out, format: format, tmux: os.Getenv("TMUX") != ""}, nil
+	default:
+		return nil, fmt.Errorf("invalid notify format %q: use %s or %s", format, NotifyOSC9, NotifyOSC777)
+	}
+}
+
+// notify writes one notification. Each sequence goes out in a single write
+// so it cannot interleave with a frame being rendered.
+func (n *notifier) notify(title, body string) {
+	if n == nil {
+		return
+	}
+	var sequence string
+	switch n.format {
+	case NotifyOSC9:
+		sequence = "\x1b]9;" + oscText(title+": "+body) + "\x07"
+	case NotifyOSC777:
+		sequence = "\x1b]777;notify;" + strings.ReplaceAll(oscText(title), ";", ",") + ";" + oscText(body) + "\x07"
+	}
+	if n.tmux {
+		sequence = "\x1bPtmux;" + strings.ReplaceAll(sequence, "\x1b", "\x1b\x1b") + "\x1b\\"
+	}
+	io.WriteString(n.out, sequence)
+}
+
+// oscText drops control characters, which would end the sequence early.
+func oscText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// notifyAnswerChange notifies when a server's answer for a hostname differs
+// from its previous one. Cached answers and the first answer seen are not
+// changes.
+func (m *model) notifyAnswerChange(event dnsres.ResolverEvent) {
+	if m.notify == nil || event.Source == "cache" {
+		return
+	}
+	addresses := slices.Clone(event.Addresses)
+	slices.Sort(addresses)
+	answer := strings.Join(addresses, ", ")
+	key := event.Hostname + " " + event.Server
+	previous, seen := m.answers[key]
+	m.answers[key] = answer
+	if seen && previous != answer {
+		m.notify.notify("dnsres: "+dnsres.DisplayHostname(event.Hostname)+" changed", fmt.Sprintf("%s now answers %s (was %s)", event.Server, answer, previous))
+	}
+}
+
+// notifyHealthChange notifies when a server that was up is reported down.
+func (m *model) notifyHealthChange(previous, current map[string]health.ServerHealth) {
+	if m.notify == nil {
+		return
+	}
+	for _, server := range m.serverOrder {
+		before, now := previous[server], current[server]
+		if before.Checked() && before.Healthy && now.Checked() && !now.Healthy {
+			body := server + " is down"
+			if now.LastError != "" {
+				body += ": " + now.LastError
+			}
+			m.notify.notify("dnsres: resolver down", body)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package tui
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"dnsres/internal/dnsres"
+
+	"github.com/charmbracelet/x/ansi"
+)
+
+// runPlain is the TUI for screen readers and dumb terminals: it prints
+// activity as plain lines and a status block after every cycle, with no
+// boxes, colors, spinners or cursor movement. It returns when ctx is done or
+// the resolver stops.
+func (m *model) runPlain(ctx context.Context, out io.Writer) error {
+	// Per-query successes are summed up in the status block instead.
+	quiet := false
+	m.onActivity = func(line string) {
+		if !quiet {
+			fmt.Fprintln(out, ansi.Strip(line))
+		}
+	}
+	fmt.Fprintf(out, "dnsres: monitoring %d hostnames on %d servers every %s. Press Ctrl+C to quit.\n",
+		len(m.config.Hostnames), len(m.config.DNSServers), m.config.QueryInterval.Duration)
+
+	health := time.NewTicker(2 * time.Second)
+	defer health.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-m.events:
+			if !ok {
+				return nil
+			}
+			quiet = event.Type == dnsres.EventResolveSuccess || event.Type == dnsres.EventCycleStart
+			m.applyEvent(event)
+			quiet = false
+			if event.Type == dnsres.EventCycleComplete {
+				fmt.Fprint(out, m.plainStatus(time.Now()))
+			}
+		case <-health.C:
+			current := m.resolver.HealthSnapshot()
+			m.notifyHealthChange(m.health, current)
+			m.health = current
+		case err := <-m.resolverErrs:
+			if err != nil {
+				fmt.Fprintf(out, "resolver error: %v\n", err)
+			}
+			return nil
+		}
+	}
+}
+
+// plainStatus renders the summary and the servers and hostnames tables as
+// space-aligned text, ending with a blank line.
+func (m *model) plainStatus(now time.Time) string {
+	healthy, unhealthy := m.healthCounts()
+	lines := []string{
+		"",
+		fmt.Sprintf("Status at %s", now.Format("15:04:05")),
+		fmt.Sprintf("Last cycle took %s.", m.lastCycleDur.Round(time.Millisecond)),
+	}
+	if next := m.resolver.NextCycle(); next.After(now) {
+		lines = append(lines, fmt.Sprintf("Next cycle in %s.", next.Sub(now).Round(time.Second)))
+	}
+	lines = append(lines, fmt.Sprintf("Servers: %d up, %d down.", healthy, unhealthy))
+	lines = append(lines, alignRows(serverColumns, m.serverRows())...)
+	lines = append(lines, "", "Hostnames:")
+	lines = append(lines, alignRows(hostnameColumns, m.hostnameRows())...)
+	return strings.Join(lines, "\n") + "\n\n"
+}
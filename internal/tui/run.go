@@ -5,7 +5,10 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"dnsres/internal/dnsres"
 
@@ -16,8 +19,15 @@ import (
 func Run() error {
 	configFile := flag.String("config", "", "Path to configuration file (default: auto-detect)")
 	hostname := flag.String("host", "", "Override hostname from config file")
+	notify := flag.String("notify", "", "Desktop notifications when an answer changes or a server goes down: osc9 or osc777 (default: off)")
+	plain := flag.Bool("plain", false, "Print plain-text status without boxes, colors, or spinners, for screen readers and dumb terminals")
 	flag.Parse()
 
+	notifier, err := newNotifier(*notify, os.Stdout)
+	if err != nil {
+		return err
+	}
+
 	args := flag.Args()
 	var positionalHost string
 	if len(args) > 0 {
@@ -25,30 +35,39 @@ func Run() error {
 	}
 
 	// Resolve config path
-	configPath, _, err := dnsres.ResolveConfigPath(*configFile)
+	configPath, err := dnsres.ResolveConfigPath(*configFile)
 	if err != nil {
 		return fmt.Errorf("failed to resolve config path: %w", err)
 	}
 
 	var config *dnsres.Config
-	if configPath == "" {
-		config = dnsres.DefaultConfig()
-	} else {
+	switch {
+	case configPath != "":
 		config, err = dnsres.LoadConfig(configPath)
 		if err != nil {
 			return fmt.Errorf("failed to load config: %w", err)
 		}
+	case positionalHost != "" || *hostname != "":
+		config = dnsres.DefaultConfig()
+	default:
+		config, err = dnsres.FirstRunConfig(os.Stdin, os.Stdout)
+		if err != nil {
+			return err
+		}
 	}
 
 	if positionalHost != "" {
-		config.Hostnames = []string{positionalHost}
+		config.Hostnames = []string{dnsres.NormalizeHostname(positionalHost)}
 	} else if *hostname != "" {
-		config.Hostnames = []string{*hostname}
+		config.Hostnames = []string{dnsres.NormalizeHostname(*hostname)}
 	}
 
 	if len(config.Hostnames) == 0 {
 		return fmt.Errorf("hostname required: provide a domain as the first argument or use -host")
 	}
+	if config.ResultsFile.Path == dnsres.ResultsFileStdout {
+		return fmt.Errorf("results_file.path %q writes over the TUI; use a file path", dnsres.ResultsFileStdout)
+	}
 
 	resolver, err := dnsres.NewDNSResolver(config)
 	if err != nil {
@@ -65,13 +84,27 @@ func Run() error {
 		close(errCh)
 	}()
 
-	events, unsubscribe := resolver.SubscribeEvents(200)
+	events, unsubscribe := resolver.SubscribeEventsWithOptions(dnsres.SubscribeOptions{Buffer: 200, Durable: true, Name: "tui"})
 	model := newModel(resolver, config, cancel, events, unsubscribe, errCh)
-
-	program := tea.NewProgram(model, tea.WithAltScreen())
-	if err := program.Start(); err != nil {
+	model.ctx = ctx
+	model.configPath = configPath
+	model.notify = notifier
+
+	if *plain {
+		signalCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		err := model.runPlain(signalCtx, os.Stdout)
+		stop()
+		unsubscribe()
 		cancel()
-		return fmt.Errorf("failed to start TUI: %w", err)
+		if err != nil {
+			return err
+		}
+	} else {
+		program := tea.NewProgram(model, tea.WithAltScreen(), tea.WithMouseCellMotion())
+		if err := program.Start(); err != nil {
+			cancel()
+			return fmt.Errorf("failed to start TUI: %w", err)
+		}
 	}
 
 	if err := <-errCh; err != nil {
@@ -0,0 +1,308 @@
+package tui
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"dnsres/health"
+	"dnsres/internal/dnsres"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+type settingsSavedMsg struct {
+	config  *dnsres.Config
+	saved   bool
+	restart bool
+	err     error
+}
+
+// settingsField describes one row of the settings screen.
+type settingsField struct {
+	label string
+	// key is the config key the value is written to, as for
+	// dnsres.EditConfig.
+	key string
+	// restart marks settings the resolver fixes at startup.
+	restart bool
+	value   func(*dnsres.Config) string
+	parse   func(string) (any, error)
+}
+
+var settingsFields = []settingsField{
+	{
+		label: "Hostnames",
+		key:   "hostnames",
+		value: func(c *dnsres.Config) string { return strings.Join(c.Hostnames, " ") },
+		parse: parseList,
+	},
+	{
+		label: "DNS servers",
+		key:   "dns_servers",
+		value: func(c *dnsres.Config) string { return strings.Join(c.DNSServers, " ") },
+		parse: parseList,
+	},
+	{
+		label:   "Query interval",
+		key:     "query_interval",
+		restart: true,
+		value:   func(c *dnsres.Config) string { return c.QueryInterval.Duration.String() },
+		parse:   parseDuration,
+	},
+	{
+		label: "Query timeout",
+		key:   "query_timeout",
+		value: func(c *dnsres.Config) string { return c.QueryTimeout.Duration.String() },
+		parse: parseDuration,
+	},
+	{
+		label: "Breaker threshold",
+		key:   "circuit_breaker.threshold",
+		value: func(c *dnsres.Config) string { return strconv.Itoa(c.CircuitBreaker.Threshold) },
+		parse: parseCount,
+	},
+	{
+		label: "Breaker timeout",
+		key:   "circuit_breaker.timeout",
+		value: func(c *dnsres.Config) string { return c.CircuitBreaker.Timeout.Duration.String() },
+		parse: parseDuration,
+	},
+	{
+		label:   "Down after failures",
+		key:     "health_check.unhealthy_threshold",
+		restart: true,
+		value: func(c *dnsres.Config) string {
+			return strconv.Itoa(thresholdOrDefault(c.HealthCheck.UnhealthyThreshold, health.DefaultUnhealthyThreshold))
+		},
+		parse: parseCount,
+	},
+	{
+		label:   "Up after successes",
+		key:     "health_check.healthy_threshold",
+		restart: true,
+		value: func(c *dnsres.Config) string {
+			return strconv.Itoa(thresholdOrDefault(c.HealthCheck.HealthyThreshold, health.DefaultHealthyThreshold))
+		},
+		parse: parseCount,
+	},
+}
+
+// settingsForm is the settings screen: one text input per settingsFields
+// entry, prefilled from the running config.
+type settingsForm struct {
+	inputs  []textinput.Model
+	initial []string
+	focus   int
+	err     string
+	saving  bool
+}
+
+func newSettingsForm(config *dnsres.Config) *settingsForm {
+	form := &settingsForm{
+		inputs:  make([]textinput.Model, len(settingsFields)),
+		initial: make([]string, len(settingsFields)),
+	}
+	for i, field := range settingsFields {
+		input := textinput.New()
+		input.Prompt = ""
+		input.SetValue(field.value(config))
+		form.inputs[i] = input
+		form.initial[i] = input.Value()
+	}
+	form.inputs[0].Focus()
+	return form
+}
+
+// move shifts focus by delta fields, wrapping around.
+func (f *settingsForm) move(delta int) tea.Cmd {
+	f.inputs[f.focus].Blur()
+	f.focus = (f.focus + delta + len(f.inputs)) % len(f.inputs)
+	return f.inputs[f.focus].Focus()
+}
+
+func (f *settingsForm) update(msg tea.Msg) tea.Cmd {
+	var cmd tea.Cmd
+	f.inputs[f.focus], cmd = f.inputs[f.focus].Update(msg)
+	return cmd
+}
+
+// changes returns the config keys of the fields that were edited with their
+// parsed values, and whether any of them only applies after a restart.
+func (f *settingsForm) changes() (map[string]any, bool, error) {
+	settings := map[string]any{}
+	restart := false
+	for i, field := range settingsFields {
+		text := strings.TrimSpace(f.inputs[i].Value())
+		if text == strings.TrimSpace(f.initial[i]) {
+			continue
+		}
+		value, err := field.parse(text)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s %v", strings.ToLower(field.label), err)
+		}
+		settings[field.key] = value
+		restart = restart || field.restart
+	}
+	return settings, restart, nil
+}
+
+func (f *settingsForm) view(width int) string {
+	lines := []string{titleStyle.Render("Settings"), ""}
+	labelWidth := 0
+	for _, field := range settingsFields {
+		labelWidth = max(labelWidth, len(field.label))
+	}
+	for i, field := range settingsFields {
+		f.inputs[i].Width = max(width-labelWidth-16, 10)
+		marker := "  "
+		if i == f.focus {
+			marker = "> "
+		}
+		line := fmt.Sprintf("%s%-*s  %s", marker, labelWidth, field.label, f.inputs[i].View())
+		if field.restart {
+			line += mutedStyle.Render("  (restart)")
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "")
+	switch {
+	case f.saving:
+		lines = append(lines, mutedStyle.Render("Saving..."))
+	case f.err != "":
+		lines = append(lines, badStyle.Render(f.err))
+	}
+	lines = append(lines, mutedStyle.Render("tab/shift+tab move, enter save and apply, esc cancel"))
+	return strings.Join(lines, "\n")
+}
+
+// handleSettingsKey handles a key press while the settings screen is open.
+func (m *model) handleSettingsKey(msg tea.KeyMsg) tea.Cmd {
+	if m.settings.saving {
+		return nil
+	}
+	switch msg.String() {
+	case "esc":
+		m.settings = nil
+		return nil
+	case "tab", "down":
+		return m.settings.move(1)
+	case "shift+tab", "up":
+		return m.settings.move(-1)
+	case "enter", "ctrl+s":
+		return m.saveSettings()
+	}
+	return m.settings.update(msg)
+}
+
+// saveSettings validates the edited fields, then writes them to the config
+// file and queues the new config for the resolver.
+func (m *model) saveSettings() tea.Cmd {
+	settings, restart, err := m.settings.changes()
+	if err != nil {
+		m.settings.err = err.Error()
+		return nil
+	}
+	if len(settings) == 0 {
+		m.settings = nil
+		return nil
+	}
+	config, err := dnsres.EditConfig(m.config, settings)
+	if err != nil {
+		m.settings.err = err.Error()
+		return nil
+	}
+	m.settings.err = ""
+	m.settings.saving = true
+
+	resolver, path, ctx := m.resolver, m.configPath, m.ctx
+	return func() tea.Msg {
+		if path != "" {
+			if err := dnsres.SaveConfigSettings(path, settings); err != nil {
+				return settingsSavedMsg{err: err}
+			}
+		}
+		if err := resolver.Reload(ctx, config, "tui"); err != nil {
+			return settingsSavedMsg{err: fmt.Errorf("config not applied: %w", err)}
+		}
+		return settingsSavedMsg{config: config, saved: path != "", restart: restart}
+	}
+}
+
+// applySettingsSaved closes the settings screen once its changes are saved
+// and applied, or shows why they were not.
+func (m *model) applySettingsSaved(msg settingsSavedMsg) {
+	if msg.err != nil {
+		if m.settings != nil {
+			m.settings.saving = false
+			m.settings.err = msg.err.Error()
+		}
+		return
+	}
+	m.settings = nil
+	m.config = msg.config
+	m.restartPending = m.restartPending || msg.restart
+	m.setServers(msg.config.DNSServers)
+
+	activity := "settings applied"
+	if msg.saved {
+		activity = fmt.Sprintf("settings saved to %s and applied", m.configPath)
+	} else {
+		activity += " (no config file; not saved)"
+	}
+	if msg.restart {
+		activity += "; query interval and health thresholds change after a restart"
+	}
+	m.appendActivity(activity)
+}
+
+// setServers shows servers in the table, keeping the state of servers that
+// stay.
+func (m *model) setServers(servers []string) {
+	states := make(map[string]*serverState, len(servers))
+	for _, server := range servers {
+		if state, ok := m.servers[server]; ok {
+			states[server] = state
+		} else {
+			states[server] = &serverState{}
+		}
+	}
+	m.servers = states
+	m.serverOrder = append([]string(nil), servers...)
+	m.resize()
+	m.updateTableRows()
+}
+
+func parseList(text string) (any, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return nil, errors.New("must list at least one entry")
+	}
+	return fields, nil
+}
+
+func parseDuration(text string) (any, error) {
+	duration, err := time.ParseDuration(text)
+	if err != nil || duration <= 0 {
+		return nil, errors.New("must be a positive duration such as 30s")
+	}
+	return duration.String(), nil
+}
+
+func parseCount(text string) (any, error) {
+	count, err := strconv.Atoi(text)
+	if err != nil || count <= 0 {
+		return nil, errors.New("must be a positive whole number")
+	}
+	return count, nil
+}
+
+func thresholdOrDefault(value, fallback int) int {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,416 @@
+package tui
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"dnsres/internal/dnsres"
+
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// tab is one screen of the TUI, selected with its number key.
+type tab int
+
+const (
+	tabOverview tab = iota
+	tabServers
+	tabHostnames
+	tabCache
+	tabBreakers
+	tabEvents
+	tabConfig
+	tabCount
+)
+
+var tabNames = [tabCount]string{"Overview", "Servers", "Hostnames", "Cache", "Breakers", "Events", "Config"}
+
+var activeTabStyle = lipgloss.NewStyle().Bold(true).Reverse(true)
+
+// hostnameState is what the TUI has seen of one hostname's resolutions.
+type hostnameState struct {
+	lastAddresses []string
+	lastServer    string
+	lastSuccess   time.Time
+	lastError     string
+	failures      int
+}
+
+func (m *model) ensureHostname(hostname string) *hostnameState {
+	state, ok := m.hostnames[hostname]
+	if !ok {
+		state = &hostnameState{}
+		m.hostnames[hostname] = state
+	}
+	return state
+}
+
+// selectTab switches to t, which keeps its own scroll position.
+func (m *model) selectTab(t tab) {
+	m.tab = (t + tabCount) % tabCount
+	m.refreshPane()
+}
+
+// tabBar renders the tab names with their number keys.
+func (m *model) tabBar() string {
+	labels := make([]string, 0, tabCount)
+	for t, name := range tabNames {
+		label := fmt.Sprintf(" %d %s ", t+1, name)
+		if tab(t) == m.tab {
+			labels = append(labels, activeTabStyle.Render(label))
+		} else {
+			labels = append(labels, mutedStyle.Render(label))
+		}
+	}
+	return strings.Join(labels, " ")
+}
+
+// tabView renders the body of a tab other than the overview.
+func (m *model) tabView() string {
+	if m.tab == tabConfig && m.settings != nil {
+		return panelStyle.Width(m.width).Render(m.settings.view(m.width - 4))
+	}
+	return panelStyle.Width(m.width).Render(m.panes[m.tab].View())
+}
+
+// refreshPane renders the active tab's content into its viewport. The
+// events pane follows new events while scrolled to the bottom.
+func (m *model) refreshPane() {
+	if m.tab == tabOverview {
+		return
+	}
+	pane := &m.panes[m.tab]
+	follow := m.tab == tabEvents && pane.AtBottom()
+	pane.SetContent(m.paneContent(m.tab))
+	if follow {
+		pane.GotoBottom()
+	}
+}
+
+func (m *model) paneContent(t tab) string {
+	switch t {
+	case tabServers:
+		return m.serversView()
+	case tabHostnames:
+		return m.hostnamesView()
+	case tabCache:
+		return m.cacheView()
+	case tabBreakers:
+		return m.breakersView()
+	case tabEvents:
+		return m.historyView()
+	case tabConfig:
+		return m.configView()
+	}
+	return ""
+}
+
+// scroll passes navigation keys to the active tab's viewport.
+func (m *model) scroll(msg tea.KeyMsg) tea.Cmd {
+	var cmd tea.Cmd
+	if m.tab == tabOverview {
+		m.viewport, cmd = m.viewport.Update(msg)
+		return cmd
+	}
+	m.panes[m.tab], cmd = m.panes[m.tab].Update(msg)
+	return cmd
+}
+
+func (m *model) resizePanes() {
+	for t := range m.panes {
+		m.panes[t].Width = max(m.width-4, 10)
+		m.panes[t].Height = max(m.height-3, 3)
+	}
+	m.refreshPane()
+}
+
+func newPanes() [tabCount]viewport.Model {
+	var panes [tabCount]viewport.Model
+	for t := range panes {
+		panes[t] = viewport.New(0, 0)
+	}
+	return panes
+}
+
+// formatRows lays out rows as left-aligned columns under a bold header,
+// highlighting the row whose first column is selected.
+func formatRows(header []string, rows [][]string, selected string) string {
+	lines := alignRows(header, rows)
+	lines[0] = titleStyle.Render(lines[0])
+	for i, row := range rows {
+		if selected != "" && row[0] == selected {
+			lines[i+1] = selectedRowStyle.Render(lines[i+1])
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// alignRows pads the header and rows into left-aligned columns.
+func alignRows(header []string, rows [][]string) []string {
+	widths := make([]int, len(header))
+	for _, row := range append([][]string{header}, rows...) {
+		for i, cell := range row {
+			widths[i] = max(widths[i], len(cell))
+		}
+	}
+	format := func(row []string) string {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = fmt.Sprintf("%-*s", widths[i], cell)
+		}
+		return strings.TrimRight(strings.Join(cells, "  "), " ")
+	}
+	lines := []string{format(header)}
+	for _, row := range rows {
+		lines = append(lines, format(row))
+	}
+	return lines
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("15:04:05")
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+var (
+	serverColumns   = []string{"Server", "Health", "OK", "Failed", "Last OK", "Latency", "Breaker", "Last Error"}
+	hostnameColumns = []string{"Hostname", "Last Answer", "Via", "Last OK", "Failed", "Last Error"}
+)
+
+// serverRows returns a row of serverColumns for each server.
+func (m *model) serverRows() [][]string {
+	breakers := m.resolver.BreakerSnapshot()
+	now := time.Now()
+	rows := make([][]string, 0, len(m.serverOrder))
+	for _, server := range m.serverOrder {
+		state := m.servers[server]
+		latency := "-"
+		if state.lastLatency > 0 {
+			latency = state.lastLatency.Round(time.Millisecond).String()
+		}
+		rows = append(rows, []string{
+			server,
+			healthStatus(m.health[server], now),
+			fmt.Sprint(state.total),
+			fmt.Sprint(state.failures),
+			formatTime(state.lastSuccess),
+			latency,
+			orDash(breakers[server].State),
+			orDash(state.lastError),
+		})
+	}
+	return rows
+}
+
+// hostnameRows returns a row of hostnameColumns for each configured or
+// resolved hostname.
+func (m *model) hostnameRows() [][]string {
+	names := append([]string{}, m.config.Hostnames...)
+	for hostname := range m.hostnames {
+		names = append(names, hostname)
+	}
+	rows := [][]string{}
+	for _, hostname := range uniqueSorted(names) {
+		state, ok := m.hostnames[hostname]
+		if !ok {
+			state = &hostnameState{}
+		}
+		rows = append(rows, []string{
+			dnsres.DisplayHostname(hostname),
+			orDash(strings.Join(state.lastAddresses, " ")),
+			orDash(state.lastServer),
+			formatTime(state.lastSuccess),
+			fmt.Sprint(state.failures),
+			orDash(state.lastError),
+		})
+	}
+	return rows
+}
+
+// displayHostnames returns hostnames as shown to people.
+func displayHostnames(hostnames []string) []string {
+	display := make([]string, len(hostnames))
+	for i, hostname := range hostnames {
+		display[i] = dnsres.DisplayHostname(hostname)
+	}
+	return display
+}
+
+func (m *model) serversView() string {
+	view := formatRows(serverColumns, m.serverRows(), m.selected[tabServers])
+	if rows := scoreRows(m.resolver.ScoreSnapshot()); len(rows) > 0 {
+		view += "\n\n" + formatRows(scoreColumns, rows, "")
+	}
+	return view
+}
+
+var scoreColumns = []string{"Rank", "Server", "Score", "Avail", "p95", "Agree", "Breaker Opens"}
+
+// scoreRows returns a row of scoreColumns for each scored server, best
+// first.
+func scoreRows(scores []dnsres.ServerScore) [][]string {
+	rows := make([][]string, 0, len(scores))
+	for _, score := range scores {
+		p95 := time.Duration(score.LatencyP95Ms * float64(time.Millisecond)).Round(time.Millisecond)
+		rows = append(rows, []string{
+			fmt.Sprint(score.Rank),
+			score.Server,
+			fmt.Sprintf("%.1f", score.Score),
+			fmt.Sprintf("%.1f%%", score.Availability*100),
+			p95.String(),
+			fmt.Sprintf("%.1f%%", score.Agreement*100),
+			fmt.Sprint(score.BreakerOpens),
+		})
+	}
+	return rows
+}
+
+func (m *model) hostnamesView() string {
+	return formatRows(hostnameColumns, m.hostnameRows(), m.selected[tabHostnames])
+}
+
+func (m *model) cacheView() string {
+	stats := m.resolver.CacheSnapshot()
+	limit := func(value int64) string {
+		if value <= 0 {
+			return "unlimited"
+		}
+		return fmt.Sprint(value)
+	}
+	ratio := "n/a"
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		ratio = fmt.Sprintf("%.1f%%", stats.HitRatio*100)
+	}
+	return strings.Join([]string{
+		fmt.Sprintf("Entries: %d (max %s)", stats.Entries, limit(int64(stats.MaxEntries))),
+		fmt.Sprintf("Size: %d bytes (max %s)", stats.Bytes, limit(stats.MaxBytes)),
+		fmt.Sprintf("Hits: %d", stats.Hits),
+		fmt.Sprintf("Misses: %d", stats.Misses),
+		fmt.Sprintf("Hit ratio: %s", ratio),
+		fmt.Sprintf("Evictions: %d", stats.Evictions),
+		fmt.Sprintf("Expirations: %d", stats.Expirations),
+		"",
+		formatRows([]string{"Shard", "Entries", "Bytes", "Contended"}, shardRows(stats.Shards), ""),
+	}, "\n")
+}
+
+var breakerColumns = []string{"Server", "State", "Failures"}
+
+// breakerRows returns a row of breakerColumns for each breaker, by server.
+func (m *model) breakerRows() [][]string {
+	breakers := m.resolver.BreakerSnapshot()
+	servers := make([]string, 0, len(breakers))
+	for server := range breakers {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	rows := make([][]string, 0, len(servers))
+	for _, server := range servers {
+		rows = append(rows, []string{server, breakers[server].State, fmt.Sprint(breakers[server].Failures)})
+	}
+	return rows
+}
+
+func shardRows(shards []dnsres.CacheShardStats) [][]string {
+	rows := make([][]string, 0, len(shards))
+	for i, shard := range shards {
+		rows = append(rows, []string{fmt.Sprint(i), fmt.Sprint(shard.Entries), fmt.Sprint(shard.Bytes), fmt.Sprint(shard.Contended)})
+	}
+	return rows
+}
+
+func (m *model) breakersView() string {
+	header := fmt.Sprintf("Opens after %d consecutive failures, retries after %s\n\n",
+		m.config.CircuitBreaker.Threshold, m.config.CircuitBreaker.Timeout.Duration)
+	return header + formatRows(breakerColumns, m.breakerRows(), m.selected[tabBreakers])
+}
+
+func (m *model) configView() string {
+	source := m.configPath
+	if source == "" {
+		source = "none (running process only)"
+	}
+	lines := []string{
+		fmt.Sprintf("Config file: %s", source),
+		fmt.Sprintf("Hostnames: %s", strings.Join(displayHostnames(m.config.Hostnames), " ")),
+		fmt.Sprintf("DNS servers: %s", strings.Join(m.config.DNSServers, " ")),
+		fmt.Sprintf("Query interval: %s", m.config.QueryInterval.Duration),
+		fmt.Sprintf("Query timeout: %s", m.config.QueryTimeout.Duration),
+		fmt.Sprintf("Circuit breaker: threshold %d, timeout %s", m.config.CircuitBreaker.Threshold, m.config.CircuitBreaker.Timeout.Duration),
+		fmt.Sprintf("Health check: unhealthy after %d, healthy after %d", m.config.HealthCheck.UnhealthyThreshold, m.config.HealthCheck.HealthyThreshold),
+		fmt.Sprintf("Cache: %d entries", m.config.Cache.MaxSize),
+		fmt.Sprintf("Log directory: %s", m.resolver.GetLogDir()),
+		fmt.Sprintf("Listening: %s", listenerSummary(m.resolver.ListenPorts())),
+	}
+	if leader := m.resolver.LeaderSnapshot(); leader != nil {
+		lines = append(lines, fmt.Sprintf("Leader election: %s", leaderSummary(leader)))
+	}
+	lines = append(lines, "", mutedStyle.Render("e to edit settings"))
+	return strings.Join(lines, "\n")
+}
+
+// listenerSummary lists the port each listener bound, such as
+// "health :8880, metrics :9990".
+func listenerSummary(ports map[string]int) string {
+	if len(ports) == 0 {
+		return "not yet"
+	}
+	names := make([]string, 0, len(ports))
+	for name := range ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s :%d", name, ports[name])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// leaderSummary describes the instance's part in leader election, such as
+// "standby via etcd (leader probe-b)".
+func leaderSummary(leader *dnsres.LeaderStatus) string {
+	role := "standby"
+	if leader.Leader {
+		role = "leader"
+	}
+	summary := fmt.Sprintf("%s via %s", role, leader.Backend)
+	if !leader.Leader && leader.Holder != "" {
+		summary += fmt.Sprintf(" (leader %s)", leader.Holder)
+	}
+	if leader.LastError != "" {
+		summary += ", last error: " + leader.LastError
+	}
+	return summary
+}
+
+// applyHostnameEvent keeps the hostnames tab's view of resolutions.
+func (m *model) applyHostnameEvent(event dnsres.ResolverEvent) {
+	if event.Hostname == "" {
+		return
+	}
+	state := m.ensureHostname(event.Hostname)
+	switch event.Type {
+	case dnsres.EventResolveSuccess:
+		state.lastAddresses = append([]string(nil), event.Addresses...)
+		state.lastServer = event.Server
+		state.lastSuccess = event.Time
+		state.lastError = ""
+	case dnsres.EventResolveFailure:
+		state.failures++
+		state.lastError = event.Error
+	}
+}
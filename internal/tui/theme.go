@@ -24,4 +24,6 @@ var (
 	goodStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("#2E8540")).Bold(true)
 	badStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("#B71C1C")).Bold(true)
 	warnStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("#F9A825")).Bold(true)
+
+	selectedRowStyle = lipgloss.NewStyle().Reverse(true)
 )
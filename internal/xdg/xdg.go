@@ -2,6 +2,7 @@ package xdg
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -46,29 +47,27 @@ func DataHome() string {
 	return filepath.Join(home, ".local", "share")
 }
 
-// ConfigFile returns the path to the dnsres config file.
-// If the file doesn't exist, it creates it with minimal defaults.
-// Returns: (path, wasCreated, error)
-func ConfigFile() (string, bool, error) {
-	configDir := filepath.Join(ConfigHome(), "dnsres")
-	configPath := filepath.Join(configDir, "config.json")
+// ConfigFile returns the path to the dnsres config file and whether it
+// exists. The file is never created here; see WriteConfig.
+func ConfigFile() (string, bool) {
+	configPath := filepath.Join(ConfigHome(), "dnsres", "config.json")
+	return configPath, fileExists(configPath)
+}
 
-	// If config exists, return it
-	if fileExists(configPath) {
-		return configPath, false, nil
+// WriteConfig writes a minimal config file monitoring hostnames through
+// servers to path, creating its directory. An existing file is not
+// overwritten.
+func WriteConfig(path string, hostnames, servers []string) error {
+	if len(hostnames) == 0 {
+		return errors.New("at least one hostname is required")
 	}
-
-	// Create directory
-	if err := os.MkdirAll(configDir, 0755); err != nil {
-		return "", false, fmt.Errorf("failed to create config directory: %w", err)
+	if len(servers) == 0 {
+		return errors.New("at least one DNS server is required")
 	}
-
-	// Create minimal default config file
-	if err := createMinimalConfig(configPath); err != nil {
-		return "", false, fmt.Errorf("failed to create default config: %w", err)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
 	}
-
-	return configPath, true, nil
+	return createMinimalConfig(path, hostnames, servers)
 }
 
 // EnsureStateDir ensures the dnsres state directory exists.
@@ -105,12 +104,11 @@ func fileExists(path string) bool {
 }
 
 // createMinimalConfig creates a minimal config file with essential fields only.
-func createMinimalConfig(path string) error {
+func createMinimalConfig(path string, hostnames, servers []string) (err error) {
 	// Minimal config with all required fields and reasonable defaults
-	// Users can override hostnames via command line or edit this file
 	config := map[string]interface{}{
-		"hostnames":             []string{"example.com"},
-		"dns_servers":           []string{"8.8.8.8:53", "1.1.1.1:53", "9.9.9.9:53"},
+		"hostnames":             hostnames,
+		"dns_servers":           servers,
 		"query_timeout":         "5s",
 		"query_interval":        "30s",
 		"health_port":           8880,
@@ -126,7 +124,7 @@ func createMinimalConfig(path string) error {
 		},
 	}
 
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
 		return err
 	}
@@ -133,72 +133,52 @@ func TestConfigFile(t *testing.T) {
 	oldValue := os.Getenv("XDG_CONFIG_HOME")
 	defer os.Setenv("XDG_CONFIG_HOME", oldValue)
 	os.Setenv("XDG_CONFIG_HOME", tempDir)
+	expectedPath := filepath.Join(tempDir, "dnsres", "config.json")
 
-	t.Run("creates config file when it does not exist", func(t *testing.T) {
-		configPath, wasCreated, err := ConfigFile()
-		if err != nil {
-			t.Fatalf("ConfigFile() error = %v", err)
-		}
-		if !wasCreated {
-			t.Error("ConfigFile() should report file was created")
+	t.Run("does not create a missing config file", func(t *testing.T) {
+		configPath, exists := ConfigFile()
+		if exists {
+			t.Error("ConfigFile() should report a missing file")
 		}
-
-		expectedPath := filepath.Join(tempDir, "dnsres", "config.json")
 		if configPath != expectedPath {
 			t.Errorf("ConfigFile() path = %v, want %v", configPath, expectedPath)
 		}
-
-		// Verify file exists
-		if _, err := os.Stat(configPath); err != nil {
-			t.Errorf("config file should exist: %v", err)
-		}
-
-		// Verify file permissions
-		info, err := os.Stat(configPath)
-		if err != nil {
-			t.Fatalf("failed to stat config file: %v", err)
-		}
-		if info.Mode().Perm() != 0644 {
-			t.Errorf("config file permissions = %v, want 0644", info.Mode().Perm())
-		}
-
-		// Verify it's valid JSON with expected fields
-		data, err := os.ReadFile(configPath)
-		if err != nil {
-			t.Fatalf("failed to read config file: %v", err)
-		}
-
-		var config map[string]interface{}
-		if err := json.Unmarshal(data, &config); err != nil {
-			t.Fatalf("config file is not valid JSON: %v", err)
-		}
-
-		// Check essential fields
-		requiredFields := []string{"hostnames", "dns_servers", "query_timeout", "query_interval"}
-		for _, field := range requiredFields {
-			if _, ok := config[field]; !ok {
-				t.Errorf("config missing required field: %s", field)
-			}
+		if _, err := os.Stat(configPath); !os.IsNotExist(err) {
+			t.Errorf("config file should not be created, stat error = %v", err)
 		}
 	})
 
-	t.Run("returns existing config file without creating new one", func(t *testing.T) {
-		// Call again
-		configPath, wasCreated, err := ConfigFile()
-		if err != nil {
-			t.Fatalf("ConfigFile() error = %v", err)
+	t.Run("reports an existing config file", func(t *testing.T) {
+		if err := WriteConfig(expectedPath, []string{"www.example.org"}, []string{"1.1.1.1:53"}); err != nil {
+			t.Fatalf("WriteConfig() error = %v", err)
 		}
-		if wasCreated {
-			t.Error("ConfigFile() should report file was not created when it exists")
+		configPath, exists := ConfigFile()
+		if !exists {
+			t.Error("ConfigFile() should report the file exists")
 		}
-
-		expectedPath := filepath.Join(tempDir, "dnsres", "config.json")
 		if configPath != expectedPath {
 			t.Errorf("ConfigFile() path = %v, want %v", configPath, expectedPath)
 		}
 	})
 }
 
+func TestWriteConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "nested", "config.json")
+
+	if err := WriteConfig(configPath, nil, []string{"1.1.1.1:53"}); err == nil {
+		t.Error("WriteConfig() should require a hostname")
+	}
+	if err := WriteConfig(configPath, []string{"www.example.org"}, nil); err == nil {
+		t.Error("WriteConfig() should require a DNS server")
+	}
+	if err := WriteConfig(configPath, []string{"www.example.org"}, []string{"1.1.1.1:53"}); err != nil {
+		t.Fatalf("WriteConfig() error = %v", err)
+	}
+	if err := WriteConfig(configPath, []string{"other.example.org"}, []string{"1.1.1.1:53"}); err == nil {
+		t.Error("WriteConfig() should not overwrite an existing file")
+	}
+}
+
 func TestEnsureStateDir(t *testing.T) {
 	tempDir := t.TempDir()
 
@@ -322,7 +302,7 @@ func TestCreateMinimalConfig(t *testing.T) {
 	tempDir := t.TempDir()
 	configPath := filepath.Join(tempDir, "config.json")
 
-	if err := createMinimalConfig(configPath); err != nil {
+	if err := createMinimalConfig(configPath, []string{"www.example.org"}, []string{"8.8.8.8:53", "1.1.1.1:53"}); err != nil {
 		t.Fatalf("createMinimalConfig() error = %v", err)
 	}
 
@@ -372,12 +352,12 @@ func TestCreateMinimalConfig(t *testing.T) {
 	}
 
 	// Verify specific values
-	if hostnames, ok := config["hostnames"].([]interface{}); !ok || len(hostnames) == 0 {
-		t.Error("hostnames should be a non-empty array")
+	if hostnames, ok := config["hostnames"].([]interface{}); !ok || len(hostnames) != 1 || hostnames[0] != "www.example.org" {
+		t.Errorf("hostnames = %v, want [www.example.org]", config["hostnames"])
 	}
 
-	if servers, ok := config["dns_servers"].([]interface{}); !ok || len(servers) == 0 {
-		t.Error("dns_servers should be a non-empty array")
+	if servers, ok := config["dns_servers"].([]interface{}); !ok || len(servers) != 2 {
+		t.Errorf("dns_servers = %v, want the two given servers", config["dns_servers"])
 	}
 
 	if timeout, ok := config["query_timeout"].(string); !ok || timeout != "5s" {
@@ -31,6 +31,22 @@ var (
 		[]string{"server", "hostname", "error_type"},
 	)
 
+	DNSResolutionMalformed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_resolution_malformed_total",
+			Help: "Responses that could not be parsed or did not answer their query, by class",
+		},
+		[]string{"server", "class"},
+	)
+
+	DNSResolutionMismatched = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_resolution_mismatched_replies_total",
+			Help: "Replies whose transaction ID or question did not match the outstanding query, a sign of spoofing or a broken middlebox",
+		},
+		[]string{"server", "reason"},
+	)
+
 	DNSResolutionDuration = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "dns_resolution_duration_seconds",
@@ -48,6 +64,95 @@ var (
 		[]string{"hostname"},
 	)
 
+	DNSResolutionFlapping = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_resolution_flapping",
+			Help: "Whether a server's answers for the hostname alternate between sets across cycles",
+		},
+		[]string{"hostname"},
+	)
+
+	DNSResolutionLatencyBaseline = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_resolution_latency_baseline_seconds",
+			Help: "Learned baseline latency of queries to a server for a hostname",
+		},
+		[]string{"server", "hostname"},
+	)
+
+	DNSResolutionLatencyAnomaly = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_resolution_latency_anomaly",
+			Help: "Whether queries to a server for a hostname take a multiple of their baseline latency",
+		},
+		[]string{"server", "hostname"},
+	)
+
+	DNSResolutionLatencyAnomalies = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_resolution_latency_anomalies_total",
+			Help: "Number of latency anomalies started by server",
+		},
+		[]string{"server"},
+	)
+
+	DNSResolutionHedges = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_resolution_hedges_total",
+			Help: "Hedged queries sent to a second server by whether it answered first",
+		},
+		[]string{"server", "result"},
+	)
+
+	DNSResolutionInFlight = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_resolution_in_flight",
+			Help: "Queries in flight to servers with a max_in_flight cap",
+		},
+		[]string{"server"},
+	)
+
+	DNSResolutionSlotQueueDepth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_resolution_slot_queue_depth",
+			Help: "Queries waiting for a free slot under a server's max_in_flight cap",
+		},
+		[]string{"server"},
+	)
+
+	DNSResolutionSlotWait = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dns_resolution_slot_wait_seconds",
+			Help:    "Time queries waited for a free slot under a server's max_in_flight cap",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		},
+		[]string{"server"},
+	)
+
+	DNSServerScore = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_server_score",
+			Help: "Composite health score of a DNS server from 0 to 100",
+		},
+		[]string{"server"},
+	)
+
+	DNSReferenceDivergence = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_reference_divergence",
+			Help: "Whether a server's addresses differ from the reference server's",
+		},
+		[]string{"server", "hostname"},
+	)
+
+	DNSReferenceLatencyDelta = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_reference_latency_delta_seconds",
+			Help: "How much longer a server took to answer than the reference server",
+		},
+		[]string{"server", "hostname"},
+	)
+
 	DNSResolutionCycleDuration = promauto.NewHistogram(
 		prometheus.HistogramOpts{
 			Name:    "dns_resolution_cycle_duration_seconds",
@@ -198,6 +303,58 @@ var (
 		},
 	)
 
+	CacheExpirations = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dns_resolver_cache_expirations_total",
+			Help: "Total number of cache entries removed after their TTL expired",
+		},
+	)
+
+	CacheBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dns_resolver_cache_bytes",
+			Help: "Current estimated size of the DNS cache in bytes",
+		},
+	)
+
+	CacheHitRatio = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dns_resolver_cache_hit_ratio",
+			Help: "Cache hits as a fraction of cache lookups since startup",
+		},
+	)
+
+	CacheShardEntries = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_resolver_cache_shard_entries",
+			Help: "Current number of entries in each cache shard",
+		},
+		[]string{"shard"},
+	)
+
+	CacheShardBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_resolver_cache_shard_bytes",
+			Help: "Current estimated size of each cache shard in bytes",
+		},
+		[]string{"shard"},
+	)
+
+	CacheLockContention = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_resolver_cache_lock_contention_total",
+			Help: "Cache shard lock acquisitions that had to wait for another holder",
+		},
+		[]string{"shard"},
+	)
+
+	CacheRefreshWaits = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dns_resolver_cache_refresh_waits_total",
+			Help: "Cache lookups that waited for another caller to re-query an expired entry",
+		},
+	)
+
 	// Circuit Breaker Metrics
 	CircuitBreakerState = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -215,6 +372,30 @@ var (
 		[]string{"server"},
 	)
 
+	CircuitBreakerStateSeconds = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "circuit_breaker_state_seconds_total",
+			Help: "Seconds each server's circuit breaker spent in each state (closed, open, half-open), counted whenever the breaker is used",
+		},
+		[]string{"server", "state"},
+	)
+
+	CircuitBreakerOpenings = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "circuit_breaker_open_total",
+			Help: "Number of times each server's circuit breaker opened",
+		},
+		[]string{"server"},
+	)
+
+	CircuitBreakerLastStateChange = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "circuit_breaker_last_state_change_timestamp_seconds",
+			Help: "Unix time of the last state change of each server's circuit breaker, or of its creation",
+		},
+		[]string{"server"},
+	)
+
 	// Health Check Metrics
 	HealthStatus = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -233,6 +414,339 @@ var (
 		[]string{"server"},
 	)
 
+	DNSServerNodeChanges = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_server_node_changes_total",
+			Help: "Number of times the anycast node answering for a server changed",
+		},
+		[]string{"server"},
+	)
+
+	DNSServerFingerprintChanges = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_server_fingerprint_changes_total",
+			Help: "Number of times the inferred resolver software for a server changed",
+		},
+		[]string{"server"},
+	)
+
+	DNSServerDNS64 = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_server_dns64",
+			Help: "Whether the server synthesizes AAAA records via DNS64 (1=yes, 0=no)",
+		},
+		[]string{"server"},
+	)
+
+	DNSServerInterception = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_server_interception",
+			Help: "Whether the interception probe found the server rewriting NXDOMAIN or behind a captive portal (1=yes, 0=no) by kind",
+		},
+		[]string{"server", "kind"},
+	)
+
+	DNSResolutionDNS64 = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_resolution_dns64_total",
+			Help: "Number of responses containing DNS64-synthesized AAAA records",
+		},
+		[]string{"server", "hostname"},
+	)
+
+	DNSServerRoleQueries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_server_role_queries_total",
+			Help: "Number of queries per server by role (primary, fallback) and result (success, failure)",
+		},
+		[]string{"server", "role", "result"},
+	)
+
+	DNSResolutionFallbacks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_resolution_fallback_total",
+			Help: "Number of times fallback servers were queried because a primary failed",
+		},
+		[]string{"hostname"},
+	)
+
+	DNSResForwarderQueries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsres_forwarder_queries_total",
+			Help: "Queries answered by the local DNS forwarder by result (cache, consensus, disagreement, forwarded, servfail)",
+		},
+		[]string{"result"},
+	)
+
+	DNSResDiscoveredHostnames = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dnsres_discovered_hostnames",
+			Help: "Number of hostnames most recently returned by each discovery source",
+		},
+		[]string{"source"},
+	)
+
+	DNSResAnalyzerFindings = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsres_analyzer_findings_total",
+			Help: "Number of findings reported by response analyzers by analyzer and severity",
+		},
+		[]string{"analyzer", "severity"},
+	)
+
+	DNSResBlockedAnswers = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsres_blocked_answers_total",
+			Help: "Number of answers that matched a screening blocklist by server and list",
+		},
+		[]string{"server", "list"},
+	)
+
+	DNSResIncidentsOpen = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dnsres_incidents_open",
+			Help: "Number of hostnames with an open incident",
+		},
+	)
+
+	DNSResBurstActive = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dnsres_burst_active",
+			Help: "Whether a hostname is being polled at the burst rate after a failure or inconsistency (1) or not (0)",
+		},
+		[]string{"hostname"},
+	)
+
+	DNSResEmailAlerts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsres_email_alerts_total",
+			Help: "Email alerts by result (sent, suppressed by the rate limit, standby when another instance leads, or failed)",
+		},
+		[]string{"result"},
+	)
+
+	DNSResPublishedEvents = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsres_published_events_total",
+			Help: "Resolver events sent to the MQTT or NATS broker by result (published or dropped)",
+		},
+		[]string{"result"},
+	)
+
+	DNSResKafkaRecords = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsres_kafka_records_total",
+			Help: "Resolution results sent to Kafka by result (written, failed after retries, or dropped because the buffer was full)",
+		},
+		[]string{"result"},
+	)
+
+	DNSResKafkaBuffered = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dnsres_kafka_buffered_records",
+			Help: "Resolution results waiting to be written to Kafka",
+		},
+	)
+
+	DNSResResultsFileRecords = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsres_results_file_records_total",
+			Help: "Resolution results written to the results file by result (written or failed)",
+		},
+		[]string{"result"},
+	)
+
+	DNSResSlowQueries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsres_slow_queries_total",
+			Help: "Queries written to the slow query log for taking at least slow_query_log.threshold",
+		},
+		[]string{"server"},
+	)
+
+	DNSResArchiveObjects = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsres_archive_objects_total",
+			Help: "Rotated logs and reports sent to object storage by kind (log or report) and result (uploaded, failed, or expired and deleted)",
+		},
+		[]string{"kind", "result"},
+	)
+
+	DNSResReports = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsres_reports_total",
+			Help: "Scheduled reports by destination (email, webhook or slack) and result (sent, failed, or standby when another instance leads)",
+		},
+		[]string{"destination", "result"},
+	)
+
+	DNSResGRPCRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsres_grpc_requests_total",
+			Help: "gRPC API calls by method and status code",
+		},
+		[]string{"method", "code"},
+	)
+
+	DNSResMemoryPressure = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dnsres_memory_budget_pressure",
+			Help: "Heap in use as a fraction of memory.budget_mb; above 1 the cache and event history are shrunk and hostname labels aggregated",
+		},
+	)
+
+	DNSResCheckPassing = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dnsres_check_passing",
+			Help: "Whether a configured check expression held for every server's response in the last cycle (1) or not (0)",
+		},
+		[]string{"hostname", "check"},
+	)
+
+	DNSResLogFileBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dnsres_log_file_bytes",
+			Help: "Current size of each dnsres log file in bytes",
+		},
+		[]string{"stream"},
+	)
+
+	DNSResSchedulerLag = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "dnsres_scheduler_lag_seconds",
+			Help:    "Delay between a scheduler tick firing and its resolution cycle starting",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		},
+	)
+
+	DNSResSchedulerQueueDepth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dnsres_scheduler_queue_depth",
+			Help: "Hostnames due for resolution and waiting for a concurrency slot, by tier (interval, scheduled or burst)",
+		},
+		[]string{"tier"},
+	)
+
+	DNSResSchedulerWait = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dnsres_scheduler_wait_seconds",
+			Help:    "Time from a hostname's work being due until its resolution started, by tier",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		},
+		[]string{"tier"},
+	)
+
+	DNSResSchedulerDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsres_scheduler_dropped_total",
+			Help: "Work dropped or skipped by the scheduler, by tier and reason (tick_skipped, firing_skipped or cycle_timeout)",
+		},
+		[]string{"tier", "reason"},
+	)
+
+	DNSResCycleOverlaps = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dnsres_cycle_overlaps_total",
+			Help: "Number of resolution cycles that ran longer than the query interval",
+		},
+	)
+
+	DNSResSampledHostnames = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dnsres_sampled_hostnames",
+			Help: "Hostnames resolved in the last cycle when sampling is on",
+		},
+	)
+
+	DNSResSamplingCoverage = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dnsres_sampling_coverage_ratio",
+			Help: "Fraction of the hostnames resolved so far in the current sampling round",
+		},
+	)
+
+	DNSResSamplingRounds = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dnsres_sampling_rounds_total",
+			Help: "Completed sampling rounds, each covering every hostname",
+		},
+	)
+
+	DNSResRandomizationBits = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dnsres_randomization_entropy_bits",
+			Help: "Entropy measured by the startup randomization audit, by kind (id or port)",
+		},
+		[]string{"kind"},
+	)
+
+	DNSResLeader = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dnsres_leader",
+			Help: "1 while this instance is the elected leader and sends alerts and reports, 0 while it stands by",
+		},
+	)
+
+	DNSResLeaderTransitions = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dnsres_leader_transitions_total",
+			Help: "Times this instance became leader or stepped down",
+		},
+	)
+
+	DNSResLeaderElectionErrors = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dnsres_leader_election_errors_total",
+			Help: "Leader election campaigns that failed to reach the lock backend",
+		},
+	)
+
+	DNSResWarmingUp = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dnsres_warming_up",
+			Help: "1 during the warm_up window after startup, when failures do not trip circuit breakers or raise alerts",
+		},
+	)
+
+	DNSResCycleTimeouts = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dnsres_cycle_timeouts_total",
+			Help: "Resolution cycles canceled at cycle_timeout with queries still running or hostnames not yet queried",
+		},
+	)
+
+	DNSResEventBusDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsres_event_bus_dropped_total",
+			Help: "Number of resolver events dropped because a subscriber fell behind, by subscriber name",
+		},
+		[]string{"subscriber", "durable"},
+	)
+
+	DNSResEventBusSubscribers = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dnsres_event_bus_subscribers",
+			Help: "Active event bus subscribers by subscriber name (tui, grpc, email, publish, other)",
+		},
+		[]string{"subscriber"},
+	)
+
+	DNSResEventBusPublished = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsres_event_bus_published_total",
+			Help: "Number of resolver events published to the event bus by event type",
+		},
+		[]string{"type"},
+	)
+
+	DNSResConfigReloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsres_config_reloads_total",
+			Help: "Number of configuration reload attempts by result (success, failure)",
+		},
+		[]string{"result"},
+	)
+
 	DNSRecordCount = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "dns_record_count",
@@ -242,6 +756,15 @@ var (
 		[]string{"server", "hostname", "type"},
 	)
 
+	DNSResolutionPhaseDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dns_resolution_phase_duration_seconds",
+			Help:    "DNS query latency by phase: queue, connect, network and processing",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		},
+		[]string{"server", "phase"},
+	)
+
 	DNSResponseSize = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "dns_response_size_bytes",
@@ -251,3 +774,34 @@ var (
 		[]string{"server", "hostname"},
 	)
 )
+
+// AggregatedHostname replaces the hostname label of every metric labeled by
+// hostname while the memory budget is exceeded.
+const AggregatedHostname = "_aggregated"
+
+// ResetHostnameSeries drops every series of the metrics labeled by hostname,
+// freeing their memory when labels are aggregated.
+func ResetHostnameSeries() {
+	for _, vec := range []interface{ Reset() }{
+		DNSResolutionTotal,
+		DNSResolutionSuccess,
+		DNSResolutionFailure,
+		DNSResolutionDuration,
+		DNSResolutionConsistency,
+		DNSResolutionFlapping,
+		DNSResolutionFallbacks,
+		DNSResolutionCacheHit,
+		DNSResolutionCacheMiss,
+		DNSResolutionNXDOMAIN,
+		DNSResolutionDNS64,
+		DNSResponseSize,
+		DNSReferenceDivergence,
+		DNSReferenceLatencyDelta,
+		DNSResolutionLatencyBaseline,
+		DNSResolutionLatencyAnomaly,
+		DNSResBurstActive,
+		DNSResCheckPassing,
+	} {
+		vec.Reset()
+	}
+}
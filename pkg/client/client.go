@@ -0,0 +1,231 @@
+// Package client calls the dnsres HTTP API, described by the OpenAPI 3
+// document each instance serves at /openapi.json.
+//
+// Each operation in the document has a method named after its operationId:
+//
+//	c := client.New("http://monitor.example:8880")
+//	stats, err := c.GetStats(ctx)
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Client talks to one dnsres instance. It is safe for concurrent use.
+type Client struct {
+	baseURL string
+	http    *http.Client
+}
+
+// Option customizes a Client.
+type Option func(*Client)
+
+// WithHTTPClient sends requests with hc instead of http.DefaultClient, e.g.
+// to set a timeout or TLS configuration.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// New returns a client for the instance whose health_port is reachable at
+// baseURL, e.g. "http://localhost:8880".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{baseURL: strings.TrimSuffix(baseURL, "/"), http: http.DefaultClient}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Error is a response with an unexpected status code.
+type Error struct {
+	StatusCode int
+	// Body is the start of the response body, which explains 400 errors.
+	Body string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("dnsres API: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// GetHealth returns the health check's status with per-server details. An
+// unhealthy instance is not an error; check Status.
+func (c *Client) GetHealth(ctx context.Context) (HealthStatus, error) {
+	var status HealthStatus
+	err := c.get(ctx, "/", url.Values{"format": {"json"}}, &status, http.StatusServiceUnavailable)
+	return status, err
+}
+
+// GetLive reports whether the instance's process is serving requests.
+func (c *Client) GetLive(ctx context.Context) (bool, error) {
+	return c.probe(ctx, "/livez")
+}
+
+// GetStartup reports whether the instance has loaded its configuration.
+func (c *Client) GetStartup(ctx context.Context) (bool, error) {
+	return c.probe(ctx, "/startupz")
+}
+
+// GetReady reports whether the instance has completed a resolution cycle.
+func (c *Client) GetReady(ctx context.Context) (bool, error) {
+	return c.probe(ctx, "/readyz")
+}
+
+// GetStats returns the resolver statistics.
+func (c *Client) GetStats(ctx context.Context) (StatsSnapshot, error) {
+	var stats StatsSnapshot
+	err := c.get(ctx, "/stats", nil, &stats)
+	return stats, err
+}
+
+// ListRecentEventsParams filters ListRecentEvents. The zero value returns
+// every event kept in memory.
+type ListRecentEventsParams struct {
+	Limit int
+	Type  EventType
+}
+
+// ListRecentEvents returns recent events, oldest first.
+func (c *Client) ListRecentEvents(ctx context.Context, params ListRecentEventsParams) ([]ResolverEvent, error) {
+	query := limitQuery(params.Limit)
+	if params.Type != "" {
+		query.Set("type", string(params.Type))
+	}
+	var events []ResolverEvent
+	err := c.get(ctx, "/events/recent", query, &events)
+	return events, err
+}
+
+// ListAudit returns up to limit recent control actions, oldest first. A
+// limit of zero returns every entry kept in memory.
+func (c *Client) ListAudit(ctx context.Context, limit int) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := c.get(ctx, "/audit", limitQuery(limit), &entries)
+	return entries, err
+}
+
+// ListIncidentsParams filters ListIncidents.
+type ListIncidentsParams struct {
+	Limit int
+	// Open returns only open incidents.
+	Open bool
+}
+
+// ListIncidents returns open incidents followed by recently closed ones,
+// newest first.
+func (c *Client) ListIncidents(ctx context.Context, params ListIncidentsParams) ([]Incident, error) {
+	query := limitQuery(params.Limit)
+	if params.Open {
+		query.Set("open", "true")
+	}
+	var incidents []Incident
+	err := c.get(ctx, "/incidents", query, &incidents)
+	return incidents, err
+}
+
+// ListMalformed returns up to limit recent malformed or non-conformant
+// responses, oldest first. A limit of zero returns every sample kept.
+func (c *Client) ListMalformed(ctx context.Context, limit int) ([]MalformedSample, error) {
+	var samples []MalformedSample
+	err := c.get(ctx, "/malformed", limitQuery(limit), &samples)
+	return samples, err
+}
+
+// ListHostnameTargets returns the monitored hostnames as Prometheus HTTP
+// service discovery target groups.
+func (c *Client) ListHostnameTargets(ctx context.Context) ([]TargetGroup, error) {
+	var groups []TargetGroup
+	err := c.get(ctx, "/sd/hostnames", nil, &groups)
+	return groups, err
+}
+
+// ListServerTargets returns the configured DNS servers as Prometheus HTTP
+// service discovery target groups.
+func (c *Client) ListServerTargets(ctx context.Context) ([]TargetGroup, error) {
+	var groups []TargetGroup
+	err := c.get(ctx, "/sd/servers", nil, &groups)
+	return groups, err
+}
+
+// GetHostnameRollup returns the latest state of hostname across servers. A
+// hostname no server answers for is not an error; check Verdict.
+func (c *Client) GetHostnameRollup(ctx context.Context, hostname string) (HostnameRollup, error) {
+	var rollup HostnameRollup
+	err := c.get(ctx, "/hostz/"+url.PathEscape(hostname), nil, &rollup, http.StatusServiceUnavailable)
+	return rollup, err
+}
+
+// GetOpenAPI returns the instance's OpenAPI document.
+func (c *Client) GetOpenAPI(ctx context.Context) (json.RawMessage, error) {
+	var document json.RawMessage
+	err := c.get(ctx, "/openapi.json", nil, &document)
+	return document, err
+}
+
+func limitQuery(limit int) url.Values {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	return query
+}
+
+// get decodes the JSON response of path into out. Status codes other than
+// 200 and those in also are errors.
+func (c *Client) get(ctx context.Context, path string, query url.Values, out any, also ...int) error {
+	resp, err := c.do(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && !slices.Contains(also, resp.StatusCode) {
+		return responseError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s response: %w", path, err)
+	}
+	return nil
+}
+
+// probe reports whether a probe endpoint answered 200 rather than 503.
+func (c *Client) probe(ctx context.Context, path string) (bool, error) {
+	resp, err := c.do(ctx, path, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusServiceUnavailable:
+		return false, nil
+	}
+	return false, responseError(resp)
+}
+
+func (c *Client) do(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	return c.http.Do(req)
+}
+
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &Error{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientQueriesAndErrors(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		queries = append(queries, req.URL.RequestURI())
+		switch req.URL.Path {
+		case "/":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"status":"unhealthy","timestamp":"2024-03-14T11:00:00Z","details":{"192.0.2.53:53":"unreachable"}}`))
+		case "/readyz":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not ready"))
+		case "/incidents":
+			w.Write([]byte(`[{"id":2,"hostname":"a.example","started":"2024-03-14T11:00:00Z","causes":["failure"],"servers":[],"events":[]}]`))
+		default:
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	c := New(server.URL + "/")
+	ctx := context.Background()
+
+	health, err := c.GetHealth(ctx)
+	if err != nil || health.Status != "unhealthy" || health.Details["192.0.2.53:53"] != "unreachable" {
+		t.Fatalf("GetHealth() = %+v, %v", health, err)
+	}
+	if ready, err := c.GetReady(ctx); err != nil || ready {
+		t.Fatalf("GetReady() = %v, %v", ready, err)
+	}
+	incidents, err := c.ListIncidents(ctx, ListIncidentsParams{Limit: 5, Open: true})
+	if err != nil || len(incidents) != 1 || !incidents[0].Open() {
+		t.Fatalf("ListIncidents() = %+v, %v", incidents, err)
+	}
+
+	_, err = c.ListRecentEvents(ctx, ListRecentEventsParams{Limit: 3, Type: "resolve_failure"})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Body != "invalid limit" {
+		t.Fatalf("ListRecentEvents() error = %v", err)
+	}
+
+	want := []string{
+		"/?format=json",
+		"/readyz",
+		"/incidents?limit=5&open=true",
+		"/events/recent?limit=3&type=resolve_failure",
+	}
+	if len(queries) != len(want) {
+		t.Fatalf("requests = %q, want %q", queries, want)
+	}
+	for i := range want {
+		if queries[i] != want[i] {
+			t.Errorf("request %d = %q, want %q", i, queries[i], want[i])
+		}
+	}
+}
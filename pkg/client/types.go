@@ -0,0 +1,367 @@
+package client
+
+import (
+	"math"
+	"time"
+)
+
+// The types below are the schemas of the OpenAPI document, with the same
+// names and JSON fields.
+
+// HealthStatus is the health check's JSON form.
+type HealthStatus struct {
+	// Status is "healthy", "degraded" or "unhealthy".
+	Status    string    `json:"status"`
+	Timestamp time.Time `json:"timestamp"`
+	// Details maps each server to "ok" or "unreachable", followed by any
+	// issues, e.g. "ok: nxdomain_redirect".
+	Details map[string]string `json:"details,omitempty"`
+	// Servers holds every configured server's latest check result.
+	Servers map[string]ServerHealth `json:"servers,omitempty"`
+}
+
+// ServerHealth is one server's latest health check result.
+type ServerHealth struct {
+	Healthy bool `json:"healthy"`
+	// LastCheck is the zero time until the first check completes.
+	LastCheck           time.Time `json:"last_check"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	// LastLatency is a Go duration, e.g. "1.2ms".
+	LastLatency string `json:"last_latency,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+// StatsSnapshot is the resolver's statistics.
+type StatsSnapshot struct {
+	StartTime    time.Time               `json:"start_time"`
+	Uptime       string                  `json:"uptime"`
+	Cycles       CycleStats              `json:"cycles"`
+	Servers      map[string]ServerStats  `json:"servers"`
+	Nodes        map[string]NodeInfo     `json:"nodes,omitempty"`
+	Fingerprints map[string]Fingerprint  `json:"fingerprints,omitempty"`
+	DNS64        map[string]string       `json:"dns64,omitempty"`
+	Interception map[string]Interception `json:"interception,omitempty"`
+	MDNS         map[string]MDNSResult   `json:"mdns,omitempty"`
+	Subscribers  []SubscriberStats       `json:"event_subscribers"`
+	Cache        CacheStats              `json:"cache"`
+	Listeners    map[string]int          `json:"listeners,omitempty"`
+	Leader       *LeaderStatus           `json:"leader,omitempty"`
+	Reference    *ReferenceStats         `json:"reference,omitempty"`
+	Flapping     map[string]FlapStatus   `json:"flapping,omitempty"`
+	// LatencyAnomalies lists the servers whose queries for a hostname take
+	// a multiple of their baseline latency.
+	LatencyAnomalies []LatencyAnomaly `json:"latency_anomalies,omitempty"`
+	// Scores ranks the servers by composite health score, best first.
+	Scores []ServerScore `json:"scores,omitempty"`
+	// Randomization is the result of the startup randomization audit.
+	Randomization *RandomizationAudit `json:"randomization,omitempty"`
+}
+
+// CycleStats counts resolution cycles.
+type CycleStats struct {
+	Completed int `json:"completed"`
+	// Skipped counts scheduler ticks dropped because the previous cycle was
+	// still running.
+	Skipped int `json:"skipped"`
+	// AverageDuration is a Go duration, e.g. "1.2s".
+	AverageDuration string `json:"average_duration"`
+}
+
+// ServerStats counts one server's queries.
+type ServerStats struct {
+	Total     int    `json:"total"`
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// NodeInfo is the anycast node that last answered for a server.
+type NodeInfo struct {
+	Node     string
+	Source   string
+	Changes  int
+	LastSeen time.Time
+}
+
+// Fingerprint identifies a server's DNS implementation.
+type Fingerprint struct {
+	Implementation string    `json:"implementation"`
+	Version        string    `json:"version,omitempty"`
+	Signature      string    `json:"signature"`
+	Changes        int       `json:"changes"`
+	LastChecked    time.Time `json:"last_checked"`
+}
+
+// Interception is a server's latest interception probe result.
+type Interception struct {
+	NXDOMAINRedirect bool      `json:"nxdomain_redirect"`
+	RedirectAddrs    []string  `json:"redirect_addresses,omitempty"`
+	CaptivePortal    bool      `json:"captive_portal"`
+	PortalDetail     string    `json:"portal_detail,omitempty"`
+	LastChecked      time.Time `json:"last_checked"`
+}
+
+// MDNSResult is a hostname's latest multicast DNS answer.
+type MDNSResult struct {
+	Addresses []string  `json:"addresses,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Duration  string    `json:"duration"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// CacheStats describes the response cache. Counters cover the cache's
+// lifetime.
+type CacheStats struct {
+	Entries     int          `json:"entries"`
+	Bytes       int64        `json:"bytes"`
+	MaxEntries  int          `json:"max_entries"`
+	MaxBytes    int64        `json:"max_bytes"`
+	Hits        uint64       `json:"hits"`
+	Misses      uint64       `json:"misses"`
+	Evictions   uint64       `json:"evictions"`
+	Expirations uint64       `json:"expirations"`
+	HitRatio    float64      `json:"hit_ratio"`
+	Shards      []CacheShard `json:"shards"`
+}
+
+// CacheShard describes one cache shard.
+type CacheShard struct {
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	Contended uint64 `json:"contended"`
+}
+
+// LeaderStatus describes the instance's part in leader election. Only the
+// leader sends alerts and reports.
+type LeaderStatus struct {
+	Backend   string    `json:"backend"`
+	Identity  string    `json:"identity"`
+	Leader    bool      `json:"leader"`
+	Holder    string    `json:"holder,omitempty"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// ReferenceStats compares every server with the reference server.
+type ReferenceStats struct {
+	Server  string                         `json:"server"`
+	Servers map[string]ReferenceComparison `json:"servers"`
+}
+
+// ReferenceComparison summarizes how one server's answers compared with the
+// reference server's.
+type ReferenceComparison struct {
+	Compared          int64                `json:"compared"`
+	Divergent         int64                `json:"divergent"`
+	Failed            int64                `json:"failed"`
+	AvgLatencyDeltaMs float64              `json:"avg_latency_delta_ms"`
+	LastDivergence    *ReferenceDivergence `json:"last_divergence,omitempty"`
+}
+
+// ReferenceDivergence is one answer that differed from the reference's.
+type ReferenceDivergence struct {
+	Hostname string    `json:"hostname"`
+	Missing  []string  `json:"missing,omitempty"`
+	Extra    []string  `json:"extra,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// FlapStatus describes a hostname whose answers are flapping.
+type FlapStatus struct {
+	Since   time.Time `json:"since"`
+	Servers []string  `json:"servers"`
+	Detail  string    `json:"detail"`
+}
+
+// LatencyAnomaly describes a server whose queries for a hostname take far
+// longer than its baseline.
+type LatencyAnomaly struct {
+	Server     string    `json:"server"`
+	Hostname   string    `json:"hostname"`
+	Since      time.Time `json:"since"`
+	BaselineMs float64   `json:"baseline_ms"`
+	LatencyMs  float64   `json:"latency_ms"`
+}
+
+// ServerScore is a server's composite health score, from 0 to 100, and the
+// parts it is computed from.
+type ServerScore struct {
+	Server       string  `json:"server"`
+	Rank         int     `json:"rank"`
+	Score        float64 `json:"score"`
+	Availability float64 `json:"availability"`
+	LatencyP95Ms float64 `json:"latency_p95_ms"`
+	Agreement    float64 `json:"agreement"`
+	BreakerOpens int     `json:"breaker_opens"`
+	BreakerOpen  bool    `json:"breaker_open"`
+}
+
+// RandomizationAudit is the outcome of the startup self-test of transaction
+// ID and source port randomization.
+type RandomizationAudit struct {
+	CheckedAt       time.Time `json:"checked_at"`
+	IDSource        string    `json:"id_source"`
+	IDEntropyBits   float64   `json:"id_entropy_bits"`
+	SourcePorts     string    `json:"source_ports"`
+	PortEntropyBits float64   `json:"port_entropy_bits"`
+	PortsSampled    int       `json:"ports_sampled"`
+	PortsDistinct   int       `json:"ports_distinct"`
+	SocketReuse     bool      `json:"socket_reuse"`
+	Effective       bool      `json:"effective"`
+	Warnings        []string  `json:"warnings,omitempty"`
+}
+
+// HostnameRollup is the latest state of one hostname across servers.
+// Verdict is "consistent", "inconsistent", "degraded" (some servers failed,
+// the rest agree) or "failing" (no server answered).
+type HostnameRollup struct {
+	Hostname       string            `json:"hostname"`
+	CheckedAt      time.Time         `json:"checked_at"`
+	Verdict        string            `json:"verdict"`
+	Servers        []HostnameServer  `json:"servers"`
+	LastChange     *time.Time        `json:"last_change,omitempty"`
+	Flapping       *FlapStatus       `json:"flapping,omitempty"`
+	RecentFailures []HostnameFailure `json:"recent_failures"`
+}
+
+// HostnameServer is one server's latest result for a hostname.
+type HostnameServer struct {
+	Server    string     `json:"server"`
+	CheckedAt time.Time  `json:"checked_at"`
+	Addresses []string   `json:"addresses,omitempty"`
+	LatencyMs float64    `json:"latency_ms,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	ChangedAt *time.Time `json:"changed_at,omitempty"`
+}
+
+// HostnameFailure is one failed query for a hostname.
+type HostnameFailure struct {
+	Time   time.Time `json:"time"`
+	Server string    `json:"server"`
+	Error  string    `json:"error"`
+}
+
+// SubscriberStats reports delivery accounting for one event subscriber.
+type SubscriberStats struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Buffer  int    `json:"buffer"`
+	Durable bool   `json:"durable"`
+	Queued  int    `json:"queued"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// EventType identifies the kind of resolver event, e.g. "resolve_failure".
+type EventType string
+
+// EventSchemaVersion is the event schema_version this package decodes.
+const EventSchemaVersion = 1
+
+// ResolverEvent is one resolver event. Success, Failure and Cycle are set
+// only for resolve_success, resolve_failure and cycle events; the flat
+// optional fields are used by the other event types.
+type ResolverEvent struct {
+	SchemaVersion int       `json:"schema_version"`
+	Type          EventType `json:"type"`
+	Time          time.Time `json:"time"`
+	Hostname      string    `json:"hostname,omitempty"`
+	// HostnameDisplay is Hostname with punycode labels shown in Unicode,
+	// set only when the two differ.
+	HostnameDisplay string            `json:"hostname_display,omitempty"`
+	Server          string            `json:"server,omitempty"`
+	DurationMS      float64           `json:"duration_ms,omitempty"`
+	Success         *SuccessDetails   `json:"success,omitempty"`
+	Failure         *FailureDetails   `json:"failure,omitempty"`
+	Cycle           *CycleDetails     `json:"cycle,omitempty"`
+	Error           string            `json:"error,omitempty"`
+	Source          string            `json:"source,omitempty"`
+	Consistent      *bool             `json:"consistent,omitempty"`
+	Node            string            `json:"node,omitempty"`
+	PreviousNode    string            `json:"previous_node,omitempty"`
+	Detail          string            `json:"detail,omitempty"`
+	Dropped         int               `json:"dropped,omitempty"`
+	Severity        string            `json:"severity,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+// Duration returns the event's duration_ms as a time.Duration.
+func (e ResolverEvent) Duration() time.Duration {
+	return time.Duration(math.Round(e.DurationMS * float64(time.Millisecond)))
+}
+
+// SuccessDetails are the fields of a resolve_success event.
+type SuccessDetails struct {
+	Addresses []string           `json:"addresses"`
+	Geo       map[string]GeoInfo `json:"geo,omitempty"`
+	Source    string             `json:"source,omitempty"`
+}
+
+// FailureDetails are the fields of a resolve_failure event.
+type FailureDetails struct {
+	Error  string `json:"error"`
+	Source string `json:"source,omitempty"`
+}
+
+// CycleDetails are the fields of cycle_start, cycle_complete and
+// cycle_timeout events.
+type CycleDetails struct {
+	HostnameCount int    `json:"hostname_count"`
+	ServerCount   int    `json:"server_count"`
+	QueryMode     string `json:"query_mode,omitempty"`
+	Detail        string `json:"detail,omitempty"`
+}
+
+// GeoInfo locates an answer address.
+type GeoInfo struct {
+	Country      string `json:"country,omitempty"`
+	ASN          uint32 `json:"asn,omitempty"`
+	Organization string `json:"organization,omitempty"`
+}
+
+// AuditEntry records one runtime control action.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	Target   string    `json:"target,omitempty"`
+	OldValue string    `json:"old_value,omitempty"`
+	NewValue string    `json:"new_value,omitempty"`
+}
+
+// TargetGroup is one entry of a Prometheus HTTP service discovery response.
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// Incident is a period during which a hostname had failing servers or
+// inconsistent answers.
+type Incident struct {
+	ID       int        `json:"id"`
+	Hostname string     `json:"hostname"`
+	Started  time.Time  `json:"started"`
+	Ended    *time.Time `json:"ended,omitempty"`
+	// Causes are "failure" and/or "inconsistent".
+	Causes        []string        `json:"causes"`
+	Servers       []string        `json:"servers"`
+	Events        []ResolverEvent `json:"events"`
+	DroppedEvents int             `json:"dropped_events,omitempty"`
+}
+
+// Open reports whether the incident is still ongoing.
+func (i Incident) Open() bool {
+	return i.Ended == nil
+}
+
+// MalformedSample is a response that could not be parsed or did not answer
+// its query.
+type MalformedSample struct {
+	Time     time.Time `json:"time"`
+	Server   string    `json:"server"`
+	Hostname string    `json:"hostname"`
+	// Class is bad_compression, truncated, bad_rdata, long_name,
+	// id_mismatch, question_mismatch, unexpected_qdcount or malformed.
+	Class string `json:"class"`
+	Error string `json:"error"`
+	// Response is what could be decoded of the response, in dig's format.
+	Response string `json:"response,omitempty"`
+}